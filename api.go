@@ -23,18 +23,26 @@ import (
 const APIUnixSocket = "/tmp/forwarder.sock"
 
 // APIHandler serves API endpoints.
-// It provides health and readiness endpoints prometheus metrics, and pprof debug endpoints.
+// It provides health and readiness endpoints prometheus metrics, pprof debug endpoints, and an OpenAPI document describing them.
 type APIHandler struct {
 	mux   *http.ServeMux
 	ready func(ctx context.Context) bool
 
 	title    string
 	patterns []string
+	openAPI  []byte
 }
 
 type APIEndpoint struct {
 	Path    string
 	Handler http.Handler
+
+	// Method is the only HTTP method accepted by the endpoint, requests with other methods get 405 Method Not Allowed.
+	// If empty, the endpoint accepts any method and is documented as a GET endpoint.
+	Method string
+
+	// Description is used in the OpenAPI document.
+	Description string
 }
 
 func NewAPIHandler(title string, r prometheus.Gatherer, ready func(ctx context.Context) bool, extraEndpoints ...APIEndpoint) *APIHandler {
@@ -45,35 +53,62 @@ func NewAPIHandler(title string, r prometheus.Gatherer, ready func(ctx context.C
 		title: title,
 	}
 
-	var indexPatterns []string
-	handleFunc := func(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	var (
+		indexPatterns []string
+		descriptions  = make(map[string]string)
+		methods       = make(map[string]string)
+	)
+	handleFunc := func(pattern, description string, handler func(http.ResponseWriter, *http.Request)) {
 		indexPatterns = append(indexPatterns, pattern)
+		descriptions[pattern] = description
 		m.HandleFunc(pattern, handler)
 	}
 
-	handleFunc("/metrics", promhttp.HandlerFor(r, promhttp.HandlerOpts{
+	handleFunc("/metrics", "Prometheus metrics in OpenMetrics format", promhttp.HandlerFor(r, promhttp.HandlerOpts{
 		DisableCompression: true,
 		EnableOpenMetrics:  true,
 	}).ServeHTTP)
-	handleFunc("/healthz", a.healthz)
-	handleFunc("/readyz", a.readyz)
+	handleFunc("/healthz", "Liveness probe", a.healthz)
+	handleFunc("/readyz", "Readiness probe", a.readyz)
+	handleFunc("/openapi.json", "OpenAPI 3 document describing the API", a.openapi)
 
 	for _, e := range extraEndpoints {
-		handleFunc(e.Path, e.Handler.ServeHTTP)
+		if e.Method != "" {
+			indexPatterns = append(indexPatterns, e.Path)
+			descriptions[e.Path] = e.Description
+			methods[e.Path] = e.Method
+			m.Handle(e.Method+" "+e.Path, e.Handler)
+			m.HandleFunc(e.Path, methodNotAllowed(e.Method))
+			continue
+		}
+		handleFunc(e.Path, e.Description, e.Handler.ServeHTTP)
 	}
 
-	handleFunc("/debug/pprof/", pprof.Index)
+	handleFunc("/debug/pprof/", "Go pprof profiles index", pprof.Index)
 	m.HandleFunc("/debug/pprof/profile", pprof.Profile)
 	m.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	m.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	descriptions["/debug/pprof/profile"] = "Go pprof CPU profile"
+	descriptions["/debug/pprof/symbol"] = "Go pprof symbol lookup"
+	descriptions["/debug/pprof/trace"] = "Go execution trace"
 
 	sort.Strings(indexPatterns)
 	a.patterns = indexPatterns
+	a.openAPI = openAPIDocument(title, descriptions, methods)
 	m.HandleFunc("/", a.index)
 
 	return a
 }
 
+func methodNotAllowed(allow string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Allow", allow)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("method not allowed"))
+	}
+}
+
 func (h *APIHandler) healthz(w http.ResponseWriter, _ *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "text/plain")
@@ -92,6 +127,12 @@ func (h *APIHandler) readyz(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (h *APIHandler) openapi(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(h.openAPI)
+}
+
 const indexTemplate = `<!DOCTYPE html>
 <html>
 <head>
@@ -132,6 +173,23 @@ func (h *APIHandler) index(w http.ResponseWriter, _ *http.Request) {
 	buf.WriteTo(w) //nolint:errcheck // ignore error
 }
 
+// ReadOnlyAPIHandler rejects requests to h with methods other than GET, HEAD and OPTIONS.
+// Endpoints that mutate the state of the server must not use these methods,
+// so that the API can be made strictly observational regardless of authentication.
+func ReadOnlyAPIHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			h.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte("API is read-only"))
+		}
+	})
+}
+
 func (h *APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.mux.ServeHTTP(w, r)
 }
@@ -0,0 +1,74 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// The types below are a minimal subset of the OpenAPI 3 specification
+// required to describe the API endpoints.
+// See https://spec.openapis.org/oas/v3.0.3
+
+type openAPI struct {
+	OpenAPI string                     `json:"openapi"`
+	Info    openAPIInfo                `json:"info"`
+	Paths   map[string]openAPIPathItem `json:"paths"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIPathItem struct {
+	Get  *openAPIOperation `json:"get,omitempty"`
+	Post *openAPIOperation `json:"post,omitempty"`
+}
+
+type openAPIOperation struct {
+	Summary   string                     `json:"summary,omitempty"`
+	Responses map[string]openAPIResponse `json:"responses"`
+}
+
+type openAPIResponse struct {
+	Description string `json:"description"`
+}
+
+// openAPIDocument returns the OpenAPI document for endpoints with the given descriptions.
+// Endpoints are documented as GET endpoints unless methods specifies otherwise.
+func openAPIDocument(title string, descriptions, methods map[string]string) []byte {
+	doc := openAPI{
+		OpenAPI: "3.0.3",
+		Info: openAPIInfo{
+			Title:   title,
+			Version: "1",
+		},
+		Paths: make(map[string]openAPIPathItem, len(descriptions)),
+	}
+	for path, desc := range descriptions {
+		op := &openAPIOperation{
+			Summary: desc,
+			Responses: map[string]openAPIResponse{
+				"200": {Description: "OK"},
+			},
+		}
+		switch methods[path] {
+		case http.MethodPost:
+			doc.Paths[path] = openAPIPathItem{Post: op}
+		default:
+			doc.Paths[path] = openAPIPathItem{Get: op}
+		}
+	}
+
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
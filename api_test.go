@@ -0,0 +1,103 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestReadOnlyAPIHandler(t *testing.T) {
+	h := ReadOnlyAPIHandler(NewAPIHandler("test", prometheus.NewRegistry(), nil))
+
+	tests := []struct {
+		method string
+		status int
+	}{
+		{method: http.MethodGet, status: http.StatusOK},
+		{method: http.MethodHead, status: http.StatusOK},
+		{method: http.MethodPost, status: http.StatusMethodNotAllowed},
+		{method: http.MethodPut, status: http.StatusMethodNotAllowed},
+		{method: http.MethodDelete, status: http.StatusMethodNotAllowed},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.method, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, httptest.NewRequest(tc.method, "/healthz", http.NoBody))
+			if rw.Code != tc.status {
+				t.Fatalf("expected %d, got %d", tc.status, rw.Code)
+			}
+		})
+	}
+}
+
+func TestAPIHandlerOpenAPI(t *testing.T) {
+	h := NewAPIHandler("test", prometheus.NewRegistry(), nil, APIEndpoint{
+		Path:        "/version",
+		Handler:     http.NotFoundHandler(),
+		Description: "Version information",
+	})
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/openapi.json", http.NoBody))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, rw.Code)
+	}
+
+	var doc openAPI
+	if err := json.Unmarshal(rw.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/metrics", "/healthz", "/readyz", "/openapi.json", "/version", "/debug/pprof/profile"} {
+		if _, ok := doc.Paths[p]; !ok {
+			t.Errorf("missing path %s", p)
+		}
+	}
+	if got := doc.Paths["/version"].Get.Summary; got != "Version information" {
+		t.Errorf("expected summary %q, got %q", "Version information", got)
+	}
+}
+
+func TestAPIHandlerMethodEndpoint(t *testing.T) {
+	var called int
+	h := NewAPIHandler("test", prometheus.NewRegistry(), nil, APIEndpoint{
+		Path: "/action",
+		Handler: http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			called++
+		}),
+		Method:      http.MethodPost,
+		Description: "Action",
+	})
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/action", http.NoBody))
+	if rw.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected %d, got %d", http.StatusMethodNotAllowed, rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/action", http.NoBody))
+	if rw.Code != http.StatusOK || called != 1 {
+		t.Fatalf("expected %d and one call, got %d and %d calls", http.StatusOK, rw.Code, called)
+	}
+
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/openapi.json", http.NoBody))
+	var doc openAPI
+	if err := json.Unmarshal(rw.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if op := doc.Paths["/action"]; op.Post == nil || op.Get != nil {
+		t.Errorf("expected POST operation, got %+v", op)
+	}
+}
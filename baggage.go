@@ -0,0 +1,95 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// BaggageHeader is the W3C baggage header used by OpenTelemetry to propagate key-value pairs.
+// See https://www.w3.org/TR/baggage/
+const BaggageHeader = "Baggage"
+
+// BaggageMember is a key-value pair added to the baggage header of outgoing requests.
+type BaggageMember struct {
+	Key   string
+	Value string
+}
+
+// ParseBaggageMember parses <key>=<value> string into BaggageMember.
+// Environment variables in the value are expanded, e.g. pod=${HOSTNAME}.
+func ParseBaggageMember(val string) (BaggageMember, error) {
+	k, v, ok := strings.Cut(val, "=")
+	if !ok {
+		return BaggageMember{}, errors.New("expected <key>=<value>")
+	}
+	k = strings.TrimSpace(k)
+	if !httpguts.ValidHeaderFieldName(k) {
+		return BaggageMember{}, fmt.Errorf("invalid key %q", k)
+	}
+
+	return BaggageMember{Key: k, Value: os.ExpandEnv(strings.TrimSpace(v))}, nil
+}
+
+func (m BaggageMember) String() string {
+	return m.Key + "=" + baggageEscape(m.Value)
+}
+
+// baggageEscape percent-encodes characters that are not allowed in baggage values.
+func baggageEscape(s string) string {
+	var sb strings.Builder
+	for i := range len(s) {
+		c := s[i]
+		if c > 0x20 && c < 0x7f && c != '"' && c != ',' && c != ';' && c != '\\' && c != '%' {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// injectBaggage adds the configured members to the baggage header of non-CONNECT requests.
+// Members already sent by the client take precedence.
+func (hp *HTTPProxy) injectBaggage() RequestModifier {
+	return RequestModifierFunc(func(req *http.Request) error {
+		if req.Method == http.MethodConnect {
+			return nil
+		}
+
+		present := make(map[string]struct{})
+		for _, v := range req.Header.Values(BaggageHeader) {
+			for _, m := range strings.Split(v, ",") {
+				k, _, _ := strings.Cut(m, "=")
+				present[strings.TrimSpace(k)] = struct{}{}
+			}
+		}
+
+		var add []string
+		for _, m := range hp.config.Baggage {
+			if _, ok := present[m.Key]; !ok {
+				add = append(add, m.String())
+			}
+		}
+		if len(add) == 0 {
+			return nil
+		}
+
+		if v := req.Header.Values(BaggageHeader); len(v) > 0 {
+			add = append(v, add...)
+		}
+		req.Header.Set(BaggageHeader, strings.Join(add, ","))
+
+		return nil
+	})
+}
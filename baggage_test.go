@@ -0,0 +1,91 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestParseBaggageMember(t *testing.T) {
+	t.Setenv("TEST_POD", "pod-1")
+
+	m, err := ParseBaggageMember("pod=${TEST_POD}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.String() != "pod=pod-1" {
+		t.Fatalf("expected pod=pod-1, got %s", m)
+	}
+
+	m, err = ParseBaggageMember("session=a b,c;d%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "session=a%20b%2Cc%3Bd%25"; m.String() != want {
+		t.Fatalf("expected %s, got %s", want, m)
+	}
+
+	for _, v := range []string{"pod", "bad key=1", "=1"} {
+		if _, err := ParseBaggageMember(v); err == nil {
+			t.Errorf("ParseBaggageMember(%q): expected error", v)
+		}
+	}
+}
+
+func TestInjectBaggage(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Got-Baggage", req.Header.Get(BaggageHeader))
+	}))
+	defer origin.Close()
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.ProxyLocalhost = AllowProxyLocalhost
+	cfg.Baggage = []BaggageMember{
+		{Key: "region", Value: "eu"},
+		{Key: "session", Value: "proxy"},
+	}
+
+	tr, err := NewClientTransport(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	tests := []struct {
+		name    string
+		baggage string
+		want    string
+	}{
+		{name: "no client baggage", want: "region=eu,session=proxy"},
+		{name: "client baggage", baggage: "user=x", want: "user=x,region=eu,session=proxy"},
+		{name: "client precedence", baggage: "session=client", want: "session=client,region=eu"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, origin.URL, http.NoBody)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.baggage != "" {
+				req.Header.Set(BaggageHeader, tc.baggage)
+			}
+			res, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if got := res.Header.Get("Got-Baggage"); got != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
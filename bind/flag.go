@@ -12,14 +12,19 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"text/template"
+	"time"
 
 	"github.com/mmatczuk/anyflag"
 	"github.com/saucelabs/forwarder"
 	"github.com/saucelabs/forwarder/fileurl"
 	"github.com/saucelabs/forwarder/header"
 	"github.com/saucelabs/forwarder/httplog"
+	"github.com/saucelabs/forwarder/kvconfig"
 	"github.com/saucelabs/forwarder/log"
 	"github.com/saucelabs/forwarder/ruleset"
+	"github.com/saucelabs/forwarder/utils/certutil"
+	"github.com/saucelabs/forwarder/webhook"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"golang.org/x/exp/slices"
@@ -52,6 +57,42 @@ func DNSConfig(fs *pflag.FlagSet, cfg *forwarder.DNSConfig) {
 			"passing this flag will enable round-robin selection. ")
 }
 
+func DNSHosts(fs *pflag.FlagSet, hosts *[]forwarder.HostOverride, file *string) {
+	fs.Var(anyflag.NewSliceValue[forwarder.HostOverride](*hosts, hosts, forwarder.ParseHostOverride),
+		"dns-hosts", "<host>=<ip>,..."+
+			"Dial the IP address instead of resolving the host name, "+
+			"for example to point test domains at staging servers without changing /etc/hosts. "+
+			"It does not change the host name used for TLS (SNI, certificate verification) or in requests. "+
+			"It takes precedence over --dns-hosts-file. ")
+
+	fs.StringVar(file, "dns-hosts-file", *file, "<path>"+
+		"Path to a file in the /etc/hosts format with host names to dial without DNS resolution, see --dns-hosts. "+
+		"If a host name is listed more than once, the first address is used. ")
+}
+
+func DNSProxy(fs *pflag.FlagSet, cfg *forwarder.DNSProxyConfig, doh *forwarder.HTTPServerConfig) {
+	fs.StringVar(&cfg.Address, "dns-proxy-address", cfg.Address, "<host:port>"+
+		"Address to accept DNS queries over UDP and TCP. "+
+		"Queries are forwarded to the servers specified with --dns-server, or to the system DNS servers if not specified. "+
+		"Queries for domains matching --deny-domains are answered with NXDOMAIN, "+
+		"queries for domains matching --direct-domains are forwarded to the system DNS servers. "+
+		"If empty, the DNS proxy is disabled. ")
+
+	fs.DurationVar(&cfg.Timeout, "dns-proxy-timeout", cfg.Timeout, "<duration>"+
+		"Timeout for a query to a DNS server, on timeout the next server is tried. ")
+
+	fs.IntVar(&cfg.MaxConcurrentUDPQueries, "dns-proxy-max-concurrent-udp-queries", cfg.MaxConcurrentUDPQueries, "<int>"+
+		"Maximum number of UDP queries handled concurrently, queries above the limit are dropped and retried by the clients. ")
+
+	HTTPServerConfig(fs, doh, "dns-proxy-doh", forwarder.HTTPSScheme, forwarder.HTTPScheme)
+
+	f := fs.Lookup("dns-proxy-doh-address")
+	f.Usage = "<host:port>" +
+		"Address to accept DNS over HTTPS queries on the " + forwarder.DNSProxyPath + " path. " +
+		"The queries are handled as the queries on --dns-proxy-address. " +
+		"If empty, DNS over HTTPS is disabled. "
+}
+
 func PAC(fs *pflag.FlagSet, pac **url.URL) {
 	fs.VarP(anyflag.NewValue[*url.URL](*pac, pac, fileurl.ParseFilePathOrURL),
 		"pac", "p", "`<path or URL>`"+
@@ -66,6 +107,50 @@ func PAC(fs *pflag.FlagSet, pac **url.URL) {
 			"</ul>")
 }
 
+func PACDisableDNS(fs *pflag.FlagSet, disable *bool) {
+	fs.BoolVar(disable, "pac-disable-dns", *disable, ""+
+		"Prevent the PAC script from resolving host names with dnsResolve, dnsResolveEx, and functions that use them such as isInNet and isResolvable. "+
+		"Host names are treated as not resolvable, so that no DNS queries for destination hosts are sent from the proxy host. ")
+}
+
+func PACRefreshInterval(fs *pflag.FlagSet, interval *time.Duration) {
+	fs.DurationVar(interval, "pac-refresh-interval", *interval, "<duration>"+
+		"Re-read the PAC file at the given interval and apply changes without restart. "+
+		"If the file cannot be read or is invalid, the previous script is kept. "+
+		"Zero means that the file is read only at startup. ")
+}
+
+func PACRetryInterval(fs *pflag.FlagSet, interval *time.Duration) {
+	fs.DurationVar(interval, "pac-retry-interval", *interval, "<duration>"+
+		"If connecting to a proxy returned by the PAC script fails, the next entry of the result is tried, including DIRECT, as browsers do. "+
+		"The failed proxy is skipped for the given interval, unless all proxies in the result failed. "+
+		"Requests with a body that cannot be replayed are not retried. "+
+		"Zero disables the fallback, only the first entry of the result is used. ")
+}
+
+func ClusterRedis(fs *pflag.FlagSet, u **url.URL) {
+	fs.Var(anyflag.NewValueWithRedact[*url.URL](*u, u, url.Parse, RedactURL),
+		"cluster-redis", "<redis[s]://[[user]:password@]host[:port][/db]>"+
+			"Elect a leader among proxy instances sharing the Redis server. "+
+			"Only the leader downloads the PAC file from a remote URL and shares it with the other instances via Redis, "+
+			"other instances download the file on their own only if it is not shared yet, e.g. at startup. "+
+			"The MITM session ticket keys are shared between instances, see --mitm-session-tickets. "+
+			"It can be the same server as --rate-limit-redis. ")
+}
+
+func SystemProxy(fs *pflag.FlagSet, enable *bool, cfg *forwarder.SystemProxyConfig) {
+	fs.BoolVar(enable, "proxy-auto-detect", *enable, ""+
+		"Use the upstream proxy configured in the environment or the operating system. "+
+		"The HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are used if set, "+
+		"otherwise the system proxy settings are used on Windows and macOS. "+
+		"The settings are re-read periodically, see --proxy-auto-detect-interval. "+
+		"It cannot be used with the --proxy or --pac flags. ")
+
+	fs.DurationVar(&cfg.RefreshInterval, "proxy-auto-detect-interval", cfg.RefreshInterval, "<duration>"+
+		"Interval at which the proxy settings are re-read when --proxy-auto-detect is enabled. "+
+		"Zero means that the settings are read only at startup. ")
+}
+
 func ProxyHeaders(fs *pflag.FlagSet, headers *[]header.Header) {
 	fs.Var(anyflag.NewSliceValueWithRedact[header.Header](*headers, headers, header.ParseHeader, RedactHeader),
 		"proxy-header", "<header>")
@@ -78,6 +163,41 @@ func ConnectHeaders(fs *pflag.FlagSet, headers *[]header.Header) {
 			"See the documentation for the -H, --header flag for more details on the format. ")
 }
 
+func ConnectHeaderPolicy(fs *pflag.FlagSet, forward *[]string, templates *[]forwarder.ConnectHeaderTemplate) {
+	fs.StringSliceVar(forward, "connect-header-forward", *forward, "<header>,..."+
+		"Copy the specified headers from the client CONNECT request to CONNECT requests sent to the upstream HTTP proxy "+
+		"when the proxy opens a tunnel on its own, e.g. for MITMed connections. "+
+		"Tunneled CONNECT requests are forwarded with all headers. ")
+
+	fs.Var(anyflag.NewSliceValue[forwarder.ConnectHeaderTemplate](*templates, templates, forwarder.ParseConnectHeaderTemplate),
+		"connect-header-template", "[<upstream regexp>=]<name>: <template>"+
+			"Add a header with a computed value to CONNECT requests sent to the upstream HTTP proxy. "+
+			"If the upstream regexp is specified, the header is added only for upstream proxies with matching host:port. "+
+			"The value is a Go text/template, the available fields are: "+
+			"<code>.Header</code> the client CONNECT request header e.g. <code>{{.Header.Get \"X-Session-Id\"}}</code>, "+
+			"<code>.ID</code> the request ID, <code>.Target</code> the CONNECT target host:port, and <code>.Upstream</code> the upstream proxy host:port. "+
+			"If the value is empty, the header is not added. "+
+			"The flag can be specified multiple times. ")
+}
+
+func ConnectResponseHeaders(fs *pflag.FlagSet, headers *[]string) {
+	fs.StringSliceVar(headers, "connect-response-header", *headers, "<header>,..."+
+		"Copy the specified headers from successful CONNECT responses of the upstream HTTP proxy to the CONNECT response sent to the client, "+
+		"e.g. rate limit information or the assigned egress IP. "+
+		"The headers are logged and counted in the proxy_upstream_connect_response_headers_total metric. "+
+		"Unsuccessful CONNECT responses are sent to the client with all headers. ")
+}
+
+func Baggage(fs *pflag.FlagSet, members *[]forwarder.BaggageMember) {
+	fs.Var(anyflag.NewSliceValue[forwarder.BaggageMember](*members, members, forwarder.ParseBaggageMember),
+		"baggage", "<key>=<value>,..."+
+			"Add OpenTelemetry baggage to the W3C baggage header of outgoing requests, "+
+			"e.g. to propagate the pod name, region or test session to upstream services. "+
+			"Environment variables in the value are expanded e.g. pod=${HOSTNAME}. "+
+			"Members sent by the client take precedence. "+
+			"CONNECT requests are not modified. ")
+}
+
 func RequestHeaders(fs *pflag.FlagSet, headers *[]header.Header) {
 	fs.VarP(anyflag.NewSliceValueWithRedact[header.Header](*headers, headers, header.ParseHeader, RedactHeader),
 		"header", "H", "<header>"+
@@ -105,18 +225,50 @@ func ResponseHeaders(fs *pflag.FlagSet, headers *[]header.Header) {
 }
 
 func HTTPProxyConfig(fs *pflag.FlagSet, cfg *forwarder.HTTPProxyConfig, lcfg *log.Config) {
-	HTTPServerConfig(fs, &cfg.HTTPServerConfig, "", forwarder.HTTPScheme, forwarder.HTTPSScheme)
+	HTTPServerConfig(fs, &cfg.HTTPServerConfig, "", forwarder.HTTPScheme, forwarder.HTTPSScheme, forwarder.SOCKS5Scheme)
+
+	f := fs.Lookup("protocol")
+	f.Usage += "The https protocol also accepts HTTP/2 clients, CONNECT requests are tunneled over HTTP/2 streams, " +
+		"HTTP/2 is not offered if MITM is enabled. " +
+		"The socks5 protocol accepts SOCKS5 CONNECT requests, " +
+		"if basic auth is enabled clients must use username/password authentication with the same credentials. "
+
+	TLSClientAuth(fs, &cfg.TLSServerConfig, "")
 	LogConfig(fs, lcfg)
 
 	fs.VarP(anyflag.NewValueWithRedact[*url.URL](cfg.UpstreamProxy, &cfg.UpstreamProxy, forwarder.ParseProxyURL, RedactURL),
 		"proxy", "x", "<[protocol://]host:port>"+
 			"Upstream proxy to use. "+
-			"The supported protocols are: http, https, socks5. "+
+			"The supported protocols are: http, https, socks5, socks5h. "+
 			"No protocol specified will be treated as HTTP proxy. "+
+			"Destination host names are never resolved locally when an upstream proxy is used, "+
+			"for SOCKS5 proxies they are sent unresolved, so socks5 and socks5h are equivalent. "+
 			"The basic authentication username and password can be specified in the host string e.g. user:pass@host:port. "+
 			"Alternatively, you can use the -c, --credentials flag to specify the credentials. "+
 			"If both are specified, the proxy flag takes precedence. ")
 
+	fs.BoolVar(&cfg.UpstreamProxyHTTP2, "proxy-h2", cfg.UpstreamProxyHTTP2, ""+
+		"Use HTTP/2 for CONNECT requests to HTTPS upstream proxies that advertise h2 in TLS ALPN. "+
+		"All tunnels to a proxy are multiplexed over a single connection, which reduces the number of connections to busy gateways. "+
+		"Proxies that do not support HTTP/2 are used with HTTP/1.1. "+
+		"Plain HTTP requests are always sent over HTTP/1.1. ")
+
+	fs.Var(anyflag.NewSliceValue[forwarder.SubnetUpstream](cfg.UpstreamProxyBySubnet, &cfg.UpstreamProxyBySubnet, forwarder.ParseSubnetUpstream),
+		"proxy-by-client-subnet", "<cidr>=<[protocol://]host:port|direct>,..."+
+			"Upstream proxy to use for clients connecting from the specified subnet, or direct to connect directly. "+
+			"The first subnet containing the client address is used, "+
+			"requests from other clients are routed using the --proxy flag or PAC script. "+
+			"The direct domains and localhost rules take precedence over this flag. "+
+			"The credentials for upstream proxies can be specified in the same way as for the --proxy flag. ")
+
+	fs.StringVar(&cfg.UpstreamProxyHeader, "proxy-select-header", cfg.UpstreamProxyHeader, "<name>"+
+		"If set and the header is present in the request, the upstream proxy from the header value is used for the request instead of the configured one. "+
+		"The header value is an upstream proxy in the same format as for the --proxy flag, or direct to connect directly. "+
+		"For CONNECT requests the upstream proxy is used for the tunnel and for the MITMed requests. "+
+		"Requests with an invalid header value are rejected. "+
+		"Enable it only if the clients are trusted, if basic authentication is enabled, only authenticated clients can use it. "+
+		"The header is not sent upstream. ")
+
 	proxyLocalhostValues := []forwarder.ProxyLocalhostMode{
 		forwarder.DenyProxyLocalhost,
 		forwarder.AllowProxyLocalhost,
@@ -132,12 +284,90 @@ func HTTPProxyConfig(fs *pflag.FlagSet, cfg *forwarder.HTTPProxyConfig, lcfg *lo
 		"Name of this proxy instance. This value is used in the Via header in requests. "+
 		"The name value in Via header is extended with a random string to avoid collisions when several proxies are chained. ")
 
+	fs.BoolVar(&cfg.StripTrailers, "strip-trailers", cfg.StripTrailers, ""+
+		"Remove trailers from requests sent upstream and from responses sent to clients. "+
+		"By default, request and response trailers are relayed, including the TE: trailers request header used by gRPC. "+
+		"Enable it for origins that fail on requests with trailers. ")
+
+	fs.BoolVar(&cfg.ChunkedPassThrough, "chunked-passthrough", cfg.ChunkedPassThrough, ""+
+		"Relay chunked responses to plain HTTP requests with the origin's exact framing, "+
+		"preserving chunk sizes, chunk extensions and trailers instead of re-chunking the body. "+
+		"It applies to requests sent directly to the origin, these requests use a dedicated connection that is not reused. "+
+		"Responses whose body is read by the proxy, e.g. with --capture-dir or --rewrite-content-types, are re-chunked. "+
+		"It cannot be used with request collapsing. ")
+
+	fs.BoolVar(&cfg.HeaderFidelity, "header-fidelity", cfg.HeaderFidelity, ""+
+		"Preserve the case, order and whitespace of header fields that are not modified by the proxy, "+
+		"for clients and origins sensitive to the exact header bytes. "+
+		"Headers of requests sent directly to the origin over plain HTTP, and of their responses, are preserved, "+
+		"these requests use a dedicated connection that is not reused. "+
+		"Requests sent through upstream proxies or over TLS, and their responses, are written as usual. "+
+		"It cannot be used with request collapsing. ")
+
+	fs.BoolVar(&cfg.RejectPipelining, "reject-pipelining", cfg.RejectPipelining, ""+
+		"Reject pipelined HTTP/1.1 requests, i.e. requests received before the response to the previous request on the connection was sent, "+
+		"with 400 Bad Request and close the connection. "+
+		"By default, pipelined requests are handled one at a time and the responses are sent in request order. "+
+		"Pipelined requests are counted in the proxy_pipelined_requests_total metric. ")
+
+	fs.BoolVar(&cfg.DenyPlaintextCredentials, "deny-plaintext-credentials", cfg.DenyPlaintextCredentials, ""+
+		"Reject requests with the Authorization header that would be sent upstream over plain HTTP, "+
+		"including credentials set with the --credentials flag. "+
+		"Clients receive a 403 response explaining that credentials must be sent over HTTPS. "+
+		"Requests received over TLS and forwarded over plain HTTP, and vice versa, are counted in the proxy_scheme_changes_total metric. ")
+
+	fs.BoolVar(&cfg.Stealth, "stealth", cfg.Stealth, ""+
+		"Remove headers that identify traffic as proxied from requests sent upstream and from responses sent to clients: "+
+		"Via, Forwarded, X-Forwarded-* and the request ID header, see --log-http-request-id-header. "+
+		"Headers added with the --header and --response-header flags are still sent. "+
+		"Request loops through chained proxies cannot be detected when requests are sent without the Via header. ")
+
+	fs.BoolVar(&cfg.ServerTiming, "server-timing", cfg.ServerTiming, ""+
+		"Add a Server-Timing header to responses with the time spent by the proxy in each phase of the request: "+
+		"queue, dns, connect, tls, upstream (time to first response byte) and total. "+
+		"Browser developer tools show it in the request timing view. "+
+		"If the request is sent through an upstream proxy, dns and connect refer to the upstream proxy. ")
+
+	fs.IntVar(&cfg.MaxConcurrentRequests, "max-concurrent-requests", cfg.MaxConcurrentRequests, "<int>"+
+		"Maximum number of proxy requests handled concurrently, including open CONNECT tunnels. "+
+		"Requests above the limit are shed before any other processing with 503 Service Unavailable and Retry-After: 1, "+
+		"so that an overloaded proxy keeps capacity for the API server. "+
+		"The API server has its own listener and is never shed, so that health probes keep working under overload. "+
+		"If zero, there is no limit. ")
+
+	fs.DurationVar(&cfg.SlowRequestThreshold, "slow-request-threshold", cfg.SlowRequestThreshold, "<duration>"+
+		"Log requests that are in-flight longer than the threshold, with the request metadata and "+
+		"the stack trace of the goroutine handling the request, to help locate hangs in the proxy or upstream. "+
+		"A request is in-flight until the response is written to the client, for CONNECT requests until the tunnel is established. "+
+		"Each slow request is logged once, and again when it completes. "+
+		"If zero, slow requests are not logged. ")
+
+	fs.StringVar(&cfg.RuleTraceHeader, "rule-trace-header", cfg.RuleTraceHeader, "<name>"+
+		"If set and the header is present in the request, "+
+		"the proxy adds "+forwarder.RuleTraceResponseHeader+" headers to the response describing the routing decisions made for the request. "+
+		"This includes matched deny, direct and MITM rules, the PAC result, the upstream proxy used and the matched credentials. "+
+		"If basic authentication is enabled, only authenticated clients can use it. "+
+		"The header is not sent upstream. ")
+
 	fs.StringVar(&cfg.RequestIDHeader, "log-http-request-id-header", cfg.RequestIDHeader,
 		"<name>"+
 			"If the header is present in the request, "+
 			"the proxy will associate the value with the request in the logs. ")
 }
 
+func DecisionLog(fs *pflag.FlagSet, file **os.File, cfg *forwarder.DecisionLogConfig) {
+	fs.VarP(struct{ pflag.Value }{anyflag.NewValueWithRedact[*os.File](*file, file,
+		forwarder.OpenFileParser(log.DefaultFileFlags, log.DefaultFileMode, log.DefaultDirMode), DisplayFileName)},
+		"decision-log-file", "", "<path>"+
+			"Path to the decision log file, if empty, the decision log is disabled. "+
+			"The decision log records the routing decisions made for requests as newline delimited JSON. "+
+			"Each entry contains matched deny, direct and MITM rules, the PAC result, the upstream proxy used, and the authenticated user. "+
+			"It is separate from the application log and is intended for offline policy audits. ")
+
+	fs.Float64Var(&cfg.SampleRate, "decision-log-sample-rate", cfg.SampleRate, "<float>"+
+		"Fraction of requests to record in the decision log, in range (0, 1]. ")
+}
+
 func DenyDomains(fs *pflag.FlagSet, cfg *[]ruleset.RegexpListItem) {
 	fs.Var(anyflag.NewSliceValue[ruleset.RegexpListItem](*cfg, cfg, ruleset.ParseRegexpListItem),
 		"deny-domains", "[-]<regexp>,..."+
@@ -145,6 +375,84 @@ func DenyDomains(fs *pflag.FlagSet, cfg *[]ruleset.RegexpListItem) {
 			"Prefix domains with '-' to exclude requests to certain domains from being denied.")
 }
 
+func DirectDomainsSchedule(fs *pflag.FlagSet, cfg **ruleset.Schedule) {
+	fs.Var(anyflag.NewValue[*ruleset.Schedule](*cfg, cfg, ruleset.ParseSchedule),
+		"direct-domains-schedule", "<schedule>"+
+			"Connect directly to the domains specified with --direct-domains only when the schedule is active. "+
+			"By default, the domains are always connected directly. "+
+			"The schedule applies to the whole list, individual domains and upstream proxies cannot be scheduled. "+
+			scheduleSyntax)
+}
+
+func PortPolicy(fs *pflag.FlagSet, cfg *[]forwarder.PortPolicy) {
+	fs.Var(anyflag.NewSliceValue[forwarder.PortPolicy](*cfg, cfg, forwarder.ParsePortPolicy),
+		"port-policy", "<regexp>=<rule>[|<rule>]...,..."+
+			"Restrict destination ports and protocols for the specified domains. "+
+			"The rule is a port, a port range <min>-<max>, or a protocol: http, https or connect. "+
+			"Requests to matching domains that use other ports or protocols are denied, "+
+			"this applies to both plain HTTP and CONNECT requests. "+
+			"The policies are checked for each request before the connection is dialed, "+
+			"including MITMed requests, SOCKS5 and TCP forward connections, which are handled as CONNECT requests. "+
+			"They restrict the destinations requested by clients, "+
+			"connections to upstream proxies, PAC servers and addresses set with --connect-to are not restricted. "+
+			"The first policy with a matching domain is used, domains not matching any policy are not restricted. "+
+			"Example: '.*\\.corp=443|connect'. ")
+}
+
+func TCPForward(fs *pflag.FlagSet, cfg *[]forwarder.TCPForward) {
+	fs.Var(anyflag.NewSliceValue[forwarder.TCPForward](*cfg, cfg, forwarder.ParseTCPForward),
+		"tcp-forward", "[tls://]<listen address>=[tls://]<host:port>,..."+
+			"Forward TCP connections accepted on the listen address to the target host and port. "+
+			"Each connection is handled as a CONNECT request to the target, "+
+			"it uses the upstream proxy or PAC, and is subject to the same rules as HTTP clients, "+
+			"connections to localhost require --proxy-localhost allow. "+
+			"The tls:// prefix on the listen address terminates TLS using the proxy TLS certificate, "+
+			"the tls:// prefix on the target originates TLS to the target. "+
+			"Connection metrics are reported per listener. "+
+			"Do not include the targets in --mitm-domains. "+
+			"Example: '0.0.0.0:5432=db.internal:5432'. ")
+}
+
+func Homograph(fs *pflag.FlagSet, cfg *forwarder.HomographConfig) {
+	fs.StringSliceVar(&cfg.ProtectedDomains, "homograph-protected-domains", cfg.ProtectedDomains, "<domain>,..."+
+		"Detect requests to internationalized domain names that are visually confusable with the specified domains or their subdomains, "+
+		"e.g. 'xn--pple-43d.com' (аpple.com with Cyrillic 'а') for 'apple.com'. "+
+		"Matches are logged and counted in the proxy_homographs_total metric. ")
+
+	fs.BoolVar(&cfg.Block, "homograph-block", cfg.Block, ""+
+		"Deny requests to domains detected with --homograph-protected-domains. ")
+}
+
+func RateLimit(fs *pflag.FlagSet, limits *[]forwarder.RateLimit, redis **url.URL) {
+	fs.Var(anyflag.NewSliceValue[forwarder.RateLimit](*limits, limits, forwarder.ParseRateLimit),
+		"rate-limit", "<requests>/<duration>,..."+
+			"Limit the number of requests per client, requests over the limit are denied with 429 Too Many Requests. "+
+			"Clients are identified by the proxy basic authentication username, or by IP address if it is not present. "+
+			"CONNECT requests and requests in MITM tunnels each count as a request. "+
+			"Multiple limits can be specified, long periods can be used as quotas e.g. 10/1s,10000/24h. "+
+			"Periods are fixed windows aligned to the Unix epoch. ")
+
+	fs.Var(anyflag.NewValueWithRedact[*url.URL](*redis, redis, url.Parse, RedactURL),
+		"rate-limit-redis", "<redis[s]://[[user]:password@]host[:port][/db]>"+
+			"Store request counts for --rate-limit in Redis, so that the limits are enforced across all proxy instances sharing the Redis server. "+
+			"If Redis is unavailable, requests are allowed. ")
+}
+
+const scheduleSyntax = "<p/>" +
+	"The schedule is a cron-like specification with five space separated fields: " +
+	"minute, hour, day of month, month and day of week. " +
+	"It can be prefixed with TZ=<timezone> to use a timezone other than the local one. " +
+	"Example: 'TZ=Europe/Berlin * 9-16 * * mon-fri'. "
+
+func DenyDomainsSchedule(fs *pflag.FlagSet, cfg **ruleset.Schedule) {
+	fs.Var(anyflag.NewValue[*ruleset.Schedule](*cfg, cfg, ruleset.ParseSchedule),
+		"deny-domains-schedule", "<schedule>"+
+			"Deny requests to the domains specified with --deny-domains only when the schedule is active. "+
+			"By default, the domains are always denied. "+
+			"The schedule applies to the whole list, individual domains cannot be scheduled. "+
+			scheduleSyntax)
+}
+
 func DirectDomains(fs *pflag.FlagSet, cfg *[]ruleset.RegexpListItem) {
 	fs.Var(anyflag.NewSliceValue[ruleset.RegexpListItem](*cfg, cfg, ruleset.ParseRegexpListItem),
 		"direct-domains", "[-]<regexp>,..."+
@@ -153,6 +461,52 @@ func DirectDomains(fs *pflag.FlagSet, cfg *[]ruleset.RegexpListItem) {
 			"This flag takes precedence over the PAC script.")
 }
 
+func RequestCollapsing(fs *pflag.FlagSet, enable *bool, cfg *forwarder.RequestCollapsingConfig) {
+	fs.BoolVar(enable, "collapse-requests", *enable, ""+
+		"Collapse identical in-flight requests into a single upstream request and share the response. "+
+		"Only GET and HEAD requests without body are collapsed, "+
+		"requests are identical if they have the same method, URL and headers specified by --collapse-key-headers. "+
+		"Only responses visible to the proxy, i.e. plain HTTP and MITMed HTTPS requests, can be collapsed. "+
+		"Responses with Set-Cookie or Vary headers, or with Cache-Control private or no-store, are not shared, "+
+		"the waiting requests are sent upstream on their own. ")
+
+	fs.StringSliceVar(&cfg.KeyHeaders, "collapse-key-headers", cfg.KeyHeaders, "<header>,..."+
+		"Request headers that must be equal for requests to be collapsed. ")
+
+	fs.Var(&cfg.MaxBodySize, "collapse-max-body-size", "<size>"+
+		"Maximum size of a response body that can be shared. "+
+		"Responses with a larger or unknown content length are not shared. ")
+}
+
+func SOCKS5UDP(fs *pflag.FlagSet, enable *bool, cfg *forwarder.SOCKS5UDPConfig) {
+	fs.BoolVar(enable, "socks5-udp", *enable, ""+
+		"Relay UDP datagrams for SOCKS5 UDP ASSOCIATE requests, this requires --protocol socks5. "+
+		"Datagrams are sent directly to the destination, the upstream proxy and PAC are not used. "+
+		"The --deny-domains, --proxy-localhost, --port-policy and --homograph-block rules apply to the datagram destinations, "+
+		"port policies are checked with the connect protocol. "+
+		"Destination domain names are resolved with the configured DNS servers, the result is cached for the idle timeout. "+
+		"The association is closed when the client closes the TCP connection that requested it. ")
+
+	fs.DurationVar(&cfg.IdleTimeout, "socks5-udp-idle-timeout", cfg.IdleTimeout, "<duration>"+
+		"Close UDP associations with no datagrams in either direction for the specified duration. "+
+		"Destinations are also removed from the association NAT table after this duration, "+
+		"datagrams from removed destinations are dropped. ")
+
+	fs.IntVar(&cfg.MaxDestinations, "socks5-udp-max-destinations", cfg.MaxDestinations, "<count>"+
+		"Maximum number of destinations a UDP association can send datagrams to at the same time. ")
+}
+
+func NoProxy(fs *pflag.FlagSet, cfg *[]forwarder.NoProxyEntry) {
+	fs.Var(anyflag.NewSliceValue[forwarder.NoProxyEntry](*cfg, cfg, forwarder.ParseNoProxyEntry),
+		"no-proxy", "<host[:port]|ip[:port]|cidr|*>,..."+
+			"Connect directly to the specified hosts without using the upstream proxy. "+
+			"The list has the same semantics as the NO_PROXY environment variable in curl and Go. "+
+			"A domain matches the domain and all its subdomains, a domain prefixed with '.' or '*.' matches subdomains only. "+
+			"IP addresses and CIDRs match the IP address of the host, if the host is an IP address. "+
+			"A port can be specified to match only that port, and '*' matches all hosts. "+
+			"This flag takes precedence over the PAC script.")
+}
+
 const pathOrBase64Syntax = "<p/>" +
 	"Syntax:" +
 	"<ul>" +
@@ -185,12 +539,74 @@ func MITMConfig(fs *pflag.FlagSet, mitm *bool, cfg *forwarder.MITMConfig) {
 	fs.DurationVar(&cfg.Validity, "mitm-validity", cfg.Validity, ""+
 		"Validity period of the generated MITM certificates. ")
 
+	fs.Var(anyflag.NewValue[certutil.KeyType](cfg.KeyType, &cfg.KeyType, certutil.ParseKeyType),
+		"mitm-key-type", "<rsa|ecdsa|ed25519>"+
+			"Type of the keys of the generated MITM certificates. "+
+			"RSA keys are 2048 bits, ECDSA keys use the P-256 curve. "+
+			"ECDSA and Ed25519 keys are faster to generate, note that Ed25519 certificates are not supported by some clients. ")
+
+	fs.Var(anyflag.NewSliceValue[forwarder.MITMProtocolRule](cfg.ProtocolRules, &cfg.ProtocolRules, forwarder.ParseMITMProtocolRule),
+		"mitm-protocol", "<regexp>=<option>[|<option>]...,..."+
+			"Control the protocols of MITMed connections to the specified domains. "+
+			"The option is h1 to offer only HTTP/1.1 to clients, h2 to also allow HTTP/2, "+
+			"a minimum TLS version accepted from clients: tls1.0, tls1.1, tls1.2 or tls1.3, "+
+			"or forward-alpn to send requests to the origin server with HTTP/2 if the client negotiated HTTP/2, it requires h2. "+
+			"By default, clients are offered HTTP/1.1 with TLS 1.2 or later, and requests are sent to origin servers with HTTP/1.1. "+
+			"The first rule with a matching domain is used. "+
+			"Example: '.*\\.example\\.com=h2|tls1.3|forward-alpn'. ")
+
+	fs.BoolVar(&cfg.SharedKey, "mitm-shared-key", cfg.SharedKey, "<value>"+
+		"Use a single key generated on start for all MITM certificates. "+
+		"Setting this to false generates a new key for each certificate, which costs CPU time when many hosts are accessed. ")
+
+	fs.IntVar(&cfg.GenWorkers, "mitm-gen-workers", cfg.GenWorkers, "<int>"+
+		"Maximum number of MITM certificates generated concurrently. "+
+		"Zero means the number of CPUs (GOMAXPROCS). ")
+
+	fs.IntVar(&cfg.PrefetchQueueSize, "mitm-prefetch-queue-size", cfg.PrefetchQueueSize, "<size>"+
+		"Maximum number of MITM certificates waiting to be generated on CONNECT before the TLS ClientHello arrives. "+
+		"If the queue is full, the certificate is generated during the TLS handshake. "+
+		"Zero disables prefetching. ")
+
 	fs.Uint32Var(&cfg.CacheSize, "mitm-cache-size", cfg.CacheSize, "<size>"+
 		"Maximum number of certificates to cache. "+
 		"If the cache is full, the least recently used certificate is removed. ")
 
 	fs.DurationVar(&cfg.CacheTTL, "mitm-cache-ttl", cfg.CacheTTL, "<duration>"+
 		"Expiration time of the cached certificates. ")
+
+	fs.BoolVar(&cfg.SessionTickets, "mitm-session-tickets", cfg.SessionTickets, "<value>"+
+		"Enable TLS session resumption with session tickets for MITMed connections. "+
+		"It saves full TLS handshakes when clients, e.g. browsers, open many connections to the same host. "+
+		"The ticket keys are rotated every --mitm-ticket-key-rotation, "+
+		"and shared between proxy instances if --cluster-redis is set. ")
+
+	fs.DurationVar(&cfg.TicketKeyRotation, "mitm-ticket-key-rotation", cfg.TicketKeyRotation, "<duration>"+
+		"Interval of session ticket key rotation. "+
+		"Tickets encrypted with the previous two keys are still accepted. ")
+
+	fs.DurationVar(&cfg.CAExpiryWarning, "mitm-ca-expiry-warning", cfg.CAExpiryWarning, "<duration>"+
+		"Log a warning every hour when the MITM CA certificate expires in less than the specified duration. ")
+
+	fs.DurationVar(&cfg.CARotateBefore, "mitm-ca-rotate-before", cfg.CARotateBefore, "<duration>"+
+		"Enable MITM CA rotation, zero disables rotation. "+
+		"The generated CA certificate is replaced with a new one when it expires in less than the specified duration. "+
+		"The CA certificate loaded from files is replaced when the files change. "+
+		"The new CA is served at the /cacert API endpoint together with the current one for the --mitm-ca-rotate-overlap duration before it is used. ")
+
+	fs.DurationVar(&cfg.CARotateOverlap, "mitm-ca-rotate-overlap", cfg.CARotateOverlap, "<duration>"+
+		"Time the new MITM CA is served before it is used to sign certificates, and the previous CA is served after rotation. "+
+		"Clients should fetch the CA certificates from the /cacert API endpoint within this time. ")
+}
+
+func MITMCertLog(fs *pflag.FlagSet, file **os.File) {
+	fs.VarP(struct{ pflag.Value }{anyflag.NewValueWithRedact[*os.File](*file, file,
+		forwarder.OpenFileParser(log.DefaultFileFlags, log.DefaultFileMode, log.DefaultDirMode), DisplayFileName)},
+		"mitm-cert-log-file", "", "<path>"+
+			"Path to the append-only log of issued MITM certificates, if empty, the log is disabled. "+
+			"Each generated certificate is recorded as a JSON line with the time, host, serial number, validity, SHA-256 fingerprint and the CA fingerprint. "+
+			"The log can be queried at the /mitm/certs API endpoint with the host, since, until and limit query parameters, "+
+			"a host with a leading dot matches the domain and its subdomains. ")
 }
 
 func MITMDomains(fs *pflag.FlagSet, cfg *[]ruleset.RegexpListItem) {
@@ -200,6 +616,186 @@ func MITMDomains(fs *pflag.FlagSet, cfg *[]ruleset.RegexpListItem) {
 			"Prefix domains with '-' to exclude requests to certain domains from being MITMed.")
 }
 
+func BodyCapture(fs *pflag.FlagSet, cfg *forwarder.BodyCaptureConfig, domains *[]ruleset.RegexpListItem) {
+	fs.StringVar(&cfg.Dir, "capture-dir", cfg.Dir, "<path>"+
+		"Spool directory for captured response bodies, if empty, capture is disabled. "+
+		"Bodies of responses visible to the proxy, i.e. plain HTTP and MITMed HTTPS responses, are written to separate files as they are sent to the client. "+
+		"The files are indexed in the index.jsonl manifest in the directory, "+
+		"each entry contains the request ID, method, URL, status, content type and encoding, file name, size, and whether the body was truncated. "+
+		"Bodies are stored as received from the server, i.e. they may be compressed. ")
+
+	fs.Var(anyflag.NewSliceValue[ruleset.RegexpListItem](*domains, domains, ruleset.ParseRegexpListItem),
+		"capture-domains", "[-]<regexp>,..."+
+			"Limit capture to responses from the specified domains. "+
+			"Prefix domains with '-' to exclude requests to certain domains from being captured.")
+
+	fs.StringSliceVar(&cfg.ContentTypes, "capture-content-types", cfg.ContentTypes, "<media type>,..."+
+		"Limit capture to responses with the specified media types. "+
+		"A type ending with '/' matches all subtypes, e.g. image/ matches image/png and image/jpeg. ")
+
+	fs.Var(&cfg.MaxBodySize, "capture-max-body-size", "<size>"+
+		"Maximum number of bytes captured per body, longer bodies are truncated. "+
+		"Zero means no limit. ")
+
+	fs.Var(&cfg.MaxTotalSize, "capture-max-total-size", "<size>"+
+		"Maximum number of bytes captured in total, once reached, capture stops. "+
+		"Zero means no limit. ")
+}
+
+func ContentVerify(fs *pflag.FlagSet, cfg *forwarder.ContentVerifyConfig, manifest *string, domains *[]ruleset.RegexpListItem) {
+	fs.BoolVar(&cfg.Headers, "verify-checksums", cfg.Headers, ""+
+		"Verify downloaded content against checksums sent by the server "+
+		"in the X-Checksum-Sha256, X-Checksum-Sha1, X-Checksum-Md5, Digest and Content-Digest headers. "+
+		"Only responses visible to the proxy, i.e. plain HTTP and MITMed HTTPS responses, are verified. "+
+		"If the checksum does not match, the connection is aborted before the last byte of the body is sent, "+
+		"so that the client never receives the complete content. ")
+
+	fs.StringVar(manifest, "verify-manifest", *manifest, "<path>"+
+		"Verify downloaded content against SHA-256 digests from a manifest file. "+
+		"The manifest uses the sha256sum format with URLs instead of file names, "+
+		"i.e. each line contains a hex encoded digest followed by whitespace and the URL. ")
+
+	fs.Var(anyflag.NewSliceValue[ruleset.RegexpListItem](*domains, domains, ruleset.ParseRegexpListItem),
+		"verify-domains", "[-]<regexp>,..."+
+			"Limit content verification to the specified domains. "+
+			"Prefix domains with '-' to exclude requests to certain domains from being verified.")
+}
+
+func Inject(fs *pflag.FlagSet, cfg *forwarder.InjectConfig, html **url.URL, headers *[]header.Header, domains *[]ruleset.RegexpListItem) {
+	fs.Var(anyflag.NewValue[*url.URL](*html, html, fileurl.ParseFilePathOrURL),
+		"inject-html", "`<path or URL>`"+
+			"HTML snippet to inject into HTML responses, such as a script tag loading test instrumentation or telemetry. "+
+			"The snippet is inserted before the closing head tag, or after the opening body tag if there is no head. "+
+			"Only responses visible to the proxy, i.e. plain HTTP and MITMed HTTPS responses, are modified. "+
+			"Responses with encodings other than gzip are passed through, "+
+			"for page requests of clients accepting gzip the Accept-Encoding header is limited to gzip. "+
+			"Pages with a Content-Security-Policy may block inline scripts. "+
+			"<p/>"+
+			"Syntax:"+
+			"<ul>"+
+			"<li>File: <code>/path/to/snippet.html</code>"+
+			"<li>Embed: <code>data:base64,<base64 encoded data></code>"+
+			"</ul>")
+
+	fs.Var(anyflag.NewSliceValueWithRedact[header.Header](*headers, headers, header.ParseHeader, RedactHeader),
+		"inject-headers", "<name:value>,..."+
+			"Headers to add to HTML responses modified by injection. "+
+			"If no snippet is specified, only the headers are added. ")
+
+	fs.Var(anyflag.NewSliceValue[ruleset.RegexpListItem](*domains, domains, ruleset.ParseRegexpListItem),
+		"inject-domains", "[-]<regexp>,..."+
+			"Limit injection to responses from the specified domains. "+
+			"Prefix domains with '-' to exclude requests to certain domains from being modified.")
+
+	fs.Var(&cfg.MaxBodySize, "inject-max-body-size", "<size>"+
+		"Maximum size of a response body that is modified, larger responses are passed through. ")
+}
+
+func URLRewrite(fs *pflag.FlagSet, cfg *forwarder.URLRewriteConfig, domains *[]ruleset.RegexpListItem) {
+	fs.Var(anyflag.NewSliceValue[forwarder.HostRewrite](cfg.Hosts, &cfg.Hosts, forwarder.ParseHostRewrite),
+		"rewrite-hosts", "<from-host[:port]>=<to-host[:port]>,..."+
+			"Rewrite absolute URLs in response bodies from production hosts to sandbox hosts, "+
+			"so that recorded pages work inside isolated test networks behind the proxy. "+
+			"Hosts of absolute and protocol-relative URLs are replaced, including JSON escaped URLs, "+
+			"the Location and Content-Location headers are rewritten too. "+
+			"A host without a port matches URLs with any port, the port is kept unless the target host has a port. "+
+			"The URL scheme is not changed. "+
+			"Only responses visible to the proxy, i.e. plain HTTP and MITMed HTTPS responses, are rewritten. "+
+			"Responses with encodings other than gzip are passed through, "+
+			"for requests of clients accepting gzip the Accept-Encoding header is limited to gzip. ")
+
+	fs.Var(anyflag.NewSliceValue[ruleset.RegexpListItem](*domains, domains, ruleset.ParseRegexpListItem),
+		"rewrite-domains", "[-]<regexp>,..."+
+			"Limit URL rewriting to responses from the specified domains. "+
+			"Prefix domains with '-' to exclude requests to certain domains from being rewritten.")
+
+	fs.StringSliceVar(&cfg.ContentTypes, "rewrite-content-types", cfg.ContentTypes, "<media type>,..."+
+		"Media types of responses with rewritten bodies. "+
+		"A type ending with '/' matches all subtypes, such as text/ matches text/html and text/css. ")
+
+	fs.Var(&cfg.MaxBodySize, "rewrite-max-body-size", "<size>"+
+		"Maximum size of a response body that is rewritten, larger responses are passed through. ")
+}
+
+func ResponseDiff(fs *pflag.FlagSet, cfg *forwarder.ResponseDiffConfig, file **os.File, reference **url.URL, domains *[]ruleset.RegexpListItem) {
+	fs.VarP(struct{ pflag.Value }{anyflag.NewValueWithRedact[*os.File](*file, file,
+		forwarder.OpenFileParser(log.DefaultFileFlags, log.DefaultFileMode, log.DefaultDirMode), DisplayFileName)},
+		"diff-log-file", "", "<path>"+
+			"Path to the response diff log file, if empty, response diffing is disabled. "+
+			"When enabled, requests are also sent to the reference upstream specified by the --diff-reference flag, "+
+			"clients receive the primary response, and differences in status, headers and body are recorded as newline delimited JSON. "+
+			"For JSON bodies the paths of differing values are recorded, for other bodies the offset of the first differing byte. "+
+			"Only GET, HEAD and OPTIONS requests visible to the proxy, i.e. plain HTTP and MITMed HTTPS requests, are diffed. "+
+			"It is useful for validating proxy or backend migrations. ")
+
+	fs.Var(anyflag.NewValueWithRedact[*url.URL](*reference, reference, forwarder.ParseProxyURL, RedactURL),
+		"diff-reference", "<[protocol://]host:port>"+
+			"Upstream proxy to send reference requests to, if empty, reference requests are sent directly. "+
+			"The supported protocols are the same as for the --proxy flag. ")
+
+	fs.Var(anyflag.NewSliceValue[ruleset.RegexpListItem](*domains, domains, ruleset.ParseRegexpListItem),
+		"diff-domains", "[-]<regexp>,..."+
+			"Limit response diffing to the specified domains. "+
+			"Prefix domains with '-' to exclude requests to certain domains from being diffed.")
+
+	fs.StringSliceVar(&cfg.IgnoreHeaders, "diff-ignore-headers", cfg.IgnoreHeaders, "<name>,..."+
+		"Response headers that are not compared. ")
+
+	fs.Var(&cfg.MaxBodySize, "diff-max-body-size", "<size>"+
+		"Maximum number of bytes of each body that are compared. ")
+
+	fs.DurationVar(&cfg.Timeout, "diff-timeout", cfg.Timeout, "<duration>"+
+		"Timeout for receiving the reference response. ")
+}
+
+func RequestSigning(fs *pflag.FlagSet, cfg *forwarder.RequestSigningConfig) {
+	fs.Var(anyflag.NewSliceValueWithRedact[forwarder.SigningRule](cfg.Rules, &cfg.Rules, forwarder.ParseSigningRule, forwarder.RedactSigningRule),
+		"sign", "<host-regexp>=sigv4:<region>:<service>|<host-regexp>=hmac:<key-id>:<secret>,..."+
+			"Sign outbound requests to matching hosts, so that clients behind the proxy do not need the credentials themselves. "+
+			"The first rule matching the request host is applied. "+
+			"The sigv4 method signs requests with AWS Signature Version 4 using the credentials from the --sign-aws-credentials flag. "+
+			"The hmac method signs requests with the HMAC-SHA256 HTTP Signatures scheme, "+
+			"the Authorization header contains the key ID and the signature of the request target, Host, Date and Digest headers. "+
+			"Only requests visible to the proxy, i.e. plain HTTP and MITMed HTTPS requests, are signed. ")
+
+	fs.Var(anyflag.NewValueWithRedact[*forwarder.AWSCredentials](cfg.AWS, &cfg.AWS, forwarder.ParseAWSCredentials, forwarder.RedactAWSCredentials),
+		"sign-aws-credentials", "<access-key-id>:<secret-access-key>[:<session-token>]"+
+			"AWS credentials for sigv4 signing. "+
+			"If not set, the credentials are read from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables. ")
+
+	fs.Var(&cfg.MaxBodySize, "sign-max-body-size", "<size>"+
+		"Maximum size of a request body that is hashed for signing. "+
+		"Requests to S3 with larger bodies are signed with an unsigned payload, other requests with larger bodies are rejected. ")
+}
+
+func OAuth2(fs *pflag.FlagSet, cfg *forwarder.OAuth2Config) {
+	fs.Var(anyflag.NewSliceValueWithRedact[forwarder.OAuth2Rule](cfg.Rules, &cfg.Rules, forwarder.ParseOAuth2Rule, forwarder.RedactOAuth2Rule),
+		"oauth2", "<host-regexp>=<scheme>://<client-id>:<client-secret>@<token-url>[?<param>=<value>&...],..."+
+			"Inject OAuth2 bearer tokens into outbound requests to matching hosts, "+
+			"so that services behind the proxy do not need to handle OAuth2 themselves. "+
+			"The first rule matching the request host is applied. "+
+			"Tokens are obtained from the token URL with the client credentials and cached until they expire. "+
+			"The query parameters, such as scope or audience, are sent with the token request. "+
+			"By default the client_credentials grant is used and the token is set if the request has no Authorization header. "+
+			"With grant_type=token-exchange, the request bearer token is exchanged for a token for the destination (RFC 8693). "+
+			"Only requests visible to the proxy, i.e. plain HTTP and MITMed HTTPS requests, are modified. ")
+
+	fs.DurationVar(&cfg.Timeout, "oauth2-timeout", cfg.Timeout, "<duration>"+
+		"Timeout for obtaining an OAuth2 token. ")
+}
+
+func MITMDomainFronting(fs *pflag.FlagSet, deny *bool, allow *[]ruleset.RegexpListItem) {
+	fs.BoolVar(deny, "mitm-deny-domain-fronting", *deny, ""+
+		"Reject MITMed requests if the Host header does not match the CONNECT request host. "+
+		"This prevents clients from reaching denied domains by sending requests with a different Host header over a connection to an allowed domain. ")
+
+	fs.Var(anyflag.NewSliceValue[ruleset.RegexpListItem](*allow, allow, ruleset.ParseRegexpListItem),
+		"mitm-domain-fronting-allow-domains", "[-]<regexp>,..."+
+			"Allow MITMed requests to the specified domains even if the Host header does not match the CONNECT request host. "+
+			"Prefix domains with '-' to exclude requests to certain domains from being allowed. "+
+			"See the documentation for the --mitm-deny-domain-fronting flag for more details. ")
+}
+
 func ProxyProtocol(fs *pflag.FlagSet, enabled *bool, cfg *forwarder.ProxyProtocolConfig) {
 	fs.BoolVar(enabled, "proxy-protocol-listener", *enabled,
 		"The PROXY protocol is used to correctly read the client's IP address. "+
@@ -219,16 +815,164 @@ func Credentials(fs *pflag.FlagSet, credentials *[]*forwarder.HostPortUser) {
 			"The flag can be specified multiple times to add multiple credentials. ")
 }
 
+func CredentialsCommand(fs *pflag.FlagSet, cfg *forwarder.CredentialsCommandConfig) {
+	fs.Var(anyflag.NewValue[[]string](cfg.Command, &cfg.Command, func(val string) ([]string, error) {
+		return strings.Fields(val), nil
+	}), "proxy-credentials-command", "<command>"+
+		"Command to mint upstream proxy credentials, such as a script fetching a short-lived token from an identity provider. "+
+		"The command is split on whitespace and executed without a shell, use a script for more complex commands. "+
+		"It must print username:password, or a JSON object with username, password and optional expires_in fields, "+
+		"where expires_in is the credentials lifetime in seconds. "+
+		"The command is executed on start, periodically, and when the upstream proxy responds with 407 Proxy Authentication Required. "+
+		"The credentials override the ones from the --proxy flag and PAC script, they are kept in memory only. ")
+
+	fs.DurationVar(&cfg.Interval, "proxy-credentials-command-interval", cfg.Interval, "<duration>"+
+		"Interval between executions of the credentials command. "+
+		"If the command returns expires_in, the credentials are refreshed after 3/4 of their lifetime if it is shorter. ")
+}
+
+func Negotiate(fs *pflag.FlagSet, cfg *forwarder.NegotiateConfig) {
+	splitCommand := func(val string) ([]string, error) {
+		return strings.Fields(val), nil
+	}
+
+	fs.Var(anyflag.NewValue[[]string](cfg.TokenCommand, &cfg.TokenCommand, splitCommand), "proxy-negotiate-token-command", "<command>"+
+		"Command to obtain a SPNEGO token for Negotiate (Kerberos) authentication to upstream HTTP proxies. "+
+		"Forwarder does not implement Kerberos, the command is a hook that obtains the token, such as a script using the system GSSAPI library. "+
+		"The command is split on whitespace and executed without a shell, the upstream proxy hostname is appended as the last argument, "+
+		"the service principal is HTTP@<hostname>. "+
+		"It must print the base64 encoded token, optionally prefixed with \"Negotiate \". "+
+		"The token is sent in the Proxy-Authorization header of CONNECT requests and plain HTTP requests sent to upstream proxies. ")
+
+	fs.DurationVar(&cfg.TokenTTL, "proxy-negotiate-token-ttl", cfg.TokenTTL, "<duration>"+
+		"Time a token is reused for requests to the same upstream proxy. "+
+		"By default, a new token is obtained for each request, which is required by proxies with a Kerberos replay cache. ")
+
+	fs.Var(anyflag.NewValue[[]string](cfg.RenewCommand, &cfg.RenewCommand, splitCommand), "proxy-negotiate-renew-command", "<command>"+
+		"Command to obtain or renew the Kerberos ticket-granting ticket used by the token command, such as kinit with a keytab. "+
+		"The command is executed on start, periodically, and when the upstream proxy responds with 407 Proxy Authentication Required. ")
+
+	fs.DurationVar(&cfg.RenewInterval, "proxy-negotiate-renew-interval", cfg.RenewInterval, "<duration>"+
+		"Interval between executions of the renew command, it should be shorter than the ticket lifetime. ")
+}
+
+func UpstreamPool(fs *pflag.FlagSet, cfg *forwarder.UpstreamPoolConfig) {
+	fs.Var(anyflag.NewSliceValueWithRedact[*url.URL](cfg.Proxies, &cfg.Proxies, forwarder.ParseProxyURL, RedactURL),
+		"proxy-pool", "<[protocol://]host:port>,..."+
+			"Upstream proxies to route requests through, see --proxy-pool-strategy. "+
+			"The score of each proxy is the moving average of the latency plus the moving average of the error rate multiplied by --proxy-pool-error-penalty. "+
+			"The scores are available at the /upstreams API endpoint. "+
+			"The credentials for upstream proxies can be specified in the same way as for the --proxy flag. "+
+			"It cannot be used with the --proxy and --pac flags. ")
+
+	strategies := []forwarder.UpstreamPoolStrategy{
+		forwarder.UpstreamPoolLatency,
+		forwarder.UpstreamPoolRoundRobin,
+		forwarder.UpstreamPoolLeastConn,
+	}
+	fs.Var(anyflag.NewValue[forwarder.UpstreamPoolStrategy](cfg.Strategy, &cfg.Strategy,
+		anyflag.EnumParser[forwarder.UpstreamPoolStrategy](strategies...)),
+		"proxy-pool-strategy", "<latency|round-robin|least-conn>"+
+			"Algorithm used to select the proxy for a request. "+
+			"The latency strategy prefers the proxy with the lowest score, "+
+			"a small fraction of requests is routed to other proxies to keep their scores up to date, see --proxy-pool-probe-rate. "+
+			"The round-robin strategy routes requests to the proxies in turn. "+
+			"The least-conn strategy routes requests to the proxy with the fewest active requests, "+
+			"a CONNECT request is active until the tunnel is closed. ")
+
+	fs.Float64Var(&cfg.Decay, "proxy-pool-decay", cfg.Decay, "<float>"+
+		"Weight of the latest request in the moving averages, in range (0, 1]. "+
+		"Higher values make the scores react faster to changes. ")
+
+	fs.DurationVar(&cfg.ErrorPenalty, "proxy-pool-error-penalty", cfg.ErrorPenalty, "<duration>"+
+		"Latency equivalent of a failed request. ")
+
+	fs.Float64Var(&cfg.Hysteresis, "proxy-pool-hysteresis", cfg.Hysteresis, "<float>"+
+		"Relative score improvement required to switch the preferred proxy, in range [0, 1). "+
+		"It prevents flapping between proxies with similar scores. ")
+
+	fs.Float64Var(&cfg.ProbeRate, "proxy-pool-probe-rate", cfg.ProbeRate, "<float>"+
+		"Fraction of requests routed to proxies other than the preferred one, in range [0, 1]. "+
+		"Only used with the latency strategy. ")
+}
+
+func SPIFFE(fs *pflag.FlagSet, socket *string, domains, clientIDs *[]ruleset.RegexpListItem) {
+	fs.StringVar(socket, "spiffe-socket", *socket, "<unix:///path|tcp://ip:port>"+
+		"Address of the SPIFFE Workload API used to obtain X.509 SVIDs and trust bundles. "+
+		"By default, the value is taken from the SPIFFE_ENDPOINT_SOCKET environment variable. "+
+		"The documents are rotated automatically when the Workload API issues new ones. ")
+
+	fs.Var(anyflag.NewSliceValue[ruleset.RegexpListItem](*domains, domains, ruleset.ParseRegexpListItem),
+		"spiffe-domains", "[-]<regexp>,..."+
+			"Present the X.509 SVID in direct HTTPS connections to matching hosts, including connections to MITM origins, "+
+			"and verify the server SVID against the SPIFFE trust bundles instead of the system root certificates and host name. "+
+			"It takes precedence over --http-tls-client-cert. ")
+
+	fs.Var(anyflag.NewSliceValue[ruleset.RegexpListItem](*clientIDs, clientIDs, ruleset.ParseRegexpListItem),
+		"spiffe-client-ids", "[-]<regexp>,..."+
+			"Require clients of the https and h2 proxy listener to present X.509 SVIDs issued by a trusted domain, "+
+			"with SPIFFE IDs matching the list, use .* to accept all IDs. ")
+}
+
+func ConfigBackend(fs *pflag.FlagSet, cfg **url.URL) {
+	fs.Var(anyflag.NewValueWithRedact[*url.URL](*cfg, cfg, url.Parse, kvconfig.Redacted),
+		"config-backend", "<etcd|consul>[+https]://[credentials@]host[:port]/prefix"+
+			"Read and watch configuration from etcd or Consul key-value store, etcd is accessed with the v3 JSON gateway. "+
+			"For etcd the credentials are username:password, for Consul it is an ACL token. "+
+			"The supported keys under the prefix are: deny-domains, direct-domains, credentials and proxy, "+
+			"the values use the syntax of the corresponding flags with one item per line, lines starting with '#' are ignored. "+
+			"Changes are applied without restart, a key that is not set falls back to the flag value. "+
+			"The proxy key is ignored if --pac or --proxy-auto-detect is used. ")
+}
+
 func HTTPTransportConfig(fs *pflag.FlagSet, cfg *forwarder.HTTPTransportConfig) {
 	DialConfig(fs, &cfg.DialConfig, "http")
 
 	TLSClientConfig(fs, &cfg.TLSClientConfig)
 
+	fs.Var(anyflag.NewValueWithRedact[*url.URL](cfg.ECH.DoHURL, &cfg.ECH.DoHURL, url.Parse, RedactURL),
+		"http-tls-ech-doh-url", "<url>"+
+			"Enable Encrypted Client Hello (ECH) for direct HTTPS connections, and use the specified DNS over HTTPS endpoint "+
+			"to look up ECH configs published by origins in DNS HTTPS records, for example https://cloudflare-dns.com/dns-query. "+
+			"ECH encrypts the server name (SNI), so that the destination host name is not visible on the network. "+
+			"Connections to origins that do not publish ECH configs use plain TLS. ")
+
+	fs.BoolVar(&cfg.ECH.Require, "http-tls-ech-require", cfg.ECH.Require, ""+
+		"Fail connections to origins that do not publish ECH configs instead of falling back to plain TLS, see --http-tls-ech-doh-url. ")
+
+	fs.Var(anyflag.NewSliceValue[forwarder.ClientCertificate](cfg.ClientCertificates, &cfg.ClientCertificates, forwarder.ParseClientCertificate),
+		"http-tls-client-cert", "<host-regexp>=<cert-file>:<key-file>,..."+
+			"Client certificates presented to origins with server names matching the host regexp in direct HTTPS connections, "+
+			"including connections to MITM origins. "+
+			"The first entry matching the server name is used. "+
+			"This allows clients that cannot hold the certificates to access mTLS protected services through the proxy. "+
+			"Connections through an upstream proxy do not present the certificates. ")
+
+	fs.IntVar(&cfg.MaxIdleConns, "http-max-idle-conns", cfg.MaxIdleConns, "<int>"+
+		"The maximum number of idle (keep-alive) connections across all hosts. "+
+		"Zero means no limit. "+
+		"See --autotune for the default. ")
+
+	fs.IntVar(&cfg.MaxIdleConnsPerHost, "http-max-idle-conns-per-host", cfg.MaxIdleConnsPerHost, "<int>"+
+		"The maximum number of idle (keep-alive) connections to keep per host. "+
+		"See --autotune for the default. ")
+
 	fs.DurationVar(&cfg.IdleConnTimeout,
 		"http-idle-conn-timeout", cfg.IdleConnTimeout,
 		"The maximum amount of time an idle (keep-alive) connection will remain idle before closing itself. "+
 			"Zero means no limit. ")
 
+	fs.DurationVar(&cfg.MaxConnAge,
+		"http-max-conn-age", cfg.MaxConnAge,
+		"The maximum age of an upstream connection. "+
+			"A connection older than that is closed after the next request, so that connections are periodically recycled. "+
+			"This is useful behind NATs and load balancers that silently drop long-lived connections. "+
+			"Zero means no limit. ")
+
+	fs.IntVar(&cfg.MaxConnRequests, "http-max-conn-requests", cfg.MaxConnRequests, "<int>"+
+		"The maximum number of requests sent over an upstream connection before it is closed. "+
+		"Zero means no limit. ")
+
 	fs.DurationVar(&cfg.ResponseHeaderTimeout,
 		"http-response-header-timeout", cfg.ResponseHeaderTimeout,
 		"The amount of time to wait for a server's response headers after fully writing the request (including its body, if any)."+
@@ -252,6 +996,47 @@ func DialConfig(fs *pflag.FlagSet, cfg *forwarder.DialConfig, prefix string) {
 
 	fs.DurationVar(&cfg.Retry.Backoff, namePrefix+"dial-backoff", cfg.Retry.Backoff,
 		"The amount of time to wait between dial attempts. ")
+
+	fs.Var(addrFlag{anyflag.NewValue[netip.Addr](cfg.SourceAddress, &cfg.SourceAddress, netip.ParseAddr), &cfg.SourceAddress},
+		namePrefix+"dial-source-address", "<ip>"+
+			"Source IP address of outbound connections. "+
+			"Use it on multi-homed hosts to send traffic from a specific IP address. "+
+			"Only destinations of the same IP version as the source address can be reached. ")
+
+	fs.StringVar(&cfg.Interface, namePrefix+"dial-interface", cfg.Interface, "<name>"+
+		"Network interface to bind outbound connections to, for example eth1. "+
+		"Use it on multi-homed hosts to send traffic through a specific network interface regardless of the routing table. "+
+		"This option is only supported on Linux. ")
+
+	fs.Var(anyflag.NewValue[forwarder.IPVersion](cfg.IPVersion, &cfg.IPVersion,
+		anyflag.EnumParser[forwarder.IPVersion](forwarder.IPVersionAuto, forwarder.IPVersionV4, forwarder.IPVersionV6)),
+		namePrefix+"dial-ip-version", "<auto|v4|v6>"+
+			"IP version to use for outbound connections. "+
+			"Setting this to v4 or v6 restricts connections to IPv4 or IPv6 addresses, host names are resolved to addresses of that version only. "+
+			"Setting this to auto uses both. ")
+}
+
+func DialProxyProtocol(fs *pflag.FlagSet, cfg *forwarder.ProxyProtocolVersion) {
+	fs.Var(anyflag.NewValue[forwarder.ProxyProtocolVersion](*cfg, cfg,
+		anyflag.EnumParser[forwarder.ProxyProtocolVersion](forwarder.ProxyProtocolOff, forwarder.ProxyProtocolV1, forwarder.ProxyProtocolV2)),
+		"http-dial-proxy-protocol", "<off|v1|v2>"+
+			"Send a PROXY protocol header of the specified version on outbound connections to upstream proxies and origin servers, "+
+			"so that they see the original client IP address. "+
+			"The header is sent only on connections made on behalf of proxy clients. "+
+			"Such connections are not reused for other requests, as they carry the address of a single client. ")
+}
+
+// addrFlag is a netip.Addr flag that prints the zero address as an empty string.
+type addrFlag struct {
+	*anyflag.Value[netip.Addr]
+	addr *netip.Addr
+}
+
+func (f addrFlag) String() string {
+	if !f.addr.IsValid() {
+		return ""
+	}
+	return f.addr.String()
 }
 
 func ConnectTo(fs *pflag.FlagSet, cfg *[]forwarder.HostPortPair) {
@@ -285,6 +1070,227 @@ func TLSClientConfig(fs *pflag.FlagSet, cfg *forwarder.TLSClientConfig) {
 		"File to log TLS master secrets in NSS key log format. "+
 		"By default, the value is taken from the SSLKEYLOGFILE environment variable. "+
 		"It can be used to allow external programs such as Wireshark to decrypt TLS connections. ")
+
+	fs.IntVar(&cfg.SessionCacheSize, "http-tls-session-cache-size", cfg.SessionCacheSize, "<int>"+
+		"Number of TLS sessions cached for resumption of outbound connections, including connections to MITM origins. "+
+		"Resumed connections skip the full handshake, which cuts latency and CPU for repeated connections to the same origins. "+
+		"Zero disables the cache. ")
+
+	fs.Var(keyExchangeValue(&cfg.KeyExchange),
+		"http-tls-key-exchange", "<default|hybrid|classic>"+
+			"Key exchange mechanisms offered in outbound TLS connections, including connections to MITM origins. "+
+			"Setting this to hybrid prefers the X25519MLKEM768 post-quantum hybrid key exchange, it requires Go 1.24 or later. "+
+			"Setting this to classic disables post-quantum key exchanges, use it for servers or middleboxes that fail on large client hellos. "+
+			"The negotiated group is reported in the tls_client_handshakes_total metric. ")
+}
+
+func keyExchangeValue(k *forwarder.KeyExchange) pflag.Value {
+	keyExchanges := []forwarder.KeyExchange{
+		forwarder.KeyExchangeDefault,
+		forwarder.KeyExchangeHybrid,
+		forwarder.KeyExchangeClassic,
+	}
+	return anyflag.NewValue[forwarder.KeyExchange](*k, k, anyflag.EnumParser[forwarder.KeyExchange](keyExchanges...))
+}
+
+func WSTunnel(fs *pflag.FlagSet, cfg *forwarder.HTTPServerConfig) {
+	HTTPServerConfig(fs, cfg, "ws-tunnel", forwarder.HTTPSScheme, forwarder.HTTPScheme)
+
+	f := fs.Lookup("ws-tunnel-address")
+	f.Usage = "<host:port>" +
+		"Address to accept proxy connections tunneled over WebSocket on the " + forwarder.WSTunnelPath + " path, such as wss://forwarder:443/tunnel. " +
+		"The tunnel carries the proxy protocol inside, it allows to reach the proxy from networks that only allow HTTPS to specific hosts. " +
+		"Clients can connect using the dialvia.WebSocket dialer. " +
+		"If empty, the tunnel is disabled. "
+}
+
+func ReverseListenerConfig(fs *pflag.FlagSet, cfg *forwarder.ReverseListenerConfig) {
+	fs.Var(anyflag.NewValueWithRedact[*url.URL](cfg.RelayURL, &cfg.RelayURL, url.Parse, RedactURL),
+		"reverse-relay", "<ws|wss://[user:password@]host:port/agent>"+
+			"Run in agent mode, the proxy connects to a relay started with the forwarder relay command and accepts proxy sessions over these connections. "+
+			"It allows to proxy into networks that do not accept inbound connections, such as NAT'd lab networks. "+
+			"The connections to the relay use the HTTP client TLS options. ")
+
+	fs.IntVar(&cfg.Conns, "reverse-relay-conns", cfg.Conns, "<int>"+
+		"Number of idle connections kept open to the relay. "+
+		"It limits the number of sessions the relay can start at the same time, used connections are replaced immediately. ")
+
+	fs.DurationVar(&cfg.RetryInterval, "reverse-relay-retry-interval", cfg.RetryInterval, "<duration>"+
+		"Time to wait before reconnecting to the relay after a failure. ")
+}
+
+func APIReadOnly(fs *pflag.FlagSet, readOnly *bool) {
+	fs.BoolVar(readOnly, "api-read-only", *readOnly, ""+
+		"Reject API requests with methods other than GET, HEAD and OPTIONS. "+
+		"This disables all endpoints that change the state of the server regardless of authentication, "+
+		"use it when the API must be strictly observational. ")
+}
+
+func ReadyFile(fs *pflag.FlagSet, path *string) {
+	fs.StringVar(path, "ready-file", *path, "<path>"+
+		"Write a JSON file once all listeners are bound, the file is removed on shutdown. "+
+		"It contains the PID, version, the actual listener addresses, which is useful with port 0, "+
+		"and the SHA-256 fingerprint of the MITM CA certificate. "+
+		"The file is written atomically, its presence indicates that the server accepts connections. ")
+}
+
+func DiscoveryHook(fs *pflag.FlagSet, command *[]string, u **url.URL, timeout *time.Duration) {
+	fs.Var(anyflag.NewValue[[]string](*command, command, func(val string) ([]string, error) {
+		return strings.Fields(val), nil
+	}), "discovery-command", "<command>"+
+		"Command to register the listeners with a service discovery system once all listeners are bound. "+
+		"The command is split on whitespace and executed without a shell, use a script for more complex commands. "+
+		"It receives the same JSON as the --ready-file on stdin. "+
+		"If the command fails, the server shuts down. ")
+
+	fs.Var(anyflag.NewValueWithRedact[*url.URL](*u, u, url.Parse, RedactURL),
+		"discovery-url", "<url>"+
+			"URL to POST the same JSON as the --ready-file to once all listeners are bound. "+
+			"If the request fails or the response status code is not 2xx, the server shuts down. ")
+
+	fs.DurationVar(timeout, "discovery-timeout", *timeout, "<duration>"+
+		"Timeout for the discovery command and the discovery URL request. ")
+}
+
+func Webhook(fs *pflag.FlagSet, cfg *webhook.Config, errorRate **forwarder.RateLimit, caExpiry *time.Duration) {
+	fs.Var(anyflag.NewSliceValueWithRedact[*url.URL](cfg.URLs, &cfg.URLs, url.Parse, RedactURL),
+		"webhook", "<url>,..."+
+			"Send notable events to the specified URLs as POST requests, so that alerts can be raised without a metrics stack. "+
+			"The events are: "+strings.Join(webhook.EventTypes, ", ")+". "+
+			"By default, the request body is the event as JSON with type, time, source, subject and message fields. ")
+
+	fs.Var(anyflag.NewValueWithRedact[*template.Template](cfg.Template, &cfg.Template, webhook.ParseTemplate, DisplayTemplate),
+		"webhook-template", "<template>"+
+			"Go text/template used to render the webhook request body, it is executed with the event. "+
+			"The json function quotes strings, for example '{\"text\": {{json .Message}}}'. "+
+			"The body is sent with the application/json content type. ")
+
+	fs.Var(anyflag.NewValueWithRedact[string](cfg.Secret, &cfg.Secret, func(val string) (string, error) { return val, nil }, RedactSecret),
+		"webhook-secret", "<secret>"+
+			"Sign webhook requests with HMAC-SHA256 using the secret. "+
+			"The signature is sent in the "+webhook.SignatureHeader+" header as t=<unix timestamp>,sha256=<hex signature>, "+
+			"where the signature is computed over the timestamp, a dot and the request body. ")
+
+	fs.StringSliceVar(&cfg.Events, "webhook-events", cfg.Events, "<event>,..."+
+		"Send only the specified events, by default all events are sent. ")
+
+	fs.DurationVar(&cfg.Cooldown, "webhook-cooldown", cfg.Cooldown, "<duration>"+
+		"Minimum time between events of the same type and subject, such as the same upstream proxy or client. "+
+		"Events within the cooldown are dropped. ")
+
+	fs.IntVar(&cfg.Retries, "webhook-retries", cfg.Retries, "<number>"+
+		"Number of retries if the webhook request fails or the response status code is 5xx or 429. "+
+		"The time between retries starts at 1s and doubles with every retry. ")
+
+	fs.Var(anyflag.NewValue[*forwarder.RateLimit](*errorRate, errorRate, func(val string) (*forwarder.RateLimit, error) {
+		l, err := forwarder.ParseRateLimit(val)
+		return &l, err
+	}),
+		"webhook-error-rate", "<errors>/<duration>"+
+			"Send the "+webhook.ErrorRateExceeded+" event when the number of proxy errors in the period reaches the threshold, for example 100/1m. "+
+			"Denied requests are not counted as errors. ")
+
+	fs.DurationVar(caExpiry, "webhook-mitm-ca-expiry", *caExpiry, "<duration>"+
+		"Send the "+webhook.MITMCAExpiring+" event when the MITM CA certificate expires in less than the specified duration. "+
+		"The certificate is checked at startup and every hour, zero disables the check. ")
+}
+
+func ErrorStream(fs *pflag.FlagSet, enable *bool) {
+	fs.BoolVar(enable, "api-error-stream", *enable, ""+
+		"Stream proxy errors such as round trip failures, TLS errors and denied requests at the /errors/stream API endpoint. "+
+		"Events are sent as Server-Sent Events if the client accepts text/event-stream, and as newline delimited JSON otherwise. "+
+		"Slow consumers miss events instead of slowing down the proxy. ")
+}
+
+func SLO(fs *pflag.FlagSet, enable *bool, cfg *forwarder.SLOConfig) {
+	fs.BoolVar(enable, "slo", *enable, ""+
+		"Track the proxy service level objectives, and serve the error budget burn rates at the /slo API endpoint and as metrics. "+
+		"A request counts against the availability objective if the proxy fails it with a 5xx error response, "+
+		"and against the latency objective if the response is written later than --slo-latency after the request was read. "+
+		"For CONNECT requests the latency is the time to establish the tunnel. "+
+		"A burn rate of 1 means that the error budget is consumed exactly over the window. ")
+
+	fs.Float64Var(&cfg.Availability, "slo-availability", cfg.Availability, "<float>"+
+		"Target ratio of requests that are not failed by the proxy. ")
+
+	fs.DurationVar(&cfg.Latency, "slo-latency", cfg.Latency,
+		"Latency threshold of the latency objective, zero disables the latency objective. ")
+
+	fs.Float64Var(&cfg.LatencyTarget, "slo-latency-target", cfg.LatencyTarget, "<float>"+
+		"Target ratio of requests served within --slo-latency. ")
+
+	fs.DurationSliceVar(&cfg.Windows, "slo-windows", cfg.Windows, "<duration>,..."+
+		"Sliding windows over which the burn rates are computed, the resolution is 10s. ")
+}
+
+func ConnTable(fs *pflag.FlagSet, enable *bool, logInterval *time.Duration) {
+	fs.BoolVar(enable, "conntrack", *enable, ""+
+		"Track open client and upstream connections, and serve a summary at the /conntrack API endpoint. "+
+		"The summary contains the number of open connections per destination and client, "+
+		"the connection age distribution, and top talkers by the number of bytes transferred. "+
+		"Use the top query parameter to change the number of reported addresses, the default is 10. "+
+		"Enabling it enables traffic tracking for all connections. ")
+
+	fs.DurationVar(logInterval, "conntrack-log-interval", *logInterval, "<duration>"+
+		"Log the connection table summary at the specified interval, zero disables logging. "+
+		"It requires --conntrack. ")
+}
+
+func LeakCheck(fs *pflag.FlagSet, cfg *forwarder.LeakCheckConfig) {
+	fs.DurationVar(&cfg.Interval, "leak-check-interval", cfg.Interval, "<duration>"+
+		"Periodically compare the number of goroutines with the number of open client and upstream connections, "+
+		"and report a suspected goroutine leak, such as a tunnel that outlives its connections, "+
+		"in the logs and in the leak_check_alerts_total metric. "+
+		"The log lists the functions that started the most goroutines. "+
+		"Zero disables the check. "+
+		"Enabling it enables connection tracking, see the --conntrack flag. ")
+
+	fs.Float64Var(&cfg.GoroutinesPerConn, "leak-check-goroutines-per-conn", cfg.GoroutinesPerConn, "<number>"+
+		"Expected maximum number of goroutines per open connection. ")
+
+	fs.IntVar(&cfg.Slack, "leak-check-slack", cfg.Slack, "<number>"+
+		"Number of goroutines allowed on top of the expected number, "+
+		"the baseline number of goroutines is measured at the first check. ")
+
+	fs.IntVar(&cfg.Checks, "leak-check-checks", cfg.Checks, "<number>"+
+		"Number of consecutive failed checks required to report a leak. ")
+}
+
+func FDLimit(fs *pflag.FlagSet, limit, reserve *uint64, guard *bool) {
+	fs.Uint64Var(limit, "fd-limit", *limit, "<number>"+
+		"Raise the soft limit of open file descriptors to the specified value at startup, "+
+		"the value is capped at the hard limit. "+
+		"Zero keeps the limit set by the operating system, which is raised to the hard limit on most systems. ")
+
+	fs.Uint64Var(reserve, "fd-reserve", *reserve, "<number>"+
+		"Number of file descriptors reserved for files, DNS lookups, upstream connections and API server connections, "+
+		"which are never shed. "+
+		"New client connections are shed when the number of open connections reaches the soft limit minus the reserve. "+
+		"Zero sets the reserve to 10% of the soft limit, but not less than 64. ")
+
+	fs.BoolVar(guard, "fd-guard", *guard, ""+
+		"Shed new client connections when the process is about to run out of file descriptors. "+
+		"Plain HTTP clients get a 503 Service Unavailable response, TLS clients are disconnected. ")
+}
+
+func Autotune(fs *pflag.FlagSet, autotune *bool, bufferSize *forwarder.SizeSuffix) {
+	fs.BoolVar(autotune, "autotune", *autotune, ""+
+		"Derive buffer sizes, idle connection limits and cache sizes from the memory limit (GOMEMLIMIT) and the number of CPUs (GOMAXPROCS). "+
+		"If GOMEMLIMIT is not set, it is set to 90% of the container (cgroup) memory limit. "+
+		"If there is neither GOMEMLIMIT nor a container memory limit, or if disabled, static defaults are used. "+
+		"The derived values are logged at startup, the flags of the individual settings take precedence. ")
+
+	fs.Var(bufferSize, "buffer-size", "<size>"+
+		"Size of the buffers used to copy bodies and tunnel data, and of the read and write buffers of upstream connections. "+
+		"See --autotune for the default. ")
+}
+
+func APICORS(fs *pflag.FlagSet, origins *[]string) {
+	fs.Var(anyflag.NewSliceValue[string](*origins, origins, func(val string) (string, error) { return val, nil }),
+		"api-cors-origins", "<origin>,..."+
+			"Allow browsers to call the API from the specified origins e.g. https://dashboard.example.com. "+
+			"Use '*' to allow all origins. "+
+			"Preflight requests are answered without authentication, other requests require the API basic auth if it is enabled. ")
 }
 
 func HTTPServerConfig(fs *pflag.FlagSet, cfg *forwarder.HTTPServerConfig, prefix string, schemes ...forwarder.Scheme) {
@@ -315,12 +1321,13 @@ func HTTPServerConfig(fs *pflag.FlagSet, cfg *forwarder.HTTPServerConfig, prefix
 			return sb.String()
 		}
 
+		usage := "<" + supportedSchemesStr("|") + ">" +
+			"The server protocol. " +
+			"For https and h2 protocols, if TLS certificate is not specified, " +
+			"the server will use a self-signed certificate. "
 		fs.VarP(anyflag.NewValue[forwarder.Scheme](cfg.Protocol, &cfg.Protocol,
 			anyflag.EnumParser[forwarder.Scheme](schemes...)),
-			namePrefix+"protocol", "", "<"+supportedSchemesStr("|")+">"+
-				"The server protocol. "+
-				"For https and h2 protocols, if TLS certificate is not specified, "+
-				"the server will use a self-signed certificate. ")
+			namePrefix+"protocol", "", usage)
 
 		TLSServerConfig(fs, &cfg.TLSServerConfig, namePrefix)
 	}
@@ -413,6 +1420,53 @@ func HTTPLogConfig(fs *pflag.FlagSet, cfg []NamedParam[httplog.Mode]) {
 		"<code-block>--log-http=api:errors,proxy:headers,url</code-block>")
 }
 
+func LogRedact(fs *pflag.FlagSet, cfg *httplog.RedactConfig) {
+	fs.StringSliceVar(&cfg.Headers, "log-redact-headers", cfg.Headers, "<name>,..."+
+		"Redact values of the specified headers in HTTP request and response logs, see --log-http. "+
+		"By default, headers that commonly carry credentials are redacted. "+
+		"Set to an empty value to disable redaction. ")
+
+	fs.BoolVar(&cfg.Hash, "log-redact-hash", cfg.Hash, ""+
+		"Replace redacted header values with a truncated SHA-256 hash instead of a placeholder, "+
+		"so that requests with the same value can be correlated in logs. "+
+		"Note that low entropy values can be recovered from the hash. ")
+}
+
+func LogHTTPBody(fs *pflag.FlagSet, cfg *httplog.BodyConfig, domains *[]ruleset.RegexpListItem) {
+	fs.Var((*forwarder.SizeSuffix)(&cfg.MaxBytes), "log-http-body-max-size", "<size>"+
+		"Maximum size of a body logged in the body mode of --log-http, the rest is replaced with a truncation marker. "+
+		"Compressed bodies are decoded before logging. "+
+		"Zero means no limit. ")
+
+	fs.IntVar(&cfg.BinaryPreviewBytes, "log-http-body-binary-preview", cfg.BinaryPreviewBytes, "<bytes>"+
+		"Number of bytes of binary bodies logged as a hex dump in the body mode of --log-http. "+
+		"Bodies that are not valid UTF-8 text or contain control characters are considered binary. ")
+
+	fs.Var(anyflag.NewSliceValue[ruleset.RegexpListItem](*domains, domains, ruleset.ParseRegexpListItem),
+		"log-http-body-domains", "[-]<regexp>,..."+
+			"Log bodies only for requests to the specified domains in the body mode of --log-http, "+
+			"for other requests only the request line and headers are logged. "+
+			"Prefix domains with '-' to exclude requests to certain domains. ")
+}
+
+func LogHTTPFile(fs *pflag.FlagSet, file **os.File) {
+	fs.VarP(struct{ pflag.Value }{anyflag.NewValueWithRedact[*os.File](*file, file,
+		forwarder.OpenFileParser(log.DefaultFileFlags, log.DefaultFileMode, log.DefaultDirMode), DisplayFileName)},
+		"log-http-file", "", "<path>"+
+			"Path to the HTTP request log file, see --log-http. "+
+			"If empty, HTTP requests are logged to the application log. "+
+			"The file is reopened on SIGHUP to allow log rotation using external tools. ")
+}
+
+func LogHTTPFilter(fs *pflag.FlagSet, cfg *httplog.Filter) {
+	fs.Var(anyflag.NewSliceValue[httplog.Predicate](*cfg, (*[]httplog.Predicate)(cfg), httplog.ParsePredicate),
+		"log-http-filter", "[host=|path=|status=]<value>,..."+
+			"Log only requests matching all the predicates, see --log-http. "+
+			"The host and path predicates take a regexp matched against the request host without port, and the URL path. "+
+			"The status predicate takes a status code, a class such as 5xx, or a range such as 400-499. "+
+			"A regexp without a prefix is matched against the host and path concatenated, for example example\\.com/api/. ")
+}
+
 func TLSServerConfig(fs *pflag.FlagSet, cfg *forwarder.TLSServerConfig, namePrefix string) {
 	fs.DurationVar(&cfg.HandshakeTimeout,
 		namePrefix+"tls-handshake-timeout", cfg.HandshakeTimeout,
@@ -427,6 +1481,34 @@ func TLSServerConfig(fs *pflag.FlagSet, cfg *forwarder.TLSServerConfig, namePref
 		namePrefix+"tls-key-file", "<path or base64>"+
 			"TLS private key to use if the server protocol is https or h2. "+
 			pathOrBase64Syntax)
+
+	fs.Var(keyExchangeValue(&cfg.KeyExchange),
+		namePrefix+"tls-key-exchange", "<default|hybrid|classic>"+
+			"Key exchange mechanisms accepted if the server protocol is https or h2. "+
+			"Setting this to hybrid prefers the X25519MLKEM768 post-quantum hybrid key exchange, it requires Go 1.24 or later. "+
+			"Setting this to classic disables post-quantum key exchanges. "+
+			"The negotiated group is reported in the listener_tls_handshakes_total metric. ")
+}
+
+func TLSClientAuth(fs *pflag.FlagSet, cfg *forwarder.TLSServerConfig, namePrefix string) {
+	fs.Var(anyflag.NewValueWithRedact[string](cfg.ClientCAFile, &cfg.ClientCAFile, func(val string) (string, error) { return val, nil }, RedactBase64),
+		namePrefix+"tls-client-ca-file", "<path or base64>"+
+			"CA certificates to verify client certificates with if the server protocol is https. "+
+			"It requires --"+namePrefix+"tls-client-auth to be set to request or require. "+
+			pathOrBase64Syntax)
+
+	clientAuth := []forwarder.ClientAuth{
+		forwarder.ClientAuthNone,
+		forwarder.ClientAuthRequest,
+		forwarder.ClientAuthRequire,
+	}
+	fs.Var(anyflag.NewValue[forwarder.ClientAuth](cfg.ClientAuth, &cfg.ClientAuth, anyflag.EnumParser[forwarder.ClientAuth](clientAuth...)),
+		namePrefix+"tls-client-auth", "<none|request|require>"+
+			"Client certificate authentication if the server protocol is https. "+
+			"Setting this to request verifies the client certificate if the client presents one. "+
+			"Setting this to require rejects clients that do not present a valid certificate, "+
+			"so that only provisioned machines can use the proxy. "+
+			"The client certificate is available to request modifiers. ")
 }
 
 func LogConfig(fs *pflag.FlagSet, cfg *log.Config) {
@@ -446,6 +1528,14 @@ func LogConfig(fs *pflag.FlagSet, cfg *log.Config) {
 			"Log level. ")
 }
 
+func LogSink(fs *pflag.FlagSet, cfg *[]string) {
+	fs.StringSliceVar(cfg, "log-sink", *cfg, "<stdout-json|file:<path>|grpc://<host:port>|grpcs://<host:port>>,..."+
+		"Ship log messages as structured records to the specified sinks, in batches. "+
+		"The stdout-json sink writes newline delimited JSON to stdout, it replaces the text output unless --log-file is set. "+
+		"The file sink writes newline delimited JSON to a file. "+
+		"The grpc and grpcs sinks send records to a collector implementing the forwarder.log.v1.LogCollector service. ")
+}
+
 func MarkFlagHidden(cmd *cobra.Command, names ...string) {
 	for _, name := range names {
 		if err := cmd.Flags().MarkHidden(name); err != nil {
@@ -11,6 +11,7 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"text/template"
 
 	"github.com/saucelabs/forwarder/header"
 )
@@ -47,3 +48,17 @@ func DisplayFileName(f *os.File) string {
 	}
 	return f.Name()
 }
+
+func RedactSecret(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "xxxxx"
+}
+
+func DisplayTemplate(t *template.Template) string {
+	if t == nil || t.Tree == nil {
+		return ""
+	}
+	return t.Root.String()
+}
@@ -0,0 +1,238 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/log"
+)
+
+// BodyCaptureConfig configures capturing response bodies to files.
+// Only responses visible to the proxy are captured, i.e. plain HTTP and MITMed HTTPS responses.
+type BodyCaptureConfig struct {
+	// Dir is the spool directory, bodies are written to files in this directory,
+	// and the index manifest is written to the index.jsonl file.
+	Dir string
+
+	// Domains limits capture to responses for matching hosts, if nil all hosts are captured.
+	Domains Matcher
+
+	// ContentTypes limits capture to responses with matching media types, if empty all types are captured.
+	// An entry ending with "/" matches all subtypes e.g. "image/".
+	ContentTypes []string
+
+	// MaxBodySize is the maximum number of bytes captured per body, longer bodies are truncated.
+	// Zero means no limit.
+	MaxBodySize SizeSuffix
+
+	// MaxTotalSize is the maximum number of bytes captured in total, once reached capture stops.
+	// Zero means no limit.
+	MaxTotalSize SizeSuffix
+}
+
+func DefaultBodyCaptureConfig() *BodyCaptureConfig {
+	return &BodyCaptureConfig{
+		MaxBodySize:  10 * Mebi,
+		MaxTotalSize: 1 * Gibi,
+	}
+}
+
+func (c *BodyCaptureConfig) Validate() error {
+	if c.Dir == "" {
+		return errors.New("dir is required")
+	}
+	if c.MaxBodySize < 0 || c.MaxTotalSize < 0 {
+		return errors.New("size limits must not be negative")
+	}
+	return nil
+}
+
+// BodyCaptureEntry is a single entry in the body capture index manifest.
+type BodyCaptureEntry struct {
+	Time            time.Time `json:"time"`
+	ID              string    `json:"id"`
+	Method          string    `json:"method"`
+	URL             string    `json:"url"`
+	Status          int       `json:"status"`
+	ContentType     string    `json:"content_type,omitempty"`
+	ContentEncoding string    `json:"content_encoding,omitempty"`
+	File            string    `json:"file"`
+	Size            int64     `json:"size"`
+	Truncated       bool      `json:"truncated,omitempty"`
+}
+
+type bodyCapture struct {
+	config BodyCaptureConfig
+	log    log.Logger
+
+	seq   atomic.Uint64
+	total atomic.Int64
+	full  atomic.Bool
+
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newBodyCapture(cfg *BodyCaptureConfig, log log.Logger) (*bodyCapture, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	idx, err := os.OpenFile(filepath.Join(cfg.Dir, "index.jsonl"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &bodyCapture{
+		config: *cfg,
+		log:    log,
+		enc:    json.NewEncoder(idx),
+	}, nil
+}
+
+func (bc *bodyCapture) match(res *http.Response) bool {
+	if res.Body == nil || res.Body == http.NoBody || res.Request.Method == http.MethodHead {
+		return false
+	}
+	if bc.config.Domains != nil && !matchHost(bc.config.Domains, res.Request.URL.Hostname()) {
+		return false
+	}
+	if len(bc.config.ContentTypes) == 0 {
+		return true
+	}
+
+	mt, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	for _, ct := range bc.config.ContentTypes {
+		if mt == ct || (strings.HasSuffix(ct, "/") && strings.HasPrefix(mt, ct)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ModifyResponse wraps the response body so that it is written to a spool file as it is read by the client.
+func (bc *bodyCapture) ModifyResponse(res *http.Response) error {
+	if bc.full.Load() || !bc.match(res) {
+		return nil
+	}
+
+	name := fmt.Sprintf("%08d.body", bc.seq.Add(1))
+	f, err := os.Create(filepath.Join(bc.config.Dir, name))
+	if err != nil {
+		bc.log.Errorf("failed to create body capture file: %v", err)
+		return nil
+	}
+
+	req := res.Request
+	res.Body = &captureBody{
+		ReadCloser: res.Body,
+		bc:         bc,
+		f:          f,
+		e: BodyCaptureEntry{
+			Time:            time.Now().UTC(),
+			ID:              martian.ContextTraceID(req.Context()),
+			Method:          req.Method,
+			URL:             req.URL.Redacted(),
+			Status:          res.StatusCode,
+			ContentType:     res.Header.Get("Content-Type"),
+			ContentEncoding: res.Header.Get("Content-Encoding"),
+			File:            name,
+		},
+	}
+
+	return nil
+}
+
+// reserve returns the number of bytes up to n that can be captured without exceeding the total size limit.
+func (bc *bodyCapture) reserve(n int64) int64 {
+	if bc.config.MaxTotalSize == 0 {
+		return n
+	}
+	limit := int64(bc.config.MaxTotalSize)
+	for {
+		t := bc.total.Load()
+		r := max(min(n, limit-t), 0)
+		if !bc.total.CompareAndSwap(t, t+r) {
+			continue
+		}
+		if r < n && !bc.full.Swap(true) {
+			bc.log.Infof("body capture total size limit reached, capture stopped limit=%s", bc.config.MaxTotalSize)
+		}
+		return r
+	}
+}
+
+func (bc *bodyCapture) index(e *BodyCaptureEntry) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if err := bc.enc.Encode(e); err != nil {
+		bc.log.Errorf("failed to write body capture index entry: %v", err)
+	}
+}
+
+type captureBody struct {
+	io.ReadCloser
+	bc   *bodyCapture
+	f    *os.File
+	e    BodyCaptureEntry
+	once sync.Once
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.e.Truncated {
+		b.write(p[:n])
+	}
+	return n, err
+}
+
+func (b *captureBody) write(p []byte) {
+	w := int64(len(p))
+	if m := int64(b.bc.config.MaxBodySize); m > 0 && b.e.Size+w > m {
+		w = m - b.e.Size
+		b.e.Truncated = true
+	}
+	if w <= 0 {
+		return
+	}
+	if r := b.bc.reserve(w); r < w {
+		w = r
+		b.e.Truncated = true
+	}
+	if w == 0 {
+		return
+	}
+	if _, err := b.f.Write(p[:w]); err != nil {
+		b.bc.log.Errorf("failed to write body capture file %s: %v", b.e.File, err)
+		b.e.Truncated = true
+		return
+	}
+	b.e.Size += w
+}
+
+func (b *captureBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		if err := b.f.Close(); err != nil {
+			b.bc.log.Errorf("failed to close body capture file %s: %v", b.e.File, err)
+		}
+		b.bc.index(&b.e)
+	})
+	return err
+}
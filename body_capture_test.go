@@ -0,0 +1,102 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestBodyCapture(t *testing.T) {
+	cfg := DefaultBodyCaptureConfig()
+	cfg.Dir = t.TempDir()
+	cfg.ContentTypes = []string{"image/", "application/pdf"}
+	cfg.MaxBodySize = 8
+	cfg.MaxTotalSize = 12
+
+	bc, err := newBodyCapture(cfg, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(contentType, body string) {
+		t.Helper()
+
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/file", http.NoBody)
+		res := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {contentType}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}
+		if err := bc.ModifyResponse(res); err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != body {
+			t.Fatalf("body modified: got %q, want %q", b, body)
+		}
+		res.Body.Close()
+	}
+
+	send("text/html", "<html></html>")
+	send("image/png", "0123456789")
+	send("application/pdf; charset=binary", "abcdef")
+	send("image/jpeg", "xyz")
+
+	f, err := os.Open(filepath.Join(cfg.Dir, "index.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var entries []BodyCaptureEntry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e BodyCaptureEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+
+	want := []struct {
+		body      string
+		truncated bool
+	}{
+		{"01234567", true},
+		{"abcd", true},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries, want %d: %+v", len(entries), len(want), entries)
+	}
+	for i, w := range want {
+		e := entries[i]
+		b, err := os.ReadFile(filepath.Join(cfg.Dir, e.File))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != w.body || e.Size != int64(len(w.body)) || e.Truncated != w.truncated {
+			t.Errorf("entry %d: got body %q size %d truncated %v, want %q truncated %v", i, b, e.Size, e.Truncated, w.body, w.truncated)
+		}
+		if e.URL != "http://example.com/file" || e.Status != http.StatusOK {
+			t.Errorf("entry %d: unexpected entry %+v", i, e)
+		}
+	}
+}
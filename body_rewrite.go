@@ -0,0 +1,89 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// limitAcceptEncoding limits Accept-Encoding to gzip, so that the response body can be decoded for rewriting.
+// Requests of clients that do not accept gzip are not modified.
+func limitAcceptEncoding(req *http.Request) {
+	if ae := req.Header.Get("Accept-Encoding"); ae != "" && ae != "gzip" && strings.Contains(ae, "gzip") {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+}
+
+// readBodyForRewrite reads and decodes the response body if it is at most limit bytes.
+// It returns false if the body cannot be rewritten, in that case the response body is restored.
+// On success the response body is consumed and Content-Encoding is removed, call setRewrittenBody to set the new body.
+func readBodyForRewrite(res *http.Response, limit int64) ([]byte, bool, error) {
+	ce := strings.ToLower(res.Header.Get("Content-Encoding"))
+	if ce != "" && ce != "identity" && ce != "gzip" {
+		return nil, false, nil
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(res.Body, limit+1))
+	if err != nil {
+		return nil, false, fmt.Errorf("read body: %w", err)
+	}
+	if int64(len(raw)) > limit {
+		res.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(raw), res.Body), res.Body}
+		return nil, false, nil
+	}
+	res.Body.Close()
+
+	body := raw
+	if ce == "gzip" {
+		body, err = gunzip(raw, limit)
+		if err != nil {
+			res.Body = io.NopCloser(bytes.NewReader(raw))
+			return nil, false, nil
+		}
+		res.Header.Del("Content-Encoding")
+	}
+
+	return body, true, nil
+}
+
+// setRewrittenBody sets the response body and the headers describing it.
+func setRewrittenBody(res *http.Response, body []byte) {
+	// The content changed, validators of the original content no longer apply.
+	res.Header.Del("ETag")
+	res.Header.Del("Content-MD5")
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	res.ContentLength = int64(len(body))
+	res.TransferEncoding = nil
+	res.Body = io.NopCloser(bytes.NewReader(body))
+}
+
+func gunzip(b []byte, limit int64) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	out, err := io.ReadAll(io.LimitReader(zr, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > limit {
+		return nil, errors.New("decoded body too large")
+	}
+	return out, nil
+}
@@ -0,0 +1,21 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package cgroup provides access to the resource limits of the Linux control group of the process.
+// Both cgroup v2 (unified) and v1 hierarchies mounted at /sys/fs/cgroup are supported,
+// in a container the cgroup namespace makes the container cgroup the root.
+package cgroup
+
+import (
+	"errors"
+)
+
+var ErrUnsupported = errors.New("cgroups are not supported on this platform")
+
+// MemoryLimit returns the memory limit in bytes, or 0 if there is no limit.
+func MemoryLimit() (uint64, error) {
+	return memoryLimit()
+}
@@ -0,0 +1,60 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+//go:build linux
+
+package cgroup
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var memoryLimitFiles = []string{
+	"/sys/fs/cgroup/memory.max",                   // v2
+	"/sys/fs/cgroup/memory/memory.limit_in_bytes", // v1
+}
+
+func memoryLimit() (uint64, error) {
+	for _, name := range memoryLimitFiles {
+		b, err := os.ReadFile(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		n, err := parseLimit(string(b))
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", name, err)
+		}
+		return n, nil
+	}
+	return 0, nil
+}
+
+// unlimited is the threshold above which a v1 limit means no limit,
+// the kernel reports the maximum value rounded down to the page size.
+const unlimited = 1 << 62
+
+func parseLimit(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if s == "max" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n >= unlimited {
+		return 0, nil
+	}
+	return n, nil
+}
@@ -0,0 +1,40 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+//go:build linux
+
+package cgroup
+
+import "testing"
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		input string
+		want  uint64
+		err   bool
+	}{
+		{input: "max\n", want: 0},
+		{input: "268435456\n", want: 256 << 20},
+		{input: "9223372036854771712\n", want: 0},
+		{input: "foo", err: true},
+	}
+	for _, tc := range tests {
+		got, err := parseLimit(tc.input)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected error", tc.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.input, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%q: got %d, want %d", tc.input, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ClientCertificate is a TLS client certificate presented to servers with names matching Host.
+type ClientCertificate struct {
+	Host     *regexp.Regexp
+	CertFile string
+	KeyFile  string
+}
+
+// ParseClientCertificate parses <host-regexp>=<cert-file>:<key-file> string into ClientCertificate.
+func ParseClientCertificate(val string) (ClientCertificate, error) {
+	host, files, ok := strings.Cut(val, "=")
+	if !ok {
+		return ClientCertificate{}, errors.New("expected <host-regexp>=<cert-file>:<key-file>")
+	}
+	re, err := regexp.Compile(host)
+	if err != nil {
+		return ClientCertificate{}, fmt.Errorf("host: %w", err)
+	}
+	// Split on the last colon, so that Windows paths with a drive letter are supported for the certificate.
+	i := strings.LastIndexByte(files, ':')
+	if i <= 0 || i == len(files)-1 {
+		return ClientCertificate{}, errors.New("expected <host-regexp>=<cert-file>:<key-file>")
+	}
+
+	return ClientCertificate{
+		Host:     re,
+		CertFile: files[:i],
+		KeyFile:  files[i+1:],
+	}, nil
+}
+
+func (c ClientCertificate) String() string {
+	return c.Host.String() + "=" + c.CertFile + ":" + c.KeyFile
+}
+
+type clientCertSource struct {
+	match func(host string) bool
+	get   func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+
+	// verify, if set, replaces the default server certificate verification.
+	verify func(rawCerts [][]byte, _ [][]*x509.Certificate) error
+}
+
+// clientCertificates selects the client certificate by the server name.
+type clientCertificates struct {
+	sources []clientCertSource
+}
+
+func loadClientCertificates(cfg *HTTPTransportConfig) (*clientCertificates, error) {
+	if len(cfg.ClientCertificates) == 0 && cfg.SPIFFE == nil {
+		return nil, nil //nolint:nilnil // no client certificates
+	}
+
+	c := new(clientCertificates)
+
+	// SPIFFE takes precedence, so that mesh services are verified against the SPIFFE trust bundles.
+	if src := cfg.SPIFFE; src != nil {
+		match := func(string) bool { return true }
+		if cfg.SPIFFEDomains != nil {
+			match = cfg.SPIFFEDomains.Match
+		}
+		c.sources = append(c.sources, clientCertSource{
+			match:  match,
+			get:    src.GetClientCertificate,
+			verify: src.VerifyPeerCertificate(nil),
+		})
+	}
+
+	for _, v := range cfg.ClientCertificates {
+		cert, err := loadX509KeyPair(v.CertFile, v.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", v.Host, err)
+		}
+		c.sources = append(c.sources, clientCertSource{
+			match: v.Host.MatchString,
+			get: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &cert, nil
+			},
+		})
+	}
+
+	return c, nil
+}
+
+// configure sets the client certificate for host in tlsCfg.
+// If no source matches, the certificates configured in tlsCfg are used.
+func (c *clientCertificates) configure(tlsCfg *tls.Config, host string) {
+	if c == nil {
+		return
+	}
+	host = NormalizeHost(host)
+	for _, s := range c.sources {
+		if s.match(host) {
+			tlsCfg.Certificates = nil
+			tlsCfg.GetClientCertificate = s.get
+			if s.verify != nil {
+				tlsCfg.InsecureSkipVerify = true
+				tlsCfg.VerifyPeerCertificate = s.verify
+			}
+			return
+		}
+	}
+}
+
+type tlsNextProtosKey struct{}
+
+// withTLSNextProtos overrides the ALPN protocols offered by TLS dialers for connections dialed with ctx.
+func withTLSNextProtos(ctx context.Context, protos []string) context.Context {
+	return context.WithValue(ctx, tlsNextProtosKey{}, protos)
+}
+
+func configureTLSNextProtos(ctx context.Context, cfg *tls.Config) {
+	if protos, ok := ctx.Value(tlsNextProtosKey{}).([]string); ok {
+		cfg.NextProtos = protos
+	}
+}
+
+// tlsDialer dials TLS connections with per-host client certificates.
+type tlsDialer struct {
+	dial             dialContextFunc
+	tlsConfig        func() *tls.Config
+	clientCerts      *clientCertificates
+	handshakeTimeout time.Duration
+}
+
+func (d *tlsDialer) DialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := d.dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.handshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.handshakeTimeout)
+		defer cancel()
+	}
+
+	cfg := d.tlsConfig().Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	d.clientCerts.configure(cfg, cfg.ServerName)
+	configureTLSNextProtos(ctx, cfg)
+
+	tc := tls.Client(conn, cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tc, nil
+}
@@ -0,0 +1,201 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"github.com/saucelabs/forwarder/utils/certutil"
+)
+
+func TestParseClientCertificate(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+		err bool
+	}{
+		{in: `api\.example\.com=/etc/cert.pem:/etc/key.pem`, out: `api\.example\.com=/etc/cert.pem:/etc/key.pem`},
+		{in: `.*=C:\cert.pem:C:\key.pem`, out: `.*=C:\cert.pem:C:\key.pem`},
+		{in: `api\.example\.com=/etc/cert.pem`, err: true},
+		{in: `api\.example\.com=/etc/cert.pem:`, err: true},
+		{in: `api.example.com`, err: true},
+		{in: `(=/etc/cert.pem:/etc/key.pem`, err: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.in, func(t *testing.T) {
+			c, err := ParseClientCertificate(tc.in)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.String(); got != tc.out {
+				t.Fatalf("got %q, want %q", got, tc.out)
+			}
+		})
+	}
+}
+
+func writeClientCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+
+	c, err := certutil.ECDSASelfSignedCert().Gen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(c.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestHTTPTransportClientCertificates(t *testing.T) {
+	certFile, keyFile := writeClientCert(t, t.TempDir())
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	s.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	s.StartTLS()
+	defer s.Close()
+
+	tests := []struct {
+		name   string
+		host   string
+		status int
+	}{
+		{name: "match", host: `127\.0\.0\.1`, status: http.StatusOK},
+		{name: "no match", host: `example\.com`, status: http.StatusUnauthorized},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultHTTPTransportConfig()
+			cfg.Insecure = true
+			cfg.ClientCertificates = []ClientCertificate{{
+				Host:     regexp.MustCompile(tc.host),
+				CertFile: certFile,
+				KeyFile:  keyFile,
+			}}
+			tr, err := NewHTTPTransport(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tr.CloseIdleConnections()
+
+			req, err := http.NewRequest(http.MethodGet, s.URL, http.NoBody)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != tc.status {
+				t.Fatalf("got status %d, want %d", res.StatusCode, tc.status)
+			}
+		})
+	}
+}
+
+func TestHTTPProxyMITMClientCertificates(t *testing.T) {
+	certFile, keyFile := writeClientCert(t, t.TempDir())
+
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	origin.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	origin.StartTLS()
+	defer origin.Close()
+
+	tcfg := DefaultHTTPTransportConfig()
+	tcfg.Insecure = true
+	tcfg.ClientCertificates = []ClientCertificate{{
+		Host:     regexp.MustCompile(`127\.0\.0\.1`),
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	}}
+	rt, err := NewHTTPTransport(tcfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rt.CloseIdleConnections()
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.Address = "localhost:0"
+	cfg.PromRegistry = prometheus.NewRegistry()
+	cfg.ProxyLocalhost = AllowProxyLocalhost
+	cfg.MITM = DefaultMITMConfig()
+
+	p, err := NewHTTPProxy(cfg, nil, nil, rt, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx) //nolint:errcheck // returns on cancel
+
+	addrs, _ := p.Addr()
+	tr := &http.Transport{
+		Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: addrs[0]}),
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true, //nolint:gosec // MITM certificate
+		},
+	}
+	defer tr.CloseIdleConnections()
+
+	req, err := http.NewRequest(http.MethodGet, origin.URL, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", res.StatusCode, http.StatusOK)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/saucelabs/forwarder/log"
+)
+
+// ClientTransport is an http.RoundTripper that sends requests through an in-process proxy.
+// It applies the same policy as the proxy server, i.e. credentials, header modifiers, deny and direct rules,
+// PAC or upstream proxy selection, MITM and metrics, without listening on a port.
+// Connections to the proxy are in-memory pipes, see MemListener.
+type ClientTransport struct {
+	*http.Transport
+
+	proxy  *HTTPProxy
+	cancel context.CancelFunc
+	errCh  chan error
+}
+
+// NewClientTransport returns a transport that sends requests through a proxy configured with cfg.
+// The arguments are the same as for NewHTTPProxy, the listener configuration in cfg is ignored.
+// If the proxy uses MITM, the transport trusts the MITM CA certificate in addition to the system roots.
+// It is the caller's responsibility to call Close on the returned transport.
+func NewClientTransport(cfg *HTTPProxyConfig, pr PACResolver, cm *CredentialsMatcher, rt http.RoundTripper, log log.Logger) (*ClientTransport, error) {
+	ml := NewMemListener("client-transport")
+
+	c := *cfg
+	c.Protocol = HTTPScheme
+	c.Address = ml.Addr().String()
+	c.ExtraListeners = nil
+	c.Listener = ml
+
+	hp, err := NewHTTPProxy(&c, pr, cm, rt, log)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		hp.Close()
+		return nil, fmt.Errorf("system cert pool: %w", err)
+	}
+	if ca := hp.MITMCACert(); ca != nil {
+		pool.AddCert(ca)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &ClientTransport{
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(&url.URL{
+				Scheme: string(HTTPScheme),
+				Host:   ml.Addr().String(),
+				User:   c.BasicAuth,
+			}),
+			DialContext: ml.DialContext,
+			TLSClientConfig: &tls.Config{
+				RootCAs:    pool,
+				MinVersion: tls.VersionTLS12,
+			},
+		},
+		proxy:  hp,
+		cancel: cancel,
+		errCh:  make(chan error, 1),
+	}
+	go func() {
+		t.errCh <- hp.Run(ctx)
+	}()
+
+	return t, nil
+}
+
+// Proxy returns the in-process proxy.
+func (t *ClientTransport) Proxy() *HTTPProxy {
+	return t.proxy
+}
+
+// Close closes idle connections and stops the in-process proxy.
+func (t *ClientTransport) Close() error {
+	t.Transport.CloseIdleConnections()
+	t.cancel()
+
+	err := <-t.errCh
+	if errors.Is(err, context.Canceled) {
+		err = nil
+	}
+	return err
+}
@@ -0,0 +1,64 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestClientTransport(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Got-Header", req.Header.Get("X-Forwarder"))
+	}))
+	defer origin.Close()
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.ProxyLocalhost = AllowProxyLocalhost
+	cfg.DenyDomains = MatchFunc(func(s string) bool { return s == "denied" })
+	cfg.RequestModifiers = []RequestModifier{
+		RequestModifierFunc(func(req *http.Request) error {
+			req.Header.Set("X-Forwarder", "true")
+			return nil
+		}),
+	}
+
+	tr, err := NewClientTransport(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := tr.Close(); err != nil {
+			t.Errorf("Close(): %v", err)
+		}
+	}()
+	c := &http.Client{Transport: tr}
+
+	res, err := c.Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, res.StatusCode)
+	}
+	if got := res.Header.Get("Got-Header"); got != "true" {
+		t.Fatalf("expected request modifier to be applied, got %q", got)
+	}
+
+	res, err = c.Get("http://denied")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected %d, got %d", http.StatusForbidden, res.StatusCode)
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package cluster coordinates multiple forwarder instances sharing a Redis server.
+package cluster
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/redis"
+	"github.com/saucelabs/forwarder/log"
+)
+
+// Leader elects a single leader among instances using a lease key in Redis.
+// The leader renews the lease every TTL/3, if it fails to do so, another instance takes over after TTL.
+// Election is best effort, for a short time there may be no leader or, in rare cases, two leaders.
+// It is meant to avoid duplicate work, not to guarantee mutual exclusion.
+type Leader struct {
+	c      *redis.Client
+	key    string
+	id     string
+	ttl    time.Duration
+	log    log.Logger
+	leader atomic.Bool
+}
+
+// NewLeader returns a Leader for the Redis URL redis://[[user]:password@]host[:port][/db],
+// instances with the same name compete for the same lease.
+func NewLeader(u *url.URL, name string, ttl time.Duration, log log.Logger) (*Leader, error) {
+	c, err := redis.NewClient(u)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Leader{
+		c:   c,
+		key: "forwarder:leader:" + name,
+		id:  instanceID(),
+		ttl: ttl,
+		log: log,
+	}, nil
+}
+
+func instanceID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	h, _ := os.Hostname()
+	return h + "-" + hex.EncodeToString(b)
+}
+
+// ID returns the identifier of this instance stored in the lease.
+func (l *Leader) ID() string {
+	return l.id
+}
+
+// IsLeader returns true if this instance holds the lease.
+func (l *Leader) IsLeader() bool {
+	return l.leader.Load()
+}
+
+// Campaign tries to acquire or renew the lease once.
+func (l *Leader) Campaign(ctx context.Context) error {
+	ttl := strconv.FormatInt(l.ttl.Milliseconds(), 10)
+
+	replies, err := l.c.Do(ctx, []string{"SET", l.key, l.id, "NX", "PX", ttl})
+	if err != nil {
+		l.setLeader(false)
+		return err
+	}
+	if !replies[0].Nil {
+		l.setLeader(true)
+		return nil
+	}
+
+	replies, err = l.c.Do(ctx, []string{"GET", l.key})
+	if err != nil {
+		l.setLeader(false)
+		return err
+	}
+	if replies[0].Nil || replies[0].Value != l.id {
+		l.setLeader(false)
+		return nil
+	}
+
+	// The lease may expire between GET and PEXPIRE, and be taken by another instance.
+	// In that case its lease is extended, and this instance steps down in the next round.
+	if _, err := l.c.Do(ctx, []string{"PEXPIRE", l.key, ttl}); err != nil {
+		l.setLeader(false)
+		return err
+	}
+	l.setLeader(true)
+
+	return nil
+}
+
+func (l *Leader) setLeader(v bool) {
+	if l.leader.Swap(v) != v {
+		if v {
+			l.log.Infof("became leader id=%s", l.id)
+		} else {
+			l.log.Infof("lost leadership id=%s", l.id)
+		}
+	}
+}
+
+// Run campaigns every TTL/3 until ctx is done, on exit it releases the lease if held.
+func (l *Leader) Run(ctx context.Context) error {
+	t := time.NewTicker(l.ttl / 3)
+	defer t.Stop()
+
+	for {
+		if err := l.Campaign(ctx); err != nil && ctx.Err() == nil {
+			l.log.Errorf("leader election: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			l.release()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+func (l *Leader) release() {
+	if !l.leader.Load() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	replies, err := l.c.Do(ctx, []string{"GET", l.key})
+	if err == nil && !replies[0].Nil && replies[0].Value == l.id {
+		_, err = l.c.Do(ctx, []string{"DEL", l.key})
+	}
+	if err != nil {
+		l.log.Errorf("release leadership: %s", err)
+	}
+	l.setLeader(false)
+}
+
+// Close closes connections to Redis.
+func (l *Leader) Close() error {
+	return l.c.Close()
+}
+
+// Fetch returns the result of fetch shared by all instances under key.
+// The leader calls fetch and publishes the result, followers read the published value.
+// If the value was not published yet, e.g. at startup, followers call fetch.
+// Published values expire after ttl.
+// Errors talking to Redis are logged, and do not fail the fetch.
+func (l *Leader) Fetch(ctx context.Context, key string, ttl time.Duration, fetch func(context.Context) ([]byte, error)) ([]byte, error) {
+	key = "forwarder:shared:" + key
+
+	if !l.IsLeader() {
+		replies, err := l.c.Do(ctx, []string{"GET", key})
+		if err != nil {
+			l.log.Errorf("read shared value %s, fetching: %s", key, err)
+		} else if !replies[0].Nil {
+			return []byte(replies[0].Value), nil
+		}
+		return fetch(ctx)
+	}
+
+	b, err := fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := l.c.Do(ctx, []string{"SET", key, string(b), "PX", strconv.FormatInt(ttl.Milliseconds(), 10)}); err != nil {
+		l.log.Errorf("publish shared value %s: %s", key, err)
+	}
+
+	return b, nil
+}
+
+// GetOrSet returns the value shared by all instances under key.
+// The first instance to store the value wins, other instances get the stored value.
+// Stored values expire after ttl.
+func (l *Leader) GetOrSet(ctx context.Context, key string, ttl time.Duration, value func() []byte) ([]byte, error) {
+	key = "forwarder:shared:" + key
+
+	v := value()
+	replies, err := l.c.Do(ctx, []string{"SET", key, string(v), "NX", "PX", strconv.FormatInt(ttl.Milliseconds(), 10)})
+	if err != nil {
+		return nil, err
+	}
+	if !replies[0].Nil {
+		return v, nil
+	}
+
+	replies, err = l.c.Do(ctx, []string{"GET", key})
+	if err != nil {
+		return nil, err
+	}
+	// The value expired between SET and GET.
+	if replies[0].Nil {
+		return v, nil
+	}
+	return []byte(replies[0].Value), nil
+}
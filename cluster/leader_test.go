@@ -0,0 +1,149 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package cluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/redis/redistest"
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestLeader(t *testing.T) {
+	s, err := redistest.NewServer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	newLeader := func() *Leader {
+		l, err := NewLeader(s.URL(""), "test", time.Minute, stdlog.Default())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		return l
+	}
+	a, b := newLeader(), newLeader()
+
+	ctx := context.Background()
+	for range 2 {
+		if err := a.Campaign(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Campaign(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if !a.IsLeader() || b.IsLeader() {
+			t.Fatalf("expected a to be the leader, got a=%t b=%t", a.IsLeader(), b.IsLeader())
+		}
+	}
+
+	// Lease expired, b takes over.
+	s.Expire("forwarder:leader:test")
+	if err := b.Campaign(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Campaign(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if a.IsLeader() || !b.IsLeader() {
+		t.Fatalf("expected b to be the leader, got a=%t b=%t", a.IsLeader(), b.IsLeader())
+	}
+
+	// Leader releases the lease on exit.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	b.Run(cctx)
+	if _, ok := s.Get("forwarder:leader:test"); ok {
+		t.Fatal("expected lease to be released")
+	}
+}
+
+func TestLeaderFetch(t *testing.T) {
+	s, err := redistest.NewServer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	leader, err := NewLeader(s.URL(""), "test", time.Minute, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+	follower, err := NewLeader(s.URL(""), "test", time.Minute, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+
+	ctx := context.Background()
+	leader.Campaign(ctx)
+	follower.Campaign(ctx)
+
+	calls := 0
+	fetch := func(v string) func(context.Context) ([]byte, error) {
+		return func(context.Context) ([]byte, error) {
+			calls++
+			return []byte(v), nil
+		}
+	}
+
+	// Not published yet, the follower fetches on its own.
+	if b, err := follower.Fetch(ctx, "pac", time.Minute, fetch("follower")); err != nil || string(b) != "follower" {
+		t.Fatalf("Fetch() = %q, %v", b, err)
+	}
+	if b, err := leader.Fetch(ctx, "pac", time.Minute, fetch("leader")); err != nil || string(b) != "leader" {
+		t.Fatalf("Fetch() = %q, %v", b, err)
+	}
+	if b, err := follower.Fetch(ctx, "pac", time.Minute, fetch("follower")); err != nil || string(b) != "leader" {
+		t.Fatalf("Fetch() = %q, %v", b, err)
+	}
+	if calls != 2 {
+		t.Fatalf("expected 2 fetches, got %d", calls)
+	}
+}
+
+func TestLeaderGetOrSet(t *testing.T) {
+	s, err := redistest.NewServer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	a, err := NewLeader(s.URL(""), "test", time.Minute, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := NewLeader(s.URL(""), "test", time.Minute, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	ctx := context.Background()
+	value := func(v string) func() []byte {
+		return func() []byte { return []byte(v) }
+	}
+
+	if v, err := a.GetOrSet(ctx, "key", time.Minute, value("a")); err != nil || string(v) != "a" {
+		t.Fatalf("GetOrSet() = %q, %v", v, err)
+	}
+	if v, err := b.GetOrSet(ctx, "key", time.Minute, value("b")); err != nil || string(v) != "a" {
+		t.Fatalf("GetOrSet() = %q, %v", v, err)
+	}
+
+	// Value expired, b stores a new one.
+	s.Expire("forwarder:shared:key")
+	if v, err := b.GetOrSet(ctx, "key", time.Minute, value("b")); err != nil || string(v) != "b" {
+		t.Fatalf("GetOrSet() = %q, %v", v, err)
+	}
+}
@@ -9,7 +9,10 @@ package main
 import (
 	"fmt"
 	"os"
+	"runtime/debug"
+	"strconv"
 
+	"github.com/saucelabs/forwarder/cgroup"
 	"github.com/saucelabs/forwarder/command/forwarder"
 	"go.uber.org/automaxprocs/maxprocs"
 )
@@ -19,7 +22,7 @@ func main() {
 		fmt.Fprintf(os.Stderr, "failed to set GOMAXPROCS: %v\n", err)
 	}
 	if _, ok := os.LookupEnv("GOMEMLIMIT"); !ok {
-		os.Setenv("GOMEMLIMIT", "250MiB")
+		setMemoryLimit()
 	}
 
 	if err := forwarder.Command().Execute(); err != nil {
@@ -27,3 +30,16 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// setMemoryLimit sets GOMEMLIMIT to 90% of the container memory limit,
+// leaving headroom for memory not managed by the Go runtime.
+// If there is no container memory limit, GOMEMLIMIT is left unset.
+func setMemoryLimit() {
+	n, err := cgroup.MemoryLimit()
+	if err != nil || n == 0 {
+		return
+	}
+	limit := int64(n / 10 * 9) //nolint:gosec // cgroup limits are below 1<<62
+	debug.SetMemoryLimit(limit)
+	os.Setenv("GOMEMLIMIT", strconv.FormatInt(limit, 10)+"B")
+}
@@ -0,0 +1,189 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// RequestCollapsingConfig configures collapsing of identical in-flight requests.
+// When enabled, concurrent GET and HEAD requests without body that have the same key
+// are sent upstream once, and the response is shared between all the clients.
+type RequestCollapsingConfig struct {
+	// KeyHeaders are the request headers that are part of the key in addition to the method and URL.
+	// Requests that differ in any of the headers are not collapsed.
+	KeyHeaders []string
+
+	// MaxBodySize is the maximum size of a response body that can be shared.
+	// Responses with a larger or unknown content length are not shared,
+	// the waiting requests are sent upstream on their own.
+	// Responses that may be specific to a client, i.e. with Set-Cookie, Vary,
+	// or Cache-Control private or no-store, are never shared.
+	MaxBodySize SizeSuffix
+}
+
+func DefaultRequestCollapsingConfig() *RequestCollapsingConfig {
+	return &RequestCollapsingConfig{
+		KeyHeaders:  []string{"Accept", "Accept-Encoding", "Authorization", "Cookie", "Range"},
+		MaxBodySize: 10 * Mebi,
+	}
+}
+
+func (c *RequestCollapsingConfig) Validate() error {
+	if c.MaxBodySize <= 0 {
+		return errors.New("max body size must be positive")
+	}
+	return nil
+}
+
+type collapseCall struct {
+	done chan struct{}
+	res  *http.Response
+	body []byte
+}
+
+type collapsingTransport struct {
+	rt        http.RoundTripper
+	config    RequestCollapsingConfig
+	collapsed func()
+
+	mu    sync.Mutex
+	calls map[string]*collapseCall
+}
+
+func newCollapsingTransport(rt http.RoundTripper, cfg *RequestCollapsingConfig, collapsed func()) *collapsingTransport {
+	return &collapsingTransport{
+		rt:        rt,
+		config:    *cfg,
+		collapsed: collapsed,
+		calls:     make(map[string]*collapseCall),
+	}
+}
+
+func (t *collapsingTransport) key(req *http.Request) string {
+	var sb strings.Builder
+	sb.WriteString(req.Method)
+	sb.WriteByte(' ')
+	sb.WriteString(req.URL.String())
+	for _, h := range t.config.KeyHeaders {
+		sb.WriteByte('\n')
+		sb.WriteString(h)
+		sb.WriteByte(':')
+		sb.WriteString(strings.Join(req.Header.Values(h), ","))
+	}
+	return sb.String()
+}
+
+func (t *collapsingTransport) collapsible(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	return req.Header.Get("Upgrade") == ""
+}
+
+func (t *collapsingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.collapsible(req) {
+		return t.rt.RoundTrip(req)
+	}
+
+	key := t.key(req)
+
+	t.mu.Lock()
+	if c, ok := t.calls[key]; ok {
+		t.mu.Unlock()
+		return t.wait(c, req)
+	}
+	c := &collapseCall{
+		done: make(chan struct{}),
+	}
+	t.calls[key] = c
+	t.mu.Unlock()
+
+	res, err := t.rt.RoundTrip(req)
+	if err == nil {
+		res, err = t.share(c, res)
+	}
+
+	t.mu.Lock()
+	delete(t.calls, key)
+	t.mu.Unlock()
+	close(c.done)
+
+	return res, err
+}
+
+// share reads the response body if it can be shared and sets the call result.
+func (t *collapsingTransport) share(c *collapseCall, res *http.Response) (*http.Response, error) {
+	if res.ContentLength < 0 || res.ContentLength > int64(t.config.MaxBodySize) || !shareable(res) {
+		return res, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, res.ContentLength))
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// The response is modified by the proxy after it is returned, share a copy.
+	shared := *res
+	shared.Header = res.Header.Clone()
+	shared.Trailer = res.Trailer.Clone()
+	c.res = &shared
+	c.body = body
+	res.Body = io.NopCloser(bytes.NewReader(body))
+
+	return res, nil
+}
+
+// shareable returns false if the response may be specific to the client that requested it.
+func shareable(res *http.Response) bool {
+	if len(res.Header.Values("Set-Cookie")) > 0 || len(res.Header.Values("Vary")) > 0 {
+		return false
+	}
+	for _, v := range res.Header.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, _, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if strings.EqualFold(name, "private") || strings.EqualFold(name, "no-store") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (t *collapsingTransport) wait(c *collapseCall, req *http.Request) (*http.Response, error) {
+	select {
+	case <-c.done:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+
+	if c.res == nil {
+		return t.rt.RoundTrip(req)
+	}
+
+	if t.collapsed != nil {
+		t.collapsed()
+	}
+
+	res := new(http.Response)
+	*res = *c.res
+	res.Header = c.res.Header.Clone()
+	res.Trailer = c.res.Trailer.Clone()
+	res.Body = io.NopCloser(bytes.NewReader(c.body))
+	res.Request = req
+
+	return res, nil
+}
@@ -0,0 +1,186 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type blockingTransport struct {
+	calls   atomic.Int32
+	started chan struct{}
+	release chan struct{}
+	length  int64
+	header  http.Header
+}
+
+func (t *blockingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.calls.Add(1) == 1 {
+		close(t.started)
+	}
+	<-t.release
+	h := http.Header{"Content-Type": {"text/plain"}}
+	for k, v := range t.header {
+		h[k] = v
+	}
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        h,
+		Body:          io.NopCloser(strings.NewReader("hello")),
+		ContentLength: t.length,
+		Request:       req,
+	}, nil
+}
+
+func TestCollapsingTransport(t *testing.T) {
+	tests := []struct {
+		name      string
+		length    int64
+		header    func(i int) http.Header
+		resHeader http.Header
+		wantCalls int32
+	}{
+		{
+			name:      "collapsed",
+			length:    5,
+			header:    func(int) http.Header { return http.Header{} },
+			wantCalls: 1,
+		},
+		{
+			name:      "unknown length",
+			length:    -1,
+			header:    func(int) http.Header { return http.Header{} },
+			wantCalls: 5,
+		},
+		{
+			name:   "different key headers",
+			length: 5,
+			header: func(i int) http.Header {
+				return http.Header{"Authorization": {"Bearer " + strings.Repeat("x", i)}}
+			},
+			wantCalls: 5,
+		},
+		{
+			name:      "set cookie",
+			length:    5,
+			header:    func(int) http.Header { return http.Header{} },
+			resHeader: http.Header{"Set-Cookie": {"session=1"}},
+			wantCalls: 5,
+		},
+		{
+			name:      "cache control private",
+			length:    5,
+			header:    func(int) http.Header { return http.Header{} },
+			resHeader: http.Header{"Cache-Control": {"max-age=60, Private"}},
+			wantCalls: 5,
+		},
+		{
+			name:      "cache control private field",
+			length:    5,
+			header:    func(int) http.Header { return http.Header{} },
+			resHeader: http.Header{"Cache-Control": {`private="Set-Cookie"`}},
+			wantCalls: 5,
+		},
+		{
+			name:      "cache control no store",
+			length:    5,
+			header:    func(int) http.Header { return http.Header{} },
+			resHeader: http.Header{"Cache-Control": {"no-store"}},
+			wantCalls: 5,
+		},
+		{
+			name:      "cache control public",
+			length:    5,
+			header:    func(int) http.Header { return http.Header{} },
+			resHeader: http.Header{"Cache-Control": {"public, max-age=60"}},
+			wantCalls: 1,
+		},
+		{
+			name:      "vary",
+			length:    5,
+			header:    func(int) http.Header { return http.Header{} },
+			resHeader: http.Header{"Vary": {"User-Agent"}},
+			wantCalls: 5,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			bt := &blockingTransport{
+				started: make(chan struct{}),
+				release: make(chan struct{}),
+				length:  tc.length,
+				header:  tc.resHeader,
+			}
+			var collapsed atomic.Int32
+			ct := newCollapsingTransport(bt, DefaultRequestCollapsingConfig(), func() { collapsed.Add(1) })
+
+			const n = 5
+			var wg sync.WaitGroup
+			bodies := make([]string, n)
+			do := func(i int) {
+				defer wg.Done()
+				req := httptest.NewRequest(http.MethodGet, "http://example.com/file", http.NoBody)
+				req.Header = tc.header(i)
+				res, err := ct.RoundTrip(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				b, _ := io.ReadAll(res.Body)
+				res.Body.Close()
+				bodies[i] = string(b)
+			}
+
+			wg.Add(1)
+			go do(0)
+			<-bt.started
+			for i := 1; i < n; i++ {
+				wg.Add(1)
+				go do(i)
+			}
+			// Let the other requests reach the transport.
+			time.Sleep(50 * time.Millisecond)
+			close(bt.release)
+			wg.Wait()
+
+			if got := bt.calls.Load(); got != tc.wantCalls {
+				t.Errorf("got %d upstream calls, want %d", got, tc.wantCalls)
+			}
+			if got, want := collapsed.Load(), n-bt.calls.Load(); got != want {
+				t.Errorf("got %d collapsed requests, want %d", got, want)
+			}
+			for i, b := range bodies {
+				if b != "hello" {
+					t.Errorf("request %d: got body %q", i, b)
+				}
+			}
+		})
+	}
+}
+
+func TestCollapsingTransportSkipsNonIdempotent(t *testing.T) {
+	bt := &blockingTransport{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+		length:  5,
+	}
+	close(bt.release)
+	ct := newCollapsingTransport(bt, DefaultRequestCollapsingConfig(), nil)
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/file", strings.NewReader("body"))
+	if ct.collapsible(req) {
+		t.Fatal("POST request must not be collapsible")
+	}
+}
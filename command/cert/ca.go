@@ -0,0 +1,71 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package cert
+
+import (
+	"time"
+
+	"github.com/saucelabs/forwarder/bind"
+	"github.com/saucelabs/forwarder/utils/certutil"
+	"github.com/spf13/cobra"
+)
+
+type caCommandConfig struct {
+	certConfig
+}
+
+func (c *caCommandConfig) runE(cmd *cobra.Command, _ []string) error {
+	t := c.template()
+	t.IsCA = true
+
+	cert, err := t.Gen()
+	if err != nil {
+		return err
+	}
+
+	return c.write(cmd.OutOrStdout(), cert)
+}
+
+func caCommand() *cobra.Command {
+	c := caCommandConfig{
+		certConfig: certConfig{
+			commonName:   "Forwarder Proxy MITM CA",
+			organization: "Forwarder Proxy MITM",
+			validity:     5 * 365 * 24 * time.Hour,
+			keyType:      certutil.KeyTypeECDSA,
+			format:       pemFormat,
+			out:          "ca",
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:     "ca [--out <path>] [--format <pem|pkcs12>] [flags]",
+		Short:   "Generate a CA certificate for MITM",
+		Long:    caLong,
+		RunE:    c.runE,
+		Example: caExample,
+	}
+
+	fs := cmd.Flags()
+	bindCertConfig(fs, &c.certConfig)
+
+	bind.AutoMarkFlagFilename(cmd)
+
+	return cmd
+}
+
+const caLong = `Generate a CA certificate and private key for MITM.
+Use it to provision a CA shared by a fleet of proxies with the --mitm-cacert-file and --mitm-cakey-file flags,
+instead of a CA generated by each proxy instance on start.
+`
+
+const caExample = `  # Generate a CA with Ed25519 key valid for 1 year
+  forwarder cert ca --key-type ed25519 --validity 8760h --out mitm-ca
+
+  # Use the CA for MITM
+  forwarder run --mitm-cacert-file mitm-ca.crt --mitm-cakey-file mitm-ca.key
+`
@@ -0,0 +1,149 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package cert
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/mmatczuk/anyflag"
+	"github.com/saucelabs/forwarder/utils/certutil"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+func Command() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cert",
+		Short: "Tools for generating MITM CA and server certificates",
+	}
+	cmd.AddCommand(
+		caCommand(),
+		serverCommand(),
+	)
+	return cmd
+}
+
+type outputFormat string
+
+const (
+	pemFormat    outputFormat = "pem"
+	pkcs12Format outputFormat = "pkcs12"
+)
+
+func (f outputFormat) String() string {
+	return string(f)
+}
+
+// certConfig holds the options common to the cert subcommands.
+type certConfig struct {
+	commonName   string
+	organization string
+	validity     time.Duration
+	keyType      certutil.KeyType
+	format       outputFormat
+	out          string
+	password     string
+}
+
+func bindCertConfig(fs *pflag.FlagSet, cfg *certConfig) {
+	fs.StringVar(&cfg.commonName, "common-name", cfg.commonName, "<name>"+
+		"Common name of the certificate subject. ")
+
+	fs.StringVar(&cfg.organization, "organization", cfg.organization, "<name>"+
+		"Organization of the certificate subject. ")
+
+	fs.DurationVar(&cfg.validity, "validity", cfg.validity, "<duration>"+
+		"Validity period of the certificate starting now. ")
+
+	fs.Var(anyflag.NewValue[certutil.KeyType](cfg.keyType, &cfg.keyType, certutil.ParseKeyType),
+		"key-type", "<rsa|ecdsa|ed25519>"+
+			"Type of the generated private key. "+
+			"RSA keys are 2048 bits, ECDSA keys use the P-256 curve. ")
+
+	fs.Var(anyflag.NewValue[outputFormat](cfg.format, &cfg.format, anyflag.EnumParser[outputFormat](pemFormat, pkcs12Format)),
+		"format", "<pem|pkcs12>"+
+			"Output format. "+
+			"Setting this to pem writes the certificate chain and the PKCS#8 private key to the --out path with .crt and .key extensions. "+
+			"Setting this to pkcs12 writes the certificate chain and the private key protected with --password to the --out path with .p12 extension. ")
+
+	fs.StringVar(&cfg.out, "out", cfg.out, "<path>"+
+		"Output file path without extension. "+
+		"Existing files are not overwritten. ")
+
+	fs.StringVar(&cfg.password, "password", cfg.password, "<password>"+
+		"Password protecting the PKCS#12 file, see --format. ")
+}
+
+func (c *certConfig) template() *certutil.SelfSignedCert {
+	t := certutil.ECDSASelfSignedCert()
+	t.SetKeyType(c.keyType)
+	t.CommonName = c.commonName
+	t.Organization = []string{c.organization}
+	t.ValidFor = c.validity
+	return t
+}
+
+// write writes the certificate in the configured format, and reports the written files to w.
+func (c *certConfig) write(w io.Writer, cert tls.Certificate) error {
+	if c.out == "" {
+		return errors.New("output path is required")
+	}
+
+	switch c.format {
+	case pemFormat:
+		certPEM, keyPEM, err := certutil.EncodePEM(cert)
+		if err != nil {
+			return err
+		}
+		// Check both files before writing to avoid leaving a key without a certificate.
+		for _, name := range []string{c.out + ".crt", c.out + ".key"} {
+			if _, err := os.Stat(name); err == nil {
+				return fmt.Errorf("%s: %w", name, os.ErrExist)
+			}
+		}
+		if err := writeNewFile(c.out+".key", keyPEM, 0o600); err != nil {
+			return err
+		}
+		if err := writeNewFile(c.out+".crt", certPEM, 0o644); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "wrote %s.crt and %s.key\n", c.out, c.out)
+	case pkcs12Format:
+		b, err := certutil.EncodePKCS12(cert, c.password)
+		if err != nil {
+			return err
+		}
+		if err := writeNewFile(c.out+".p12", b, 0o600); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "wrote %s.p12\n", c.out)
+	default:
+		return fmt.Errorf("unknown format %q", c.format)
+	}
+
+	fmt.Fprintf(w, "sha256 fingerprint=%x\n", sha256.Sum256(cert.Certificate[0]))
+
+	return nil
+}
+
+func writeNewFile(name string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,115 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package cert
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mmatczuk/anyflag"
+	"github.com/saucelabs/forwarder"
+	"github.com/saucelabs/forwarder/bind"
+	"github.com/saucelabs/forwarder/utils/certutil"
+	"github.com/spf13/cobra"
+)
+
+type serverCommandConfig struct {
+	certConfig
+	hosts      []string
+	caCertFile string
+	caKeyFile  string
+}
+
+func (c *serverCommandConfig) runE(cmd *cobra.Command, _ []string) error {
+	if len(c.hosts) == 0 {
+		return errors.New("at least one host is required")
+	}
+
+	ca, err := c.loadCA()
+	if err != nil {
+		return fmt.Errorf("load CA: %w", err)
+	}
+
+	t := c.template()
+	t.Hosts = c.hosts
+	if t.CommonName == "" {
+		t.CommonName = c.hosts[0]
+	}
+
+	cert, err := t.GenSignedBy(ca)
+	if err != nil {
+		return err
+	}
+
+	return c.write(cmd.OutOrStdout(), cert)
+}
+
+func (c *serverCommandConfig) loadCA() (tls.Certificate, error) {
+	if c.caCertFile == "" || c.caKeyFile == "" {
+		return tls.Certificate{}, errors.New("CA certificate and key files are required")
+	}
+
+	certPEM, err := forwarder.ReadFileOrBase64(c.caCertFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := forwarder.ReadFileOrBase64(c.caKeyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+func serverCommand() *cobra.Command {
+	c := serverCommandConfig{
+		certConfig: certConfig{
+			organization: "Forwarder Proxy MITM",
+			validity:     365 * 24 * time.Hour,
+			keyType:      certutil.KeyTypeECDSA,
+			format:       pemFormat,
+			out:          "server",
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:     "server --ca-cert-file <path> --ca-key-file <path> --hosts <host>,... [flags]",
+		Short:   "Generate a server certificate signed by a CA",
+		Long:    serverLong,
+		RunE:    c.runE,
+		Example: serverExample,
+	}
+
+	fs := cmd.Flags()
+	fs.Var(anyflag.NewValueWithRedact[string](c.caCertFile, &c.caCertFile, func(val string) (string, error) { return val, nil }, bind.RedactBase64),
+		"ca-cert-file", "<path or base64>"+
+			"CA certificate file in PEM format to sign the server certificate with. ")
+	fs.Var(anyflag.NewValueWithRedact[string](c.caKeyFile, &c.caKeyFile, func(val string) (string, error) { return val, nil }, bind.RedactBase64),
+		"ca-key-file", "<path or base64>"+
+			"CA private key file in PEM format. ")
+	fs.StringSliceVar(&c.hosts, "hosts", c.hosts, "<host>,..."+
+		"DNS names and IP addresses the server certificate is valid for. ")
+	bindCertConfig(fs, &c.certConfig)
+
+	bind.AutoMarkFlagFilename(cmd)
+
+	return cmd
+}
+
+const serverLong = `Generate a server certificate and private key signed by a CA, for example the CA generated with the forwarder cert ca command.
+If --common-name is empty, the first host is used as the common name.
+The certificate validity is limited to the validity of the CA certificate.
+The written certificate chain includes the CA certificate.
+`
+
+const serverExample = `  # Generate a server certificate for the proxy API server
+  forwarder cert server --ca-cert-file mitm-ca.crt --ca-key-file mitm-ca.key --hosts proxy.example.com,10.0.0.1
+
+  # Generate a server certificate in PKCS#12 format
+  forwarder cert server --ca-cert-file mitm-ca.crt --ca-key-file mitm-ca.key --hosts proxy.example.com --format pkcs12 --password secret
+`
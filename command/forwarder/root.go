@@ -8,9 +8,12 @@ package forwarder
 
 import (
 	"github.com/saucelabs/forwarder/bind"
+	"github.com/saucelabs/forwarder/command/cert"
 	"github.com/saucelabs/forwarder/command/pac"
 	"github.com/saucelabs/forwarder/command/ready"
+	"github.com/saucelabs/forwarder/command/relay"
 	"github.com/saucelabs/forwarder/command/run"
+	"github.com/saucelabs/forwarder/command/test/bench"
 	"github.com/saucelabs/forwarder/command/test/grpc"
 	"github.com/saucelabs/forwarder/command/test/httpbin"
 	"github.com/saucelabs/forwarder/command/version"
@@ -30,8 +33,11 @@ func CommandGroups() templates.CommandGroups {
 			Message: "Commands:",
 			Commands: []*cobra.Command{
 				run.Command(),
+				run.SelfTestCommand(),
 				pac.Command(),
+				relay.Command(),
 				ready.Command(),
+				cert.Command(),
 			},
 		},
 	}
@@ -43,6 +49,7 @@ func FlagGroups() templates.FlagGroups {
 			Name: "Server options",
 			Prefix: []string{
 				"proxy-protocol",
+				"slow-request",
 				"",
 			},
 		},
@@ -53,10 +60,24 @@ func FlagGroups() templates.FlagGroups {
 				"pac",
 
 				"direct-domains",
+				"no-proxy",
+				"collapse",
 				"deny-domains",
+				"port-policy",
+				"tcp-forward",
+				"socks5-udp",
+				"homograph",
+				"rate-limit",
+				"rule-trace",
+				"strip-trailers",
+				"chunked-passthrough",
+				"header-fidelity",
+				"server-timing",
 
 				"header",
+				"baggage",
 				"connect-header",
+				"connect-response-header",
 				"proxy-header",
 				"response-header",
 			},
@@ -65,6 +86,25 @@ func FlagGroups() templates.FlagGroups {
 			Name:   "MITM options",
 			Prefix: []string{"mitm"},
 		},
+		{
+			Name: "Certificate options",
+			Prefix: []string{
+				"ca-cert-file",
+				"ca-key-file",
+				"hosts",
+				"common-name",
+				"organization",
+				"validity",
+				"key-type",
+				"format",
+				"out",
+				"password",
+			},
+		},
+		{
+			Name:   "Capture and verification options",
+			Prefix: []string{"capture", "verify"},
+		},
 		{
 			Name:   "DNS options",
 			Prefix: []string{"dns"},
@@ -83,15 +123,24 @@ func FlagGroups() templates.FlagGroups {
 			Prefix: []string{
 				"api",
 				"prom",
+				"conntrack",
+				"slo",
 			},
 		},
 		{
-			Name:   "Logging options",
-			Prefix: []string{"log"},
+			Name:   "Webhook options",
+			Prefix: []string{"webhook"},
+		},
+		{
+			Name: "Logging options",
+			Prefix: []string{
+				"log",
+				"decision-log",
+			},
 		},
 		{
 			Name:   "Options",
-			Prefix: []string{"config-file"},
+			Prefix: []string{"config-file", "config-backend"},
 		},
 	}
 }
@@ -114,9 +163,10 @@ func Command() *cobra.Command {
 	// Add test commands.
 	test := &cobra.Command{
 		Use:   "test",
-		Short: "Run test servers for various protocols",
+		Short: "Run test servers for various protocols and benchmarks",
 	}
 	test.AddCommand(
+		bench.Command(),
 		grpc.Command(),
 		httpbin.Command(),
 	)
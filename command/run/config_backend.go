@@ -0,0 +1,248 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package run
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/saucelabs/forwarder"
+	"github.com/saucelabs/forwarder/kvconfig"
+	"github.com/saucelabs/forwarder/log"
+	"github.com/saucelabs/forwarder/ruleset"
+)
+
+// configBackendTimeout is the timeout for reading the initial configuration from the backend.
+const configBackendTimeout = 30 * time.Second
+
+var configBackendKeys = []string{"credentials", "deny-domains", "direct-domains", "proxy"}
+
+// configBackend applies configuration from a key-value store on top of the flag values.
+// A key that is not set in the store falls back to the flag value.
+type configBackend struct {
+	client *kvconfig.Client
+	ch     *forwarder.ConfigHistory
+	cfg    []byte
+	log    log.Logger
+
+	credentials   []*forwarder.HostPortUser
+	denyDomains   []ruleset.RegexpListItem
+	directDomains []ruleset.RegexpListItem
+	upstream      *url.URL
+
+	cm     *forwarder.CredentialsMatcher
+	deny   *ruleset.DynamicMatcher
+	direct *ruleset.DynamicMatcher
+	proxy  atomic.Pointer[url.URL]
+}
+
+// configureConfigBackend reads the initial configuration from the backend,
+// and replaces the deny and direct domains and upstream proxy with ones that follow the backend.
+// The credentials are set in cm, it must be created with forwarder.NewDynamicCredentialsMatcher.
+// The cfg is the startup configuration, backend configuration is recorded in ch on top of it.
+func (c *command) configureConfigBackend(cm *forwarder.CredentialsMatcher, ch *forwarder.ConfigHistory, cfg []byte, l log.Logger) (*configBackend, error) {
+	client, err := kvconfig.Open(c.configBackend, l)
+	if err != nil {
+		return nil, err
+	}
+
+	cb := &configBackend{
+		client:        client,
+		ch:            ch,
+		cfg:           cfg,
+		log:           l,
+		credentials:   c.credentials,
+		denyDomains:   c.denyDomains,
+		directDomains: c.directDomains,
+		upstream:      c.httpProxyConfig.UpstreamProxy,
+		cm:            cm,
+		deny:          ruleset.NewDynamicMatcher(nil),
+		direct:        ruleset.NewDynamicMatcher(nil),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), configBackendTimeout)
+	defer cancel()
+	s, err := client.Get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("read configuration from %s: %w", kvconfig.Redacted(c.configBackend), err)
+	}
+	if err := cb.apply(s); err != nil {
+		return nil, err
+	}
+	l.Infof("using configuration from %s", kvconfig.Redacted(c.configBackend))
+
+	c.httpProxyConfig.DenyDomains = cb.deny
+	if c.denyDomainsSchedule != nil {
+		c.httpProxyConfig.DenyDomains = ruleset.NewScheduledMatcher(cb.deny, c.denyDomainsSchedule)
+	}
+	c.httpProxyConfig.DirectDomains = cb.direct
+	if c.directDomainsSchedule != nil {
+		c.httpProxyConfig.DirectDomains = ruleset.NewScheduledMatcher(cb.direct, c.directDomainsSchedule)
+	}
+
+	if c.pac == nil && !c.systemProxy {
+		c.httpProxyConfig.UpstreamProxyFunc = cb.proxyFunc
+	} else if _, ok := s["proxy"]; ok {
+		l.Infof("ignoring proxy key, upstream proxy is selected with PAC or system settings")
+	}
+
+	return cb, nil
+}
+
+// watch applies configuration changes until ctx is done, invalid configuration is logged and ignored.
+func (cb *configBackend) watch(ctx context.Context) error {
+	return cb.client.Watch(ctx, func(s kvconfig.Snapshot) {
+		if err := cb.apply(s); err != nil {
+			cb.log.Errorf("ignoring configuration update, keeping the previous configuration: %s", err)
+			return
+		}
+		cb.log.Infof("configuration updated")
+	})
+}
+
+func (cb *configBackend) apply(s kvconfig.Snapshot) error {
+	for k := range s {
+		if !slices.Contains(configBackendKeys, k) {
+			cb.log.Infof("ignoring unsupported key %s", k)
+		}
+	}
+
+	var err error
+
+	credentials := cb.credentials
+	if v, ok := s["credentials"]; ok {
+		if credentials, err = parseConfigBackendList(v, forwarder.ParseHostPortUser); err != nil {
+			return fmt.Errorf("credentials: %w", err)
+		}
+	}
+	deny, err := cb.regexpMatcher(s, "deny-domains", cb.denyDomains)
+	if err != nil {
+		return err
+	}
+	direct, err := cb.regexpMatcher(s, "direct-domains", cb.directDomains)
+	if err != nil {
+		return err
+	}
+	upstream := cb.upstream
+	if v, ok := s["proxy"]; ok {
+		upstream = nil
+		if v = strings.TrimSpace(v); v != "" {
+			if upstream, err = forwarder.ParseProxyURL(v); err != nil {
+				return fmt.Errorf("proxy: %w", err)
+			}
+		}
+	}
+
+	// Credentials are validated on update, update them first so that nothing is changed on error.
+	if err := cb.cm.Update(credentials); err != nil {
+		return fmt.Errorf("credentials: %w", err)
+	}
+	cb.deny.Store(deny)
+	cb.direct.Store(direct)
+	cb.proxy.Store(upstream)
+
+	if cb.ch != nil {
+		cb.ch.Add("config-backend", cb.describe(credentials, s, upstream))
+	}
+
+	return nil
+}
+
+func (cb *configBackend) regexpMatcher(s kvconfig.Snapshot, key string, def []ruleset.RegexpListItem) (*ruleset.RegexpMatcher, error) {
+	l := def
+	if v, ok := s[key]; ok {
+		var err error
+		if l, err = parseConfigBackendList(v, ruleset.ParseRegexpListItem); err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	if len(l) == 0 {
+		return nil, nil //nolint:nilnil // nil matcher does not match anything
+	}
+	m, err := ruleset.NewRegexpMatcherFromList(l)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	return m, nil
+}
+
+func (cb *configBackend) proxyFunc(_ *http.Request) (*url.URL, error) {
+	u := cb.proxy.Load()
+	if u == nil {
+		return nil, nil
+	}
+
+	proxyURL := new(url.URL)
+	*proxyURL = *u
+	if proxyURL.User == nil {
+		proxyURL.User = cb.cm.MatchURL(proxyURL)
+	}
+	return proxyURL, nil
+}
+
+// describe returns the startup configuration with the keys set in the backend appended,
+// in the key=value format used by the configuration history.
+func (cb *configBackend) describe(credentials []*forwarder.HostPortUser, s kvconfig.Snapshot, upstream *url.URL) []byte {
+	var b bytes.Buffer
+	b.Write(cb.cfg)
+	for _, k := range configBackendKeys {
+		v, ok := s[k]
+		if !ok {
+			continue
+		}
+		switch k {
+		case "credentials":
+			r := make([]string, len(credentials))
+			for i := range credentials {
+				r[i] = forwarder.RedactHostPortUser(credentials[i])
+			}
+			v = strings.Join(r, ",")
+		case "proxy":
+			v = ""
+			if upstream != nil {
+				v = upstream.Redacted()
+			}
+		default:
+			v = strings.Join(configBackendLines(v), ",")
+		}
+		fmt.Fprintf(&b, "\nconfig-backend/%s=%s", k, v)
+	}
+	return b.Bytes()
+}
+
+// configBackendLines returns non-empty lines of v that are not comments.
+func configBackendLines(v string) []string {
+	var lines []string
+	for _, line := range strings.Split(v, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func parseConfigBackendList[T any](v string, parse func(string) (T, error)) ([]T, error) {
+	lines := configBackendLines(v)
+	l := make([]T, 0, len(lines))
+	for i, line := range lines {
+		t, err := parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("%w at pos %d", err, i)
+		}
+		l = append(l, t)
+	}
+	return l, nil
+}
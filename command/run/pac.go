@@ -0,0 +1,123 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package run
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/saucelabs/forwarder"
+	"github.com/saucelabs/forwarder/cluster"
+	"github.com/saucelabs/forwarder/log"
+	"github.com/saucelabs/forwarder/pac"
+	"github.com/saucelabs/forwarder/utils/httphandler"
+)
+
+// pacLoader reads the PAC script, and optionally refreshes it periodically.
+// If leader is set, only the leader downloads remote PAC scripts and shares them with other instances.
+type pacLoader struct {
+	url        *url.URL
+	rt         http.RoundTripper
+	disableDNS bool
+	interval   time.Duration
+	leader     *cluster.Leader
+	log        log.Logger
+
+	script   atomic.Pointer[string]
+	resolver *forwarder.DynamicPACResolver
+}
+
+func (pl *pacLoader) init(ctx context.Context) error {
+	if pl.interval > 0 && pl.url.Scheme == "file" && pl.url.Path == "-" {
+		return errors.New("cannot refresh PAC script read from stdin")
+	}
+
+	script, err := pl.read(ctx)
+	if err != nil {
+		return err
+	}
+	r, err := pl.newResolver(script)
+	if err != nil {
+		return err
+	}
+	pl.script.Store(&script)
+	pl.resolver = forwarder.NewDynamicPACResolver(r)
+
+	return nil
+}
+
+func (pl *pacLoader) read(ctx context.Context) (string, error) {
+	remote := pl.url.Scheme == "http" || pl.url.Scheme == "https"
+	if pl.leader == nil || !remote {
+		return forwarder.ReadURLString(pl.url, pl.rt)
+	}
+
+	h := sha256.Sum256([]byte(pl.url.String()))
+	key := "pac:" + hex.EncodeToString(h[:])
+	ttl := 2 * pl.interval
+	if ttl == 0 {
+		ttl = time.Hour
+	}
+	b, err := pl.leader.Fetch(ctx, key, ttl, func(context.Context) ([]byte, error) {
+		s, err := forwarder.ReadURLString(pl.url, pl.rt)
+		return []byte(s), err
+	})
+	return string(b), err
+}
+
+func (pl *pacLoader) newResolver(script string) (forwarder.PACResolver, error) {
+	pr, err := pac.NewProxyResolverPool(&pac.ProxyResolverConfig{Script: script, DisableDNS: pl.disableDNS}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pr.FindProxyForURL(&url.URL{Scheme: "https", Host: "saucelabs.com"}, ""); err != nil {
+		return nil, err
+	}
+	return pr, nil
+}
+
+// refresh re-reads the PAC script every interval until ctx is done.
+// If the script cannot be read or is invalid, the previous script is kept.
+func (pl *pacLoader) refresh(ctx context.Context) error {
+	t := time.NewTicker(pl.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+
+		script, err := pl.read(ctx)
+		if err != nil {
+			pl.log.Errorf("refresh PAC script, keeping the previous script: %s", err)
+			continue
+		}
+		if script == *pl.script.Load() {
+			continue
+		}
+		r, err := pl.newResolver(script)
+		if err != nil {
+			pl.log.Errorf("refresh PAC script, keeping the previous script: %s", err)
+			continue
+		}
+		pl.resolver.Store(r)
+		pl.script.Store(&script)
+		pl.log.Infof("PAC script updated")
+	}
+}
+
+func (pl *pacLoader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	httphandler.SendFileString("application/x-ns-proxy-autoconfig", *pl.script.Load()).ServeHTTP(w, r)
+}
@@ -0,0 +1,182 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package run
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// readyInfo is written to the ready file once all listeners are bound,
+// it allows orchestrating tools to discover the runtime values, such as ports chosen by the system.
+type readyInfo struct {
+	PID       int             `json:"pid"`
+	Version   string          `json:"version"`
+	Listeners []readyListener `json:"listeners"`
+	// MITMCAFingerprint is the hex encoded SHA-256 fingerprint of the MITM CA certificate.
+	MITMCAFingerprint string `json:"mitm_ca_fingerprint,omitempty"`
+}
+
+type readyListener struct {
+	Name     string `json:"name"`
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"`
+}
+
+func (ri *readyInfo) add(name, protocol string, addrs ...string) {
+	for _, a := range addrs {
+		ri.Listeners = append(ri.Listeners, readyListener{Name: name, Protocol: protocol, Address: a})
+	}
+}
+
+func (ri *readyInfo) setMITMCA(ca *x509.Certificate) {
+	if ca == nil {
+		return
+	}
+	sum := sha256.Sum256(ca.Raw)
+	ri.MITMCAFingerprint = hex.EncodeToString(sum[:])
+}
+
+// String returns the startup banner listing the listeners.
+func (ri *readyInfo) String() string {
+	var sb strings.Builder
+	sb.WriteString("ready pid=")
+	sb.WriteString(strconv.Itoa(ri.PID))
+	for _, l := range ri.Listeners {
+		sb.WriteString("\n  " + l.Name + " " + l.Protocol + "://" + l.Address)
+	}
+	if ri.MITMCAFingerprint != "" {
+		sb.WriteString("\n  MITM CA sha256 fingerprint=" + ri.MITMCAFingerprint)
+	}
+	return sb.String()
+}
+
+// writeReadyFile writes the file atomically, readers never see a partially written file.
+func writeReadyFile(path string, ri *readyInfo) error {
+	b, err := json.MarshalIndent(ri, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// listenersHandler serves the listeners as JSON, it must not be called before all listeners are added.
+func listenersHandler(ri *readyInfo) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ri.Listeners) //nolint // ignore error
+	})
+}
+
+// discoveryHook registers the ready info with an external service discovery system.
+// The command is executed with the ready info JSON on stdin, the URL receives it in a POST request.
+type discoveryHook struct {
+	Command []string
+	URL     *url.URL
+	Timeout time.Duration
+}
+
+func defaultDiscoveryHook() *discoveryHook {
+	return &discoveryHook{
+		Timeout: 30 * time.Second,
+	}
+}
+
+func (h *discoveryHook) enabled() bool {
+	return len(h.Command) > 0 || h.URL != nil
+}
+
+func (h *discoveryHook) run(ctx context.Context, ri *readyInfo) error {
+	b, err := json.Marshal(ri)
+	if err != nil {
+		return err
+	}
+
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
+	}
+
+	if len(h.Command) > 0 {
+		if err := h.exec(ctx, b); err != nil {
+			return fmt.Errorf("command: %w", err)
+		}
+	}
+	if h.URL != nil {
+		if err := h.post(ctx, b); err != nil {
+			return fmt.Errorf("url: %w", err)
+		}
+	}
+	return nil
+}
+
+func (h *discoveryHook) exec(ctx context.Context, b []byte) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...) //nolint:gosec // the command is configured by the operator
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if s := strings.TrimSpace(stderr.String()); s != "" {
+			return fmt.Errorf("%w: %s", err, s)
+		}
+		return err
+	}
+	return nil
+}
+
+func (h *discoveryHook) post(ctx context.Context, b []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL.String(), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 1024)) //nolint:errcheck // drain body
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+	return nil
+}
@@ -8,69 +8,179 @@ package run
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"runtime"
+	"runtime/debug"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/saucelabs/forwarder"
 	"github.com/saucelabs/forwarder/bind"
+	"github.com/saucelabs/forwarder/cluster"
+	"github.com/saucelabs/forwarder/conntrack"
+	"github.com/saucelabs/forwarder/fdlimit"
 	"github.com/saucelabs/forwarder/header"
+	"github.com/saucelabs/forwarder/hostsfile"
 	"github.com/saucelabs/forwarder/httplog"
 	"github.com/saucelabs/forwarder/internal/version"
 	"github.com/saucelabs/forwarder/log"
 	"github.com/saucelabs/forwarder/log/martianlog"
+	"github.com/saucelabs/forwarder/log/sink"
 	"github.com/saucelabs/forwarder/log/stdlog"
-	"github.com/saucelabs/forwarder/pac"
+	"github.com/saucelabs/forwarder/ratelimit"
 	"github.com/saucelabs/forwarder/ruleset"
 	"github.com/saucelabs/forwarder/runctx"
+	"github.com/saucelabs/forwarder/spiffe"
 	"github.com/saucelabs/forwarder/utils/cobrautil"
 	"github.com/saucelabs/forwarder/utils/httphandler"
 	"github.com/saucelabs/forwarder/utils/httpx"
+	"github.com/saucelabs/forwarder/webhook"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"go.uber.org/goleak"
 	"go.uber.org/multierr"
 )
 
+// configHistoryLimit is the number of configuration generations served by the /configz/history endpoint.
+const configHistoryLimit = 10
+
+// clusterLeaderTTL is the lease duration of the cluster leader.
+const clusterLeaderTTL = 15 * time.Second
+
 type command struct {
-	promReg             *prometheus.Registry
-	dnsConfig           *forwarder.DNSConfig
-	httpTransportConfig *forwarder.HTTPTransportConfig
-	connectTo           []forwarder.HostPortPair
-	pac                 *url.URL
-	credentials         []*forwarder.HostPortUser
-	denyDomains         []ruleset.RegexpListItem
-	directDomains       []ruleset.RegexpListItem
-	connectHeaders      []header.Header
-	requestHeaders      []header.Header
-	responseHeaders     []header.Header
-	httpProxyConfig     *forwarder.HTTPProxyConfig
-	mitm                bool
-	mitmConfig          *forwarder.MITMConfig
-	mitmDomains         []ruleset.RegexpListItem
-	proxyProtocol       bool
-	proxyProtocolConfig *forwarder.ProxyProtocolConfig
-	apiServerConfig     *forwarder.HTTPServerConfig
-	logConfig           *log.Config
-
-	dryRun bool
-	goleak bool
+	promReg                  *prometheus.Registry
+	dnsConfig                *forwarder.DNSConfig
+	dnsProxyConfig           *forwarder.DNSProxyConfig
+	dohServerConfig          *forwarder.HTTPServerConfig
+	httpTransportConfig      *forwarder.HTTPTransportConfig
+	connectTo                []forwarder.HostPortPair
+	dnsHostsFile             string
+	configBackend            *url.URL
+	pac                      *url.URL
+	pacDisableDNS            bool
+	pacRefreshInterval       time.Duration
+	clusterRedis             *url.URL
+	credentials              []*forwarder.HostPortUser
+	denyDomains              []ruleset.RegexpListItem
+	denyDomainsSchedule      *ruleset.Schedule
+	directDomains            []ruleset.RegexpListItem
+	directDomainsSchedule    *ruleset.Schedule
+	connectHeaders           []header.Header
+	requestHeaders           []header.Header
+	responseHeaders          []header.Header
+	httpProxyConfig          *forwarder.HTTPProxyConfig
+	systemProxy              bool
+	systemProxyConfig        *forwarder.SystemProxyConfig
+	mitm                     bool
+	mitmConfig               *forwarder.MITMConfig
+	mitmDomains              []ruleset.RegexpListItem
+	mitmFrontingAllow        []ruleset.RegexpListItem
+	mitmCertLogFile          *os.File
+	proxyProtocol            bool
+	proxyProtocolConfig      *forwarder.ProxyProtocolConfig
+	apiServerConfig          *forwarder.HTTPServerConfig
+	apiReadOnly              bool
+	wsTunnelServerConfig     *forwarder.HTTPServerConfig
+	reverseConfig            *forwarder.ReverseListenerConfig
+	credentialsCommandConfig *forwarder.CredentialsCommandConfig
+	negotiateConfig          *forwarder.NegotiateConfig
+	upstreamPoolConfig       *forwarder.UpstreamPoolConfig
+	leakCheckConfig          *forwarder.LeakCheckConfig
+	spiffeSocket             string
+	spiffeDomains            []ruleset.RegexpListItem
+	spiffeClientIDs          []ruleset.RegexpListItem
+	connTable                bool
+	errorStream              bool
+	slo                      bool
+	sloConfig                *forwarder.SLOConfig
+	webhookConfig            *webhook.Config
+	webhookErrorRate         *forwarder.RateLimit
+	webhookCAExpiry          time.Duration
+	connTableLogInterval     time.Duration
+	fdLimit                  uint64
+	fdReserve                uint64
+	fdGuard                  bool
+	autotune                 bool
+	bufferSize               forwarder.SizeSuffix
+	logConfig                *log.Config
+	logSinks                 []string
+	logHTTPFile              *os.File
+	logHTTPBodyDomains       []ruleset.RegexpListItem
+	decisionLogFile          *os.File
+	decisionLogConfig        *forwarder.DecisionLogConfig
+	bodyCaptureConfig        *forwarder.BodyCaptureConfig
+	bodyCaptureDomains       []ruleset.RegexpListItem
+	contentVerifyConfig      *forwarder.ContentVerifyConfig
+	injectConfig             *forwarder.InjectConfig
+	injectHTML               *url.URL
+	injectHeaders            []header.Header
+	injectDomains            []ruleset.RegexpListItem
+	urlRewriteConfig         *forwarder.URLRewriteConfig
+	urlRewriteDomains        []ruleset.RegexpListItem
+	resDiffConfig            *forwarder.ResponseDiffConfig
+	resDiffFile              *os.File
+	resDiffReference         *url.URL
+	resDiffDomains           []ruleset.RegexpListItem
+	signingConfig            *forwarder.RequestSigningConfig
+	oauth2Config             *forwarder.OAuth2Config
+	homographConfig          *forwarder.HomographConfig
+	rateLimits               []forwarder.RateLimit
+	rateLimitRedis           *url.URL
+	collapse                 bool
+	collapseConfig           *forwarder.RequestCollapsingConfig
+	socks5UDP                bool
+	socks5UDPConfig          *forwarder.SOCKS5UDPConfig
+	verifyManifest           string
+	verifyDomains            []ruleset.RegexpListItem
+
+	dryRun    bool
+	readyFile string
+	discovery *discoveryHook
+	goleak    bool
+	selfTest  bool
 }
 
 func (c *command) runE(cmd *cobra.Command, _ []string) (cmdErr error) {
 	if f := c.logConfig.File; f != nil {
 		defer f.Close()
 	}
+	if f := c.decisionLogFile; f != nil {
+		defer f.Close()
+	}
+	if f := c.resDiffFile; f != nil {
+		defer f.Close()
+	}
+	if f := c.mitmCertLogFile; f != nil {
+		defer f.Close()
+	}
 	onError, err := c.registerErrorsMetric()
 	if err != nil {
 		return fmt.Errorf("register errors metric: %w", err)
 	}
-	logger := stdlog.New(c.logConfig, stdlog.WithOnError(onError))
+	logOpts := []stdlog.Option{stdlog.WithOnError(onError)}
+	if len(c.logSinks) > 0 {
+		b, err := c.openLogSinks()
+		if err != nil {
+			return fmt.Errorf("log sink: %w", err)
+		}
+		defer func() {
+			if err := b.Close(); err != nil {
+				fmt.Fprintf(cmd.ErrOrStderr(), "close log sink: %s\n", err)
+			}
+		}()
+		logOpts = append(logOpts, stdlog.WithSink(b))
+	}
+	logger := stdlog.New(c.logConfig, logOpts...)
 
 	defer func() {
 		if err := logger.Close(); err != nil {
@@ -86,9 +196,30 @@ func (c *command) runE(cmd *cobra.Command, _ []string) (cmdErr error) {
 	}()
 
 	logger.Infof("Forwarder %s (%s)", version.Version, version.Commit)
-	logger.Debugf("resource limits: GOMAXPROCS=%d GOMEMLIMIT=%s", runtime.GOMAXPROCS(0), os.Getenv("GOMEMLIMIT"))
 
-	var ep []forwarder.APIEndpoint
+	if f := c.logHTTPFile; f != nil {
+		hl := stdlog.New(&log.Config{File: f, Level: log.InfoLevel})
+		defer func() {
+			if err := hl.Close(); err != nil {
+				fmt.Fprintf(cmd.ErrOrStderr(), "close HTTP logger: %s\n", err)
+			}
+		}()
+		c.httpProxyConfig.LogHTTPLogger = hl.Named("proxy")
+		c.apiServerConfig.LogHTTPLogger = hl.Named("api")
+		c.wsTunnelServerConfig.LogHTTPLogger = hl.Named("ws-tunnel")
+		c.dohServerConfig.LogHTTPLogger = hl.Named("dns-proxy-doh")
+	}
+
+	if c.selfTest {
+		c.configureSelfTest()
+	}
+	c.configureTuning(cmd.Flags(), logger)
+
+	var (
+		ep        []forwarder.APIEndpoint
+		ch        = forwarder.NewConfigHistory(configHistoryLimit)
+		allConfig []byte
+	)
 
 	{
 		var (
@@ -120,9 +251,17 @@ func (c *command) runE(cmd *cobra.Command, _ []string) (cmdErr error) {
 		}
 		logger.Debugf("all configuration\n%s\n\n", cfg)
 
+		ch.Add("startup", cfg)
+		allConfig = cfg
+
 		ep = append(ep, forwarder.APIEndpoint{
-			Path:    "/configz",
-			Handler: httphandler.SendFile("text/plain", cfg),
+			Path:        "/configz",
+			Handler:     httphandler.SendFile("text/plain", cfg),
+			Description: "Effective configuration",
+		}, forwarder.APIEndpoint{
+			Path:        "/configz/history",
+			Handler:     ch,
+			Description: "Applied configuration generations with diffs and timestamps",
 		})
 	}
 
@@ -136,6 +275,85 @@ func (c *command) runE(cmd *cobra.Command, _ []string) (cmdErr error) {
 		}
 	}
 
+	var wst *forwarder.WSTunnel
+	if c.wsTunnelServerConfig.Address != "" {
+		wst = forwarder.NewWSTunnel(logger.Named("ws-tunnel"))
+		c.httpProxyConfig.ExtraListeners = append(c.httpProxyConfig.ExtraListeners, forwarder.NamedListenerConfig{
+			Name:           "ws-tunnel",
+			ListenerConfig: forwarder.ListenerConfig{Listener: wst},
+		})
+	}
+
+	if c.reverseConfig.RelayURL != nil {
+		tlsCfg := new(tls.Config)
+		if err := c.httpTransportConfig.TLSClientConfig.ConfigureTLSConfig(tlsCfg); err != nil {
+			return fmt.Errorf("reverse relay: %w", err)
+		}
+		rl, err := forwarder.NewReverseListener(c.reverseConfig, tlsCfg, logger.Named("reverse"))
+		if err != nil {
+			return fmt.Errorf("reverse relay: %w", err)
+		}
+		defer rl.Close()
+		c.httpProxyConfig.ExtraListeners = append(c.httpProxyConfig.ExtraListeners, forwarder.NamedListenerConfig{
+			Name:           "reverse",
+			ListenerConfig: forwarder.ListenerConfig{Listener: rl},
+		})
+	}
+
+	var cc *forwarder.CredentialsCommand
+	if len(c.credentialsCommandConfig.Command) > 0 {
+		var err error
+		cc, err = forwarder.NewCredentialsCommand(c.credentialsCommandConfig, logger.Named("credentials-command"))
+		if err != nil {
+			return fmt.Errorf("proxy credentials command: %w", err)
+		}
+		c.httpProxyConfig.UpstreamProxyCredentialsCommand = cc
+	}
+
+	var ng *forwarder.Negotiate
+	if len(c.negotiateConfig.TokenCommand) > 0 {
+		var err error
+		ng, err = forwarder.NewNegotiate(c.negotiateConfig, logger.Named("negotiate"))
+		if err != nil {
+			return fmt.Errorf("proxy negotiate: %w", err)
+		}
+		c.httpProxyConfig.UpstreamProxyNegotiate = ng
+	}
+
+	var ss *spiffe.Source
+	if len(c.spiffeDomains) > 0 || len(c.spiffeClientIDs) > 0 {
+		if c.spiffeSocket == "" {
+			return fmt.Errorf("spiffe: workload API address is required, set --spiffe-socket or %s", spiffe.EndpointSocketEnv)
+		}
+		var err error
+		ss, err = spiffe.NewSource(c.spiffeSocket, logger.Named("spiffe"))
+		if err != nil {
+			return fmt.Errorf("spiffe: %w", err)
+		}
+		defer ss.Close()
+
+		if len(c.spiffeDomains) > 0 {
+			m, err := ruleset.NewRegexpMatcherFromList(c.spiffeDomains)
+			if err != nil {
+				return fmt.Errorf("spiffe domains: %w", err)
+			}
+			c.httpTransportConfig.SPIFFE = ss
+			c.httpTransportConfig.SPIFFEDomains = m
+		}
+		if len(c.spiffeClientIDs) > 0 {
+			m, err := ruleset.NewRegexpMatcherFromList(c.spiffeClientIDs)
+			if err != nil {
+				return fmt.Errorf("spiffe client IDs: %w", err)
+			}
+			c.httpProxyConfig.TLSServerConfig.SPIFFE = ss
+			c.httpProxyConfig.TLSServerConfig.SPIFFEIDs = m
+		}
+	}
+
+	if err := c.configureFDGuard(logger.Named("fd-guard")); err != nil {
+		return err
+	}
+
 	if c.httpTransportConfig.TLSClientConfig.KeyLogFile != "" {
 		logger.Infof("using TLS key logging, writing to %s", c.httpTransportConfig.TLSClientConfig.KeyLogFile)
 	}
@@ -144,7 +362,37 @@ func (c *command) runE(cmd *cobra.Command, _ []string) (cmdErr error) {
 		c.httpTransportConfig.RedirectFunc = forwarder.DialRedirectFromHostPortPairs(c.connectTo)
 	}
 
-	var pr forwarder.PACResolver
+	if c.dnsHostsFile != "" {
+		recs, err := hostsfile.ReadFile(c.dnsHostsFile)
+		if err != nil {
+			return fmt.Errorf("read hosts file: %w", err)
+		}
+		// The --dns-hosts entries take precedence over the hosts file.
+		for _, r := range recs {
+			c.httpTransportConfig.Hosts = append(c.httpTransportConfig.Hosts, forwarder.HostOverride{Host: r.Host, Addr: r.Addr})
+		}
+	}
+	if len(c.httpTransportConfig.Hosts) > 0 {
+		logger.Infof("using static host overrides hosts=%d", len(c.httpTransportConfig.Hosts))
+	}
+
+	var leader *cluster.Leader
+	if c.clusterRedis != nil {
+		l, err := cluster.NewLeader(c.clusterRedis, "forwarder", clusterLeaderTTL, logger.Named("cluster"))
+		if err != nil {
+			return fmt.Errorf("cluster: %w", err)
+		}
+		defer l.Close()
+		if err := l.Campaign(context.Background()); err != nil {
+			logger.Named("cluster").Errorf("leader election: %s", err)
+		}
+		leader = l
+	}
+
+	var (
+		pr forwarder.PACResolver
+		pl *pacLoader
+	)
 	if c.pac != nil {
 		// Disable metrics for receiving PAC file.
 		cfg := *c.httpTransportConfig
@@ -154,31 +402,45 @@ func (c *command) runE(cmd *cobra.Command, _ []string) (cmdErr error) {
 			return err
 		}
 
-		script, err := forwarder.ReadURLString(c.pac, rt)
-		if err != nil {
-			return fmt.Errorf("read PAC file: %w", err)
-		}
-		pr, err = pac.NewProxyResolverPool(&pac.ProxyResolverConfig{Script: script}, nil)
-		if err != nil {
-			return err
+		pl = &pacLoader{
+			url:        c.pac,
+			rt:         rt,
+			disableDNS: c.pacDisableDNS,
+			interval:   c.pacRefreshInterval,
+			leader:     leader,
+			log:        logger.Named("pac"),
 		}
-		if _, err := pr.FindProxyForURL(&url.URL{Scheme: "https", Host: "saucelabs.com"}, ""); err != nil {
-			return err
+		if err := pl.init(context.Background()); err != nil {
+			return fmt.Errorf("read PAC file: %w", err)
 		}
 		pr = &forwarder.LoggingPACResolver{
-			Resolver: pr,
+			Resolver: pl.resolver,
 			Logger:   logger.Named("pac"),
 		}
 
 		ep = append(ep, forwarder.APIEndpoint{
-			Path:    "/pac",
-			Handler: httphandler.SendFileString("application/x-ns-proxy-autoconfig", script),
+			Path:        "/pac",
+			Handler:     pl,
+			Description: "PAC script used by the proxy",
 		})
 	}
 
-	cm, err := forwarder.NewCredentialsMatcher(c.credentials, logger.Named("credentials"))
-	if err != nil {
-		return fmt.Errorf("credentials: %w", err)
+	if len(c.upstreamPoolConfig.Proxies) > 0 {
+		c.httpProxyConfig.UpstreamPool = c.upstreamPoolConfig
+	}
+
+	if c.systemProxy {
+		c.httpProxyConfig.SystemProxy = c.systemProxyConfig
+	}
+
+	var cm *forwarder.CredentialsMatcher
+	if c.configBackend != nil {
+		cm = forwarder.NewDynamicCredentialsMatcher(logger.Named("credentials"))
+	} else {
+		cm, err = forwarder.NewCredentialsMatcher(c.credentials, logger.Named("credentials"))
+		if err != nil {
+			return fmt.Errorf("credentials: %w", err)
+		}
 	}
 
 	if len(c.denyDomains) > 0 {
@@ -187,6 +449,9 @@ func (c *command) runE(cmd *cobra.Command, _ []string) (cmdErr error) {
 			return fmt.Errorf("deny domains: %w", err)
 		}
 		c.httpProxyConfig.DenyDomains = dd
+		if c.denyDomainsSchedule != nil {
+			c.httpProxyConfig.DenyDomains = ruleset.NewScheduledMatcher(dd, c.denyDomainsSchedule)
+		}
 	}
 
 	if len(c.directDomains) > 0 {
@@ -195,12 +460,37 @@ func (c *command) runE(cmd *cobra.Command, _ []string) (cmdErr error) {
 			return fmt.Errorf("direct domains: %w", err)
 		}
 		c.httpProxyConfig.DirectDomains = dd
+		if c.directDomainsSchedule != nil {
+			c.httpProxyConfig.DirectDomains = ruleset.NewScheduledMatcher(dd, c.directDomainsSchedule)
+		}
+	}
+
+	var cb *configBackend
+	if c.configBackend != nil {
+		cb, err = c.configureConfigBackend(cm, ch, allConfig, logger.Named("config-backend"))
+		if err != nil {
+			return fmt.Errorf("config backend: %w", err)
+		}
 	}
 
 	c.configureHeadersModifiers()
 
+	if len(c.logHTTPBodyDomains) > 0 {
+		m, err := ruleset.NewRegexpMatcherFromList(c.logHTTPBodyDomains)
+		if err != nil {
+			return fmt.Errorf("log http body domains: %w", err)
+		}
+		c.httpProxyConfig.LogHTTPBody.Domains = m.Match
+	}
+	c.apiServerConfig.LogHTTPFilter = c.httpProxyConfig.LogHTTPFilter
+	c.wsTunnelServerConfig.LogHTTPFilter = c.httpProxyConfig.LogHTTPFilter
+	c.dohServerConfig.LogHTTPFilter = c.httpProxyConfig.LogHTTPFilter
+
 	if c.mitm || c.mitmConfig.CACertFile != "" || len(c.mitmDomains) > 0 {
 		c.httpProxyConfig.MITM = c.mitmConfig
+		if leader != nil {
+			c.mitmConfig.TicketKeyStore = leader.GetOrSet
+		}
 
 		if len(c.mitmDomains) > 0 {
 			dd, err := ruleset.NewRegexpMatcherFromList(c.mitmDomains)
@@ -209,13 +499,261 @@ func (c *command) runE(cmd *cobra.Command, _ []string) (cmdErr error) {
 			}
 			c.httpProxyConfig.MITMDomains = dd
 		}
+
+		if len(c.mitmFrontingAllow) > 0 {
+			dd, err := ruleset.NewRegexpMatcherFromList(c.mitmFrontingAllow)
+			if err != nil {
+				return fmt.Errorf("mitm domain fronting allow domains: %w", err)
+			}
+			c.httpProxyConfig.MITMDomainFrontingAllow = dd
+		}
+
+		if c.mitmCertLogFile != nil {
+			cl := forwarder.NewMITMCertLog(c.mitmCertLogFile, logger.Named("mitm-cert-log"))
+			c.httpProxyConfig.MITMCertLog = cl
+
+			ep = append(ep, forwarder.APIEndpoint{
+				Path:        "/mitm/certs",
+				Handler:     cl,
+				Description: "Issued MITM certificates, filtered by the host, since, until and limit query parameters",
+			})
+		}
 	}
 
 	if c.proxyProtocol {
 		c.httpProxyConfig.ProxyProtocolConfig = c.proxyProtocolConfig
 	}
+	if c.httpTransportConfig.ProxyProtocol != forwarder.ProxyProtocolOff {
+		logger.Infof("sending PROXY protocol %s headers on outbound connections", c.httpTransportConfig.ProxyProtocol)
+		c.httpProxyConfig.DialClientAddr = true
+	}
+
+	if c.decisionLogFile != nil {
+		c.decisionLogConfig.Writer = c.decisionLogFile
+		c.httpProxyConfig.DecisionLog = c.decisionLogConfig
+	}
+
+	if c.bodyCaptureConfig.Dir != "" {
+		if len(c.bodyCaptureDomains) > 0 {
+			dd, err := ruleset.NewRegexpMatcherFromList(c.bodyCaptureDomains)
+			if err != nil {
+				return fmt.Errorf("capture domains: %w", err)
+			}
+			c.bodyCaptureConfig.Domains = dd
+		}
+		c.httpProxyConfig.BodyCapture = c.bodyCaptureConfig
+	}
+
+	if c.collapse {
+		c.httpProxyConfig.RequestCollapsing = c.collapseConfig
+	}
+
+	if c.slo {
+		c.httpProxyConfig.SLO = c.sloConfig
+	}
+
+	if c.socks5UDP {
+		c.httpProxyConfig.SOCKS5UDP = c.socks5UDPConfig
+	}
+
+	if c.contentVerifyConfig.Headers || c.verifyManifest != "" {
+		if c.verifyManifest != "" {
+			f, err := os.Open(c.verifyManifest)
+			if err != nil {
+				return fmt.Errorf("verify manifest: %w", err)
+			}
+			m, err := forwarder.ParseChecksumManifest(f)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("verify manifest: %w", err)
+			}
+			c.contentVerifyConfig.Manifest = m
+		}
+		if len(c.verifyDomains) > 0 {
+			dd, err := ruleset.NewRegexpMatcherFromList(c.verifyDomains)
+			if err != nil {
+				return fmt.Errorf("verify domains: %w", err)
+			}
+			c.contentVerifyConfig.Domains = dd
+		}
+		c.httpProxyConfig.ContentVerify = c.contentVerifyConfig
+	}
+
+	if c.injectHTML != nil || len(c.injectHeaders) > 0 {
+		if c.injectHTML != nil {
+			s, err := forwarder.ReadURLString(c.injectHTML, nil)
+			if err != nil {
+				return fmt.Errorf("inject html: %w", err)
+			}
+			c.injectConfig.HTML = s
+		}
+		if len(c.injectHeaders) > 0 {
+			c.injectConfig.Headers = make(http.Header)
+			for _, h := range c.injectHeaders {
+				if h.Action != header.Add {
+					return fmt.Errorf("inject headers: %s: only adding headers is supported", h.Name)
+				}
+				h.Apply(c.injectConfig.Headers)
+			}
+		}
+		if len(c.injectDomains) > 0 {
+			dd, err := ruleset.NewRegexpMatcherFromList(c.injectDomains)
+			if err != nil {
+				return fmt.Errorf("inject domains: %w", err)
+			}
+			c.injectConfig.Domains = dd
+		}
+		c.httpProxyConfig.Inject = c.injectConfig
+	}
+
+	if len(c.urlRewriteConfig.Hosts) > 0 {
+		if len(c.urlRewriteDomains) > 0 {
+			dd, err := ruleset.NewRegexpMatcherFromList(c.urlRewriteDomains)
+			if err != nil {
+				return fmt.Errorf("rewrite domains: %w", err)
+			}
+			c.urlRewriteConfig.Domains = dd
+		}
+		c.httpProxyConfig.URLRewrite = c.urlRewriteConfig
+	}
+
+	if c.resDiffFile != nil {
+		// Disable metrics for reference requests.
+		cfg := *c.httpTransportConfig
+		cfg.PromRegistry = nil
+		tr, err := forwarder.NewHTTPTransport(&cfg)
+		if err != nil {
+			return fmt.Errorf("diff reference: %w", err)
+		}
+		if c.resDiffReference != nil {
+			logger.Named("diff").Infof("using reference upstream proxy %s", c.resDiffReference.Redacted())
+			tr.Proxy = http.ProxyURL(c.resDiffReference)
+		}
+		c.resDiffConfig.Transport = tr
+		c.resDiffConfig.Writer = c.resDiffFile
+		if len(c.resDiffDomains) > 0 {
+			dd, err := ruleset.NewRegexpMatcherFromList(c.resDiffDomains)
+			if err != nil {
+				return fmt.Errorf("diff domains: %w", err)
+			}
+			c.resDiffConfig.Domains = dd
+		}
+		c.httpProxyConfig.ResponseDiff = c.resDiffConfig
+	}
+
+	if len(c.oauth2Config.Rules) > 0 {
+		c.httpProxyConfig.OAuth2 = c.oauth2Config
+	}
+
+	if len(c.signingConfig.Rules) > 0 {
+		if c.signingConfig.AWS == nil && os.Getenv("AWS_ACCESS_KEY_ID") != "" {
+			c.signingConfig.AWS = &forwarder.AWSCredentials{
+				AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+				SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+				SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+			}
+		}
+		c.httpProxyConfig.RequestSigning = c.signingConfig
+	}
+
+	if len(c.homographConfig.ProtectedDomains) > 0 {
+		c.httpProxyConfig.Homograph = c.homographConfig
+	}
+
+	if len(c.rateLimits) > 0 {
+		rl := &forwarder.RateLimitConfig{
+			Limits: c.rateLimits,
+		}
+		if c.rateLimitRedis != nil {
+			rc, err := ratelimit.NewRedisCounter(c.rateLimitRedis, "forwarder:rate-limit:")
+			if err != nil {
+				return fmt.Errorf("rate limit redis: %w", err)
+			}
+			defer rc.Close()
+			logger.Named("rate-limit").Infof("using shared request counters in %s", c.rateLimitRedis.Redacted())
+			rl.Counter = rc
+		}
+		c.httpProxyConfig.RateLimit = rl
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	g := runctx.NewGroup()
+	var ready readyInfo
+	if cb != nil {
+		g.Add(cb.watch)
+	}
+	if leader != nil {
+		g.Add(leader.Run)
+	}
+	if pl != nil && c.pacRefreshInterval > 0 {
+		g.Add(pl.refresh)
+	}
+	if cc != nil {
+		g.Add(cc.Run)
+	}
+	if ng != nil {
+		g.Add(ng.Run)
+	}
+	if ss != nil {
+		g.Add(ss.Run)
+	}
+	var wh *webhook.Notifier
+	if len(c.webhookConfig.URLs) > 0 {
+		c.webhookConfig.Source = c.httpProxyConfig.Name
+		if err := c.webhookConfig.Validate(); err != nil {
+			return fmt.Errorf("webhook: %w", err)
+		}
+		wh = webhook.New(c.webhookConfig, logger.Named("webhook"))
+		c.httpProxyConfig.Webhook = &forwarder.WebhookConfig{
+			Notifier:  wh,
+			ErrorRate: c.webhookErrorRate,
+		}
+		g.Add(wh.Run)
+	}
+	if c.errorStream {
+		es := forwarder.NewErrorStream()
+		c.httpProxyConfig.ErrorStream = es
+
+		ep = append(ep, forwarder.APIEndpoint{
+			Path:        "/errors/stream",
+			Handler:     es,
+			Description: "Stream of proxy errors as Server-Sent Events or newline delimited JSON",
+		})
+	}
+	// The leak check compares the number of goroutines with the number of open connections from the table.
+	if c.connTable || c.leakCheckConfig.Interval > 0 {
+		t := conntrack.NewTable()
+		c.httpTransportConfig.ConnTable = t
+		c.httpProxyConfig.ConnTable = t
+		for i := range c.httpProxyConfig.ExtraListeners {
+			c.httpProxyConfig.ExtraListeners[i].ConnTable = t
+		}
+
+		if c.connTable {
+			ep = append(ep, forwarder.APIEndpoint{
+				Path:        "/conntrack",
+				Handler:     httphandler.ConnTable(t),
+				Description: "Open connections per destination and client, connection age distribution and top talkers",
+			})
+
+			if c.connTableLogInterval > 0 {
+				l := logger.Named("conntrack")
+				g.Add(func(ctx context.Context) error {
+					return t.Log(ctx, c.connTableLogInterval, 10, l.Infof)
+				})
+			}
+		}
+
+		if c.leakCheckConfig.Interval > 0 {
+			lc, err := forwarder.NewLeakChecker(c.leakCheckConfig, t.Len, logger.Named("leakcheck"))
+			if err != nil {
+				return fmt.Errorf("leak check: %w", err)
+			}
+			g.Add(lc.Run)
+		}
+	}
 	{
 		rt, err := forwarder.NewHTTPTransport(c.httpTransportConfig)
 		if err != nil {
@@ -224,6 +762,15 @@ func (c *command) runE(cmd *cobra.Command, _ []string) (cmdErr error) {
 		rt.DialContext = martianlog.LoggingDialContext(rt.DialContext)
 		c.transportWithProxyConnectHeader(rt)
 
+		var st *selfTest
+		if c.selfTest {
+			st = newSelfTest()
+			defer st.Close()
+			if err := st.trustOrigin(rt); err != nil {
+				return fmt.Errorf("self-test: %w", err)
+			}
+		}
+
 		p, err := forwarder.NewHTTPProxy(c.httpProxyConfig, pr, cm, rt, logger.Named("proxy"))
 		if err != nil {
 			return err
@@ -231,11 +778,104 @@ func (c *command) runE(cmd *cobra.Command, _ []string) (cmdErr error) {
 		defer p.Close()
 		g.Add(p.Run)
 
+		// Listeners are in the order of the main listener, extra listeners and TCP forwards.
+		addrs, _ := p.Addr()
+		ready.add("proxy", string(c.httpProxyConfig.Protocol), addrs[0])
+		addrs = addrs[1:]
+		for _, lc := range c.httpProxyConfig.ExtraListeners {
+			// Listeners not bound by the proxy, such as the WebSocket tunnel, have no address.
+			if lc.Listener == nil {
+				ready.add(lc.Name, string(c.httpProxyConfig.Protocol), addrs[0])
+			}
+			addrs = addrs[1:]
+		}
+		for i, f := range c.httpProxyConfig.TCPForwards {
+			proto := "tcp"
+			if f.ListenTLS {
+				proto = "tls"
+			}
+			ready.add("tcp-forward", proto, addrs[i])
+		}
+		ready.setMITMCA(p.MITMCACert())
+
+		if h := p.UpstreamPool(); h != nil {
+			ep = append(ep, forwarder.APIEndpoint{
+				Path:        "/upstreams",
+				Handler:     h,
+				Description: "Upstream proxy pool scores and the preferred proxy",
+			})
+		}
+		if h := p.SLO(); h != nil {
+			ep = append(ep, forwarder.APIEndpoint{
+				Path:        "/slo",
+				Handler:     h,
+				Description: "Service level objectives error budget burn rates over the sliding windows",
+			})
+		}
+
+		if wst != nil {
+			s, err := forwarder.NewHTTPServer(c.wsTunnelServerConfig, wst, logger.Named("ws-tunnel"))
+			if err != nil {
+				return err
+			}
+			defer s.Close()
+			g.Add(s.Run)
+			ready.add("ws-tunnel", string(c.wsTunnelServerConfig.Protocol), s.Addr())
+		}
+
+		if c.dnsProxyConfig.Address != "" || c.dohServerConfig.Address != "" {
+			c.dnsProxyConfig.Servers = c.dnsConfig.Servers
+			c.dnsProxyConfig.DenyDomains = c.httpProxyConfig.DenyDomains
+			c.dnsProxyConfig.DirectDomains = c.httpProxyConfig.DirectDomains
+			dp, err := forwarder.NewDNSProxy(c.dnsProxyConfig, logger.Named("dns-proxy"))
+			if err != nil {
+				return err
+			}
+			defer dp.Close()
+			g.Add(dp.Run)
+			if a := dp.Addr(); a != "" {
+				ready.add("dns-proxy", "dns", a)
+			}
+
+			if c.dohServerConfig.Address != "" {
+				mux := http.NewServeMux()
+				mux.Handle(forwarder.DNSProxyPath, dp)
+				s, err := forwarder.NewHTTPServer(c.dohServerConfig, mux, logger.Named("dns-proxy-doh"))
+				if err != nil {
+					return err
+				}
+				defer s.Close()
+				g.Add(s.Run)
+				ready.add("dns-proxy-doh", string(c.dohServerConfig.Protocol), s.Addr())
+			}
+		}
+
+		if c.selfTest {
+			g.Add(func(ctx context.Context) error {
+				defer cancel()
+				return st.run(ctx, cmd.OutOrStdout(), p, c.httpProxyConfig)
+			})
+		}
+
+		ep = append(ep, forwarder.APIEndpoint{
+			Path:        "/transport/close-idle",
+			Handler:     httphandler.CloseIdleConnections(p),
+			Method:      http.MethodPost,
+			Description: "Close idle upstream connections to reset the transport connection pools",
+		})
+
 		if ca := p.MITMCACert(); ca != nil {
 			ep = append(ep, forwarder.APIEndpoint{
-				Path:    "/cacert",
-				Handler: httphandler.SendCACert(ca),
+				Path:        "/cacert",
+				Handler:     httphandler.SendCACerts(p.MITMCACerts),
+				Description: "MITM CA certificates, during CA rotation it includes both the old and the new CA",
 			})
+
+			if wh != nil && c.webhookCAExpiry > 0 {
+				g.Add(func(ctx context.Context) error {
+					return wh.WatchCertExpiry(ctx, p.MITMCACert, c.webhookCAExpiry)
+				})
+			}
 		}
 	}
 
@@ -255,13 +895,23 @@ func (c *command) runE(cmd *cobra.Command, _ []string) (cmdErr error) {
 
 		ep := append([]forwarder.APIEndpoint{
 			{
-				Path:    "/version",
-				Handler: httphandler.Version(version.Version, version.Time, version.Commit),
+				Path:        "/version",
+				Handler:     httphandler.Version(version.Version, version.Time, version.Commit),
+				Description: "Version information",
+			},
+			{
+				Path:        "/listeners",
+				Handler:     listenersHandler(&ready),
+				Description: "Listener names, protocols and bound addresses, including ports chosen by the system",
 			},
 		}, ep...)
-		h := forwarder.NewAPIHandler("Forwarder "+version.Version, c.promReg, nil, ep...)
+		var h http.Handler = forwarder.NewAPIHandler("Forwarder "+version.Version, c.promReg, nil, ep...)
+		if c.apiReadOnly {
+			logger.Named("api").Infof("read-only mode enabled")
+			h = forwarder.ReadOnlyAPIHandler(h)
+		}
 
-		if os.Getenv("PLATFORM") == "container" {
+		if os.Getenv("PLATFORM") == "container" && !c.selfTest {
 			g.Add(func(ctx context.Context) error {
 				logger.Named("api").Infof("HTTP server listen socket path=%s", forwarder.APIUnixSocket)
 				return httpx.ServeUnixSocket(ctx, h, forwarder.APIUnixSocket)
@@ -275,6 +925,7 @@ func (c *command) runE(cmd *cobra.Command, _ []string) (cmdErr error) {
 			}
 			defer a.Close()
 			g.Add(a.Run)
+			ready.add("api", string(c.apiServerConfig.Protocol), a.Addr())
 		}
 	}
 
@@ -291,7 +942,110 @@ func (c *command) runE(cmd *cobra.Command, _ []string) (cmdErr error) {
 		return nil
 	}
 
-	return g.Run()
+	ready.PID = os.Getpid()
+	ready.Version = version.Version
+	logger.Infof("%s", &ready)
+	if c.readyFile != "" {
+		if err := writeReadyFile(c.readyFile, &ready); err != nil {
+			return fmt.Errorf("write ready file: %w", err)
+		}
+		defer os.Remove(c.readyFile)
+	}
+	if c.discovery.enabled() {
+		g.Add(func(ctx context.Context) error {
+			if err := c.discovery.run(ctx, &ready); err != nil {
+				return fmt.Errorf("discovery hook: %w", err)
+			}
+			logger.Infof("listeners registered with discovery hook")
+			return nil
+		})
+	}
+
+	return g.RunContext(ctx)
+}
+
+func (c *command) configureFDGuard(l log.Logger) error {
+	soft, hard, err := fdlimit.Get()
+	if errors.Is(err, fdlimit.ErrUnsupported) {
+		l.Debugf("file descriptor limit not supported on this platform")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("get file descriptor limit: %w", err)
+	}
+
+	if c.fdLimit > 0 && c.fdLimit != soft {
+		soft, err = fdlimit.Set(c.fdLimit)
+		if err != nil {
+			return fmt.Errorf("set file descriptor limit: %w", err)
+		}
+	}
+
+	if !c.fdGuard {
+		l.Infof("file descriptor limit soft=%d hard=%d", soft, hard)
+		return nil
+	}
+
+	reserve := c.fdReserve
+	if reserve == 0 {
+		reserve = forwarder.DefaultFDReserve(soft)
+	}
+	if reserve >= soft {
+		return fmt.Errorf("file descriptor reserve %d must be lower than the soft limit %d", reserve, soft)
+	}
+	limit := soft - reserve
+	l.Infof("file descriptor limit soft=%d hard=%d, shedding client connections above %d open connections", soft, hard, limit)
+
+	g := forwarder.NewFDGuard(int64(limit), l)
+	c.httpTransportConfig.FDGuard = g
+	c.httpProxyConfig.FDGuard = g
+	for i := range c.httpProxyConfig.ExtraListeners {
+		c.httpProxyConfig.ExtraListeners[i].FDGuard = g
+	}
+
+	return nil
+}
+
+// configureTuning applies the resource dependent defaults derived from GOMEMLIMIT and GOMAXPROCS,
+// the values set with flags take precedence.
+// GOMEMLIMIT is only set if it was set explicitly or if there is a container memory limit, see cmd/forwarder,
+// otherwise the static defaults are kept.
+func (c *command) configureTuning(fs *pflag.FlagSet, l log.Logger) {
+	t := forwarder.DefaultTuning()
+	t.Procs = runtime.GOMAXPROCS(0)
+	if c.autotune {
+		limit := debug.SetMemoryLimit(-1)
+		if limit == math.MaxInt64 {
+			limit = 0
+		}
+		t = forwarder.NewTuning(limit, t.Procs)
+	}
+
+	if fs.Changed("buffer-size") {
+		t.BufferSize = c.bufferSize
+	}
+	if fs.Changed("http-max-idle-conns") {
+		t.MaxIdleConns = c.httpTransportConfig.MaxIdleConns
+	}
+	if fs.Changed("http-max-idle-conns-per-host") {
+		t.MaxIdleConnsPerHost = c.httpTransportConfig.MaxIdleConnsPerHost
+	}
+	if fs.Changed("mitm-cache-size") {
+		t.MITMCacheSize = c.mitmConfig.CacheSize
+	}
+	if fs.Changed("http-tls-session-cache-size") {
+		t.TLSSessionCacheSize = c.httpTransportConfig.SessionCacheSize
+	}
+
+	c.httpProxyConfig.CopyBufferSize = int(t.BufferSize)
+	c.httpTransportConfig.ReadBufferSize = int(t.BufferSize)
+	c.httpTransportConfig.WriteBufferSize = int(t.BufferSize)
+	c.httpTransportConfig.MaxIdleConns = t.MaxIdleConns
+	c.httpTransportConfig.MaxIdleConnsPerHost = t.MaxIdleConnsPerHost
+	c.mitmConfig.CacheSize = t.MITMCacheSize
+	c.httpTransportConfig.SessionCacheSize = t.TLSSessionCacheSize
+
+	l.Infof("resource tuning autotune=%t %s", c.autotune, t)
 }
 
 func (c *command) configureHeadersModifiers() {
@@ -330,6 +1084,34 @@ func (c *command) transportWithProxyConnectHeader(tr *http.Transport) {
 	}
 }
 
+func (c *command) openLogSinks() (*log.Batcher, error) {
+	var ms log.MultiSink
+	for _, v := range c.logSinks {
+		s, err := sink.Open(v)
+		if err != nil {
+			ms.Close()
+			return nil, err
+		}
+		ms = append(ms, s)
+	}
+
+	// JSON on stdout replaces the text output unless it goes to a file.
+	if slices.Contains(c.logSinks, sink.Stdout) && c.logConfig.File == nil {
+		f, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			ms.Close()
+			return nil, err
+		}
+		c.logConfig.File = f
+	}
+
+	var s log.Sink = ms
+	if len(ms) == 1 {
+		s = ms[0]
+	}
+	return log.NewBatcher(s, log.DefaultBatchConfig()), nil
+}
+
 func (c *command) registerErrorsMetric() (func(name string), error) {
 	m := prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: c.httpProxyConfig.PromNamespace,
@@ -416,27 +1198,87 @@ func Command() *cobra.Command {
 		Example: example,
 		RunE:    c.runE,
 	}
+	c.bindFlags(cmd)
+
+	return cmd
+}
 
+func (c *command) bindFlags(cmd *cobra.Command) {
 	fs := cmd.Flags()
 	bind.DNSConfig(fs, c.dnsConfig)
+	bind.DNSHosts(fs, &c.httpTransportConfig.Hosts, &c.dnsHostsFile)
+	bind.DNSProxy(fs, c.dnsProxyConfig, c.dohServerConfig)
 	bind.HTTPTransportConfig(fs, c.httpTransportConfig)
+	bind.DialProxyProtocol(fs, &c.httpTransportConfig.ProxyProtocol)
 	bind.ConnectTo(fs, &c.connectTo)
 	bind.PAC(fs, &c.pac)
+	bind.PACDisableDNS(fs, &c.pacDisableDNS)
+	bind.PACRefreshInterval(fs, &c.pacRefreshInterval)
+	bind.PACRetryInterval(fs, &c.httpProxyConfig.PACRetryInterval)
+	bind.ClusterRedis(fs, &c.clusterRedis)
+	bind.SystemProxy(fs, &c.systemProxy, c.systemProxyConfig)
 	bind.Credentials(fs, &c.credentials)
+	bind.CredentialsCommand(fs, c.credentialsCommandConfig)
+	bind.Negotiate(fs, c.negotiateConfig)
+	bind.SPIFFE(fs, &c.spiffeSocket, &c.spiffeDomains, &c.spiffeClientIDs)
+	bind.ConfigBackend(fs, &c.configBackend)
 	bind.DenyDomains(fs, &c.denyDomains)
+	bind.DenyDomainsSchedule(fs, &c.denyDomainsSchedule)
 	bind.DirectDomains(fs, &c.directDomains)
+	bind.DirectDomainsSchedule(fs, &c.directDomainsSchedule)
+	bind.NoProxy(fs, &c.httpProxyConfig.NoProxy)
+	bind.RequestCollapsing(fs, &c.collapse, c.collapseConfig)
+	bind.PortPolicy(fs, &c.httpProxyConfig.PortPolicies)
+	bind.TCPForward(fs, &c.httpProxyConfig.TCPForwards)
+	bind.SOCKS5UDP(fs, &c.socks5UDP, c.socks5UDPConfig)
+	bind.Homograph(fs, c.homographConfig)
+	bind.RateLimit(fs, &c.rateLimits, &c.rateLimitRedis)
 	bind.ConnectHeaders(fs, &c.connectHeaders)
+	bind.ConnectHeaderPolicy(fs, &c.httpProxyConfig.ConnectHeaderForward, &c.httpProxyConfig.ConnectHeaderTemplates)
+	bind.ConnectResponseHeaders(fs, &c.httpProxyConfig.ConnectResponseHeaders)
 	bind.RequestHeaders(fs, &c.requestHeaders)
+	bind.Baggage(fs, &c.httpProxyConfig.Baggage)
 	bind.ResponseHeaders(fs, &c.responseHeaders)
 	bind.HTTPProxyConfig(fs, c.httpProxyConfig, c.logConfig)
+	bind.UpstreamPool(fs, c.upstreamPoolConfig)
+	bind.LogSink(fs, &c.logSinks)
+	bind.DecisionLog(fs, &c.decisionLogFile, c.decisionLogConfig)
 	bind.MITMConfig(fs, &c.mitm, c.mitmConfig)
 	bind.MITMDomains(fs, &c.mitmDomains)
+	bind.MITMCertLog(fs, &c.mitmCertLogFile)
+	bind.BodyCapture(fs, c.bodyCaptureConfig, &c.bodyCaptureDomains)
+	bind.ContentVerify(fs, c.contentVerifyConfig, &c.verifyManifest, &c.verifyDomains)
+	bind.Inject(fs, c.injectConfig, &c.injectHTML, &c.injectHeaders, &c.injectDomains)
+	bind.URLRewrite(fs, c.urlRewriteConfig, &c.urlRewriteDomains)
+	bind.ResponseDiff(fs, c.resDiffConfig, &c.resDiffFile, &c.resDiffReference, &c.resDiffDomains)
+	bind.OAuth2(fs, c.oauth2Config)
+	bind.RequestSigning(fs, c.signingConfig)
+	bind.MITMDomainFronting(fs, &c.httpProxyConfig.MITMDenyDomainFronting, &c.mitmFrontingAllow)
 	bind.ProxyProtocol(fs, &c.proxyProtocol, c.proxyProtocolConfig)
 	bind.HTTPServerConfig(fs, c.apiServerConfig, "api", forwarder.HTTPScheme)
+	bind.APIReadOnly(fs, &c.apiReadOnly)
+	bind.WSTunnel(fs, c.wsTunnelServerConfig)
+	bind.ReverseListenerConfig(fs, c.reverseConfig)
+	bind.ConnTable(fs, &c.connTable, &c.connTableLogInterval)
+	bind.LeakCheck(fs, c.leakCheckConfig)
+	bind.ErrorStream(fs, &c.errorStream)
+	bind.SLO(fs, &c.slo, c.sloConfig)
+	bind.Webhook(fs, c.webhookConfig, &c.webhookErrorRate, &c.webhookCAExpiry)
+	bind.FDLimit(fs, &c.fdLimit, &c.fdReserve, &c.fdGuard)
+	bind.Autotune(fs, &c.autotune, &c.bufferSize)
+	bind.ReadyFile(fs, &c.readyFile)
+	bind.DiscoveryHook(fs, &c.discovery.Command, &c.discovery.URL, &c.discovery.Timeout)
+	bind.APICORS(fs, &c.apiServerConfig.CORSOrigins)
 	bind.HTTPLogConfig(fs, []bind.NamedParam[httplog.Mode]{
 		{Name: "api", Param: &c.apiServerConfig.LogHTTPMode},
 		{Name: "proxy", Param: &c.httpProxyConfig.LogHTTPMode},
+		{Name: "ws-tunnel", Param: &c.wsTunnelServerConfig.LogHTTPMode},
+		{Name: "dns-proxy-doh", Param: &c.dohServerConfig.LogHTTPMode},
 	})
+	bind.LogRedact(fs, c.httpProxyConfig.LogHTTPRedact)
+	bind.LogHTTPBody(fs, c.httpProxyConfig.LogHTTPBody, &c.logHTTPBodyDomains)
+	bind.LogHTTPFilter(fs, &c.httpProxyConfig.LogHTTPFilter)
+	bind.LogHTTPFile(fs, &c.logHTTPFile)
 
 	bind.ProxyHeaders(fs, &c.connectHeaders)
 	fs.Lookup("proxy-header").Deprecated = "use --connect-header flag instead"
@@ -444,14 +1286,14 @@ func Command() *cobra.Command {
 
 	bind.AutoMarkFlagFilename(cmd)
 	cmd.MarkFlagsMutuallyExclusive("proxy", "pac")
+	cmd.MarkFlagsMutuallyExclusive("proxy", "proxy-auto-detect")
+	cmd.MarkFlagsMutuallyExclusive("pac", "proxy-auto-detect")
 
 	fs.BoolVar(&c.goleak, "goleak", false, "enable goleak")
 
 	bind.MarkFlagHidden(cmd,
 		"goleak",
 	)
-
-	return cmd
 }
 
 func Metrics() (*prometheus.Registry, error) {
@@ -479,20 +1321,61 @@ func Metrics() (*prometheus.Registry, error) {
 
 func makeCommand() command {
 	c := command{
-		promReg:             prometheus.NewRegistry(),
-		dnsConfig:           forwarder.DefaultDNSConfig(),
-		httpTransportConfig: forwarder.DefaultHTTPTransportConfig(),
-		httpProxyConfig:     forwarder.DefaultHTTPProxyConfig(),
-		mitmConfig:          forwarder.DefaultMITMConfig(),
-		proxyProtocolConfig: forwarder.DefaultProxyProtocolConfig(),
-		apiServerConfig:     forwarder.DefaultHTTPServerConfig(),
-		logConfig:           log.DefaultConfig(),
+		promReg:                  prometheus.NewRegistry(),
+		dnsConfig:                forwarder.DefaultDNSConfig(),
+		dnsProxyConfig:           forwarder.DefaultDNSProxyConfig(),
+		dohServerConfig:          forwarder.DefaultHTTPServerConfig(),
+		httpTransportConfig:      forwarder.DefaultHTTPTransportConfig(),
+		httpProxyConfig:          forwarder.DefaultHTTPProxyConfig(),
+		systemProxyConfig:        forwarder.DefaultSystemProxyConfig(),
+		mitmConfig:               forwarder.DefaultMITMConfig(),
+		proxyProtocolConfig:      forwarder.DefaultProxyProtocolConfig(),
+		apiServerConfig:          forwarder.DefaultHTTPServerConfig(),
+		wsTunnelServerConfig:     forwarder.DefaultHTTPServerConfig(),
+		reverseConfig:            forwarder.DefaultReverseListenerConfig(),
+		credentialsCommandConfig: forwarder.DefaultCredentialsCommandConfig(),
+		negotiateConfig:          forwarder.DefaultNegotiateConfig(),
+		upstreamPoolConfig:       forwarder.DefaultUpstreamPoolConfig(),
+		leakCheckConfig:          forwarder.DefaultLeakCheckConfig(),
+		sloConfig:                forwarder.DefaultSLOConfig(),
+		spiffeSocket:             os.Getenv(spiffe.EndpointSocketEnv),
+		logConfig:                log.DefaultConfig(),
+		decisionLogConfig:        forwarder.DefaultDecisionLogConfig(),
+		bodyCaptureConfig:        forwarder.DefaultBodyCaptureConfig(),
+		contentVerifyConfig:      new(forwarder.ContentVerifyConfig),
+		injectConfig:             forwarder.DefaultInjectConfig(),
+		urlRewriteConfig:         forwarder.DefaultURLRewriteConfig(),
+		resDiffConfig:            forwarder.DefaultResponseDiffConfig(),
+		signingConfig:            forwarder.DefaultRequestSigningConfig(),
+		oauth2Config:             forwarder.DefaultOAuth2Config(),
+		homographConfig:          new(forwarder.HomographConfig),
+		collapseConfig:           forwarder.DefaultRequestCollapsingConfig(),
+		socks5UDPConfig:          forwarder.DefaultSOCKS5UDPConfig(),
+		webhookConfig:            webhook.DefaultConfig(),
+		webhookCAExpiry:          7 * 24 * time.Hour,
+		fdGuard:                  true,
+		autotune:                 true,
+		discovery:                defaultDiscoveryHook(),
 	}
 	c.httpTransportConfig.PromRegistry = c.promReg
 	c.httpTransportConfig.PromNamespace = promNs
 	c.httpProxyConfig.PromRegistry = c.promReg
 	c.httpProxyConfig.PromNamespace = promNs
+	c.leakCheckConfig.PromRegistry = c.promReg
+	c.leakCheckConfig.PromNamespace = promNs
+	c.dnsProxyConfig.PromRegistry = c.promReg
+	c.dnsProxyConfig.PromNamespace = promNs
 	c.apiServerConfig.Address = "localhost:10000"
+	c.apiServerConfig.LogHTTPRedact = c.httpProxyConfig.LogHTTPRedact
+	c.apiServerConfig.LogHTTPBody = c.httpProxyConfig.LogHTTPBody
+	c.wsTunnelServerConfig.Address = ""
+	c.wsTunnelServerConfig.Protocol = forwarder.HTTPSScheme
+	c.wsTunnelServerConfig.LogHTTPRedact = c.httpProxyConfig.LogHTTPRedact
+	c.wsTunnelServerConfig.LogHTTPBody = c.httpProxyConfig.LogHTTPBody
+	c.dohServerConfig.Address = ""
+	c.dohServerConfig.Protocol = forwarder.HTTPSScheme
+	c.dohServerConfig.LogHTTPRedact = c.httpProxyConfig.LogHTTPRedact
+	c.dohServerConfig.LogHTTPBody = c.httpProxyConfig.LogHTTPBody
 
 	return c
 }
@@ -0,0 +1,368 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package run
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1" //nolint:gosec // required by the WebSocket handshake
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/saucelabs/forwarder"
+	"github.com/spf13/cobra"
+)
+
+func SelfTestCommand() *cobra.Command {
+	c := makeCommand()
+	c.selfTest = true
+
+	cmd := &cobra.Command{
+		Use:   "selftest [--pac <path or url>] [--mitm]...",
+		Short: "Check the proxy configuration by sending test traffic through it",
+		Long:  selfTestLong,
+		RunE:  c.runE,
+	}
+	c.bindFlags(cmd)
+
+	return cmd
+}
+
+const selfTestLong = `Check the proxy configuration by sending test traffic through it.
+It accepts the same flags as the run command, and starts the proxy on an ephemeral localhost port without the API server.
+An ephemeral origin server is started, and HTTP, HTTPS (MITM or tunnel), WebSocket and SSE requests are sent to it through the proxy.
+Requests to the origin server are always sent directly, the upstream proxy and PAC script are not used for them.
+The result of each check is printed to stdout, the command fails if any of the checks fail.
+`
+
+// configureSelfTest adjusts the configuration so that the proxy can be reached by the self-test client,
+// and the self-test client can reach the origin server.
+func (c *command) configureSelfTest() {
+	c.httpProxyConfig.Address = "localhost:0"
+	c.httpProxyConfig.ExtraListeners = nil
+	if c.httpProxyConfig.Protocol == forwarder.HTTP2Scheme {
+		c.httpProxyConfig.Protocol = forwarder.HTTPSScheme
+	}
+	c.httpProxyConfig.ProxyLocalhost = forwarder.DirectProxyLocalhost
+	c.proxyProtocol = false
+	c.apiServerConfig.Address = ""
+}
+
+const selfTestTimeout = 10 * time.Second
+
+type selfTestResult struct {
+	name string
+	err  error
+	skip string
+}
+
+type selfTest struct {
+	origin    *httptest.Server
+	tlsOrigin *httptest.Server
+}
+
+func newSelfTest() *selfTest {
+	return &selfTest{
+		origin:    httptest.NewServer(selfTestOriginHandler()),
+		tlsOrigin: httptest.NewTLSServer(selfTestOriginHandler()),
+	}
+}
+
+// trustOrigin makes the proxy transport trust the origin server certificate.
+func (st *selfTest) trustOrigin(rt *http.Transport) error {
+	if rt.TLSClientConfig == nil {
+		rt.TLSClientConfig = new(tls.Config)
+	}
+	if rt.TLSClientConfig.RootCAs == nil {
+		p, err := x509.SystemCertPool()
+		if err != nil {
+			return err
+		}
+		rt.TLSClientConfig.RootCAs = p
+	}
+	rt.TLSClientConfig.RootCAs.AddCert(st.tlsOrigin.Certificate())
+	return nil
+}
+
+func (st *selfTest) Close() {
+	st.origin.Close()
+	st.tlsOrigin.Close()
+}
+
+func (st *selfTest) run(ctx context.Context, w io.Writer, p *forwarder.HTTPProxy, cfg *forwarder.HTTPProxyConfig) error {
+	origin, tlsOrigin := st.origin, st.tlsOrigin
+
+	addrs, _ := p.Addr()
+	proxyURL := &url.URL{
+		Scheme: string(cfg.Protocol),
+		Host:   addrs[0],
+		User:   cfg.BasicAuth,
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(tlsOrigin.Certificate())
+	mitmCA := p.MITMCACert()
+	if mitmCA != nil {
+		roots.AddCert(mitmCA)
+	}
+	tlsConfig := &tls.Config{
+		RootCAs: roots,
+		// The proxy certificate is most likely self-signed, and Go uses the same TLS config for the proxy and the origin.
+		InsecureSkipVerify: proxyURL.Scheme == string(forwarder.HTTPSScheme), //nolint:gosec // see above
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: tlsConfig,
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	var results []selfTestResult
+	check := func(name string, fn func(ctx context.Context) error) {
+		ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+		defer cancel()
+		results = append(results, selfTestResult{name: name, err: fn(ctx)})
+	}
+
+	check("http", func(ctx context.Context) error {
+		return selfTestGet(ctx, client, origin.URL, nil)
+	})
+
+	{
+		ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+		var mitm bool
+		err := selfTestGet(ctx, client, tlsOrigin.URL, func(res *http.Response) {
+			if mitmCA != nil && res.TLS != nil && len(res.TLS.PeerCertificates) > 0 {
+				mitm = res.TLS.PeerCertificates[0].CheckSignatureFrom(mitmCA) == nil
+			}
+		})
+		cancel()
+		tunnel := selfTestResult{name: "https-tunnel", err: err}
+		mitmed := selfTestResult{name: "https-mitm", err: err}
+		switch {
+		case err != nil && mitmCA != nil:
+			tunnel.skip = "MITM enabled"
+		case err != nil:
+			mitmed.skip = "MITM disabled"
+		case mitm:
+			tunnel.skip = "MITM applied to the origin"
+		case mitmCA != nil:
+			mitmed.skip = "MITM not applied to the origin"
+		default:
+			mitmed.skip = "MITM disabled"
+		}
+		results = append(results, tunnel, mitmed)
+	}
+
+	check("websocket", func(ctx context.Context) error {
+		return selfTestWebSocket(ctx, proxyURL, tlsConfig, origin.URL+"/ws")
+	})
+
+	check("sse", func(ctx context.Context) error {
+		return selfTestSSE(ctx, client, origin.URL+"/sse")
+	})
+
+	var failed int
+	for _, r := range results {
+		switch {
+		case r.skip != "":
+			fmt.Fprintf(w, "SKIP %s: %s\n", r.name, r.skip)
+		case r.err != nil:
+			failed++
+			fmt.Fprintf(w, "FAIL %s: %v\n", r.name, r.err)
+		default:
+			fmt.Fprintf(w, "PASS %s\n", r.name)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("self-test failed: %d of %d checks failed", failed, len(results))
+	}
+
+	return nil
+}
+
+const selfTestSSEEvents = 3
+
+func selfTestOriginHandler() http.Handler {
+	m := http.NewServeMux()
+	m.HandleFunc("/", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("OK"))
+	})
+	m.HandleFunc("/sse", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		rc := http.NewResponseController(w)
+		for i := range selfTestSSEEvents {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	})
+	m.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			http.Error(w, "expected websocket upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\n\r\n", webSocketAccept(r.Header.Get("Sec-WebSocket-Key")))
+		if err := brw.Flush(); err != nil {
+			return
+		}
+		io.Copy(conn, brw) //nolint:errcheck // echo until the client closes the connection
+	})
+	return m
+}
+
+func webSocketAccept(key string) string {
+	h := sha1.New() //nolint:gosec // required by the WebSocket handshake
+	h.Write([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func selfTestGet(ctx context.Context, client *http.Client, u string, fn func(res *http.Response)) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, http.NoBody)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s: %s", res.Status, res.Header.Get(forwarder.ErrorHeader))
+	}
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if string(b) != "OK" {
+		return fmt.Errorf("unexpected body %q", b)
+	}
+	if fn != nil {
+		fn(res)
+	}
+	return nil
+}
+
+func selfTestSSE(ctx context.Context, client *http.Client, u string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, http.NoBody)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s: %s", res.Status, res.Header.Get(forwarder.ErrorHeader))
+	}
+
+	var events int
+	s := bufio.NewScanner(res.Body)
+	for s.Scan() {
+		if strings.HasPrefix(s.Text(), "data:") {
+			events++
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	if events != selfTestSSEEvents {
+		return fmt.Errorf("expected %d events, got %d", selfTestSSEEvents, events)
+	}
+	return nil
+}
+
+// selfTestWebSocket performs a WebSocket handshake through the proxy and checks that data is echoed back.
+// WebSocket framing is not used, as the proxy is not aware of it.
+func selfTestWebSocket(ctx context.Context, proxyURL *url.URL, tlsConfig *tls.Config, u string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if proxyURL.Scheme == string(forwarder.HTTPSScheme) {
+		tconn := tls.Client(conn, tlsConfig)
+		if err := tconn.HandshakeContext(ctx); err != nil {
+			return err
+		}
+		conn = tconn
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, http.NoBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "c2VsZnRlc3Qtd2Vic29ja2V0")
+	if u := proxyURL.User; u != nil {
+		p, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+p)))
+	}
+	if err := req.WriteProxy(conn); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		res.Body.Close()
+		return fmt.Errorf("unexpected status %s: %s", res.Status, res.Header.Get(forwarder.ErrorHeader))
+	}
+	if got, want := res.Header.Get("Sec-WebSocket-Accept"), webSocketAccept(req.Header.Get("Sec-WebSocket-Key")); got != want {
+		return fmt.Errorf("unexpected Sec-WebSocket-Accept %q", got)
+	}
+
+	const ping = "ping"
+	if _, err := io.WriteString(conn, ping); err != nil {
+		return err
+	}
+	b := make([]byte, len(ping))
+	if _, err := io.ReadFull(br, b); err != nil {
+		return err
+	}
+	if string(b) != ping {
+		return errors.New("unexpected echo")
+	}
+
+	return nil
+}
@@ -0,0 +1,285 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package bench
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mmatczuk/anyflag"
+	"github.com/saucelabs/forwarder"
+	"github.com/saucelabs/forwarder/bind"
+	"github.com/saucelabs/forwarder/utils/httpbin"
+	"github.com/spf13/cobra"
+)
+
+type command struct {
+	proxy       *url.URL
+	target      string
+	apiAddr     string
+	concurrency int
+	duration    time.Duration
+	insecure    bool
+}
+
+// Metrics of the proxy process used to report resource usage.
+const (
+	cpuMetric = "forwarder_process_cpu_seconds_total"
+	rssMetric = "forwarder_process_resident_memory_bytes"
+)
+
+func (c *command) runE(cmd *cobra.Command, _ []string) error {
+	if c.concurrency <= 0 {
+		return errors.New("concurrency must be positive")
+	}
+
+	target := c.target
+	if target == "" {
+		l, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			return err
+		}
+		s := &http.Server{
+			Handler:           httpbin.Handler(),
+			ReadHeaderTimeout: time.Minute,
+		}
+		go s.Serve(l) //nolint:errcheck // closed below
+		defer s.Close()
+		target = "http://" + l.Addr().String() + "/status/200"
+	}
+
+	tr := &http.Transport{
+		Proxy:               http.ProxyURL(c.proxy),
+		MaxIdleConnsPerHost: c.concurrency,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: c.insecure, //nolint:gosec // explicitly enabled by the user
+		},
+	}
+	defer tr.CloseIdleConnections()
+
+	w := cmd.OutOrStdout()
+	fmt.Fprintf(w, "Benchmarking %s via %s, concurrency=%d duration=%s\n", target, c.proxy.Redacted(), c.concurrency, c.duration)
+
+	before, beforeErr := c.scrapeMetrics()
+	r := c.run(cmd.Context(), tr, target)
+	after, afterErr := c.scrapeMetrics()
+
+	r.print(w)
+
+	if c.apiAddr != "" {
+		if err := errors.Join(beforeErr, afterErr); err != nil {
+			fmt.Fprintf(w, "Proxy resources: n/a: %v\n", err)
+		} else {
+			cpu := (after[cpuMetric] - before[cpuMetric]) / r.elapsed.Seconds()
+			fmt.Fprintf(w, "Proxy CPU:      %.1f%% of one core\n", cpu*100)
+			fmt.Fprintf(w, "Proxy memory:   %.1f MiB RSS\n", after[rssMetric]/(1<<20))
+		}
+	}
+
+	if r.requests == 0 {
+		return errors.New("no successful requests")
+	}
+
+	return nil
+}
+
+type result struct {
+	elapsed   time.Duration
+	requests  int
+	errors    int
+	firstErr  error
+	latencies []time.Duration
+}
+
+func (c *command) run(ctx context.Context, tr http.RoundTripper, target string) *result {
+	ctx, cancel := context.WithTimeout(ctx, c.duration)
+	defer cancel()
+
+	var (
+		mu  sync.Mutex
+		res result
+		wg  sync.WaitGroup
+	)
+
+	start := time.Now()
+	for range c.concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var (
+				latencies []time.Duration
+				errs      int
+				firstErr  error
+			)
+			for ctx.Err() == nil {
+				t := time.Now()
+				err := doRequest(ctx, tr, target)
+				if ctx.Err() != nil {
+					break
+				}
+				if err != nil {
+					errs++
+					if firstErr == nil {
+						firstErr = err
+					}
+					continue
+				}
+				latencies = append(latencies, time.Since(t))
+			}
+
+			mu.Lock()
+			res.latencies = append(res.latencies, latencies...)
+			res.errors += errs
+			if res.firstErr == nil {
+				res.firstErr = firstErr
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	res.elapsed = time.Since(start)
+	res.requests = len(res.latencies)
+	slices.Sort(res.latencies)
+
+	return &res
+}
+
+func doRequest(ctx context.Context, tr http.RoundTripper, target string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, http.NoBody)
+	if err != nil {
+		return err
+	}
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if _, err := io.Copy(io.Discard, res.Body); err != nil {
+		return err
+	}
+	if res.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("unexpected status %s: %s", res.Status, res.Header.Get(forwarder.ErrorHeader))
+	}
+	return nil
+}
+
+func (r *result) percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(r.latencies)-1) * p)
+	return r.latencies[i]
+}
+
+func (r *result) print(w io.Writer) {
+	fmt.Fprintf(w, "Requests:       %d\n", r.requests)
+	fmt.Fprintf(w, "Errors:         %d\n", r.errors)
+	if r.firstErr != nil {
+		fmt.Fprintf(w, "First error:    %v\n", r.firstErr)
+	}
+	fmt.Fprintf(w, "RPS:            %.1f\n", float64(r.requests)/r.elapsed.Seconds())
+	fmt.Fprintf(w, "Latency p50:    %s\n", r.percentile(0.50))
+	fmt.Fprintf(w, "Latency p90:    %s\n", r.percentile(0.90))
+	fmt.Fprintf(w, "Latency p99:    %s\n", r.percentile(0.99))
+	fmt.Fprintf(w, "Latency max:    %s\n", r.percentile(1))
+}
+
+// scrapeMetrics returns the proxy process metrics from the API server /metrics endpoint.
+func (c *command) scrapeMetrics() (map[string]float64, error) {
+	if c.apiAddr == "" {
+		return nil, nil
+	}
+
+	res, err := http.Get("http://" + c.apiAddr + "/metrics") //nolint:noctx // local API server
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	m := make(map[string]float64)
+	s := bufio.NewScanner(res.Body)
+	for s.Scan() {
+		name, val, ok := strings.Cut(s.Text(), " ")
+		if !ok || (name != cpuMetric && name != rssMetric) {
+			continue
+		}
+		v, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", name, err)
+		}
+		m[name] = v
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if _, ok := m[cpuMetric]; !ok {
+		return nil, fmt.Errorf("metric %s not found", cpuMetric)
+	}
+
+	return m, nil
+}
+
+func Command() *cobra.Command {
+	c := command{
+		proxy:       &url.URL{Scheme: "http", Host: "localhost:3128"},
+		apiAddr:     "localhost:10000",
+		concurrency: 10,
+		duration:    10 * time.Second,
+	}
+
+	cmd := &cobra.Command{
+		Use:   "bench [--proxy <url>] [--target <url>] [--concurrency <n>] [--duration <duration>] [flags]",
+		Short: "Measure throughput and latency of a running proxy",
+		Long:  long,
+		RunE:  c.runE,
+	}
+
+	fs := cmd.Flags()
+	fs.VarP(anyflag.NewValueWithRedact[*url.URL](c.proxy, &c.proxy, forwarder.ParseProxyURL, bind.RedactURL),
+		"proxy", "x", "<[protocol://]host:port>"+
+			"Proxy to benchmark. ")
+	fs.StringVar(&c.target, "target", c.target, "<url>"+
+		"URL to request through the proxy. "+
+		"If empty, a built-in HTTP server listening on localhost is used, "+
+		"in that case the proxy must be started with --proxy-localhost allow. ")
+	fs.StringVar(&c.apiAddr, "api-address", c.apiAddr, "<host:port>"+
+		"Address of the proxy API server used to report CPU and memory usage of the proxy. "+
+		"If empty, resource usage is not reported. ")
+	fs.IntVar(&c.concurrency, "concurrency", c.concurrency, "<n>"+
+		"Number of concurrent clients. ")
+	fs.DurationVar(&c.duration, "duration", c.duration, "<duration>"+
+		"Duration of the benchmark. ")
+	fs.BoolVar(&c.insecure, "insecure", c.insecure, ""+
+		"Do not verify the proxy and target TLS certificates. ")
+	bind.AutoMarkFlagFilename(cmd)
+
+	return cmd
+}
+
+const long = `Measure throughput and latency of a running proxy.
+It sends GET requests to the target through the proxy from concurrent clients for the given duration,
+and reports requests per second, latency percentiles, and CPU and memory usage of the proxy.
+Use it to compare tuning options and releases.
+`
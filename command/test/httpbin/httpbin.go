@@ -111,6 +111,8 @@ func Command() *cobra.Command {
 	bind.HTTPLogConfig(fs, []bind.NamedParam[httplog.Mode]{
 		{Name: "server", Param: &c.httpServerConfig.LogHTTPMode},
 	})
+	bind.LogRedact(fs, c.httpServerConfig.LogHTTPRedact)
+	bind.LogHTTPFilter(fs, &c.httpServerConfig.LogHTTPFilter)
 	bind.LogConfig(fs, c.logConfig)
 
 	bind.AutoMarkFlagFilename(cmd)
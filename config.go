@@ -108,6 +108,7 @@ func validateProxyURL(u *url.URL) error {
 			"http",
 			"https",
 			"socks5",
+			"socks5h",
 		}
 		if !slices.Contains(supportedSchemes, u.Scheme) {
 			return fmt.Errorf("unsupported scheme %q, supported schemes are: %s", u.Scheme, strings.Join(supportedSchemes, ", "))
@@ -0,0 +1,129 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConfigGeneration is a configuration applied at a given time.
+// Diff lists the changes relative to the previous generation,
+// lines prefixed with '-' are removed and lines prefixed with '+' are added.
+type ConfigGeneration struct {
+	Generation int       `json:"generation"`
+	Time       time.Time `json:"time"`
+	Reason     string    `json:"reason"`
+	Diff       []string  `json:"diff,omitempty"`
+}
+
+// ConfigHistory records applied configuration generations, the startup configuration and each reload.
+// The configuration is expected in the key=value per line format, as served by the /configz endpoint.
+// Only the last limit generations are kept.
+type ConfigHistory struct {
+	mu    sync.Mutex
+	limit int
+	gens  []ConfigGeneration
+	last  map[string]string
+	next  int
+}
+
+func NewConfigHistory(limit int) *ConfigHistory {
+	return &ConfigHistory{
+		limit: limit,
+		next:  1,
+	}
+}
+
+// Add records a new configuration generation.
+func (h *ConfigHistory) Add(reason string, cfg []byte) {
+	kv := parseConfigLines(cfg)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.gens = append(h.gens, ConfigGeneration{
+		Generation: h.next,
+		Time:       time.Now().UTC(),
+		Reason:     reason,
+		Diff:       configDiff(h.last, kv),
+	})
+	h.next++
+	h.last = kv
+
+	if h.limit > 0 && len(h.gens) > h.limit {
+		h.gens = h.gens[len(h.gens)-h.limit:]
+	}
+}
+
+// Generations returns the recorded generations, the oldest first.
+func (h *ConfigHistory) Generations() []ConfigGeneration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]ConfigGeneration(nil), h.gens...)
+}
+
+func (h *ConfigHistory) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	b, err := json.MarshalIndent(h.Generations(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func parseConfigLines(cfg []byte) map[string]string {
+	kv := make(map[string]string)
+	s := bufio.NewScanner(bytes.NewReader(cfg))
+	for s.Scan() {
+		k, v, ok := strings.Cut(s.Text(), "=")
+		if !ok {
+			continue
+		}
+		kv[k] = v
+	}
+	return kv
+}
+
+func configDiff(prev, cur map[string]string) []string {
+	keys := make([]string, 0, len(prev)+len(cur))
+	for k := range prev {
+		keys = append(keys, k)
+	}
+	for k := range cur {
+		if _, ok := prev[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var diff []string
+	for _, k := range keys {
+		pv, pok := prev[k]
+		cv, cok := cur[k]
+		if pok && cok && pv == cv {
+			continue
+		}
+		if pok {
+			diff = append(diff, "-"+k+"="+pv)
+		}
+		if cok {
+			diff = append(diff, "+"+k+"="+cv)
+		}
+	}
+	return diff
+}
@@ -0,0 +1,38 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestConfigHistory(t *testing.T) {
+	h := NewConfigHistory(2)
+	h.Add("startup", []byte("address=:3128\nproxy=\n"))
+	h.Add("reload", []byte("address=:3128\nproxy=http://upstream:8080\n"))
+	h.Add("reload", []byte("address=:3129\n"))
+
+	gens := h.Generations()
+	if len(gens) != 2 {
+		t.Fatalf("expected 2 generations, got %d", len(gens))
+	}
+
+	if gens[0].Generation != 2 {
+		t.Errorf("expected generation 2, got %d", gens[0].Generation)
+	}
+	if want := []string{"-proxy=", "+proxy=http://upstream:8080"}; !slices.Equal(gens[0].Diff, want) {
+		t.Errorf("expected diff %v, got %v", want, gens[0].Diff)
+	}
+
+	if gens[1].Generation != 3 {
+		t.Errorf("expected generation 3, got %d", gens[1].Generation)
+	}
+	if want := []string{"-address=:3128", "+address=:3129", "-proxy=http://upstream:8080"}; !slices.Equal(gens[1].Diff, want) {
+		t.Errorf("expected diff %v, got %v", want, gens[1].Diff)
+	}
+}
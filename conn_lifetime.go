@@ -0,0 +1,126 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/mmatczuk/connfu"
+	"github.com/saucelabs/forwarder/utils/reflectx"
+)
+
+// connLifetime limits the age and the number of requests of pooled upstream connections.
+// This is important behind NATs and load balancers that silently drop long-lived connections.
+type connLifetime struct {
+	maxAge      time.Duration
+	maxRequests int64
+	metrics     *connLifetimeMetrics
+}
+
+func newConnLifetime(cfg *HTTPTransportConfig) *connLifetime {
+	return &connLifetime{
+		maxAge:      cfg.MaxConnAge,
+		maxRequests: int64(cfg.MaxConnRequests),
+		metrics:     newConnLifetimeMetrics(cfg.PromRegistry, cfg.PromNamespace),
+	}
+}
+
+func (l *connLifetime) wrapDial(dial dialContextFunc) dialContextFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		// The dial function is also used for CONNECT tunnels, keep optional interfaces such as CloseWrite.
+		return connfu.Combine(&lifetimeConn{
+			Conn:    conn,
+			lt:      l,
+			created: time.Now(),
+		}, conn), nil
+	}
+}
+
+type lifetimeConn struct {
+	net.Conn
+	lt       *connLifetime
+	created  time.Time
+	requests atomic.Int64
+	recycled atomic.Bool
+}
+
+// reuse is called when the connection is picked for a request,
+// it reports whether the connection may be kept for further requests.
+func (c *lifetimeConn) reuse() bool {
+	n := c.requests.Add(1)
+
+	var reason string
+	switch {
+	case c.lt.maxRequests > 0 && n >= c.lt.maxRequests:
+		reason = "requests"
+	case c.lt.maxAge > 0 && time.Since(c.created) >= c.lt.maxAge:
+		reason = "age"
+	default:
+		return true
+	}
+
+	// With HTTP/2 multiple requests may be in flight when the limit is reached, count the connection once.
+	if c.recycled.CompareAndSwap(false, true) {
+		c.lt.metrics.recycle(reason)
+	}
+	return false
+}
+
+func asLifetimeConn(conn net.Conn) *lifetimeConn {
+	for conn != nil {
+		if c, ok := reflectx.LookupImpl[*lifetimeConn](reflect.ValueOf(conn)); ok {
+			return c
+		}
+		nc, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		conn = nc.NetConn()
+	}
+	return nil
+}
+
+// connLifetimeTransport marks the last request sent over a connection that reached its lifetime limits
+// with Connection: close, so that the transport closes the connection after the response is read.
+// Connections not dialed with connLifetime are not affected.
+type connLifetimeTransport struct {
+	rt http.RoundTripper
+}
+
+func newConnLifetimeTransport(rt http.RoundTripper) http.RoundTripper {
+	return &connLifetimeTransport{rt: rt}
+}
+
+func (t *connLifetimeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var r *http.Request
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if c := asLifetimeConn(info.Conn); c != nil && !c.reuse() {
+				// The transport may send a shallow copy of the request, the header is shared with the copy.
+				r.Close = true
+				r.Header.Set("Connection", "close")
+			}
+		},
+	}
+	r = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	res, err := t.rt.RoundTrip(r)
+	if res != nil {
+		res.Request = req
+	}
+	return res, err
+}
@@ -0,0 +1,114 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestConnLifetime(t *testing.T) {
+	var conns atomic.Int32
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.Copy(io.Discard, req.Body)
+	}))
+	origin.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	origin.Start()
+	defer origin.Close()
+
+	tests := []struct {
+		name       string
+		configure  func(cfg *HTTPTransportConfig)
+		wait       time.Duration
+		wantConns  int32
+		wantReason string
+	}{
+		{
+			name: "requests",
+			configure: func(cfg *HTTPTransportConfig) {
+				cfg.MaxConnRequests = 2
+			},
+			wantConns:  3,
+			wantReason: "requests",
+		},
+		{
+			name: "age",
+			configure: func(cfg *HTTPTransportConfig) {
+				cfg.MaxConnAge = 50 * time.Millisecond
+			},
+			wait:       100 * time.Millisecond,
+			wantConns:  3,
+			wantReason: "age",
+		},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			conns.Store(0)
+
+			r := prometheus.NewRegistry()
+			cfg := DefaultHTTPTransportConfig()
+			cfg.PromRegistry = r
+			tc.configure(cfg)
+			tr, err := NewHTTPTransport(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tr.CloseIdleConnections()
+			c := &http.Client{Transport: newConnLifetimeTransport(tr)}
+
+			for j := range 5 {
+				// Alternate requests with and without body, the transport sends a copy of requests with body.
+				var body io.Reader
+				if j%2 == 1 {
+					body = strings.NewReader("body")
+				}
+				res, err := c.Post(origin.URL, "text/plain", body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.Copy(io.Discard, res.Body)
+				res.Body.Close()
+
+				time.Sleep(tc.wait)
+			}
+
+			if got := conns.Load(); got != tc.wantConns {
+				t.Fatalf("conns: got %d, want %d", got, tc.wantConns)
+			}
+
+			mfs, err := r.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, mf := range mfs {
+				if mf.GetName() != "http_transport_cx_recycled_total" {
+					continue
+				}
+				m := mf.GetMetric()
+				if len(m) != 1 || m[0].GetLabel()[0].GetValue() != tc.wantReason || m[0].GetCounter().GetValue() != 2 {
+					t.Fatalf("unexpected metric %v", mf)
+				}
+				return
+			}
+			t.Fatal("metric not found")
+		})
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+type connectConnState int
+
+const (
+	connectPending connectConnState = iota
+	connectEstablished
+	connectFailed
+)
+
+// connectConn presents a client connection to the proxy as a CONNECT tunnel,
+// so that non-HTTP clients are subject to the same rules as HTTP clients.
+// The first read calls handshake, reads return the CONNECT request it returns followed by the client data.
+// Writes consume the response to the CONNECT request, and write through once the tunnel is established.
+type connectConn struct {
+	net.Conn
+
+	// handshake is called on the first read, it returns the CONNECT request.
+	handshake func() ([]byte, error)
+	// established, if set, is called with the CONNECT response status code, or 0 if the response is malformed,
+	// before the tunnel data is written.
+	established func(code int) error
+
+	handshakeOnce sync.Once
+	handshakeErr  error
+	r             io.Reader
+
+	state connectConnState
+	wbuf  bytes.Buffer
+}
+
+func (c *connectConn) Read(p []byte) (int, error) {
+	c.handshakeOnce.Do(func() {
+		var req []byte
+		req, c.handshakeErr = c.handshake()
+		c.r = io.MultiReader(bytes.NewReader(req), c.Conn)
+	})
+	if c.handshakeErr != nil {
+		return 0, c.handshakeErr
+	}
+	if c.state == connectFailed {
+		return 0, io.EOF
+	}
+	return c.r.Read(p)
+}
+
+func (c *connectConn) Write(p []byte) (int, error) {
+	switch c.state {
+	case connectEstablished:
+		return c.Conn.Write(p)
+	case connectFailed:
+		// Discard the error response body, the client does not speak HTTP.
+		return len(p), nil
+	}
+
+	c.wbuf.Write(p)
+	i := bytes.Index(c.wbuf.Bytes(), []byte("\r\n\r\n"))
+	if i < 0 {
+		return len(p), nil
+	}
+
+	code := parseStatusCode(c.wbuf.Bytes()[:i])
+	if c.established != nil {
+		if err := c.established(code); err != nil {
+			return 0, err
+		}
+	}
+	if code != http.StatusOK {
+		c.state = connectFailed
+		return len(p), nil
+	}
+	c.state = connectEstablished
+
+	if rest := c.wbuf.Bytes()[i+4:]; len(rest) > 0 {
+		if _, err := c.Conn.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+	c.wbuf = bytes.Buffer{}
+
+	return len(p), nil
+}
+
+// parseStatusCode returns the status code from the response header, or 0 if it is malformed.
+func parseStatusCode(header []byte) int {
+	line, _, _ := bytes.Cut(header, []byte("\r\n"))
+	_, status, _ := bytes.Cut(line, []byte(" "))
+	if len(status) < 3 {
+		return 0
+	}
+	code, err := strconv.Atoi(string(status[:3]))
+	if err != nil {
+		return 0
+	}
+	return code
+}
+
+// connectRequest returns a CONNECT request for addr with the header.
+func connectRequest(addr string, h http.Header) []byte {
+	var b bytes.Buffer
+	b.WriteString("CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n")
+	h.Write(&b) //nolint:errcheck // bytes.Buffer does not fail
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
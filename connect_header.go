@@ -0,0 +1,156 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+)
+
+// ConnectHeaderTemplate is a header added to CONNECT requests sent to upstream HTTP proxies.
+// The value is a text/template executed with ConnectHeaderData, if it evaluates to an empty string, the header is not added.
+type ConnectHeaderTemplate struct {
+	// Upstream limits the template to upstream proxies with matching host:port, if nil the template applies to all upstream proxies.
+	Upstream *regexp.Regexp
+	Name     string
+	Value    *template.Template
+
+	raw string
+}
+
+// ConnectHeaderData is the data passed to ConnectHeaderTemplate.
+type ConnectHeaderData struct {
+	// Header is the header of the client CONNECT request, it is empty if the client did not send one.
+	Header http.Header
+	// ID is the request ID.
+	ID string
+	// Target is the CONNECT target host:port.
+	Target string
+	// Upstream is the upstream proxy host:port.
+	Upstream string
+}
+
+// ParseConnectHeaderTemplate parses "[<upstream regexp>=]<name>: <template>".
+func ParseConnectHeaderTemplate(val string) (ConnectHeaderTemplate, error) {
+	ct := ConnectHeaderTemplate{raw: val}
+
+	m := connectHeaderTemplateRegex.FindStringSubmatch(val)
+	if m == nil {
+		return ct, errors.New("expected [<upstream regexp>=]<name>: <template>")
+	}
+	if m[1] != "" {
+		re, err := regexp.Compile(m[1])
+		if err != nil {
+			return ct, fmt.Errorf("upstream: %w", err)
+		}
+		ct.Upstream = re
+	}
+	ct.Name = m[2]
+	tmpl := m[3]
+
+	t, err := template.New(ct.Name).Option("missingkey=zero").Parse(tmpl)
+	if err != nil {
+		return ct, err
+	}
+	ct.Value = t
+
+	return ct, nil
+}
+
+// connectHeaderTemplateRegex matches "[<upstream regexp>=]<name>: <template>",
+// the upstream regexp cannot contain whitespace, quotes or '=' so that it is not confused with the template.
+var connectHeaderTemplateRegex = regexp.MustCompile(`^(?:([^\s"=]+)=)?([A-Za-z0-9-]+):\s*(.*)$`)
+
+func (ct ConnectHeaderTemplate) String() string {
+	return ct.raw
+}
+
+// proxyConnectHeader returns headers for CONNECT requests sent to upstream HTTP proxies.
+// It copies the client CONNECT headers listed in ConnectHeaderForward, adds headers from ConnectHeaderTemplates,
+// and the Negotiate Proxy-Authorization header if UpstreamProxyNegotiate is set.
+func (hp *HTTPProxy) proxyConnectHeader(ctx context.Context, proxyURL *url.URL, target string) (http.Header, error) {
+	ch := martian.ContextConnectHeader(ctx)
+	h := make(http.Header)
+
+	if n := hp.config.UpstreamProxyNegotiate; n != nil {
+		nh, err := n.proxyConnectHeader(ctx, proxyURL, target)
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(h, nh)
+	}
+
+	for _, name := range hp.config.ConnectHeaderForward {
+		if v := ch.Values(name); len(v) > 0 {
+			h[http.CanonicalHeaderKey(name)] = v
+		}
+	}
+
+	if len(hp.config.ConnectHeaderTemplates) == 0 {
+		return h, nil
+	}
+
+	data := ConnectHeaderData{
+		Header:   ch,
+		ID:       martian.ContextTraceID(ctx),
+		Target:   target,
+		Upstream: proxyURL.Host,
+	}
+	if data.Header == nil {
+		data.Header = http.Header{}
+	}
+
+	var sb strings.Builder
+	for _, ct := range hp.config.ConnectHeaderTemplates {
+		if ct.Upstream != nil && !ct.Upstream.MatchString(proxyURL.Host) {
+			continue
+		}
+		sb.Reset()
+		if err := ct.Value.Execute(&sb, data); err != nil {
+			return nil, fmt.Errorf("connect header %s: %w", ct.Name, err)
+		}
+		if v := sb.String(); v != "" {
+			h.Set(ct.Name, v)
+		}
+	}
+
+	return h, nil
+}
+
+// connectResponseHeaders logs and counts the ConnectResponseHeaders copied from upstream proxy CONNECT responses.
+func (hp *HTTPProxy) connectResponseHeaders() ResponseModifier {
+	return ResponseModifierFunc(func(res *http.Response) error {
+		if res.Request.Method != http.MethodConnect || res.StatusCode != http.StatusOK {
+			return nil
+		}
+
+		var sb strings.Builder
+		for _, name := range hp.config.ConnectResponseHeaders {
+			v := res.Header.Values(name)
+			if len(v) == 0 {
+				continue
+			}
+			name = http.CanonicalHeaderKey(name)
+			hp.metrics.connectResponseHeader(name)
+			fmt.Fprintf(&sb, " %s=%s", name, strings.Join(v, ","))
+		}
+		if sb.Len() > 0 {
+			hp.log.Infof("upstream CONNECT response host=%s%s", res.Request.URL.Host, sb.String())
+		}
+
+		return nil
+	})
+}
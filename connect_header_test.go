@@ -0,0 +1,107 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestParseConnectHeaderTemplate(t *testing.T) {
+	ct, err := ParseConnectHeaderTemplate(`upstream\.example\.com:3128=X-Target: {{.Target}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct.Name != "X-Target" || ct.Upstream == nil || ct.Upstream.String() != `upstream\.example\.com:3128` {
+		t.Fatalf("unexpected template %+v", ct)
+	}
+
+	for _, s := range []string{"X-Target", "X Target: foo", "X-Target: {{.Target", "[=X-Target: foo"} {
+		if _, err := ParseConnectHeaderTemplate(s); err == nil {
+			t.Errorf("ParseConnectHeaderTemplate(%q): expected error", s)
+		}
+	}
+}
+
+func TestProxyConnectHeader(t *testing.T) {
+	var templates []ConnectHeaderTemplate
+	for _, s := range []string{
+		`X-Target: {{.Target}}`,
+		`other=X-Other: foo`,
+		`X-Upstream: {{.Upstream}}`,
+		`X-Session: {{.Header.Get "X-Session-Id"}}`,
+	} {
+		ct, err := ParseConnectHeaderTemplate(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		templates = append(templates, ct)
+	}
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.ConnectHeaderForward = []string{"X-Session-Id"}
+	cfg.ConnectHeaderTemplates = templates
+	hp, err := newHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := hp.proxyConnectHeader(context.Background(), &url.URL{Scheme: "http", Host: "upstream:3128"}, "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := http.Header{
+		"X-Target":   {"example.com:443"},
+		"X-Upstream": {"upstream:3128"},
+	}
+	if diff := cmp.Diff(want, h); diff != "" {
+		t.Fatalf("unexpected header (-want +got):\n%s", diff)
+	}
+}
+
+func TestConnectResponseHeaders(t *testing.T) {
+	cfg := DefaultHTTPProxyConfig()
+	cfg.ConnectResponseHeaders = []string{"x-egress-ip"}
+	r := prometheus.NewRegistry()
+	cfg.PromRegistry = r
+	hp, err := newHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"X-Egress-Ip": {"192.0.2.1"}},
+		Request:    httptest.NewRequest(http.MethodConnect, "http://example.com:443", http.NoBody),
+	}
+	if err := hp.connectResponseHeaders().ModifyResponse(res); err != nil {
+		t.Fatal(err)
+	}
+
+	mfs, err := r.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != "proxy_upstream_connect_response_headers_total" {
+			continue
+		}
+		m := mf.GetMetric()
+		if len(m) != 1 || m[0].GetLabel()[0].GetValue() != "X-Egress-Ip" || m[0].GetCounter().GetValue() != 1 {
+			t.Fatalf("unexpected metric %v", mf)
+		}
+		return
+	}
+	t.Fatal("metric not found")
+}
@@ -101,6 +101,12 @@ type Builder struct {
 	// OnClose is called after the underlying connection is closed and before the Close method returns.
 	// OnClose is called at most once.
 	OnClose func()
+
+	// Table, if set, tracks the connection in the table until it is closed.
+	// Direction and Address describe the connection in the table.
+	Table     *Table
+	Direction Direction
+	Address   string
 }
 
 func (b Builder) Build(c net.Conn) net.Conn {
@@ -114,6 +120,17 @@ func (b Builder) BuildWithObserver(c net.Conn) (net.Conn, *Observer) {
 		co *Observer
 	)
 
+	var id uint64
+	if t := b.Table; t != nil {
+		onClose := b.OnClose
+		b.OnClose = func() {
+			t.remove(id)
+			if onClose != nil {
+				onClose()
+			}
+		}
+	}
+
 	if b.TrackTraffic {
 		if b.OnClose != nil {
 			cc := &struct {
@@ -149,6 +166,10 @@ func (b Builder) BuildWithObserver(c net.Conn) (net.Conn, *Observer) {
 		}
 	}
 
+	if b.Table != nil {
+		id = b.Table.add(b.Direction, b.Address, co)
+	}
+
 	return connfu.Combine(wc, c), co
 }
 
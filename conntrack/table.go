@@ -0,0 +1,250 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package conntrack
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Direction is the direction of a connection in Table.
+type Direction string
+
+const (
+	// Inbound connections are accepted by a listener, the address is the client address.
+	Inbound Direction = "inbound"
+	// Outbound connections are dialed, the address is the dialed address.
+	Outbound Direction = "outbound"
+)
+
+type tableEntry struct {
+	dir     Direction
+	addr    string
+	created time.Time
+	o       *Observer
+}
+
+// Table is a table of open connections.
+// Connections are added by Builder when Table is set, and removed when closed.
+type Table struct {
+	mu    sync.Mutex
+	id    uint64
+	conns map[uint64]tableEntry
+
+	now func() time.Time
+}
+
+func NewTable() *Table {
+	return &Table{
+		conns: make(map[uint64]tableEntry),
+		now:   time.Now,
+	}
+}
+
+func (t *Table) add(dir Direction, addr string, o *Observer) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.id++
+	t.conns[t.id] = tableEntry{
+		dir:     dir,
+		addr:    addr,
+		created: t.now(),
+		o:       o,
+	}
+	return t.id
+}
+
+func (t *Table) remove(id uint64) {
+	t.mu.Lock()
+	delete(t.conns, id)
+	t.mu.Unlock()
+}
+
+// Len returns the number of open connections.
+func (t *Table) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// AddressCount is the number of open connections to or from an address.
+type AddressCount struct {
+	Address string `json:"address"`
+	Open    int    `json:"open"`
+}
+
+// AgeBucket is the number of open connections younger than LE.
+// The last bucket has LE set to "+Inf".
+type AgeBucket struct {
+	LE    string `json:"le"`
+	Count int    `json:"count"`
+}
+
+// ConnInfo describes an open connection.
+// Rx and Tx are only available if the connection tracks traffic.
+type ConnInfo struct {
+	Direction Direction `json:"direction"`
+	Address   string    `json:"address"`
+	Age       string    `json:"age"`
+	Rx        uint64    `json:"rx_bytes"`
+	Tx        uint64    `json:"tx_bytes"`
+}
+
+// Summary summarizes the connection table.
+type Summary struct {
+	Time         time.Time      `json:"time"`
+	Inbound      int            `json:"inbound"`
+	Outbound     int            `json:"outbound"`
+	Destinations []AddressCount `json:"destinations"`
+	Clients      []AddressCount `json:"clients"`
+	Ages         []AgeBucket    `json:"ages"`
+	TopTalkers   []ConnInfo     `json:"top_talkers"`
+}
+
+var ageBuckets = []time.Duration{
+	time.Second,
+	10 * time.Second,
+	time.Minute,
+	10 * time.Minute,
+	time.Hour,
+}
+
+// Summary returns the number of open connections per destination and client,
+// the connection age distribution and top n connections by the number of bytes transferred.
+// Destinations and clients are limited to top n addresses by the number of open connections.
+func (t *Table) Summary(n int) Summary {
+	t.mu.Lock()
+	entries := make([]tableEntry, 0, len(t.conns))
+	for _, e := range t.conns {
+		entries = append(entries, e)
+	}
+	t.mu.Unlock()
+
+	now := t.now()
+	s := Summary{
+		Time: now,
+		Ages: make([]AgeBucket, len(ageBuckets)+1),
+	}
+	for i, b := range ageBuckets {
+		s.Ages[i].LE = b.String()
+	}
+	s.Ages[len(ageBuckets)].LE = "+Inf"
+
+	dst := make(map[string]int)
+	src := make(map[string]int)
+	talkers := make([]ConnInfo, 0, len(entries))
+	for _, e := range entries {
+		switch e.dir {
+		case Inbound:
+			s.Inbound++
+			src[e.addr]++
+		case Outbound:
+			s.Outbound++
+			dst[e.addr]++
+		}
+
+		age := now.Sub(e.created)
+		i, _ := slices.BinarySearch(ageBuckets, age)
+		s.Ages[i].Count++
+
+		ci := ConnInfo{
+			Direction: e.dir,
+			Address:   e.addr,
+			Age:       age.Truncate(time.Millisecond).String(),
+		}
+		if e.o != nil {
+			ci.Rx = e.o.Rx()
+			ci.Tx = e.o.Tx()
+		}
+		talkers = append(talkers, ci)
+	}
+
+	s.Destinations = topAddresses(dst, n)
+	s.Clients = topAddresses(src, n)
+
+	slices.SortFunc(talkers, func(a, b ConnInfo) int {
+		return cmp.Compare(b.Rx+b.Tx, a.Rx+a.Tx)
+	})
+	s.TopTalkers = talkers[:min(n, len(talkers))]
+
+	return s
+}
+
+func topAddresses(m map[string]int, n int) []AddressCount {
+	ac := make([]AddressCount, 0, len(m))
+	for addr, open := range m {
+		ac = append(ac, AddressCount{Address: addr, Open: open})
+	}
+	slices.SortFunc(ac, func(a, b AddressCount) int {
+		if c := cmp.Compare(b.Open, a.Open); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Address, b.Address)
+	})
+	return ac[:min(n, len(ac))]
+}
+
+// Log logs the table summary with top n addresses at the given interval until the context is canceled.
+func (t *Table) Log(ctx context.Context, interval time.Duration, n int, logf func(format string, args ...any)) error {
+	tk := time.NewTicker(interval)
+	defer tk.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-tk.C:
+			logf("%s", t.Summary(n))
+		}
+	}
+}
+
+func (s Summary) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "open connections inbound=%d outbound=%d", s.Inbound, s.Outbound)
+
+	writeAddresses := func(name string, ac []AddressCount) {
+		if len(ac) == 0 {
+			return
+		}
+		sb.WriteString(" " + name + "=")
+		for i, a := range ac {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			fmt.Fprintf(&sb, "%s(%d)", a.Address, a.Open)
+		}
+	}
+	writeAddresses("destinations", s.Destinations)
+	writeAddresses("clients", s.Clients)
+
+	sb.WriteString(" ages=")
+	for i, b := range s.Ages {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, "le%s:%d", b.LE, b.Count)
+	}
+
+	if len(s.TopTalkers) > 0 {
+		sb.WriteString(" top_talkers=")
+		for i, c := range s.TopTalkers {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			fmt.Fprintf(&sb, "%s(%s,rx=%d,tx=%d,age=%s)", c.Address, c.Direction, c.Rx, c.Tx, c.Age)
+		}
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,66 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package conntrack
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTable(t *testing.T) {
+	now := time.Now()
+	tbl := NewTable()
+	tbl.now = func() time.Time { return now }
+
+	pipe := func(dir Direction, addr string) net.Conn {
+		c1, c2 := net.Pipe()
+		t.Cleanup(func() { c2.Close() })
+		go func() {
+			b := make([]byte, 16)
+			for {
+				if _, err := c2.Read(b); err != nil {
+					return
+				}
+			}
+		}()
+		return Builder{TrackTraffic: true, Table: tbl, Direction: dir, Address: addr}.Build(c1)
+	}
+
+	a := pipe(Outbound, "a:443")
+	tbl.now = func() time.Time { return now.Add(30 * time.Second) }
+	b := pipe(Outbound, "a:443")
+	c := pipe(Outbound, "b:443")
+	d := pipe(Inbound, "10.0.0.1:5000")
+
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	tbl.now = func() time.Time { return now.Add(time.Minute) }
+	s := tbl.Summary(1)
+	if s.Inbound != 1 || s.Outbound != 3 {
+		t.Fatalf("got inbound=%d outbound=%d, want 1 3", s.Inbound, s.Outbound)
+	}
+	if len(s.Destinations) != 1 || s.Destinations[0] != (AddressCount{Address: "a:443", Open: 2}) {
+		t.Fatalf("unexpected destinations %+v", s.Destinations)
+	}
+	if len(s.TopTalkers) != 1 || s.TopTalkers[0].Address != "b:443" || s.TopTalkers[0].Tx != 5 {
+		t.Fatalf("unexpected top talkers %+v", s.TopTalkers)
+	}
+	// 1m bucket contains 3 connections opened 30s ago and 1 opened 1m ago.
+	if got := s.Ages[2]; got.LE != "1m0s" || got.Count != 4 {
+		t.Fatalf("unexpected age bucket %+v", got)
+	}
+
+	for _, c := range []net.Conn{a, b, c, d} {
+		c.Close()
+	}
+	if n := tbl.Len(); n != 0 {
+		t.Fatalf("got %d open connections after close, want 0", n)
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"  //nolint:gosec // used for checksum verification only
+	"crypto/sha1" //nolint:gosec // used for checksum verification only
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ContentVerifyConfig configures verification of downloaded content checksums.
+// Only responses visible to the proxy are verified, i.e. plain HTTP and MITMed HTTPS responses with status 200.
+//
+// If the checksum does not match, the response body is cut before the last byte and the connection is aborted,
+// so that the client never receives the complete content.
+type ContentVerifyConfig struct {
+	// Headers enables verification of checksums sent by the server in the
+	// X-Checksum-Sha256, X-Checksum-Sha1, X-Checksum-Md5, Digest and Content-Digest headers.
+	Headers bool
+
+	// Manifest maps URLs to expected SHA-256 digests, see ParseChecksumManifest.
+	Manifest map[string][]byte
+
+	// Domains limits verification to responses for matching hosts, if nil all hosts are verified.
+	Domains Matcher
+}
+
+// ParseChecksumManifest parses a manifest in the sha256sum format with URLs instead of file names,
+// i.e. lines of a hex encoded SHA-256 digest followed by whitespace and the URL.
+// Empty lines and lines starting with '#' are ignored.
+func ParseChecksumManifest(r io.Reader) (map[string][]byte, error) {
+	m := make(map[string][]byte)
+
+	s := bufio.NewScanner(r)
+	for i := 1; s.Scan(); i++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			return nil, fmt.Errorf("line %d: expected <sha256> <url>", i)
+		}
+		d, err := hex.DecodeString(f[0])
+		if err != nil || len(d) != sha256.Size {
+			return nil, fmt.Errorf("line %d: invalid sha256 digest %q", i, f[0])
+		}
+		// sha256sum marks binary mode with '*' before the file name.
+		m[strings.TrimPrefix(f[1], "*")] = d
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+type expectedDigest struct {
+	source string
+	newFn  func() hash.Hash
+	sum    []byte
+}
+
+// expectedDigests returns the digests the response body must match.
+func (c *ContentVerifyConfig) expectedDigests(res *http.Response) ([]expectedDigest, error) {
+	var ds []expectedDigest
+
+	if d, ok := c.Manifest[res.Request.URL.String()]; ok {
+		ds = append(ds, expectedDigest{"manifest", sha256.New, d})
+	}
+
+	if !c.Headers {
+		return ds, nil
+	}
+
+	// Content-Digest is computed over the encoded content, other headers refer to the representation.
+	if v := res.Header.Get("Content-Digest"); v != "" {
+		d, err := parseStructuredDigest(v)
+		if err != nil {
+			return nil, fmt.Errorf("Content-Digest: %w", err)
+		}
+		if d != nil {
+			d.source = "Content-Digest"
+			ds = append(ds, *d)
+		}
+	}
+
+	if ce := res.Header.Get("Content-Encoding"); ce != "" && ce != "identity" {
+		return ds, nil
+	}
+
+	for _, h := range []struct {
+		name  string
+		newFn func() hash.Hash
+	}{
+		{"X-Checksum-Sha256", sha256.New},
+		{"X-Checksum-Sha1", sha1.New},
+		{"X-Checksum-Md5", md5.New},
+	} {
+		v := res.Header.Get(h.name)
+		if v == "" {
+			continue
+		}
+		d, err := hex.DecodeString(strings.TrimSpace(v))
+		if err != nil || len(d) != h.newFn().Size() {
+			return nil, fmt.Errorf("%s: invalid digest %q", h.name, v)
+		}
+		ds = append(ds, expectedDigest{h.name, h.newFn, d})
+	}
+
+	if v := res.Header.Get("Digest"); v != "" {
+		d, err := parseLegacyDigest(v)
+		if err != nil {
+			return nil, fmt.Errorf("Digest: %w", err)
+		}
+		if d != nil {
+			d.source = "Digest"
+			ds = append(ds, *d)
+		}
+	}
+
+	return ds, nil
+}
+
+// parseStructuredDigest parses RFC 9530 digest header value e.g. sha-256=:<base64>:.
+// It returns nil if no supported algorithm is found.
+func parseStructuredDigest(v string) (*expectedDigest, error) {
+	for _, e := range strings.Split(v, ",") {
+		alg, val, ok := strings.Cut(strings.TrimSpace(e), "=")
+		if !ok {
+			continue
+		}
+		newFn := digestAlgorithm(alg)
+		if newFn == nil {
+			continue
+		}
+		if len(val) < 2 || val[0] != ':' || val[len(val)-1] != ':' {
+			return nil, fmt.Errorf("invalid %s value", alg)
+		}
+		sum, err := base64.StdEncoding.DecodeString(val[1 : len(val)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value: %w", alg, err)
+		}
+		return &expectedDigest{newFn: newFn, sum: sum}, nil
+	}
+	return nil, nil //nolint:nilnil // no supported algorithm
+}
+
+// parseLegacyDigest parses RFC 3230 digest header value e.g. SHA-256=<base64>.
+// It returns nil if no supported algorithm is found.
+func parseLegacyDigest(v string) (*expectedDigest, error) {
+	for _, e := range strings.Split(v, ",") {
+		alg, val, ok := strings.Cut(strings.TrimSpace(e), "=")
+		if !ok {
+			continue
+		}
+		newFn := digestAlgorithm(alg)
+		if newFn == nil {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value: %w", alg, err)
+		}
+		return &expectedDigest{newFn: newFn, sum: sum}, nil
+	}
+	return nil, nil //nolint:nilnil // no supported algorithm
+}
+
+func digestAlgorithm(alg string) func() hash.Hash {
+	switch strings.ToLower(alg) {
+	case "sha-256":
+		return sha256.New
+	case "sha-512":
+		return sha512.New
+	default:
+		return nil
+	}
+}
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+func (hp *HTTPProxy) verifyContent() ResponseModifier {
+	cfg := hp.config.ContentVerify
+
+	return ResponseModifierFunc(func(res *http.Response) error {
+		if res.StatusCode != http.StatusOK || res.Body == nil || res.Body == http.NoBody || res.Request.Method == http.MethodHead {
+			return nil
+		}
+		if cfg.Domains != nil && !matchHost(cfg.Domains, res.Request.URL.Hostname()) {
+			return nil
+		}
+
+		ds, err := cfg.expectedDigests(res)
+		if err != nil {
+			hp.log.Errorf("content verification skipped url=%s: %s", res.Request.URL.Redacted(), err)
+			return nil
+		}
+		if len(ds) == 0 {
+			return nil
+		}
+
+		hs := make([]hash.Hash, len(ds))
+		ws := make([]io.Writer, len(ds))
+		for i := range ds {
+			hs[i] = ds[i].newFn()
+			ws[i] = hs[i]
+		}
+
+		url := res.Request.URL.Redacted()
+		res.Body = &verifyBody{
+			ReadCloser: res.Body,
+			w:          io.MultiWriter(ws...),
+			verify: func() error {
+				for i, d := range ds {
+					if got := hs[i].Sum(nil); !bytes.Equal(got, d.sum) {
+						hp.metrics.contentVerification("mismatch")
+						hp.log.Errorf("content verification failed url=%s source=%s want=%x got=%x", url, d.source, d.sum, got)
+						return fmt.Errorf("%s: %w", d.source, errChecksumMismatch)
+					}
+				}
+				hp.metrics.contentVerification("ok")
+				return nil
+			},
+		}
+
+		return nil
+	})
+}
+
+// verifyBody hashes the body as it is read and verifies it at EOF.
+// The last byte is held back until the body is verified.
+type verifyBody struct {
+	io.ReadCloser
+	w      io.Writer
+	verify func() error
+
+	buf []byte
+	off int
+	eof bool
+	err error
+}
+
+func (b *verifyBody) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	for !b.eof && b.err == nil && len(b.buf)-b.off <= 1 {
+		b.fill()
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	avail := b.buf[b.off:]
+	if !b.eof {
+		avail = avail[:len(avail)-1]
+	}
+	n := copy(p, avail)
+	b.off += n
+
+	if b.eof && b.off == len(b.buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (b *verifyBody) fill() {
+	if b.buf == nil {
+		b.buf = make([]byte, 0, 32*1024)
+	}
+	// Compact the unread bytes, there is at most one.
+	b.buf = append(b.buf[:0], b.buf[b.off:]...)
+	b.off = 0
+
+	n, err := b.ReadCloser.Read(b.buf[len(b.buf):cap(b.buf)])
+	b.w.Write(b.buf[len(b.buf) : len(b.buf)+n]) //nolint:errcheck // hash.Hash never returns an error
+	b.buf = b.buf[:len(b.buf)+n]
+
+	switch {
+	case errors.Is(err, io.EOF):
+		b.eof = true
+		b.err = b.verify()
+	case err != nil:
+		b.err = err
+	}
+}
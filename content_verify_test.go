@@ -0,0 +1,125 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestParseChecksumManifest(t *testing.T) {
+	sum := sha256.Sum256([]byte("foo"))
+	in := "# comment\n\n" + hex.EncodeToString(sum[:]) + "  http://example.com/foo\n" +
+		hex.EncodeToString(sum[:]) + " *http://example.com/bar\n"
+
+	m, err := ParseChecksumManifest(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 || string(m["http://example.com/foo"]) != string(sum[:]) || string(m["http://example.com/bar"]) != string(sum[:]) {
+		t.Fatalf("unexpected manifest %x", m)
+	}
+
+	if _, err := ParseChecksumManifest(strings.NewReader("abcd http://example.com/foo\n")); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestVerifyContent(t *testing.T) {
+	const body = "hello world"
+	sum := sha256.Sum256([]byte(body))
+	bad := sha256.Sum256([]byte("bye"))
+
+	tests := []struct {
+		name     string
+		header   http.Header
+		manifest map[string][]byte
+		ok       bool
+	}{
+		{
+			name:   "x-checksum ok",
+			header: http.Header{"X-Checksum-Sha256": {hex.EncodeToString(sum[:])}},
+			ok:     true,
+		},
+		{
+			name:   "x-checksum mismatch",
+			header: http.Header{"X-Checksum-Sha256": {hex.EncodeToString(bad[:])}},
+		},
+		{
+			name:   "digest ok",
+			header: http.Header{"Digest": {"SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])}},
+			ok:     true,
+		},
+		{
+			name:   "content-digest mismatch",
+			header: http.Header{"Content-Digest": {"sha-256=:" + base64.StdEncoding.EncodeToString(bad[:]) + ":"}},
+		},
+		{
+			name:     "manifest ok",
+			manifest: map[string][]byte{"http://example.com/file": sum[:]},
+			ok:       true,
+		},
+		{
+			name:     "manifest mismatch",
+			manifest: map[string][]byte{"http://example.com/file": bad[:]},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultHTTPProxyConfig()
+			cfg.ContentVerify = &ContentVerifyConfig{
+				Headers:  true,
+				Manifest: tc.manifest,
+			}
+			hp, err := newHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res := &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     tc.header,
+				Body:       io.NopCloser(iotest.OneByteReader(strings.NewReader(body))),
+				Request:    httptest.NewRequest(http.MethodGet, "http://example.com/file", http.NoBody),
+			}
+			if res.Header == nil {
+				res.Header = http.Header{}
+			}
+			if err := hp.verifyContent().ModifyResponse(res); err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := io.ReadAll(res.Body)
+			if tc.ok {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if string(b) != body {
+					t.Fatalf("got body %q, want %q", b, body)
+				}
+				return
+			}
+			if !errors.Is(err, errChecksumMismatch) {
+				t.Fatalf("got error %v, want %v", err, errChecksumMismatch)
+			}
+			if len(b) != len(body)-1 {
+				t.Fatalf("got %d bytes, want all but the last byte", len(b))
+			}
+		})
+	}
+}
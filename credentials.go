@@ -11,16 +11,21 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"sync/atomic"
 
 	"github.com/saucelabs/forwarder/log"
 )
 
 type CredentialsMatcher struct {
+	c   atomic.Pointer[credentialsSet]
+	log log.Logger
+}
+
+type credentialsSet struct {
 	hostport map[string]*url.Userinfo
 	host     map[string]*url.Userinfo
 	port     map[string]*url.Userinfo
 	global   *url.Userinfo
-	log      log.Logger
 }
 
 func NewCredentialsMatcher(credentials []*HostPortUser, log log.Logger) (*CredentialsMatcher, error) {
@@ -28,11 +33,30 @@ func NewCredentialsMatcher(credentials []*HostPortUser, log log.Logger) (*Creden
 		return nil, nil //nolint:nilnil // nil is a valid value
 	}
 
+	m := NewDynamicCredentialsMatcher(log)
+	if err := m.Update(credentials); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// NewDynamicCredentialsMatcher returns an empty matcher, the credentials can be set later with Update.
+func NewDynamicCredentialsMatcher(log log.Logger) *CredentialsMatcher {
 	m := &CredentialsMatcher{
+		log: log,
+	}
+	m.c.Store(new(credentialsSet))
+	return m
+}
+
+// Update replaces the credentials, it is safe to call concurrently with matching.
+// On error the credentials are not changed.
+func (m *CredentialsMatcher) Update(credentials []*HostPortUser) error {
+	c := &credentialsSet{
 		hostport: make(map[string]*url.Userinfo),
 		host:     make(map[string]*url.Userinfo),
 		port:     make(map[string]*url.Userinfo),
-		log:      log,
 	}
 
 	for i, hpu := range credentials {
@@ -41,41 +65,50 @@ func NewCredentialsMatcher(credentials []*HostPortUser, log log.Logger) (*Creden
 		}
 
 		if err := hpu.Validate(); err != nil {
-			return nil, withRowInfo(err)
+			return withRowInfo(err)
 		}
+		host := NormalizeHost(hpu.Host)
 
 		switch {
-		case hpu.Host == "*" && hpu.Port == "0":
-			if m.global != nil {
-				return nil, withRowInfo(errors.New("duplicate global input"))
+		case host == "*" && hpu.Port == "0":
+			if c.global != nil {
+				return withRowInfo(errors.New("duplicate global input"))
 			}
-			m.global = hpu.Userinfo
-		case hpu.Host == "*":
-			if _, ok := m.port[hpu.Port]; ok {
-				return nil, withRowInfo(fmt.Errorf("duplicate wildcard host with port %s credentis", hpu.Port))
+			c.global = hpu.Userinfo
+		case host == "*":
+			if _, ok := c.port[hpu.Port]; ok {
+				return withRowInfo(fmt.Errorf("duplicate wildcard host with port %s credentis", hpu.Port))
 			}
-			m.port[hpu.Port] = hpu.Userinfo
+			c.port[hpu.Port] = hpu.Userinfo
 		case hpu.Port == "0":
-			if _, ok := m.host[hpu.Host]; ok {
-				return nil, withRowInfo(fmt.Errorf("duplicate wildcard port with host %s credentis", hpu.Host))
+			if _, ok := c.host[host]; ok {
+				return withRowInfo(fmt.Errorf("duplicate wildcard port with host %s credentis", hpu.Host))
 			}
-			m.host[hpu.Host] = hpu.Userinfo
+			c.host[host] = hpu.Userinfo
 		default:
-			hostport := net.JoinHostPort(hpu.Host, hpu.Port)
-			if _, ok := m.hostport[hostport]; ok {
-				return nil, errors.New("duplicate input")
+			hostport := net.JoinHostPort(host, hpu.Port)
+			if _, ok := c.hostport[hostport]; ok {
+				return errors.New("duplicate input")
 			}
-			m.hostport[hostport] = hpu.Userinfo
+			c.hostport[hostport] = hpu.Userinfo
 		}
 	}
 
-	return m, nil
+	m.c.Store(c)
+
+	return nil
 }
 
 // MatchURL adds standard http and https ports if they are missing in URL and calls Match function.
 func (m *CredentialsMatcher) MatchURL(u *url.URL) *url.Userinfo {
+	ui, _ := m.matchURL(u)
+	return ui
+}
+
+// matchURL is like MatchURL but it also returns the host:port mask that matched.
+func (m *CredentialsMatcher) matchURL(u *url.URL) (*url.Userinfo, string) {
 	if m == nil || u == nil {
-		return nil
+		return nil, ""
 	}
 
 	const (
@@ -92,49 +125,58 @@ func (m *CredentialsMatcher) MatchURL(u *url.URL) *url.Userinfo {
 			hostport = fmt.Sprintf("%s:%d", u.Host, httpsPort)
 		default:
 			m.log.Errorf("cannot to determine port for %s", u.Redacted())
-			return nil
+			return nil, ""
 		}
 	}
 
-	return m.Match(hostport)
+	return m.match(hostport)
 }
 
 // Match `hostport` to one of the configured input.
 // Priority is exact Match, then host, then port, then global wildcard.
 func (m *CredentialsMatcher) Match(hostport string) *url.Userinfo {
-	if m == nil {
-		return nil
-	}
+	u, _ := m.match(hostport)
+	return u
+}
 
-	if u, ok := m.hostport[hostport]; ok {
-		m.log.Debugf(hostport)
-		return u
+func (m *CredentialsMatcher) match(hostport string) (*url.Userinfo, string) {
+	if m == nil {
+		return nil, ""
 	}
 
 	host, port, err := net.SplitHostPort(hostport)
 	if err != nil {
 		m.log.Infof("invalid hostport %s", hostport)
-		return nil
+		return nil, ""
+	}
+	host = NormalizeHost(host)
+	hostport = net.JoinHostPort(host, port)
+
+	c := m.c.Load()
+
+	if u, ok := c.hostport[hostport]; ok {
+		m.log.Debugf(hostport)
+		return u, hostport
 	}
 
 	// Host wildcard - check the port only.
-	if u, ok := m.port[port]; ok {
+	if u, ok := c.port[port]; ok {
 		m.log.Debugf("host=* port=%s", port)
-		return u
+		return u, "*:" + port
 	}
 
 	// Port wildcard - check the host only.
-	if u, ok := m.host[host]; ok {
+	if u, ok := c.host[host]; ok {
 		m.log.Debugf("host=%s port=*", host)
-		return u
+		return u, host + ":*"
 	}
 
 	// Log whether the global wildcard is set.
 	// This is a very esoteric use case. It's only added to support a legacy implementation.
-	if m.global != nil {
+	if c.global != nil {
 		m.log.Debugf("global wildcard")
-		return m.global
+		return c.global, "*:*"
 	}
 
-	return nil
+	return nil, ""
 }
@@ -0,0 +1,283 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/saucelabs/forwarder/log"
+)
+
+type CredentialsCommandConfig struct {
+	// Command is the program and arguments to execute.
+	Command []string
+
+	// Interval is the time between refreshes.
+	// If the command returns expires_in, the credentials are refreshed earlier if needed.
+	Interval time.Duration
+
+	// MinInterval is the minimum time between refreshes triggered by 407 responses.
+	MinInterval time.Duration
+
+	// Timeout limits the command execution time.
+	Timeout time.Duration
+}
+
+func DefaultCredentialsCommandConfig() *CredentialsCommandConfig {
+	return &CredentialsCommandConfig{
+		Interval:    15 * time.Minute,
+		MinInterval: 10 * time.Second,
+		Timeout:     30 * time.Second,
+	}
+}
+
+func (c *CredentialsCommandConfig) Validate() error {
+	if len(c.Command) == 0 {
+		return errors.New("command is required")
+	}
+	if c.Interval <= 0 {
+		return errors.New("interval must be positive")
+	}
+	return nil
+}
+
+// maxCredentialsCommandOutput limits the command output that is read.
+const maxCredentialsCommandOutput = 64 * 1024
+
+// CredentialsCommand mints upstream proxy credentials by executing an external command,
+// such as a script that fetches a short-lived token from an identity provider.
+// The command is executed on start, periodically, and when the upstream proxy responds with 407.
+//
+// The command must print the credentials to stdout, either as username:password,
+// or as a JSON object with username, password and optional expires_in fields, expires_in is in seconds.
+// The credentials are kept in memory only and are never logged.
+type CredentialsCommand struct {
+	config  CredentialsCommandConfig
+	log     log.Logger
+	user    atomic.Pointer[url.Userinfo]
+	refresh chan struct{}
+
+	mu   sync.Mutex
+	next time.Duration
+	last time.Time
+}
+
+// NewCredentialsCommand executes the command and returns an error if it fails,
+// call Run to refresh the credentials.
+func NewCredentialsCommand(cfg *CredentialsCommandConfig, log log.Logger) (*CredentialsCommand, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	c := &CredentialsCommand{
+		config:  *cfg,
+		log:     log,
+		refresh: make(chan struct{}, 1),
+	}
+	if err := c.update(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Userinfo returns the current credentials.
+func (c *CredentialsCommand) Userinfo() *url.Userinfo {
+	return c.user.Load()
+}
+
+// Refresh requests a refresh of the credentials, it does not block.
+// Refreshes more frequent than MinInterval are ignored.
+func (c *CredentialsCommand) Refresh() {
+	select {
+	case c.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// Run refreshes the credentials until ctx is done.
+// On error the previous credentials are kept and the command is retried after MinInterval.
+func (c *CredentialsCommand) Run(ctx context.Context) error {
+	t := time.NewTimer(c.nextRefresh())
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		case <-c.refresh:
+			if c.sinceLast() < c.config.MinInterval {
+				continue
+			}
+			c.log.Infof("upstream proxy rejected credentials, refreshing")
+		}
+
+		var next time.Duration
+		if err := c.update(ctx); err != nil {
+			c.log.Errorf("refresh credentials, keeping the previous credentials: %s", err)
+			next = c.config.MinInterval
+		} else {
+			next = c.nextRefresh()
+		}
+		t.Stop()
+		t.Reset(next)
+	}
+}
+
+func (c *CredentialsCommand) nextRefresh() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.next
+}
+
+func (c *CredentialsCommand) sinceLast() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Since(c.last)
+}
+
+func (c *CredentialsCommand) update(ctx context.Context) error {
+	out, err := c.exec(ctx)
+	if err != nil {
+		return err
+	}
+	u, expiresIn, err := parseCredentialsCommandOutput(out)
+	clear(out)
+	if err != nil {
+		return err
+	}
+
+	next := c.config.Interval
+	if expiresIn > 0 {
+		// Refresh before the credentials expire to avoid 407 responses.
+		next = min(next, expiresIn*3/4)
+	}
+
+	c.user.Store(u)
+	c.mu.Lock()
+	c.next = next
+	c.last = time.Now()
+	c.mu.Unlock()
+
+	c.log.Infof("credentials updated username=%s next_refresh=%s", u.Username(), next)
+
+	return nil
+}
+
+func (c *CredentialsCommand) exec(ctx context.Context) ([]byte, error) {
+	return runCommand(ctx, c.config.Command, c.config.Timeout, maxCredentialsCommandOutput)
+}
+
+// runCommand executes the command without a shell and returns its stdout limited to maxOutput bytes,
+// the error includes the beginning of stderr if the command fails.
+func runCommand(ctx context.Context, command []string, timeout time.Duration, maxOutput int) ([]byte, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...) //nolint:gosec // the command is configured by the operator
+	cmd.Stdout = &limitedWriter{w: &stdout, n: maxOutput}
+	cmd.Stderr = &limitedWriter{w: &stderr, n: 1024}
+
+	if err := cmd.Run(); err != nil {
+		if s := strings.TrimSpace(stderr.String()); s != "" {
+			return nil, fmt.Errorf("%s: %w: %s", command[0], err, s)
+		}
+		return nil, fmt.Errorf("%s: %w", command[0], err)
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// parseCredentialsCommandOutput parses username:password or a JSON object.
+func parseCredentialsCommandOutput(out []byte) (*url.Userinfo, time.Duration, error) {
+	out = bytes.TrimSpace(out)
+	if len(out) == 0 {
+		return nil, 0, errors.New("empty output")
+	}
+
+	if out[0] == '{' {
+		var v struct {
+			Username  string `json:"username"`
+			Password  string `json:"password"`
+			ExpiresIn int64  `json:"expires_in"`
+		}
+		if err := json.Unmarshal(out, &v); err != nil {
+			return nil, 0, errors.New("invalid JSON output")
+		}
+		if v.Username == "" {
+			return nil, 0, errors.New("missing username")
+		}
+		return url.UserPassword(v.Username, v.Password), time.Duration(v.ExpiresIn) * time.Second, nil
+	}
+
+	line, _, _ := bytes.Cut(out, []byte("\n"))
+	u, err := ParseUserinfo(string(bytes.TrimSpace(line)))
+	if err != nil {
+		// Do not include the output in the error as it may contain secrets.
+		return nil, 0, errors.New("invalid output, expected username:password")
+	}
+	return u, 0, nil
+}
+
+// limitedWriter discards writes after n bytes.
+type limitedWriter struct {
+	w io.Writer
+	n int
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(p) > l.n {
+		p = p[:l.n]
+	}
+	l.n -= len(p)
+	if _, err := l.w.Write(p); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// proxyFunc returns a ProxyFunc that sets the command credentials on upstream proxy URLs returned by fn.
+func (c *CredentialsCommand) proxyFunc(fn ProxyFunc) ProxyFunc {
+	return func(req *http.Request) (*url.URL, error) {
+		u, err := fn(req)
+		if u == nil || err != nil {
+			return u, err
+		}
+
+		proxyURL := new(url.URL)
+		*proxyURL = *u
+		proxyURL.User = c.Userinfo()
+		return proxyURL, nil
+	}
+}
+
+// refreshOnProxyAuthRequired is a response modifier that triggers a refresh when the upstream proxy responds with 407.
+// Responses generated by this proxy do not pass through response modifiers.
+func (c *CredentialsCommand) refreshOnProxyAuthRequired(res *http.Response) error {
+	if res.StatusCode == http.StatusProxyAuthRequired {
+		c.Refresh()
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log"
+)
+
+func TestParseCredentialsCommandOutput(t *testing.T) {
+	tests := []struct {
+		name      string
+		out       string
+		user      string
+		expiresIn time.Duration
+		err       bool
+	}{
+		{name: "userinfo", out: "user:pass\n", user: "user:pass"},
+		{name: "userinfo first line", out: "user:pass\nignored\n", user: "user:pass"},
+		{name: "json", out: `{"username":"user","password":"token","expires_in":300}`, user: "user:token", expiresIn: 300 * time.Second},
+		{name: "json without expires_in", out: `{"username":"user","password":"token"}`, user: "user:token"},
+		{name: "empty", out: " \n", err: true},
+		{name: "invalid json", out: `{"username":`, err: true},
+		{name: "json without username", out: `{"password":"token"}`, err: true},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			u, expiresIn, err := parseCredentialsCommandOutput([]byte(tc.out))
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.String() != tc.user {
+				t.Errorf("user: got %q, want %q", u.String(), tc.user)
+			}
+			if expiresIn != tc.expiresIn {
+				t.Errorf("expires_in: got %s, want %s", expiresIn, tc.expiresIn)
+			}
+		})
+	}
+}
+
+func TestCredentialsCommandProxyFunc(t *testing.T) {
+	cfg := DefaultCredentialsCommandConfig()
+	cfg.Command = []string{"sh", "-c", "echo user:secret"}
+	cc, err := NewCredentialsCommand(cfg, log.NopLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := &url.URL{Scheme: "http", User: url.UserPassword("static", "pass"), Host: "proxy:3128"}
+	fn := cc.proxyFunc(func(*http.Request) (*url.URL, error) {
+		return upstream, nil
+	})
+
+	u, err := fn(&http.Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.User.String(); got != "user:secret" {
+		t.Fatalf("got %q, want user:secret", got)
+	}
+	if upstream.User.String() != "static:pass" {
+		t.Fatal("upstream URL modified")
+	}
+}
+
+func TestCredentialsCommandError(t *testing.T) {
+	cfg := DefaultCredentialsCommandConfig()
+	cfg.Command = []string{"sh", "-c", "echo secret:token; exit 1"}
+	if _, err := NewCredentialsCommand(cfg, log.NopLogger); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -82,3 +82,28 @@ func TestUserInfoMatcherMatch(t *testing.T) {
 		})
 	}
 }
+
+func TestCredentialsMatcherUpdate(t *testing.T) {
+	m := NewDynamicCredentialsMatcher(stdlog.Default())
+	if u := m.Match("abc:80"); u != nil {
+		t.Fatalf("expected no match, got %s", u)
+	}
+
+	hpu, err := ParseHostPortUser("user:pass@abc:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Update([]*HostPortUser{hpu}); err != nil {
+		t.Fatal(err)
+	}
+	if u := m.Match("abc:80"); u.String() != "user:pass" {
+		t.Fatalf("expected user:pass, got %s", u)
+	}
+
+	if err := m.Update([]*HostPortUser{hpu, hpu}); err == nil {
+		t.Fatal("expected error for duplicate credentials")
+	}
+	if u := m.Match("abc:80"); u.String() != "user:pass" {
+		t.Fatalf("expected credentials unchanged after error, got %s", u)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/log"
+)
+
+// DecisionLogConfig configures the decision log.
+// The decision log records routing decisions made for requests as newline delimited JSON,
+// it is intended for offline policy audits and is separate from the access log.
+type DecisionLogConfig struct {
+	// Writer is the destination of the decision log.
+	Writer io.Writer
+
+	// SampleRate is the fraction of requests that are logged, 1 means all requests.
+	SampleRate float64
+}
+
+func DefaultDecisionLogConfig() *DecisionLogConfig {
+	return &DecisionLogConfig{
+		SampleRate: 1,
+	}
+}
+
+func (c *DecisionLogConfig) Validate() error {
+	if c.Writer == nil {
+		return errors.New("writer is required")
+	}
+	if c.SampleRate <= 0 || c.SampleRate > 1 {
+		return errors.New("sample rate must be in range (0, 1]")
+	}
+	return nil
+}
+
+// DecisionLogEntry is a single entry in the decision log.
+type DecisionLogEntry struct {
+	Time      time.Time         `json:"time"`
+	ID        string            `json:"id"`
+	Method    string            `json:"method"`
+	URL       string            `json:"url"`
+	Status    int               `json:"status"`
+	Principal string            `json:"principal,omitempty"`
+	Decisions map[string]string `json:"decisions,omitempty"`
+}
+
+type decisionLogger struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	log log.Logger
+	now func() time.Time
+}
+
+func newDecisionLogger(cfg *DecisionLogConfig, log log.Logger, now func() time.Time) *decisionLogger {
+	return &decisionLogger{
+		enc: json.NewEncoder(cfg.Writer),
+		log: log,
+		now: now,
+	}
+}
+
+func (l *decisionLogger) write(res *http.Response, t *ruleTrace) {
+	req := res.Request
+
+	e := DecisionLogEntry{
+		Time:   l.now().UTC(),
+		ID:     martian.ContextTraceID(req.Context()),
+		Method: req.Method,
+		URL:    req.URL.Redacted(),
+		Status: res.StatusCode,
+	}
+	t.each(func(key, value string) {
+		if key == "principal" {
+			e.Principal = value
+			return
+		}
+		if e.Decisions == nil {
+			e.Decisions = make(map[string]string)
+		}
+		e.Decisions[key] = value
+	})
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(e); err != nil {
+		l.log.Errorf("failed to write decision log entry: %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// DialerRegistry holds custom dialers for selected hosts.
+// Dialer consults the registry before falling back to the default TCP dialer,
+// this allows to reach in-memory endpoints in hermetic tests,
+// or to dial hosts in a service mesh in a topology specific way.
+//
+// The zero value is an empty registry ready to use.
+type DialerRegistry struct {
+	mu      sync.RWMutex
+	dialers map[string]dialContextFunc
+}
+
+func NewDialerRegistry() *DialerRegistry {
+	return new(DialerRegistry)
+}
+
+// Register registers dial for the given pattern replacing any previously registered dialer.
+// The pattern is a host or a host:port, the host may start with "*." to match all subdomains.
+// If the pattern has no port, it matches all ports.
+func (r *DialerRegistry) Register(pattern string, dial func(ctx context.Context, network, address string) (net.Conn, error)) error {
+	if dial == nil {
+		return errors.New("nil dialer")
+	}
+	p, err := normalizeDialerPattern(pattern)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.dialers == nil {
+		r.dialers = make(map[string]dialContextFunc)
+	}
+	r.dialers[p] = dial
+
+	return nil
+}
+
+// Unregister removes the dialer registered for the given pattern.
+func (r *DialerRegistry) Unregister(pattern string) {
+	p, err := normalizeDialerPattern(pattern)
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.dialers, p)
+}
+
+func normalizeDialerPattern(pattern string) (string, error) {
+	host, port := pattern, ""
+	if h, p, err := net.SplitHostPort(pattern); err == nil {
+		host, port = h, p
+	}
+	host = strings.ToLower(host)
+	if host == "" || host == "*." || strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+		return "", fmt.Errorf("invalid dialer pattern %q", pattern)
+	}
+	if port == "" {
+		return host, nil
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// lookup returns the dialer for the given address or nil if none matches.
+// Exact host:port patterns take precedence over host patterns, and exact hosts over wildcards.
+// For wildcards, the most specific (longest) match wins.
+func (r *DialerRegistry) lookup(address string) dialContextFunc {
+	if r == nil {
+		return nil
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil
+	}
+	host = strings.ToLower(host)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.dialers) == 0 {
+		return nil
+	}
+
+	get := func(h string) dialContextFunc {
+		if d, ok := r.dialers[net.JoinHostPort(h, port)]; ok {
+			return d
+		}
+		return r.dialers[h]
+	}
+
+	if d := get(host); d != nil {
+		return d
+	}
+	for h := host; ; {
+		i := strings.IndexByte(h, '.')
+		if i < 0 {
+			break
+		}
+		h = h[i+1:]
+		if d := get("*." + h); d != nil {
+			return d
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDialerRegistryLookup(t *testing.T) {
+	var r DialerRegistry
+
+	dialer := func(name string) func(context.Context, string, string) (net.Conn, error) {
+		return func(context.Context, string, string) (net.Conn, error) {
+			return nil, errors.New(name)
+		}
+	}
+	for _, p := range []string{"foo.memu", "foo.memu:443", "*.memu", "*.bar.memu"} {
+		if err := r.Register(p, dialer(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"foo.memu:80", "foo.memu"},
+		{"FOO.memu:80", "foo.memu"},
+		{"foo.memu:443", "foo.memu:443"},
+		{"baz.memu:80", "*.memu"},
+		{"a.bar.memu:80", "*.bar.memu"},
+		{"a.b.bar.memu:80", "*.bar.memu"},
+		{"memu:80", ""},
+		{"example.com:80", ""},
+		{"foo.memu", ""},
+	}
+	for _, tc := range tests {
+		d := r.lookup(tc.address)
+		if d == nil {
+			if tc.want != "" {
+				t.Errorf("lookup(%q): got nil, want %q", tc.address, tc.want)
+			}
+			continue
+		}
+		_, err := d(context.Background(), "tcp", tc.address)
+		if got := err.Error(); got != tc.want {
+			t.Errorf("lookup(%q): got %q, want %q", tc.address, got, tc.want)
+		}
+	}
+
+	r.Unregister("*.memu")
+	if d := r.lookup("baz.memu:80"); d != nil {
+		t.Error("lookup after Unregister: got dialer, want nil")
+	}
+}
+
+func TestDialerRegistryInvalidPattern(t *testing.T) {
+	var r DialerRegistry
+	for _, p := range []string{"", "*.", "foo.*.com", "*:80"} {
+		if err := r.Register(p, (&net.Dialer{}).DialContext); err == nil {
+			t.Errorf("Register(%q): got no error", p)
+		}
+	}
+}
+
+func TestDialerRegistryDialer(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	r := NewDialerRegistry()
+	if err := r.Register("*.memu", func(context.Context, string, string) (net.Conn, error) {
+		return c1, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDialer(&DialConfig{
+		DialTimeout: 10 * time.Millisecond,
+		Dialers:     r,
+	})
+	conn, err := d.DialContext(context.Background(), "tcp", "foo.memu:80")
+	if err != nil {
+		t.Fatalf("d.DialContext(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	go conn.Write([]byte("x")) //nolint:errcheck // read below
+	buf := make([]byte, 1)
+	if _, err := c2.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf[0] != 'x' {
+		t.Fatalf("got %q, want %q", buf, "x")
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package dialvia
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/net/http2"
+)
+
+// ErrHTTP2NotSupported is returned by HTTP2ProxyDialer if the proxy does not negotiate HTTP/2.
+var ErrHTTP2NotSupported = errors.New("proxy does not support HTTP/2")
+
+// HTTP2ProxyDialer sends CONNECT requests to an HTTPS proxy as streams over a single HTTP/2 connection.
+// It reduces the number of connections to the proxy and avoids TCP handshakes for new tunnels.
+// If the proxy does not select h2 in TLS ALPN, all calls return ErrHTTP2NotSupported,
+// and the caller is expected to fall back to HTTPProxyDialer.
+type HTTP2ProxyDialer struct {
+	dial      ContextDialerFunc
+	proxyURL  *url.URL
+	tlsConfig *tls.Config
+	tr        http2.Transport
+
+	mu          sync.Mutex
+	cc          *http2.ClientConn
+	laddr       net.Addr
+	raddr       net.Addr
+	unsupported atomic.Bool
+
+	Timeout time.Duration
+}
+
+func HTTP2Proxy(dial ContextDialerFunc, proxyURL *url.URL, tlsConfig *tls.Config) *HTTP2ProxyDialer {
+	if dial == nil {
+		panic("dial is required")
+	}
+	if proxyURL == nil {
+		panic("proxy URL is required")
+	}
+	if proxyURL.Scheme != "https" {
+		panic("proxy URL scheme must be https")
+	}
+	if tlsConfig == nil {
+		panic("TLS config is required")
+	}
+
+	tlsConfig.ServerName = proxyURL.Hostname()
+	tlsConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+
+	return &HTTP2ProxyDialer{
+		dial:      dial,
+		proxyURL:  proxyURL,
+		tlsConfig: tlsConfig,
+	}
+}
+
+// DialContextR sends a CONNECT request for addr with the given header,
+// and returns the response and a connection over the HTTP/2 stream if the response status is 2xx.
+// The caller is responsible for closing the response body.
+func (d *HTTP2ProxyDialer) DialContextR(ctx context.Context, network, addr string, header http.Header) (*http.Response, net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, nil, fmt.Errorf("unsupported network: %s", network)
+	}
+	if d.unsupported.Load() {
+		return nil, nil, ErrHTTP2NotSupported
+	}
+
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	cc, addrs, err := d.clientConn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pr, pw := io.Pipe()
+	req := &http.Request{
+		Method:        http.MethodConnect,
+		URL:           &url.URL{Host: addr},
+		Host:          addr,
+		Header:        http.Header{},
+		Body:          pr,
+		ContentLength: -1,
+	}
+	if u := d.proxyURL.User; u != nil {
+		pass, _ := u.Password()
+		auth := u.Username() + ":" + pass
+		req.Header.Add("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+	maps.Copy(req.Header, header)
+
+	// The stream must outlive the dial context, it is cancelled when the connection is closed.
+	sctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	req = req.WithContext(sctx)
+
+	type result struct {
+		res *http.Response
+		err error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		res, err := cc.RoundTrip(req)
+		resCh <- result{res, err}
+	}()
+
+	var r result
+	select {
+	case <-ctx.Done():
+		cancel()
+		pw.Close()
+		return nil, nil, ctx.Err()
+	case r = <-resCh:
+	}
+	if r.err != nil {
+		cancel()
+		pw.Close()
+		return nil, nil, r.err
+	}
+
+	if r.res.StatusCode/100 != 2 {
+		cancel()
+		pw.Close()
+		return r.res, nil, nil
+	}
+
+	return r.res, &h2Conn{
+		r:      r.res.Body,
+		w:      pw,
+		cancel: cancel,
+		laddr:  addrs[0],
+		raddr:  addrs[1],
+	}, nil
+}
+
+// DialContext is like DialContextR but returns an error if the response status is not 2xx.
+func (d *HTTP2ProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	res, conn, err := d.DialContextR(ctx, network, addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	if conn == nil {
+		b, err := httputil.DumpResponse(res, true)
+		if err != nil {
+			b = []byte(fmt.Sprintf("error dumping response: %s", err))
+		}
+		res.Body.Close()
+		return nil, fmt.Errorf("proxy connection failed status=%d\n\n%s", res.StatusCode, string(b))
+	}
+	return conn, nil
+}
+
+// clientConn returns the shared HTTP/2 connection to the proxy, it dials a new one if needed.
+// It returns the local and remote addresses of the connection.
+func (d *HTTP2ProxyDialer) clientConn(ctx context.Context) (*http2.ClientConn, [2]net.Addr, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.cc != nil && d.cc.CanTakeNewRequest() {
+		return d.cc, d.ccAddrs(), nil
+	}
+
+	conn, err := d.dial(ctx, "tcp", d.proxyURL.Host)
+	if err != nil {
+		return nil, [2]net.Addr{}, err
+	}
+	tconn := tls.Client(conn, d.tlsConfig)
+	if err := tconn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, [2]net.Addr{}, err
+	}
+	if tconn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		tconn.Close()
+		d.unsupported.Store(true)
+		return nil, [2]net.Addr{}, ErrHTTP2NotSupported
+	}
+
+	cc, err := d.tr.NewClientConn(tconn)
+	if err != nil {
+		tconn.Close()
+		return nil, [2]net.Addr{}, err
+	}
+	if d.cc != nil {
+		d.cc.Shutdown(context.Background()) //nolint:errcheck // the connection is drained in the background
+	}
+	d.cc = cc
+	d.laddr, d.raddr = tconn.LocalAddr(), tconn.RemoteAddr()
+
+	return d.cc, d.ccAddrs(), nil
+}
+
+func (d *HTTP2ProxyDialer) ccAddrs() [2]net.Addr {
+	return [2]net.Addr{d.laddr, d.raddr}
+}
+
+// Close closes the HTTP/2 connection to the proxy, it terminates all tunnels.
+func (d *HTTP2ProxyDialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.cc == nil {
+		return nil
+	}
+	err := d.cc.Close()
+	d.cc = nil
+	return err
+}
+
+// h2Conn is a net.Conn over an HTTP/2 CONNECT stream.
+// Deadlines are not supported, the stream is reset on Close.
+type h2Conn struct {
+	r      io.ReadCloser
+	w      *io.PipeWriter
+	cancel context.CancelFunc
+	laddr  net.Addr
+	raddr  net.Addr
+}
+
+func (c *h2Conn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *h2Conn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (c *h2Conn) Close() error {
+	c.w.Close()
+	err := c.r.Close()
+	c.cancel()
+	return err
+}
+
+// CloseWrite half-closes the stream, the proxy receives END_STREAM.
+func (c *h2Conn) CloseWrite() error {
+	return c.w.Close()
+}
+
+func (c *h2Conn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *h2Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *h2Conn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (c *h2Conn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (c *h2Conn) SetWriteDeadline(time.Time) error {
+	return nil
+}
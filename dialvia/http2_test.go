@@ -0,0 +1,124 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package dialvia
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTP2ProxyDialerDialContext(t *testing.T) {
+	var conns atomic.Int32
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect || r.Host != "foobar.com:443" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") == "" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+
+		rc := http.NewResponseController(w)
+		w.WriteHeader(http.StatusOK)
+		rc.Flush()
+
+		buf := make([]byte, 1024)
+		for {
+			n, err := r.Body.Read(buf)
+			if n > 0 {
+				w.Write(buf[:n])
+				rc.Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}))
+	s.EnableHTTP2 = true
+	s.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	s.StartTLS()
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.User = url.UserPassword("user", "pass")
+
+	d := HTTP2Proxy(
+		(&net.Dialer{Timeout: 5 * time.Second}).DialContext,
+		u,
+		&tls.Config{InsecureSkipVerify: true}, //nolint:gosec // test server
+	)
+	defer d.Close()
+
+	ctx := context.Background()
+
+	for i := range 3 {
+		conn, err := d.DialContext(ctx, "tcp", "foobar.com:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := fmt.Sprintf("Hello, World %d!\n", i)
+		fmt.Fprint(conn, want)
+		buf := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf); got != want {
+			t.Fatalf("conn.Read(): got %q, want %q", got, want)
+		}
+		conn.Close()
+	}
+
+	if got := conns.Load(); got != 1 {
+		t.Fatalf("expected a single connection to the proxy, got %d", got)
+	}
+
+	if _, err := d.DialContext(ctx, "tcp", "other.com:443"); err == nil {
+		t.Fatal("expected error for non-2xx response")
+	}
+}
+
+func TestHTTP2ProxyDialerNotSupported(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := HTTP2Proxy(
+		(&net.Dialer{Timeout: 5 * time.Second}).DialContext,
+		u,
+		&tls.Config{InsecureSkipVerify: true}, //nolint:gosec // test server
+	)
+	defer d.Close()
+
+	for range 2 {
+		if _, err := d.DialContext(context.Background(), "tcp", "foobar.com:443"); !errors.Is(err, ErrHTTP2NotSupported) {
+			t.Fatalf("expected %v, got %v", ErrHTTP2NotSupported, err)
+		}
+	}
+}
@@ -15,6 +15,9 @@ import (
 	"golang.org/x/net/proxy"
 )
 
+// SOCKS5ProxyDialer dials through a SOCKS5 proxy.
+// Host names are sent to the proxy unresolved and resolved by the proxy (remote DNS),
+// so both socks5 and socks5h schemes behave like socks5h in curl.
 type SOCKS5ProxyDialer struct {
 	dial     ContextDialerFunc
 	proxyURL *url.URL
@@ -29,8 +32,8 @@ func SOCKS5Proxy(dial ContextDialerFunc, proxyURL *url.URL) *SOCKS5ProxyDialer {
 	if proxyURL == nil {
 		panic("proxy URL is required")
 	}
-	if proxyURL.Scheme != "socks5" {
-		panic("proxy URL scheme must be socks5")
+	if proxyURL.Scheme != "socks5" && proxyURL.Scheme != "socks5h" {
+		panic("proxy URL scheme must be socks5 or socks5h")
 	}
 
 	return &SOCKS5ProxyDialer{
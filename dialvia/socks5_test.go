@@ -9,6 +9,7 @@ package dialvia
 import (
 	"context"
 	"errors"
+	"io"
 	"net"
 	"net/url"
 	"testing"
@@ -43,3 +44,79 @@ func TestSOCKS5ProxyDialer(t *testing.T) {
 		}
 	})
 }
+
+func TestSOCKS5ProxyDialerRemoteDNS(t *testing.T) {
+	for _, scheme := range []string{"socks5", "socks5h"} {
+		t.Run(scheme, func(t *testing.T) {
+			l, err := net.Listen("tcp", "localhost:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			addrc := make(chan string, 1)
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				addrc <- readSOCKS5ConnectDomain(conn)
+			}()
+
+			dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if addr != l.Addr().String() {
+					t.Errorf("unexpected dial to %q", addr)
+				}
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			}
+			d := SOCKS5Proxy(dial, &url.URL{Scheme: scheme, Host: l.Addr().String()})
+			d.Timeout = 5 * time.Second
+
+			go d.DialContext(context.Background(), "tcp", "unresolvable.invalid:443") //nolint:errcheck // the proxy never replies
+
+			select {
+			case addr := <-addrc:
+				if addr != "unresolvable.invalid" {
+					t.Fatalf("got address %q, want unresolved domain name", addr)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout")
+			}
+		})
+	}
+}
+
+// readSOCKS5ConnectDomain accepts the SOCKS5 greeting without authentication,
+// and returns the domain name from the CONNECT request or an empty string if the address is not a domain name.
+func readSOCKS5ConnectDomain(conn net.Conn) string {
+	buf := make([]byte, 256)
+
+	// VER NMETHODS METHODS...
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return ""
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return ""
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return ""
+	}
+
+	// VER CMD RSV ATYP
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return ""
+	}
+	const atypDomain = 3
+	if buf[3] != atypDomain {
+		return ""
+	}
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return ""
+	}
+	n := int(buf[0])
+	if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+		return ""
+	}
+	return string(buf[:n])
+}
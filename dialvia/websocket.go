@@ -0,0 +1,173 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package dialvia
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketDialer connects to a proxy through a WebSocket tunnel, such as wss://forwarder/tunnel.
+// The returned connection carries the proxy protocol,
+// so it can be used as http.Transport.DialContext together with http.Transport.Proxy.
+// It allows to reach the proxy from networks that only allow HTTPS to specific hosts.
+type WebSocketDialer struct {
+	dial      ContextDialerFunc
+	tunnelURL *url.URL
+	tlsConfig *tls.Config
+
+	Timeout time.Duration
+	Header  http.Header
+}
+
+func WebSocket(dial ContextDialerFunc, tunnelURL *url.URL, tlsConfig *tls.Config) *WebSocketDialer {
+	if dial == nil {
+		panic("dial is required")
+	}
+	if tunnelURL == nil {
+		panic("tunnel URL is required")
+	}
+	if tunnelURL.Scheme != "ws" && tunnelURL.Scheme != "wss" {
+		panic("tunnel URL scheme must be ws or wss")
+	}
+
+	return &WebSocketDialer{
+		dial:      dial,
+		tunnelURL: tunnelURL,
+		tlsConfig: tlsConfig,
+	}
+}
+
+// DialContext connects to the tunnel, network and address are ignored.
+func (d *WebSocketDialer) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	wd := websocket.Dialer{
+		NetDialContext:  d.dial,
+		TLSClientConfig: d.tlsConfig,
+	}
+
+	h := d.Header.Clone()
+	if u := d.tunnelURL.User; u != nil {
+		if h == nil {
+			h = http.Header{}
+		}
+		pass, _ := u.Password()
+		auth := u.Username() + ":" + pass
+		h.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+
+	tu := *d.tunnelURL
+	tu.User = nil
+
+	c, res, err := wd.DialContext(ctx, tu.String(), h)
+	if err != nil {
+		if res != nil {
+			return nil, fmt.Errorf("tunnel connection failed status=%d: %w", res.StatusCode, err)
+		}
+		return nil, err
+	}
+
+	return NewWebSocketConn(c), nil
+}
+
+// NewWebSocketConn returns a net.Conn that sends writes as binary WebSocket messages,
+// and reads binary messages as a byte stream.
+func NewWebSocketConn(c *websocket.Conn) net.Conn {
+	return &wsConn{c: c}
+}
+
+type wsConn struct {
+	c *websocket.Conn
+	r io.Reader
+
+	wmu sync.Mutex
+}
+
+func (w *wsConn) Read(p []byte) (int, error) {
+	for {
+		if w.r == nil {
+			t, r, err := w.c.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					err = io.EOF
+				}
+				return 0, err
+			}
+			if t != websocket.BinaryMessage {
+				continue
+			}
+			w.r = r
+		}
+
+		n, err := w.r.Read(p)
+		if err == io.EOF {
+			w.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (w *wsConn) Write(p []byte) (int, error) {
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+
+	if err := w.c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *wsConn) Close() error {
+	w.wmu.Lock()
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	w.c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)) //nolint:errcheck // best effort
+	w.wmu.Unlock()
+
+	return w.c.Close()
+}
+
+func (w *wsConn) LocalAddr() net.Addr {
+	return w.c.LocalAddr()
+}
+
+func (w *wsConn) RemoteAddr() net.Addr {
+	return w.c.RemoteAddr()
+}
+
+func (w *wsConn) SetDeadline(t time.Time) error {
+	if err := w.c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return w.c.SetWriteDeadline(t)
+}
+
+func (w *wsConn) SetReadDeadline(t time.Time) error {
+	return w.c.SetReadDeadline(t)
+}
+
+func (w *wsConn) SetWriteDeadline(t time.Time) error {
+	return w.c.SetWriteDeadline(t)
+}
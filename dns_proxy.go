@@ -0,0 +1,472 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/saucelabs/forwarder/log"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNSProxyPath is the path of the DNS over HTTPS endpoint, see RFC 8484.
+const DNSProxyPath = "/dns-query"
+
+// DNSProxyConfig configures a DNS proxy that forwards queries to upstream resolvers
+// and applies the proxy domain policy.
+type DNSProxyConfig struct {
+	// Address is the address to accept DNS queries over UDP and TCP.
+	Address string
+
+	// Servers are the upstream resolvers, if empty the system resolvers are used.
+	Servers []netip.AddrPort
+
+	// Timeout is the timeout of a query to an upstream resolver.
+	Timeout time.Duration
+
+	// DenyDomains are answered with NXDOMAIN.
+	DenyDomains Matcher
+
+	// DirectDomains are resolved with the system resolvers instead of Servers.
+	DirectDomains Matcher
+
+	// MaxConcurrentUDPQueries is the maximum number of UDP queries handled concurrently,
+	// queries above the limit are dropped, the clients retry them.
+	MaxConcurrentUDPQueries int
+
+	PromConfig
+}
+
+func DefaultDNSProxyConfig() *DNSProxyConfig {
+	return &DNSProxyConfig{
+		Timeout:                 5 * time.Second,
+		MaxConcurrentUDPQueries: 1024,
+	}
+}
+
+func (c *DNSProxyConfig) Validate() error {
+	if c.Timeout <= 0 {
+		return errors.New("timeout must be positive")
+	}
+	if c.MaxConcurrentUDPQueries < 1 {
+		return errors.New("max concurrent UDP queries must be at least 1")
+	}
+	return nil
+}
+
+// dnsUDPBufferSize is the size of the buffer to read UDP queries into,
+// it is the EDNS(0) payload size recommended by the DNS Flag Day 2020.
+// Larger queries are truncated and fail to parse.
+const dnsUDPBufferSize = 4096
+
+var dnsUDPBufferPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, dnsUDPBufferSize)
+		return &b
+	},
+}
+
+type dnsProxyMetrics struct {
+	queries  *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+func newDNSProxyMetrics(r prometheus.Registerer, namespace string) *dnsProxyMetrics {
+	if r == nil {
+		r = prometheus.NewRegistry() // This registry will be discarded.
+	}
+	f := promauto.With(r)
+
+	return &dnsProxyMetrics{
+		queries: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "dns_proxy_queries_total",
+			Namespace: namespace,
+			Help:      "Number of DNS proxy queries by transport and result",
+		}, []string{"transport", "result"}),
+		duration: f.NewHistogramVec(prometheus.HistogramOpts{
+			Name:      "dns_proxy_query_duration_seconds",
+			Namespace: namespace,
+			Help:      "DNS proxy query duration by transport",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"transport"}),
+	}
+}
+
+// DNSProxy serves DNS queries over UDP, TCP, and HTTPS, see ServeHTTP.
+// Queries for denied domains are answered with NXDOMAIN,
+// other queries are forwarded to the upstream resolvers and the responses are returned unmodified.
+type DNSProxy struct {
+	config        DNSProxyConfig
+	servers       []netip.AddrPort
+	directServers []netip.AddrPort
+	metrics       *dnsProxyMetrics
+	log           log.Logger
+
+	pc net.PacketConn
+	l  net.Listener
+}
+
+// NewDNSProxy creates a DNS proxy, if the address is empty it only serves DNS over HTTPS.
+// It is the caller's responsibility to call Close on the returned proxy.
+func NewDNSProxy(cfg *DNSProxyConfig, log log.Logger) (*DNSProxy, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	p := &DNSProxy{
+		config:        *cfg,
+		servers:       cfg.Servers,
+		directServers: systemDNSServers(),
+		metrics:       newDNSProxyMetrics(cfg.PromRegistry, cfg.PromNamespace),
+		log:           log,
+	}
+	if len(p.servers) == 0 {
+		p.servers = p.directServers
+	}
+
+	if cfg.Address != "" {
+		pc, err := net.ListenPacket("udp", cfg.Address)
+		if err != nil {
+			return nil, err
+		}
+		// Listen on the same port over TCP, it matters if the port is chosen by the system.
+		l, err := net.Listen("tcp", pc.LocalAddr().String())
+		if err != nil {
+			pc.Close()
+			return nil, err
+		}
+		p.pc, p.l = pc, l
+
+		p.log.Infof("DNS proxy listen address=%s servers=%s", pc.LocalAddr(), p.servers)
+	}
+
+	return p, nil
+}
+
+// Addr returns the address the proxy is listening on, it is the same for UDP and TCP.
+func (p *DNSProxy) Addr() string {
+	if p.pc == nil {
+		return ""
+	}
+	return p.pc.LocalAddr().String()
+}
+
+func (p *DNSProxy) Run(ctx context.Context) error {
+	if p.pc == nil {
+		<-ctx.Done()
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		p.serveUDP(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		p.serveTCP(ctx)
+	}()
+
+	<-ctx.Done()
+	p.Close()
+	wg.Wait()
+
+	return nil
+}
+
+func (p *DNSProxy) Close() error {
+	if p.pc == nil {
+		return nil
+	}
+	return errors.Join(p.pc.Close(), p.l.Close())
+}
+
+func (p *DNSProxy) serveUDP(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	sem := make(chan struct{}, p.config.MaxConcurrentUDPQueries)
+	for {
+		bp := dnsUDPBufferPool.Get().(*[]byte) //nolint:forcetypeassert // pool of *[]byte
+		n, addr, err := p.pc.ReadFrom(*bp)
+		q := bytes.Clone((*bp)[:n])
+		dnsUDPBufferPool.Put(bp)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			p.log.Errorf("DNS proxy UDP read: %s", err)
+			continue
+		}
+
+		select {
+		case sem <- struct{}{}:
+		default:
+			p.metrics.queries.WithLabelValues("udp", "dropped").Inc()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			res := p.query(ctx, "udp", q)
+			if res == nil {
+				return
+			}
+			if _, err := p.pc.WriteTo(res, addr); err != nil {
+				p.log.Debugf("DNS proxy UDP write client=%s: %s", addr, err)
+			}
+		}()
+	}
+}
+
+func (p *DNSProxy) serveTCP(ctx context.Context) {
+	for {
+		conn, err := p.l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			p.log.Errorf("DNS proxy TCP accept: %s", err)
+			continue
+		}
+		go p.serveTCPConn(ctx, conn)
+	}
+}
+
+func (p *DNSProxy) serveTCPConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	for {
+		// Idle connections are closed after the timeout, see RFC 7766 section 6.2.3.
+		conn.SetReadDeadline(time.Now().Add(2 * p.config.Timeout)) //nolint:errcheck // closed on error
+		q, err := readDNSTCPMessage(br)
+		if err != nil {
+			return
+		}
+		res := p.query(ctx, "tcp", q)
+		if res == nil {
+			return
+		}
+		if _, err := conn.Write(appendDNSTCPMessage(nil, res)); err != nil {
+			return
+		}
+	}
+}
+
+// ServeHTTP serves DNS over HTTPS GET and POST requests, see RFC 8484.
+func (p *DNSProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		q   []byte
+		err error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		q, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if ct := r.Header.Get("Content-Type"); ct != "application/dns-message" {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		q, err = io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil || len(q) == 0 {
+		http.Error(w, "invalid DNS query", http.StatusBadRequest)
+		return
+	}
+
+	res := p.query(r.Context(), "https", q)
+	if res == nil {
+		http.Error(w, "invalid DNS query", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Write(res) //nolint:errcheck // nothing to do
+}
+
+// query returns the response to the DNS query q, or nil if q cannot be parsed.
+func (p *DNSProxy) query(ctx context.Context, transport string, q []byte) []byte {
+	start := time.Now()
+	defer func() {
+		p.metrics.duration.WithLabelValues(transport).Observe(time.Since(start).Seconds())
+	}()
+
+	var parser dnsmessage.Parser
+	h, err := parser.Start(q)
+	if err != nil {
+		p.metrics.queries.WithLabelValues(transport, "malformed").Inc()
+		return nil
+	}
+	question, err := parser.Question()
+	if err != nil {
+		p.metrics.queries.WithLabelValues(transport, "malformed").Inc()
+		return dnsErrorResponse(h, nil, dnsmessage.RCodeFormatError)
+	}
+
+	name := strings.TrimSuffix(question.Name.String(), ".")
+	if p.config.DenyDomains != nil && matchHost(p.config.DenyDomains, name) {
+		p.log.Debugf("DNS proxy denied name=%s type=%s", name, question.Type)
+		p.metrics.queries.WithLabelValues(transport, "denied").Inc()
+		return dnsErrorResponse(h, &question, dnsmessage.RCodeNameError)
+	}
+
+	servers := p.servers
+	if p.config.DirectDomains != nil && matchHost(p.config.DirectDomains, name) {
+		servers = p.directServers
+	}
+
+	// UDP queries are forwarded over UDP so that truncated responses are passed to the client,
+	// which retries over TCP, other queries are forwarded over TCP.
+	network := "tcp"
+	if transport == "udp" {
+		network = "udp"
+	}
+
+	for _, s := range servers {
+		res, err := p.exchange(ctx, network, s, h.ID, q)
+		if err != nil {
+			p.log.Debugf("DNS proxy query name=%s type=%s server=%s: %s", name, question.Type, s, err)
+			continue
+		}
+		p.metrics.queries.WithLabelValues(transport, "ok").Inc()
+		return res
+	}
+
+	p.metrics.queries.WithLabelValues(transport, "servfail").Inc()
+	return dnsErrorResponse(h, &question, dnsmessage.RCodeServerFailure)
+}
+
+func (p *DNSProxy) exchange(ctx context.Context, network string, server netip.AddrPort, id uint16, q []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.config.Timeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server.String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl) //nolint:errcheck // fails on timeout
+	}
+
+	var res []byte
+	if network == "udp" {
+		if _, err := conn.Write(q); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 64*1024)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		res = buf[:n]
+	} else {
+		if _, err := conn.Write(appendDNSTCPMessage(nil, q)); err != nil {
+			return nil, err
+		}
+		if res, err = readDNSTCPMessage(bufio.NewReader(conn)); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(res) < 2 || binary.BigEndian.Uint16(res) != id {
+		return nil, errors.New("response ID mismatch")
+	}
+	return res, nil
+}
+
+func dnsErrorResponse(qh dnsmessage.Header, q *dnsmessage.Question, rcode dnsmessage.RCode) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 qh.ID,
+		Response:           true,
+		OpCode:             qh.OpCode,
+		RecursionDesired:   qh.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	if q != nil {
+		b.StartQuestions() //nolint:errcheck // cannot fail in this state
+		if err := b.Question(*q); err != nil {
+			return nil
+		}
+	}
+	res, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return res
+}
+
+func readDNSTCPMessage(r io.Reader) ([]byte, error) {
+	var n [2]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func appendDNSTCPMessage(dst, m []byte) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(m))) //nolint:gosec // DNS messages are limited to 64KiB
+	return append(dst, m...)
+}
+
+// systemDNSServers returns the name servers from /etc/resolv.conf,
+// if there are none it defaults to localhost like the Go resolver.
+func systemDNSServers() []netip.AddrPort {
+	var servers []netip.AddrPort
+
+	f, err := os.Open("/etc/resolv.conf")
+	if err == nil {
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			fields := strings.Fields(s.Text())
+			if len(fields) < 2 || fields[0] != "nameserver" {
+				continue
+			}
+			if a, err := netip.ParseAddr(fields[1]); err == nil {
+				servers = append(servers, netip.AddrPortFrom(a.WithZone(""), 53))
+			}
+		}
+	}
+
+	if len(servers) == 0 {
+		servers = []netip.AddrPort{
+			netip.MustParseAddrPort("127.0.0.1:53"),
+			netip.MustParseAddrPort("[::1]:53"),
+		}
+	}
+	return servers
+}
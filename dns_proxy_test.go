@@ -0,0 +1,246 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsTestAnswer is the A record returned by the test DNS server for all names.
+var dnsTestAnswer = [4]byte{192, 0, 2, 1}
+
+func dnsTestResponse(t *testing.T, q []byte) []byte {
+	t.Helper()
+
+	var p dnsmessage.Parser
+	h, err := p.Start(q)
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+	question, err := p.Question()
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true})
+	b.StartQuestions()                     //nolint:errcheck // test
+	b.Question(question)                   //nolint:errcheck // test
+	b.StartAnswers()                       //nolint:errcheck // test
+	b.AResource(dnsmessage.ResourceHeader{ //nolint:errcheck // test
+		Name:  question.Name,
+		Class: dnsmessage.ClassINET,
+		TTL:   60,
+	}, dnsmessage.AResource{A: dnsTestAnswer})
+	res, err := b.Finish()
+	if err != nil {
+		t.Error(err)
+	}
+	return res
+}
+
+// startTestDNSServer starts a DNS server on UDP and TCP that answers all queries with dnsTestAnswer.
+func startTestDNSServer(t *testing.T) netip.AddrPort {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(dnsTestResponse(t, buf[:n]), addr) //nolint:errcheck // test server
+		}
+	}()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				q, err := readDNSTCPMessage(c)
+				if err != nil {
+					return
+				}
+				c.Write(appendDNSTCPMessage(nil, dnsTestResponse(t, q))) //nolint:errcheck // test server
+			}()
+		}
+	}()
+
+	return netip.MustParseAddrPort(pc.LocalAddr().String())
+}
+
+func dnsTestQuery(t *testing.T, name string) []byte {
+	t.Helper()
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 0xbeef, RecursionDesired: true})
+	b.StartQuestions() //nolint:errcheck // test
+	if err := b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  dnsmessage.TypeA,
+		Class: dnsmessage.ClassINET,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	q, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func checkDNSTestResponse(t *testing.T, res []byte, rcode dnsmessage.RCode) {
+	t.Helper()
+
+	var m dnsmessage.Message
+	if err := m.Unpack(res); err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != 0xbeef {
+		t.Fatalf("got ID %x", m.ID)
+	}
+	if m.RCode != rcode {
+		t.Fatalf("got rcode %s, want %s", m.RCode, rcode)
+	}
+	if rcode != dnsmessage.RCodeSuccess {
+		return
+	}
+	if len(m.Answers) != 1 {
+		t.Fatalf("got %d answers", len(m.Answers))
+	}
+	if a, ok := m.Answers[0].Body.(*dnsmessage.AResource); !ok || a.A != dnsTestAnswer {
+		t.Fatalf("unexpected answer %v", m.Answers[0].Body)
+	}
+}
+
+func TestDNSProxy(t *testing.T) {
+	cfg := DefaultDNSProxyConfig()
+	cfg.Address = "127.0.0.1:0"
+	cfg.Servers = []netip.AddrPort{startTestDNSServer(t)}
+	cfg.DenyDomains = MatchFunc(func(host string) bool { return host == "denied.example" })
+	cfg.PromRegistry = prometheus.NewRegistry()
+
+	p, err := NewDNSProxy(cfg, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx) //nolint:errcheck // returns on cancel
+
+	udp := func(t *testing.T, q []byte) []byte {
+		t.Helper()
+		c, err := net.Dial("udp", p.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if _, err := c.Write(q); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1024)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[:n]
+	}
+
+	t.Run("udp", func(t *testing.T) {
+		checkDNSTestResponse(t, udp(t, dnsTestQuery(t, "example.com.")), dnsmessage.RCodeSuccess)
+	})
+
+	t.Run("udp denied", func(t *testing.T) {
+		checkDNSTestResponse(t, udp(t, dnsTestQuery(t, "denied.example.")), dnsmessage.RCodeNameError)
+	})
+
+	t.Run("tcp", func(t *testing.T) {
+		c, err := net.Dial("tcp", p.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		br := bufio.NewReader(c)
+		for _, name := range []string{"example.com.", "example.org."} {
+			if _, err := c.Write(appendDNSTCPMessage(nil, dnsTestQuery(t, name))); err != nil {
+				t.Fatal(err)
+			}
+			res, err := readDNSTCPMessage(br)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkDNSTestResponse(t, res, dnsmessage.RCodeSuccess)
+		}
+	})
+
+	doh := func(t *testing.T, req *http.Request) []byte {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/dns-message" {
+			t.Fatalf("got content type %q", ct)
+		}
+		b, _ := io.ReadAll(rec.Body)
+		return b
+	}
+
+	t.Run("doh get", func(t *testing.T) {
+		q := base64.RawURLEncoding.EncodeToString(dnsTestQuery(t, "example.com."))
+		req := httptest.NewRequest(http.MethodGet, DNSProxyPath+"?dns="+q, http.NoBody)
+		checkDNSTestResponse(t, doh(t, req), dnsmessage.RCodeSuccess)
+	})
+
+	t.Run("doh post denied", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, DNSProxyPath, bytes.NewReader(dnsTestQuery(t, "denied.example.")))
+		req.Header.Set("Content-Type", "application/dns-message")
+		checkDNSTestResponse(t, doh(t, req), dnsmessage.RCodeNameError)
+	})
+
+	t.Run("servfail", func(t *testing.T) {
+		cfg := *cfg
+		cfg.Address = ""
+		cfg.Servers = []netip.AddrPort{netip.MustParseAddrPort("127.0.0.1:1")}
+		cfg.PromRegistry = prometheus.NewRegistry()
+		p, err := NewDNSProxy(&cfg, stdlog.Default())
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := p.query(context.Background(), "tcp", dnsTestQuery(t, "example.com."))
+		checkDNSTestResponse(t, res, dnsmessage.RCodeServerFailure)
+	})
+}
@@ -0,0 +1,316 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ECHConfig configures Encrypted Client Hello for outbound TLS connections.
+// ECH encrypts the ClientHello including SNI with a key the origin publishes in DNS HTTPS records,
+// so that the destination host name is not visible on the network.
+type ECHConfig struct {
+	// DoHURL is the DNS over HTTPS endpoint used to look up HTTPS records.
+	// If nil, ECH is disabled.
+	// A DoH endpoint is used instead of the system resolver, so that the lookup does not reveal the host name either.
+	DoHURL *url.URL
+
+	// Require fails connections to origins that do not publish ECH configs, instead of falling back to plain TLS.
+	Require bool
+}
+
+const (
+	// typeHTTPS is the HTTPS resource record type, see RFC 9460.
+	typeHTTPS dnsmessage.Type = 65
+
+	// svcParamECH is the SvcParamKey of the ECH config list.
+	svcParamECH = 5
+
+	echMinTTL = time.Minute
+	echMaxTTL = time.Hour
+
+	dohTimeout = 5 * time.Second
+)
+
+var errNoECHConfig = errors.New("origin does not publish ECH configs")
+
+type echCacheEntry struct {
+	configs []byte
+	expires time.Time
+}
+
+// echResolver looks up ECH config lists using DNS over HTTPS, and caches them for the record TTL.
+type echResolver struct {
+	doh    *url.URL
+	client *http.Client
+	now    func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]echCacheEntry
+}
+
+func newECHResolver(doh *url.URL, dial dialContextFunc) *echResolver {
+	return &echResolver{
+		doh: doh,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext:       dial,
+				ForceAttemptHTTP2: true,
+			},
+			Timeout: dohTimeout,
+		},
+		now:   time.Now,
+		cache: make(map[string]echCacheEntry),
+	}
+}
+
+// lookup returns the ECH config list for the host and port, or nil if the origin does not publish one.
+func (r *echResolver) lookup(ctx context.Context, host, port string) ([]byte, error) {
+	if net.ParseIP(host) != nil {
+		return nil, nil
+	}
+
+	name := echQueryName(host, port)
+
+	r.mu.Lock()
+	e, ok := r.cache[name]
+	r.mu.Unlock()
+	if ok && r.now().Before(e.expires) {
+		return e.configs, nil
+	}
+
+	configs, ttl, err := r.query(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	r.store(name, configs, ttl)
+
+	return configs, nil
+}
+
+// echQueryName returns the name of HTTPS records for the host and port, see RFC 9460 section 9.1.
+func echQueryName(host, port string) string {
+	if port != "443" {
+		return "_" + port + "._https." + host
+	}
+	return host
+}
+
+func (r *echResolver) store(name string, configs []byte, ttl time.Duration) {
+	ttl = min(max(ttl, echMinTTL), echMaxTTL)
+
+	r.mu.Lock()
+	r.cache[name] = echCacheEntry{
+		configs: configs,
+		expires: r.now().Add(ttl),
+	}
+	r.mu.Unlock()
+}
+
+func (r *echResolver) query(ctx context.Context, name string) (configs []byte, ttl time.Duration, err error) {
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, 0, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: qname, Type: typeHTTPS, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, 0, err
+	}
+	q, err := b.Finish()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.doh.String(), bytes.NewReader(q))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("DoH query: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("DoH query: unexpected status code %d", res.StatusCode)
+	}
+	msg, err := io.ReadAll(io.LimitReader(res.Body, 64*1024))
+	if err != nil {
+		return nil, 0, fmt.Errorf("DoH query: %w", err)
+	}
+
+	return parseECHConfigs(msg)
+}
+
+// parseECHConfigs returns the ECH config list from the first HTTPS record in the DNS response that has one.
+func parseECHConfigs(msg []byte) (configs []byte, ttl time.Duration, err error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return nil, 0, err
+	}
+	if h.RCode != dnsmessage.RCodeSuccess && h.RCode != dnsmessage.RCodeNameError {
+		return nil, 0, fmt.Errorf("DNS error: %s", h.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	ttl = echMaxTTL
+	for {
+		rh, err := p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			return nil, ttl, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if rh.Type != typeHTTPS {
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+
+		ur, err := p.UnknownResource()
+		if err != nil {
+			return nil, 0, err
+		}
+		if c := svcbECH(ur.Data); c != nil {
+			return c, time.Duration(rh.TTL) * time.Second, nil
+		}
+	}
+}
+
+// svcbECH returns the ech SvcParam value of SVCB RDATA, see RFC 9460 section 2.2.
+func svcbECH(data []byte) []byte {
+	// Skip SvcPriority.
+	if len(data) < 2 {
+		return nil
+	}
+	data = data[2:]
+
+	// Skip uncompressed TargetName.
+	for {
+		if len(data) == 0 {
+			return nil
+		}
+		l := int(data[0])
+		if len(data) < 1+l {
+			return nil
+		}
+		data = data[1+l:]
+		if l == 0 {
+			break
+		}
+	}
+
+	for len(data) >= 4 {
+		key := binary.BigEndian.Uint16(data)
+		l := int(binary.BigEndian.Uint16(data[2:]))
+		data = data[4:]
+		if len(data) < l {
+			return nil
+		}
+		if key == svcParamECH {
+			return data[:l]
+		}
+		data = data[l:]
+	}
+
+	return nil
+}
+
+// echDialer dials TLS connections with ECH when the origin publishes ECH configs.
+type echDialer struct {
+	cfg              *ECHConfig
+	resolver         *echResolver
+	dial             dialContextFunc
+	tlsConfig        func() *tls.Config
+	clientCerts      *clientCertificates
+	handshakeTimeout time.Duration
+}
+
+func (d *echDialer) DialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	configs, err := d.resolver.lookup(ctx, host, port)
+	if err != nil {
+		if d.cfg.Require {
+			return nil, fmt.Errorf("ECH lookup for %s: %w", host, err)
+		}
+		configs = nil
+	}
+	if configs == nil && d.cfg.Require {
+		return nil, fmt.Errorf("%s: %w", host, errNoECHConfig)
+	}
+
+	conn, err := d.handshake(ctx, network, addr, host, configs)
+
+	// The origin rotated its keys, retry once with the configs it sent.
+	var rejErr *tls.ECHRejectionError
+	if errors.As(err, &rejErr) && len(rejErr.RetryConfigList) > 0 {
+		d.resolver.store(echQueryName(host, port), rejErr.RetryConfigList, echMinTTL)
+		conn, err = d.handshake(ctx, network, addr, host, rejErr.RetryConfigList)
+	}
+
+	return conn, err
+}
+
+func (d *echDialer) handshake(ctx context.Context, network, addr, host string, configs []byte) (net.Conn, error) {
+	conn, err := d.dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.handshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.handshakeTimeout)
+		defer cancel()
+	}
+
+	cfg := d.tlsConfig().Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	d.clientCerts.configure(cfg, cfg.ServerName)
+	configureTLSNextProtos(ctx, cfg)
+	cfg.EncryptedClientHelloConfigList = configs
+	if configs != nil && cfg.MinVersion < tls.VersionTLS13 {
+		cfg.MinVersion = tls.VersionTLS13
+	}
+
+	tc := tls.Client(conn, cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tc, nil
+}
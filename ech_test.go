@@ -0,0 +1,150 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testDoHServer answers HTTPS queries with a record containing ech for names in records.
+func testDoHServer(t *testing.T, records map[string][]byte, queries *atomic.Int32) *httptest.Server {
+	t.Helper()
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var p dnsmessage.Parser
+		h, err := p.Start(b)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		q, err := p.Question()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		h.Response = true
+		bld := dnsmessage.NewBuilder(nil, h)
+		bld.StartQuestions()
+		bld.Question(q)
+		bld.StartAnswers()
+		if ech, ok := records[q.Name.String()]; ok {
+			// SvcPriority 1, TargetName ".", alpn=h2, ech=<ech>.
+			data := []byte{0, 1, 0, 0, 1, 0, 3, 2, 'h', '2', 0, svcParamECH, 0, byte(len(ech))}
+			data = append(data, ech...)
+			bld.UnknownResource(dnsmessage.ResourceHeader{
+				Name:  q.Name,
+				Type:  typeHTTPS,
+				Class: dnsmessage.ClassINET,
+				TTL:   300,
+			}, dnsmessage.UnknownResource{Type: typeHTTPS, Data: data})
+		}
+		msg, err := bld.Finish()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(msg)
+	}))
+}
+
+func TestECHResolver(t *testing.T) {
+	var queries atomic.Int32
+	s := testDoHServer(t, map[string][]byte{
+		"example.com.":              []byte("configs"),
+		"_8443._https.example.com.": []byte("configs8443"),
+	}, &queries)
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newECHResolver(u, (&net.Dialer{}).DialContext)
+
+	tests := []struct {
+		host, port string
+		want       []byte
+	}{
+		{"example.com", "443", []byte("configs")},
+		{"example.com", "443", []byte("configs")},
+		{"example.com", "8443", []byte("configs8443")},
+		{"other.com", "443", nil},
+		{"127.0.0.1", "443", nil},
+	}
+	for _, tc := range tests {
+		got, err := r.lookup(context.Background(), tc.host, tc.port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, tc.want) {
+			t.Fatalf("%s:%s: expected %q, got %q", tc.host, tc.port, tc.want, got)
+		}
+	}
+
+	if n := queries.Load(); n != 3 {
+		t.Fatalf("expected 3 queries, got %d", n)
+	}
+}
+
+func TestECHDialerFallback(t *testing.T) {
+	var queries atomic.Int32
+	doh := testDoHServer(t, nil, &queries)
+	defer doh.Close()
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+
+	u, err := url.Parse(doh.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := (&net.Dialer{}).DialContext
+	_, port, err := net.SplitHostPort(origin.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, require := range []bool{false, true} {
+		d := &echDialer{
+			cfg:       &ECHConfig{DoHURL: u, Require: require},
+			resolver:  newECHResolver(u, dial),
+			dial:      dial,
+			tlsConfig: func() *tls.Config { return &tls.Config{InsecureSkipVerify: true} }, //nolint:gosec // test
+		}
+		conn, err := d.DialTLSContext(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+		if require {
+			if !errors.Is(err, errNoECHConfig) {
+				t.Fatalf("expected errNoECHConfig, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrorEvent is a proxy error reported to ErrorStream subscribers.
+type ErrorEvent struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	Client    string    `json:"client"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	Status    int       `json:"status"`
+	Label     string    `json:"label,omitempty"`
+	Fault     Fault     `json:"fault,omitempty"`
+	Message   string    `json:"message"`
+	Error     string    `json:"error"`
+}
+
+// errorStreamBuffer is the number of events buffered per subscriber.
+// If a subscriber does not keep up, new events are dropped for that subscriber.
+const errorStreamBuffer = 64
+
+// ErrorStream broadcasts proxy errors, i.e. round trip failures, TLS errors and denied requests, to subscribers.
+// It serves the events as Server-Sent Events if the client accepts text/event-stream,
+// and as newline delimited JSON otherwise.
+type ErrorStream struct {
+	mu   sync.Mutex
+	subs map[chan ErrorEvent]struct{}
+}
+
+func NewErrorStream() *ErrorStream {
+	return &ErrorStream{
+		subs: make(map[chan ErrorEvent]struct{}),
+	}
+}
+
+// Publish sends the event to all subscribers without blocking.
+func (s *ErrorStream) Publish(e ErrorEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ch := range s.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving events, and a function to cancel the subscription.
+func (s *ErrorStream) Subscribe() (events <-chan ErrorEvent, cancel func()) {
+	ch := make(chan ErrorEvent, errorStreamBuffer)
+
+	s.mu.Lock()
+	s.subs[ch] = struct{}{}
+	s.mu.Unlock()
+
+	return ch, func() {
+		s.mu.Lock()
+		delete(s.subs, ch)
+		s.mu.Unlock()
+	}
+}
+
+func (s *ErrorStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	events, cancel := s.Subscribe()
+	defer cancel()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-events:
+			b, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			if sse {
+				w.Write([]byte("event: error\ndata: "))
+				w.Write(b)
+				w.Write([]byte("\n\n"))
+			} else {
+				w.Write(b)
+				w.Write([]byte("\n"))
+			}
+			f.Flush()
+		}
+	}
+}
+
+func (hp *HTTPProxy) publishError(req *http.Request, err error, code int, msg, label string, fault Fault) {
+	if label == skipMetricsLabel {
+		label = ""
+	}
+
+	e := ErrorEvent{
+		Time:    hp.now().UTC(),
+		Client:  req.RemoteAddr,
+		Method:  req.Method,
+		Host:    req.Host,
+		Status:  code,
+		Label:   label,
+		Fault:   fault,
+		Message: msg,
+		Error:   err.Error(),
+	}
+	if hp.config.RequestIDHeader != "" {
+		e.RequestID = req.Header.Get(hp.config.RequestIDHeader)
+	}
+
+	hp.config.ErrorStream.Publish(e)
+}
@@ -0,0 +1,134 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestErrorStreamDeniedRequest(t *testing.T) {
+	es := NewErrorStream()
+	events, cancel := es.Subscribe()
+	defer cancel()
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.DenyDomains = MatchFunc(func(s string) bool { return s == "denied" })
+	cfg.ErrorStream = es
+
+	tr, err := NewClientTransport(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	req, err := http.NewRequest(http.MethodGet, "http://denied", http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Request-Id", "test-id")
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	select {
+	case e := <-events:
+		if e.Status != http.StatusForbidden {
+			t.Errorf("expected status %d, got %d", http.StatusForbidden, e.Status)
+		}
+		if e.Host != "denied" || e.Method != http.MethodGet || e.RequestID != "test-id" {
+			t.Errorf("unexpected event: %+v", e)
+		}
+		if e.Label != "" {
+			t.Errorf("expected no label for denied request, got %q", e.Label)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+}
+
+func TestErrorStreamServeHTTP(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept string
+		ct     string
+		prefix string
+	}{
+		{name: "ndjson", ct: "application/x-ndjson", prefix: "{"},
+		{name: "sse", accept: "text/event-stream", ct: "text/event-stream", prefix: "event: error"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			es := NewErrorStream()
+			s := httptest.NewServer(es)
+			defer s.Close()
+
+			req, err := http.NewRequest(http.MethodGet, s.URL, http.NoBody)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			if ct := res.Header.Get("Content-Type"); ct != tc.ct {
+				t.Fatalf("expected content type %q, got %q", tc.ct, ct)
+			}
+
+			// The subscription is registered after the headers are flushed, publish until it is received.
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				for {
+					es.Publish(ErrorEvent{Host: "example.com", Status: http.StatusBadGateway})
+					select {
+					case <-done:
+						return
+					case <-time.After(10 * time.Millisecond):
+					}
+				}
+			}()
+
+			r := bufio.NewReader(res.Body)
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(line, tc.prefix) {
+				t.Fatalf("expected line to start with %q, got %q", tc.prefix, line)
+			}
+			if tc.accept != "" {
+				if line, err = r.ReadString('\n'); err != nil {
+					t.Fatal(err)
+				}
+				line = strings.TrimPrefix(line, "data: ")
+			}
+			var e ErrorEvent
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Fatal(err)
+			}
+			if e.Host != "example.com" || e.Status != http.StatusBadGateway {
+				t.Fatalf("unexpected event: %+v", e)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/saucelabs/forwarder/log"
+)
+
+// FDGuard protects the process from running out of file descriptors.
+// It counts connections accepted by listeners and dialed by dialers that use it,
+// and when the number of open connections reaches the limit, new client connections are shed,
+// i.e. plain HTTP clients get a 503 Service Unavailable response and the connection is closed.
+// Dialed connections are never shed, so that requests from already accepted clients can be served.
+type FDGuard struct {
+	limit int64
+	open  atomic.Int64
+	log   log.Logger
+
+	lastLog  atomic.Int64
+	shedding chan struct{}
+}
+
+// DefaultFDReserve returns the number of file descriptors reserved for files, DNS and other uses,
+// given the soft limit of open file descriptors.
+func DefaultFDReserve(fdLimit uint64) uint64 {
+	return max(64, fdLimit/10)
+}
+
+// NewFDGuard returns a guard that allows up to limit open connections.
+func NewFDGuard(limit int64, log log.Logger) *FDGuard {
+	return &FDGuard{
+		limit:    limit,
+		log:      log,
+		shedding: make(chan struct{}, fdGuardMaxShedWriters),
+	}
+}
+
+// Limit returns the maximum number of open connections.
+func (g *FDGuard) Limit() int64 {
+	return g.limit
+}
+
+// Open returns the number of open connections.
+func (g *FDGuard) Open() int64 {
+	return g.open.Load()
+}
+
+// acquire counts a new client connection, it returns false if the connection should be shed.
+func (g *FDGuard) acquire() bool {
+	if g.open.Add(1) > g.limit {
+		g.open.Add(-1)
+		return false
+	}
+	return true
+}
+
+// track counts a new dialed connection.
+func (g *FDGuard) track() {
+	g.open.Add(1)
+}
+
+func (g *FDGuard) release() {
+	g.open.Add(-1)
+}
+
+var fdGuardShedResponse = []byte("HTTP/1.1 503 Service Unavailable\r\n" +
+	"Connection: close\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Length: 48\r\n" +
+	"\r\n" +
+	"too many open connections, file descriptors low\n")
+
+// fdGuardMaxShedWriters is the maximum number of shed connections the response is written to concurrently,
+// above that connections are closed without a response.
+const fdGuardMaxShedWriters = 64
+
+// shed rejects the connection, the response is only written if writeResponse is true.
+// The response is written in the background, so that shedding never blocks Accept.
+func (g *FDGuard) shed(conn net.Conn, writeResponse bool) {
+	if writeResponse {
+		select {
+		case g.shedding <- struct{}{}:
+			go func() {
+				conn.SetWriteDeadline(time.Now().Add(time.Second)) //nolint:errcheck // best effort
+				conn.Write(fdGuardShedResponse)                    //nolint:errcheck // best effort
+				conn.Close()
+				<-g.shedding
+			}()
+		default:
+			conn.Close()
+		}
+	} else {
+		conn.Close()
+	}
+
+	// Log at most once per second.
+	now := time.Now().UnixNano()
+	if last := g.lastLog.Load(); now-last > int64(time.Second) && g.lastLog.CompareAndSwap(last, now) {
+		g.log.Errorf("shedding connection from %s: open connections=%d reached the limit=%d derived from the file descriptor limit",
+			conn.RemoteAddr(), g.open.Load(), g.limit)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log"
+)
+
+func TestFDGuardShedsListenerConnections(t *testing.T) {
+	g := NewFDGuard(1, log.NopLogger)
+
+	l := Listener{
+		ListenerConfig: testListenerConfig,
+	}
+	l.FDGuard = g
+	defer l.Close()
+
+	l.listenAndWait(t)
+	go l.acceptAndCopy()
+
+	echo := func() net.Conn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("net.Dial(): got %v, want no error", err)
+		}
+		fmt.Fprintf(conn, "Hello, World!\n")
+		if _, err := conn.Read(make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	c1 := echo()
+
+	c2, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer c2.Close()
+	res, err := http.ReadResponse(bufio.NewReader(c2), nil)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	io.Copy(io.Discard, res.Body) //nolint:errcheck // test
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want %d", res.StatusCode, http.StatusServiceUnavailable)
+	}
+
+	c1.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for g.Open() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d open connections, want 0", g.Open())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	echo().Close()
+}
+
+func TestFDGuardShedDoesNotBlock(t *testing.T) {
+	g := NewFDGuard(0, log.NopLogger)
+
+	// net.Pipe writes block until the other end reads.
+	c, s := net.Pipe()
+	defer c.Close()
+
+	done := make(chan struct{})
+	go func() {
+		g.shed(s, true)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("shed(): blocked on write")
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want %d", res.StatusCode, http.StatusServiceUnavailable)
+	}
+}
+
+func TestFDGuardDialedConnectionsAreNotShed(t *testing.T) {
+	g := NewFDGuard(1, log.NopLogger)
+
+	if !g.acquire() {
+		t.Fatal("acquire(): got false, want true")
+	}
+	g.track()
+	if g.acquire() {
+		t.Fatal("acquire(): got true, want false")
+	}
+	if got := g.Open(); got != 2 {
+		t.Fatalf("Open(): got %d, want 2", got)
+	}
+
+	g.release()
+	g.release()
+	if !g.acquire() {
+		t.Fatal("acquire(): got false, want true")
+	}
+}
+
+func TestDefaultFDReserve(t *testing.T) {
+	tests := []struct {
+		limit, want uint64
+	}{
+		{256, 64},
+		{1024, 102},
+		{1 << 20, 1 << 20 / 10},
+	}
+	for _, tc := range tests {
+		if got := DefaultFDReserve(tc.limit); got != tc.want {
+			t.Errorf("DefaultFDReserve(%d): got %d, want %d", tc.limit, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package fdlimit provides access to the open file descriptor limit (RLIMIT_NOFILE).
+// Note that the Go runtime raises the soft limit to the hard limit at startup on most Unix systems.
+package fdlimit
+
+import (
+	"errors"
+)
+
+var ErrUnsupported = errors.New("file descriptor limit is not supported on this platform")
+
+// Get returns the soft and hard limits of open file descriptors.
+func Get() (soft, hard uint64, err error) {
+	return get()
+}
+
+// Set sets the soft limit of open file descriptors to n, capped at the hard limit.
+// It returns the new soft limit.
+func Set(n uint64) (uint64, error) {
+	return set(n)
+}
@@ -0,0 +1,209 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package forwardertest provides utilities for testing code that embeds forwarder.
+// It allows to run a proxy on an ephemeral localhost port for the duration of a test,
+// and provides test modifiers and transports.
+package forwardertest
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/saucelabs/forwarder"
+	"github.com/saucelabs/forwarder/internal/martian/martiantest"
+	"github.com/saucelabs/forwarder/log"
+)
+
+// Modifier is a request and response modifier that counts modified requests and responses,
+// and can be configured to return errors or run custom functions.
+type Modifier = martiantest.Modifier
+
+// NewModifier returns a new test modifier.
+func NewModifier() *Modifier {
+	return martiantest.NewModifier()
+}
+
+// Transport is an http.RoundTripper that returns canned responses without network access.
+// By default, it responds with 200 OK.
+type Transport = martiantest.Transport
+
+// NewTransport returns a new test transport.
+func NewTransport() *Transport {
+	return martiantest.NewTransport()
+}
+
+// Logger returns a logger that writes to the test log.
+func Logger(tb testing.TB) log.Logger {
+	return testLogger{tb}
+}
+
+type testLogger struct {
+	tb testing.TB
+}
+
+func (l testLogger) Errorf(format string, args ...any) {
+	l.tb.Helper()
+	l.tb.Logf("[ERROR] "+format, args...)
+}
+
+func (l testLogger) Infof(format string, args ...any) {
+	l.tb.Helper()
+	l.tb.Logf("[INFO] "+format, args...)
+}
+
+func (l testLogger) Debugf(format string, args ...any) {
+	l.tb.Helper()
+	l.tb.Logf("[DEBUG] "+format, args...)
+}
+
+// Listen returns a TCP listener on an ephemeral localhost port.
+// The listener is closed when the test ends.
+func Listen(tb testing.TB) net.Listener {
+	tb.Helper()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		tb.Fatalf("listen: %v", err)
+	}
+	tb.Cleanup(func() { l.Close() })
+
+	return l
+}
+
+// FreePort returns a localhost TCP port that is free at the time of the call.
+// Prefer Listen if the code under test accepts a listener, as the port may be taken before it is used.
+func FreePort(tb testing.TB) int {
+	tb.Helper()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		tb.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port //nolint:forcetypeassert // tcp listener
+}
+
+// Proxy is a forwarder.HTTPProxy running on an ephemeral localhost port.
+type Proxy struct {
+	*forwarder.HTTPProxy
+
+	// URL is the proxy URL including basic auth credentials if configured.
+	URL *url.URL
+
+	insecure bool
+	dial     func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// NewProxy starts a proxy with the given configuration on an ephemeral localhost port.
+// The proxy is stopped when the test ends.
+//
+// If cfg is nil, the default configuration is used with localhost proxying allowed,
+// so that servers started with httptest can be reached.
+// If rt is nil, the default forwarder transport is used.
+func NewProxy(tb testing.TB, cfg *forwarder.HTTPProxyConfig, rt http.RoundTripper) *Proxy {
+	tb.Helper()
+	return newProxy(tb, cfg, rt, nil)
+}
+
+// NewMemProxy is like NewProxy but the proxy listens on an in-memory listener instead of a localhost port.
+// Use Client to send requests through the proxy.
+func NewMemProxy(tb testing.TB, cfg *forwarder.HTTPProxyConfig, rt http.RoundTripper) *Proxy {
+	tb.Helper()
+	return newProxy(tb, cfg, rt, forwarder.NewMemListener("forwardertest"))
+}
+
+func newProxy(tb testing.TB, cfg *forwarder.HTTPProxyConfig, rt http.RoundTripper, ml *forwarder.MemListener) *Proxy {
+	tb.Helper()
+
+	if cfg == nil {
+		cfg = forwarder.DefaultHTTPProxyConfig()
+		cfg.ProxyLocalhost = forwarder.AllowProxyLocalhost
+	} else {
+		c := *cfg
+		cfg = &c
+	}
+	cfg.Address = "localhost:0"
+	cfg.ExtraListeners = nil
+	cfg.Listener = nil
+	if ml != nil {
+		cfg.Listener = ml
+	}
+
+	if rt == nil {
+		tr, err := forwarder.NewHTTPTransport(forwarder.DefaultHTTPTransportConfig())
+		if err != nil {
+			tb.Fatalf("transport: %v", err)
+		}
+		rt = tr
+	}
+
+	hp, err := forwarder.NewHTTPProxy(cfg, nil, nil, rt, Logger(tb))
+	if err != nil {
+		tb.Fatalf("proxy: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- hp.Run(ctx)
+	}()
+	tb.Cleanup(func() {
+		cancel()
+		if err := <-errCh; err != nil && !errors.Is(err, context.Canceled) {
+			tb.Errorf("proxy: %v", err)
+		}
+		hp.Close()
+	})
+
+	addrs, _ := hp.Addr()
+	p := &Proxy{
+		HTTPProxy: hp,
+		URL: &url.URL{
+			Scheme: string(cfg.Protocol),
+			Host:   addrs[0],
+			User:   cfg.BasicAuth,
+		},
+		insecure: cfg.Protocol != forwarder.HTTPScheme,
+	}
+	if ml != nil {
+		p.dial = ml.DialContext
+	}
+
+	return p
+}
+
+// Client returns an HTTP client that sends requests through the proxy.
+// The client trusts the MITM CA certificate of the proxy, and the given root CAs.
+// If the proxy uses TLS, certificate verification is disabled,
+// as the proxy certificate is usually self-signed and Go uses the same TLS config for the proxy and the origin.
+func (p *Proxy) Client(rootCAs ...*x509.Certificate) *http.Client {
+	pool := x509.NewCertPool()
+	for _, c := range rootCAs {
+		pool.AddCert(c)
+	}
+	if ca := p.MITMCACert(); ca != nil {
+		pool.AddCert(ca)
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:       http.ProxyURL(p.URL),
+			DialContext: p.dial,
+			TLSClientConfig: &tls.Config{
+				RootCAs:            pool,
+				InsecureSkipVerify: p.insecure, //nolint:gosec // see above
+			},
+		},
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwardertest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/saucelabs/forwarder"
+)
+
+func TestProxy(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	m := NewModifier()
+	cfg := forwarder.DefaultHTTPProxyConfig()
+	cfg.ProxyLocalhost = forwarder.AllowProxyLocalhost
+	cfg.MITM = forwarder.DefaultMITMConfig()
+	cfg.RequestModifiers = append(cfg.RequestModifiers, m)
+
+	tr := NewTransport()
+	tr.Respond(http.StatusTeapot)
+
+	p := NewProxy(t, cfg, tr)
+	c := p.Client(s.Certificate())
+	defer c.CloseIdleConnections()
+
+	res, err := c.Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusTeapot {
+		t.Fatalf("expected status %d, got %d", http.StatusTeapot, res.StatusCode)
+	}
+	if !m.RequestModified() {
+		t.Fatal("expected request to be modified")
+	}
+}
+
+func TestFreePort(t *testing.T) {
+	if p := FreePort(t); p == 0 {
+		t.Fatal("expected non-zero port")
+	}
+}
+
+func TestMemProxy(t *testing.T) {
+	cfg := forwarder.DefaultHTTPProxyConfig()
+	cfg.MITM = forwarder.DefaultMITMConfig()
+
+	tr := NewTransport()
+	tr.Respond(http.StatusTeapot)
+
+	p := NewMemProxy(t, cfg, tr)
+	c := p.Client()
+	defer c.CloseIdleConnections()
+
+	for _, u := range []string{"http://example.com", "https://example.com"} {
+		res, err := c.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusTeapot {
+			t.Fatalf("%s: expected status %d, got %d", u, http.StatusTeapot, res.StatusCode)
+		}
+	}
+}
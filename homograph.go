@@ -0,0 +1,148 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"golang.org/x/text/unicode/norm"
+)
+
+// HomographConfig configures detection of internationalized domain names
+// that are visually confusable with protected domains, e.g. "аpple.com" with Cyrillic "а" and "apple.com".
+type HomographConfig struct {
+	// ProtectedDomains are the ASCII domains to protect, subdomains are protected too.
+	ProtectedDomains []string
+
+	// Block denies requests to confusable domains, otherwise they are only logged.
+	Block bool
+}
+
+func (c *HomographConfig) Validate() error {
+	if len(c.ProtectedDomains) == 0 {
+		return errors.New("protected domains are required")
+	}
+	for _, d := range c.ProtectedDomains {
+		if d == "" || !isASCII(NormalizeHost(d)) {
+			return fmt.Errorf("invalid protected domain %q, expected an ASCII domain name", d)
+		}
+	}
+	return nil
+}
+
+// homographSkeletons maps characters to the Latin characters they are commonly confused with.
+// It is a subset of the Unicode confusables (UTS #39) for Cyrillic, Greek and Latin letters used in domain names,
+// characters with diacritics are handled by removing the combining marks after NFKD decomposition.
+var homographSkeletons = map[rune]rune{
+	// Cyrillic.
+	'а': 'a', 'в': 'b', 'с': 'c', 'ԁ': 'd', 'е': 'e', 'ё': 'e', 'һ': 'h', 'і': 'i', 'ї': 'i', 'ј': 'j',
+	'к': 'k', 'ӏ': 'l', 'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p', 'ԛ': 'q', 'ѕ': 's', 'т': 't', 'ц': 'u',
+	'ѵ': 'v', 'ԝ': 'w', 'х': 'x', 'у': 'y', 'ү': 'y', 'з': '3', 'ь': 'b', 'ɡ': 'g',
+	// Greek.
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't',
+	'υ': 'u', 'χ': 'x', 'γ': 'y', 'ω': 'w',
+	// Latin.
+	'ı': 'i', 'ȷ': 'j', 'ł': 'l', 'ø': 'o', 'đ': 'd', 'ħ': 'h', 'ŀ': 'l', 'ß': 'b',
+	// Digits.
+	'0': 'o', '1': 'l',
+}
+
+// homographSkeleton returns the string with confusable characters replaced by their Latin counterparts.
+func homographSkeleton(s string) string {
+	var sb strings.Builder
+	for _, r := range norm.NFKD.String(s) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		r = unicode.ToLower(r)
+		if m, ok := homographSkeletons[r]; ok {
+			r = m
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+func isASCII(s string) bool {
+	for i := range len(s) {
+		if s[i] > unicode.MaxASCII {
+			return false
+		}
+	}
+	return true
+}
+
+type homographMatcher struct {
+	protected []string
+	skeletons []string
+}
+
+func newHomographMatcher(cfg *HomographConfig) *homographMatcher {
+	m := &homographMatcher{
+		protected: make([]string, len(cfg.ProtectedDomains)),
+		skeletons: make([]string, len(cfg.ProtectedDomains)),
+	}
+	for i, d := range cfg.ProtectedDomains {
+		d = NormalizeHost(d)
+		m.protected[i] = d
+		m.skeletons[i] = homographSkeleton(d)
+	}
+	return m
+}
+
+// match returns the protected domain the host is confusable with.
+// Only internationalized domain names are considered, the host must be normalized.
+func (m *homographMatcher) match(host string) (string, bool) {
+	if isASCII(host) {
+		return "", false
+	}
+
+	s := homographSkeleton(host)
+	for i, sk := range m.skeletons {
+		p := m.protected[i]
+		if host == p || strings.HasSuffix(host, "."+p) {
+			continue
+		}
+		if s == sk || strings.HasSuffix(s, "."+sk) {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+func (hp *HTTPProxy) checkHomograph() martian.RequestModifier {
+	cfg := hp.config.Homograph
+	m := newHomographMatcher(cfg)
+
+	action := "warn"
+	if cfg.Block {
+		action = "block"
+	}
+
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		host := NormalizeHost(req.URL.Hostname())
+		protected, ok := m.match(host)
+		if !ok {
+			return nil
+		}
+
+		hp.log.Infof("IDN homograph detected: host=%s, punycode=%s, protected=%s, action=%s", host, asciiHost(host), protected, action)
+		hp.metrics.homograph(action)
+		ruleTraceFromContext(req.Context()).add("homograph", protected)
+
+		if cfg.Block {
+			ruleTraceFromContext(req.Context()).add("deny", "homograph")
+			return ErrHomograph
+		}
+		return nil
+	})
+}
@@ -0,0 +1,65 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestHomographMatcherMatch(t *testing.T) {
+	m := newHomographMatcher(&HomographConfig{ProtectedDomains: []string{"apple.com", "PayPal.com"}})
+
+	tests := []struct {
+		host      string
+		protected string
+	}{
+		{host: "xn--pple-43d.com", protected: "apple.com"},
+		{host: "аpple.com", protected: "apple.com"},
+		{host: "login.раypаl.com", protected: "paypal.com"},
+		{host: "äpple.com", protected: "apple.com"},
+		{host: "apple.com"},
+		{host: "www.apple.com"},
+		{host: "bücher.apple.com"},
+		{host: "bücher.example"},
+		{host: "app1e.com"},
+	}
+
+	for _, tc := range tests {
+		p, ok := m.match(NormalizeHost(tc.host))
+		if p != tc.protected || ok != (tc.protected != "") {
+			t.Errorf("match(%q): got %q %t, want %q", tc.host, p, ok, tc.protected)
+		}
+	}
+}
+
+func TestCheckHomograph(t *testing.T) {
+	for _, block := range []bool{false, true} {
+		cfg := DefaultHTTPProxyConfig()
+		cfg.Homograph = &HomographConfig{
+			ProtectedDomains: []string{"apple.com"},
+			Block:            block,
+		}
+		hp, err := newHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "http://xn--pple-43d.com/", http.NoBody)
+		err = hp.checkHomograph().ModifyRequest(req)
+		if block && !errors.Is(err, ErrHomograph) {
+			t.Errorf("block: got error %v, want %v", err, ErrHomograph)
+		}
+		if !block && err != nil {
+			t.Errorf("warn: got error %v, want nil", err)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 	"net/url"
 	"regexp"
 	"strconv"
@@ -178,3 +179,34 @@ func ParseHostPortPair(val string) (HostPortPair, error) {
 
 	return hpp, hpp.Validate()
 }
+
+// HostOverride maps a host name to an IP address that is dialed instead of resolving the host name.
+type HostOverride struct {
+	Host string
+	Addr netip.Addr
+}
+
+func (h HostOverride) String() string {
+	return h.Host + "=" + h.Addr.String()
+}
+
+// ParseHostOverride parses HOST=IP string into HostOverride.
+func ParseHostOverride(val string) (HostOverride, error) {
+	host, ip, ok := strings.Cut(val, "=")
+	if !ok {
+		return HostOverride{}, errors.New("expected host=ip")
+	}
+	if !isDomainName(host) {
+		return HostOverride{}, fmt.Errorf("invalid host %q", host)
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return HostOverride{}, fmt.Errorf("ip: %w", err)
+	}
+
+	return HostOverride{Host: normalizeOverrideHost(host), Addr: addr.Unmap()}, nil
+}
+
+func normalizeOverrideHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
@@ -0,0 +1,67 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net/netip"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// NormalizeHost returns the canonical form of host used for matching and logging.
+// It removes IPv6 brackets and trailing dots, and lowercases the host.
+// IP addresses are converted to the canonical form, IPv4-mapped IPv6 addresses are unmapped, zones are kept.
+// Internationalized domain names, both punycode (xn--) and Unicode, are converted to Unicode,
+// so that rules written against Unicode names match punycode names too.
+// Hosts that are not valid IDNA names are only lowercased.
+func NormalizeHost(host string) string {
+	if len(host) > 1 && host[0] == '[' && host[len(host)-1] == ']' {
+		host = host[1 : len(host)-1]
+	}
+	host = strings.TrimSuffix(host, ".")
+
+	if a, err := netip.ParseAddr(host); err == nil {
+		return a.Unmap().String()
+	}
+
+	host = strings.ToLower(host)
+	if host == "" || host == "*" {
+		return host
+	}
+
+	a, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		return host
+	}
+	u, err := idna.Lookup.ToUnicode(a)
+	if err != nil {
+		return host
+	}
+	return u
+}
+
+// asciiHost returns the punycode form of a normalized host, or host if it cannot be converted.
+func asciiHost(host string) string {
+	if a, err := idna.Lookup.ToASCII(host); err == nil {
+		return a
+	}
+	return host
+}
+
+// matchHost normalizes host and matches it with m.
+// If the host is an internationalized domain name, both the Unicode and punycode forms are tried.
+func matchHost(m Matcher, host string) bool {
+	host = NormalizeHost(host)
+	if m.Match(host) {
+		return true
+	}
+	if a := asciiHost(host); a != host {
+		return m.Match(a)
+	}
+	return false
+}
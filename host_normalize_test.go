@@ -0,0 +1,61 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"Example.COM", "example.com"},
+		{"example.com.", "example.com"},
+		{"[::1]", "::1"},
+		{"[0:0:0:0:0:0:0:1]", "::1"},
+		{"::ffff:127.0.0.1", "127.0.0.1"},
+		{"fe80::1%eth0", "fe80::1%eth0"},
+		{"xn--bcher-kva.example", "bücher.example"},
+		{"XN--BCHER-KVA.example", "bücher.example"},
+		{"Bücher.example", "bücher.example"},
+		{"my_host", "my_host"},
+		{"*", "*"},
+	}
+
+	for _, tc := range tests {
+		if got := NormalizeHost(tc.host); got != tc.want {
+			t.Errorf("NormalizeHost(%q): got %q, want %q", tc.host, got, tc.want)
+		}
+	}
+}
+
+func TestMatchHost(t *testing.T) {
+	unicode := MatchFunc(regexp.MustCompile(`^bücher\.example$`).MatchString)
+	punycode := MatchFunc(regexp.MustCompile(`^xn--bcher-kva\.example$`).MatchString)
+
+	for _, host := range []string{"xn--bcher-kva.example", "bücher.example", "BÜCHER.example."} {
+		if !matchHost(unicode, host) {
+			t.Errorf("unicode rule did not match %q", host)
+		}
+		if !matchHost(punycode, host) {
+			t.Errorf("punycode rule did not match %q", host)
+		}
+	}
+}
+
+func TestIsLocalhostNormalized(t *testing.T) {
+	hp := &HTTPProxy{localhost: []string{"localhost"}}
+
+	for _, host := range []string{"LOCALHOST.", "[::1]", "::ffff:127.0.0.1", "127.1.2.3"} {
+		if !hp.isLocalhost(host) {
+			t.Errorf("isLocalhost(%q): got false, want true", host)
+		}
+	}
+}
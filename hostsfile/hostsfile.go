@@ -8,6 +8,7 @@ package hostsfile
 
 import (
 	"io"
+	"net/netip"
 	"os"
 	"sort"
 
@@ -44,3 +45,44 @@ func readLocalhostAliases(r io.Reader) ([]string, error) {
 	sort.Strings(v)
 	return v, nil
 }
+
+// Record maps a host name to an IP address.
+type Record struct {
+	Host string
+	Addr netip.Addr
+}
+
+// ReadFile returns the records of the hosts file sorted by host name,
+// addresses of the same host name are in the order of the file.
+func ReadFile(name string) ([]Record, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return readRecords(f)
+}
+
+func readRecords(r io.Reader) ([]Record, error) {
+	hf, err := hostsfile.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var v []Record
+	for _, r := range hf.Records() {
+		addr, ok := netip.AddrFromSlice(r.IpAddress.IP)
+		if !ok {
+			continue
+		}
+		for h := range r.Hostnames {
+			v = append(v, Record{Host: h, Addr: addr.Unmap()})
+		}
+	}
+
+	sort.SliceStable(v, func(i, j int) bool {
+		return v[i].Host < v[j].Host
+	})
+	return v, nil
+}
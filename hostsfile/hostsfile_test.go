@@ -7,6 +7,7 @@
 package hostsfile
 
 import (
+	"net/netip"
 	"strings"
 	"testing"
 
@@ -40,3 +41,29 @@ func TestReadLocalhostAliases(t *testing.T) {
 		t.Errorf("unexpected result (-want +got):\n%s", diff)
 	}
 }
+
+func TestReadRecords(t *testing.T) {
+	data := `
+127.0.0.1	localhost
+::1             localhost
+10.0.0.2	staging.example.com
+# comment
+10.0.0.1	api.example.com www.example.com
+`
+	v, err := readRecords(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	golden := []Record{
+		{Host: "api.example.com", Addr: netip.MustParseAddr("10.0.0.1")},
+		{Host: "localhost", Addr: netip.MustParseAddr("127.0.0.1")},
+		{Host: "localhost", Addr: netip.MustParseAddr("::1")},
+		{Host: "staging.example.com", Addr: netip.MustParseAddr("10.0.0.2")},
+		{Host: "www.example.com", Addr: netip.MustParseAddr("10.0.0.1")},
+	}
+
+	if diff := cmp.Diff(v, golden, cmp.Comparer(func(a, b netip.Addr) bool { return a == b })); diff != "" {
+		t.Errorf("unexpected result (-want +got):\n%s", diff)
+	}
+}
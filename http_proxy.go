@@ -15,8 +15,10 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -74,33 +76,95 @@ type (
 	ResponseModifierFunc    = martian.ResponseModifierFunc
 
 	ConnectFunc = martian.ConnectFunc
+
+	RequestTiming = martian.RequestTiming
 )
 
+// ContextRequestTiming returns the timing of the upstream round trip of a request,
+// it can be used in response modifiers with res.Request.Context().
+// It returns false if the request was not sent upstream.
+func ContextRequestTiming(ctx context.Context) (RequestTiming, bool) {
+	return martian.ContextRequestTiming(ctx)
+}
+
 // ErrConnectFallback is returned by a ConnectFunc to indicate
 // that the CONNECT request should be handled by martian.
 var ErrConnectFallback = martian.ErrConnectFallback
 
 type HTTPProxyConfig struct {
 	HTTPServerConfig
-	ExtraListeners    []NamedListenerConfig
-	Name              string
-	MITM              *MITMConfig
-	MITMDomains       Matcher
-	ProxyLocalhost    ProxyLocalhostMode
-	UpstreamProxy     *url.URL
-	UpstreamProxyFunc ProxyFunc
-	DenyDomains       Matcher
-	DirectDomains     Matcher
-	RequestIDHeader   string
-	RequestModifiers  []RequestModifier
-	ResponseModifiers []ResponseModifier
-	ConnectFunc       ConnectFunc
-	ConnectTimeout    time.Duration
-	PromHTTPOpts      []middleware.PrometheusOpt
+	ExtraListeners                  []NamedListenerConfig
+	TCPForwards                     []TCPForward
+	SOCKS5UDP                       *SOCKS5UDPConfig
+	Name                            string
+	MITM                            *MITMConfig
+	MITMDomains                     Matcher
+	MITMDenyDomainFronting          bool
+	MITMDomainFrontingAllow         Matcher
+	MITMCertLog                     *MITMCertLog
+	ProxyLocalhost                  ProxyLocalhostMode
+	UpstreamProxy                   *url.URL
+	UpstreamPool                    *UpstreamPoolConfig
+	UpstreamProxyFunc               ProxyFunc
+	UpstreamProxyHTTP2              bool
+	UpstreamProxyCredentialsCommand *CredentialsCommand
+	UpstreamProxyNegotiate          *Negotiate
+	UpstreamProxyBySubnet           []SubnetUpstream
+	UpstreamProxyHeader             string
+	DialClientAddr                  bool
+	PACRetryInterval                time.Duration
+	SystemProxy                     *SystemProxyConfig
+	DenyDomains                     Matcher
+	PortPolicies                    []PortPolicy
+	Homograph                       *HomographConfig
+	RateLimit                       *RateLimitConfig
+	DirectDomains                   Matcher
+	NoProxy                         []NoProxyEntry
+	RequestIDHeader                 string
+	RuleTraceHeader                 string
+	DecisionLog                     *DecisionLogConfig
+	ErrorStream                     *ErrorStream
+	SLO                             *SLOConfig
+	Webhook                         *WebhookConfig
+	BodyCapture                     *BodyCaptureConfig
+	ContentVerify                   *ContentVerifyConfig
+	Inject                          *InjectConfig
+	URLRewrite                      *URLRewriteConfig
+	ResponseDiff                    *ResponseDiffConfig
+	OAuth2                          *OAuth2Config
+	RequestSigning                  *RequestSigningConfig
+	RequestCollapsing               *RequestCollapsingConfig
+	RequestModifiers                []RequestModifier
+	ResponseModifiers               []ResponseModifier
+	ConnectFunc                     ConnectFunc
+	ConnectHeaderForward            []string
+	ConnectHeaderTemplates          []ConnectHeaderTemplate
+	ConnectResponseHeaders          []string
+	Baggage                         []BaggageMember
+	StripTrailers                   bool
+	ChunkedPassThrough              bool
+	HeaderFidelity                  bool
+	RejectPipelining                bool
+	CopyBufferSize                  int
+	MaxConcurrentRequests           int
+	DenyPlaintextCredentials        bool
+	Stealth                         bool
+	ServerTiming                    bool
+	ConnectTimeout                  time.Duration
+	SlowRequestThreshold            time.Duration
+	PromHTTPOpts                    []middleware.PrometheusOpt
 
 	// TestingHTTPHandler uses Martian's [http.Handler] implementation
 	// over [http.Server] instead of the default TCP server.
 	TestingHTTPHandler bool
+
+	// TestingClock replaces time.Now in request trace IDs and durations, decision log and error stream timestamps,
+	// and in validity of MITM certificates.
+	// Together with TestingIDGenerator it makes logs and metrics in golden file tests deterministic.
+	TestingClock func() time.Time
+
+	// TestingIDGenerator replaces generation of request trace IDs and the random suffix of the Name in the Via header.
+	TestingIDGenerator func() string
 }
 
 func DefaultHTTPProxyConfig() *HTTPProxyConfig {
@@ -111,6 +175,8 @@ func DefaultHTTPProxyConfig() *HTTPProxyConfig {
 			IdleTimeout:       1 * time.Hour,
 			ReadHeaderTimeout: 1 * time.Minute,
 			shutdownConfig:    defaultShutdownConfig(),
+			LogHTTPRedact:     httplog.DefaultRedactConfig(),
+			LogHTTPBody:       httplog.DefaultBodyConfig(),
 			TLSServerConfig: TLSServerConfig{
 				HandshakeTimeout: 10 * time.Second,
 			},
@@ -119,6 +185,8 @@ func DefaultHTTPProxyConfig() *HTTPProxyConfig {
 		ProxyLocalhost:  DenyProxyLocalhost,
 		RequestIDHeader: "X-Request-Id",
 		ConnectTimeout:  60 * time.Second, // http.Transport sets a constant 1m timeout for CONNECT requests.
+
+		PACRetryInterval: 5 * time.Minute,
 	}
 }
 
@@ -131,33 +199,151 @@ func (c *HTTPProxyConfig) Validate() error {
 			return errors.New("extra listener name is required")
 		}
 	}
-	if c.Protocol != HTTPScheme && c.Protocol != HTTPSScheme {
+	if c.SOCKS5UDP != nil {
+		if c.Protocol != SOCKS5Scheme {
+			return errors.New("socks5_udp: requires socks5 protocol")
+		}
+		if err := c.SOCKS5UDP.Validate(); err != nil {
+			return fmt.Errorf("socks5_udp: %w", err)
+		}
+	}
+	for _, f := range c.TCPForwards {
+		if err := f.Validate(); err != nil {
+			return fmt.Errorf("tcp_forward %s: %w", f, err)
+		}
+	}
+	if c.Protocol != HTTPScheme && c.Protocol != HTTPSScheme && c.Protocol != SOCKS5Scheme {
 		return fmt.Errorf("unsupported protocol: %s", c.Protocol)
 	}
 	if !c.ProxyLocalhost.isValid() {
 		return fmt.Errorf("unsupported proxy_localhost: %s", c.ProxyLocalhost)
 	}
+	if c.DialClientAddr && c.UpstreamProxyHTTP2 {
+		return errors.New("dial_client_addr: HTTP/2 upstream proxy connections are shared between clients")
+	}
 	if err := validateProxyURL(c.UpstreamProxy); err != nil {
 		return fmt.Errorf("upstream_proxy_uri: %w", err)
 	}
+	if c.UpstreamPool != nil {
+		if err := c.UpstreamPool.Validate(); err != nil {
+			return fmt.Errorf("upstream_pool: %w", err)
+		}
+	}
+	if c.MaxConcurrentRequests < 0 {
+		return errors.New("max_concurrent_requests: must not be negative")
+	}
+	if c.PACRetryInterval < 0 {
+		return errors.New("pac_retry_interval: must not be negative")
+	}
+	for _, su := range c.UpstreamProxyBySubnet {
+		if err := su.Validate(); err != nil {
+			return fmt.Errorf("upstream_proxy_by_subnet %s: %w", su.Subnet, err)
+		}
+	}
+	if c.MITM != nil {
+		if err := c.MITM.Validate(); err != nil {
+			return fmt.Errorf("mitm: %w", err)
+		}
+	}
+	if c.DecisionLog != nil {
+		if err := c.DecisionLog.Validate(); err != nil {
+			return fmt.Errorf("decision_log: %w", err)
+		}
+	}
+	if c.BodyCapture != nil {
+		if err := c.BodyCapture.Validate(); err != nil {
+			return fmt.Errorf("body_capture: %w", err)
+		}
+	}
+	if c.Inject != nil {
+		if err := c.Inject.Validate(); err != nil {
+			return fmt.Errorf("inject: %w", err)
+		}
+	}
+	if c.URLRewrite != nil {
+		if err := c.URLRewrite.Validate(); err != nil {
+			return fmt.Errorf("url_rewrite: %w", err)
+		}
+	}
+	if c.ResponseDiff != nil {
+		if err := c.ResponseDiff.Validate(); err != nil {
+			return fmt.Errorf("response_diff: %w", err)
+		}
+	}
+	if c.OAuth2 != nil {
+		if err := c.OAuth2.Validate(); err != nil {
+			return fmt.Errorf("oauth2: %w", err)
+		}
+	}
+	if c.RequestSigning != nil {
+		if err := c.RequestSigning.Validate(); err != nil {
+			return fmt.Errorf("request_signing: %w", err)
+		}
+	}
+	if c.Homograph != nil {
+		if err := c.Homograph.Validate(); err != nil {
+			return fmt.Errorf("homograph: %w", err)
+		}
+	}
+	if c.RateLimit != nil {
+		if err := c.RateLimit.Validate(); err != nil {
+			return fmt.Errorf("rate_limit: %w", err)
+		}
+	}
+	if c.Webhook != nil {
+		if err := c.Webhook.Validate(); err != nil {
+			return fmt.Errorf("webhook: %w", err)
+		}
+	}
+	if c.RequestCollapsing != nil {
+		if err := c.RequestCollapsing.Validate(); err != nil {
+			return fmt.Errorf("request_collapsing: %w", err)
+		}
+		if c.ChunkedPassThrough {
+			return errors.New("chunked_passthrough: not supported with request collapsing")
+		}
+		if c.HeaderFidelity {
+			return errors.New("header_fidelity: not supported with request collapsing")
+		}
+	}
+	if c.SLO != nil {
+		if err := c.SLO.Validate(); err != nil {
+			return fmt.Errorf("slo: %w", err)
+		}
+	}
 
 	return nil
 }
 
 type HTTPProxy struct {
-	config     HTTPProxyConfig
-	pac        PACResolver
-	creds      *CredentialsMatcher
-	transport  http.RoundTripper
-	log        log.Logger
-	metrics    *httpProxyMetrics
-	proxy      *martian.Proxy
-	mitmCACert *x509.Certificate
-	proxyFunc  ProxyFunc
-	localhost  []string
+	config         HTTPProxyConfig
+	pac            PACResolver
+	creds          *CredentialsMatcher
+	transport      http.RoundTripper
+	log            log.Logger
+	metrics        *httpProxyMetrics
+	proxy          *martian.Proxy
+	mitmCA         *mitmCA
+	mitmTicketKeys *mitmTicketKeys
+	mitmALPN       *mitmALPNTransport
+	proxyFunc      ProxyFunc
+	localhost      []string
+	decisionLog    *decisionLogger
+	errorRate      *errorRate
+	systemProxy    *systemProxy
+	bodyCapture    *bodyCapture
+	resDiff        *responseDiff
+	oauth2         *oauth2Injector
+	pool           *upstreamPool
+	pacFallback    *pacFallback
+	slowReqs       *slowRequestWatchdog
+	reqLimit       *requestLimiter
+	slo            *sloTracker
 
 	tlsConfig *tls.Config
-	listeners []net.Listener
+	// forwardTLSConfig is used by TCP forwards that terminate TLS.
+	forwardTLSConfig *tls.Config
+	listeners        []net.Listener
 }
 
 // NewHTTPProxy creates a new HTTP proxy.
@@ -173,13 +359,16 @@ func NewHTTPProxy(cfg *HTTPProxyConfig, pr PACResolver, cm *CredentialsMatcher,
 			return nil, err
 		}
 	}
+	if err := hp.configureTCPForwardTLS(); err != nil {
+		return nil, err
+	}
 
 	lh, err := hostsfile.LocalhostAliases()
 	if err != nil {
 		return nil, fmt.Errorf("read localhost aliases: %w", err)
 	}
 	for i := range lh {
-		lh[i] = strings.ToLower(lh[i])
+		lh[i] = NormalizeHost(lh[i])
 	}
 	hp.localhost = append(hp.localhost, lh...)
 
@@ -190,6 +379,10 @@ func NewHTTPProxy(cfg *HTTPProxyConfig, pr PACResolver, cm *CredentialsMatcher,
 	hp.listeners = ll
 
 	for _, l := range hp.listeners {
+		if fl, ok := l.(*tcpForwardListener); ok {
+			hp.log.Infof("TCP forward listen address=%s forward=%s", l.Addr(), fl.forward)
+			continue
+		}
 		hp.log.Infof("PROXY server listen address=%s protocol=%s", l.Addr(), hp.config.Protocol)
 	}
 
@@ -213,6 +406,12 @@ func newHTTPProxy(cfg *HTTPProxyConfig, pr PACResolver, cm *CredentialsMatcher,
 	if cfg.UpstreamProxy != nil && pr != nil {
 		return nil, errors.New("cannot use both upstream proxy and PAC")
 	}
+	if cfg.UpstreamPool != nil && (cfg.UpstreamProxy != nil || pr != nil) {
+		return nil, errors.New("cannot use upstream proxy pool with upstream proxy or PAC")
+	}
+	if cfg.SystemProxy != nil && (cfg.UpstreamProxy != nil || cfg.UpstreamPool != nil || pr != nil) {
+		return nil, errors.New("cannot use system proxy with upstream proxy or PAC")
+	}
 
 	// If not set, use http.DefaultTransport.
 	if rt == nil {
@@ -248,18 +447,63 @@ func (hp *HTTPProxy) configureHTTPS() error {
 	}
 
 	hp.tlsConfig = httpsTLSConfigTemplate()
+	if err := hp.config.ConfigureTLSConfig(hp.tlsConfig); err != nil {
+		return err
+	}
 
-	return hp.config.ConfigureTLSConfig(hp.tlsConfig)
+	// HTTP/2 connections are served by the proxy handler, which does not support MITM.
+	// Do not offer h2 when MITM is enabled, so that MITM based policies apply to all clients.
+	if hp.config.MITM == nil {
+		hp.tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	} else {
+		hp.log.Debugf("MITM enabled, HTTP/2 is not offered on the proxy listener")
+	}
+
+	return nil
+}
+
+func (hp *HTTPProxy) configureTCPForwardTLS() error {
+	if !slices.ContainsFunc(hp.config.TCPForwards, func(f TCPForward) bool { return f.ListenTLS }) {
+		return nil
+	}
+
+	if hp.tlsConfig != nil {
+		hp.forwardTLSConfig = hp.tlsConfig.Clone()
+	} else {
+		hp.forwardTLSConfig = httpsTLSConfigTemplate()
+		if err := hp.config.ConfigureTLSConfig(hp.forwardTLSConfig); err != nil {
+			return err
+		}
+	}
+	// The forwarded protocol is not known, do not negotiate HTTP.
+	hp.forwardTLSConfig.NextProtos = nil
+
+	return nil
 }
 
 func (hp *HTTPProxy) configureProxy() error {
 	hp.proxy = new(martian.Proxy)
 	hp.proxy.AllowHTTP = true
 	hp.proxy.RequestIDHeader = hp.config.RequestIDHeader
+	hp.proxy.TestingClock = hp.config.TestingClock
+	hp.proxy.TestingNewID = hp.config.TestingIDGenerator
 	hp.proxy.ConnectFunc = hp.config.ConnectFunc
 	hp.proxy.ConnectTimeout = hp.config.ConnectTimeout
+	hp.proxy.ProxyHTTP2 = hp.config.UpstreamProxyHTTP2
+	if len(hp.config.ConnectHeaderForward) > 0 || len(hp.config.ConnectHeaderTemplates) > 0 || hp.config.UpstreamProxyNegotiate != nil {
+		hp.proxy.GetProxyConnectHeader = hp.proxyConnectHeader
+	}
+	hp.proxy.ProxyConnectResponseHeaders = hp.config.ConnectResponseHeaders
+	hp.proxy.StripTrailers = hp.config.StripTrailers
+	hp.proxy.ChunkedPassThrough = hp.config.ChunkedPassThrough
+	hp.proxy.HeaderFidelity = hp.config.HeaderFidelity
+	hp.proxy.CopyBufferSize = hp.config.CopyBufferSize
+	hp.proxy.SchemeChangeFunc = hp.schemeChange
+	hp.proxy.RejectPipelining = hp.config.RejectPipelining
+	hp.proxy.PipelinedFunc = hp.pipelined
 	hp.proxy.WithoutWarning = true
 	hp.proxy.ErrorResponse = hp.errorResponse
+	hp.proxy.WebSocketCloseFunc = hp.webSocketClose
 	hp.proxy.IdleTimeout = hp.config.IdleTimeout
 	hp.proxy.TLSHandshakeTimeout = hp.config.TLSServerConfig.HandshakeTimeout
 	hp.proxy.ReadTimeout = hp.config.ReadTimeout
@@ -267,7 +511,7 @@ func (hp *HTTPProxy) configureProxy() error {
 	hp.proxy.WriteTimeout = hp.config.WriteTimeout
 
 	if hp.config.MITM != nil {
-		mc, err := newMartianMITMConfig(hp.config.MITM)
+		mc, err := newMartianMITMConfig(hp.config.MITM, hp.now)
 		if err != nil {
 			return fmt.Errorf("mitm: %w", err)
 		}
@@ -277,43 +521,180 @@ func (hp *HTTPProxy) configureProxy() error {
 			hp.log.Infof("using MITM")
 		}
 		registerMITMCacheMetrics(hp.config.PromRegistry, hp.config.PromNamespace+"_mitm_", mc.CacheMetrics)
-		hp.mitmCACert = mc.CACert()
+		registerMITMGenMetrics(hp.config.PromRegistry, hp.config.PromNamespace+"_mitm_", mc.GenMetrics)
+		if hp.config.MITMCertLog != nil {
+			hp.log.Infof("MITM certificate log enabled")
+			mc.SetIssuedCertCallback(hp.config.MITMCertLog.add)
+		}
+		hp.mitmCA = newMITMCA(hp.config.MITM, mc, hp.log, hp.now)
+		registerMITMCAMetrics(hp.config.PromRegistry, hp.config.PromNamespace, hp.mitmCA)
+		if r := hp.config.MITM.CARotateBefore; r > 0 {
+			hp.log.Infof("MITM CA rotation enabled rotate_before=%s overlap=%s", r, hp.config.MITM.CARotateOverlap)
+		}
+		if hp.config.MITM.SessionTickets {
+			hp.log.Infof("MITM session tickets enabled key_rotation=%s shared=%t",
+				hp.config.MITM.TicketKeyRotation, hp.config.MITM.TicketKeyStore != nil)
+			hp.mitmTicketKeys = newMITMTicketKeys(hp.config.MITM, mc, hp.log, hp.now)
+			if err := hp.mitmTicketKeys.rotate(context.Background()); err != nil {
+				hp.log.Errorf("MITM session ticket keys, sessions cannot be resumed until the keys are set: %s", err)
+			}
+		} else {
+			mc.SetSessionTicketsDisabled(true)
+		}
+
+		for _, r := range hp.config.MITM.ProtocolRules {
+			hp.log.Infof("MITM protocol rule=%s", r)
+		}
+		if hp.config.MITM.forwardALPN() {
+			if _, ok := hp.transport.(*http.Transport); !ok {
+				return fmt.Errorf("mitm: forwarding ALPN is not supported with transport %T", hp.transport)
+			}
+		}
 
 		hp.proxy.MITMConfig = mc
 
 		if hp.config.MITMDomains != nil {
 			hp.proxy.MITMFilter = func(req *http.Request) bool {
-				return hp.config.MITMDomains.Match(req.URL.Hostname())
+				ok := matchHost(hp.config.MITMDomains, req.URL.Hostname())
+				ruleTraceFromContext(req.Context()).add("mitm", strconv.FormatBool(ok))
+				return ok
 			}
 		}
 		hp.proxy.MITMTLSHandshakeTimeout = hp.config.TLSServerConfig.HandshakeTimeout
 	}
 
 	hp.proxy.RoundTripper = hp.transport
+	hp.proxy.WrapRoundTripper = newConnLifetimeTransport
+	if cfg := hp.config.RequestCollapsing; cfg != nil {
+		hp.log.Infof("request collapsing enabled key_headers=%s max_body_size=%s", strings.Join(cfg.KeyHeaders, ","), cfg.MaxBodySize)
+		hp.proxy.WrapRoundTripper = func(rt http.RoundTripper) http.RoundTripper {
+			return newCollapsingTransport(newConnLifetimeTransport(rt), cfg, hp.metrics.collapsed)
+		}
+	}
+	if hp.config.MITM != nil && hp.config.MITM.forwardALPN() {
+		// The transport is wrapped after it is configured by the proxy, so that the HTTP/2 transport is a copy of the configured transport.
+		wrap := hp.proxy.WrapRoundTripper
+		hp.proxy.WrapRoundTripper = func(rt http.RoundTripper) http.RoundTripper {
+			hp.mitmALPN = newMITMALPNTransport(hp.config.MITM.ProtocolRules, rt.(*http.Transport))
+			return wrap(hp.mitmALPN)
+		}
+	}
 	switch {
 	case hp.config.UpstreamProxyFunc != nil:
 		hp.log.Infof("using external proxy function")
 		hp.proxyFunc = hp.config.UpstreamProxyFunc
 	case hp.config.UpstreamProxy != nil:
-		u := hp.upstreamProxyURL()
+		u := hp.upstreamProxyURL(hp.config.UpstreamProxy)
 		hp.log.Infof("using upstream proxy: %s", u.Redacted())
 		hp.proxyFunc = http.ProxyURL(u)
+	case hp.config.UpstreamPool != nil:
+		cfg := hp.config.UpstreamPool
+		proxies := make([]*url.URL, len(cfg.Proxies))
+		for i, u := range cfg.Proxies {
+			proxies[i] = hp.upstreamProxyURL(u)
+			hp.log.Infof("using upstream proxy from pool: %s", proxies[i].Redacted())
+		}
+		hp.log.Infof("upstream proxy pool strategy=%s decay=%g error_penalty=%s hysteresis=%g probe_rate=%g",
+			cfg.Strategy, cfg.Decay, cfg.ErrorPenalty, cfg.Hysteresis, cfg.ProbeRate)
+		hp.pool = newUpstreamPool(cfg, proxies, hp.log)
+		hp.proxyFunc = hp.pool.proxyFunc
 	case hp.pac != nil:
 		hp.log.Infof("using PAC proxy")
+		if d := hp.config.PACRetryInterval; d > 0 {
+			hp.log.Infof("PAC proxy fallback enabled retry_interval=%s", d)
+			hp.pacFallback = newPACFallback(d, hp.log)
+			hp.proxy.RetryConnect = hp.pacFallback.retry
+		}
 		hp.proxyFunc = hp.pacProxy
+	case hp.config.SystemProxy != nil:
+		hp.log.Infof("using system proxy settings refresh_interval=%s", hp.config.SystemProxy.RefreshInterval)
+		hp.systemProxy = newSystemProxy(hp.config.SystemProxy, hp.log)
+		if err := hp.systemProxy.refresh(); err != nil {
+			return fmt.Errorf("system proxy: %w", err)
+		}
+		hp.proxyFunc = hp.systemProxyFunc
 	default:
 		hp.log.Infof("no upstream proxy specified")
 	}
 
+	if len(hp.config.UpstreamProxyBySubnet) > 0 {
+		hp.proxyFunc = hp.subnetUpstream(hp.proxyFunc)
+	}
+
 	if hp.config.DirectDomains != nil {
 		hp.proxyFunc = hp.directDomains(hp.proxyFunc)
 	}
 
+	if len(hp.config.NoProxy) > 0 {
+		hp.proxyFunc = hp.noProxy(hp.proxyFunc)
+	}
+
 	hp.log.Infof("localhost proxying mode=%s", hp.config.ProxyLocalhost)
 	if hp.config.ProxyLocalhost == DirectProxyLocalhost {
 		hp.proxyFunc = hp.directLocalhost(hp.proxyFunc)
 	}
+	if h := hp.config.UpstreamProxyHeader; h != "" {
+		hp.log.Infof("upstream proxy selection by request header enabled header=%s", h)
+		hp.proxyFunc = hp.upstreamHeaderProxy(hp.proxyFunc)
+	}
+	if cc := hp.config.UpstreamProxyCredentialsCommand; cc != nil && hp.proxyFunc != nil {
+		hp.log.Infof("using upstream proxy credentials from command")
+		hp.proxyFunc = cc.proxyFunc(hp.proxyFunc)
+	}
+	if hp.config.UpstreamProxyNegotiate != nil && hp.proxyFunc != nil {
+		hp.log.Infof("using Negotiate authentication for upstream proxies")
+	}
 	hp.proxy.ProxyURL = hp.proxyFunc
+	if hp.config.RuleTraceHeader != "" {
+		hp.log.Infof("rule tracing enabled header=%s", hp.config.RuleTraceHeader)
+	}
+	if hp.config.DecisionLog != nil {
+		hp.log.Infof("decision log enabled sample_rate=%g", hp.config.DecisionLog.SampleRate)
+		hp.decisionLog = newDecisionLogger(hp.config.DecisionLog, hp.log, hp.now)
+	}
+	if hp.config.Webhook != nil && hp.config.Webhook.ErrorRate != nil {
+		hp.log.Infof("webhook error rate threshold=%s", hp.config.Webhook.ErrorRate)
+		hp.errorRate = &errorRate{limit: *hp.config.Webhook.ErrorRate}
+	}
+	if hp.ruleTraceEnabled() {
+		hp.proxy.ProxyURL = ruleTraceProxyFunc(hp.proxyFunc)
+	}
+	if hp.config.BodyCapture != nil {
+		hp.log.Infof("body capture enabled dir=%s", hp.config.BodyCapture.Dir)
+		bc, err := newBodyCapture(hp.config.BodyCapture, hp.log)
+		if err != nil {
+			return fmt.Errorf("body capture: %w", err)
+		}
+		hp.bodyCapture = bc
+	}
+
+	if cfg := hp.config.ResponseDiff; cfg != nil {
+		hp.log.Infof("response diffing enabled max_body_size=%s timeout=%s", cfg.MaxBodySize, cfg.Timeout)
+		hp.resDiff = newResponseDiff(cfg, hp.log, hp.metrics)
+	}
+
+	if cfg := hp.config.OAuth2; cfg != nil {
+		for _, r := range cfg.Rules {
+			hp.log.Infof("OAuth2 token injection enabled rule=%s", RedactOAuth2Rule(r))
+		}
+		hp.oauth2 = newOAuth2Injector(cfg, hp.transport, hp.log)
+	}
+
+	if d := hp.config.SlowRequestThreshold; d > 0 {
+		hp.log.Infof("slow request watchdog enabled threshold=%s", d)
+		hp.slowReqs = newSlowRequestWatchdog(d, hp.log)
+	}
+
+	if n := hp.config.MaxConcurrentRequests; n > 0 {
+		hp.log.Infof("concurrent requests limit enabled limit=%d", n)
+		hp.reqLimit = newRequestLimiter(n, hp.log)
+	}
+
+	if cfg := hp.config.SLO; cfg != nil {
+		hp.log.Infof("SLO tracking enabled availability=%g latency=%s latency_target=%g windows=%v",
+			cfg.Availability, cfg.Latency, cfg.LatencyTarget, cfg.Windows)
+		hp.slo = newSLOTracker(cfg, hp.config.PromRegistry, hp.config.PromNamespace)
+	}
 
 	mw, trace := hp.middlewareStack()
 	hp.proxy.RequestModifier = mw
@@ -323,9 +704,9 @@ func (hp *HTTPProxy) configureProxy() error {
 	return nil
 }
 
-func (hp *HTTPProxy) upstreamProxyURL() *url.URL {
+func (hp *HTTPProxy) upstreamProxyURL(u *url.URL) *url.URL {
 	proxyURL := new(url.URL)
-	*proxyURL = *hp.config.UpstreamProxy
+	*proxyURL = *u
 
 	if proxyURL.User == nil {
 		if u := hp.creds.MatchURL(proxyURL); u != nil {
@@ -341,15 +722,27 @@ func (hp *HTTPProxy) pacProxy(r *http.Request) (*url.URL, error) {
 	if err != nil {
 		return nil, err
 	}
+	t := ruleTraceFromContext(r.Context())
+	t.add("pac", s)
 
-	p, err := pac.Proxies(s).First()
-	if err != nil {
-		return nil, err
+	var p pac.Proxy
+	if hp.pacFallback != nil {
+		proxies, err := pac.Proxies(s).All()
+		if err != nil {
+			return nil, err
+		}
+		p = hp.pacFallback.pick(r.Context(), proxies)
+	} else {
+		p, err = pac.Proxies(s).First()
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	proxyURL := p.URL()
-	if u := hp.creds.MatchURL(proxyURL); u != nil {
+	if u, mask := hp.creds.matchURL(proxyURL); u != nil {
 		proxyURL.User = u
+		t.addUserinfo("upstream-credentials", u, mask)
 	}
 
 	return proxyURL, nil
@@ -360,33 +753,160 @@ func (hp *HTTPProxy) middlewareStack() (martian.RequestResponseModifier, *martia
 
 	// Wrap stack in a group so that we can run security checks before the httpspec modifiers.
 	topg := fifo.NewGroup()
+	// Shed requests before any other processing.
+	if hp.reqLimit != nil {
+		topg.AddRequestModifier(hp.reqLimit)
+	}
+	if hp.config.DecisionLog != nil {
+		topg.AddRequestModifier(hp.ruleTraceSample())
+	}
 	if hp.config.BasicAuth != nil {
 		hp.log.Infof("basic auth enabled")
 		topg.AddRequestModifier(hp.basicAuth(hp.config.BasicAuth))
 	}
+	// Rule tracing is enabled after basic auth so that only authorized clients can use it.
+	if hp.config.RuleTraceHeader != "" {
+		topg.AddRequestModifier(hp.ruleTraceHeader())
+	}
+	// The upstream header is trusted after basic auth so that only authorized clients can use it.
+	if hp.config.UpstreamProxyHeader != "" {
+		topg.AddRequestModifier(hp.upstreamHeader())
+	}
 	if hp.config.ProxyLocalhost == DenyProxyLocalhost {
 		topg.AddRequestModifier(hp.denyLocalhost())
 	}
 	if hp.config.DenyDomains != nil {
 		topg.AddRequestModifier(hp.denyDomains(hp.config.DenyDomains))
 	}
+	if len(hp.config.PortPolicies) > 0 {
+		topg.AddRequestModifier(hp.denyPortPolicy())
+	}
+	if hp.config.Homograph != nil {
+		hp.log.Infof("IDN homograph detection enabled protected_domains=%s block=%t",
+			strings.Join(hp.config.Homograph.ProtectedDomains, ","), hp.config.Homograph.Block)
+		topg.AddRequestModifier(hp.checkHomograph())
+	}
+	if hp.config.MITM != nil && hp.config.MITMDenyDomainFronting {
+		hp.log.Infof("MITM domain fronting protection enabled")
+		topg.AddRequestModifier(hp.denyDomainFronting())
+	}
+	if hp.config.RateLimit != nil {
+		hp.log.Infof("rate limit enabled limits=%s", rateLimitsString(hp.config.RateLimit.Limits))
+		topg.AddRequestModifier(hp.rateLimit())
+	}
+	if hp.config.DialClientAddr {
+		topg.AddRequestModifier(hp.dialClientAddr())
+	}
+
+	// The pool observes the response before other modifiers read the body, so that only the upstream latency is measured.
+	if hp.pool != nil {
+		topg.AddRequestModifier(hp.pool)
+		topg.AddResponseModifier(hp.pool)
+	}
+	if hp.pacFallback != nil {
+		topg.AddRequestModifier(hp.pacFallback)
+	}
 
 	// stack contains the request/response modifiers in the order they are applied.
 	// fg is the inner stack that is executed after the core request modifiers and before the core response modifiers.
-	stack, fg := httpspec.NewStack(hp.config.Name)
+	var stack, fg *fifo.Group
+	if hp.config.TestingIDGenerator != nil {
+		stack, fg = httpspec.NewStackWithViaBoundary(hp.config.Name, hp.config.TestingIDGenerator())
+	} else {
+		stack, fg = httpspec.NewStack(hp.config.Name)
+	}
 	topg.AddRequestModifier(stack)
 	topg.AddResponseModifier(stack)
+	if hp.ruleTraceEnabled() {
+		topg.AddResponseModifier(hp.ruleTraceEnd())
+	}
+
+	// Stealth headers are removed first, so that explicitly configured headers are still added.
+	if hp.config.Stealth {
+		hp.log.Infof("stealth mode enabled, proxy headers are removed")
+		fg.AddRequestModifier(hp.stealthRequest())
+		fg.AddResponseModifier(hp.stealthResponse())
+	}
+
+	if len(hp.config.Baggage) > 0 {
+		fg.AddRequestModifier(hp.injectBaggage())
+	}
 
 	for _, m := range hp.config.RequestModifiers {
 		fg.AddRequestModifier(m)
 	}
 
+	if hp.config.URLRewrite != nil {
+		fg.AddRequestModifier(hp.urlRewriteAcceptEncoding())
+	}
+	if hp.config.Inject != nil {
+		fg.AddRequestModifier(hp.injectAcceptEncoding())
+	}
+	if hp.resDiff != nil {
+		fg.AddRequestModifier(hp.resDiff)
+	}
+
+	// Proxy-Authorization is set last, so that it is not removed by other modifiers.
+	if n := hp.config.UpstreamProxyNegotiate; n != nil && hp.proxyFunc != nil {
+		m := n.proxyAuthorization(hp.proxyFunc)
+		fg.AddRequestModifier(m)
+		if hp.proxy.RetryConnect != nil {
+			hp.proxy.RetryConnect = n.retryConnect(hp.proxy.RetryConnect, m)
+		}
+	}
+
 	for _, m := range hp.config.ResponseModifiers {
 		fg.AddResponseModifier(m)
 	}
 
+	if len(hp.config.ConnectResponseHeaders) > 0 {
+		fg.AddResponseModifier(hp.connectResponseHeaders())
+	}
+
+	if cc := hp.config.UpstreamProxyCredentialsCommand; cc != nil {
+		fg.AddResponseModifier(martian.ResponseModifierFunc(cc.refreshOnProxyAuthRequired))
+	}
+	if n := hp.config.UpstreamProxyNegotiate; n != nil {
+		fg.AddResponseModifier(martian.ResponseModifierFunc(n.renewOnProxyAuthRequired))
+	}
+
+	if hp.config.ServerTiming {
+		fg.AddResponseModifier(serverTiming())
+	}
+
+	if hp.config.ContentVerify != nil {
+		hp.log.Infof("content verification enabled headers=%t manifest_entries=%d",
+			hp.config.ContentVerify.Headers, len(hp.config.ContentVerify.Manifest))
+		fg.AddResponseModifier(hp.verifyContent())
+	}
+
+	if hp.resDiff != nil {
+		fg.AddResponseModifier(hp.resDiff)
+	}
+
+	if hp.config.URLRewrite != nil {
+		for _, hr := range hp.config.URLRewrite.Hosts {
+			hp.log.Infof("url rewrite enabled from=%s to=%s", hr.From, hr.To)
+		}
+		fg.AddResponseModifier(hp.urlRewrite())
+	}
+
+	if hp.config.Inject != nil {
+		hp.log.Infof("response injection enabled html=%t headers=%d", hp.config.Inject.HTML != "", len(hp.config.Inject.Headers))
+		fg.AddResponseModifier(hp.inject())
+	}
+
+	if hp.bodyCapture != nil {
+		fg.AddResponseModifier(hp.bodyCapture)
+	}
+
 	if hp.config.LogHTTPMode != httplog.None {
-		lf := httplog.NewLogger(hp.log.Infof, hp.config.LogHTTPMode).LogFunc()
+		hl := hp.log
+		if hp.config.LogHTTPLogger != nil {
+			hl = hp.config.LogHTTPLogger
+		}
+		lf := httplog.NewLogger(hl.Infof, hp.config.LogHTTPMode, hp.config.LogHTTPRedact, hp.config.LogHTTPBody).LogFunc()
+		lf = hp.config.LogHTTPFilter.Wrap(lf)
 		fg.AddResponseModifier(lf)
 	}
 
@@ -406,12 +926,48 @@ func (hp *HTTPProxy) middlewareStack() (martian.RequestResponseModifier, *martia
 		}
 	}
 
+	if hp.slowReqs != nil {
+		trace = hp.slowReqs.wrapTrace(trace)
+	}
+	if hp.reqLimit != nil {
+		trace = hp.reqLimit.wrapTrace(trace)
+	}
+	if hp.pool != nil {
+		trace = hp.pool.wrapTrace(trace)
+	}
+	if hp.slo != nil {
+		trace = hp.slo.wrapTrace(trace)
+	}
+
 	fg.AddRequestModifier(martian.RequestModifierFunc(hp.setBasicAuth))
 	fg.AddRequestModifier(martian.RequestModifierFunc(setEmptyUserAgent))
 
+	if hp.oauth2 != nil {
+		fg.AddRequestModifier(hp.oauth2)
+		fg.AddResponseModifier(hp.oauth2)
+	}
+
+	// Checked last to include the credentials set by the proxy.
+	if hp.config.DenyPlaintextCredentials {
+		hp.log.Infof("plaintext credentials protection enabled")
+		fg.AddRequestModifier(hp.denyPlaintextCredentials())
+	}
+
+	// Signing must be the last request modifier, so that the signed request is not modified.
+	if hp.config.RequestSigning != nil {
+		for _, r := range hp.config.RequestSigning.Rules {
+			hp.log.Infof("request signing enabled rule=%s", RedactSigningRule(r))
+		}
+		fg.AddRequestModifier(hp.signRequest())
+	}
+
 	return topg.ToImmutable(), trace
 }
 
+func (hp *HTTPProxy) ruleTraceEnabled() bool {
+	return hp.config.RuleTraceHeader != "" || hp.config.DecisionLog != nil
+}
+
 func (hp *HTTPProxy) basicAuth(u *url.Userinfo) martian.RequestModifier {
 	user := u.Username()
 	pass, _ := u.Password()
@@ -421,6 +977,7 @@ func (hp *HTTPProxy) basicAuth(u *url.Userinfo) martian.RequestModifier {
 		if !ba.AuthenticatedRequest(req, user, pass) {
 			return ErrProxyAuthentication
 		}
+		ruleTraceFromContext(req.Context()).add("principal", user)
 		return nil
 	})
 }
@@ -428,6 +985,7 @@ func (hp *HTTPProxy) basicAuth(u *url.Userinfo) martian.RequestModifier {
 func (hp *HTTPProxy) denyLocalhost() martian.RequestModifier {
 	return martian.RequestModifierFunc(func(req *http.Request) error {
 		if hp.isLocalhost(req.URL.Hostname()) {
+			ruleTraceFromContext(req.Context()).add("deny", "localhost")
 			return ErrProxyLocalhost
 		}
 		return nil
@@ -436,20 +994,74 @@ func (hp *HTTPProxy) denyLocalhost() martian.RequestModifier {
 
 func (hp *HTTPProxy) denyDomains(r Matcher) martian.RequestModifier {
 	return martian.RequestModifierFunc(func(req *http.Request) error {
-		if r.Match(req.URL.Hostname()) {
+		if matchHost(r, req.URL.Hostname()) {
+			ruleTraceFromContext(req.Context()).add("deny", "domains")
 			return ErrProxyDenied
 		}
 		return nil
 	})
 }
 
+// denyPortPolicy rejects requests not allowed by the port policies.
+// It runs for CONNECT and plain HTTP requests before the upstream connection is dialed.
+// The policies are not checked by the dialer, as it cannot tell the destination from an upstream proxy.
+func (hp *HTTPProxy) denyPortPolicy() martian.RequestModifier {
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		proto, ok := portPolicyCheck(hp.config.PortPolicies, req)
+		if ok {
+			return nil
+		}
+
+		hp.log.Infof("port policy violation: protocol=%s, host=%s, port=%s", proto, NormalizeHost(req.URL.Hostname()), req.URL.Port())
+		hp.metrics.portPolicyViolation(proto)
+		ruleTraceFromContext(req.Context()).add("deny", "port-policy")
+		return ErrPortPolicy
+	})
+}
+
+// dialClientAddr passes the client address to the dialer, so that it is sent in the PROXY protocol header,
+// see WithDialClientAddr.
+func (hp *HTTPProxy) dialClientAddr() martian.RequestModifier {
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		if ap, err := netip.ParseAddrPort(req.RemoteAddr); err == nil {
+			*req = *req.WithContext(WithDialClientAddr(req.Context(), ap))
+		}
+		return nil
+	})
+}
+
+// denyDomainFronting rejects MITMed requests with Host header pointing to a different host than the CONNECT request.
+// Otherwise, a client could CONNECT to an allowed host and send requests to a denied one over the same connection.
+func (hp *HTTPProxy) denyDomainFronting() martian.RequestModifier {
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		authority := martian.ContextConnectAuthority(req.Context())
+		if authority == "" {
+			return nil
+		}
+
+		host := NormalizeHost(req.URL.Hostname())
+		connectHost := NormalizeHost((&url.URL{Host: authority}).Hostname())
+		if host == connectHost {
+			return nil
+		}
+		if m := hp.config.MITMDomainFrontingAllow; m != nil && matchHost(m, host) {
+			return nil
+		}
+
+		hp.log.Infof("domain fronting detected: CONNECT host=%s, host=%s", connectHost, host)
+		ruleTraceFromContext(req.Context()).add("deny", "domain-fronting")
+		return ErrDomainFronting
+	})
+}
+
 func (hp *HTTPProxy) directDomains(fn ProxyFunc) ProxyFunc {
 	if fn == nil {
 		return nil
 	}
 
 	return func(req *http.Request) (*url.URL, error) {
-		if hp.config.DirectDomains.Match(req.URL.Hostname()) {
+		if matchHost(hp.config.DirectDomains, req.URL.Hostname()) {
+			ruleTraceFromContext(req.Context()).add("direct", "domains")
 			return nil, nil
 		}
 		return fn(req)
@@ -463,6 +1075,7 @@ func (hp *HTTPProxy) directLocalhost(fn ProxyFunc) ProxyFunc {
 
 	return func(req *http.Request) (*url.URL, error) {
 		if hp.isLocalhost(req.URL.Hostname()) {
+			ruleTraceFromContext(req.Context()).add("direct", "localhost")
 			return nil, nil
 		}
 		return fn(req)
@@ -470,7 +1083,7 @@ func (hp *HTTPProxy) directLocalhost(fn ProxyFunc) ProxyFunc {
 }
 
 func (hp *HTTPProxy) isLocalhost(host string) bool {
-	host = strings.ToLower(host)
+	host = NormalizeHost(host)
 
 	if slices.Contains(hp.localhost, host) {
 		return true
@@ -484,15 +1097,75 @@ func (hp *HTTPProxy) isLocalhost(host string) bool {
 
 func (hp *HTTPProxy) setBasicAuth(req *http.Request) error {
 	if req.Header.Get("Authorization") == "" {
-		if u := hp.creds.MatchURL(req.URL); u != nil {
+		if u, mask := hp.creds.matchURL(req.URL); u != nil {
 			p, _ := u.Password()
 			req.SetBasicAuth(u.Username(), p)
+			ruleTraceFromContext(req.Context()).addUserinfo("credentials", u, mask)
 		}
 	}
 
 	return nil
 }
 
+// schemeChange counts requests forwarded with a different scheme than the protocol they were received with.
+// A downgrade exposes a request a client sent over TLS, such as a MITMed request, on the network.
+func (hp *HTTPProxy) schemeChange(req *http.Request, from, to string) {
+	hp.log.Debugf("request scheme changed from=%s to=%s host=%s", from, to, req.URL.Host)
+	hp.metrics.schemeChange(from, to)
+}
+
+func (hp *HTTPProxy) pipelined(req *http.Request) {
+	action := "serialized"
+	if hp.config.RejectPipelining {
+		action = "rejected"
+	}
+	hp.log.Debugf("pipelined request action=%s host=%s", action, req.URL.Host)
+	hp.metrics.pipelined(action)
+}
+
+// denyPlaintextCredentials rejects requests with the Authorization header that would be sent upstream over plain HTTP.
+func (hp *HTTPProxy) denyPlaintextCredentials() martian.RequestModifier {
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		if req.Method == http.MethodConnect || req.URL.Scheme != "http" || req.Header.Get("Authorization") == "" {
+			return nil
+		}
+
+		hp.log.Infof("denied plaintext credentials host=%s", req.URL.Host)
+		hp.metrics.plaintextCredentialsDenied()
+		ruleTraceFromContext(req.Context()).add("deny", "plaintext-credentials")
+		return ErrPlaintextCredentials
+	})
+}
+
+func (hp *HTTPProxy) stealthRequest() martian.RequestModifier {
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		hp.stripProxyHeaders(req.Header)
+		return nil
+	})
+}
+
+func (hp *HTTPProxy) stealthResponse() martian.ResponseModifier {
+	return martian.ResponseModifierFunc(func(res *http.Response) error {
+		hp.stripProxyHeaders(res.Header)
+		return nil
+	})
+}
+
+// stripProxyHeaders removes headers that identify a message as proxied:
+// Via, Forwarded, X-Forwarded-* and the request ID header.
+func (hp *HTTPProxy) stripProxyHeaders(h http.Header) {
+	h.Del("Via")
+	h.Del("Forwarded")
+	if hp.config.RequestIDHeader != "" {
+		h.Del(hp.config.RequestIDHeader)
+	}
+	for k := range h {
+		if strings.HasPrefix(k, "X-Forwarded-") {
+			delete(h, k)
+		}
+	}
+}
+
 func setEmptyUserAgent(req *http.Request) error {
 	if _, ok := req.Header["User-Agent"]; !ok {
 		// If the outbound request doesn't have a User-Agent header set,
@@ -502,19 +1175,89 @@ func setEmptyUserAgent(req *http.Request) error {
 	return nil
 }
 
+func (hp *HTTPProxy) webSocketClose(_ context.Context, code int) {
+	hp.metrics.webSocketUpstreamClose(code)
+}
+
+func (hp *HTTPProxy) now() time.Time {
+	if hp.config.TestingClock != nil {
+		return hp.config.TestingClock()
+	}
+	return time.Now()
+}
+
 func (hp *HTTPProxy) MITMCACert() *x509.Certificate {
-	return hp.mitmCACert
+	if hp.mitmCA == nil {
+		return nil
+	}
+	return hp.mitmCA.mc.CACert()
+}
+
+// MITMCACerts returns the MITM CA certificates clients should trust, the CA used to sign certificates first.
+// During CA rotation, it includes the next or the previous CA.
+func (hp *HTTPProxy) MITMCACerts() []*x509.Certificate {
+	if hp.mitmCA == nil {
+		return nil
+	}
+	return hp.mitmCA.certs()
+}
+
+// UpstreamPool returns a handler serving the upstream proxy pool scores as JSON,
+// it returns nil if the upstream proxy pool is not configured.
+func (hp *HTTPProxy) UpstreamPool() http.Handler {
+	if hp.pool == nil {
+		return nil
+	}
+	return hp.pool
+}
+
+// SLO returns a handler serving the service level objectives burn rates as JSON,
+// it returns nil if SLO tracking is not configured.
+func (hp *HTTPProxy) SLO() http.Handler {
+	if hp.slo == nil {
+		return nil
+	}
+	return hp.slo
 }
 
 func (hp *HTTPProxy) ProxyFunc() ProxyFunc {
 	return hp.proxyFunc
 }
 
+// CloseIdleConnections closes idle upstream connections kept by the transport,
+// so that new requests open new connections, while in-flight requests and tunnels are not interrupted.
+// It is useful after an upstream proxy failover or a NAT mapping change.
+func (hp *HTTPProxy) CloseIdleConnections() {
+	tr, ok := hp.transport.(interface{ CloseIdleConnections() })
+	if !ok {
+		hp.log.Infof("transport %T does not support closing idle connections", hp.transport)
+		return
+	}
+	tr.CloseIdleConnections()
+	if hp.mitmALPN != nil {
+		hp.mitmALPN.CloseIdleConnections()
+	}
+	hp.log.Infof("closed idle upstream connections")
+}
+
 func (hp *HTTPProxy) handler() http.Handler {
 	return hp.proxy.Handler()
 }
 
 func (hp *HTTPProxy) Run(ctx context.Context) error {
+	if hp.systemProxy != nil {
+		go hp.systemProxy.run(ctx)
+	}
+	if hp.mitmCA != nil {
+		go hp.mitmCA.run(ctx)
+	}
+	if hp.mitmTicketKeys != nil {
+		go hp.mitmTicketKeys.run(ctx)
+	}
+	if hp.slowReqs != nil {
+		go hp.slowReqs.run(ctx)
+	}
+
 	if hp.config.TestingHTTPHandler {
 		hp.log.Infof("using http handler")
 		return hp.runHTTPHandler(ctx)
@@ -587,6 +1330,9 @@ func (hp *HTTPProxy) run(ctx context.Context) error {
 		if tr, ok := hp.transport.(*http.Transport); ok {
 			tr.CloseIdleConnections()
 		}
+		if hp.mitmALPN != nil {
+			hp.mitmALPN.CloseIdleConnections()
+		}
 
 		return ctxErr
 	})
@@ -605,12 +1351,42 @@ func (hp *HTTPProxy) run(ctx context.Context) error {
 
 func (hp *HTTPProxy) listen() ([]net.Listener, error) {
 	switch hp.config.Protocol {
-	case HTTPScheme, HTTPSScheme, HTTP2Scheme:
+	case HTTPScheme, HTTPSScheme, HTTP2Scheme, SOCKS5Scheme:
 	default:
 		return nil, fmt.Errorf("invalid protocol %q", hp.config.Protocol)
 	}
 
-	if len(hp.config.ExtraListeners) == 0 {
+	ll, err := hp.listenHTTP()
+	if err != nil {
+		return nil, err
+	}
+
+	// TCP forward listeners are last.
+	n := len(ll) - len(hp.config.TCPForwards)
+	if hp.config.Protocol == SOCKS5Scheme {
+		var udp *socks5UDPRelay
+		if cfg := hp.config.SOCKS5UDP; cfg != nil {
+			hp.log.Infof("SOCKS5 UDP relay enabled idle_timeout=%s max_destinations=%d", cfg.IdleTimeout, cfg.MaxDestinations)
+			udp = &socks5UDPRelay{
+				config:   *cfg,
+				allow:    hp.socks5UDPAllow(),
+				resolver: &net.Resolver{PreferGo: true},
+				metrics:  newSOCKS5UDPMetrics(hp.config.PromRegistry, hp.config.PromNamespace),
+				log:      hp.log,
+			}
+		}
+		for i := range ll[:n] {
+			ll[i] = &socks5Listener{Listener: ll[i], user: hp.config.BasicAuth, udp: udp}
+		}
+	}
+	for i, f := range hp.config.TCPForwards {
+		ll[n+i] = &tcpForwardListener{Listener: ll[n+i], forward: f, user: hp.config.BasicAuth}
+	}
+	return ll, nil
+}
+
+func (hp *HTTPProxy) listenHTTP() ([]net.Listener, error) {
+	if len(hp.config.ExtraListeners) == 0 && len(hp.config.TCPForwards) == 0 {
 		l := &Listener{
 			ListenerConfig: hp.config.ListenerConfig,
 			TLSConfig:      hp.tlsConfig,
@@ -625,9 +1401,26 @@ func (hp *HTTPProxy) listen() ([]net.Listener, error) {
 		return []net.Listener{l}, nil
 	}
 
+	lcs := append([]NamedListenerConfig{{ListenerConfig: hp.config.ListenerConfig}}, hp.config.ExtraListeners...)
+	forwards := make(map[string]TCPForward, len(hp.config.TCPForwards))
+	for _, f := range hp.config.TCPForwards {
+		lc := hp.config.ListenerConfig
+		lc.Address = f.ListenAddress
+		lc.Listener = nil
+		name := "tcp_forward_" + f.ListenAddress
+		lcs = append(lcs, NamedListenerConfig{Name: name, ListenerConfig: lc})
+		forwards[name] = f
+	}
+
 	return MultiListener{
-		ListenerConfigs: append([]NamedListenerConfig{{ListenerConfig: hp.config.ListenerConfig}}, hp.config.ExtraListeners...),
+		ListenerConfigs: lcs,
 		TLSConfig: func(lc NamedListenerConfig) *tls.Config {
+			if f, ok := forwards[lc.Name]; ok {
+				if f.ListenTLS {
+					return hp.forwardTLSConfig
+				}
+				return nil
+			}
 			return hp.tlsConfig
 		},
 		PromConfig: hp.config.PromConfig,
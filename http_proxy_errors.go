@@ -8,16 +8,20 @@ package forwarder
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"net/http"
 	"os"
 	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/saucelabs/forwarder/internal/martian"
 	"github.com/saucelabs/forwarder/internal/martian/proxyutil"
@@ -30,11 +34,30 @@ type denyError struct {
 // ErrorHeader is the header that is set on error responses with the error message.
 const ErrorHeader = "X-Forwarder-Error"
 
+// FaultHeader is the header that is set on error responses with the classified cause of the error, see Fault.
+const FaultHeader = "X-Forwarder-Fault"
+
+// Fault is a machine-readable cause of an error response.
+type Fault string
+
+const (
+	FaultDNS            Fault = "dns"
+	FaultConnectRefused Fault = "connect_refused"
+	FaultTLSVerify      Fault = "tls_verify"
+	FaultUpstreamAuth   Fault = "upstream_auth"
+	FaultTimeout        Fault = "timeout"
+)
+
 var (
 	ErrProxyAuthentication = errors.New("proxy authentication required")
 
 	ErrProxyLocalhost = denyError{errors.New("localhost proxying is disabled")}
 	ErrProxyDenied    = denyError{errors.New("proxying denied")}
+	ErrDomainFronting = denyError{errors.New("request host does not match CONNECT authority")}
+	ErrPortPolicy     = denyError{errors.New("destination port or protocol not allowed")}
+	ErrHomograph      = denyError{errors.New("domain name is confusable with a protected domain")}
+
+	ErrPlaintextCredentials = denyError{errors.New("credentials must not be sent over plain HTTP, use HTTPS")}
 )
 
 const skipMetricsLabel = "-"
@@ -47,9 +70,12 @@ func (hp *HTTPProxy) errorResponse(req *http.Request, err error) *http.Response
 		handleTLSCertificateError,
 		handleTLSECHRejectionError,
 		handleTLSAlertError,
+		handleH2GoAwayError,
 		handleMartianErrorStatus,
 		handleAuthenticationError,
 		handleDenyError,
+		handleRateLimitError,
+		handleOverloadError,
 		handleStatusText,
 	}
 
@@ -72,6 +98,19 @@ func (hp *HTTPProxy) errorResponse(req *http.Request, err error) *http.Response
 
 	if label != skipMetricsLabel {
 		hp.metrics.error(label)
+		if hp.pool != nil {
+			hp.pool.done(req, true)
+		}
+	}
+	fault := classifyFault(err)
+	if fault != "" {
+		hp.metrics.fault(fault)
+	}
+	if hp.config.ErrorStream != nil {
+		hp.publishError(req, err, code, msg, label, fault)
+	}
+	if hp.config.Webhook != nil {
+		hp.notifyError(req, err, label)
 	}
 
 	var body bytes.Buffer
@@ -86,7 +125,17 @@ func (hp *HTTPProxy) errorResponse(req *http.Request, err error) *http.Response
 	if code == http.StatusProxyAuthRequired {
 		resp.Header.Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", hp.config.Name))
 	}
+	var rlErr *rateLimitError
+	if errors.As(err, &rlErr) {
+		resp.Header.Set("Retry-After", strconv.FormatInt(int64(math.Ceil(rlErr.retryAfter.Seconds())), 10))
+	}
+	if errors.Is(err, ErrProxyOverloaded) {
+		resp.Header.Set("Retry-After", "1")
+	}
 	resp.Header.Set(ErrorHeader, hp.config.Name+" "+err.Error())
+	if fault != "" {
+		resp.Header.Set(FaultHeader, string(fault))
+	}
 	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
 	resp.ContentLength = int64(body.Len())
 	return resp
@@ -94,6 +143,35 @@ func (hp *HTTPProxy) errorResponse(req *http.Request, err error) *http.Response
 
 type errorHandler func(*http.Request, error) (int, string, string)
 
+// classifyFault returns the cause of an upstream failure, or an empty string if the error is not classified.
+// Unlike the error handlers it looks at the root cause, e.g. a DNS failure is classified as dns regardless of the operation that failed.
+func classifyFault(err error) Fault {
+	var (
+		dnsErr       *net.DNSError
+		certErr      *tls.CertificateVerificationError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+		netErr       net.Error
+	)
+
+	switch {
+	case errors.As(err, &dnsErr):
+		return FaultDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return FaultConnectRefused
+	case errors.As(err, &certErr), errors.As(err, &authorityErr), errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return FaultTLSVerify
+	case err.Error() == http.StatusText(http.StatusProxyAuthRequired):
+		// The transport reports the upstream proxy CONNECT response status as error text, see handleStatusText.
+		return FaultUpstreamAuth
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return FaultTimeout
+	default:
+		return ""
+	}
+}
+
 func handleWindowsNetError(req *http.Request, err error) (code int, msg, label string) {
 	if runtime.GOOS != "windows" {
 		return
@@ -193,6 +271,19 @@ func handleTLSAlertError(req *http.Request, err error) (code int, msg, label str
 	return
 }
 
+// The HTTP/2 transport bundled in net/http does not export the GOAWAY error types.
+// It reports "server sent GOAWAY and closed the connection" if the upstream closed the connection,
+// and "received Server's graceful shutdown GOAWAY" if the request could not be retried on a new connection.
+func handleH2GoAwayError(req *http.Request, err error) (code int, msg, label string) {
+	if s := err.Error(); strings.Contains(s, "http2:") && strings.Contains(s, "GOAWAY") {
+		code = http.StatusBadGateway
+		msg = fmt.Sprintf("upstream %q is shutting down (HTTP/2 GOAWAY), retry the request", req.Host)
+		label = "h2_goaway"
+	}
+
+	return
+}
+
 func handleMartianErrorStatus(req *http.Request, err error) (code int, msg, label string) {
 	var martianErr martian.ErrorStatus
 	if errors.As(err, &martianErr) {
@@ -225,6 +316,27 @@ func handleDenyError(req *http.Request, err error) (code int, msg, label string)
 	return
 }
 
+func handleRateLimitError(req *http.Request, err error) (code int, msg, label string) {
+	var rlErr *rateLimitError
+	if errors.As(err, &rlErr) {
+		code = http.StatusTooManyRequests
+		msg = fmt.Sprintf("too many requests, proxying is denied to host %q", req.Host)
+		label = skipMetricsLabel
+	}
+
+	return
+}
+
+func handleOverloadError(_ *http.Request, err error) (code int, msg, label string) {
+	if errors.Is(err, ErrProxyOverloaded) {
+		code = http.StatusServiceUnavailable
+		msg = "proxy overloaded, try again later"
+		label = "overloaded"
+	}
+
+	return
+}
+
 // There is a difference between sending HTTP and HTTPS requests in the presence of an upstream proxy.
 // For HTTPS client issues a CONNECT request to the proxy and then sends the original request.
 // In case the proxy responds with status code 4XX or 5XX to the CONNECT request, the client interprets it as URL error.
@@ -0,0 +1,83 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestClassifyFault(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want Fault
+	}{
+		{
+			name: "dns",
+			err:  &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "foo.invalid", IsNotFound: true}},
+			want: FaultDNS,
+		},
+		{
+			name: "dns timeout",
+			err:  &net.OpError{Op: "dial", Err: &net.DNSError{Err: "i/o timeout", Name: "foo.invalid", IsTimeout: true}},
+			want: FaultDNS,
+		},
+		{
+			name: "connect refused",
+			err:  &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+			want: FaultConnectRefused,
+		},
+		{
+			name: "tls verify",
+			err:  &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}},
+			want: FaultTLSVerify,
+		},
+		{
+			name: "tls hostname",
+			err:  &url.Error{Op: "Get", URL: "https://example.com", Err: x509.HostnameError{Host: "example.com", Certificate: &x509.Certificate{}}},
+			want: FaultTLSVerify,
+		},
+		{
+			name: "upstream auth",
+			err:  errors.New(http.StatusText(http.StatusProxyAuthRequired)),
+			want: FaultUpstreamAuth,
+		},
+		{
+			name: "timeout",
+			err:  fmt.Errorf("round trip: %w", context.DeadlineExceeded),
+			want: FaultTimeout,
+		},
+		{
+			name: "net timeout",
+			err:  &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded},
+			want: FaultTimeout,
+		},
+		{
+			name: "other",
+			err:  errors.New("unexpected EOF"),
+		},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			if got := classifyFault(tc.err); got != tc.want {
+				t.Fatalf("classifyFault(): got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -7,13 +7,27 @@
 package forwarder
 
 import (
+	"strconv"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/saucelabs/forwarder/internal/martian/mitm/mitmprom"
 )
 
 type httpProxyMetrics struct {
-	errors *prometheus.CounterVec
+	errors               *prometheus.CounterVec
+	faults               *prometheus.CounterVec
+	portPolicyViolations *prometheus.CounterVec
+	contentVerifications *prometheus.CounterVec
+	collapsedRequests    prometheus.Counter
+	connectResHeaders    *prometheus.CounterVec
+	homographs           *prometheus.CounterVec
+	rateLimitedRequests  *prometheus.CounterVec
+	wsUpstreamCloses     *prometheus.CounterVec
+	responseDiffs        *prometheus.CounterVec
+	schemeChanges        *prometheus.CounterVec
+	plaintextCredentials prometheus.Counter
+	pipelinedRequests    *prometheus.CounterVec
 }
 
 func newHTTPProxyMetrics(r prometheus.Registerer, namespace string) *httpProxyMetrics {
@@ -28,6 +42,66 @@ func newHTTPProxyMetrics(r prometheus.Registerer, namespace string) *httpProxyMe
 			Namespace: namespace,
 			Help:      "Number of proxy errors",
 		}, []string{"reason"}),
+		faults: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_faults_total",
+			Namespace: namespace,
+			Help:      "Number of error responses by classified fault, i.e. dns, connect_refused, tls_verify, upstream_auth or timeout",
+		}, []string{"fault"}),
+		portPolicyViolations: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_port_policy_violations_total",
+			Namespace: namespace,
+			Help:      "Number of requests denied by port policy",
+		}, []string{"protocol"}),
+		contentVerifications: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_content_verifications_total",
+			Namespace: namespace,
+			Help:      "Number of verified response bodies by result",
+		}, []string{"result"}),
+		collapsedRequests: f.NewCounter(prometheus.CounterOpts{
+			Name:      "proxy_collapsed_requests_total",
+			Namespace: namespace,
+			Help:      "Number of requests served with a response shared with an identical in-flight request",
+		}),
+		connectResHeaders: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_upstream_connect_response_headers_total",
+			Namespace: namespace,
+			Help:      "Number of upstream proxy CONNECT responses with the header by header name",
+		}, []string{"header"}),
+		homographs: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_homographs_total",
+			Namespace: namespace,
+			Help:      "Number of requests to domains confusable with protected domains by action",
+		}, []string{"action"}),
+		rateLimitedRequests: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_rate_limited_requests_total",
+			Namespace: namespace,
+			Help:      "Number of requests denied by rate limit by limit",
+		}, []string{"limit"}),
+		wsUpstreamCloses: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_websocket_upstream_closes_total",
+			Namespace: namespace,
+			Help:      "Number of WebSocket connections closed by upstream by close code, 1006 means closed without a close frame",
+		}, []string{"code"}),
+		responseDiffs: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_response_diffs_total",
+			Namespace: namespace,
+			Help:      "Number of responses compared with the reference upstream response by result",
+		}, []string{"result"}),
+		schemeChanges: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_scheme_changes_total",
+			Namespace: namespace,
+			Help:      "Number of requests forwarded with a different scheme than the protocol they were received with, from https to http is a downgrade",
+		}, []string{"from", "to"}),
+		plaintextCredentials: f.NewCounter(prometheus.CounterOpts{
+			Name:      "proxy_plaintext_credentials_denied_total",
+			Namespace: namespace,
+			Help:      "Number of requests denied because the Authorization header would be sent over plain HTTP",
+		}),
+		pipelinedRequests: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_pipelined_requests_total",
+			Namespace: namespace,
+			Help:      "Number of HTTP/1.1 requests received before the response to the previous request on the connection was sent by action",
+		}, []string{"action"}),
 	}
 }
 
@@ -35,9 +109,86 @@ func (m *httpProxyMetrics) error(reason string) {
 	m.errors.WithLabelValues(reason).Inc()
 }
 
+func (m *httpProxyMetrics) fault(f Fault) {
+	m.faults.WithLabelValues(string(f)).Inc()
+}
+
+func (m *httpProxyMetrics) portPolicyViolation(protocol string) {
+	m.portPolicyViolations.WithLabelValues(protocol).Inc()
+}
+
+func (m *httpProxyMetrics) contentVerification(result string) {
+	m.contentVerifications.WithLabelValues(result).Inc()
+}
+
+func (m *httpProxyMetrics) collapsed() {
+	m.collapsedRequests.Inc()
+}
+
+func (m *httpProxyMetrics) connectResponseHeader(name string) {
+	m.connectResHeaders.WithLabelValues(name).Inc()
+}
+
+func (m *httpProxyMetrics) homograph(action string) {
+	m.homographs.WithLabelValues(action).Inc()
+}
+
 func registerMITMCacheMetrics(r prometheus.Registerer, namespace string, cm mitmprom.CacheMetricsFunc) {
 	if r == nil {
 		r = prometheus.NewRegistry() // This registry will be discarded.
 	}
 	r.MustRegister(mitmprom.NewCacheMetricsCollector(namespace, cm))
 }
+
+func registerMITMGenMetrics(r prometheus.Registerer, namespace string, gm mitmprom.GenMetricsFunc) {
+	if r == nil {
+		r = prometheus.NewRegistry() // This registry will be discarded.
+	}
+	r.MustRegister(mitmprom.NewGenMetricsCollector(namespace, gm))
+}
+
+func registerMITMCAMetrics(r prometheus.Registerer, namespace string, ca *mitmCA) {
+	if r == nil {
+		r = prometheus.NewRegistry() // This registry will be discarded.
+	}
+	f := promauto.With(r)
+
+	f.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:      "mitm_ca_expiry_timestamp_seconds",
+		Namespace: namespace,
+		Help:      "Expiry time of the MITM CA certificate used to sign certificates",
+	}, func() float64 {
+		return float64(ca.mc.CACert().NotAfter.Unix())
+	})
+	f.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:      "mitm_leaf_expiry_timestamp_seconds",
+		Namespace: namespace,
+		Help:      "Expiry time of a MITM certificate generated now",
+	}, func() float64 {
+		return float64(ca.leafExpiry().Unix())
+	})
+}
+
+func (m *httpProxyMetrics) rateLimited(limit string) {
+	m.rateLimitedRequests.WithLabelValues(limit).Inc()
+}
+
+func (m *httpProxyMetrics) webSocketUpstreamClose(code int) {
+	m.wsUpstreamCloses.WithLabelValues(strconv.Itoa(code)).Inc()
+}
+
+func (m *httpProxyMetrics) responseDiff(result string) {
+	m.responseDiffs.WithLabelValues(result).Inc()
+}
+
+func (m *httpProxyMetrics) schemeChange(from, to string) {
+	m.schemeChanges.WithLabelValues(from, to).Inc()
+}
+
+func (m *httpProxyMetrics) plaintextCredentialsDenied() {
+	m.plaintextCredentials.Inc()
+}
+
+func (m *httpProxyMetrics) pipelined(action string) {
+	m.pipelinedRequests.WithLabelValues(action).Inc()
+}
@@ -0,0 +1,154 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+)
+
+// RuleTraceResponseHeader is the response header that describes the routing decisions made for a request.
+// It is only set if the request contains the header configured in HTTPProxyConfig.RuleTraceHeader.
+const RuleTraceResponseHeader = "X-Forwarder-Rule-Trace"
+
+// ruleTrace records routing decisions made for a single request in the order they were made.
+// All methods are safe to call on a nil receiver.
+type ruleTrace struct {
+	mu sync.Mutex
+	kv [][2]string
+
+	// header enables reporting the trace in response headers.
+	header bool
+	// log enables writing the trace to the decision log.
+	log bool
+}
+
+type ruleTraceKey struct{}
+
+func ruleTraceFromContext(ctx context.Context) *ruleTrace {
+	t, _ := ctx.Value(ruleTraceKey{}).(*ruleTrace)
+	return t
+}
+
+func withRuleTrace(req *http.Request) *ruleTrace {
+	if t := ruleTraceFromContext(req.Context()); t != nil {
+		return t
+	}
+
+	t := new(ruleTrace)
+	*req = *req.WithContext(context.WithValue(req.Context(), ruleTraceKey{}, t))
+	return t
+}
+
+func (t *ruleTrace) add(key, value string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	t.kv = append(t.kv, [2]string{key, value})
+	t.mu.Unlock()
+}
+
+func (t *ruleTrace) addUserinfo(key string, u *url.Userinfo, mask string) {
+	if t == nil || u == nil {
+		return
+	}
+	t.add(key, u.Username()+"@"+mask)
+}
+
+func (t *ruleTrace) each(fn func(key, value string)) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, kv := range t.kv {
+		fn(kv[0], kv[1])
+	}
+}
+
+// ruleTraceSample attaches a ruleTrace to sampled requests for the decision log.
+// It must run before any other modifier so that all decisions are recorded.
+func (hp *HTTPProxy) ruleTraceSample() martian.RequestModifier {
+	rate := hp.config.DecisionLog.SampleRate
+
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		if rate < 1 && rand.Float64() >= rate { //nolint:gosec // sampling does not need a secure random number generator
+			return nil
+		}
+		withRuleTrace(req).log = true
+		return nil
+	})
+}
+
+// ruleTraceHeader enables reporting the ruleTrace in response headers if the request contains the rule trace header.
+// The header is removed from the request so that it is not sent upstream.
+func (hp *HTTPProxy) ruleTraceHeader() martian.RequestModifier {
+	h := hp.config.RuleTraceHeader
+
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		if req.Header.Get(h) == "" {
+			return nil
+		}
+		req.Header.Del(h)
+		withRuleTrace(req).header = true
+		return nil
+	})
+}
+
+func (hp *HTTPProxy) ruleTraceEnd() martian.ResponseModifier {
+	return martian.ResponseModifierFunc(func(res *http.Response) error {
+		if res.Request == nil {
+			return nil
+		}
+
+		t := ruleTraceFromContext(res.Request.Context())
+		if t == nil {
+			return nil
+		}
+
+		if t.header {
+			t.each(func(key, value string) {
+				res.Header.Add(RuleTraceResponseHeader, key+"="+value)
+			})
+		}
+		if t.log {
+			hp.decisionLog.write(res, t)
+		}
+
+		return nil
+	})
+}
+
+// ruleTraceProxyFunc records the upstream proxy selected by fn.
+func ruleTraceProxyFunc(fn ProxyFunc) ProxyFunc {
+	if fn == nil {
+		return nil
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		u, err := fn(req)
+		if t := ruleTraceFromContext(req.Context()); t != nil {
+			switch {
+			case err != nil:
+				t.add("upstream", "error")
+			case u == nil:
+				t.add("upstream", "direct")
+			default:
+				t.add("upstream", u.Redacted())
+			}
+		}
+		return u, err
+	}
+}
@@ -7,16 +7,31 @@
 package forwarder
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
 	"io"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/saucelabs/forwarder/log/stdlog"
 	"golang.org/x/net/http2"
 )
@@ -197,5 +212,446 @@ func TestErrorResponse(t *testing.T) {
 		if !strings.Contains(string(b), "unverified certificates:") {
 			t.Fatalf("expected unverified certificates chain, body=%q", b)
 		}
+		if got := res.Header.Get(FaultHeader); got != string(FaultTLSVerify) {
+			t.Fatalf("%s: got %q, want %q", FaultHeader, got, FaultTLSVerify)
+		}
+	})
+
+	t.Run("fault connect refused", func(t *testing.T) {
+		l, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := l.Addr().String()
+		l.Close()
+
+		req, err := http.NewRequest(http.MethodGet, "http://"+addr, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		res := rw.Result()
+		if res.StatusCode != http.StatusBadGateway {
+			t.Fatalf("expected %d, got %d", http.StatusBadGateway, res.StatusCode)
+		}
+		if got := res.Header.Get(FaultHeader); got != string(FaultConnectRefused) {
+			t.Fatalf("%s: got %q, want %q", FaultHeader, got, FaultConnectRefused)
+		}
+	})
+}
+
+func TestRuleTrace(t *testing.T) {
+	cfg := DefaultHTTPProxyConfig()
+	cfg.RuleTraceHeader = "X-Rule-Trace"
+	cfg.DenyDomains = MatchFunc(func(s string) bool { return s == "denied" })
+
+	h, err := NewHTTPProxyHandler(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		trace  []string
+	}{
+		{
+			name:   "header set",
+			header: "1",
+			trace:  []string{"deny=domains"},
+		},
+		{
+			name: "header not set",
+		},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "http://denied", http.NoBody)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.header != "" {
+				req.Header.Set(cfg.RuleTraceHeader, tc.header)
+			}
+
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			res := rw.Result()
+			if res.StatusCode != http.StatusForbidden {
+				t.Fatalf("expected %d, got %d", http.StatusForbidden, res.StatusCode)
+			}
+			if got := res.Header.Values(RuleTraceResponseHeader); !slices.Equal(got, tc.trace) {
+				t.Fatalf("expected trace %v, got %v", tc.trace, got)
+			}
+		})
+	}
+}
+
+func TestDecisionLog(t *testing.T) {
+	var buf bytes.Buffer
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.DenyDomains = MatchFunc(func(s string) bool { return s == "denied" })
+	cfg.DecisionLog = DefaultDecisionLogConfig()
+	cfg.DecisionLog.Writer = &buf
+
+	h, err := NewHTTPProxyHandler(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://denied", http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	var e DecisionLogEntry
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatalf("unmarshal decision log entry %q: %v", buf.String(), err)
+	}
+	if e.Status != http.StatusForbidden {
+		t.Errorf("expected status %d, got %d", http.StatusForbidden, e.Status)
+	}
+	if e.Decisions["deny"] != "domains" {
+		t.Errorf("expected deny decision, got %v", e.Decisions)
+	}
+}
+
+func TestTestingFixture(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Got-Via", req.Header.Get("Via"))
+	}))
+	defer origin.Close()
+
+	var (
+		buf bytes.Buffer
+		seq int
+	)
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.ProxyLocalhost = AllowProxyLocalhost
+	cfg.DecisionLog = DefaultDecisionLogConfig()
+	cfg.DecisionLog.Writer = &buf
+	cfg.TestingClock = func() time.Time { return time.Unix(1_700_000_000, 0) }
+	cfg.TestingIDGenerator = func() string {
+		seq++
+		return fmt.Sprintf("id-%d", seq)
+	}
+
+	tr, err := NewClientTransport(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	for i := range 2 {
+		req, err := http.NewRequest(http.MethodGet, origin.URL, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if got, want := res.Header.Get("Got-Via"), "1.1 forwarder-id-1"; got != want {
+			t.Errorf("expected Via %q, got %q", want, got)
+		}
+
+		var e DecisionLogEntry
+		if err := json.NewDecoder(&buf).Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("id-%d", i+2); e.ID != want {
+			t.Errorf("expected trace ID %q, got %q", want, e.ID)
+		}
+		if want := cfg.TestingClock().UTC(); !e.Time.Equal(want) {
+			t.Errorf("expected time %v, got %v", want, e.Time)
+		}
+	}
+}
+
+func TestDenyPlaintextCredentials(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	cfg := DefaultHTTPProxyConfig()
+	cfg.DenyPlaintextCredentials = true
+	cfg.RuleTraceHeader = "X-Rule-Trace"
+	cfg.PromRegistry = reg
+
+	h, err := NewHTTPProxyHandler(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(cfg.RuleTraceHeader, "1")
+	req.SetBasicAuth("user", "pass")
+	req.TLS = &tls.ConnectionState{}
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	res := rw.Result()
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected %d, got %d", http.StatusForbidden, res.StatusCode)
+	}
+	if got := res.Header.Values(RuleTraceResponseHeader); !slices.Equal(got, []string{"deny=plaintext-credentials"}) {
+		t.Fatalf("unexpected trace %v", got)
+	}
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var downgrades float64
+	for _, mf := range mfs {
+		if mf.GetName() != "proxy_scheme_changes_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			downgrades += m.GetCounter().GetValue()
+		}
+	}
+	if downgrades != 1 {
+		t.Fatalf("expected 1 scheme change, got %v", downgrades)
+	}
+}
+
+func TestHTTPSProxyH2(t *testing.T) {
+	origin, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer origin.Close()
+	go func() {
+		for {
+			conn, err := origin.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn) //nolint:errcheck // echo server
+			}()
+		}
+	}()
+
+	start := func(t *testing.T, mitm bool) string {
+		t.Helper()
+
+		cfg := DefaultHTTPProxyConfig()
+		cfg.Protocol = HTTPSScheme
+		cfg.Address = "localhost:0"
+		cfg.PromRegistry = prometheus.NewRegistry()
+		cfg.ProxyLocalhost = AllowProxyLocalhost
+		if mitm {
+			cfg.MITM = DefaultMITMConfig()
+		}
+
+		p, err := NewHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		go p.Run(ctx) //nolint:errcheck // returns on cancel
+
+		addrs, _ := p.Addr()
+		return addrs[0]
+	}
+
+	dial := func(t *testing.T, addr string) *tls.Conn {
+		t.Helper()
+		conn, err := tls.Dial("tcp", addr, &tls.Config{
+			InsecureSkipVerify: true, //nolint:gosec // self-signed certificate
+			NextProtos:         []string{"h2", "http/1.1"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	t.Run("connect", func(t *testing.T) {
+		conn := dial(t, start(t, false))
+		if got := conn.ConnectionState().NegotiatedProtocol; got != "h2" {
+			t.Fatalf("NegotiatedProtocol: got %q, want h2", got)
+		}
+
+		var tr http2.Transport
+		cc, err := tr.NewClientConn(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cc.Close()
+
+		pr, pw := io.Pipe()
+		req, err := http.NewRequest(http.MethodConnect, "https://"+origin.Addr().String(), pr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.URL.Scheme = ""
+		req.URL.Path = ""
+
+		res, err := cc.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("got status %d, want %d", res.StatusCode, http.StatusOK)
+		}
+
+		go io.WriteString(pw, "hello") //nolint:errcheck // test
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(res.Body, b); err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "hello" {
+			t.Fatalf("got %q, want %q", b, "hello")
+		}
+		pw.Close()
+	})
+
+	t.Run("mitm", func(t *testing.T) {
+		conn := dial(t, start(t, true))
+		if got := conn.ConnectionState().NegotiatedProtocol; got == "h2" {
+			t.Fatal("h2 negotiated with MITM enabled")
+		}
+	})
+}
+
+// newTestClientCA returns a PEM encoded CA certificate and a client certificate signed by it.
+func newTestClientCA(t *testing.T) (caPEM []byte, client tls.Certificate) {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Client CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "machine-1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	return caPEM, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestHTTPSProxyClientAuth(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Got-Client", req.Header.Get("X-Client"))
+	}))
+	defer origin.Close()
+
+	caPEM, clientCert := newTestClientCA(t)
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.Protocol = HTTPSScheme
+	cfg.Address = "localhost:0"
+	cfg.PromRegistry = prometheus.NewRegistry()
+	cfg.ProxyLocalhost = AllowProxyLocalhost
+	cfg.ClientCAFile = "data:base64," + base64.StdEncoding.EncodeToString(caPEM)
+	cfg.ClientAuth = ClientAuthRequire
+	cfg.RequestModifiers = []RequestModifier{
+		RequestModifierFunc(func(req *http.Request) error {
+			if c := ProxyClientCertificate(req); c != nil {
+				req.Header.Set("X-Client", c.Subject.CommonName)
+			}
+			return nil
+		}),
+	}
+
+	p, err := NewHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx) //nolint:errcheck // returns on cancel
+
+	addrs, _ := p.Addr()
+	proxyURL := &url.URL{Scheme: "https", Host: addrs[0]}
+
+	get := func(certs ...tls.Certificate) (*http.Response, error) {
+		tr := &http.Transport{
+			Proxy: http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true, //nolint:gosec // self-signed certificate
+				Certificates:       certs,
+			},
+		}
+		defer tr.CloseIdleConnections()
+		req, err := http.NewRequest(http.MethodGet, origin.URL, http.NoBody)
+		if err != nil {
+			return nil, err
+		}
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		res.Body.Close()
+		return res, nil
+	}
+
+	t.Run("no certificate", func(t *testing.T) {
+		if _, err := get(); err == nil {
+			t.Fatal("got no error, want TLS handshake error")
+		}
+	})
+
+	t.Run("certificate", func(t *testing.T) {
+		res, err := get(clientCert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("got status %d, want %d", res.StatusCode, http.StatusOK)
+		}
+		if got := res.Header.Get("Got-Client"); got != "machine-1" {
+			t.Fatalf("got client %q, want %q", got, "machine-1")
+		}
 	})
 }
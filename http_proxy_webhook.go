@@ -0,0 +1,107 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/saucelabs/forwarder/webhook"
+)
+
+// WebhookConfig configures proxy events sent to webhooks.
+type WebhookConfig struct {
+	Notifier *webhook.Notifier
+
+	// ErrorRate, if set, sends webhook.ErrorRateExceeded event when the number of errors in a period reaches the limit.
+	// Denied requests are not counted as errors.
+	ErrorRate *RateLimit
+}
+
+func (c *WebhookConfig) Validate() error {
+	if c.Notifier == nil {
+		return errors.New("notifier is required")
+	}
+	return nil
+}
+
+func (hp *HTTPProxy) notifyError(req *http.Request, err error, label string) {
+	n := hp.config.Webhook.Notifier
+
+	var rlErr *rateLimitError
+	if errors.As(err, &rlErr) {
+		n.Notify(webhook.Event{
+			Type:    webhook.RateLimitExceeded,
+			Subject: rlErr.client,
+			Message: fmt.Sprintf("client %s exceeded rate limit %s", rlErr.client, rlErr.limit),
+		})
+		return
+	}
+	if label == skipMetricsLabel {
+		return
+	}
+
+	if u := hp.upstreamProxyDown(req, err); u != "" {
+		n.Notify(webhook.Event{
+			Type:    webhook.UpstreamProxyDown,
+			Subject: u,
+			Message: fmt.Sprintf("failed to connect to upstream proxy %s: %s", u, err),
+		})
+	}
+
+	if hp.errorRate != nil && hp.errorRate.incr(time.Now()) {
+		l := hp.errorRate.limit
+		n.Notify(webhook.Event{
+			Type:    webhook.ErrorRateExceeded,
+			Message: fmt.Sprintf("error rate threshold %s reached, last error: %s", l, err),
+		})
+	}
+}
+
+// upstreamProxyDown returns the upstream proxy host if err is a failure to connect to the upstream proxy used for req.
+func (hp *HTTPProxy) upstreamProxyDown(req *http.Request, err error) string {
+	// Failures to connect to HTTP proxies are reported as proxyconnect, other proxies as dial errors.
+	var netErr *net.OpError
+	if !errors.As(err, &netErr) || (netErr.Op != "proxyconnect" && netErr.Op != "dial") {
+		return ""
+	}
+	if hp.proxyFunc == nil {
+		return ""
+	}
+	u, perr := hp.proxyFunc(req)
+	if perr != nil || u == nil {
+		return ""
+	}
+	return u.Host
+}
+
+// errorRate counts errors in fixed windows aligned to the Unix epoch.
+type errorRate struct {
+	limit RateLimit
+
+	mu     sync.Mutex
+	window int64
+	n      int64
+}
+
+// incr counts an error and returns true if the limit is reached in the current window.
+func (r *errorRate) incr(t time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if w := t.UnixNano() / int64(r.limit.Period); w != r.window {
+		r.window = w
+		r.n = 0
+	}
+	r.n++
+
+	return r.n == r.limit.Requests
+}
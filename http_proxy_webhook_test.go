@@ -0,0 +1,94 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"github.com/saucelabs/forwarder/webhook"
+)
+
+func TestWebhookEvents(t *testing.T) {
+	events := make(chan webhook.Event, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e webhook.Event
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Error(err)
+		}
+		events <- e
+	}))
+	defer receiver.Close()
+
+	// Reserve a port with nothing listening on it.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadProxy := &url.URL{Scheme: "http", Host: l.Addr().String()}
+	l.Close()
+
+	wcfg := webhook.DefaultConfig()
+	wcfg.URLs = []*url.URL{{Scheme: "http", Host: receiver.Listener.Addr().String()}}
+	n := webhook.New(wcfg, stdlog.Default())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.Run(ctx)
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.UpstreamProxy = deadProxy
+	cfg.RateLimit = &RateLimitConfig{Limits: []RateLimit{{Requests: 1, Period: time.Hour}}}
+	cfg.Webhook = &WebhookConfig{
+		Notifier:  n,
+		ErrorRate: &RateLimit{Requests: 1, Period: time.Hour},
+	}
+
+	tr, err := NewClientTransport(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	for range 2 {
+		req, err := http.NewRequest(http.MethodGet, "http://example.com", http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	got := make(map[string]webhook.Event)
+	for len(got) < 3 {
+		select {
+		case e := <-events:
+			got[e.Type] = e
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for events, got %v", got)
+		}
+	}
+
+	if e := got[webhook.UpstreamProxyDown]; e.Subject != deadProxy.Host {
+		t.Errorf("expected upstream proxy down subject %s, got %q", deadProxy.Host, e.Subject)
+	}
+	if _, ok := got[webhook.ErrorRateExceeded]; !ok {
+		t.Errorf("expected %s event", webhook.ErrorRateExceeded)
+	}
+	if e := got[webhook.RateLimitExceeded]; e.Subject == "" {
+		t.Errorf("expected rate limit exceeded subject, got %+v", e)
+	}
+}
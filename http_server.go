@@ -28,6 +28,9 @@ const (
 	HTTPScheme  Scheme = "http"
 	HTTPSScheme Scheme = "https"
 	HTTP2Scheme Scheme = "h2"
+
+	// SOCKS5Scheme is supported by the proxy only, SOCKS5 CONNECT requests are served as HTTP CONNECT requests.
+	SOCKS5Scheme Scheme = "socks5"
 )
 
 func (s Scheme) String() string {
@@ -80,8 +83,14 @@ type HTTPServerConfig struct {
 	ReadHeaderTimeout time.Duration
 	WriteTimeout      time.Duration
 	shutdownConfig
-	LogHTTPMode httplog.Mode
-	BasicAuth   *url.Userinfo
+	LogHTTPMode   httplog.Mode
+	LogHTTPRedact *httplog.RedactConfig
+	LogHTTPBody   *httplog.BodyConfig
+	LogHTTPFilter httplog.Filter
+	// LogHTTPLogger, if set, receives HTTP request logs instead of the server logger.
+	LogHTTPLogger log.Logger
+	BasicAuth     *url.Userinfo
+	CORSOrigins   []string
 	PromConfig
 }
 
@@ -92,6 +101,8 @@ func DefaultHTTPServerConfig() *HTTPServerConfig {
 		IdleTimeout:       1 * time.Hour,
 		ReadHeaderTimeout: 1 * time.Minute,
 		shutdownConfig:    defaultShutdownConfig(),
+		LogHTTPRedact:     httplog.DefaultRedactConfig(),
+		LogHTTPBody:       httplog.DefaultBodyConfig(),
 	}
 }
 
@@ -159,9 +170,19 @@ func withMiddleware(cfg *HTTPServerConfig, log log.Logger, h http.Handler) http.
 		h = middleware.NewBasicAuth().Wrap(h, cfg.BasicAuth.Username(), p)
 	}
 
+	// CORS middleware must be executed before basic auth as preflight requests are not authenticated.
+	if len(cfg.CORSOrigins) > 0 {
+		h = middleware.NewCORS(cfg.CORSOrigins).Wrap(h)
+	}
+
 	// Logger middleware must immediately follow the Prometheus middleware because it uses the Prometheus delegator.
 	if cfg.LogHTTPMode != httplog.None {
-		h = httplog.NewLogger(log.Infof, cfg.LogHTTPMode).LogFunc().Wrap(h)
+		hl := log
+		if cfg.LogHTTPLogger != nil {
+			hl = cfg.LogHTTPLogger
+		}
+		lf := httplog.NewLogger(hl.Infof, cfg.LogHTTPMode, cfg.LogHTTPRedact, cfg.LogHTTPBody).LogFunc()
+		h = cfg.LogHTTPFilter.Wrap(lf).Wrap(h)
 	}
 
 	// Prometheus middleware must be the first one to be executed to collect metrics for all other middlewares.
@@ -8,8 +8,11 @@ package forwarder
 
 import (
 	"crypto/tls"
+	"fmt"
 	"net/http"
 	"time"
+
+	"github.com/saucelabs/forwarder/spiffe"
 )
 
 type HTTPTransportConfig struct {
@@ -33,12 +36,27 @@ type HTTPTransportConfig struct {
 	// Zero means no limit.
 	MaxConnsPerHost int
 
+	// ReadBufferSize and WriteBufferSize are the sizes of the buffers of each connection.
+	ReadBufferSize  int
+	WriteBufferSize int
+
 	// IdleConnTimeout is the maximum amount of time an idle
 	// (keep-alive) connection will remain idle before closing
 	// itself.
 	// Zero means no limit.
 	IdleConnTimeout time.Duration
 
+	// MaxConnAge, if non-zero, is the maximum age of a connection.
+	// A connection older than that is used for one more request and then closed,
+	// so that connections are periodically recycled.
+	// It applies to requests sent by the HTTP proxy.
+	MaxConnAge time.Duration
+
+	// MaxConnRequests, if non-zero, is the maximum number of requests sent over a connection
+	// before it is closed.
+	// It applies to requests sent by the HTTP proxy.
+	MaxConnRequests int
+
 	// ResponseHeaderTimeout, if non-zero, specifies the amount of
 	// time to wait for a server's response headers after fully
 	// writing the request (including its body, if any). This
@@ -53,6 +71,22 @@ type HTTPTransportConfig struct {
 	// waiting for the server to approve.
 	// This time does not include the time to send the request header.
 	ExpectContinueTimeout time.Duration
+
+	// ECH configures Encrypted Client Hello for direct HTTPS connections.
+	ECH ECHConfig
+
+	// ClientCertificates are presented to origins that request a client certificate in direct HTTPS connections,
+	// the first entry matching the server name is used.
+	// It allows clients that cannot hold the certificates to access mTLS protected services through the proxy.
+	ClientCertificates []ClientCertificate
+
+	// SPIFFE, if set, presents the workload X.509 SVID to origins matching SPIFFEDomains in direct HTTPS connections,
+	// and verifies the origin SVID against the SPIFFE trust bundles instead of the system roots and host name.
+	// It takes precedence over ClientCertificates.
+	SPIFFE *spiffe.Source
+
+	// SPIFFEDomains limits SPIFFE authentication to matching hosts, if nil all hosts are matched.
+	SPIFFEDomains Matcher
 }
 
 func DefaultHTTPTransportConfig() *HTTPTransportConfig {
@@ -62,18 +96,38 @@ func DefaultHTTPTransportConfig() *HTTPTransportConfig {
 		IdleConnTimeout:       90 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
 		MaxIdleConnsPerHost:   512,
+		ReadBufferSize:        32 * 1024,
+		WriteBufferSize:       32 * 1024,
 	}
 }
 
 func NewHTTPTransport(cfg *HTTPTransportConfig) (*http.Transport, error) {
+	if err := cfg.DialConfig.Validate(); err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+
 	tlsCfg := new(tls.Config)
 	if err := cfg.ConfigureTLSConfig(tlsCfg); err != nil {
 		return nil, err
 	}
+	m := newTLSClientMetrics(cfg.PromRegistry, cfg.PromNamespace)
+	tlsCfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		m.handshake(&cs)
+		return nil
+	}
+
+	clientCerts, err := loadClientCertificates(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("load client certificates: %w", err)
+	}
 
-	return &http.Transport{
+	dial := NewDialer(&cfg.DialConfig).DialContext
+	if cfg.MaxConnAge > 0 || cfg.MaxConnRequests > 0 {
+		dial = newConnLifetime(cfg).wrapDial(dial)
+	}
+	tr := &http.Transport{
 		Proxy:                 nil,
-		DialContext:           NewDialer(&cfg.DialConfig).DialContext,
+		DialContext:           dial,
 		TLSClientConfig:       tlsCfg,
 		TLSHandshakeTimeout:   cfg.TLSClientConfig.HandshakeTimeout,
 		MaxIdleConns:          cfg.MaxIdleConns,
@@ -84,7 +138,34 @@ func NewHTTPTransport(cfg *HTTPTransportConfig) (*http.Transport, error) {
 		ExpectContinueTimeout: cfg.ExpectContinueTimeout,
 
 		ForceAttemptHTTP2: true,
-		ReadBufferSize:    32 * 1024,
-		WriteBufferSize:   32 * 1024,
-	}, nil
+		ReadBufferSize:    cfg.ReadBufferSize,
+		WriteBufferSize:   cfg.WriteBufferSize,
+	}
+
+	// Connections carrying the client address in the PROXY protocol header must not be reused for other clients.
+	if cfg.ProxyProtocol.version() != 0 {
+		tr.DisableKeepAlives = true
+	}
+
+	if cfg.ECH.DoHURL != nil {
+		d := &echDialer{
+			cfg:              &cfg.ECH,
+			resolver:         newECHResolver(cfg.ECH.DoHURL, dial),
+			dial:             dial,
+			tlsConfig:        func() *tls.Config { return tr.TLSClientConfig },
+			clientCerts:      clientCerts,
+			handshakeTimeout: cfg.HandshakeTimeout,
+		}
+		tr.DialTLSContext = d.DialTLSContext
+	} else if clientCerts != nil {
+		d := &tlsDialer{
+			dial:             dial,
+			tlsConfig:        func() *tls.Config { return tr.TLSClientConfig },
+			clientCerts:      clientCerts,
+			handshakeTimeout: cfg.HandshakeTimeout,
+		}
+		tr.DialTLSContext = d.DialTLSContext
+	}
+
+	return tr, nil
 }
@@ -0,0 +1,110 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package httplog
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"github.com/saucelabs/forwarder/internal/martian/messageview"
+)
+
+// BodyConfig configures logging of bodies in the body mode.
+type BodyConfig struct {
+	// MaxBytes limits the number of logged body bytes, the rest is replaced with a truncation marker.
+	// Zero means no limit.
+	MaxBytes int64
+
+	// BinaryPreviewBytes is the number of bytes of binary bodies logged as a hex dump.
+	BinaryPreviewBytes int
+
+	// Domains, if set, limits body logging to requests to matching hosts.
+	// For other requests, only the request line and headers are logged.
+	Domains func(host string) bool
+}
+
+func DefaultBodyConfig() *BodyConfig {
+	return &BodyConfig{
+		MaxBytes:           64 * 1024,
+		BinaryPreviewBytes: 64,
+	}
+}
+
+func (c *BodyConfig) match(host string) bool {
+	return c == nil || c.Domains == nil || c.Domains(host)
+}
+
+// binarySniffLen is the number of bytes inspected to detect binary content.
+const binarySniffLen = 512
+
+// writeBody writes the decoded body, binary bodies are written as a hex preview.
+func (w *logWriter) writeBody(mv *messageview.MessageView) error {
+	b, err := readBody(mv, messageview.Decode())
+	if err != nil {
+		// Fall back to the body as sent e.g. if it is not valid gzip.
+		if b, err = readBody(mv); err != nil {
+			return err
+		}
+	}
+	if len(b) == 0 {
+		return nil
+	}
+
+	if isBinary(b) {
+		n := min(len(b), w.bodyCfg.BinaryPreviewBytes)
+		fmt.Fprintf(&w.b, "[binary body, %d bytes, hex preview of %d bytes]\n", len(b), n)
+		w.b.WriteString(hex.Dump(b[:n]))
+		return nil
+	}
+
+	if m := w.bodyCfg.MaxBytes; m > 0 && int64(len(b)) > m {
+		w.b.Write(b[:m])
+		fmt.Fprintf(&w.b, "\n[truncated, %d of %d bytes logged]\n", m, len(b))
+		return nil
+	}
+
+	w.b.Write(b)
+	return nil
+}
+
+func readBody(mv *messageview.MessageView, opts ...messageview.Option) ([]byte, error) {
+	r, err := mv.BodyReader(opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// isBinary returns true if the beginning of b is not valid UTF-8 text.
+func isBinary(b []byte) bool {
+	sample := b[:min(len(b), binarySniffLen)]
+	if bytes.IndexByte(sample, 0) >= 0 {
+		return true
+	}
+
+	for i := 0; i < len(sample); {
+		r, size := utf8.DecodeRune(sample[i:])
+		if r == utf8.RuneError && size == 1 {
+			// Ignore a rune cut at the end of the sample.
+			if len(sample) < len(b) && len(sample)-i < utf8.UTFMax {
+				break
+			}
+			return true
+		}
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' && r != '\f' {
+			return true
+		}
+		i += size
+	}
+
+	return false
+}
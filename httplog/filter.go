@@ -0,0 +1,140 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package httplog
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/saucelabs/forwarder/middleware"
+)
+
+// Predicate is a condition on a logged request, see ParsePredicate.
+type Predicate struct {
+	val  string
+	kind string
+	re   *regexp.Regexp
+	lo   int
+	hi   int
+}
+
+// ParsePredicate parses a predicate in the form [host=|path=|status=]<value>.
+//   - host=<regexp> matches the request host without port
+//   - path=<regexp> matches the request URL path
+//   - status=<code> matches the response status code, the code can be a single code e.g. 502,
+//     a class e.g. 5xx, or an inclusive range e.g. 400-499
+//   - <regexp> without a prefix matches host and path concatenated e.g. example\.com/api/
+func ParsePredicate(val string) (Predicate, error) {
+	p := Predicate{val: val}
+
+	kind, v, ok := strings.Cut(val, "=")
+	switch {
+	case ok && (kind == "host" || kind == "path"):
+		p.kind = kind
+	case ok && kind == "status":
+		p.kind = kind
+		lo, hi, err := parseStatusRange(v)
+		if err != nil {
+			return Predicate{}, err
+		}
+		p.lo, p.hi = lo, hi
+		return p, nil
+	default:
+		p.kind = ""
+		v = val
+	}
+
+	re, err := regexp.Compile(v)
+	if err != nil {
+		return Predicate{}, fmt.Errorf("invalid regexp %q: %w", v, err)
+	}
+	p.re = re
+
+	return p, nil
+}
+
+func parseStatusRange(val string) (lo, hi int, err error) {
+	if c, ok := strings.CutSuffix(strings.ToLower(val), "xx"); ok {
+		n, err := strconv.Atoi(c)
+		if err != nil || len(c) != 1 || n < 1 {
+			return 0, 0, fmt.Errorf("invalid status class %q", val)
+		}
+		return n * 100, n*100 + 99, nil
+	}
+
+	l, h, ok := strings.Cut(val, "-")
+	if !ok {
+		h = l
+	}
+	if lo, err = strconv.Atoi(l); err != nil {
+		return 0, 0, fmt.Errorf("invalid status %q", val)
+	}
+	if hi, err = strconv.Atoi(h); err != nil {
+		return 0, 0, fmt.Errorf("invalid status %q", val)
+	}
+	if lo > hi {
+		return 0, 0, fmt.Errorf("invalid status range %q", val)
+	}
+
+	return lo, hi, nil
+}
+
+func (p Predicate) String() string {
+	return p.val
+}
+
+func (p Predicate) match(e middleware.LogEntry) bool {
+	switch p.kind {
+	case "host":
+		return p.re.MatchString(entryHost(e))
+	case "path":
+		return p.re.MatchString(e.Request.URL.Path)
+	case "status":
+		return e.Status >= p.lo && e.Status <= p.hi
+	default:
+		return p.re.MatchString(entryHost(e) + e.Request.URL.Path)
+	}
+}
+
+func entryHost(e middleware.LogEntry) string {
+	h := e.Request.URL.Host
+	if h == "" {
+		h = e.Request.Host
+	}
+	if host, _, err := net.SplitHostPort(h); err == nil {
+		return host
+	}
+	return h
+}
+
+// Filter restricts logging to requests matching all predicates.
+// An empty filter matches all requests.
+type Filter []Predicate
+
+func (f Filter) Match(e middleware.LogEntry) bool {
+	for _, p := range f {
+		if !p.match(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// Wrap returns a logger that logs only entries matching the filter.
+func (f Filter) Wrap(l middleware.Logger) middleware.Logger {
+	if len(f) == 0 {
+		return l
+	}
+	return func(e middleware.LogEntry) {
+		if f.Match(e) {
+			l(e)
+		}
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/saucelabs/forwarder/internal/martian"
 	"github.com/saucelabs/forwarder/internal/martian/messageview"
@@ -69,18 +70,24 @@ func SplitNameMode(val string) (name string, mode Mode, err error) {
 var DefaultMode = Errors
 
 type Logger struct {
-	log  func(format string, args ...any)
-	mode Mode
+	log    func(format string, args ...any)
+	mode   Mode
+	redact *RedactConfig
+	body   *BodyConfig
 }
 
 // NewLogger returns a logger that logs HTTP requests and responses.
-func NewLogger(logFunc func(format string, args ...any), mode Mode) *Logger {
+// If redact is not nil, values of the configured headers are redacted in dumps.
+// If body is not nil, bodies logged in the body mode are decoded, truncated, and binary bodies are logged as a hex preview.
+func NewLogger(logFunc func(format string, args ...any), mode Mode, redact *RedactConfig, body *BodyConfig) *Logger {
 	if mode == "" {
 		mode = DefaultMode
 	}
 	return &Logger{
-		log:  logFunc,
-		mode: mode,
+		log:    logFunc,
+		mode:   mode,
+		redact: redact,
+		body:   body,
 	}
 }
 
@@ -102,14 +109,18 @@ func (l *Logger) LogFunc() middleware.Logger {
 		}
 	case Headers:
 		return func(e middleware.LogEntry) {
-			var w logWriter
+			w := logWriter{redact: l.redact}
 			w.ShortURLLine(e)
 			w.Dump(e)
 			l.log("%s", w.String())
 		}
 	case Body:
 		return func(e middleware.LogEntry) {
-			w := logWriter{body: true}
+			w := logWriter{
+				body:    l.body.match(e.Request.URL.Hostname()),
+				bodyCfg: l.body,
+				redact:  l.redact,
+			}
 			w.ShortURLLine(e)
 			w.Dump(e)
 			l.log("%s", w.String())
@@ -120,7 +131,7 @@ func (l *Logger) LogFunc() middleware.Logger {
 				return
 			}
 
-			var w logWriter
+			w := logWriter{redact: l.redact}
 			w.ShortURLLine(e)
 			w.Dump(e)
 			l.log("%s", w.String())
@@ -131,8 +142,10 @@ func (l *Logger) LogFunc() middleware.Logger {
 }
 
 type logWriter struct {
-	b    bytes.Buffer
-	body bool
+	b       bytes.Buffer
+	body    bool
+	bodyCfg *BodyConfig
+	redact  *RedactConfig
 }
 
 func (w *logWriter) String() string {
@@ -141,12 +154,14 @@ func (w *logWriter) String() string {
 
 func (w *logWriter) URLLine(e middleware.LogEntry) {
 	w.trace(e)
-	fmt.Fprintf(&w.b, "%s %s status=%v duration=%s\n",
+	fmt.Fprintf(&w.b, "%s %s status=%v duration=%s",
 		e.Request.Method,
 		e.Request.URL.Redacted(),
 		e.Status,
 		e.Duration,
 	)
+	w.timing(e)
+	w.b.WriteByte('\n')
 }
 
 func (w *logWriter) ShortURLLine(e middleware.LogEntry) {
@@ -161,12 +176,14 @@ func (w *logWriter) ShortURLLine(e middleware.LogEntry) {
 		path = "/" + path
 	}
 
-	fmt.Fprintf(&w.b, "%s %s status=%v duration=%s\n",
+	fmt.Fprintf(&w.b, "%s %s status=%v duration=%s",
 		e.Request.Method,
 		scheme+host+path,
 		e.Status,
 		e.Duration,
 	)
+	w.timing(e)
+	w.b.WriteByte('\n')
 }
 
 func (w *logWriter) trace(e middleware.LogEntry) {
@@ -175,6 +192,34 @@ func (w *logWriter) trace(e middleware.LogEntry) {
 	}
 }
 
+// timing writes the non-zero upstream round trip timings.
+func (w *logWriter) timing(e middleware.LogEntry) {
+	t, ok := martian.ContextRequestTiming(e.Request.Context())
+	if !ok {
+		return
+	}
+
+	if t.Upstream != "" {
+		fmt.Fprintf(&w.b, " upstream=%s", t.Upstream)
+	}
+	for _, d := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"dns", t.DNS},
+		{"connect", t.Connect},
+		{"tls", t.TLS},
+		{"ttfb", t.TTFB},
+	} {
+		if d.d > 0 {
+			fmt.Fprintf(&w.b, " %s=%s", d.name, d.d)
+		}
+	}
+	if t.Reused {
+		w.b.WriteString(" reused=true")
+	}
+}
+
 func (w *logWriter) Dump(e middleware.LogEntry) {
 	if err := w.dump(e); err != nil {
 		w.error(err)
@@ -188,14 +233,14 @@ func (w *logWriter) dump(e middleware.LogEntry) error {
 
 	// Dump request.
 	{
-		if err := mv.SnapshotRequest(e.Request); err != nil {
-			return err
-		}
-		r, err := mv.Reader()
+		req := *e.Request
+		req.Header = w.redact.Redact(req.Header)
+		err := mv.SnapshotRequest(&req)
+		e.Request.Body = req.Body
 		if err != nil {
 			return err
 		}
-		if _, err := io.Copy(&w.b, r); err != nil {
+		if err := w.write(mv); err != nil {
 			return err
 		}
 	}
@@ -205,14 +250,14 @@ func (w *logWriter) dump(e middleware.LogEntry) error {
 		if e.Response == nil {
 			return nil
 		}
-		if err := mv.SnapshotResponse(e.Response); err != nil {
-			return err
-		}
-		r, err := mv.Reader()
+		res := *e.Response
+		res.Header = w.redact.Redact(res.Header)
+		err := mv.SnapshotResponse(&res)
+		e.Response.Body = res.Body
 		if err != nil {
 			return err
 		}
-		if _, err := io.Copy(&w.b, r); err != nil {
+		if err := w.write(mv); err != nil {
 			return err
 		}
 	}
@@ -220,6 +265,26 @@ func (w *logWriter) dump(e middleware.LogEntry) error {
 	return nil
 }
 
+func (w *logWriter) write(mv *messageview.MessageView) error {
+	if w.bodyCfg == nil {
+		r, err := mv.Reader()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(&w.b, r)
+		return err
+	}
+
+	if _, err := io.Copy(&w.b, mv.HeaderReader()); err != nil {
+		return err
+	}
+	if err := w.writeBody(mv); err != nil {
+		return err
+	}
+	_, err := io.Copy(&w.b, mv.TrailerReader())
+	return err
+}
+
 func (w *logWriter) error(err error) {
 	fmt.Fprintf(&w.b, "\nlogger error: %s\n", err)
 }
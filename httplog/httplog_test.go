@@ -7,7 +7,15 @@
 package httplog
 
 import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+
+	"github.com/saucelabs/forwarder/middleware"
 )
 
 func TestSplitNameMode(t *testing.T) {
@@ -60,3 +68,239 @@ func TestSplitNameModeError(t *testing.T) {
 		})
 	}
 }
+
+func TestLoggerRedact(t *testing.T) {
+	tests := []struct {
+		name   string
+		redact *RedactConfig
+		want   []string
+		reject []string
+	}{
+		{
+			name:   "default",
+			redact: DefaultRedactConfig(),
+			want:   []string{"Authorization: xxxxx", "Set-Cookie: xxxxx", "X-Other: visible", "request body"},
+			reject: []string{"secret-token", "session=1"},
+		},
+		{
+			name:   "hash",
+			redact: &RedactConfig{Headers: []string{"authorization"}, Hash: true},
+			want:   []string{"Authorization: sha256:", "Set-Cookie: session=1"},
+			reject: []string{"secret-token"},
+		},
+		{
+			name: "disabled",
+			want: []string{"Authorization: Bearer secret-token"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("request body"))
+			req.Header.Set("Authorization", "Bearer secret-token")
+			req.Header.Set("X-Other", "visible")
+			res := &http.Response{
+				StatusCode: http.StatusOK,
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Header:     http.Header{"Set-Cookie": {"session=1"}},
+				Body:       http.NoBody,
+			}
+
+			var out string
+			l := NewLogger(func(format string, args ...any) { out = args[0].(string) }, Body, tc.redact, nil)
+			l.LogFunc()(middleware.LogEntry{Request: req, Response: res, Status: res.StatusCode})
+
+			for _, w := range tc.want {
+				if !strings.Contains(out, w) {
+					t.Errorf("expected log to contain %q, got:\n%s", w, out)
+				}
+			}
+			for _, r := range tc.reject {
+				if strings.Contains(out, r) {
+					t.Errorf("expected log not to contain %q, got:\n%s", r, out)
+				}
+			}
+
+			if got := req.Header.Get("Authorization"); got != "Bearer secret-token" {
+				t.Errorf("request header modified: %q", got)
+			}
+			if b, _ := io.ReadAll(req.Body); string(b) != "request body" {
+				t.Errorf("request body not preserved: %q", b)
+			}
+		})
+	}
+}
+
+func TestLoggerBody(t *testing.T) {
+	gz := func(s string) []byte {
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		w.Write([]byte(s))
+		w.Close()
+		return b.Bytes()
+	}
+
+	tests := []struct {
+		name     string
+		host     string
+		body     []byte
+		encoding string
+		want     []string
+		reject   []string
+	}{
+		{
+			name:   "truncated",
+			host:   "example.com",
+			body:   []byte(strings.Repeat("a", 20) + "tail"),
+			want:   []string{strings.Repeat("a", 16) + "\n[truncated, 16 of 24 bytes logged]"},
+			reject: []string{"tail"},
+		},
+		{
+			name: "binary",
+			host: "example.com",
+			body: []byte{0x89, 'P', 'N', 'G', 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0x00},
+			want: []string{"[binary body, 10 bytes, hex preview of 4 bytes]", "89 50 4e 47"},
+		},
+		{
+			name:     "gzip",
+			host:     "example.com",
+			body:     gz("compressed text"),
+			encoding: "gzip",
+			want:     []string{"compressed text"},
+		},
+		{
+			name:   "domain not matched",
+			host:   "other.com",
+			body:   []byte("secret body"),
+			reject: []string{"secret body"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://"+tc.host+"/", http.NoBody)
+			res := &http.Response{
+				StatusCode: http.StatusOK,
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Header:     http.Header{},
+				Body:       io.NopCloser(bytes.NewReader(tc.body)),
+			}
+			if tc.encoding != "" {
+				res.Header.Set("Content-Encoding", tc.encoding)
+			}
+
+			cfg := &BodyConfig{
+				MaxBytes:           16,
+				BinaryPreviewBytes: 4,
+				Domains:            func(host string) bool { return host == "example.com" },
+			}
+			var out string
+			l := NewLogger(func(format string, args ...any) { out = args[0].(string) }, Body, nil, cfg)
+			l.LogFunc()(middleware.LogEntry{Request: req, Response: res, Status: res.StatusCode})
+
+			for _, w := range tc.want {
+				if !strings.Contains(out, w) {
+					t.Errorf("expected log to contain %q, got:\n%s", w, out)
+				}
+			}
+			for _, r := range tc.reject {
+				if strings.Contains(out, r) {
+					t.Errorf("expected log not to contain %q, got:\n%s", r, out)
+				}
+			}
+		})
+	}
+}
+
+func TestFilter(t *testing.T) {
+	entry := func(url string, status int) middleware.LogEntry {
+		return middleware.LogEntry{
+			Request: httptest.NewRequest(http.MethodGet, url, http.NoBody),
+			Status:  status,
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter []string
+		entry  middleware.LogEntry
+		match  bool
+	}{
+		{
+			name:  "empty",
+			entry: entry("http://example.com/", 200),
+			match: true,
+		},
+		{
+			name:   "host",
+			filter: []string{`host=^api\.example\.com$`},
+			entry:  entry("http://api.example.com:8080/v1", 200),
+			match:  true,
+		},
+		{
+			name:   "host no match",
+			filter: []string{`host=^api\.example\.com$`},
+			entry:  entry("http://www.example.com/v1", 200),
+			match:  false,
+		},
+		{
+			name:   "path",
+			filter: []string{"path=^/v1/"},
+			entry:  entry("http://example.com/v1/users", 200),
+			match:  true,
+		},
+		{
+			name:   "status class",
+			filter: []string{"status=5xx"},
+			entry:  entry("http://example.com/", 502),
+			match:  true,
+		},
+		{
+			name:   "status range",
+			filter: []string{"status=400-499"},
+			entry:  entry("http://example.com/", 502),
+			match:  false,
+		},
+		{
+			name:   "host and path",
+			filter: []string{`example\.com/api/`},
+			entry:  entry("http://example.com/api/users", 200),
+			match:  true,
+		},
+		{
+			name:   "all predicates",
+			filter: []string{"host=example", "status=502"},
+			entry:  entry("http://example.com/", 200),
+			match:  false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var f Filter
+			for _, v := range tc.filter {
+				p, err := ParsePredicate(v)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f = append(f, p)
+			}
+
+			logged := false
+			f.Wrap(func(e middleware.LogEntry) { logged = true })(tc.entry)
+			if logged != tc.match {
+				t.Fatalf("expected match=%v, got %v", tc.match, logged)
+			}
+		})
+	}
+}
+
+func TestParsePredicateError(t *testing.T) {
+	for _, v := range []string{"status=abc", "status=0xx", "status=500-400", "path=("} {
+		if _, err := ParsePredicate(v); err == nil {
+			t.Errorf("expected error for %q", v)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package httplog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+// DefaultRedactHeaders are headers that commonly carry credentials.
+var DefaultRedactHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Api-Key",
+}
+
+// redactedValue replaces values of redacted headers.
+const redactedValue = "xxxxx"
+
+// RedactConfig configures redaction of header values in logged requests and responses.
+type RedactConfig struct {
+	// Headers are names of headers with redacted values.
+	Headers []string
+
+	// Hash replaces values with a truncated SHA-256 hash instead of a placeholder,
+	// so that requests with the same value can be correlated.
+	// Note that low entropy values can be recovered from the hash.
+	Hash bool
+}
+
+func DefaultRedactConfig() *RedactConfig {
+	return &RedactConfig{
+		Headers: DefaultRedactHeaders,
+	}
+}
+
+// Redact returns a copy of h with redacted values, or h if there is nothing to redact.
+func (c *RedactConfig) Redact(h http.Header) http.Header {
+	if c == nil || len(h) == 0 {
+		return h
+	}
+
+	var out http.Header
+	for _, name := range c.Headers {
+		k := http.CanonicalHeaderKey(name)
+		vv, ok := h[k]
+		if !ok {
+			continue
+		}
+		if out == nil {
+			out = h.Clone()
+		}
+		rv := make([]string, len(vv))
+		for i, v := range vv {
+			rv[i] = c.redactValue(v)
+		}
+		out[k] = rv
+	}
+	if out == nil {
+		return h
+	}
+
+	return out
+}
+
+func (c *RedactConfig) redactValue(v string) string {
+	if !c.Hash {
+		return redactedValue
+	}
+	sum := sha256.Sum256([]byte(v))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,131 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// InjectConfig configures injection of a snippet into HTML responses,
+// such as a script tag loading test instrumentation or telemetry.
+// Only responses visible to the proxy are modified, i.e. plain HTTP and MITMed HTTPS responses.
+type InjectConfig struct {
+	// HTML is inserted before the closing </head> tag,
+	// if there is no head it is inserted after the opening <body> tag, or at the beginning of the document.
+	HTML string
+
+	// Headers are added to the modified responses.
+	Headers http.Header
+
+	// Domains limits injection to responses for matching hosts, if nil all hosts are modified.
+	Domains Matcher
+
+	// MaxBodySize is the maximum size of a response body that is modified, larger responses are passed through.
+	MaxBodySize SizeSuffix
+}
+
+func DefaultInjectConfig() *InjectConfig {
+	return &InjectConfig{
+		MaxBodySize: 5 * Mebi,
+	}
+}
+
+func (c *InjectConfig) Validate() error {
+	if c.HTML == "" && len(c.Headers) == 0 {
+		return errors.New("HTML or headers are required")
+	}
+	if c.MaxBodySize <= 0 {
+		return errors.New("max body size must be positive")
+	}
+	return nil
+}
+
+func (c *InjectConfig) matchHost(req *http.Request) bool {
+	return c.Domains == nil || matchHost(c.Domains, req.URL.Hostname())
+}
+
+// injectAcceptEncoding limits Accept-Encoding of page requests to gzip,
+// so that the response can be decoded for injection.
+func (hp *HTTPProxy) injectAcceptEncoding() RequestModifier {
+	cfg := hp.config.Inject
+
+	return RequestModifierFunc(func(req *http.Request) error {
+		if cfg.HTML == "" || req.Method == http.MethodConnect || !cfg.matchHost(req) {
+			return nil
+		}
+		if !strings.Contains(req.Header.Get("Accept"), "text/html") {
+			return nil
+		}
+		limitAcceptEncoding(req)
+		return nil
+	})
+}
+
+func (hp *HTTPProxy) inject() ResponseModifier {
+	cfg := hp.config.Inject
+
+	return ResponseModifierFunc(func(res *http.Response) error {
+		req := res.Request
+		if req.Method == http.MethodConnect || req.Method == http.MethodHead || !cfg.matchHost(req) {
+			return nil
+		}
+		if res.Body == nil || res.Body == http.NoBody {
+			return nil
+		}
+		if mt, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type")); mt != "text/html" {
+			return nil
+		}
+		body, ok, err := readBodyForRewrite(res, int64(cfg.MaxBodySize))
+		if err != nil {
+			return fmt.Errorf("inject: %w", err)
+		}
+		if !ok {
+			hp.log.Debugf("inject skipped url=%s: unsupported encoding or body larger than %s", req.URL.Redacted(), cfg.MaxBodySize)
+			return nil
+		}
+
+		if cfg.HTML != "" {
+			body = injectHTML(body, cfg.HTML)
+		}
+		for k, v := range cfg.Headers {
+			res.Header[k] = append(res.Header[k], v...)
+		}
+
+		setRewrittenBody(res, body)
+
+		return nil
+	})
+}
+
+// injectHTML inserts snippet before </head>, after <body ...>, or at the beginning of the document.
+// Tags are matched case-insensitively.
+func injectHTML(doc []byte, snippet string) []byte {
+	lower := bytes.ToLower(doc)
+
+	at := bytes.Index(lower, []byte("</head>"))
+	if at < 0 {
+		if i := bytes.Index(lower, []byte("<body")); i >= 0 {
+			if j := bytes.IndexByte(lower[i:], '>'); j >= 0 {
+				at = i + j + 1
+			}
+		}
+	}
+	if at < 0 {
+		at = 0
+	}
+
+	out := make([]byte, 0, len(doc)+len(snippet))
+	out = append(out, doc[:at]...)
+	out = append(out, snippet...)
+	out = append(out, doc[at:]...)
+	return out
+}
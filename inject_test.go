@@ -0,0 +1,156 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestInjectHTML(t *testing.T) {
+	const snippet = "<script src=x.js></script>"
+
+	tests := []struct {
+		name string
+		doc  string
+		want string
+	}{
+		{
+			name: "head",
+			doc:  "<html><HEAD><title>t</title></HEAD><body></body></html>",
+			want: "<html><HEAD><title>t</title>" + snippet + "</HEAD><body></body></html>",
+		},
+		{
+			name: "body",
+			doc:  `<html><body class="x">hello</body></html>`,
+			want: `<html><body class="x">` + snippet + "hello</body></html>",
+		},
+		{
+			name: "fragment",
+			doc:  "hello",
+			want: snippet + "hello",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := string(injectHTML([]byte(tc.doc), snippet)); got != tc.want {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestInject(t *testing.T) {
+	const (
+		page    = "<html><head></head><body>hello</body></html>"
+		snippet = "<script></script>"
+		want    = "<html><head>" + snippet + "</head><body>hello</body></html>"
+	)
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(page))
+	zw.Close()
+
+	tests := []struct {
+		name        string
+		contentType string
+		encoding    string
+		body        []byte
+		maxBodySize SizeSuffix
+		want        string
+	}{
+		{name: "identity", contentType: "text/html; charset=utf-8", body: []byte(page), want: want},
+		{name: "gzip", contentType: "text/html", encoding: "gzip", body: gz.Bytes(), want: want},
+		{name: "not html", contentType: "application/json", body: []byte(page), want: page},
+		{name: "unsupported encoding", contentType: "text/html", encoding: "br", body: []byte(page), want: page},
+		{name: "too large", contentType: "text/html", body: []byte(page), maxBodySize: 10, want: page},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultHTTPProxyConfig()
+			cfg.Inject = DefaultInjectConfig()
+			cfg.Inject.HTML = snippet
+			cfg.Inject.Headers = http.Header{"X-Injected": {"1"}}
+			if tc.maxBodySize > 0 {
+				cfg.Inject.MaxBodySize = tc.maxBodySize
+			}
+			hp, err := newHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res := &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": {tc.contentType}, "Etag": {`"abc"`}},
+				Body:       io.NopCloser(bytes.NewReader(tc.body)),
+				Request:    httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody),
+			}
+			if tc.encoding != "" {
+				res.Header.Set("Content-Encoding", tc.encoding)
+			}
+			if err := hp.inject().ModifyResponse(res); err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.want != want {
+				if !bytes.Equal(b, tc.body) {
+					t.Fatalf("body modified: %q", b)
+				}
+				if res.Header.Get("X-Injected") != "" {
+					t.Fatal("unexpected header")
+				}
+				return
+			}
+
+			if string(b) != want {
+				t.Fatalf("got %q, want %q", b, want)
+			}
+			if res.ContentLength != int64(len(want)) {
+				t.Fatalf("got content length %d, want %d", res.ContentLength, len(want))
+			}
+			if res.Header.Get("Content-Encoding") != "" || res.Header.Get("Etag") != "" {
+				t.Fatalf("unexpected headers: %v", res.Header)
+			}
+			if res.Header.Get("X-Injected") != "1" {
+				t.Fatal("missing injected header")
+			}
+		})
+	}
+}
+
+func TestInjectAcceptEncoding(t *testing.T) {
+	cfg := DefaultHTTPProxyConfig()
+	cfg.Inject = DefaultInjectConfig()
+	cfg.Inject.HTML = "<script></script>"
+	hp, err := newHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+	req.Header.Set("Accept", "text/html,*/*")
+	req.Header.Set("Accept-Encoding", "gzip, deflate, br, zstd")
+	if err := hp.injectAcceptEncoding().ModifyRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Header.Get("Accept-Encoding"); got != "gzip" {
+		t.Fatalf("got Accept-Encoding %q, want gzip", got)
+	}
+}
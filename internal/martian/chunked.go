@@ -0,0 +1,162 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+func isChunkedPassThrough(res *http.Response) bool {
+	b, ok := res.Body.(*passThroughBody)
+	return ok && b.raw && !b.read
+}
+
+var errMalformedChunk = errors.New("malformed chunked encoding")
+
+// writeChunkedPassThroughResponse writes the response header and copies the chunked body
+// with the origin's chunk sizes, chunk extensions and trailers.
+// If raw is not nil, the header is written with HeaderFidelity.
+// The writer is flushed after each chunk.
+func writeChunkedPassThroughResponse(w *bufio.Writer, res *http.Response, raw *rawHeader, stripTrailers bool) error {
+	var hw io.Writer = w
+	if raw != nil {
+		hw = &headerFidelityWriter{w: w, raw: raw}
+	}
+
+	text := strings.TrimPrefix(res.Status, strconv.Itoa(res.StatusCode)+" ")
+	if _, err := fmt.Fprintf(hw, "HTTP/%d.%d %03d %s\r\n", res.ProtoMajor, res.ProtoMinor, res.StatusCode, text); err != nil {
+		return err
+	}
+
+	h := res.Header.Clone()
+	h.Del("Content-Length")
+	h.Del("Transfer-Encoding")
+	h.Del("Trailer")
+	h.Set("Transfer-Encoding", "chunked")
+	if len(res.Trailer) > 0 && !stripTrailers {
+		keys := make([]string, 0, len(res.Trailer))
+		for k := range res.Trailer {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		h.Set("Trailer", strings.Join(keys, ", "))
+	}
+	if err := h.Write(hw); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(hw, "\r\n"); err != nil {
+		return err
+	}
+
+	b := res.Body.(*passThroughBody) //nolint:forcetypeassert // checked by isChunkedPassThrough
+	defer b.Close()
+
+	return copyChunked(w, b.br, stripTrailers)
+}
+
+// copyChunked copies a chunked body from r to w without re-chunking it.
+func copyChunked(w *bufio.Writer, r *bufio.Reader, stripTrailers bool) error {
+	for {
+		line, err := readChunkLine(r)
+		if err != nil {
+			return err
+		}
+		n, err := parseChunkSize(line)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		if _, err := io.CopyN(w, r, n); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		crlf, err := readChunkLine(r)
+		if err != nil {
+			return err
+		}
+		if !isEmptyLine(crlf) {
+			return errMalformedChunk
+		}
+		if _, err := w.Write(crlf); err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	// Trailers and the final empty line.
+	for {
+		line, err := readChunkLine(r)
+		if err != nil {
+			return err
+		}
+		end := isEmptyLine(line)
+		if end || !stripTrailers {
+			if _, err := w.Write(line); err != nil {
+				return err
+			}
+		}
+		if end {
+			return nil
+		}
+	}
+}
+
+// readChunkLine returns the line including the line terminator,
+// the line is valid until the next read.
+func readChunkLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	switch {
+	case errors.Is(err, io.EOF):
+		return nil, io.ErrUnexpectedEOF
+	case errors.Is(err, bufio.ErrBufferFull):
+		return nil, errors.New("chunk line too long")
+	}
+	return line, err
+}
+
+func isEmptyLine(line []byte) bool {
+	return len(bytes.TrimRight(line, "\r\n")) == 0
+}
+
+// parseChunkSize parses the chunk size line ignoring chunk extensions.
+func parseChunkSize(line []byte) (int64, error) {
+	s := string(bytes.TrimRight(line, "\r\n"))
+	s, _, _ = strings.Cut(s, ";")
+	s = strings.TrimRight(s, " \t")
+	n, err := strconv.ParseUint(s, 16, 63)
+	if err != nil {
+		return 0, errMalformedChunk
+	}
+	return int64(n), nil
+}
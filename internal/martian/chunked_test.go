@@ -0,0 +1,186 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestIntegrationChunkedPassThrough(t *testing.T) {
+	t.Parallel()
+
+	if *withHandler {
+		t.Skip("chunked pass-through is not supported by the handler")
+	}
+
+	const body = "5;name=value\r\nhello\r\n" +
+		"1\r\n \r\n" +
+		"005;ext\r\nworld\r\n" +
+		"0\r\n" +
+		"Res-Trailer: res\r\n\r\n"
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					t.Errorf("http.ReadRequest(): got %v, want no error", err)
+					return
+				}
+				req.Body.Close()
+				fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\n"+
+					"Trailer: Res-Trailer\r\n"+
+					"Transfer-Encoding: chunked\r\n\r\n"+
+					"%s", body)
+			}()
+		}
+	}()
+
+	tests := []struct {
+		name        string
+		passThrough bool
+		readBody    bool
+		wantRaw     bool
+	}{
+		{
+			name:        "pass through",
+			passThrough: true,
+			wantRaw:     true,
+		},
+		{
+			name: "re-chunk",
+		},
+		{
+			name:        "body read by modifier",
+			passThrough: true,
+			readBody:    true,
+		},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			h := testHelper{
+				Proxy: func(p *Proxy) {
+					p.AllowHTTP = true
+					p.ChunkedPassThrough = tc.passThrough
+					if tc.readBody {
+						p.ResponseModifier = ResponseModifierFunc(func(res *http.Response) error {
+							b, err := io.ReadAll(res.Body)
+							if err != nil {
+								return err
+							}
+							res.Body.Close()
+							res.Body = io.NopCloser(bytes.NewReader(b))
+							return nil
+						})
+					}
+				},
+			}
+
+			conn, cancel := h.proxyConn(t)
+			defer cancel()
+			defer conn.Close()
+
+			host := l.Addr().String()
+			if _, err := fmt.Fprintf(conn, "GET http://%s/ HTTP/1.1\r\nHost: %s\r\n\r\n", host, host); err != nil {
+				t.Fatalf("conn.Write(): got %v, want no error", err)
+			}
+
+			br := bufio.NewReader(conn)
+			tp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+			}
+			if got := tp.Trailer; len(got) != 1 {
+				t.Errorf("declared trailers: got %v, want Res-Trailer", got)
+			}
+
+			if tc.wantRaw {
+				// The body is not read by ReadResponse, read the raw framing from the connection.
+				got := make([]byte, len(body))
+				if _, err := io.ReadFull(br, got); err != nil {
+					t.Fatalf("io.ReadFull(): got %v, want no error", err)
+				}
+				if string(got) != body {
+					t.Errorf("body: got %q, want %q", got, body)
+				}
+				return
+			}
+
+			b, err := io.ReadAll(tp.Body)
+			if err != nil {
+				t.Fatalf("io.ReadAll(): got %v, want no error", err)
+			}
+			if got, want := string(b), "hello world"; got != want {
+				t.Errorf("body: got %q, want %q", got, want)
+			}
+			if got, want := tp.Trailer.Get("Res-Trailer"), "res"; got != want {
+				t.Errorf("trailer: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestParseChunkSize(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		line string
+		want int64
+		err  bool
+	}{
+		{line: "0\r\n", want: 0},
+		{line: "1a\r\n", want: 26},
+		{line: "00FF;ext=\"v\"\r\n", want: 255},
+		{line: "10 \t;ext\n", want: 16},
+		{line: "\r\n", err: true},
+		{line: "-1\r\n", err: true},
+		{line: "x\r\n", err: true},
+		{line: "ffffffffffffffffff\r\n", err: true},
+	}
+
+	for _, tc := range tests {
+		got, err := parseChunkSize([]byte(tc.line))
+		if (err != nil) != tc.err {
+			t.Errorf("parseChunkSize(%q): got error %v, want error %v", tc.line, err, tc.err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("parseChunkSize(%q): got %d, want %d", tc.line, got, tc.want)
+		}
+	}
+}
@@ -16,6 +16,8 @@ package martian
 
 import (
 	"context"
+	"crypto/tls"
+	"net/http"
 	"time"
 )
 
@@ -23,6 +25,10 @@ type contextKey int
 
 const (
 	traceIDContextKey contextKey = iota
+	connectAuthorityContextKey
+	connectHeaderContextKey
+	clientTLSContextKey
+	pipelinedContextKey
 )
 
 func withTraceID(ctx context.Context, id traceID) context.Context {
@@ -42,3 +48,58 @@ func ContextDuration(ctx context.Context) time.Duration {
 	}
 	return 0
 }
+
+func withConnectAuthority(ctx context.Context, authority string) context.Context {
+	return context.WithValue(ctx, connectAuthorityContextKey, authority)
+}
+
+// ContextConnectAuthority returns the authority of the CONNECT request
+// that established the MITMed connection the request was read from.
+// It returns an empty string if the request was not read from a MITMed connection.
+func ContextConnectAuthority(ctx context.Context) string {
+	if v := ctx.Value(connectAuthorityContextKey); v != nil {
+		return v.(string)
+	}
+	return ""
+}
+
+func withConnectHeader(ctx context.Context, h http.Header) context.Context {
+	return context.WithValue(ctx, connectHeaderContextKey, h)
+}
+
+// ContextConnectHeader returns the headers of the CONNECT request
+// that established the MITMed connection the request was read from,
+// or of the CONNECT request being tunneled.
+// It returns nil if there is no such CONNECT request.
+// The returned header must not be modified.
+func ContextConnectHeader(ctx context.Context) http.Header {
+	if v := ctx.Value(connectHeaderContextKey); v != nil {
+		return v.(http.Header)
+	}
+	return nil
+}
+
+func withClientTLS(ctx context.Context, cs *tls.ConnectionState) context.Context {
+	return context.WithValue(ctx, clientTLSContextKey, cs)
+}
+
+// ContextClientTLS returns the state of the TLS connection from the client to the proxy
+// the request was read from, it is not changed when the connection is MITMed.
+// It returns nil if the connection is not TLS.
+func ContextClientTLS(ctx context.Context) *tls.ConnectionState {
+	if v := ctx.Value(clientTLSContextKey); v != nil {
+		return v.(*tls.ConnectionState)
+	}
+	return nil
+}
+
+func withPipelined(ctx context.Context) context.Context {
+	return context.WithValue(ctx, pipelinedContextKey, true)
+}
+
+// ContextPipelined returns true if the request was received on an HTTP/1.1 connection
+// before the response to the previous request was sent.
+func ContextPipelined(ctx context.Context) bool {
+	v, _ := ctx.Value(pipelinedContextKey).(bool)
+	return v
+}
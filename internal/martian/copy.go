@@ -36,17 +36,25 @@ func drainBuffer(w io.Writer, r *bufio.Reader) error {
 	return nil
 }
 
-var copyBufPool = sync.Pool{
-	New: func() any {
-		b := make([]byte, 32*1024)
-		return &b
-	},
+// DefaultCopyBufferSize is the default size of buffers used to copy bodies and tunnel data.
+const DefaultCopyBufferSize = 32 * 1024
+
+func newCopyBufPool(size int) *sync.Pool {
+	if size <= 0 {
+		size = DefaultCopyBufferSize
+	}
+	return &sync.Pool{
+		New: func() any {
+			b := make([]byte, size)
+			return &b
+		},
+	}
 }
 
-func bicopy(ctx context.Context, cc ...copier) {
+func (p *Proxy) bicopy(ctx context.Context, cc ...copier) {
 	donec := make(chan struct{}, len(cc))
 	for i := range cc {
-		go cc[i].copy(ctx, donec)
+		go cc[i].copy(ctx, p.copyBufPool, donec)
 	}
 	for range cc {
 		<-donec
@@ -59,10 +67,10 @@ type copier struct {
 	src  io.Reader
 }
 
-func (c copier) copy(ctx context.Context, donec chan<- struct{}) {
-	bufp := copyBufPool.Get().(*[]byte) //nolint:forcetypeassert // It's *[]byte.
+func (c copier) copy(ctx context.Context, pool *sync.Pool, donec chan<- struct{}) {
+	bufp := pool.Get().(*[]byte) //nolint:forcetypeassert // It's *[]byte.
 	buf := *bufp
-	defer copyBufPool.Put(bufp)
+	defer pool.Put(bufp)
 
 	if _, err := io.CopyBuffer(c.dst, c.src, buf); err != nil && !isClosedConnError(err) {
 		log.Errorf(ctx, "failed to copy %s tunnel: %v", c.name, err)
@@ -0,0 +1,178 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"slices"
+	"sync"
+)
+
+// shouldUseDedicatedConn returns true if the request is eligible for ChunkedPassThrough or HeaderFidelity,
+// that require reading and writing the upstream connection directly.
+// Only plain HTTP/1.1 requests are eligible, upgrade requests are handled by the RoundTripper.
+func (p *Proxy) shouldUseDedicatedConn(req *http.Request) bool {
+	return (p.ChunkedPassThrough || p.HeaderFidelity) &&
+		req.URL.Scheme == "http" &&
+		req.ProtoAtLeast(1, 1) &&
+		upgradeType(req.Header) == ""
+}
+
+// resolvedProxyURL holds the upstream proxy URL resolved before calling the RoundTripper,
+// so that ProxyURL is called once per attempt.
+type resolvedProxyURL struct {
+	u  *url.URL
+	ok bool
+}
+
+type resolvedProxyURLKey struct{}
+
+// consumeResolvedProxyURL returns a proxy func that returns the URL resolved for the request if any,
+// and calls fn otherwise.
+func consumeResolvedProxyURL(fn func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		if r, ok := req.Context().Value(resolvedProxyURLKey{}).(*resolvedProxyURL); ok && r.ok {
+			r.ok = false
+			return r.u, nil
+		}
+		if fn == nil {
+			return nil, nil
+		}
+		return fn(req)
+	}
+}
+
+// roundTripDedicatedConn sends the request directly to the target over a dedicated connection,
+// if there is no upstream proxy for the request.
+// Otherwise, the request is sent using the RoundTripper.
+func (p *Proxy) roundTripDedicatedConn(req *http.Request) (*http.Response, error) {
+	if p.ProxyURL != nil {
+		u, err := timingProxyFunc(p.ProxyURL)(req)
+		if err != nil {
+			return nil, err
+		}
+		if u != nil {
+			*req = *req.WithContext(context.WithValue(req.Context(), resolvedProxyURLKey{}, &resolvedProxyURL{u: u, ok: true}))
+			return p.wrt.RoundTrip(req)
+		}
+	}
+
+	ctx := req.Context()
+	trace := httptrace.ContextClientTrace(ctx)
+
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+	addr := net.JoinHostPort(req.URL.Hostname(), port)
+
+	if trace != nil && trace.ConnectStart != nil {
+		trace.ConnectStart("tcp", addr)
+	}
+	conn, err := p.DialContext(ctx, "tcp", addr)
+	if trace != nil && trace.ConnectDone != nil {
+		trace.ConnectDone("tcp", addr, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if trace != nil && trace.GotConn != nil {
+		trace.GotConn(httptrace.GotConnInfo{Conn: conn})
+	}
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	closeConn := func() {
+		stop()
+		conn.Close()
+	}
+
+	hf := p.headerFidelity(req)
+
+	// The connection is not reused, the response body is read until the origin closes the connection or the body ends.
+	outreq := *req
+	outreq.Close = true
+	var w io.Writer = conn
+	if hf != nil && hf.req != nil {
+		w = &headerFidelityWriter{w: conn, raw: hf.req}
+	}
+	if err := outreq.Write(w); err != nil {
+		closeConn()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	if _, err := br.Peek(1); err == nil && trace != nil && trace.GotFirstResponseByte != nil {
+		trace.GotFirstResponseByte()
+	}
+
+	var res *http.Response
+	for {
+		if hf != nil {
+			hf.res = peekRawHeader(br)
+		}
+		res, err = http.ReadResponse(br, req)
+		if err != nil {
+			closeConn()
+			return nil, err
+		}
+		// Skip informational responses like 100 Continue.
+		if res.StatusCode/100 != 1 || res.StatusCode == http.StatusSwitchingProtocols {
+			break
+		}
+	}
+
+	if res.Body == http.NoBody {
+		closeConn()
+		return res, nil
+	}
+
+	res.Body = &passThroughBody{
+		body:  res.Body,
+		br:    br,
+		raw:   p.ChunkedPassThrough && slices.Equal(res.TransferEncoding, []string{"chunked"}),
+		close: sync.OnceFunc(closeConn),
+	}
+	return res, nil
+}
+
+// passThroughBody is the body of a response read from a dedicated upstream connection.
+// Read returns the decoded body, so that modifiers work as usual.
+// If the body is chunked and was not read, writeChunkedPassThroughResponse copies the origin's framing verbatim.
+type passThroughBody struct {
+	body  io.ReadCloser
+	br    *bufio.Reader
+	raw   bool
+	read  bool
+	close func()
+}
+
+func (b *passThroughBody) Read(p []byte) (int, error) {
+	b.read = true
+	return b.body.Read(p)
+}
+
+// Close closes the upstream connection, the body is not drained.
+func (b *passThroughBody) Close() error {
+	b.close()
+	return nil
+}
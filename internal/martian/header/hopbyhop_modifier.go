@@ -19,6 +19,7 @@ import (
 	"strings"
 
 	"github.com/saucelabs/forwarder/internal/martian"
+	"golang.org/x/net/http/httpguts"
 )
 
 // Hop-by-hop headers as defined by RFC2616.
@@ -47,8 +48,14 @@ func NewHopByHopModifier() martian.RequestResponseModifier {
 // ModifyRequest removes all hop-by-hop headers defined by RFC2616 as
 // well as any additional hop-by-hop headers specified in the
 // Connection header.
+// The "TE: trailers" header is preserved, it signals that the client accepts trailers
+// and is required by gRPC.
 func (m *hopByHopModifier) ModifyRequest(req *http.Request) error {
+	teTrailers := httpguts.HeaderValuesContainsToken(req.Header["Te"], "trailers")
 	removeHopByHopHeaders(req.Header)
+	if teTrailers {
+		req.Header.Set("Te", "trailers")
+	}
 	return nil
 }
 
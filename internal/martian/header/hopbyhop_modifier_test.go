@@ -77,3 +77,20 @@ func TestRemoveHopByHopHeaders(t *testing.T) {
 		t.Errorf("res.Header[%q]: got !ok, want ok", "X-End-To-End")
 	}
 }
+
+func TestRemoveHopByHopHeadersPreservesTETrailers(t *testing.T) {
+	m := NewHopByHopModifier()
+	req, err := http.NewRequest(http.MethodPost, "/", http.NoBody)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	req.Header.Set("Te", "trailers, deflate")
+
+	if err := m.ModifyRequest(req); err != nil {
+		t.Fatalf("ModifyRequest(): got %v, want no error", err)
+	}
+
+	if got, want := req.Header.Get("Te"), "trailers"; got != want {
+		t.Errorf("req.Header.Get(%q): got %q, want %q", "Te", got, want)
+	}
+}
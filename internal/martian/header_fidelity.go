@@ -0,0 +1,225 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/textproto"
+	"slices"
+	"strings"
+)
+
+// headerFidelity holds the header blocks of a request and its response as received from the wire.
+type headerFidelity struct {
+	req *rawHeader
+	res *rawHeader
+}
+
+type headerFidelityKey struct{}
+
+func withHeaderFidelity(ctx context.Context, hf *headerFidelity) context.Context {
+	return context.WithValue(ctx, headerFidelityKey{}, hf)
+}
+
+func (p *Proxy) headerFidelity(req *http.Request) *headerFidelity {
+	if !p.HeaderFidelity {
+		return nil
+	}
+	hf, _ := req.Context().Value(headerFidelityKey{}).(*headerFidelity)
+	return hf
+}
+
+// rawHeader is a header block as received, without the start line and the final empty line.
+type rawHeader struct {
+	fields []rawHeaderField
+}
+
+type rawHeaderField struct {
+	key   string // canonical key
+	value string // trimmed value, as parsed by textproto
+	line  []byte // the line including the line terminator
+}
+
+// peekRawHeader returns the header block that is about to be read from r without consuming it.
+// It returns nil if the header block does not fit in the buffer or uses obsolete line folding.
+func peekRawHeader(r *bufio.Reader) *rawHeader {
+	for {
+		b, _ := r.Peek(r.Buffered())
+		if i := headerBlockEnd(b); i > 0 {
+			// Copy the block, the buffer is reused and the http package canonicalizes header keys in place.
+			return parseRawHeader(bytes.Clone(b[:i]))
+		}
+		if len(b) == r.Size() {
+			return nil
+		}
+		// Wait for more data.
+		if _, err := r.Peek(len(b) + 1); err != nil {
+			return nil
+		}
+	}
+}
+
+// headerBlockEnd returns the length of the header block including the final empty line, or -1 if not found.
+func headerBlockEnd(b []byte) int {
+	for i := 0; i < len(b); {
+		j := bytes.IndexByte(b[i:], '\n')
+		if j < 0 {
+			return -1
+		}
+		line := b[i : i+j+1]
+		i += j + 1
+		if i > len(line) && (len(line) == 1 || (len(line) == 2 && line[0] == '\r')) {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseRawHeader parses a header block including the start line and the final empty line.
+func parseRawHeader(block []byte) *rawHeader {
+	var (
+		h     rawHeader
+		first = true
+	)
+	for len(block) > 0 {
+		i := bytes.IndexByte(block, '\n')
+		line := block[:i+1]
+		block = block[i+1:]
+
+		if first {
+			first = false
+			continue
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			return nil
+		}
+		k, v, ok := bytes.Cut(bytes.TrimRight(line, "\r\n"), []byte(":"))
+		if !ok {
+			return nil
+		}
+		h.fields = append(h.fields, rawHeaderField{
+			key:   textproto.CanonicalMIMEHeaderKey(string(k)),
+			value: strings.Trim(string(v), " \t"),
+			line:  line,
+		})
+	}
+	return &h
+}
+
+func (h *rawHeader) values(key string) []string {
+	var vv []string
+	for _, f := range h.fields {
+		if f.key == key {
+			vv = append(vv, f.value)
+		}
+	}
+	return vv
+}
+
+// rewriteHeaderBlock returns the header block serialized by the http package with fields ordered as in raw.
+// Fields whose values were not modified are copied from raw verbatim, preserving the name case and whitespace.
+// Modified fields are written at the position of the first raw occurrence, added fields are written last.
+func rewriteHeaderBlock(block []byte, raw *rawHeader) []byte {
+	out := parseRawHeader(block)
+	if out == nil {
+		return block
+	}
+	start := block[:bytes.IndexByte(block, '\n')+1]
+
+	b := make([]byte, 0, len(block))
+	b = append(b, start...)
+
+	done := make(map[string]bool)
+	for _, f := range raw.fields {
+		vv := out.values(f.key)
+		if len(vv) == 0 {
+			// Removed.
+			continue
+		}
+		if slices.Equal(vv, raw.values(f.key)) {
+			b = append(b, f.line...)
+			done[f.key] = true
+			continue
+		}
+		if done[f.key] {
+			continue
+		}
+		for _, of := range out.fields {
+			if of.key == f.key {
+				b = append(b, of.line...)
+			}
+		}
+		done[f.key] = true
+	}
+	for _, of := range out.fields {
+		if !done[of.key] {
+			b = append(b, of.line...)
+		}
+	}
+
+	return append(b, "\r\n"...)
+}
+
+// maxHeaderFidelityBlock limits the header block buffered by headerFidelityWriter.
+const maxHeaderFidelityBlock = 1 << 20
+
+// headerFidelityWriter rewrites the header block written by the http package with rewriteHeaderBlock,
+// the rest of the message is written as is.
+type headerFidelityWriter struct {
+	w    io.Writer
+	raw  *rawHeader
+	buf  []byte
+	done bool
+}
+
+func (w *headerFidelityWriter) Write(p []byte) (int, error) {
+	if w.done {
+		return w.w.Write(p)
+	}
+
+	w.buf = append(w.buf, p...)
+	i := headerBlockEnd(w.buf)
+	if i < 0 {
+		if len(w.buf) > maxHeaderFidelityBlock {
+			w.done = true
+			if _, err := w.w.Write(w.buf); err != nil {
+				return 0, err
+			}
+			w.buf = nil
+		}
+		return len(p), nil
+	}
+
+	w.done = true
+	if _, err := w.w.Write(rewriteHeaderBlock(w.buf[:i], w.raw)); err != nil {
+		return 0, err
+	}
+	if rest := w.buf[i:]; len(rest) > 0 {
+		if _, err := w.w.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+	w.buf = nil
+	return len(p), nil
+}
@@ -0,0 +1,172 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRewriteHeaderBlock(t *testing.T) {
+	t.Parallel()
+
+	raw := parseRawHeader([]byte("GET / HTTP/1.1\r\n" +
+		"host: example.com\r\n" +
+		"X-lower-Case:  spaced \r\n" +
+		"accept: a\r\n" +
+		"Accept: b\r\n" +
+		"x-modified: old\r\n" +
+		"x-removed: 1\r\n" +
+		"\r\n"))
+	if raw == nil {
+		t.Fatal("parseRawHeader(): got nil")
+	}
+
+	// As written by the http package, sorted and canonicalized.
+	block := []byte("GET / HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"Accept: a\r\n" +
+		"Accept: b\r\n" +
+		"Via: 1.1 proxy\r\n" +
+		"X-Lower-Case: spaced\r\n" +
+		"X-Modified: new\r\n" +
+		"\r\n")
+
+	want := "GET / HTTP/1.1\r\n" +
+		"host: example.com\r\n" +
+		"X-lower-Case:  spaced \r\n" +
+		"accept: a\r\n" +
+		"Accept: b\r\n" +
+		"X-Modified: new\r\n" +
+		"Via: 1.1 proxy\r\n" +
+		"\r\n"
+
+	if got := string(rewriteHeaderBlock(block, raw)); got != want {
+		t.Errorf("rewriteHeaderBlock():\ngot  %q\nwant %q", got, want)
+	}
+}
+
+func TestParseRawHeaderObsFold(t *testing.T) {
+	t.Parallel()
+
+	if h := parseRawHeader([]byte("GET / HTTP/1.1\r\nX-A: a\r\n b\r\n\r\n")); h != nil {
+		t.Errorf("parseRawHeader(): got %v, want nil", h)
+	}
+}
+
+func TestIntegrationHeaderFidelity(t *testing.T) {
+	t.Parallel()
+
+	if *withHandler {
+		t.Skip("header fidelity is not supported by the handler")
+	}
+
+	const resHeader = "HTTP/1.1 200 OK\r\n" +
+		"x-zeta: z\r\n" +
+		"content-type: text/plain\r\n" +
+		"ETag:\t\"abc\"\r\n"
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	// The origin responds with the request header block as the body.
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				var reqHeader bytes.Buffer
+				for {
+					line, err := br.ReadString('\n')
+					if err != nil {
+						t.Errorf("ReadString(): got %v, want no error", err)
+						return
+					}
+					reqHeader.WriteString(line)
+					if line == "\r\n" {
+						break
+					}
+				}
+				fmt.Fprintf(conn, "%scontent-length: %d\r\n\r\n%s", resHeader, reqHeader.Len(), reqHeader.Bytes())
+			}()
+		}
+	}()
+
+	h := testHelper{
+		Proxy: func(p *Proxy) {
+			p.AllowHTTP = true
+			p.HeaderFidelity = true
+		},
+	}
+
+	conn, cancel := h.proxyConn(t)
+	defer cancel()
+	defer conn.Close()
+
+	host := l.Addr().String()
+	if _, err := fmt.Fprintf(conn, "GET http://%s/ HTTP/1.1\r\n"+
+		"x-zeta: z\r\n"+
+		"HOST: %s\r\n"+
+		"user-agent:   test  \r\n"+
+		"X-Custom-ID: 1\r\n"+
+		"accept: */*\r\n"+
+		"Connection: close\r\n\r\n", host, host); err != nil {
+		t.Fatalf("conn.Write(): got %v, want no error", err)
+	}
+
+	br := bufio.NewReader(conn)
+	var gotResHeader strings.Builder
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("ReadString(): got %v, want no error", err)
+		}
+		if line == "\r\n" {
+			break
+		}
+		gotResHeader.WriteString(line)
+	}
+	if !strings.HasPrefix(gotResHeader.String(), resHeader) {
+		t.Errorf("response header:\ngot  %q\nwant prefix %q", gotResHeader.String(), resHeader)
+	}
+
+	body, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatalf("io.ReadAll(): got %v, want no error", err)
+	}
+	wantReq := "GET / HTTP/1.1\r\n" +
+		"x-zeta: z\r\n" +
+		"HOST: " + host + "\r\n" +
+		"user-agent:   test  \r\n" +
+		"X-Custom-ID: 1\r\n" +
+		"accept: */*\r\n"
+	if !strings.HasPrefix(string(body), wantReq) {
+		t.Errorf("upstream request header:\ngot  %q\nwant prefix %q", body, wantReq)
+	}
+}
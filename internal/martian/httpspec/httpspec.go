@@ -27,6 +27,16 @@ import (
 // behavior, in addition to a fifo.Group that can be used to add additional
 // modifiers within the stack.
 func NewStack(via string) (outer, inner *fifo.Group) {
+	return newStack(header.NewViaModifier(via))
+}
+
+// NewStackWithViaBoundary is like NewStack but uses the given boundary
+// instead of a random one in the Via header.
+func NewStackWithViaBoundary(via, boundary string) (outer, inner *fifo.Group) {
+	return newStack(header.NewViaModifierWithBoundary(via, boundary))
+}
+
+func newStack(vm *header.ViaModifier) (outer, inner *fifo.Group) {
 	outer = fifo.NewGroup()
 
 	hbhm := header.NewHopByHopModifier()
@@ -34,7 +44,6 @@ func NewStack(via string) (outer, inner *fifo.Group) {
 	outer.AddRequestModifier(header.NewForwardedModifier())
 	outer.AddRequestModifier(header.NewBadFramingModifier())
 
-	vm := header.NewViaModifier(via)
 	outer.AddRequestModifier(vm)
 
 	inner = fifo.NewGroup()
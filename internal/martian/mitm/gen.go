@@ -0,0 +1,141 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package mitm
+
+import (
+	"crypto/tls"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// GenConfig configures the worker pool generating certificates.
+type GenConfig struct {
+	// Workers is the maximum number of certificates generated concurrently.
+	// Zero means GOMAXPROCS.
+	Workers int
+
+	// PrefetchQueueSize is the maximum number of prefetched certificates waiting for a worker,
+	// prefetch requests are dropped when the queue is full.
+	// Zero disables prefetching.
+	PrefetchQueueSize int
+}
+
+func DefaultGenConfig() GenConfig {
+	return GenConfig{
+		PrefetchQueueSize: 128,
+	}
+}
+
+// GenMetrics holds the metrics of the worker pool generating certificates.
+type GenMetrics struct {
+	Queued            int64
+	Running           int64
+	Generated         uint64
+	Failed            uint64
+	Prefetched        uint64
+	PrefetchesDropped uint64
+}
+
+type genCall struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+// generator generates certificates in a bounded pool of workers,
+// concurrent requests for the same host share a single generation.
+type generator struct {
+	sem       chan struct{}
+	queueSize int64
+
+	mu       sync.Mutex
+	inflight map[string]*genCall
+
+	queued            atomic.Int64
+	running           atomic.Int64
+	queuedPrefetches  atomic.Int64
+	generated         atomic.Uint64
+	failed            atomic.Uint64
+	prefetched        atomic.Uint64
+	prefetchesDropped atomic.Uint64
+}
+
+func newGenerator(cfg GenConfig) *generator {
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	return &generator{
+		sem:       make(chan struct{}, workers),
+		queueSize: int64(cfg.PrefetchQueueSize),
+		inflight:  make(map[string]*genCall),
+	}
+}
+
+// start starts generating a certificate for hostname with gen unless it is already being generated.
+// If prefetch is true and the prefetch queue is full, it returns nil.
+func (g *generator) start(hostname string, prefetch bool, gen func(hostname string) (*tls.Certificate, error)) *genCall {
+	g.mu.Lock()
+	if call, ok := g.inflight[hostname]; ok {
+		g.mu.Unlock()
+		return call
+	}
+	if prefetch && g.queuedPrefetches.Load() >= g.queueSize {
+		g.mu.Unlock()
+		g.prefetchesDropped.Add(1)
+		return nil
+	}
+	call := &genCall{done: make(chan struct{})}
+	g.inflight[hostname] = call
+	g.mu.Unlock()
+
+	g.queued.Add(1)
+	if prefetch {
+		g.queuedPrefetches.Add(1)
+		g.prefetched.Add(1)
+	}
+
+	go func() {
+		g.sem <- struct{}{}
+		g.queued.Add(-1)
+		if prefetch {
+			g.queuedPrefetches.Add(-1)
+		}
+		g.running.Add(1)
+
+		call.cert, call.err = gen(hostname)
+
+		g.running.Add(-1)
+		<-g.sem
+
+		if call.err != nil {
+			g.failed.Add(1)
+		} else {
+			g.generated.Add(1)
+		}
+
+		g.mu.Lock()
+		delete(g.inflight, hostname)
+		g.mu.Unlock()
+
+		close(call.done)
+	}()
+
+	return call
+}
+
+func (g *generator) metrics() GenMetrics {
+	return GenMetrics{
+		Queued:            g.queued.Load(),
+		Running:           g.running.Load(),
+		Generated:         g.generated.Load(),
+		Failed:            g.failed.Load(),
+		Prefetched:        g.prefetched.Load(),
+		PrefetchesDropped: g.prefetchesDropped.Load(),
+	}
+}
@@ -20,6 +20,7 @@ package mitm
 import (
 	"bytes"
 	"context"
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -30,10 +31,12 @@ import (
 	"math/big"
 	"net"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/saucelabs/forwarder/internal/martian/h2"
 	"github.com/saucelabs/forwarder/internal/martian/log"
+	"github.com/saucelabs/forwarder/utils/certutil"
 )
 
 // MaxSerialNumber is the upper boundary that is used to create unique serial
@@ -44,16 +47,48 @@ var MaxSerialNumber = big.NewInt(0).SetBytes(bytes.Repeat([]byte{255}, 20))
 // Config is a set of configuration values that are used to build TLS configs
 // capable of MITM.
 type Config struct {
-	ca                     *x509.Certificate
-	capriv                 any
-	priv                   *rsa.PrivateKey
+	auth                   atomic.Pointer[authority]
+	keyType                certutil.KeyType
+	priv                   crypto.Signer // shared leaf key, nil if a key is generated for each certificate
 	keyID                  []byte
 	validity               time.Duration
+	now                    func() time.Time
 	org                    string
 	h2Config               *h2.Config
+	hostPolicy             func(hostname string) HostPolicy
 	certs                  Cache
-	roots                  *x509.CertPool
+	gen                    *generator
+	ticketKeys             atomic.Pointer[[][32]byte]
+	sessionTicketsDisabled bool
 	handshakeErrorCallback func(*http.Request, error)
+	issuedCertCallback     func(hostname string, cert, ca *x509.Certificate)
+}
+
+// HostPolicy controls the TLS server settings of MITMed connections to a host.
+type HostPolicy struct {
+	// HTTP2 offers h2 in ALPN, so that clients can use HTTP/2, otherwise only http/1.1 is offered.
+	HTTP2 bool
+
+	// MinVersion is the minimum TLS version accepted from clients, zero means TLS 1.2.
+	MinVersion uint16
+}
+
+// authority is the CA used to sign certificates.
+type authority struct {
+	ca     *x509.Certificate
+	capriv any
+	roots  *x509.CertPool
+}
+
+func newAuthority(ca *x509.Certificate, privateKey any) *authority {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	return &authority{
+		ca:     ca,
+		capriv: privateKey,
+		roots:  roots,
+	}
 }
 
 // NewAuthority creates a new CA certificate and associated
@@ -123,35 +158,67 @@ func NewConfig(ca *x509.Certificate, privateKey any) (*Config, error) {
 }
 
 func NewConfigWithCache(ca *x509.Certificate, privateKey any, certs Cache) (*Config, error) {
-	roots := x509.NewCertPool()
-	roots.AddCert(ca)
+	c := &Config{
+		validity: time.Hour,
+		now:      time.Now,
+		org:      "Martian Proxy",
+		certs:    certs,
+		gen:      newGenerator(DefaultGenConfig()),
+	}
+	if err := c.SetLeafKey(certutil.KeyTypeRSA, true); err != nil {
+		return nil, err
+	}
+	c.auth.Store(newAuthority(ca, privateKey))
 
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	return c, nil
+}
+
+// SetLeafKey sets the type of the keys of the generated certificates.
+// If shared is true, a single key is generated now and used for all certificates,
+// otherwise a new key is generated for each certificate.
+// Sharing the key saves CPU when certificates are generated for many hosts.
+func (c *Config) SetLeafKey(kt certutil.KeyType, shared bool) error {
+	c.keyType = kt
+	c.priv = nil
+	c.keyID = nil
+
+	if !shared {
+		_, err := certutil.ParseKeyType(string(kt))
+		return err
+	}
+
+	priv, keyID, err := c.newLeafKey()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	c.priv = priv
+	c.keyID = keyID
+
+	return nil
+}
+
+func (c *Config) newLeafKey() (priv crypto.Signer, keyID []byte, err error) {
+	priv, err = certutil.GenerateKey(c.keyType)
+	if err != nil {
+		return nil, nil, err
 	}
-	pub := priv.Public()
 
 	// Subject Key Identifier support for end entity certificate.
 	// https://www.ietf.org/rfc/rfc3280.txt (section 4.2.1.2)
-	pkixpub, err := x509.MarshalPKIXPublicKey(pub)
+	pkixpub, err := x509.MarshalPKIXPublicKey(priv.Public())
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	h := sha256.New()
 	h.Write(pkixpub)
-	keyID := h.Sum(nil)
 
-	return &Config{
-		ca:       ca,
-		capriv:   privateKey,
-		priv:     priv,
-		keyID:    keyID,
-		validity: time.Hour,
-		org:      "Martian Proxy",
-		certs:    certs,
-		roots:    roots,
-	}, nil
+	return priv, h.Sum(nil), nil
+}
+
+// SetCA replaces the CA certificate and private key used to sign the on-the-fly certificates.
+// Cached certificates signed by the previous CA fail verification, and are regenerated on use.
+func (c *Config) SetCA(ca *x509.Certificate, privateKey any) {
+	c.auth.Store(newAuthority(ca, privateKey))
 }
 
 // SetValidity sets the validity window around the current time that the
@@ -160,6 +227,32 @@ func (c *Config) SetValidity(validity time.Duration) {
 	c.validity = validity
 }
 
+// SetClock sets the function returning the current time,
+// it is used to set and check the validity window of the certificates.
+func (c *Config) SetClock(now func() time.Time) {
+	c.now = now
+}
+
+// SetGenConfig configures the worker pool generating certificates.
+// It must be called before the config is used.
+func (c *Config) SetGenConfig(cfg GenConfig) {
+	c.gen = newGenerator(cfg)
+}
+
+// SetSessionTicketKeys sets the keys used to encrypt and decrypt TLS session tickets,
+// the first key is used to encrypt new tickets, see [tls.Config.SetSessionTicketKeys].
+// Sharing the keys between connections, and between proxy instances, enables session resumption.
+// If not set, each connection uses its own key, and sessions cannot be resumed.
+// It is safe to call concurrently with TLS handshakes.
+func (c *Config) SetSessionTicketKeys(keys [][32]byte) {
+	c.ticketKeys.Store(&keys)
+}
+
+// SetSessionTicketsDisabled disables TLS session tickets.
+func (c *Config) SetSessionTicketsDisabled(disabled bool) {
+	c.sessionTicketsDisabled = disabled
+}
+
 // SetOrganization sets the organization of the certificate.
 func (c *Config) SetOrganization(org string) {
 	c.org = org
@@ -175,6 +268,13 @@ func (c *Config) H2Config() *h2.Config {
 	return c.h2Config
 }
 
+// SetHostPolicy sets the function returning the TLS server settings for MITMed connections to hostname,
+// the hostname does not include the port.
+// It must be called before the config is used.
+func (c *Config) SetHostPolicy(fn func(hostname string) HostPolicy) {
+	c.hostPolicy = fn
+}
+
 // SetHandshakeErrorCallback sets the handshakeErrorCallback function.
 func (c *Config) SetHandshakeErrorCallback(cb func(*http.Request, error)) {
 	c.handshakeErrorCallback = cb
@@ -189,15 +289,21 @@ func (c *Config) HandshakeErrorCallback(r *http.Request, err error) {
 	}
 }
 
+// SetIssuedCertCallback sets the function called after a certificate is generated,
+// it is called with the hostname, the certificate and the CA certificate that signed it.
+func (c *Config) SetIssuedCertCallback(cb func(hostname string, cert, ca *x509.Certificate)) {
+	c.issuedCertCallback = cb
+}
+
 // CACert returns the CA certificate used to sign the on-the-fly certificates.
 func (c *Config) CACert() *x509.Certificate {
-	return c.ca
+	return c.auth.Load().ca
 }
 
 // TLS returns a *tls.Config that will generate certificates on-the-fly using
 // the SNI extension in the TLS ClientHello.
 func (c *Config) TLS(ctx context.Context) *tls.Config {
-	return &tls.Config{
+	return c.configureSessionTickets(&tls.Config{
 		MinVersion: tls.VersionTLS12,
 		GetCertificate: func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 			if clientHello.ServerName == "" {
@@ -207,18 +313,29 @@ func (c *Config) TLS(ctx context.Context) *tls.Config {
 			return c.cert(ctx, clientHello.ServerName)
 		},
 		NextProtos: []string{"http/1.1"},
-	}
+	})
 }
 
 // TLSForHost returns a *tls.Config that will generate certificates on-the-fly
 // using SNI from the connection, or fall back to the provided hostname.
+// The ALPN protocols and the minimum TLS version are set according to the host policy, see SetHostPolicy.
 func (c *Config) TLSForHost(ctx context.Context, hostname string) *tls.Config {
+	var hp HostPolicy
+	if c.hostPolicy != nil {
+		hp = c.hostPolicy(stripPort(hostname))
+	}
+
 	nextProtos := []string{"http/1.1"}
-	if c.h2AllowedHost(hostname) {
+	if hp.HTTP2 || c.h2AllowedHost(hostname) {
 		nextProtos = []string{"h2", "http/1.1"}
 	}
-	return &tls.Config{
-		MinVersion: tls.VersionTLS12,
+	minVersion := uint16(tls.VersionTLS12)
+	if hp.MinVersion != 0 {
+		minVersion = hp.MinVersion
+	}
+
+	return c.configureSessionTickets(&tls.Config{
+		MinVersion: minVersion,
 		GetCertificate: func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 			host := clientHello.ServerName
 			if host == "" {
@@ -228,7 +345,18 @@ func (c *Config) TLSForHost(ctx context.Context, hostname string) *tls.Config {
 			return c.cert(ctx, host)
 		},
 		NextProtos: nextProtos,
+	})
+}
+
+func (c *Config) configureSessionTickets(tc *tls.Config) *tls.Config {
+	if c.sessionTicketsDisabled {
+		tc.SessionTicketsDisabled = true
+		return tc
+	}
+	if keys := c.ticketKeys.Load(); keys != nil && len(*keys) > 0 {
+		tc.SetSessionTicketKeys(*keys)
 	}
+	return tc
 }
 
 func (c *Config) h2AllowedHost(host string) bool {
@@ -237,23 +365,50 @@ func (c *Config) h2AllowedHost(host string) bool {
 		c.h2Config.AllowedHostsFilter(host)
 }
 
-func (c *Config) cert(ctx context.Context, hostname string) (*tls.Certificate, error) {
+// Prefetch starts generating a certificate for hostname in the background if it is not cached,
+// so that it is ready when the TLS ClientHello arrives.
+// Prefetch requests are dropped when the prefetch queue is full.
+func (c *Config) Prefetch(ctx context.Context, hostname string) {
+	hostname = stripPort(hostname)
+
+	if tlsc, ok := c.certs.Peek(hostname); ok && c.valid(tlsc, hostname) {
+		return
+	}
+
+	if c.gen.start(hostname, true, c.genCert) == nil {
+		log.Debugf(ctx, "mitm: prefetch queue full, dropped prefetch for %s", hostname)
+		return
+	}
+	log.Debugf(ctx, "mitm: prefetching certificate for %s", hostname)
+}
+
+func stripPort(hostname string) string {
 	// Remove the port if it exists.
-	host, _, err := net.SplitHostPort(hostname)
-	if err == nil {
-		hostname = host
+	if host, _, err := net.SplitHostPort(hostname); err == nil {
+		return host
 	}
+	return hostname
+}
+
+// valid checks validity of the certificate for hostname match, expiry, etc.
+func (c *Config) valid(tlsc *tls.Certificate, hostname string) bool {
+	_, err := tlsc.Leaf.Verify(x509.VerifyOptions{
+		DNSName:     hostname,
+		Roots:       c.auth.Load().roots,
+		CurrentTime: c.now(),
+	})
+	return err == nil
+}
+
+func (c *Config) cert(ctx context.Context, hostname string) (*tls.Certificate, error) {
+	hostname = stripPort(hostname)
 
 	tlsc, ok := c.certs.Get(hostname)
 	if ok {
 		log.Debugf(ctx, "mitm: cache hit for %s", hostname)
 
-		// Check validity of the certificate for hostname match, expiry, etc. In
-		// particular, if the cached certificate has expired, create a new one.
-		if _, err := tlsc.Leaf.Verify(x509.VerifyOptions{
-			DNSName: hostname,
-			Roots:   c.roots,
-		}); err == nil {
+		// In particular, if the cached certificate has expired, create a new one.
+		if c.valid(tlsc, hostname) {
 			return tlsc, nil
 		}
 
@@ -262,23 +417,54 @@ func (c *Config) cert(ctx context.Context, hostname string) (*tls.Certificate, e
 
 	log.Debugf(ctx, "mitm: cache miss for %s", hostname)
 
+	call := c.gen.start(hostname, false, c.genCert)
+	select {
+	case <-call.done:
+		return call.cert, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// genCert generates a certificate for hostname and adds it to the cache.
+func (c *Config) genCert(hostname string) (*tls.Certificate, error) {
+	auth := c.auth.Load()
+	now := c.now()
+
 	serial, err := rand.Int(rand.Reader, MaxSerialNumber)
 	if err != nil {
 		return nil, err
 	}
 
+	priv, keyID := c.priv, c.keyID
+	if priv == nil {
+		if priv, keyID, err = c.newLeafKey(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Only RSA keys are used for key encipherment.
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, ok := priv.(*rsa.PrivateKey); ok {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
 	tmpl := &x509.Certificate{
 		SerialNumber: serial,
 		Subject: pkix.Name{
 			CommonName:   hostname,
 			Organization: []string{c.org},
 		},
-		SubjectKeyId:          c.keyID,
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		SubjectKeyId:          keyID,
+		KeyUsage:              keyUsage,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
-		NotBefore:             time.Now().Add(-c.validity),
-		NotAfter:              time.Now().Add(c.validity),
+		NotBefore:             now.Add(-c.validity),
+		NotAfter:              now.Add(c.validity),
+	}
+	// Certificates must not outlive the CA, otherwise clients reject them.
+	if tmpl.NotAfter.After(auth.ca.NotAfter) {
+		tmpl.NotAfter = auth.ca.NotAfter
 	}
 
 	if ip := net.ParseIP(hostname); ip != nil {
@@ -287,7 +473,7 @@ func (c *Config) cert(ctx context.Context, hostname string) (*tls.Certificate, e
 		tmpl.DNSNames = []string{hostname}
 	}
 
-	raw, err := x509.CreateCertificate(rand.Reader, tmpl, c.ca, c.priv.Public(), c.capriv)
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, auth.ca, priv.Public(), auth.capriv)
 	if err != nil {
 		return nil, err
 	}
@@ -298,14 +484,18 @@ func (c *Config) cert(ctx context.Context, hostname string) (*tls.Certificate, e
 		return nil, err
 	}
 
-	tlsc = &tls.Certificate{
-		Certificate: [][]byte{raw, c.ca.Raw},
-		PrivateKey:  c.priv,
+	tlsc := &tls.Certificate{
+		Certificate: [][]byte{raw, auth.ca.Raw},
+		PrivateKey:  priv,
 		Leaf:        x509c,
 	}
 
 	c.certs.Add(hostname, tlsc)
 
+	if c.issuedCertCallback != nil {
+		c.issuedCertCallback(hostname, x509c, auth.ca)
+	}
+
 	return tlsc, nil
 }
 
@@ -313,3 +503,8 @@ func (c *Config) cert(ctx context.Context, hostname string) (*tls.Certificate, e
 func (c *Config) CacheMetrics() CacheMetrics {
 	return CacheMetrics(c.certs.Metrics())
 }
+
+// GenMetrics return the metrics for the worker pool generating certificates.
+func (c *Config) GenMetrics() GenMetrics {
+	return c.gen.metrics()
+}
@@ -16,12 +16,15 @@ package mitm
 
 import (
 	"context"
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
 	"net"
 	"reflect"
 	"testing"
 	"time"
+
+	"github.com/saucelabs/forwarder/utils/certutil"
 )
 
 func TestMITM(t *testing.T) {
@@ -104,6 +107,44 @@ func TestMITM(t *testing.T) {
 	}
 }
 
+func TestHostPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	ca, priv, err := NewAuthority("martian.proxy", "Martian Authority", 24*time.Hour)
+	if err != nil {
+		t.Fatalf("NewAuthority(): got %v, want no error", err)
+	}
+	c, err := NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("NewConfig(): got %v, want no error", err)
+	}
+	c.SetHostPolicy(func(hostname string) HostPolicy {
+		if hostname == "h2.example.com" {
+			return HostPolicy{HTTP2: true, MinVersion: tls.VersionTLS13}
+		}
+		return HostPolicy{}
+	})
+
+	tests := []struct {
+		host       string
+		protos     []string
+		minVersion uint16
+	}{
+		{"h2.example.com:443", []string{"h2", "http/1.1"}, tls.VersionTLS13},
+		{"h2.example.com", []string{"h2", "http/1.1"}, tls.VersionTLS13},
+		{"example.com:443", []string{"http/1.1"}, tls.VersionTLS12},
+	}
+	for _, tc := range tests {
+		conf := c.TLSForHost(ctx, tc.host)
+		if got := conf.NextProtos; !reflect.DeepEqual(got, tc.protos) {
+			t.Errorf("%s: conf.NextProtos: got %v, want %v", tc.host, got, tc.protos)
+		}
+		if got := conf.MinVersion; got != tc.minVersion {
+			t.Errorf("%s: conf.MinVersion: got %x, want %x", tc.host, got, tc.minVersion)
+		}
+	}
+}
+
 func TestCert(t *testing.T) {
 	const exampleHostname = "example.com"
 
@@ -207,3 +248,240 @@ func TestCert(t *testing.T) {
 		t.Fatalf("x509c.IPAddresses: got %v, want %v", got, want)
 	}
 }
+
+func TestCertClock(t *testing.T) {
+	const exampleHostname = "example.com"
+
+	ctx := context.Background()
+
+	ca, priv, err := NewAuthority("martian.proxy", "Martian Authority", 24*time.Hour)
+	if err != nil {
+		t.Fatalf("NewAuthority(): got %v, want no error", err)
+	}
+
+	c, err := NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("NewConfig(): got %v, want no error", err)
+	}
+
+	now := time.Now().Add(-time.Hour).Truncate(time.Second)
+	c.SetClock(func() time.Time { return now })
+	c.SetValidity(10 * time.Minute)
+
+	tlsc, err := c.cert(ctx, exampleHostname)
+	if err != nil {
+		t.Fatalf("c.cert(%q): got %v, want no error", exampleHostname, err)
+	}
+	if got, want := tlsc.Leaf.NotBefore, now.Add(-10*time.Minute); !got.Equal(want) {
+		t.Errorf("x509c.NotBefore: got %v, want %v", got, want)
+	}
+	if got, want := tlsc.Leaf.NotAfter, now.Add(10*time.Minute); !got.Equal(want) {
+		t.Errorf("x509c.NotAfter: got %v, want %v", got, want)
+	}
+
+	// The cached certificate expires according to the clock.
+	now = now.Add(20 * time.Minute)
+	tlsc2, err := c.cert(ctx, exampleHostname)
+	if err != nil {
+		t.Fatalf("c.cert(%q): got %v, want no error", exampleHostname, err)
+	}
+	if tlsc == tlsc2 {
+		t.Error("c.cert(): got cached expired certificate, want new certificate")
+	}
+}
+
+func TestCertLeafKey(t *testing.T) {
+	ctx := context.Background()
+
+	ca, priv, err := NewAuthority("martian.proxy", "Martian Authority", 24*time.Hour)
+	if err != nil {
+		t.Fatalf("NewAuthority(): got %v, want no error", err)
+	}
+
+	tests := []struct {
+		keyType certutil.KeyType
+		algo    x509.PublicKeyAlgorithm
+		usage   x509.KeyUsage
+	}{
+		{certutil.KeyTypeRSA, x509.RSA, x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment},
+		{certutil.KeyTypeECDSA, x509.ECDSA, x509.KeyUsageDigitalSignature},
+		{certutil.KeyTypeEd25519, x509.Ed25519, x509.KeyUsageDigitalSignature},
+	}
+
+	for _, tc := range tests {
+		for _, shared := range []bool{true, false} {
+			c, err := NewConfig(ca, priv)
+			if err != nil {
+				t.Fatalf("NewConfig(): got %v, want no error", err)
+			}
+			if err := c.SetLeafKey(tc.keyType, shared); err != nil {
+				t.Fatalf("c.SetLeafKey(%s, %t): got %v, want no error", tc.keyType, shared, err)
+			}
+
+			var keys []crypto.PrivateKey
+			for _, host := range []string{"foo.example.com", "bar.example.com"} {
+				tlsc, err := c.cert(ctx, host)
+				if err != nil {
+					t.Fatalf("c.cert(%q): got %v, want no error", host, err)
+				}
+				if got := tlsc.Leaf.PublicKeyAlgorithm; got != tc.algo {
+					t.Errorf("%s: x509c.PublicKeyAlgorithm: got %v, want %v", tc.keyType, got, tc.algo)
+				}
+				if got := tlsc.Leaf.KeyUsage; got != tc.usage {
+					t.Errorf("%s: x509c.KeyUsage: got %v, want %v", tc.keyType, got, tc.usage)
+				}
+				if err := tlsc.Leaf.CheckSignatureFrom(ca); err != nil {
+					t.Errorf("%s: x509c.CheckSignatureFrom(): got %v, want no error", tc.keyType, err)
+				}
+				keys = append(keys, tlsc.PrivateKey)
+			}
+
+			eq := keys[0].(interface{ Equal(crypto.PrivateKey) bool }).Equal(keys[1]) //nolint:forcetypeassert // all private keys implement Equal
+			if eq != shared {
+				t.Errorf("%s: shared key: got %t, want %t", tc.keyType, eq, shared)
+			}
+		}
+	}
+
+	c, err := NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("NewConfig(): got %v, want no error", err)
+	}
+	if err := c.SetLeafKey("dsa", false); err == nil {
+		t.Error("c.SetLeafKey(dsa): got no error, want error")
+	}
+}
+
+func TestCertPrefetch(t *testing.T) {
+	ctx := context.Background()
+
+	ca, priv, err := NewAuthority("martian.proxy", "Martian Authority", 24*time.Hour)
+	if err != nil {
+		t.Fatalf("NewAuthority(): got %v, want no error", err)
+	}
+
+	c, err := NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("NewConfig(): got %v, want no error", err)
+	}
+	c.SetGenConfig(GenConfig{Workers: 1, PrefetchQueueSize: 1})
+
+	c.Prefetch(ctx, "example.com:443")
+	tlsc, err := c.cert(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("c.cert(): got %v, want no error", err)
+	}
+	if got, want := tlsc.Leaf.DNSNames, []string{"example.com"}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("x509c.DNSNames: got %v, want %v", got, want)
+	}
+
+	// Cached certificates are not prefetched again.
+	c.Prefetch(ctx, "example.com:443")
+
+	m := c.GenMetrics()
+	if m.Generated != 1 || m.Prefetched != 1 {
+		t.Errorf("GenMetrics(): got generated=%d prefetched=%d, want generated=1 prefetched=1", m.Generated, m.Prefetched)
+	}
+	if m.Queued != 0 || m.Running != 0 {
+		t.Errorf("GenMetrics(): got queued=%d running=%d, want 0", m.Queued, m.Running)
+	}
+}
+
+func TestCertPrefetchDisabled(t *testing.T) {
+	ctx := context.Background()
+
+	ca, priv, err := NewAuthority("martian.proxy", "Martian Authority", 24*time.Hour)
+	if err != nil {
+		t.Fatalf("NewAuthority(): got %v, want no error", err)
+	}
+
+	c, err := NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("NewConfig(): got %v, want no error", err)
+	}
+	c.SetGenConfig(GenConfig{Workers: 1})
+
+	c.Prefetch(ctx, "example.com:443")
+	if m := c.GenMetrics(); m.Prefetched != 0 || m.PrefetchesDropped != 1 {
+		t.Errorf("GenMetrics(): got prefetched=%d dropped=%d, want prefetched=0 dropped=1", m.Prefetched, m.PrefetchesDropped)
+	}
+}
+
+func TestSessionTickets(t *testing.T) {
+	ctx := context.Background()
+
+	ca, priv, err := NewAuthority("martian.proxy", "Martian Authority", 24*time.Hour)
+	if err != nil {
+		t.Fatalf("NewAuthority(): got %v, want no error", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	// handshake returns true if the session was resumed.
+	handshake := func(c *Config, cache tls.ClientSessionCache) bool {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s := tls.Server(conn, c.TLSForHost(ctx, "example.com"))
+			defer s.Close()
+			s.Read(make([]byte, 1)) //nolint:errcheck // the client closes the connection on error
+		}()
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := tls.Client(conn, &tls.Config{
+			ServerName:         "example.com",
+			RootCAs:            roots,
+			ClientSessionCache: cache,
+		})
+		defer client.Close()
+		if _, err := client.Write([]byte{0}); err != nil {
+			t.Fatalf("client.Write(): got %v, want no error", err)
+		}
+		// Read until the server closes the connection to receive the TLS 1.3 session ticket.
+		client.Read(make([]byte, 1)) //nolint:errcheck // the server closes the connection
+
+		return client.ConnectionState().DidResume
+	}
+
+	tests := []struct {
+		name   string
+		keys   [][32]byte
+		resume bool
+	}{
+		{name: "per connection keys", resume: false},
+		{name: "shared keys", keys: [][32]byte{{1}, {2}}, resume: true},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := NewConfig(ca, priv)
+			if err != nil {
+				t.Fatalf("NewConfig(): got %v, want no error", err)
+			}
+			if tc.keys != nil {
+				c.SetSessionTicketKeys(tc.keys)
+			}
+
+			cache := tls.NewLRUClientSessionCache(1)
+			if handshake(c, cache) {
+				t.Fatal("first handshake: got resumed, want full handshake")
+			}
+			if got := handshake(c, cache); got != tc.resume {
+				t.Fatalf("second handshake resumed: got %t, want %t", got, tc.resume)
+			}
+		})
+	}
+}
@@ -71,3 +71,70 @@ func (c *CacheMetricsCollector) Collect(ch chan<- prometheus.Metric) {
 	ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(m.Hits))
 	ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(m.Misses))
 }
+
+type GenMetricsFunc func() mitm.GenMetrics
+
+type GenMetricsCollector struct {
+	queued            *prometheus.Desc
+	running           *prometheus.Desc
+	generated         *prometheus.Desc
+	failed            *prometheus.Desc
+	prefetched        *prometheus.Desc
+	prefetchesDropped *prometheus.Desc
+	metrics           GenMetricsFunc
+}
+
+func NewGenMetricsCollector(namespace string, f GenMetricsFunc) *GenMetricsCollector {
+	return &GenMetricsCollector{
+		queued: prometheus.NewDesc(
+			namespace+"gen_queue_length",
+			"Number of certificates waiting for a generation worker.",
+			nil, nil,
+		),
+		running: prometheus.NewDesc(
+			namespace+"gen_workers_busy",
+			"Number of generation workers generating a certificate.",
+			nil, nil,
+		),
+		generated: prometheus.NewDesc(
+			namespace+"gen_total",
+			"Number of generated certificates.",
+			nil, nil,
+		),
+		failed: prometheus.NewDesc(
+			namespace+"gen_errors_total",
+			"Number of failed certificate generations.",
+			nil, nil,
+		),
+		prefetched: prometheus.NewDesc(
+			namespace+"prefetch_total",
+			"Number of certificates generated ahead of the TLS handshake.",
+			nil, nil,
+		),
+		prefetchesDropped: prometheus.NewDesc(
+			namespace+"prefetch_dropped_total",
+			"Number of prefetch requests dropped due to a full queue.",
+			nil, nil,
+		),
+		metrics: f,
+	}
+}
+
+func (c *GenMetricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.queued
+	ch <- c.running
+	ch <- c.generated
+	ch <- c.failed
+	ch <- c.prefetched
+	ch <- c.prefetchesDropped
+}
+
+func (c *GenMetricsCollector) Collect(ch chan<- prometheus.Metric) {
+	m := c.metrics()
+	ch <- prometheus.MustNewConstMetric(c.queued, prometheus.GaugeValue, float64(m.Queued))
+	ch <- prometheus.MustNewConstMetric(c.running, prometheus.GaugeValue, float64(m.Running))
+	ch <- prometheus.MustNewConstMetric(c.generated, prometheus.CounterValue, float64(m.Generated))
+	ch <- prometheus.MustNewConstMetric(c.failed, prometheus.CounterValue, float64(m.Failed))
+	ch <- prometheus.MustNewConstMetric(c.prefetched, prometheus.CounterValue, float64(m.Prefetched))
+	ch <- prometheus.MustNewConstMetric(c.prefetchesDropped, prometheus.CounterValue, float64(m.PrefetchesDropped))
+}
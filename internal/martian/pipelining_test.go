@@ -0,0 +1,192 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/martian/martiantest"
+	"github.com/saucelabs/forwarder/internal/martian/proxyutil"
+)
+
+// writePipelined writes the requests to conn in a single write, so that they are received together.
+func writePipelined(t *testing.T, conn io.Writer, paths ...string) []*http.Request {
+	t.Helper()
+
+	var (
+		buf  bytes.Buffer
+		reqs []*http.Request
+	)
+	for _, p := range paths {
+		req, err := http.NewRequest(http.MethodGet, "http://example.com"+p, http.NoBody)
+		if err != nil {
+			t.Fatalf("http.NewRequest(): got %v, want no error", err)
+		}
+		if err := req.WriteProxy(&buf); err != nil {
+			t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+		}
+		reqs = append(reqs, req)
+	}
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		t.Fatalf("conn.Write(): got %v, want no error", err)
+	}
+	return reqs
+}
+
+func TestIntegrationPipelining(t *testing.T) {
+	t.Parallel()
+
+	if *withHandler {
+		t.Skip("pipelining is handled by http.Server when using the handler")
+	}
+
+	// The first request is the slowest, so that out of order responses would be detected.
+	tr := martiantest.NewTransport()
+	tr.Func(func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Path {
+		case "/1":
+			time.Sleep(100 * time.Millisecond)
+		case "/2":
+			time.Sleep(50 * time.Millisecond)
+		}
+		res := proxyutil.NewResponse(200, strings.NewReader(req.URL.Path), req)
+		res.ContentLength = int64(len(req.URL.Path))
+		return res, nil
+	})
+
+	t.Run("serialize", func(t *testing.T) {
+		t.Parallel()
+
+		var pipelined atomic.Int32
+		h := testHelper{
+			Proxy: func(p *Proxy) {
+				p.RoundTripper = tr
+				p.PipelinedFunc = func(*http.Request) { pipelined.Add(1) }
+			},
+		}
+		conn, cancel := h.proxyConn(t)
+		defer cancel()
+		defer conn.Close()
+
+		reqs := writePipelined(t, conn, "/1", "/2", "/3")
+		br := bufio.NewReader(conn)
+		for _, req := range reqs {
+			res, err := http.ReadResponse(br, req)
+			if err != nil {
+				t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+			}
+			b, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				t.Fatalf("io.ReadAll(): got %v, want no error", err)
+			}
+			if got, want := string(b), req.URL.Path; got != want {
+				t.Fatalf("response body: got %q, want %q", got, want)
+			}
+		}
+
+		if got, want := pipelined.Load(), int32(2); got != want {
+			t.Errorf("pipelined requests: got %d, want %d", got, want)
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		t.Parallel()
+
+		h := testHelper{
+			Proxy: func(p *Proxy) {
+				p.RoundTripper = tr
+				p.RejectPipelining = true
+			},
+		}
+		conn, cancel := h.proxyConn(t)
+		defer cancel()
+		defer conn.Close()
+
+		reqs := writePipelined(t, conn, "/1", "/2")
+		br := bufio.NewReader(conn)
+
+		res, err := http.ReadResponse(br, reqs[0])
+		if err != nil {
+			t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+		}
+		io.Copy(io.Discard, res.Body) //nolint:errcheck // test
+		res.Body.Close()
+		if got, want := res.StatusCode, http.StatusOK; got != want {
+			t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+		}
+
+		res, err = http.ReadResponse(br, reqs[1])
+		if err != nil {
+			t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+		}
+		io.Copy(io.Discard, res.Body) //nolint:errcheck // test
+		res.Body.Close()
+		if got, want := res.StatusCode, http.StatusBadRequest; got != want {
+			t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+		}
+		if !res.Close {
+			t.Error("res.Close: got false, want true")
+		}
+
+		if _, err := br.ReadByte(); !errors.Is(err, io.EOF) {
+			t.Errorf("br.ReadByte(): got %v, want EOF", err)
+		}
+	})
+
+	t.Run("sequential", func(t *testing.T) {
+		t.Parallel()
+
+		var pipelined atomic.Int32
+		h := testHelper{
+			Proxy: func(p *Proxy) {
+				p.RoundTripper = tr
+				p.RejectPipelining = true
+				p.PipelinedFunc = func(*http.Request) { pipelined.Add(1) }
+			},
+		}
+		conn, cancel := h.proxyConn(t)
+		defer cancel()
+		defer conn.Close()
+
+		br := bufio.NewReader(conn)
+		for _, p := range []string{"/1", "/2", "/3"} {
+			reqs := writePipelined(t, conn, p)
+			res, err := http.ReadResponse(br, reqs[0])
+			if err != nil {
+				t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+			}
+			io.Copy(io.Discard, res.Body) //nolint:errcheck // test
+			res.Body.Close()
+			if got, want := res.StatusCode, http.StatusOK; got != want {
+				t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+			}
+		}
+
+		if got := pipelined.Load(); got != 0 {
+			t.Errorf("pipelined requests: got %d, want 0", got)
+		}
+	})
+}
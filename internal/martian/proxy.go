@@ -43,6 +43,10 @@ type Proxy struct {
 	// RoundTripper specifies the round tripper to use for requests.
 	RoundTripper http.RoundTripper
 
+	// WrapRoundTripper optionally wraps the RoundTripper for proxied requests.
+	// The RoundTripper is wrapped after it is configured, so that *http.Transport specific setup still applies.
+	WrapRoundTripper func(http.RoundTripper) http.RoundTripper
+
 	// DialContext specifies the dial function for creating unencrypted TCP connections.
 	// If not set and the RoundTripper is an *http.Transport, the Transport's DialContext is used.
 	DialContext func(context.Context, string, string) (net.Conn, error)
@@ -51,9 +55,59 @@ type Proxy struct {
 	// If not set and the RoundTripper is an *http.Transport, the Transport's ProxyURL is used.
 	ProxyURL func(*http.Request) (*url.URL, error)
 
+	// RetryConnect, if set, is called when connecting to the upstream proxy returned by ProxyURL,
+	// or to the target if there is no upstream proxy, fails.
+	// If it returns true, the request is retried, ProxyURL is called again and may return a different proxy.
+	// Requests with a body are retried only if the body can be obtained again with GetBody.
+	RetryConnect func(req *http.Request, err error) bool
+
+	// GetProxyConnectHeader optionally returns headers to add to CONNECT requests sent to upstream HTTP proxies.
+	// The CONNECT request headers are available with ContextConnectHeader.
+	// If the RoundTripper is an *http.Transport, the headers are also added to CONNECT requests sent by the Transport.
+	GetProxyConnectHeader func(ctx context.Context, proxyURL *url.URL, target string) (http.Header, error)
+
+	// ProxyConnectResponseHeaders are the headers copied from successful CONNECT responses
+	// of upstream HTTP proxies to the CONNECT response sent to the client.
+	// Non-2xx responses are sent to the client with all headers.
+	ProxyConnectResponseHeaders []string
+
+	// CopyBufferSize is the size of buffers used to copy response bodies and tunnel data.
+	// If zero, DefaultCopyBufferSize is used.
+	CopyBufferSize int
+
+	// StripTrailers removes trailers from requests sent upstream and from responses sent to the client.
+	// It is useful for origins that fail on requests with trailers.
+	StripTrailers bool
+
+	// ChunkedPassThrough relays chunked responses to plain HTTP requests with the origin's framing,
+	// preserving chunk sizes, chunk extensions and trailers instead of re-chunking the body.
+	// Eligible requests without an upstream proxy are sent over a dedicated connection that is not reused.
+	// If a modifier reads or replaces the response body, the response is re-chunked as usual.
+	ChunkedPassThrough bool
+
+	// HeaderFidelity preserves the case, order and whitespace of header fields that are not modified by the proxy,
+	// in requests sent upstream and responses sent to the client.
+	// It applies to connections served by Serve, and to plain HTTP requests without an upstream proxy,
+	// that are sent over a dedicated connection that is not reused.
+	// Header blocks that do not fit in the connection read buffer are written as usual.
+	HeaderFidelity bool
+
 	// AllowHTTP disables automatic HTTP to HTTPS upgrades when the listener is TLS.
 	AllowHTTP bool
 
+	// RejectPipelining rejects pipelined HTTP/1.1 requests, i.e. requests received before the response
+	// to the previous request on the connection is sent, with 400 Bad Request and closes the connection.
+	// Otherwise, pipelined requests are handled one at a time and the responses are sent in request order.
+	RejectPipelining bool
+
+	// PipelinedFunc is called for each pipelined request, before it is handled or rejected.
+	PipelinedFunc func(req *http.Request)
+
+	// SchemeChangeFunc is called when the request is sent upstream with a different scheme
+	// than the protocol it was received with, i.e. a request received over TLS is forwarded over plain HTTP or vice versa.
+	// It is called after the request scheme is fixed up, from is "https" if the request was received over TLS and "http" otherwise.
+	SchemeChangeFunc func(req *http.Request, from, to string)
+
 	// RequestIDHeader specifies a special header name that the proxy will use to identify requests.
 	// If the header is present in the request, the proxy will associate the value with the request in the logs.
 	// If empty, no action is taken, and the proxy will generate a new request ID.
@@ -66,6 +120,10 @@ type Proxy struct {
 	// ConnectTimeout specifies the maximum amount of time to connect to upstream before cancelling request.
 	ConnectTimeout time.Duration
 
+	// ProxyHTTP2 enables HTTP/2 for CONNECT requests to HTTPS upstream proxies that select h2 in TLS ALPN.
+	// All tunnels to a proxy are multiplexed over a single connection.
+	ProxyHTTP2 bool
+
 	// MITMConfig is config to use for MITMing of CONNECT requests.
 	MITMConfig *mitm.Config
 
@@ -82,6 +140,11 @@ type Proxy struct {
 	// ErrorResponse specifies a custom error HTTP response to send when a proxying error occurs.
 	ErrorResponse func(req *http.Request, err error) *http.Response
 
+	// WebSocketCloseFunc is called when the upstream closes a WebSocket connection with the close frame status code.
+	// If the upstream closes the connection without a close frame, it is called with WebSocketCloseAbnormal,
+	// and the client receives a close frame with WebSocketCloseGoingAway status code.
+	WebSocketCloseFunc func(ctx context.Context, code int)
+
 	// IdleTimeout is the maximum amount of time to wait for the
 	// next request. If IdleTimeout is zero, the value of ReadTimeout is used.
 	// If both are zero, there is no timeout.
@@ -123,14 +186,23 @@ type Proxy struct {
 	// TestingSkipRoundTrip skips the round trip for requests and returns a 200 OK response.
 	TestingSkipRoundTrip bool
 
+	// TestingClock replaces time.Now in request trace IDs and durations.
+	TestingClock func() time.Time
+
+	// TestingNewID replaces generation of request trace IDs, it is not used if the request has the RequestIDHeader.
+	TestingNewID func() string
+
 	initOnce sync.Once
 
-	rt        http.RoundTripper
-	conns     map[net.Conn]struct{}
-	connsWg   atomic.Int32
-	connsMu   sync.Mutex // protects connsWg.Add/Wait and conns from concurrent access
-	closeCh   chan bool
-	closeOnce sync.Once
+	rt          http.RoundTripper
+	wrt         http.RoundTripper
+	copyBufPool *sync.Pool
+	conns       map[net.Conn]struct{}
+	connsWg     atomic.Int32
+	connsMu     sync.Mutex // protects connsWg.Add/Wait and conns from concurrent access
+	closeCh     chan bool
+	closeOnce   sync.Once
+	h2Dialers   sync.Map // proxy URL -> *dialvia.HTTP2ProxyDialer
 }
 
 func (p *Proxy) init() {
@@ -160,11 +232,25 @@ func (p *Proxy) init() {
 			} else {
 				t.Proxy = p.ProxyURL
 			}
+			if p.ChunkedPassThrough || p.HeaderFidelity {
+				t.Proxy = consumeResolvedProxyURL(t.Proxy)
+			}
+			if t.Proxy != nil {
+				t.Proxy = timingProxyFunc(t.Proxy)
+			}
 			t.OnProxyConnectResponse = OnProxyConnectResponse
+			if p.GetProxyConnectHeader != nil {
+				t.GetProxyConnectHeader = mergeProxyConnectHeader(t.GetProxyConnectHeader, p.GetProxyConnectHeader)
+			}
 
 			p.rt = t
 		}
 
+		p.wrt = p.rt
+		if p.WrapRoundTripper != nil {
+			p.wrt = p.WrapRoundTripper(p.rt)
+		}
+
 		if p.DialContext == nil {
 			p.DialContext = (&net.Dialer{
 				Timeout:   30 * time.Second,
@@ -176,6 +262,8 @@ func (p *Proxy) init() {
 			p.BaseContext = context.Background()
 		}
 
+		p.copyBufPool = newCopyBufPool(p.CopyBufferSize)
+
 		p.conns = make(map[net.Conn]struct{})
 		p.connsWg.Store(0)
 		p.closeCh = make(chan bool)
@@ -244,6 +332,12 @@ func (p *Proxy) Close() error {
 			err = multierr.Append(err, e)
 		}
 	}
+	p.h2Dialers.Range(func(_, v any) bool {
+		if e := v.(io.Closer).Close(); e != nil { //nolint:forcetypeassert // only dialers are stored
+			err = multierr.Append(err, e)
+		}
+		return true
+	})
 
 	return err
 }
@@ -329,6 +423,12 @@ func (p *Proxy) handleLoop(conn net.Conn) {
 		return
 	}
 
+	if pc.cs.NegotiatedProtocol == "h2" {
+		log.Debugf(p.BaseContext, "serving HTTP/2 connection from %s", conn.RemoteAddr())
+		p.serveH2(p.BaseContext, pc.conn)
+		return
+	}
+
 	const maxConsecutiveErrors = 5
 	errorsN := 0
 	for {
@@ -407,6 +507,16 @@ func (p *Proxy) fixRequestScheme(req *http.Request) {
 			req.URL.Scheme = "https"
 		}
 	}
+
+	if p.SchemeChangeFunc != nil {
+		from := "http"
+		if req.TLS != nil {
+			from = "https"
+		}
+		if req.URL.Scheme != from {
+			p.SchemeChangeFunc(req, from, req.URL.Scheme)
+		}
+	}
 }
 
 func (p *Proxy) roundTrip(req *http.Request) (*http.Response, error) {
@@ -415,11 +525,37 @@ func (p *Proxy) roundTrip(req *http.Request) (*http.Response, error) {
 		return proxyutil.NewResponse(200, http.NoBody, req), nil
 	}
 
-	res, err := p.rt.RoundTrip(req)
+	if p.StripTrailers {
+		req.Trailer = nil
+		req.Header.Del("Te")
+	}
+
+	// Update the request in place, so that the timing is available to response modifiers via res.Request.
+	*req = *req.WithContext(withRequestTimer(req.Context()))
+
+	rt := p.wrt.RoundTrip
+	if p.shouldUseDedicatedConn(req) {
+		rt = p.roundTripDedicatedConn
+	}
+
+	res, err := rt(req)
+	for err != nil && p.RetryConnect != nil && p.RetryConnect(req, err) {
+		if !rewindBody(req) {
+			break
+		}
+		log.Debugf(req.Context(), "retrying request after connect error: %v", err)
+		res, err = rt(req)
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	if p.StripTrailers {
+		// The Trailer map is populated again when the body is read to EOF,
+		// writers must check StripTrailers before writing trailers.
+		res.Trailer = nil
+	}
+
 	if isHeaderOnlySpec(res) && res.StatusCode != http.StatusSwitchingProtocols && res.Body != http.NoBody {
 		log.Infof(req.Context(), "unexpected body in header-only response: %d, closing body", res.StatusCode)
 		res.Body.Close()
@@ -429,6 +565,23 @@ func (p *Proxy) roundTrip(req *http.Request) (*http.Response, error) {
 	return res, err
 }
 
+// rewindBody resets the request body so that the request can be sent again,
+// it returns false if the body cannot be obtained again.
+func rewindBody(req *http.Request) bool {
+	if req.Body == nil || req.Body == http.NoBody {
+		return true
+	}
+	if req.GetBody == nil {
+		return false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return false
+	}
+	req.Body = body
+	return true
+}
+
 func (p *Proxy) errorResponse(req *http.Request, err error) *http.Response {
 	var res *http.Response
 	if p.ErrorResponse != nil {
@@ -41,6 +41,13 @@ type proxyConn struct {
 	conn   net.Conn
 	secure bool
 	cs     tls.ConnectionState
+	// clientCS is the state of the TLS connection from the client, it is not changed by MITM.
+	clientCS *tls.ConnectionState
+
+	// connectAuthority is the authority of the CONNECT request if the connection is MITMed.
+	connectAuthority string
+	// connectHeader is the header of the CONNECT request if the connection is MITMed.
+	connectHeader http.Header
 }
 
 func newProxyConn(p *Proxy, conn net.Conn) *proxyConn {
@@ -69,11 +76,17 @@ func (p *proxyConn) maybeHandshakeTLS() error {
 
 	p.secure = true
 	p.cs = tconn.ConnectionState()
+	cs := p.cs
+	p.clientCS = &cs
 
 	return nil
 }
 
 func (p *proxyConn) readRequest() (*http.Request, error) {
+	// The requests are handled one at a time, and the previous request body is drained before the next request is read.
+	// Any data buffered at this point was received before the previous response was sent.
+	pipelined := p.brw.Reader.Buffered() > 0
+
 	var idleDeadline time.Time // or zero if none
 	if d := p.idleTimeout(); d > 0 {
 		idleDeadline = time.Now().Add(d)
@@ -106,6 +119,11 @@ func (p *proxyConn) readRequest() (*http.Request, error) {
 		log.Errorf(context.TODO(), "can't set read header deadline: %v", deadlineErr)
 	}
 
+	var raw *rawHeader
+	if p.HeaderFidelity {
+		raw = peekRawHeader(p.brw.Reader)
+	}
+
 	req, err := http.ReadRequest(p.brw.Reader)
 	if err != nil {
 		return nil, err
@@ -114,7 +132,21 @@ func (p *proxyConn) readRequest() (*http.Request, error) {
 	if p.secure {
 		req.TLS = &p.cs
 	}
-	req = req.WithContext(withTraceID(p.BaseContext, newTraceID(req.Header.Get(p.RequestIDHeader))))
+	ctx := withTraceID(p.BaseContext, p.newTraceID(req))
+	if p.clientCS != nil {
+		ctx = withClientTLS(ctx, p.clientCS)
+	}
+	if p.HeaderFidelity {
+		ctx = withHeaderFidelity(ctx, &headerFidelity{req: raw})
+	}
+	if p.connectAuthority != "" {
+		ctx = withConnectAuthority(ctx, p.connectAuthority)
+		ctx = withConnectHeader(ctx, p.connectHeader)
+	}
+	if pipelined {
+		ctx = withPipelined(ctx)
+	}
+	req = req.WithContext(ctx)
 
 	// Adjust the read deadline if necessary.
 	if !hdrDeadline.Equal(wholeReqDeadline) {
@@ -131,6 +163,9 @@ func (p *proxyConn) handleMITM(req *http.Request) error {
 
 	log.Debugf(ctx, "mitm: attempting MITM")
 
+	// Generate the certificate while the CONNECT response is sent and the ClientHello is received.
+	p.MITMConfig.Prefetch(ctx, req.Host)
+
 	res := newConnectResponse(req)
 
 	if err := p.modifyResponse(res); err != nil {
@@ -159,6 +194,9 @@ func (p *proxyConn) handleMITM(req *http.Request) error {
 		return errClose
 	}
 
+	p.connectAuthority = req.URL.Host
+	p.connectHeader = req.Header.Clone()
+
 	// 22 is the TLS handshake.
 	// https://tools.ietf.org/html/rfc5246#section-6.2.1
 	if len(b) > 0 && b[0] == 22 {
@@ -190,7 +228,16 @@ func (p *proxyConn) handleMITM(req *http.Request) error {
 		log.Debugf(ctx, "mitm: negotiated protocol %s", cs.NegotiatedProtocol)
 
 		if cs.NegotiatedProtocol == "h2" {
-			return p.MITMConfig.H2Config().Proxy(p.closeCh, tlsconn, req.URL)
+			if h2c := p.MITMConfig.H2Config(); h2c != nil {
+				return h2c.Proxy(p.closeCh, tlsconn, req.URL)
+			}
+
+			sctx := withConnectHeader(withConnectAuthority(p.BaseContext, p.connectAuthority), p.connectHeader)
+			if p.clientCS != nil {
+				sctx = withClientTLS(sctx, p.clientCS)
+			}
+			p.serveH2(sctx, tlsconn)
+			return errClose
 		}
 
 		p.brw.Writer.Reset(tlsconn)
@@ -272,25 +319,25 @@ func (p *proxyConn) handleUpgradeResponse(res *http.Response) error {
 }
 
 func (p *proxyConn) tunnel(name string, res *http.Response, crw io.ReadWriteCloser) error {
-	if err := p.writeResponse(res); err != nil {
+	if err := p.writeResponseTunnel(res, true); err != nil {
 		return err
 	}
 	if err := drainBuffer(crw, p.brw.Reader); err != nil {
 		err := fmt.Errorf("got error while draining read buffer: %w", err)
-		p.traceWroteResponse(res, err)
+		p.traceClosedTunnel(res, err)
 		return err
 	}
 
 	ctx := res.Request.Context()
 
 	log.Debugf(ctx, "switched protocols, proxying %s traffic", name)
-	bicopy(ctx,
+	p.bicopy(ctx,
 		copier{"upstream " + name, crw, p.conn},
-		copier{"downstream " + name, p.conn, crw},
+		copier{"downstream " + name, p.conn, p.upstreamReader(ctx, name, crw)},
 	)
 	log.Debugf(ctx, "closed %s tunnel duration=%s", name, ContextDuration(ctx))
 
-	p.traceWroteResponse(res, nil)
+	p.traceClosedTunnel(res, nil)
 
 	return nil
 }
@@ -321,6 +368,16 @@ func (p *proxyConn) handle() error {
 		req.URL.Host = req.Host
 	}
 
+	if ContextPipelined(req.Context()) {
+		if p.PipelinedFunc != nil {
+			p.PipelinedFunc(req)
+		}
+		if p.RejectPipelining {
+			log.Infof(req.Context(), "rejecting pipelined request host=%s", req.Host)
+			return p.writeResponse(newPipelinedResponse(req))
+		}
+	}
+
 	if req.Method == http.MethodConnect {
 		return p.handleConnectRequest(req)
 	}
@@ -389,6 +446,14 @@ func (p *proxyConn) handle() error {
 	return p.writeResponse(res)
 }
 
+// newPipelinedResponse returns the response rejecting a pipelined request, the connection is closed after it is sent.
+func newPipelinedResponse(req *http.Request) *http.Response {
+	res := proxyutil.NewResponse(http.StatusBadRequest, strings.NewReader("pipelined requests are not supported\n"), req)
+	res.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	res.Close = true
+	return res
+}
+
 func (p *proxyConn) writeErrorResponse(req *http.Request, err error) error {
 	res := maybeConnectErrorResponse(err)
 	if res == nil {
@@ -404,6 +469,12 @@ func (p *proxyConn) writeErrorResponse(req *http.Request, err error) error {
 }
 
 func (p *proxyConn) writeResponse(res *http.Response) error {
+	return p.writeResponseTunnel(res, false)
+}
+
+// writeResponseTunnel writes the response, if tunnel is true the response establishes a tunnel
+// and the caller must call traceClosedTunnel when the tunnel is closed.
+func (p *proxyConn) writeResponseTunnel(res *http.Response, tunnel bool) error {
 	req := res.Request
 	ctx := req.Context()
 
@@ -435,28 +506,39 @@ func (p *proxyConn) writeResponse(res *http.Response) error {
 		res.Header.Add("Connection", "close")
 	}
 
+	var (
+		w   io.Writer = p.brw.Writer
+		raw *rawHeader
+	)
+	if hf := p.headerFidelity(req); hf != nil && hf.res != nil {
+		raw = hf.res
+		w = &headerFidelityWriter{w: w, raw: raw}
+	}
+
 	var err error
 	switch {
 	case req.Method == http.MethodConnect && res.StatusCode/100 == 2:
-		err = writeConnectOKResponse(p.brw.Writer)
+		err = writeConnectOKResponse(p.brw.Writer, res.Header)
 	case isHeaderOnlySpec(res):
 		// The http package is misbehaving when writing a HEAD response.
 		// See https://github.com/golang/go/issues/62015 for details.
 		// This works around the issue by writing the response manually.
-		err = writeHeaderOnlyResponse(p.brw.Writer, res)
+		err = writeHeaderOnlyResponse(w, res)
+	case isChunkedPassThrough(res):
+		err = writeChunkedPassThroughResponse(p.brw.Writer, res, raw, p.StripTrailers)
 	default:
 		// Add support for Server Sent Events - relay HTTP chunks and flush after each chunk.
 		// This is safe for events that are smaller than the buffer io.Copy uses (32KB).
 		// If the event is larger than the buffer, the event will be split into multiple chunks.
 		switch {
 		case isTextEventStream(res):
-			w := newPatternFlushWriter(p.brw.Writer, p.brw.Writer, sseFlushPattern)
+			w := newPatternFlushWriter(w, p.brw.Writer, sseFlushPattern)
 			err = res.Write(w)
 		case shouldChunk(res):
-			w := newPatternFlushWriter(p.brw.Writer, p.brw.Writer, chunkFlushPattern)
+			w := newPatternFlushWriter(w, p.brw.Writer, chunkFlushPattern)
 			err = res.Write(w)
 		default:
-			err = res.Write(p.brw)
+			err = res.Write(w)
 		}
 	}
 	if err != nil {
@@ -465,7 +547,7 @@ func (p *proxyConn) writeResponse(res *http.Response) error {
 		err = p.brw.Flush()
 	}
 
-	p.traceWroteResponse(res, err)
+	p.traceWroteResponseTunnel(res, err, tunnel)
 
 	if err != nil {
 		if isClosedConnError(err) {
@@ -524,6 +606,9 @@ func writeHeaderOnlyResponse(w io.Writer, res *http.Response) error {
 				return err
 			}
 		}
+		if _, err := io.WriteString(w, "\r\n"); err != nil {
+			return err
+		}
 	}
 
 	// End-of-header
@@ -82,6 +82,15 @@ func (p *Proxy) Connect(ctx context.Context, req *http.Request, terminateTLS boo
 }
 
 func (p *Proxy) connect(req *http.Request) (*http.Response, net.Conn, error) {
+	res, conn, err := p.connectOnce(req)
+	for err != nil && p.RetryConnect != nil && p.RetryConnect(req, err) {
+		log.Debugf(req.Context(), "retrying CONNECT after connect error: %v", err)
+		res, conn, err = p.connectOnce(req)
+	}
+	return res, conn, err
+}
+
+func (p *Proxy) connectOnce(req *http.Request) (*http.Response, net.Conn, error) {
 	ctx := req.Context()
 
 	var proxyURL *url.URL
@@ -107,7 +116,7 @@ func (p *Proxy) connect(req *http.Request) (*http.Response, net.Conn, error) {
 	switch proxyURL.Scheme {
 	case "http", "https":
 		return p.connectHTTP(req, proxyURL)
-	case "socks5":
+	case "socks5", "socks5h":
 		return p.connectSOCKS5(req, proxyURL)
 	default:
 		return nil, nil, fmt.Errorf("unsupported proxy scheme: %s", proxyURL.Scheme)
@@ -119,6 +128,26 @@ func (p *Proxy) connectHTTP(req *http.Request, proxyURL *url.URL) (res *http.Res
 
 	log.Debugf(ctx, "CONNECT with upstream HTTP proxy: %s", proxyURL.Host)
 
+	header := req.Header.Clone()
+	if p.GetProxyConnectHeader != nil {
+		h, err := p.GetProxyConnectHeader(withConnectHeader(ctx, req.Header), proxyURL, req.URL.Host)
+		if err != nil {
+			return nil, nil, err
+		}
+		for k, v := range h {
+			header[k] = v
+		}
+	}
+
+	if proxyURL.Scheme == "https" && p.ProxyHTTP2 {
+		res, conn, err = p.h2ProxyDialer(proxyURL).DialContextR(ctx, "tcp", req.URL.Host, header)
+		if errors.Is(err, dialvia.ErrHTTP2NotSupported) {
+			log.Debugf(ctx, "upstream proxy does not support HTTP/2, using HTTP/1.1: %s", proxyURL.Host)
+		} else {
+			return p.connectHTTPResponse(req, res, conn, err)
+		}
+	}
+
 	var d *dialvia.HTTPProxyDialer
 	if proxyURL.Scheme == "https" {
 		d = dialvia.HTTPSProxy(p.DialContext, proxyURL, p.clientTLSConfig())
@@ -126,14 +155,25 @@ func (p *Proxy) connectHTTP(req *http.Request, proxyURL *url.URL) (res *http.Res
 		d = dialvia.HTTPProxy(p.DialContext, proxyURL)
 	}
 	d.Timeout = p.ConnectTimeout
-	d.ProxyConnectHeader = req.Header.Clone()
+	d.ProxyConnectHeader = header
 
 	res, conn, err = d.DialContextR(ctx, "tcp", req.URL.Host)
 
+	return p.connectHTTPResponse(req, res, conn, err)
+}
+
+func (p *Proxy) connectHTTPResponse(req *http.Request, res *http.Response, conn net.Conn, err error) (*http.Response, net.Conn, error) {
+
 	if res != nil {
 		if res.StatusCode/100 == 2 {
 			res.Body.Close()
-			return newConnectResponse(req), conn, nil
+			cres := newConnectResponse(req)
+			for _, h := range p.ProxyConnectResponseHeaders {
+				if v := res.Header.Values(h); len(v) > 0 {
+					cres.Header[http.CanonicalHeaderKey(h)] = v
+				}
+			}
+			return cres, conn, nil
 		}
 
 		// If the proxy returns a non-2xx response, return it to the client.
@@ -144,6 +184,20 @@ func (p *Proxy) connectHTTP(req *http.Request, proxyURL *url.URL) (res *http.Res
 	return res, conn, err
 }
 
+// h2ProxyDialer returns the HTTP/2 dialer for the proxy URL,
+// dialers are cached so that all tunnels to a proxy share a single connection.
+func (p *Proxy) h2ProxyDialer(proxyURL *url.URL) *dialvia.HTTP2ProxyDialer {
+	key := proxyURL.String()
+	if d, ok := p.h2Dialers.Load(key); ok {
+		return d.(*dialvia.HTTP2ProxyDialer) //nolint:forcetypeassert // only dialers are stored
+	}
+
+	d := dialvia.HTTP2Proxy(p.DialContext, proxyURL, p.clientTLSConfig())
+	d.Timeout = p.ConnectTimeout
+	v, _ := p.h2Dialers.LoadOrStore(key, d)
+	return v.(*dialvia.HTTP2ProxyDialer) //nolint:forcetypeassert // only dialers are stored
+}
+
 func (p *Proxy) clientTLSConfig() *tls.Config {
 	if tr, ok := p.rt.(*http.Transport); ok && tr.TLSClientConfig != nil {
 		return tr.TLSClientConfig.Clone()
@@ -190,8 +244,19 @@ func newConnectResponse(req *http.Request) *http.Response {
 
 var connectOKResponse = []byte("HTTP/1.1 200 OK\r\n\r\n")
 
-func writeConnectOKResponse(w io.Writer) error {
-	_, err := w.Write(connectOKResponse)
+func writeConnectOKResponse(w io.Writer, h http.Header) error {
+	if len(h) == 0 {
+		_, err := w.Write(connectOKResponse)
+		return err
+	}
+
+	if _, err := io.WriteString(w, "HTTP/1.1 200 OK\r\n"); err != nil {
+		return err
+	}
+	if err := h.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
 	return err
 }
 
@@ -254,3 +319,29 @@ func maybeConnectErrorResponse(err error) *http.Response {
 	}
 	return nil
 }
+
+// mergeProxyConnectHeader returns a function that returns headers from both functions,
+// headers from fn2 take precedence. Any of the functions can be nil.
+func mergeProxyConnectHeader(fn1, fn2 func(context.Context, *url.URL, string) (http.Header, error)) func(context.Context, *url.URL, string) (http.Header, error) {
+	if fn1 == nil {
+		return fn2
+	}
+	return func(ctx context.Context, proxyURL *url.URL, target string) (http.Header, error) {
+		h, err := fn1(ctx, proxyURL, target)
+		if err != nil {
+			return nil, err
+		}
+		h2, err := fn2(ctx, proxyURL, target)
+		if err != nil {
+			return nil, err
+		}
+		if h == nil {
+			return h2, nil
+		}
+		h = h.Clone()
+		for k, v := range h2 {
+			h[k] = v
+		}
+		return h, nil
+	}
+}
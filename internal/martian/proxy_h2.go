@@ -0,0 +1,90 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/saucelabs/forwarder/internal/martian/log"
+	"golang.org/x/net/http2"
+)
+
+// serveH2 serves an HTTP/2 connection negotiated with TLS ALPN using the proxy handler.
+// CONNECT requests are tunneled over HTTP/2 streams, see RFC 9113 section 8.5,
+// so many tunnels share a single client connection.
+// Extended CONNECT requests (RFC 8441) are rejected, as the proxy does not translate them to HTTP/1.1 upgrades.
+// MITM is not supported for tunnels over HTTP/2, CONNECT requests that would be MITMed are rejected,
+// so that they are not tunneled without the MITM based policies.
+//
+// The ctx is the parent context of requests, for MITMed connections it carries the CONNECT request context,
+// and CONNECT requests are rejected.
+func (p *Proxy) serveH2(ctx context.Context, conn net.Conn) {
+	h := proxyHandler{Proxy: p, baseContext: ctx}
+	mitm := ContextConnectAuthority(ctx) != ""
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if mitm {
+				if req.Method == http.MethodConnect {
+					http.Error(rw, "CONNECT is not supported in MITMed HTTP/2 connections", http.StatusMethodNotAllowed)
+					return
+				}
+				if req.URL.Host == "" {
+					req.URL.Host = req.Host
+				}
+			}
+			if req.Method == http.MethodConnect && req.Header.Get(":protocol") != "" {
+				log.Debugf(req.Context(), "rejecting extended CONNECT request protocol=%s", req.Header.Get(":protocol"))
+				http.Error(rw, "extended CONNECT is not supported", http.StatusNotImplemented)
+				return
+			}
+			if req.Method == http.MethodConnect && p.shouldMITM(req) {
+				log.Infof(req.Context(), "rejecting CONNECT request over HTTP/2 to MITM host %s", req.Host)
+				http.Error(rw, "MITM is not supported over HTTP/2", http.StatusHTTPVersionNotSupported)
+				return
+			}
+			h.ServeHTTP(rw, req)
+		}),
+		IdleTimeout:       p.idleTimeout(),
+		ReadTimeout:       p.ReadTimeout,
+		ReadHeaderTimeout: p.readHeaderTimeout(),
+		WriteTimeout:      p.WriteTimeout,
+	}
+	h2s := new(http2.Server)
+	if err := http2.ConfigureServer(srv, h2s); err != nil {
+		log.Errorf(ctx, "failed to configure HTTP/2 server: %v", err)
+		return
+	}
+
+	// Send GOAWAY when the proxy is closing, the connection is closed after the active streams complete.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-p.closeCh:
+			srv.Shutdown(context.Background()) //nolint:errcheck // the server does not track connections
+		case <-done:
+		}
+	}()
+
+	h2s.ServeConn(conn, &http2.ServeConnOpts{
+		Context:    ctx,
+		BaseConfig: srv,
+	})
+}
@@ -17,9 +17,11 @@
 package martian
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptrace"
 	"strings"
 
 	"github.com/saucelabs/forwarder/internal/martian/log"
@@ -51,14 +53,14 @@ func addTrailerHeader(rw http.ResponseWriter, tr http.Header) int {
 	return announcedTrailers
 }
 
-func copyBody(w io.Writer, body io.ReadCloser) error {
+func (p *Proxy) copyBody(w io.Writer, body io.ReadCloser) error {
 	if body == http.NoBody {
 		return nil
 	}
 
-	bufp := copyBufPool.Get().(*[]byte) //nolint:forcetypeassert // It's *[]byte.
+	bufp := p.copyBufPool.Get().(*[]byte) //nolint:forcetypeassert // It's *[]byte.
 	buf := *bufp
-	defer copyBufPool.Put(bufp)
+	defer p.copyBufPool.Put(bufp)
 
 	_, err := io.CopyBuffer(w, body, buf)
 	return err
@@ -68,21 +70,30 @@ func copyBody(w io.Writer, body io.ReadCloser) error {
 //
 // Known limitations:
 //   - MITM is not supported
-//   - HTTP status code 100 is not supported, see [issue 2184]
 //
-// [issue 2184]: https://github.com/golang/go/issues/2184
+// Expect: 100-continue requests are relayed to upstream,
+// and the 100 Continue response is relayed to the client when it is received from upstream.
+// If upstream does not respond in time, http.Server sends 100 Continue when the body is read.
 type proxyHandler struct {
 	*Proxy
+
+	// baseContext overrides Proxy.BaseContext as the parent context of requests,
+	// it carries the CONNECT request context for requests read from a MITMed HTTP/2 connection.
+	baseContext context.Context
 }
 
 // Handler returns proxy as http.Handler, see [proxyHandler] for details.
 func (p *Proxy) Handler() http.Handler {
 	p.init()
-	return proxyHandler{p}
+	return proxyHandler{Proxy: p}
 }
 
 func (p proxyHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	outreq := req.Clone(withTraceID(p.BaseContext, newTraceID(req.Header.Get(p.RequestIDHeader))))
+	ctx := p.BaseContext
+	if p.baseContext != nil {
+		ctx = p.baseContext
+	}
+	outreq := req.Clone(withTraceID(ctx, p.newTraceID(req)))
 	if req.ContentLength == 0 {
 		outreq.Body = http.NoBody
 	}
@@ -90,6 +101,8 @@ func (p proxyHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		defer outreq.Body.Close()
 	}
 	outreq.Close = false
+	// Share the Trailer map with req, it is populated by http.Server when the body is read to EOF.
+	outreq.Trailer = req.Trailer
 
 	fixConnectReqContentLength(outreq)
 
@@ -160,8 +173,15 @@ func (p proxyHandler) handleUpgradeResponse(rw http.ResponseWriter, req *http.Re
 func (p proxyHandler) tunnel(name string, rw http.ResponseWriter, req *http.Request, res *http.Response, crw io.ReadWriteCloser) (ferr error) {
 	rc := http.NewResponseController(rw)
 
+	// The response is traced when the tunnel is established, or when the tunnel fails to be established.
+	var established, traced bool
 	defer func() {
-		p.traceWroteResponse(res, ferr)
+		switch {
+		case established:
+			p.traceClosedTunnel(res, ferr)
+		case !traced:
+			p.traceWroteResponse(res, ferr)
+		}
 	}()
 
 	var cc []copier
@@ -178,9 +198,11 @@ func (p proxyHandler) tunnel(name string, rw http.ResponseWriter, req *http.Requ
 			brw:   brw,
 			conn:  conn,
 		}
-		if err := pc.writeResponse(res); err != nil {
+		traced = true
+		if err := pc.writeResponseTunnel(res, true); err != nil {
 			return err
 		}
+		established = true
 
 		if err := drainBuffer(crw, brw.Reader); err != nil {
 			return fmt.Errorf("got error while draining buffer: %w", err)
@@ -188,7 +210,7 @@ func (p proxyHandler) tunnel(name string, rw http.ResponseWriter, req *http.Requ
 
 		cc = []copier{
 			{"upstream " + name, crw, conn},
-			{"downstream " + name, conn, crw},
+			{"downstream " + name, conn, p.upstreamReader(req.Context(), name, crw)},
 		}
 	case 2:
 		copyHeader(rw.Header(), res.Header)
@@ -197,10 +219,13 @@ func (p proxyHandler) tunnel(name string, rw http.ResponseWriter, req *http.Requ
 		if err := rc.Flush(); err != nil {
 			return fmt.Errorf("got error while flushing response back to client: %w", err)
 		}
+		traced = true
+		p.traceWroteResponseTunnel(res, nil, true)
+		established = true
 
 		cc = []copier{
 			{"upstream " + name, crw, req.Body},
-			{"downstream " + name, makeH2Writer(rw, rc, req), crw},
+			{"downstream " + name, makeH2Writer(rw, rc, req), p.upstreamReader(req.Context(), name, crw)},
 		}
 	default:
 		return fmt.Errorf("unsupported protocol version: %d", req.ProtoMajor)
@@ -209,12 +234,28 @@ func (p proxyHandler) tunnel(name string, rw http.ResponseWriter, req *http.Requ
 	ctx := req.Context()
 
 	log.Debugf(ctx, "established %s tunnel, proxying traffic", name)
-	bicopy(ctx, cc...)
+	p.bicopy(ctx, cc...)
 	log.Debugf(ctx, "closed %s tunnel duration=%s", name, ContextDuration(ctx))
 
 	return nil
 }
 
+func expectsContinue(req *http.Request) bool {
+	return req.ContentLength != 0 && strings.EqualFold(req.Header.Get("Expect"), "100-continue")
+}
+
+// withGot100Continue returns a context that relays 100 Continue responses from upstream to the client.
+// Writing 100 Continue disables the automatic 100 Continue response sent by http.Server on the first body read.
+// The trace hook is called by the transport before RoundTrip returns, so it does not race with the handler.
+func withGot100Continue(ctx context.Context, rw http.ResponseWriter) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		Got100Continue: func() {
+			log.Debugf(ctx, "relaying 100 Continue response")
+			rw.WriteHeader(http.StatusContinue)
+		},
+	})
+}
+
 // handleRequest handles a request and writes the response to the given http.ResponseWriter.
 // It returns an error if the request.
 func (p proxyHandler) handleRequest(rw http.ResponseWriter, req *http.Request) {
@@ -252,6 +293,10 @@ func (p proxyHandler) handleRequest(rw http.ResponseWriter, req *http.Request) {
 		req.Header.Set("Upgrade", reqUpType)
 	}
 
+	if expectsContinue(req) {
+		req = req.WithContext(withGot100Continue(ctx, rw))
+	}
+
 	// perform the HTTP roundtrip
 	res, err := p.roundTrip(req)
 	if err != nil {
@@ -335,6 +380,20 @@ func (w h2Writer) CloseWrite() error {
 	return w.close()
 }
 
+func writeTrailers(rw http.ResponseWriter, tr http.Header, announcedTrailers int) {
+	if len(tr) == announcedTrailers {
+		copyHeader(rw.Header(), tr)
+		return
+	}
+
+	h := rw.Header()
+	for k, vv := range tr {
+		for _, v := range vv {
+			h.Add(http.TrailerPrefix+k, v)
+		}
+	}
+}
+
 func (p proxyHandler) writeErrorResponse(rw http.ResponseWriter, req *http.Request, err error) {
 	res := maybeConnectErrorResponse(err)
 	if res == nil {
@@ -364,12 +423,12 @@ func (p proxyHandler) writeResponse(rw http.ResponseWriter, res *http.Response)
 	switch {
 	case isTextEventStream(res):
 		w := newPatternFlushWriter(rw, http.NewResponseController(rw), sseFlushPattern)
-		err = copyBody(w, res.Body)
+		err = p.copyBody(w, res.Body)
 	case shouldChunk(res):
 		w := newPatternFlushWriter(rw, http.NewResponseController(rw), chunkFlushPattern)
-		err = copyBody(w, res.Body)
+		err = p.copyBody(w, res.Body)
 	default:
-		err = copyBody(rw, res.Body)
+		err = p.copyBody(rw, res.Body)
 	}
 
 	if err != nil {
@@ -383,15 +442,8 @@ func (p proxyHandler) writeResponse(rw http.ResponseWriter, res *http.Response)
 	}
 
 	res.Body.Close() // close now, instead of defer, to populate res.Trailer
-	if len(res.Trailer) == announcedTrailers {
-		copyHeader(rw.Header(), res.Trailer)
-	} else {
-		h := rw.Header()
-		for k, vv := range res.Trailer {
-			for _, v := range vv {
-				h.Add(http.TrailerPrefix+k, v)
-			}
-		}
+	if !p.StripTrailers {
+		writeTrailers(rw, res.Trailer, announcedTrailers)
 	}
 
 	p.traceWroteResponse(res, err)
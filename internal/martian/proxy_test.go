@@ -24,8 +24,10 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"maps"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"strings"
@@ -37,6 +39,7 @@ import (
 	"github.com/saucelabs/forwarder/internal/martian/mitm"
 	"github.com/saucelabs/forwarder/internal/martian/proxyutil"
 	"go.uber.org/multierr"
+	"golang.org/x/net/http2"
 )
 
 var (
@@ -274,10 +277,6 @@ func TestIntegrationHTTP(t *testing.T) {
 func TestIntegrationHTTP100Continue(t *testing.T) {
 	t.Parallel()
 
-	if *withHandler {
-		t.Skip("skipping in handler mode")
-	}
-
 	tm := martiantest.NewModifier()
 	h := testHelper{
 		Proxy: func(p *Proxy) {
@@ -351,7 +350,18 @@ func TestIntegrationHTTP100Continue(t *testing.T) {
 		conn.Write([]byte("body content"))
 	}()
 
-	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	br := bufio.NewReader(conn)
+	if *withHandler {
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+		}
+		if got, want := res.StatusCode, 100; got != want {
+			t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+		}
+	}
+
+	res, err := http.ReadResponse(br, nil)
 	if err != nil {
 		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
 	}
@@ -378,6 +388,153 @@ func TestIntegrationHTTP100Continue(t *testing.T) {
 	}
 }
 
+func TestIntegrationTrailers(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, err := io.Copy(io.Discard, req.Body); err != nil {
+			t.Errorf("io.Copy(): got %v, want no error", err)
+		}
+		w.Header().Set("Trailer", "Res-Trailer")
+		w.Header().Set("Got-Te", req.Header.Get("Te"))
+		w.Header().Set("Got-Req-Trailer", req.Trailer.Get("Req-Trailer"))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("body"))
+		w.Header().Set("Res-Trailer", "res")
+	}))
+	t.Cleanup(upstream.Close)
+
+	tests := []struct {
+		name  string
+		strip bool
+		want  map[string]string
+	}{
+		{
+			name: "relay",
+			want: map[string]string{
+				"Got-Te":          "trailers",
+				"Got-Req-Trailer": "req",
+				"Res-Trailer":     "res",
+			},
+		},
+		{
+			name:  "strip",
+			strip: true,
+			want:  map[string]string{},
+		},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			h := testHelper{
+				Proxy: func(p *Proxy) {
+					p.AllowHTTP = true
+					p.StripTrailers = tc.strip
+				},
+			}
+
+			conn, cancel := h.proxyConn(t)
+			defer cancel()
+			defer conn.Close()
+
+			host := upstream.Listener.Addr().String()
+			raw := fmt.Sprintf("POST http://%s/ HTTP/1.1\r\n"+
+				"Host: %s\r\n"+
+				"Te: trailers\r\n"+
+				"Trailer: Req-Trailer\r\n"+
+				"Transfer-Encoding: chunked\r\n\r\n"+
+				"4\r\nbody\r\n0\r\n"+
+				"Req-Trailer: req\r\n\r\n", host, host)
+			if _, err := conn.Write([]byte(raw)); err != nil {
+				t.Fatalf("conn.Write(): got %v, want no error", err)
+			}
+
+			res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+			}
+			defer res.Body.Close()
+			if _, err := io.ReadAll(res.Body); err != nil {
+				t.Fatalf("io.ReadAll(): got %v, want no error", err)
+			}
+
+			got := map[string]string{}
+			for _, k := range []string{"Got-Te", "Got-Req-Trailer"} {
+				if v := res.Header.Get(k); v != "" {
+					got[k] = v
+				}
+			}
+			if v := res.Trailer.Get("Res-Trailer"); v != "" {
+				got["Res-Trailer"] = v
+			}
+			if !maps.Equal(got, tc.want) {
+				t.Errorf("headers and trailers: got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIntegrationRequestTiming(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	var (
+		timing RequestTiming
+		ok     bool
+	)
+	tm := martiantest.NewModifier()
+	tm.ResponseFunc(func(res *http.Response) {
+		timing, ok = ContextRequestTiming(res.Request.Context())
+	})
+
+	h := testHelper{
+		Proxy: func(p *Proxy) {
+			p.AllowHTTP = true
+			p.ResponseModifier = tm
+		},
+	}
+
+	conn, cancel := h.proxyConn(t)
+	defer cancel()
+	defer conn.Close()
+
+	req, err := http.NewRequest(http.MethodGet, upstream.URL, http.NoBody)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	res.Body.Close()
+
+	if !ok {
+		t.Fatal("ContextRequestTiming(): got false, want true")
+	}
+	if got, want := timing.Upstream, "direct"; got != want {
+		t.Errorf("timing.Upstream: got %q, want %q", got, want)
+	}
+	if got, want := timing.Addr, upstream.Listener.Addr().String(); got != want {
+		t.Errorf("timing.Addr: got %q, want %q", got, want)
+	}
+	if timing.Connect <= 0 || timing.TTFB <= 0 {
+		t.Errorf("timing: got connect=%s ttfb=%s, want both positive", timing.Connect, timing.TTFB)
+	}
+	if timing.Reused {
+		t.Error("timing.Reused: got true, want false")
+	}
+}
+
 func TestIntegrationHTTP101SwitchingProtocols(t *testing.T) {
 	t.Parallel()
 
@@ -997,6 +1154,54 @@ func connect(t *testing.T, conn net.Conn) *http.Response {
 	return res
 }
 
+func TestIntegrationConnectUpstreamProxyResponseHeaders(t *testing.T) {
+	t.Parallel()
+
+	if *withHandler {
+		t.Skip("skipping in handler mode")
+	}
+
+	ul, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	defer ul.Close()
+
+	go func() {
+		conn, err := ul.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nX-Egress-Ip: 192.0.2.1\r\nX-Other: foo\r\n\r\n"))
+	}()
+
+	h := testHelper{
+		Proxy: func(p *Proxy) {
+			p.ProxyURL = http.ProxyURL(&url.URL{Scheme: "http", Host: ul.Addr().String()})
+			p.ProxyConnectResponseHeaders = []string{"x-egress-ip"}
+		},
+	}
+	conn, cancel := h.proxyConn(t)
+	defer cancel()
+	defer conn.Close()
+
+	res := connect(t, conn)
+
+	if got, want := res.StatusCode, 200; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+	if got, want := res.Header.Get("X-Egress-Ip"), "192.0.2.1"; got != want {
+		t.Errorf("res.Header.Get(X-Egress-Ip): got %q, want %q", got, want)
+	}
+	if got := res.Header.Get("X-Other"); got != "" {
+		t.Errorf("res.Header.Get(X-Other): got %q, want empty", got)
+	}
+}
+
 func TestIntegrationConnectUpstreamProxy(t *testing.T) {
 	t.Parallel()
 
@@ -1179,6 +1384,138 @@ func TestIntegrationConnectFunc(t *testing.T) {
 	}
 }
 
+func TestIntegrationConnectH2(t *testing.T) {
+	t.Parallel()
+
+	ca, mc := certs(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	scfg := mc.TLS(context.Background())
+	scfg.NextProtos = []string{"h2", "http/1.1"}
+	l = tls.NewListener(l, scfg)
+
+	p := new(Proxy)
+	p.ConnectFunc = func(req *http.Request) (*http.Response, io.ReadWriteCloser, error) {
+		pr, pw := io.Pipe()
+		return newConnectResponse(req), pipeConn{pr, pw}, nil
+	}
+	go p.Serve(l)
+	defer p.Close()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		ServerName: "example.com",
+		RootCAs:    roots,
+		NextProtos: []string{"h2"},
+	})
+	if err != nil {
+		t.Fatalf("tls.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+	if got := conn.ConnectionState().NegotiatedProtocol; got != "h2" {
+		t.Fatalf("NegotiatedProtocol: got %q, want h2", got)
+	}
+
+	var tr http2.Transport
+	cc, err := tr.NewClientConn(conn)
+	if err != nil {
+		t.Fatalf("tr.NewClientConn(): got %v, want no error", err)
+	}
+	defer cc.Close()
+
+	// Tunnels are multiplexed over the same connection.
+	for i := range 3 {
+		pr, pw := io.Pipe()
+		req, err := http.NewRequest(http.MethodConnect, "https://example.com:443", pr)
+		if err != nil {
+			t.Fatalf("http.NewRequest(): got %v, want no error", err)
+		}
+		req.URL.Scheme = ""
+		req.URL.Path = ""
+
+		res, err := cc.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("cc.RoundTrip(): got %v, want no error", err)
+		}
+		if got, want := res.StatusCode, 200; got != want {
+			t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+		}
+
+		want := fmt.Sprintf("tunnel %d", i)
+		if _, err := io.WriteString(pw, want); err != nil {
+			t.Fatalf("pw.Write(): got %v, want no error", err)
+		}
+		buf := make([]byte, len(want))
+		if _, err := io.ReadFull(res.Body, buf); err != nil {
+			t.Fatalf("res.Body.Read(): got %v, want no error", err)
+		}
+		if string(buf) != want {
+			t.Errorf("res.Body.Read(): got %q, want %q", buf, want)
+		}
+
+		pw.Close()
+		res.Body.Close()
+	}
+}
+
+func TestIntegrationConnectH2MITM(t *testing.T) {
+	t.Parallel()
+
+	ca, mc := certs(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	scfg := mc.TLS(context.Background())
+	scfg.NextProtos = []string{"h2", "http/1.1"}
+	l = tls.NewListener(l, scfg)
+
+	p := new(Proxy)
+	p.MITMConfig = mc
+	go p.Serve(l)
+	defer p.Close()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		ServerName: "example.com",
+		RootCAs:    roots,
+		NextProtos: []string{"h2"},
+	})
+	if err != nil {
+		t.Fatalf("tls.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	var tr http2.Transport
+	cc, err := tr.NewClientConn(conn)
+	if err != nil {
+		t.Fatalf("tr.NewClientConn(): got %v, want no error", err)
+	}
+	defer cc.Close()
+
+	req, err := http.NewRequest(http.MethodConnect, "https://example.com:443", http.NoBody)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	req.URL.Scheme = ""
+	req.URL.Path = ""
+
+	res, err := cc.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("cc.RoundTrip(): got %v, want no error", err)
+	}
+	res.Body.Close()
+	if got, want := res.StatusCode, http.StatusHTTPVersionNotSupported; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+}
+
 func TestIntegrationConnectTerminateTLS(t *testing.T) {
 	t.Parallel()
 
@@ -1408,6 +1745,104 @@ func TestIntegrationMITM(t *testing.T) {
 	})
 }
 
+func TestIntegrationMITMHTTP2(t *testing.T) {
+	t.Parallel()
+
+	if *withHandler {
+		t.Skip("skipping in handler mode")
+	}
+
+	tr := martiantest.NewTransport()
+	tr.Func(func(req *http.Request) (*http.Response, error) {
+		res := proxyutil.NewResponse(200, nil, req)
+		res.Header.Set("Request-Scheme", req.URL.Scheme)
+		res.Header.Set("Request-Host", req.URL.Host)
+		res.Header.Set("Connect-Authority", ContextConnectAuthority(req.Context()))
+
+		return res, nil
+	})
+
+	ca, mc := certs(t)
+	mc.SetHostPolicy(func(hostname string) mitm.HostPolicy {
+		return mitm.HostPolicy{HTTP2: hostname == "example.com"}
+	})
+
+	h := testHelper{
+		Proxy: func(p *Proxy) {
+			p.RoundTripper = tr
+			p.MITMConfig = mc
+		},
+	}
+
+	c, cancel := h.proxyClient(t)
+	t.Cleanup(cancel)
+
+	conn := c.dial(t)
+	defer conn.Close()
+
+	req, err := http.NewRequest(http.MethodConnect, "//example.com:443", http.NoBody)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("req.Write(): got %v, want no error", err)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	if got, want := res.StatusCode, 200; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	tlsconn := tls.Client(conn, &tls.Config{
+		ServerName: "example.com",
+		RootCAs:    roots,
+		NextProtos: []string{"h2", "http/1.1"},
+	})
+	defer tlsconn.Close()
+	if err := tlsconn.Handshake(); err != nil {
+		t.Fatalf("tlsconn.Handshake(): got %v, want no error", err)
+	}
+	if got := tlsconn.ConnectionState().NegotiatedProtocol; got != "h2" {
+		t.Fatalf("NegotiatedProtocol: got %q, want h2", got)
+	}
+
+	var h2t http2.Transport
+	cc, err := h2t.NewClientConn(tlsconn)
+	if err != nil {
+		t.Fatalf("h2t.NewClientConn(): got %v, want no error", err)
+	}
+	defer cc.Close()
+
+	for range 2 {
+		req, err := http.NewRequest(http.MethodGet, "https://example.com/", http.NoBody)
+		if err != nil {
+			t.Fatalf("http.NewRequest(): got %v, want no error", err)
+		}
+		res, err := cc.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("cc.RoundTrip(): got %v, want no error", err)
+		}
+		res.Body.Close()
+
+		if got, want := res.StatusCode, 200; got != want {
+			t.Errorf("res.StatusCode: got %d, want %d", got, want)
+		}
+		if got, want := res.Header.Get("Request-Scheme"), "https"; got != want {
+			t.Errorf("res.Header.Get(%q): got %q, want %q", "Request-Scheme", got, want)
+		}
+		if got, want := res.Header.Get("Request-Host"), "example.com"; got != want {
+			t.Errorf("res.Header.Get(%q): got %q, want %q", "Request-Host", got, want)
+		}
+		if got, want := res.Header.Get("Connect-Authority"), "example.com:443"; got != want {
+			t.Errorf("res.Header.Get(%q): got %q, want %q", "Connect-Authority", got, want)
+		}
+	}
+}
+
 func TestIntegrationTransparentHTTP(t *testing.T) {
 	t.Parallel()
 
@@ -1787,6 +2222,66 @@ func TestHTTPThroughConnectWithMITM(t *testing.T) {
 	}
 }
 
+func TestConnectAuthorityWithMITM(t *testing.T) {
+	t.Parallel()
+
+	tm := martiantest.NewModifier()
+	tm.RequestFunc(func(req *http.Request) {
+		want := ""
+		if req.Method != http.MethodConnect {
+			want = "example.com:80"
+		}
+		if got := ContextConnectAuthority(req.Context()); got != want {
+			t.Errorf("ContextConnectAuthority(): got %q, want %q", got, want)
+		}
+	})
+
+	_, mc := certs(t)
+	h := testHelper{
+		Proxy: func(p *Proxy) {
+			p.TestingSkipRoundTrip = true
+			p.RequestModifier = tm
+			p.MITMConfig = mc
+		},
+	}
+
+	conn, cancel := h.proxyConn(t)
+	defer cancel()
+	defer conn.Close()
+
+	req, err := http.NewRequest(http.MethodConnect, "//example.com:80", http.NoBody)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("req.Write(): got %v, want no error", err)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	res.Body.Close()
+
+	// GET http://other.com/ HTTP/1.1
+	// Host: other.com
+	req, err = http.NewRequest(http.MethodGet, "http://other.com", http.NoBody)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+	}
+	res, err = http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	res.Body.Close()
+
+	if !tm.RequestModified() {
+		t.Error("tm.RequestModified(): got false, want true")
+	}
+}
+
 func TestTLSHandshakeTimeoutWithMITM(t *testing.T) {
 	t.Parallel()
 
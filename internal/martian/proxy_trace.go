@@ -17,7 +17,12 @@ type ProxyTrace struct {
 
 	// WroteResponse is called with the result of writing the response.
 	// It is called after the response has been written.
+	// For CONNECT and protocol upgrade requests, it is called when the tunnel is established.
 	WroteResponse func(WroteResponseInfo)
+
+	// ClosedTunnel is called after a tunnel established by a CONNECT
+	// or protocol upgrade request is closed.
+	ClosedTunnel func(ClosedTunnelInfo)
 }
 
 type ReadRequestInfo struct {
@@ -41,11 +46,35 @@ type WroteResponseInfo struct {
 	Res *http.Response
 	// Err is any error encountered while writing the Request.
 	Err error
+	// Tunnel is true if the response established a tunnel,
+	// ClosedTunnel is called when the tunnel is closed.
+	Tunnel bool
 }
 
 func (p *Proxy) traceWroteResponse(res *http.Response, err error) {
+	p.traceWroteResponseTunnel(res, err, false)
+}
+
+func (p *Proxy) traceWroteResponseTunnel(res *http.Response, err error, tunnel bool) {
 	if p.Trace != nil && p.Trace.WroteResponse != nil {
 		p.Trace.WroteResponse(WroteResponseInfo{
+			Res:    res,
+			Err:    err,
+			Tunnel: tunnel && err == nil,
+		})
+	}
+}
+
+type ClosedTunnelInfo struct {
+	// Res is the response that established the tunnel.
+	Res *http.Response
+	// Err is any error encountered while proxying the tunnel traffic.
+	Err error
+}
+
+func (p *Proxy) traceClosedTunnel(res *http.Response, err error) {
+	if p.Trace != nil && p.Trace.ClosedTunnel != nil {
+		p.Trace.ClosedTunnel(ClosedTunnelInfo{
 			Res: res,
 			Err: err,
 		})
@@ -0,0 +1,139 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// RequestTiming describes the upstream round trip of a request.
+// Durations are zero if the phase did not happen,
+// e.g. there is no DNS lookup for IP addresses and no connect or TLS handshake for reused connections.
+// If the request is sent through an upstream proxy, DNS and connect refer to the proxy.
+type RequestTiming struct {
+	// Upstream is the redacted URL of the upstream proxy, or "direct" if the request was sent directly.
+	// It is empty if the transport does not use a proxy function.
+	Upstream string
+	// Addr is the remote address of the upstream connection.
+	Addr string
+	// Reused is true if the upstream connection was taken from the idle pool.
+	Reused bool
+
+	// Queue is the time from reading the request to the start of the round trip,
+	// it includes running request modifiers.
+	Queue   time.Duration
+	DNS     time.Duration
+	Connect time.Duration
+	TLS     time.Duration
+	// TTFB is the time from the start of the round trip to the first response byte.
+	TTFB time.Duration
+}
+
+type requestTimingContextKey struct{}
+
+// requestTimer collects RequestTiming, the hooks may be called from transport goroutines.
+type requestTimer struct {
+	mu sync.Mutex
+	t  RequestTiming
+
+	start, dnsStart, connectStart, tlsStart time.Time
+}
+
+func withRequestTimer(ctx context.Context) context.Context {
+	rt := &requestTimer{start: time.Now()}
+	rt.t.Queue = ContextDuration(ctx)
+	ctx = httptrace.WithClientTrace(ctx, rt.clientTrace())
+	return context.WithValue(ctx, requestTimingContextKey{}, rt)
+}
+
+// ContextRequestTiming returns the timing of the upstream round trip of the request with the context.
+// It returns false if the request was not sent upstream, e.g. it was denied by a modifier.
+// It is available to response modifiers, and the values are final once the response is received.
+func ContextRequestTiming(ctx context.Context) (RequestTiming, bool) {
+	rt, ok := ctx.Value(requestTimingContextKey{}).(*requestTimer)
+	if !ok {
+		return RequestTiming{}, false
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.t, true
+}
+
+func (rt *requestTimer) update(fn func(now time.Time)) {
+	now := time.Now()
+	rt.mu.Lock()
+	fn(now)
+	rt.mu.Unlock()
+}
+
+func (rt *requestTimer) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			rt.update(func(now time.Time) { rt.dnsStart = now })
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			rt.update(func(now time.Time) { rt.t.DNS = now.Sub(rt.dnsStart) })
+		},
+		ConnectStart: func(string, string) {
+			rt.update(func(now time.Time) { rt.connectStart = now })
+		},
+		ConnectDone: func(string, string, error) {
+			rt.update(func(now time.Time) { rt.t.Connect = now.Sub(rt.connectStart) })
+		},
+		TLSHandshakeStart: func() {
+			rt.update(func(now time.Time) { rt.tlsStart = now })
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			rt.update(func(now time.Time) { rt.t.TLS = now.Sub(rt.tlsStart) })
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			rt.update(func(time.Time) {
+				rt.t.Reused = info.Reused
+				if info.Conn != nil {
+					rt.t.Addr = info.Conn.RemoteAddr().String()
+				}
+			})
+		},
+		GotFirstResponseByte: func() {
+			rt.update(func(now time.Time) { rt.t.TTFB = now.Sub(rt.start) })
+		},
+	}
+}
+
+// timingProxyFunc records the upstream proxy selected by fn in the request timing.
+func timingProxyFunc(fn func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		u, err := fn(req)
+		if rt, ok := req.Context().Value(requestTimingContextKey{}).(*requestTimer); ok && err == nil {
+			rt.update(func(time.Time) {
+				if u == nil {
+					rt.t.Upstream = "direct"
+				} else {
+					rt.t.Upstream = u.Redacted()
+				}
+			})
+		}
+		return u, err
+	}
+}
@@ -5,6 +5,7 @@ package martian
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"sync/atomic"
 	"time"
 
@@ -15,12 +16,13 @@ import (
 type traceID struct {
 	id        string
 	createdAt time.Time
+	now       func() time.Time
 }
 
 var idSeq atomic.Uint64
 
-func newTraceID(id string) traceID {
-	t := time.Now()
+func newTraceID(id string, now func() time.Time) traceID {
+	t := now()
 	n := idSeq.Add(1)
 
 	if id == "" {
@@ -30,15 +32,31 @@ func newTraceID(id string) traceID {
 	return traceID{
 		id:        id,
 		createdAt: t,
+		now:       now,
 	}
 }
 
+// newTraceID returns the trace ID of the request, the ID is taken from the RequestIDHeader if present.
+func (p *Proxy) newTraceID(req *http.Request) traceID {
+	now := time.Now
+	if p.TestingClock != nil {
+		now = p.TestingClock
+	}
+
+	id := req.Header.Get(p.RequestIDHeader)
+	if id == "" && p.TestingNewID != nil {
+		id = p.TestingNewID()
+	}
+
+	return newTraceID(id, now)
+}
+
 func (t traceID) String() string {
 	return t.id
 }
 
 func (t traceID) Duration() time.Duration {
-	return time.Since(t.createdAt)
+	return t.now().Sub(t.createdAt)
 }
 
 type TraceIDPrependingLogger struct {
@@ -0,0 +1,218 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"syscall"
+
+	"github.com/saucelabs/forwarder/internal/martian/log"
+)
+
+// WebSocket close codes reported to Proxy.WebSocketCloseFunc, see RFC 6455 section 7.4.1.
+const (
+	// WebSocketCloseGoingAway is sent to the client if the upstream closes the connection without a close frame.
+	WebSocketCloseGoingAway = 1001
+
+	// WebSocketCloseNoStatus is reported if the close frame has no status code.
+	WebSocketCloseNoStatus = 1005
+
+	// WebSocketCloseAbnormal is reported if the upstream closes the connection without a close frame.
+	WebSocketCloseAbnormal = 1006
+)
+
+const wsOpClose = 0x8
+
+func isWebSocket(upgradeType string) bool {
+	return strings.EqualFold(upgradeType, "websocket")
+}
+
+// upstreamReader returns the reader of the upstream side of a tunnel.
+func (p *Proxy) upstreamReader(ctx context.Context, name string, r io.Reader) io.Reader {
+	if p.WebSocketCloseFunc == nil || !isWebSocket(name) {
+		return r
+	}
+	return newWSCloseReader(r, func(code int) {
+		if code == WebSocketCloseAbnormal {
+			log.Infof(ctx, "upstream closed %s connection without a close frame, sending going away close frame", name)
+		} else {
+			log.Debugf(ctx, "upstream closed %s connection code=%d", name, code)
+		}
+		p.WebSocketCloseFunc(ctx, code)
+	})
+}
+
+// wsCloseReader reads WebSocket frames sent by the upstream and reports the close frame status code.
+// If the upstream closes the connection without a close frame at a frame boundary,
+// it emits a going away close frame, so that the client sees a clean closure instead of a dropped connection.
+type wsCloseReader struct {
+	r       io.Reader
+	onClose func(code int)
+
+	hdr       [14]byte
+	hdrLen    int
+	inPayload bool
+	left      uint64
+	opcode    byte
+	masked    bool
+	mask      [4]byte
+	pos       uint64
+	code      []byte
+	sawClose  bool
+
+	pending []byte
+	err     error
+}
+
+func newWSCloseReader(r io.Reader, onClose func(code int)) *wsCloseReader {
+	return &wsCloseReader{
+		r:       r,
+		onClose: onClose,
+	}
+}
+
+func (w *wsCloseReader) Read(p []byte) (int, error) {
+	if w.pending != nil {
+		n := copy(p, w.pending)
+		w.pending = w.pending[n:]
+		if len(w.pending) == 0 {
+			w.pending = nil
+		}
+		return n, nil
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	n, err := w.r.Read(p)
+	w.scan(p[:n])
+	if err != nil {
+		w.err = err
+		if !w.sawClose && !w.inPayload && w.hdrLen == 0 && isUpstreamGone(err) {
+			w.sawClose = true
+			w.onClose(WebSocketCloseAbnormal)
+			w.pending = []byte{0x80 | wsOpClose, 2, 0, 0}
+			binary.BigEndian.PutUint16(w.pending[2:], WebSocketCloseGoingAway)
+		}
+		if n > 0 || w.pending != nil {
+			err = nil
+		}
+	}
+	return n, err
+}
+
+// isUpstreamGone reports whether err indicates the peer closed the connection,
+// as opposed to the connection being closed locally.
+func isUpstreamGone(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// scan advances the frame parser over b.
+func (w *wsCloseReader) scan(b []byte) {
+	for len(b) > 0 && !w.sawClose {
+		if !w.inPayload {
+			w.hdr[w.hdrLen] = b[0]
+			w.hdrLen++
+			b = b[1:]
+			if w.hdrLen < 2 || w.hdrLen < w.headerSize() {
+				continue
+			}
+			w.startPayload()
+			if w.left == 0 {
+				w.endPayload()
+			}
+			continue
+		}
+
+		n := uint64(len(b))
+		if n > w.left {
+			n = w.left
+		}
+		if w.opcode == wsOpClose {
+			for i := uint64(0); i < n && len(w.code) < 2; i++ {
+				c := b[i]
+				if w.masked {
+					c ^= w.mask[(w.pos+i)%4]
+				}
+				w.code = append(w.code, c)
+			}
+		}
+		w.pos += n
+		w.left -= n
+		b = b[n:]
+		if w.left == 0 {
+			w.endPayload()
+		}
+	}
+}
+
+func (w *wsCloseReader) headerSize() int {
+	n := 2
+	switch w.hdr[1] & 0x7f {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if w.hdr[1]&0x80 != 0 {
+		n += 4
+	}
+	return n
+}
+
+func (w *wsCloseReader) startPayload() {
+	w.opcode = w.hdr[0] & 0x0f
+	w.masked = w.hdr[1]&0x80 != 0
+
+	i := 2
+	switch l := w.hdr[1] & 0x7f; l {
+	case 126:
+		w.left = uint64(binary.BigEndian.Uint16(w.hdr[i:]))
+		i += 2
+	case 127:
+		w.left = binary.BigEndian.Uint64(w.hdr[i:])
+		i += 8
+	default:
+		w.left = uint64(l)
+	}
+	if w.masked {
+		copy(w.mask[:], w.hdr[i:i+4])
+	}
+
+	w.hdrLen = 0
+	w.inPayload = true
+	w.pos = 0
+	w.code = w.code[:0]
+}
+
+func (w *wsCloseReader) endPayload() {
+	w.inPayload = false
+	if w.opcode != wsOpClose {
+		return
+	}
+
+	w.sawClose = true
+	code := WebSocketCloseNoStatus
+	if len(w.code) == 2 {
+		code = int(binary.BigEndian.Uint16(w.code))
+	}
+	w.onClose(code)
+}
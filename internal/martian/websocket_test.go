@@ -0,0 +1,119 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package martian
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func wsFrame(opcode byte, mask []byte, payload []byte) []byte {
+	b := []byte{0x80 | opcode}
+	l := byte(0)
+	if mask != nil {
+		l = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		b = append(b, l|byte(len(payload)))
+	default:
+		b = append(b, l|126, byte(len(payload)>>8), byte(len(payload)))
+	}
+	if mask != nil {
+		b = append(b, mask...)
+		p := bytes.Clone(payload)
+		for i := range p {
+			p[i] ^= mask[i%4]
+		}
+		payload = p
+	}
+	return append(b, payload...)
+}
+
+func TestWSCloseReader(t *testing.T) {
+	text := wsFrame(0x1, nil, bytes.Repeat([]byte("a"), 300))
+
+	tests := []struct {
+		name   string
+		stream []byte
+		code   int
+		tail   []byte
+	}{
+		{
+			name:   "close frame",
+			stream: append(bytes.Clone(text), wsFrame(wsOpClose, nil, []byte{0x03, 0xf3, 'e', 'r', 'r'})...),
+			code:   1011,
+		},
+		{
+			name:   "masked close frame",
+			stream: wsFrame(wsOpClose, []byte{1, 2, 3, 4}, []byte{0x03, 0xe8}),
+			code:   1000,
+		},
+		{
+			name:   "close frame without status",
+			stream: wsFrame(wsOpClose, nil, nil),
+			code:   WebSocketCloseNoStatus,
+		},
+		{
+			name:   "no close frame",
+			stream: text,
+			code:   WebSocketCloseAbnormal,
+			tail:   []byte{0x88, 0x02, 0x03, 0xe9},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var codes []int
+			r := newWSCloseReader(iotest.OneByteReader(bytes.NewReader(tc.stream)), func(code int) {
+				codes = append(codes, code)
+			})
+			b, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(codes) != 1 || codes[0] != tc.code {
+				t.Fatalf("expected code %d, got %v", tc.code, codes)
+			}
+			if want := append(bytes.Clone(tc.stream), tc.tail...); !bytes.Equal(b, want) {
+				t.Fatalf("unexpected output tail: %x", b[len(tc.stream):])
+			}
+		})
+	}
+}
+
+func TestWSCloseReaderMidFrame(t *testing.T) {
+	frame := wsFrame(0x2, nil, []byte("binary"))
+
+	called := false
+	r := newWSCloseReader(bytes.NewReader(frame[:4]), func(code int) {
+		called = true
+	})
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if called {
+		t.Fatal("unexpected close callback")
+	}
+	if !bytes.Equal(b, frame[:4]) {
+		t.Fatalf("unexpected output: %x", b)
+	}
+}
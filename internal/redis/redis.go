@@ -0,0 +1,260 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package redis is a minimal Redis client speaking the RESP protocol.
+// It supports pipelined commands with simple string, error, integer and bulk string replies.
+package redis
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// poolSize is the maximum number of idle connections kept by Client.
+const poolSize = 16
+
+// defaultTimeout is the timeout of a command if the context has no deadline.
+const defaultTimeout = time.Second
+
+// Reply is a reply to a command, Nil is true for nil bulk string replies e.g. GET of a missing key.
+type Reply struct {
+	Value string
+	Nil   bool
+}
+
+// Error is an error reply.
+type Error string
+
+func (e Error) Error() string {
+	return "redis: " + string(e)
+}
+
+type Client struct {
+	addr      string
+	username  string
+	password  string
+	db        int
+	tlsConfig *tls.Config
+	dialer    net.Dialer
+	pool      chan *conn
+}
+
+// NewClient returns a client for the URL redis://[[user]:password@]host[:port][/db],
+// rediss:// enables TLS, the default port is 6379.
+// Connections are opened on demand.
+func NewClient(u *url.URL) (*Client, error) {
+	c := &Client{
+		addr: u.Host,
+		pool: make(chan *conn, poolSize),
+	}
+
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		c.tlsConfig = &tls.Config{
+			ServerName: u.Hostname(),
+			MinVersion: tls.VersionTLS12,
+		}
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q, expected redis or rediss", u.Scheme)
+	}
+
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		n, err := strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("invalid database number %q", db)
+		}
+		c.db = n
+	}
+
+	return c, nil
+}
+
+// Do sends pipelined commands and returns the replies.
+// If any of the commands fails with an error reply, the first error is returned.
+func (c *Client) Do(ctx context.Context, cmds ...[]string) ([]Reply, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultTimeout)
+		defer cancel()
+	}
+
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	replies, err := cn.do(ctx, cmds...)
+	var re Error
+	if err != nil && !errors.As(err, &re) {
+		cn.Close()
+		return nil, err
+	}
+	c.put(cn)
+
+	return replies, err
+}
+
+// Close closes idle connections.
+func (c *Client) Close() error {
+	for {
+		select {
+		case cn := <-c.pool:
+			cn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	select {
+	case cn := <-c.pool:
+		return cn, nil
+	default:
+	}
+
+	nc, err := c.dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	if c.tlsConfig != nil {
+		tc := tls.Client(nc, c.tlsConfig)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		nc = tc
+	}
+
+	cn := &conn{
+		Conn: nc,
+		r:    bufio.NewReader(nc),
+	}
+	if err := cn.init(ctx, c.username, c.password, c.db); err != nil {
+		cn.Close()
+		return nil, err
+	}
+
+	return cn, nil
+}
+
+func (c *Client) put(cn *conn) {
+	select {
+	case c.pool <- cn:
+	default:
+		cn.Close()
+	}
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *conn) init(ctx context.Context, username, password string, db int) error {
+	var cmds [][]string
+	switch {
+	case username != "" && password != "":
+		cmds = append(cmds, []string{"AUTH", username, password})
+	case password != "":
+		cmds = append(cmds, []string{"AUTH", password})
+	}
+	if db != 0 {
+		cmds = append(cmds, []string{"SELECT", strconv.Itoa(db)})
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	_, err := c.do(ctx, cmds...)
+	return err
+}
+
+func (c *conn) do(ctx context.Context, cmds ...[]string) ([]Reply, error) {
+	if d, ok := ctx.Deadline(); ok {
+		c.SetDeadline(d)
+	}
+
+	var sb strings.Builder
+	for _, cmd := range cmds {
+		fmt.Fprintf(&sb, "*%d\r\n", len(cmd))
+		for _, arg := range cmd {
+			fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if _, err := io.WriteString(c.Conn, sb.String()); err != nil {
+		return nil, err
+	}
+
+	replies := make([]Reply, len(cmds))
+	var firstErr error
+	for i := range cmds {
+		r, err := c.readReply()
+		var re Error
+		if errors.As(err, &re) {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %w", cmds[i][0], err)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = r
+	}
+
+	return replies, firstErr
+}
+
+func (c *conn) readReply() (Reply, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return Reply{}, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return Reply{}, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return Reply{Value: line[1:]}, nil
+	case '-':
+		return Reply{}, Error(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return Reply{}, fmt.Errorf("redis: invalid bulk length %q", line[1:])
+		}
+		if n < 0 {
+			return Reply{Nil: true}, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return Reply{}, err
+		}
+		return Reply{Value: string(buf[:n])}, nil
+	default:
+		return Reply{}, fmt.Errorf("redis: unsupported reply type %q", line[0])
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package redistest provides an in-memory Redis server for tests.
+package redistest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server implements AUTH, SELECT, GET, SET with NX, XX and PX options, DEL, INCR and PEXPIRE commands.
+type Server struct {
+	l        net.Listener
+	password string
+
+	mu sync.Mutex
+	kv map[string]entry
+}
+
+type entry struct {
+	value   string
+	expires time.Time
+}
+
+// NewServer starts a server listening on a local port, if password is not empty clients must authenticate.
+func NewServer(password string) (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		l:        l,
+		password: password,
+		kv:       make(map[string]entry),
+	}
+	go s.serve()
+
+	return s, nil
+}
+
+// URL returns the server URL with the given password.
+func (s *Server) URL(password string) *url.URL {
+	u := &url.URL{Scheme: "redis", Host: s.l.Addr().String()}
+	if password != "" {
+		u.User = url.UserPassword("", password)
+	}
+	return u
+}
+
+func (s *Server) Close() error {
+	return s.l.Close()
+}
+
+// Get returns the value of key.
+func (s *Server) Get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.lookup(key)
+	return e.value, ok
+}
+
+// Expire removes the key as if it expired.
+func (s *Server) Expire(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.kv, key)
+}
+
+func (s *Server) lookup(key string) (entry, bool) {
+	e, ok := s.kv[key]
+	if ok && !e.expires.IsZero() && !time.Now().Before(e.expires) {
+		delete(s.kv, key)
+		return entry{}, false
+	}
+	return e, ok
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	authenticated := s.password == ""
+	for {
+		cmd, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		var reply string
+		switch name := strings.ToUpper(cmd[0]); {
+		case name == "AUTH":
+			if cmd[len(cmd)-1] == s.password {
+				authenticated = true
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		default:
+			reply = s.exec(name, cmd[1:])
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) exec(name string, args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch name {
+	case "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		e, ok := s.lookup(args[0])
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(e.value), e.value)
+	case "SET":
+		e := entry{value: args[1]}
+		_, exists := s.lookup(args[0])
+		for i := 2; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				if exists {
+					return "$-1\r\n"
+				}
+			case "XX":
+				if !exists {
+					return "$-1\r\n"
+				}
+			case "PX":
+				i++
+				ms, _ := strconv.ParseInt(args[i], 10, 64)
+				e.expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			}
+		}
+		s.kv[args[0]] = e
+		return "+OK\r\n"
+	case "DEL":
+		_, ok := s.lookup(args[0])
+		delete(s.kv, args[0])
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "INCR":
+		e, _ := s.lookup(args[0])
+		n, _ := strconv.ParseInt(e.value, 10, 64)
+		n++
+		e.value = strconv.FormatInt(n, 10)
+		s.kv[args[0]] = e
+		return fmt.Sprintf(":%d\r\n", n)
+	case "PEXPIRE":
+		e, ok := s.lookup(args[0])
+		if !ok {
+			return ":0\r\n"
+		}
+		ms, _ := strconv.ParseInt(args[1], 10, 64)
+		e.expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		s.kv[args[0]] = e
+		return ":1\r\n"
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	cmd := make([]string, n)
+	for i := range cmd {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(l[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		cmd[i] = string(buf[:size])
+	}
+	return cmd, nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package kvconfig
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// consulWait is the maximum duration of a blocking query.
+const consulWait = "5m"
+
+// consul reads keys with the Consul KV HTTP API, changes are detected with blocking queries.
+//
+// See https://developer.hashicorp.com/consul/api-docs/kv
+type consul struct {
+	c      *http.Client
+	base   url.URL
+	prefix string
+	token  string
+	query  url.Values
+}
+
+type consulKV struct {
+	Key   string
+	Value []byte
+}
+
+func (b *consul) get(ctx context.Context, index uint64) (Snapshot, uint64, error) {
+	u := b.base
+	u.Path = "/v1/kv/" + b.prefix
+
+	q := url.Values{}
+	for k, v := range b.query {
+		q[k] = v
+	}
+	q.Set("recurse", "true")
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", consulWait)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), http.NoBody)
+	if err != nil {
+		return nil, 0, err
+	}
+	if b.token != "" {
+		req.Header.Set("X-Consul-Token", b.token)
+	}
+
+	res, err := b.c.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+
+	idx, err := strconv.ParseUint(res.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid X-Consul-Index header: %w", err)
+	}
+	// The index must be greater than zero for blocking queries,
+	// if it goes backwards the store was reset and values must be read again.
+	if idx == 0 || idx < index {
+		idx = 1
+	}
+
+	s := make(Snapshot)
+	switch res.StatusCode {
+	case http.StatusOK:
+		var kvs []consulKV
+		if err := json.NewDecoder(res.Body).Decode(&kvs); err != nil {
+			return nil, 0, fmt.Errorf("decode response: %w", err)
+		}
+		for _, kv := range kvs {
+			k := strings.TrimPrefix(kv.Key, b.prefix)
+			if k == "" || strings.HasSuffix(k, "/") {
+				continue
+			}
+			s[k] = string(kv.Value)
+		}
+	case http.StatusNotFound:
+		// No keys under the prefix.
+	default:
+		return nil, 0, readError(res)
+	}
+
+	return s, idx, nil
+}
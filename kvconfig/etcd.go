@@ -0,0 +1,215 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package kvconfig
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// etcd reads keys with the etcd v3 JSON gateway, changes are detected with watch streams.
+// Byte fields are base64 encoded and 64-bit integers are encoded as strings.
+//
+// See https://etcd.io/docs/latest/dev-guide/api_grpc_gateway/
+type etcd struct {
+	c        *http.Client
+	base     url.URL
+	prefix   string
+	user     string
+	password string
+}
+
+type etcdHeader struct {
+	Revision uint64 `json:"revision,string"`
+}
+
+type etcdRangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end"`
+}
+
+type etcdRangeResponse struct {
+	Header etcdHeader `json:"header"`
+	KVs    []struct {
+		Key   []byte `json:"key"`
+		Value []byte `json:"value"`
+	} `json:"kvs"`
+}
+
+type etcdWatchRequest struct {
+	CreateRequest struct {
+		etcdRangeRequest
+		StartRevision uint64 `json:"start_revision,string"`
+	} `json:"create_request"`
+}
+
+type etcdWatchResponse struct {
+	Result *struct {
+		Canceled        bool              `json:"canceled"`
+		CancelReason    string            `json:"cancel_reason"`
+		CompactRevision uint64            `json:"compact_revision,string"`
+		Events          []json.RawMessage `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (b *etcd) get(ctx context.Context, index uint64) (Snapshot, uint64, error) {
+	token, err := b.authenticate(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("authenticate: %w", err)
+	}
+
+	if index > 0 {
+		if err := b.wait(ctx, token, index); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	var res etcdRangeResponse
+	if err := b.post(ctx, token, "/v3/kv/range", b.rangeRequest(), &res); err != nil {
+		return nil, 0, err
+	}
+
+	s := make(Snapshot, len(res.KVs))
+	for _, kv := range res.KVs {
+		k := strings.TrimPrefix(string(kv.Key), b.prefix)
+		if k == "" {
+			continue
+		}
+		s[k] = string(kv.Value)
+	}
+
+	return s, res.Header.Revision, nil
+}
+
+func (b *etcd) rangeRequest() etcdRangeRequest {
+	return etcdRangeRequest{
+		Key:      []byte(b.prefix),
+		RangeEnd: prefixEnd([]byte(b.prefix)),
+	}
+}
+
+// prefixEnd returns the smallest key greater than all keys with the prefix.
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// All bytes are 0xff, use the end of the key space.
+	return []byte{0}
+}
+
+// wait blocks until there is a change under the prefix after revision.
+func (b *etcd) wait(ctx context.Context, token string, revision uint64) error {
+	var wr etcdWatchRequest
+	wr.CreateRequest.etcdRangeRequest = b.rangeRequest()
+	wr.CreateRequest.StartRevision = revision + 1
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	res, err := b.do(ctx, token, "/v3/watch", wr)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	dec := json.NewDecoder(res.Body)
+	for {
+		var msg etcdWatchResponse
+		if err := dec.Decode(&msg); err != nil {
+			return fmt.Errorf("watch: %w", err)
+		}
+		if msg.Error != nil {
+			return fmt.Errorf("watch: %s", msg.Error.Message)
+		}
+		if r := msg.Result; r != nil {
+			// The start revision was compacted, the changes must be read with a range request.
+			if r.CompactRevision > 0 || len(r.Events) > 0 {
+				return nil
+			}
+			if r.Canceled {
+				return fmt.Errorf("watch canceled: %s", r.CancelReason)
+			}
+		}
+	}
+}
+
+func (b *etcd) authenticate(ctx context.Context) (string, error) {
+	if b.user == "" {
+		return "", nil
+	}
+
+	req := struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}{b.user, b.password}
+	var res struct {
+		Token string `json:"token"`
+	}
+	if err := b.post(ctx, "", "/v3/auth/authenticate", req, &res); err != nil {
+		return "", err
+	}
+	if res.Token == "" {
+		return "", errors.New("empty token")
+	}
+
+	return res.Token, nil
+}
+
+func (b *etcd) post(ctx context.Context, token, path string, in, out any) error {
+	res, err := b.do(ctx, token, path, in)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
+
+func (b *etcd) do(ctx context.Context, token, path string, in any) (*http.Response, error) {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+
+	u := b.base
+	u.Path = path
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	res, err := b.c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		return nil, readError(res)
+	}
+
+	return res, nil
+}
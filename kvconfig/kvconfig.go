@@ -0,0 +1,177 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package kvconfig reads and watches configuration stored in etcd or Consul key-value stores.
+// Both stores are accessed over HTTP, Consul with the KV HTTP API and etcd with the v3 JSON gateway,
+// so that no client libraries are needed.
+package kvconfig
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/saucelabs/forwarder/log"
+)
+
+// Snapshot maps key names, relative to the prefix, to values.
+type Snapshot map[string]string
+
+// backend returns the values under the prefix.
+// If index is not zero, it blocks until the values change after index.
+// It returns the index of the returned values.
+type backend interface {
+	get(ctx context.Context, index uint64) (Snapshot, uint64, error)
+}
+
+// Client reads and watches the keys under a prefix.
+type Client struct {
+	b     backend
+	log   log.Logger
+	index uint64
+	last  Snapshot
+
+	// RetryInterval is the time to wait before retrying a failed watch.
+	RetryInterval time.Duration
+}
+
+// Open returns a client for the backend specified by the URL.
+// The supported schemes are:
+//
+//   - etcd://[user:password@]host[:port]/prefix - etcd v3 JSON gateway, the default port is 2379,
+//   - consul://[token@]host[:port]/prefix - Consul KV HTTP API, the default port is 8500.
+//
+// The schemes can be suffixed with "+https" to use TLS, e.g. etcd+https://host/prefix.
+// For etcd the prefix includes the leading slash, for Consul it does not.
+func Open(u *url.URL, log log.Logger) (*Client, error) {
+	scheme, tlsSuffix := strings.CutSuffix(u.Scheme, "+https")
+	base := url.URL{
+		Scheme: "http",
+		Host:   u.Host,
+	}
+	if tlsSuffix {
+		base.Scheme = "https"
+	}
+
+	prefix := strings.TrimSuffix(u.Path, "/")
+	if prefix == "" {
+		return nil, errors.New("missing key prefix")
+	}
+	prefix += "/"
+
+	var b backend
+	switch scheme {
+	case "etcd":
+		base.Host = withDefaultPort(u.Host, "2379")
+		e := &etcd{
+			c:      http.DefaultClient,
+			base:   base,
+			prefix: prefix,
+		}
+		if u.User != nil {
+			e.user = u.User.Username()
+			e.password, _ = u.User.Password()
+		}
+		b = e
+	case "consul":
+		base.Host = withDefaultPort(u.Host, "8500")
+		c := &consul{
+			c:      http.DefaultClient,
+			base:   base,
+			prefix: strings.TrimPrefix(prefix, "/"),
+			query:  u.Query(),
+		}
+		if u.User != nil {
+			c.token = u.User.Username()
+		}
+		b = c
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q, expected etcd or consul", u.Scheme)
+	}
+
+	return &Client{
+		b:             b,
+		log:           log,
+		RetryInterval: 5 * time.Second,
+	}, nil
+}
+
+// Redacted returns the URL with the credentials masked.
+// Unlike url.URL.Redacted it masks the username, as it holds the Consul ACL token.
+func Redacted(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	if u.User == nil {
+		return u.String()
+	}
+	ru := *u
+	ru.User = url.User("xxxxx")
+	return ru.String()
+}
+
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// Get returns the current values under the prefix.
+func (c *Client) Get(ctx context.Context) (Snapshot, error) {
+	s, idx, err := c.b.get(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	c.index = idx
+	c.last = s
+	return s, nil
+}
+
+// Watch calls fn every time the values under the prefix change until ctx is done.
+// Changes are detected relative to the values returned by the last call to Get.
+// Errors are logged and the watch is retried after RetryInterval.
+func (c *Client) Watch(ctx context.Context, fn func(Snapshot)) error {
+	for {
+		s, idx, err := c.b.get(ctx, c.index)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			c.log.Errorf("watch: %s", err)
+
+			// Refresh the index after the error, the store may have been restored from backup.
+			c.index = 0
+
+			t := time.NewTimer(c.RetryInterval)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			case <-t.C:
+			}
+			continue
+		}
+
+		c.index = idx
+		if !maps.Equal(s, c.last) {
+			c.last = s
+			fn(s)
+		}
+	}
+}
+
+func readError(res *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	return fmt.Errorf("unexpected status %s: %s", res.Status, strings.TrimSpace(string(b)))
+}
@@ -0,0 +1,239 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/saucelabs/forwarder/log"
+)
+
+// LeakCheckConfig configures periodic goroutine leak checks.
+// The number of goroutines is expected to be proportional to the number of open connections,
+// each connection is served by a bounded number of goroutines.
+// Goroutines in excess of that indicate a leak, for example a tunnel that is not closed with its connections.
+type LeakCheckConfig struct {
+	// Interval is the time between checks, zero disables the checks.
+	Interval time.Duration
+
+	// GoroutinesPerConn is the expected maximum number of goroutines per open connection.
+	GoroutinesPerConn float64
+
+	// Slack is the number of goroutines allowed on top of the baseline measured at the first check.
+	Slack int
+
+	// Checks is the number of consecutive failed checks required to report a leak,
+	// it prevents alerts on short bursts.
+	Checks int
+
+	PromConfig
+}
+
+func DefaultLeakCheckConfig() *LeakCheckConfig {
+	return &LeakCheckConfig{
+		GoroutinesPerConn: 4,
+		Slack:             100,
+		Checks:            3,
+	}
+}
+
+func (c *LeakCheckConfig) Validate() error {
+	if c.Interval < 0 {
+		return errors.New("interval must be non-negative")
+	}
+	if c.GoroutinesPerConn <= 0 {
+		return errors.New("goroutines per connection must be positive")
+	}
+	if c.Slack < 0 {
+		return errors.New("slack must be non-negative")
+	}
+	if c.Checks < 1 {
+		return errors.New("checks must be at least 1")
+	}
+	return nil
+}
+
+type leakCheckMetrics struct {
+	goroutines prometheus.Gauge
+	conns      prometheus.Gauge
+	excess     prometheus.Gauge
+	alerts     prometheus.Counter
+}
+
+func newLeakCheckMetrics(r prometheus.Registerer, namespace string) *leakCheckMetrics {
+	if r == nil {
+		r = prometheus.NewRegistry() // This registry will be discarded.
+	}
+	f := promauto.With(r)
+
+	return &leakCheckMetrics{
+		goroutines: f.NewGauge(prometheus.GaugeOpts{
+			Name:      "leak_check_goroutines",
+			Namespace: namespace,
+			Help:      "Number of goroutines at the last leak check",
+		}),
+		conns: f.NewGauge(prometheus.GaugeOpts{
+			Name:      "leak_check_cx_active",
+			Namespace: namespace,
+			Help:      "Number of open connections at the last leak check",
+		}),
+		excess: f.NewGauge(prometheus.GaugeOpts{
+			Name:      "leak_check_excess_goroutines",
+			Namespace: namespace,
+			Help:      "Number of goroutines over the expected limit at the last leak check, negative if below the limit",
+		}),
+		alerts: f.NewCounter(prometheus.CounterOpts{
+			Name:      "leak_check_alerts_total",
+			Namespace: namespace,
+			Help:      "Number of reported goroutine leaks",
+		}),
+	}
+}
+
+// LeakChecker periodically compares the number of goroutines with the number of open connections,
+// and reports a suspected leak when they diverge.
+// The report lists the functions that started the most goroutines.
+type LeakChecker struct {
+	config  LeakCheckConfig
+	conns   func() int
+	log     log.Logger
+	metrics *leakCheckMetrics
+
+	baseline int
+	failed   int
+}
+
+// NewLeakChecker returns a checker, conns returns the number of open connections.
+func NewLeakChecker(cfg *LeakCheckConfig, conns func() int, log log.Logger) (*LeakChecker, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &LeakChecker{
+		config:   *cfg,
+		conns:    conns,
+		log:      log,
+		metrics:  newLeakCheckMetrics(cfg.PromRegistry, cfg.PromNamespace),
+		baseline: -1,
+	}, nil
+}
+
+func (c *LeakChecker) Run(ctx context.Context) error {
+	if c.config.Interval == 0 {
+		return nil
+	}
+
+	c.log.Infof("goroutine leak check enabled interval=%s goroutines_per_conn=%g slack=%d checks=%d",
+		c.config.Interval, c.config.GoroutinesPerConn, c.config.Slack, c.config.Checks)
+
+	t := time.NewTicker(c.config.Interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			c.check(runtime.NumGoroutine(), c.conns())
+		}
+	}
+}
+
+// check returns true if a leak is reported.
+func (c *LeakChecker) check(goroutines, conns int) bool {
+	expected := int(c.config.GoroutinesPerConn * float64(conns))
+	if c.baseline < 0 {
+		c.baseline = max(goroutines-expected, 0)
+		c.log.Debugf("goroutine leak check baseline=%d goroutines=%d conns=%d", c.baseline, goroutines, conns)
+	}
+	limit := c.baseline + c.config.Slack + expected
+	excess := goroutines - limit
+
+	c.metrics.goroutines.Set(float64(goroutines))
+	c.metrics.conns.Set(float64(conns))
+	c.metrics.excess.Set(float64(excess))
+
+	if excess <= 0 {
+		if c.failed >= c.config.Checks {
+			c.log.Infof("goroutine leak check recovered goroutines=%d conns=%d limit=%d", goroutines, conns, limit)
+		}
+		c.failed = 0
+		return false
+	}
+
+	c.failed++
+	if c.failed != c.config.Checks {
+		return false
+	}
+
+	c.metrics.alerts.Inc()
+	c.log.Errorf("goroutine leak suspected goroutines=%d conns=%d limit=%d excess=%d, top goroutine creators:\n%s",
+		goroutines, conns, limit, excess, formatGoroutineCreators(goroutineCreators(), 10))
+	return true
+}
+
+type goroutineCreator struct {
+	fn    string
+	count int
+}
+
+// goroutineCreators returns the number of goroutines by the function that started them, sorted by count.
+func goroutineCreators() []goroutineCreator {
+	buf := allGoroutineStacks()
+
+	m := make(map[string]int)
+	for _, g := range bytes.Split(buf, []byte("\n\n")) {
+		m[goroutineCreatedBy(string(g))]++
+	}
+
+	res := make([]goroutineCreator, 0, len(m))
+	for fn, n := range m {
+		res = append(res, goroutineCreator{fn, n})
+	}
+	slices.SortFunc(res, func(a, b goroutineCreator) int {
+		if c := cmp.Compare(b.count, a.count); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.fn, b.fn)
+	})
+	return res
+}
+
+// goroutineCreatedBy returns the function from the "created by" line of a goroutine stack.
+func goroutineCreatedBy(stack string) string {
+	const prefix = "\ncreated by "
+	i := strings.LastIndex(stack, prefix)
+	if i < 0 {
+		return "main"
+	}
+	fn := stack[i+len(prefix):]
+	if j := strings.IndexAny(fn, " \n"); j >= 0 {
+		fn = fn[:j]
+	}
+	return fn
+}
+
+func formatGoroutineCreators(creators []goroutineCreator, n int) string {
+	var sb strings.Builder
+	for i, c := range creators {
+		if i == n {
+			break
+		}
+		fmt.Fprintf(&sb, "%6d %s\n", c.count, c.fn)
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
@@ -0,0 +1,109 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func metricValue(t *testing.T, m prometheus.Metric) float64 {
+	t.Helper()
+
+	var d dto.Metric
+	if err := m.Write(&d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Gauge != nil {
+		return d.Gauge.GetValue()
+	}
+	return d.Counter.GetValue()
+}
+
+func TestLeakCheckerCheck(t *testing.T) {
+	var l recordingLogger
+	cfg := DefaultLeakCheckConfig()
+	cfg.GoroutinesPerConn = 2
+	cfg.Slack = 10
+	cfg.Checks = 2
+	cfg.PromRegistry = prometheus.NewRegistry()
+
+	c, err := NewLeakChecker(cfg, nil, &l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Baseline is 20 goroutines, the limit is 30 + 2 per connection.
+	steps := []struct {
+		goroutines, conns int
+		alert             bool
+	}{
+		{20, 0, false},
+		{230, 100, false},
+		{50, 0, false},
+		{40, 5, false}, // resets the failed checks
+		{60, 5, false},
+		{60, 5, true},
+		{60, 5, false}, // reported once
+		{30, 0, false},
+		{31, 0, false},
+		{31, 0, true},
+	}
+	for i, s := range steps {
+		if got := c.check(s.goroutines, s.conns); got != s.alert {
+			t.Fatalf("step %d: got alert=%v, want %v", i, got, s.alert)
+		}
+	}
+
+	if n := metricValue(t, c.metrics.alerts); n != 2 {
+		t.Fatalf("alerts: got %g, want 2", n)
+	}
+	if n := metricValue(t, c.metrics.excess); n != 1 {
+		t.Fatalf("excess: got %g, want 1", n)
+	}
+	if s := l.String(); !strings.Contains(s, "goroutine leak suspected") || !strings.Contains(s, "recovered") {
+		t.Fatalf("unexpected log:\n%s", s)
+	}
+}
+
+func TestGoroutineCreatedBy(t *testing.T) {
+	tests := []struct {
+		stack string
+		want  string
+	}{
+		{
+			stack: "goroutine 1 [running]:\nmain.main()\n\t/src/main.go:10 +0x1d",
+			want:  "main",
+		},
+		{
+			stack: "goroutine 7 [IO wait]:\ninternal/poll.runtime_pollWait(...)\n" +
+				"created by github.com/saucelabs/forwarder/internal/martian.(*Proxy).Serve in goroutine 1\n" +
+				"\t/src/internal/martian/proxy.go:353 +0x2a5",
+			want: "github.com/saucelabs/forwarder/internal/martian.(*Proxy).Serve",
+		},
+	}
+	for _, tc := range tests {
+		if got := goroutineCreatedBy(tc.stack); got != tc.want {
+			t.Errorf("got %q, want %q", got, tc.want)
+		}
+	}
+}
+
+func TestGoroutineCreators(t *testing.T) {
+	cs := goroutineCreators()
+	if len(cs) == 0 {
+		t.Fatal("expected goroutine creators")
+	}
+	for i := 1; i < len(cs); i++ {
+		if cs[i].count > cs[i-1].count {
+			t.Fatalf("not sorted: %+v", cs)
+		}
+	}
+}
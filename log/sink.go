@@ -0,0 +1,192 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Record is a single log message passed to a Sink.
+type Record struct {
+	Time    time.Time
+	Level   Level
+	Name    string
+	Labels  []string
+	Message string
+}
+
+// Sink is a destination for log records, it allows to route logs to an external pipeline.
+// Records are passed in batches by Batcher, Write is never called concurrently.
+// Write must not retain the records slice.
+type Sink interface {
+	Write(ctx context.Context, records []Record) error
+	Close() error
+}
+
+// MultiSink writes records to all sinks.
+type MultiSink []Sink
+
+func (ms MultiSink) Write(ctx context.Context, records []Record) error {
+	var errs []error
+	for _, s := range ms {
+		if err := s.Write(ctx, records); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (ms MultiSink) Close() error {
+	var errs []error
+	for _, s := range ms {
+		if err := s.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type BatchConfig struct {
+	// Size is the maximum number of records in a batch.
+	Size int
+
+	// Interval is the maximum time a record waits before the batch is written.
+	Interval time.Duration
+
+	// QueueSize is the number of records waiting to be written,
+	// if the queue is full new records are dropped.
+	QueueSize int
+
+	// WriteTimeout limits the time of a single Sink.Write call.
+	WriteTimeout time.Duration
+}
+
+func DefaultBatchConfig() *BatchConfig {
+	return &BatchConfig{
+		Size:         100,
+		Interval:     time.Second,
+		QueueSize:    10000,
+		WriteTimeout: 10 * time.Second,
+	}
+}
+
+// Batcher collects records and writes them to a Sink in batches,
+// when the batch is full or the batch interval elapses.
+// Add never blocks, so a slow sink does not slow down the proxy.
+// Sink errors are reported to stderr as the logger cannot log its own failures.
+type Batcher struct {
+	sink    Sink
+	cfg     BatchConfig
+	queue   chan Record
+	done    chan struct{}
+	dropped atomic.Uint64
+
+	mu       sync.RWMutex
+	closed   bool
+	closeErr error
+}
+
+// NewBatcher returns a Batcher writing to s, it starts a goroutine that runs until Close is called.
+func NewBatcher(s Sink, cfg *BatchConfig) *Batcher {
+	b := &Batcher{
+		sink:  s,
+		cfg:   *cfg,
+		queue: make(chan Record, cfg.QueueSize),
+		done:  make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// Add queues the record, if the queue is full or the batcher is closed the record is dropped.
+func (b *Batcher) Add(r Record) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		b.dropped.Add(1)
+		return
+	}
+	select {
+	case b.queue <- r:
+	default:
+		b.dropped.Add(1)
+	}
+}
+
+// Dropped returns the number of records dropped because the queue was full.
+func (b *Batcher) Dropped() uint64 {
+	return b.dropped.Load()
+}
+
+func (b *Batcher) run() {
+	defer close(b.done)
+
+	t := time.NewTicker(b.cfg.Interval)
+	defer t.Stop()
+
+	batch := make([]Record, 0, b.cfg.Size)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		b.write(batch)
+		clear(batch)
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case r, ok := <-b.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, r)
+			if len(batch) >= b.cfg.Size {
+				flush()
+			}
+		case <-t.C:
+			flush()
+		}
+	}
+}
+
+func (b *Batcher) write(batch []Record) {
+	ctx := context.Background()
+	if b.cfg.WriteTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.cfg.WriteTimeout)
+		defer cancel()
+	}
+
+	if err := b.sink.Write(ctx, batch); err != nil {
+		fmt.Fprintf(os.Stderr, "log sink: dropping %d records: %v\n", len(batch), err)
+	}
+}
+
+// Close writes the queued records and closes the sink.
+func (b *Batcher) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return b.closeErr
+	}
+	b.closed = true
+	close(b.queue)
+	<-b.done
+	b.closeErr = b.sink.Close()
+
+	return b.closeErr
+}
@@ -0,0 +1,73 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package sink
+
+import (
+	"context"
+	"time"
+
+	flog "github.com/saucelabs/forwarder/log"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// GRPCMethod is the full name of the collector method called for every batch.
+// The collector implements the following service using well-known protobuf types:
+//
+//	package forwarder.log.v1;
+//
+//	service LogCollector {
+//	  rpc Write(google.protobuf.ListValue) returns (google.protobuf.Empty);
+//	}
+//
+// Each ListValue element is a Struct with time (RFC 3339 string), level, name, labels and msg fields.
+const GRPCMethod = "/forwarder.log.v1.LogCollector/Write"
+
+// GRPC ships records to a collector over gRPC, see GRPCMethod.
+type GRPC struct {
+	conn *grpc.ClientConn
+}
+
+// NewGRPC returns a sink sending records to the collector at target.
+// Options configure the connection e.g. transport credentials, they are required for plaintext connections.
+func NewGRPC(target string, opts ...grpc.DialOption) (*GRPC, error) {
+	conn, err := grpc.NewClient(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &GRPC{conn: conn}, nil
+}
+
+func (s *GRPC) Write(ctx context.Context, records []flog.Record) error {
+	l := &structpb.ListValue{
+		Values: make([]*structpb.Value, 0, len(records)),
+	}
+	for i := range records {
+		r := &records[i]
+
+		labels := make([]*structpb.Value, len(r.Labels))
+		for i, v := range r.Labels {
+			labels[i] = structpb.NewStringValue(v)
+		}
+		l.Values = append(l.Values, structpb.NewStructValue(&structpb.Struct{
+			Fields: map[string]*structpb.Value{
+				"time":   structpb.NewStringValue(r.Time.Format(time.RFC3339Nano)),
+				"level":  structpb.NewStringValue(r.Level.String()),
+				"name":   structpb.NewStringValue(r.Name),
+				"labels": structpb.NewListValue(&structpb.ListValue{Values: labels}),
+				"msg":    structpb.NewStringValue(r.Message),
+			},
+		}))
+	}
+
+	return s.conn.Invoke(ctx, GRPCMethod, l, &emptypb.Empty{})
+}
+
+func (s *GRPC) Close() error {
+	return s.conn.Close()
+}
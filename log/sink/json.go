@@ -0,0 +1,79 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package sink provides reference implementations of log.Sink.
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	flog "github.com/saucelabs/forwarder/log"
+)
+
+type jsonRecord struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Name    string    `json:"name,omitempty"`
+	Labels  []string  `json:"labels,omitempty"`
+	Message string    `json:"msg"`
+}
+
+// JSON writes records as newline delimited JSON objects with time, level, name, labels and msg fields.
+type JSON struct {
+	w     io.Writer
+	close func() error
+	buf   bytes.Buffer
+}
+
+// NewJSON returns a sink writing to w, closing the sink does not close w.
+func NewJSON(w io.Writer) *JSON {
+	return &JSON{
+		w:     w,
+		close: func() error { return nil },
+	}
+}
+
+// NewStdout returns a sink writing JSON to stdout.
+func NewStdout() *JSON {
+	return NewJSON(os.Stdout)
+}
+
+// NewFile returns a sink writing JSON to f, f is reopened on SIGHUP to allow log rotation and closed with the sink.
+func NewFile(f *os.File) *JSON {
+	rf := flog.NewRotatableFile(f)
+	return &JSON{
+		w:     rf,
+		close: rf.Close,
+	}
+}
+
+func (s *JSON) Write(_ context.Context, records []flog.Record) error {
+	s.buf.Reset()
+	enc := json.NewEncoder(&s.buf)
+	for i := range records {
+		r := &records[i]
+		if err := enc.Encode(jsonRecord{
+			Time:    r.Time,
+			Level:   r.Level.String(),
+			Name:    r.Name,
+			Labels:  r.Labels,
+			Message: r.Message,
+		}); err != nil {
+			return err
+		}
+	}
+	_, err := s.w.Write(s.buf.Bytes())
+	return err
+}
+
+func (s *JSON) Close() error {
+	return s.close()
+}
@@ -0,0 +1,48 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package sink
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+
+	flog "github.com/saucelabs/forwarder/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Stdout is the Open value of the stdout JSON sink.
+const Stdout = "stdout-json"
+
+// Open returns a sink for the value:
+//   - stdout-json: JSON to stdout
+//   - file:<path>: JSON to a file
+//   - grpc://<host:port>: gRPC collector over plaintext connection
+//   - grpcs://<host:port>: gRPC collector over TLS connection
+func Open(val string) (flog.Sink, error) {
+	if val == Stdout {
+		return NewStdout(), nil
+	}
+	if p, ok := strings.CutPrefix(val, "file:"); ok {
+		f, err := os.OpenFile(p, flog.DefaultFileFlags, flog.DefaultFileMode)
+		if err != nil {
+			return nil, err
+		}
+		return NewFile(f), nil
+	}
+	if t, ok := strings.CutPrefix(val, "grpc://"); ok {
+		return NewGRPC(t, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+	if t, ok := strings.CutPrefix(val, "grpcs://"); ok {
+		return NewGRPC(t, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})))
+	}
+
+	return nil, fmt.Errorf("unsupported log sink %q", val)
+}
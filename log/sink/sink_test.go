@@ -0,0 +1,107 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package sink
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	flog "github.com/saucelabs/forwarder/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+var testRecords = []flog.Record{
+	{
+		Time:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Level:   flog.ErrorLevel,
+		Name:    "proxy",
+		Labels:  []string{"a"},
+		Message: "dial failed",
+	},
+	{
+		Time:    time.Date(2024, 1, 2, 3, 4, 6, 0, time.UTC),
+		Level:   flog.InfoLevel,
+		Message: "ok",
+	},
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewJSON(&buf)
+	if err := s.Write(context.Background(), testRecords); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"time":"2024-01-02T03:04:05Z","level":"error","name":"proxy","labels":["a"],"msg":"dial failed"}
+{"time":"2024-01-02T03:04:06Z","level":"info","msg":"ok"}
+`
+	if buf.String() != want {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	ch := make(chan *structpb.ListValue, 1)
+	desc := grpc.ServiceDesc{
+		ServiceName: "forwarder.log.v1.LogCollector",
+		HandlerType: (*any)(nil),
+		Methods: []grpc.MethodDesc{
+			{
+				MethodName: "Write",
+				Handler: func(_ any, _ context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+					var l structpb.ListValue
+					if err := dec(&l); err != nil {
+						return nil, err
+					}
+					ch <- &l
+					return &emptypb.Empty{}, nil
+				},
+			},
+		},
+	}
+
+	l := bufconn.Listen(1 << 20)
+	gs := grpc.NewServer()
+	gs.RegisterService(&desc, struct{}{})
+	go gs.Serve(l)
+	defer gs.Stop()
+
+	s, err := NewGRPC("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return l.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Write(context.Background(), testRecords); err != nil {
+		t.Fatal(err)
+	}
+
+	got := <-ch
+	if len(got.Values) != len(testRecords) {
+		t.Fatalf("expected %d records, got %d", len(testRecords), len(got.Values))
+	}
+	f := got.Values[0].GetStructValue().GetFields()
+	if f["level"].GetStringValue() != "error" || f["msg"].GetStringValue() != "dial failed" || f["time"].GetStringValue() != "2024-01-02T03:04:05Z" {
+		t.Fatalf("unexpected record: %v", f)
+	}
+}
+
+func TestOpenUnsupported(t *testing.T) {
+	if _, err := Open("kafka://localhost"); err == nil {
+		t.Fatal("expected error")
+	}
+}
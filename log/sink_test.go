@@ -0,0 +1,88 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package log
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingSink struct {
+	mu      sync.Mutex
+	batches [][]Record
+	closed  bool
+}
+
+func (s *recordingSink) Write(_ context.Context, records []Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, append([]Record(nil), records...))
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func TestBatcher(t *testing.T) {
+	s := &recordingSink{}
+	cfg := DefaultBatchConfig()
+	cfg.Size = 3
+	cfg.Interval = time.Hour
+	b := NewBatcher(s, cfg)
+
+	for i := 0; i < 7; i++ {
+		b.Add(Record{Level: InfoLevel, Message: "hello"})
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b.Add(Record{Level: InfoLevel, Message: "after close"})
+
+	if !s.closed {
+		t.Fatal("sink not closed")
+	}
+	var sizes []int
+	for _, batch := range s.batches {
+		sizes = append(sizes, len(batch))
+	}
+	if len(sizes) != 3 || sizes[0] != 3 || sizes[1] != 3 || sizes[2] != 1 {
+		t.Fatalf("unexpected batch sizes: %v", sizes)
+	}
+	if b.Dropped() != 1 {
+		t.Fatalf("expected 1 dropped record, got %d", b.Dropped())
+	}
+}
+
+func TestBatcherInterval(t *testing.T) {
+	s := &recordingSink{}
+	cfg := DefaultBatchConfig()
+	cfg.Interval = 10 * time.Millisecond
+	b := NewBatcher(s, cfg)
+	defer b.Close()
+
+	b.Add(Record{Level: InfoLevel, Message: "hello"})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		n := len(s.batches)
+		s.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("batch not written after interval")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -35,3 +35,10 @@ func WithOnError(f func(name string)) Option {
 		l.onError = f
 	}
 }
+
+// WithSink allows to send log messages to a sink in addition to the log output.
+func WithSink(b *flog.Batcher) Option {
+	return func(l *Logger) {
+		l.sink = b
+	}
+}
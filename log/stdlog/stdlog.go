@@ -7,10 +7,12 @@
 package stdlog
 
 import (
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	flog "github.com/saucelabs/forwarder/log"
 )
@@ -66,6 +68,7 @@ type Logger struct {
 
 	decorate func(string) string
 	onError  func(name string)
+	sink     *flog.Batcher
 }
 
 func (sl Logger) Named(name string, opts ...Option) *Logger { //nolint:gocritic // we pass by value to get a copy
@@ -107,6 +110,7 @@ func (sl *Logger) Errorf(format string, args ...any) {
 		format = sl.decorate(format)
 	}
 	sl.log.Printf(sl.errorPfx+format, args...)
+	sl.toSink(flog.ErrorLevel, format, args)
 }
 
 func (sl *Logger) Infof(format string, args ...any) {
@@ -117,6 +121,7 @@ func (sl *Logger) Infof(format string, args ...any) {
 		format = sl.decorate(format)
 	}
 	sl.log.Printf(sl.infoPfx+format, args...)
+	sl.toSink(flog.InfoLevel, format, args)
 }
 
 func (sl *Logger) Debugf(format string, args ...any) {
@@ -127,6 +132,20 @@ func (sl *Logger) Debugf(format string, args ...any) {
 		format = sl.decorate(format)
 	}
 	sl.log.Printf(sl.debugPfx+format, args...)
+	sl.toSink(flog.DebugLevel, format, args)
+}
+
+func (sl *Logger) toSink(level flog.Level, format string, args []any) {
+	if sl.sink == nil {
+		return
+	}
+	sl.sink.Add(flog.Record{
+		Time:    time.Now().UTC(),
+		Level:   level,
+		Name:    sl.name,
+		Labels:  sl.labels,
+		Message: fmt.Sprintf(format, args...),
+	})
 }
 
 // Unwrap returns the underlying log.Logger pointer.
@@ -0,0 +1,96 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// MemListener is an in-memory net.Listener with a matching dialer.
+// Connections are synchronous in-memory pipes, see net.Pipe.
+//
+// It allows to run the proxy or an origin server without real ports,
+// set it as ListenerConfig.Listener to serve the proxy on it,
+// and use DialContext as http.Transport.DialContext to connect to it.
+// To reach an in-memory origin server through the proxy, register DialContext in the proxy transport DialerRegistry.
+type MemListener struct {
+	addr  memAddr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewMemListener returns a new in-memory listener, name is returned as the listener address.
+func NewMemListener(name string) *MemListener {
+	return &MemListener{
+		addr:  memAddr(name),
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *MemListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *MemListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *MemListener) Addr() net.Addr {
+	return l.addr
+}
+
+// DialContext returns a new connection to the listener, network and address are ignored.
+func (l *MemListener) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	c, s := net.Pipe()
+	select {
+	case l.conns <- memConn{Conn: s, local: l.addr, remote: l.addr}:
+		return memConn{Conn: c, local: l.addr, remote: l.addr}, nil
+	case <-l.done:
+		c.Close()
+		s.Close()
+		return nil, &net.OpError{Op: "dial", Net: l.addr.Network(), Addr: l.addr, Err: net.ErrClosed}
+	case <-ctx.Done():
+		c.Close()
+		s.Close()
+		return nil, ctx.Err()
+	}
+}
+
+type memAddr string
+
+func (memAddr) Network() string {
+	return "mem"
+}
+
+func (a memAddr) String() string {
+	return string(a)
+}
+
+type memConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c memConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c memConn) RemoteAddr() net.Addr {
+	return c.remote
+}
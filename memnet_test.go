@@ -0,0 +1,60 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMemListener(t *testing.T) {
+	ml := NewMemListener("mem")
+	l := Listener{
+		ListenerConfig: ListenerConfig{
+			Listener: ml,
+		},
+		PromConfig: PromConfig{
+			PromRegistry: prometheus.NewRegistry(),
+		},
+	}
+	if err := l.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if got, want := l.Addr().String(), "mem"; got != want {
+		t.Fatalf("l.Addr(): got %q, want %q", got, want)
+	}
+
+	go l.acceptAndCopy()
+
+	conn, err := ml.DialContext(context.Background(), "tcp", "foo:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "Hello, World!\n")
+	buf := make([]byte, 20)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf[:n]), "Hello, World!\n"; got != want {
+		t.Fatalf("conn.Read(): got %q, want %q", got, want)
+	}
+
+	l.Close()
+	if _, err := ml.DialContext(context.Background(), "tcp", "foo:80"); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("DialContext after Close: got %v, want %v", err, net.ErrClosed)
+	}
+}
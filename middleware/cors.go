@@ -0,0 +1,65 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package middleware
+
+import (
+	"net/http"
+	"slices"
+)
+
+// CORS implements Cross-Origin Resource Sharing for read-only endpoints.
+// It allows browsers to call the wrapped handler from the allowed origins,
+// "*" allows all origins.
+//
+// See https://developer.mozilla.org/en-US/docs/Web/HTTP/CORS
+type CORS struct {
+	origins  []string
+	allowAll bool
+}
+
+func NewCORS(origins []string) *CORS {
+	return &CORS{
+		origins:  origins,
+		allowAll: slices.Contains(origins, "*"),
+	}
+}
+
+func (c *CORS) allowed(origin string) bool {
+	return c.allowAll || slices.Contains(c.origins, origin)
+}
+
+// Wrap wraps the provided http.Handler with CORS headers.
+// Preflight requests are answered directly, and are not passed to the handler,
+// so that they are not rejected by authentication.
+func (c *CORS) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if !c.allowed(origin) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", AuthorizationHeader)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,65 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSWrap(t *testing.T) {
+	h := NewCORS([]string{"https://dashboard.example.com"}).Wrap(
+		NewBasicAuth().Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}), "user", "pass"))
+
+	t.Run("Preflight", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodOptions, "/", http.NoBody)
+		r.Header.Set("Origin", "https://dashboard.example.com")
+		r.Header.Set("Access-Control-Request-Method", http.MethodGet)
+
+		h.ServeHTTP(w, r)
+		if w.Result().StatusCode != http.StatusNoContent {
+			t.Errorf("got %v", w.Result().StatusCode)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://dashboard.example.com" {
+			t.Errorf("got allow origin %q", got)
+		}
+	})
+
+	t.Run("Allowed Origin", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+		r.Header.Set("Origin", "https://dashboard.example.com")
+		r.SetBasicAuth("user", "pass")
+
+		h.ServeHTTP(w, r)
+		if w.Result().StatusCode != http.StatusOK {
+			t.Errorf("got %v", w.Result().StatusCode)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://dashboard.example.com" {
+			t.Errorf("got allow origin %q", got)
+		}
+	})
+
+	t.Run("Other Origin", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodOptions, "/", http.NoBody)
+		r.Header.Set("Origin", "https://evil.example.com")
+		r.Header.Set("Access-Control-Request-Method", http.MethodGet)
+
+		h.ServeHTTP(w, r)
+		if w.Result().StatusCode != http.StatusUnauthorized {
+			t.Errorf("got %v", w.Result().StatusCode)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("got allow origin %q", got)
+		}
+	})
+}
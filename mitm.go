@@ -10,6 +10,8 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
+	"fmt"
+	"slices"
 	"time"
 
 	"github.com/saucelabs/forwarder/internal/martian/mitm"
@@ -23,22 +25,94 @@ type MITMConfig struct {
 	Validity     time.Duration
 	CacheSize    uint32
 	CacheTTL     time.Duration
+
+	// KeyType is the type of the keys of the generated certificates.
+	KeyType certutil.KeyType
+
+	// ProtocolRules control the protocols of MITMed connections per host, the first matching rule is used.
+	// Hosts not matching any rule use HTTP/1.1 and TLS 1.2 or later.
+	ProtocolRules []MITMProtocolRule
+
+	// GenWorkers is the maximum number of certificates generated concurrently, zero means GOMAXPROCS.
+	GenWorkers int
+
+	// PrefetchQueueSize is the maximum number of certificates generated on CONNECT waiting for a worker, zero disables prefetching.
+	PrefetchQueueSize int
+
+	// SharedKey enables using a single key for all generated certificates instead of generating a key for each certificate.
+	SharedKey bool
+
+	// SessionTickets enables TLS session resumption with session tickets for MITMed connections.
+	SessionTickets bool
+
+	// TicketKeyRotation is the interval of session ticket key rotation.
+	TicketKeyRotation time.Duration
+
+	// TicketKeyStore, if set, shares the session ticket keys between proxy instances,
+	// so that sessions can be resumed on any instance.
+	TicketKeyStore TicketKeyStore
+
+	// CAExpiryWarning is the time before the CA expiry when warnings are logged.
+	CAExpiryWarning time.Duration
+
+	// CARotateBefore enables CA rotation, the generated CA is rotated when it expires in less than CARotateBefore,
+	// the CA loaded from files is rotated when the files change.
+	CARotateBefore time.Duration
+
+	// CARotateOverlap is the time the new CA is trusted before it is used, and the previous CA is trusted after rotation.
+	CARotateOverlap time.Duration
 }
 
 func DefaultMITMConfig() *MITMConfig {
 	cc := mitm.DefaultCacheConfig()
+	gc := mitm.DefaultGenConfig()
 
 	return &MITMConfig{
 		Organization: "Forwarder Proxy MITM",
 		Validity:     24 * time.Hour, //nolint:gomnd // 24 hours is a reasonable default
 		CacheSize:    cc.Capacity,
 		CacheTTL:     cc.TTL,
+		KeyType:      certutil.KeyTypeRSA,
+		SharedKey:    true,
+
+		GenWorkers:        gc.Workers,
+		PrefetchQueueSize: gc.PrefetchQueueSize,
+
+		SessionTickets:    true,
+		TicketKeyRotation: time.Hour,
+
+		CAExpiryWarning: 7 * 24 * time.Hour,
+		CARotateOverlap: 24 * time.Hour,
 	}
 }
 
-func (c *MITMConfig) loadCACertificate() (cert tls.Certificate, err error) {
+func (c *MITMConfig) Validate() error {
+	if _, err := certutil.ParseKeyType(string(c.KeyType)); err != nil {
+		return fmt.Errorf("key_type: %w", err)
+	}
+	if c.GenWorkers < 0 {
+		return errors.New("gen_workers must be non-negative")
+	}
+	if c.PrefetchQueueSize < 0 {
+		return errors.New("prefetch_queue_size must be non-negative")
+	}
+	if c.SessionTickets && c.TicketKeyRotation <= 0 {
+		return errors.New("ticket_key_rotation must be positive")
+	}
+	if c.CARotateBefore > 0 && c.CACertFile == "" && c.CAKeyFile == "" && c.CARotateOverlap >= c.CARotateBefore {
+		return errors.New("ca_rotate_overlap must be less than ca_rotate_before, otherwise the CA expires before the new CA is used")
+	}
+	return nil
+}
+
+func (c *MITMConfig) forwardALPN() bool {
+	return slices.ContainsFunc(c.ProtocolRules, func(r MITMProtocolRule) bool { return r.ForwardALPN })
+}
+
+func (c *MITMConfig) loadCACertificate(now time.Time) (cert tls.Certificate, err error) {
 	if c.CACertFile == "" && c.CAKeyFile == "" {
 		tmpl := certutil.ECDSASelfSignedCert()
+		tmpl.ValidFrom = now
 		tmpl.Organization = []string{c.Organization}
 		tmpl.Hosts = nil
 		tmpl.IsCA = true
@@ -48,8 +122,8 @@ func (c *MITMConfig) loadCACertificate() (cert tls.Certificate, err error) {
 	return loadX509KeyPair(c.CACertFile, c.CAKeyFile)
 }
 
-func newMartianMITMConfig(c *MITMConfig) (*mitm.Config, error) {
-	cert, err := c.loadCACertificate()
+func newMartianMITMConfig(c *MITMConfig, now func() time.Time) (*mitm.Config, error) {
+	cert, err := c.loadCACertificate(now())
 	if err != nil {
 		return nil, err
 	}
@@ -75,6 +149,17 @@ func newMartianMITMConfig(c *MITMConfig) (*mitm.Config, error) {
 	}
 	cfg.SetOrganization(c.Organization)
 	cfg.SetValidity(c.Validity)
+	cfg.SetClock(now)
+	cfg.SetGenConfig(mitm.GenConfig{
+		Workers:           c.GenWorkers,
+		PrefetchQueueSize: c.PrefetchQueueSize,
+	})
+	if len(c.ProtocolRules) > 0 {
+		cfg.SetHostPolicy(mitmHostPolicy(c.ProtocolRules))
+	}
+	if err := cfg.SetLeafKey(c.KeyType, c.SharedKey); err != nil {
+		return nil, err
+	}
 
 	return cfg, nil
 }
@@ -0,0 +1,166 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/martian/mitm"
+	"github.com/saucelabs/forwarder/log"
+)
+
+const (
+	// mitmCACheckInterval is the interval of CA expiry and rotation checks.
+	mitmCACheckInterval = time.Minute
+
+	// mitmCAWarnInterval is the minimum time between CA expiry warnings.
+	mitmCAWarnInterval = time.Hour
+)
+
+// mitmCA monitors the MITM CA certificate expiry, and rotates it if rotation is enabled.
+// When a new CA is available, it is trusted for the overlap window before it is used to sign certificates,
+// and the previous CA stays trusted for the overlap window after the switch.
+// The generated CA is rotated when it expires in less than MITMConfig.CARotateBefore,
+// the CA loaded from files is rotated when the files change.
+type mitmCA struct {
+	cfg *MITMConfig
+	mc  *mitm.Config
+	log log.Logger
+	now func() time.Time
+
+	mu        sync.Mutex
+	next      *tls.Certificate
+	nextSince time.Time
+	prev      *x509.Certificate
+	prevUntil time.Time
+	lastWarn  time.Time
+}
+
+func newMITMCA(cfg *MITMConfig, mc *mitm.Config, log log.Logger, now func() time.Time) *mitmCA {
+	return &mitmCA{
+		cfg: cfg,
+		mc:  mc,
+		log: log,
+		now: now,
+	}
+}
+
+// certs returns the CA certificates clients should trust, the active CA first.
+func (m *mitmCA) certs() []*x509.Certificate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	certs := []*x509.Certificate{m.mc.CACert()}
+	if m.next != nil {
+		certs = append(certs, m.next.Leaf)
+	}
+	if m.prev != nil {
+		certs = append(certs, m.prev)
+	}
+	return certs
+}
+
+func (m *mitmCA) run(ctx context.Context) {
+	t := time.NewTicker(mitmCACheckInterval)
+	defer t.Stop()
+
+	for {
+		m.check()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (m *mitmCA) check() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	ca := m.mc.CACert()
+
+	if m.prev != nil && !now.Before(m.prevUntil) {
+		m.prev = nil
+	}
+
+	if m.cfg.CARotateBefore > 0 {
+		if m.next == nil {
+			next, err := m.nextCA(ca, now)
+			if err != nil {
+				m.log.Errorf("MITM CA rotation: %s", err)
+			} else if next != nil {
+				m.next = next
+				m.nextSince = now
+				m.log.Infof("MITM CA rotation started, new CA sha256 fingerprint=%x expires=%s, it will be used after %s",
+					sha256.Sum256(next.Leaf.Raw), next.Leaf.NotAfter.UTC().Format(time.RFC3339), m.cfg.CARotateOverlap)
+			}
+		}
+		if m.next != nil && now.Sub(m.nextSince) >= m.cfg.CARotateOverlap {
+			m.mc.SetCA(m.next.Leaf, m.next.PrivateKey)
+			m.prev = ca
+			m.prevUntil = now.Add(m.cfg.CARotateOverlap)
+			m.next = nil
+			ca = m.mc.CACert()
+			m.log.Infof("MITM CA rotated, sha256 fingerprint=%x", sha256.Sum256(ca.Raw))
+		}
+	}
+
+	if left := ca.NotAfter.Sub(now); left < m.cfg.CAExpiryWarning && now.Sub(m.lastWarn) >= mitmCAWarnInterval {
+		m.lastWarn = now
+		if left <= 0 {
+			m.log.Errorf("MITM CA certificate expired at %s", ca.NotAfter.UTC().Format(time.RFC3339))
+		} else {
+			m.log.Errorf("MITM CA certificate expires in %s at %s", left.Round(time.Minute), ca.NotAfter.UTC().Format(time.RFC3339))
+		}
+	}
+}
+
+// nextCA returns the CA to rotate to, or nil if rotation is not needed.
+func (m *mitmCA) nextCA(ca *x509.Certificate, now time.Time) (*tls.Certificate, error) {
+	if m.cfg.CACertFile == "" && m.cfg.CAKeyFile == "" {
+		if ca.NotAfter.Sub(now) >= m.cfg.CARotateBefore {
+			return nil, nil //nolint:nilnil // no rotation needed
+		}
+	}
+
+	cert, err := m.cfg.loadCACertificate(now)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	if bytes.Equal(cert.Leaf.Raw, ca.Raw) {
+		return nil, nil //nolint:nilnil // files did not change
+	}
+	if !cert.Leaf.IsCA {
+		return nil, errors.New("certificate is not a CA")
+	}
+
+	return &cert, nil
+}
+
+// leafExpiry returns the expiry time of a certificate generated now.
+func (m *mitmCA) leafExpiry() time.Time {
+	t := m.now().Add(m.cfg.Validity)
+	if na := m.mc.CACert().NotAfter; t.After(na) {
+		t = na
+	}
+	return t
+}
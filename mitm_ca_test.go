@@ -0,0 +1,151 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"github.com/saucelabs/forwarder/utils/certutil"
+)
+
+func newTestMITMCA(t *testing.T, cfg *MITMConfig) *mitmCA {
+	t.Helper()
+
+	mc, err := newMartianMITMConfig(cfg, time.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newMITMCA(cfg, mc, stdlog.Default(), time.Now)
+}
+
+func TestMITMCARotationGenerated(t *testing.T) {
+	cfg := DefaultMITMConfig()
+	cfg.CARotateBefore = 3 * time.Hour
+	cfg.CARotateOverlap = time.Hour
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	m := newTestMITMCA(t, cfg)
+	old := m.mc.CACert()
+
+	now := time.Now()
+	m.now = func() time.Time { return now }
+	m.check()
+	if got := len(m.certs()); got != 1 {
+		t.Fatalf("expected no rotation, got %d certificates", got)
+	}
+
+	// Expiring, the new CA is trusted but not used yet.
+	now = old.NotAfter.Add(-2 * time.Hour)
+	m.check()
+	certs := m.certs()
+	if len(certs) != 2 || !certs[0].Equal(old) || certs[1].Equal(old) {
+		t.Fatalf("expected the old CA and the new CA, got %d certificates", len(certs))
+	}
+	next := certs[1]
+
+	// After overlap, the new CA is used and the old CA is trusted.
+	now = now.Add(time.Hour)
+	m.check()
+	certs = m.certs()
+	if len(certs) != 2 || !certs[0].Equal(next) || !certs[1].Equal(old) {
+		t.Fatal("expected the new CA to be active and the old CA to be trusted")
+	}
+
+	// After another overlap, the old CA is no longer trusted.
+	now = now.Add(time.Hour)
+	m.check()
+	if m.prev != nil || !m.mc.CACert().Equal(next) {
+		t.Fatal("expected the old CA to be dropped")
+	}
+
+	// Certificates are signed by the new CA.
+	tc, err := m.mc.TLS(context.Background()).GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.Leaf.CheckSignatureFrom(next); err != nil {
+		t.Fatalf("certificate not signed by the new CA: %v", err)
+	}
+	if tc.Leaf.NotAfter.After(next.NotAfter) {
+		t.Fatal("certificate outlives the CA")
+	}
+}
+
+func writeTestCA(t *testing.T, dir string) {
+	t.Helper()
+
+	ssc := certutil.ECDSASelfSignedCert()
+	ssc.IsCA = true
+	ssc.Hosts = nil
+	cert, err := ssc.Gen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	if err := os.WriteFile(filepath.Join(dir, "ca.crt"), certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "ca.key"), keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMITMCARotationFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCA(t, dir)
+
+	cfg := DefaultMITMConfig()
+	cfg.CACertFile = filepath.Join(dir, "ca.crt")
+	cfg.CAKeyFile = filepath.Join(dir, "ca.key")
+	cfg.CARotateBefore = time.Hour
+	cfg.CARotateOverlap = time.Hour
+	m := newTestMITMCA(t, cfg)
+	old := m.mc.CACert()
+
+	now := time.Now()
+	m.now = func() time.Time { return now }
+	m.check()
+	if got := len(m.certs()); got != 1 {
+		t.Fatalf("expected no rotation, got %d certificates", got)
+	}
+
+	writeTestCA(t, dir)
+	m.check()
+	if got := len(m.certs()); got != 2 {
+		t.Fatalf("expected rotation to start, got %d certificates", got)
+	}
+
+	now = now.Add(time.Hour)
+	m.check()
+	if m.mc.CACert().Equal(old) {
+		t.Fatal("expected the CA to be rotated")
+	}
+}
+
+func TestMITMConfigValidateRotation(t *testing.T) {
+	cfg := DefaultMITMConfig()
+	cfg.CARotateBefore = time.Hour
+	cfg.CARotateOverlap = time.Hour
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saucelabs/forwarder/log"
+)
+
+// MITMCertLogEntry is a MITM certificate issued by the proxy.
+type MITMCertLogEntry struct {
+	Time      time.Time `json:"time"`
+	Host      string    `json:"host"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	SHA256    string    `json:"sha256"`
+	CASHA256  string    `json:"ca_sha256"`
+}
+
+// defaultMITMCertLogLimit is the default maximum number of entries returned by a query.
+const defaultMITMCertLogLimit = 1000
+
+// MITMCertLog is an append-only log of issued MITM certificates stored in a file as newline delimited JSON.
+// It allows to audit which hostnames were intercepted and when.
+//
+// It serves the entries as newline delimited JSON, the oldest first, filtered by query parameters:
+//   - host: hostname, a leading dot matches the domain and its subdomains e.g. .example.com
+//   - since, until: RFC 3339 timestamps of the issue time
+//   - limit: maximum number of the most recent entries to return, the default is 1000
+type MITMCertLog struct {
+	mu  sync.Mutex
+	f   *os.File
+	log log.Logger
+}
+
+// NewMITMCertLog returns a log appending to f, f should be opened in append mode.
+// Queries read the file by name.
+func NewMITMCertLog(f *os.File, log log.Logger) *MITMCertLog {
+	return &MITMCertLog{
+		f:   f,
+		log: log,
+	}
+}
+
+func (l *MITMCertLog) add(host string, cert, ca *x509.Certificate) {
+	fp := sha256.Sum256(cert.Raw)
+	cafp := sha256.Sum256(ca.Raw)
+	l.Append(MITMCertLogEntry{
+		Time:      time.Now().UTC(),
+		Host:      host,
+		Serial:    cert.SerialNumber.Text(16),
+		NotBefore: cert.NotBefore.UTC(),
+		NotAfter:  cert.NotAfter.UTC(),
+		SHA256:    hex.EncodeToString(fp[:]),
+		CASHA256:  hex.EncodeToString(cafp[:]),
+	})
+}
+
+// Append writes the entry to the log.
+func (l *MITMCertLog) Append(e MITMCertLogEntry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		l.log.Errorf("MITM certificate log: %s", err)
+		return
+	}
+	b = append(b, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := l.f.Write(b); err != nil {
+		l.log.Errorf("MITM certificate log: %s", err)
+	}
+}
+
+func (l *MITMCertLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q, err := parseMITMCertLogQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries, err := l.query(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	for i := range entries {
+		enc.Encode(&entries[i])
+	}
+}
+
+type mitmCertLogQuery struct {
+	host  string
+	since time.Time
+	until time.Time
+	limit int
+}
+
+func parseMITMCertLogQuery(r *http.Request) (q mitmCertLogQuery, err error) {
+	v := r.URL.Query()
+
+	q.host = strings.ToLower(v.Get("host"))
+	if s := v.Get("since"); s != "" {
+		if q.since, err = time.Parse(time.RFC3339, s); err != nil {
+			return q, fmt.Errorf("invalid since: %w", err)
+		}
+	}
+	if s := v.Get("until"); s != "" {
+		if q.until, err = time.Parse(time.RFC3339, s); err != nil {
+			return q, fmt.Errorf("invalid until: %w", err)
+		}
+	}
+	q.limit = defaultMITMCertLogLimit
+	if s := v.Get("limit"); s != "" {
+		if q.limit, err = strconv.Atoi(s); err != nil || q.limit <= 0 {
+			return q, fmt.Errorf("invalid limit %q", s)
+		}
+	}
+
+	return q, nil
+}
+
+func (q *mitmCertLogQuery) match(e *MITMCertLogEntry) bool {
+	if q.host != "" {
+		if strings.HasPrefix(q.host, ".") {
+			if e.Host != q.host[1:] && !strings.HasSuffix(e.Host, q.host) {
+				return false
+			}
+		} else if e.Host != q.host {
+			return false
+		}
+	}
+	if !q.since.IsZero() && e.Time.Before(q.since) {
+		return false
+	}
+	if !q.until.IsZero() && e.Time.After(q.until) {
+		return false
+	}
+	return true
+}
+
+func (l *MITMCertLog) query(q mitmCertLogQuery) ([]MITMCertLogEntry, error) {
+	f, err := os.Open(l.f.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []MITMCertLogEntry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e MITMCertLogEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			continue
+		}
+		if !q.match(&e) {
+			continue
+		}
+		entries = append(entries, e)
+		if len(entries) > q.limit {
+			entries = entries[1:]
+		}
+	}
+
+	return entries, s.Err()
+}
@@ -0,0 +1,102 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log"
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestMITMCertLog(t *testing.T) {
+	f, err := os.OpenFile(filepath.Join(t.TempDir(), "certs.jsonl"), log.DefaultFileFlags, log.DefaultFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cl := NewMITMCertLog(f, stdlog.Default())
+
+	mc, err := newMartianMITMConfig(DefaultMITMConfig(), time.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc.SetIssuedCertCallback(cl.add)
+
+	tc := mc.TLS(context.Background())
+	leaf := make(map[string]*tls.Certificate)
+	for _, host := range []string{"example.com", "www.example.com", "example.org", "example.com"} {
+		c, err := tc.GetCertificate(&tls.ClientHelloInfo{ServerName: host})
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf[host] = c
+	}
+
+	tests := []struct {
+		query string
+		hosts []string
+	}{
+		{query: "", hosts: []string{"example.com", "www.example.com", "example.org"}},
+		{query: "?host=example.com", hosts: []string{"example.com"}},
+		{query: "?host=.example.com", hosts: []string{"example.com", "www.example.com"}},
+		{query: "?limit=1", hosts: []string{"example.org"}},
+		{query: "?since=2000-01-01T00:00:00Z&until=2001-01-01T00:00:00Z"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			cl.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/mitm/certs"+tc.query, http.NoBody))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+			}
+
+			var hosts []string
+			s := bufio.NewScanner(rec.Body)
+			for s.Scan() {
+				var e MITMCertLogEntry
+				if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+					t.Fatal(err)
+				}
+				fp := sha256.Sum256(leaf[e.Host].Leaf.Raw)
+				if e.SHA256 != hex.EncodeToString(fp[:]) {
+					t.Errorf("fingerprint mismatch for %s", e.Host)
+				}
+				if e.Serial != leaf[e.Host].Leaf.SerialNumber.Text(16) {
+					t.Errorf("serial mismatch for %s", e.Host)
+				}
+				hosts = append(hosts, e.Host)
+			}
+			if len(hosts) != len(tc.hosts) {
+				t.Fatalf("expected hosts %v, got %v", tc.hosts, hosts)
+			}
+			for i := range hosts {
+				if hosts[i] != tc.hosts[i] {
+					t.Fatalf("expected hosts %v, got %v", tc.hosts, hosts)
+				}
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	cl.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/mitm/certs?limit=0", http.NoBody))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
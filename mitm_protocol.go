@@ -0,0 +1,167 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/internal/martian/mitm"
+)
+
+// Options that can be used in MITMProtocolRule.
+const (
+	MITMProtocolHTTP1       = "h1"
+	MITMProtocolHTTP2       = "h2"
+	MITMProtocolForwardALPN = "forward-alpn"
+)
+
+var mitmTLSVersions = map[string]uint16{
+	"tls1.0": tls.VersionTLS10,
+	"tls1.1": tls.VersionTLS11,
+	"tls1.2": tls.VersionTLS12,
+	"tls1.3": tls.VersionTLS13,
+}
+
+// MITMProtocolRule controls the protocols of MITMed connections to hosts matching Host.
+type MITMProtocolRule struct {
+	Host *regexp.Regexp
+
+	// HTTP2 allows clients to negotiate HTTP/2 with ALPN, otherwise only HTTP/1.1 is offered.
+	HTTP2 bool
+
+	// MinTLSVersion is the minimum TLS version accepted from clients, zero means TLS 1.2.
+	MinTLSVersion uint16
+
+	// ForwardALPN sends the requests to the origin server with the protocol negotiated with the client,
+	// otherwise HTTP/1.1 is used.
+	ForwardALPN bool
+}
+
+// ParseMITMProtocolRule parses <regexp>=<option>[|<option>]... string into MITMProtocolRule.
+// The option is h1 or h2, a minimum TLS version tls1.0, tls1.1, tls1.2 or tls1.3, or forward-alpn.
+func ParseMITMProtocolRule(val string) (MITMProtocolRule, error) {
+	idx := strings.LastIndex(val, "=")
+	if idx <= 0 || idx == len(val)-1 {
+		return MITMProtocolRule{}, errors.New("expected <regexp>=<option>[|<option>]...")
+	}
+
+	re, err := regexp.Compile(val[:idx])
+	if err != nil {
+		return MITMProtocolRule{}, err
+	}
+	r := MITMProtocolRule{Host: re}
+
+	var proto string
+	for _, opt := range strings.Split(val[idx+1:], "|") {
+		switch opt {
+		case MITMProtocolHTTP1, MITMProtocolHTTP2:
+			if proto != "" && proto != opt {
+				return MITMProtocolRule{}, errors.New("h1 and h2 are mutually exclusive")
+			}
+			proto = opt
+			r.HTTP2 = opt == MITMProtocolHTTP2
+		case MITMProtocolForwardALPN:
+			r.ForwardALPN = true
+		default:
+			v, ok := mitmTLSVersions[opt]
+			if !ok {
+				return MITMProtocolRule{}, fmt.Errorf("invalid option %q", opt)
+			}
+			r.MinTLSVersion = v
+		}
+	}
+
+	if r.ForwardALPN && !r.HTTP2 {
+		return MITMProtocolRule{}, errors.New("forward-alpn requires h2")
+	}
+
+	return r, nil
+}
+
+func (r MITMProtocolRule) String() string {
+	opts := []string{MITMProtocolHTTP1}
+	if r.HTTP2 {
+		opts[0] = MITMProtocolHTTP2
+	}
+	if r.MinTLSVersion != 0 {
+		opts = append(opts, "tls"+strings.TrimPrefix(tls.VersionName(r.MinTLSVersion), "TLS "))
+	}
+	if r.ForwardALPN {
+		opts = append(opts, MITMProtocolForwardALPN)
+	}
+	return r.Host.String() + "=" + strings.Join(opts, "|")
+}
+
+// matchMITMProtocolRule returns the first rule matching the host.
+func matchMITMProtocolRule(rules []MITMProtocolRule, host string) (MITMProtocolRule, bool) {
+	for _, r := range rules {
+		if matchHost(MatchFunc(r.Host.MatchString), host) {
+			return r, true
+		}
+	}
+	return MITMProtocolRule{}, false
+}
+
+func mitmHostPolicy(rules []MITMProtocolRule) func(hostname string) mitm.HostPolicy {
+	return func(hostname string) mitm.HostPolicy {
+		r, ok := matchMITMProtocolRule(rules, hostname)
+		if !ok {
+			return mitm.HostPolicy{}
+		}
+		return mitm.HostPolicy{
+			HTTP2:      r.HTTP2,
+			MinVersion: r.MinTLSVersion,
+		}
+	}
+}
+
+// mitmALPNTransport sends MITMed requests from HTTP/2 clients to origin servers matching a rule with ForwardALPN
+// with a transport that negotiates HTTP/2.
+// Other requests are sent with rt, which uses HTTP/1.1, see martian.Proxy.
+type mitmALPNTransport struct {
+	rules []MITMProtocolRule
+	rt    http.RoundTripper
+	h2    *http.Transport
+}
+
+func newMITMALPNTransport(rules []MITMProtocolRule, tr *http.Transport) *mitmALPNTransport {
+	h2 := tr.Clone()
+	h2.TLSNextProto = nil
+	h2.ForceAttemptHTTP2 = true
+	if dial := h2.DialTLSContext; dial != nil {
+		h2.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dial(withTLSNextProtos(ctx, []string{"h2", "http/1.1"}), network, addr)
+		}
+	}
+
+	return &mitmALPNTransport{
+		rules: rules,
+		rt:    tr,
+		h2:    h2,
+	}
+}
+
+func (t *mitmALPNTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.TLS != nil && req.TLS.NegotiatedProtocol == "h2" && martian.ContextConnectAuthority(req.Context()) != "" {
+		if r, ok := matchMITMProtocolRule(t.rules, req.URL.Hostname()); ok && r.ForwardALPN {
+			return t.h2.RoundTrip(req)
+		}
+	}
+	return t.rt.RoundTrip(req)
+}
+
+func (t *mitmALPNTransport) CloseIdleConnections() {
+	t.h2.CloseIdleConnections()
+}
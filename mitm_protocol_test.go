@@ -0,0 +1,79 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/saucelabs/forwarder/internal/martian/mitm"
+)
+
+func TestParseMITMProtocolRule(t *testing.T) {
+	tests := []struct {
+		input string
+		err   bool
+	}{
+		{input: `.*\.example\.com=h1`},
+		{input: `.*\.example\.com=h2`},
+		{input: `.*\.example\.com=h1|tls1.3`},
+		{input: `.*\.example\.com=h2|tls1.2|forward-alpn`},
+		{input: `.*\.example\.com=`, err: true},
+		{input: `=h2`, err: true},
+		{input: `.*\.example\.com=h1|h2`, err: true},
+		{input: `.*\.example\.com=h1|forward-alpn`, err: true},
+		{input: `.*\.example\.com=h3`, err: true},
+		{input: `.*\.example\.com=tls1.4`, err: true},
+		{input: `(=h2`, err: true},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.input, func(t *testing.T) {
+			r, err := ParseMITMProtocolRule(tc.input)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected error, got %v", r)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.String() != tc.input {
+				t.Fatalf("expected %s, got %s", tc.input, r)
+			}
+		})
+	}
+}
+
+func TestMITMHostPolicy(t *testing.T) {
+	var rules []MITMProtocolRule
+	for _, s := range []string{`h1\.example\.com=h1|tls1.3`, `.*\.example\.com=h2`} {
+		r, err := ParseMITMProtocolRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, r)
+	}
+	policy := mitmHostPolicy(rules)
+
+	tests := []struct {
+		host string
+		want mitm.HostPolicy
+	}{
+		{host: "h1.example.com", want: mitm.HostPolicy{MinVersion: tls.VersionTLS13}},
+		{host: "h2.example.com", want: mitm.HostPolicy{HTTP2: true}},
+		{host: "example.org", want: mitm.HostPolicy{}},
+	}
+
+	for _, tc := range tests {
+		if got := policy(tc.host); got != tc.want {
+			t.Errorf("%s: expected %+v, got %+v", tc.host, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/martian/mitm"
+	"github.com/saucelabs/forwarder/log"
+)
+
+// TicketKeyStore shares a value between proxy instances, the first stored value under name wins and expires after ttl.
+// It is used to share the MITM session ticket keys, see cluster.Leader.GetOrSet.
+type TicketKeyStore func(ctx context.Context, name string, ttl time.Duration, value func() []byte) ([]byte, error)
+
+// mitmTicketKeysKept is the number of ticket keys in use, the current key and the previous keys to decrypt older tickets.
+const mitmTicketKeysKept = 3
+
+// mitmTicketKeys rotates the session ticket keys of the MITM TLS server.
+// Keys are bound to epochs of the rotation interval since the Unix epoch,
+// so that instances sharing the keys via the store rotate them at the same time.
+type mitmTicketKeys struct {
+	interval time.Duration
+	store    TicketKeyStore
+	mc       *mitm.Config
+	log      log.Logger
+	now      func() time.Time
+
+	epoch int64
+}
+
+func newMITMTicketKeys(cfg *MITMConfig, mc *mitm.Config, log log.Logger, now func() time.Time) *mitmTicketKeys {
+	store := cfg.TicketKeyStore
+	if store == nil {
+		store = newLocalTicketKeyStore(now)
+	}
+
+	return &mitmTicketKeys{
+		interval: cfg.TicketKeyRotation,
+		store:    store,
+		mc:       mc,
+		log:      log,
+		now:      now,
+		epoch:    -1,
+	}
+}
+
+func (k *mitmTicketKeys) run(ctx context.Context) {
+	t := time.NewTicker(min(k.interval/10, time.Minute))
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		if err := k.rotate(ctx); err != nil {
+			k.log.Errorf("rotate MITM session ticket keys, keeping the previous keys: %s", err)
+		}
+	}
+}
+
+// rotate sets the keys of the current and previous epochs if the epoch changed.
+func (k *mitmTicketKeys) rotate(ctx context.Context) error {
+	epoch := k.now().UnixNano() / int64(k.interval)
+	if epoch == k.epoch {
+		return nil
+	}
+
+	keys := make([][32]byte, 0, mitmTicketKeysKept)
+	for i := range int64(mitmTicketKeysKept) {
+		b, err := k.store(ctx, "mitm-ticket-key:"+strconv.FormatInt(epoch-i, 10), mitmTicketKeysKept*k.interval, newTicketKey)
+		if err != nil {
+			return err
+		}
+		if len(b) != 32 {
+			return fmt.Errorf("invalid ticket key length %d", len(b))
+		}
+		keys = append(keys, [32]byte(b))
+	}
+	k.mc.SetSessionTicketKeys(keys)
+	k.epoch = epoch
+
+	k.log.Debugf("rotated MITM session ticket keys epoch=%d", epoch)
+
+	return nil
+}
+
+func newTicketKey() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}
+
+// newLocalTicketKeyStore returns a TicketKeyStore keeping the keys in memory, for a single instance.
+func newLocalTicketKeyStore(now func() time.Time) TicketKeyStore {
+	type entry struct {
+		value   []byte
+		expires time.Time
+	}
+	var (
+		mu      sync.Mutex
+		entries = make(map[string]entry)
+	)
+
+	return func(_ context.Context, name string, ttl time.Duration, value func() []byte) ([]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		t := now()
+		for k, e := range entries {
+			if !t.Before(e.expires) {
+				delete(entries, k)
+			}
+		}
+		if e, ok := entries[name]; ok {
+			return e.value, nil
+		}
+		v := value()
+		entries[name] = entry{value: v, expires: t.Add(ttl)}
+		return v, nil
+	}
+}
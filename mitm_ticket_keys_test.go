@@ -0,0 +1,83 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestMITMTicketKeysRotation(t *testing.T) {
+	now := time.Unix(0, 0).Add(10 * time.Hour)
+	clock := func() time.Time { return now }
+
+	var names []string
+	local := newLocalTicketKeyStore(clock)
+	store := func(ctx context.Context, name string, ttl time.Duration, value func() []byte) ([]byte, error) {
+		names = append(names, name)
+		return local(ctx, name, ttl, value)
+	}
+
+	cfg := DefaultMITMConfig()
+	cfg.TicketKeyStore = store
+	mc, err := newMartianMITMConfig(cfg, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := newMITMTicketKeys(cfg, mc, stdlog.Default(), clock)
+
+	ctx := context.Background()
+	if err := k.rotate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"mitm-ticket-key:10", "mitm-ticket-key:9", "mitm-ticket-key:8"}
+	if !slices.Equal(names, want) {
+		t.Fatalf("expected keys %v, got %v", want, names)
+	}
+
+	// Same epoch, keys are not rotated.
+	names = nil
+	now = now.Add(30 * time.Minute)
+	if err := k.rotate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Fatalf("expected no rotation, got %v", names)
+	}
+
+	// Next epoch, the current key is kept as the previous one.
+	now = now.Add(30 * time.Minute)
+	if err := k.rotate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"mitm-ticket-key:11", "mitm-ticket-key:10", "mitm-ticket-key:9"}
+	if !slices.Equal(names, want) {
+		t.Fatalf("expected keys %v, got %v", want, names)
+	}
+}
+
+func TestLocalTicketKeyStore(t *testing.T) {
+	now := time.Now()
+	s := newLocalTicketKeyStore(func() time.Time { return now })
+
+	ctx := context.Background()
+	a, _ := s(ctx, "key", time.Hour, newTicketKey)
+	b, _ := s(ctx, "key", time.Hour, newTicketKey)
+	if !slices.Equal(a, b) {
+		t.Fatal("expected the stored key")
+	}
+
+	now = now.Add(time.Hour)
+	c, _ := s(ctx, "key", time.Hour, newTicketKey)
+	if slices.Equal(a, c) {
+		t.Fatal("expected a new key after expiry")
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/log"
+)
+
+type NegotiateConfig struct {
+	// TokenCommand is the program and arguments to execute to obtain a SPNEGO token for an upstream proxy.
+	// The proxy hostname is appended as the last argument, the service principal is HTTP@<hostname>.
+	TokenCommand []string
+
+	// TokenTTL is the time a token is reused for requests to the same upstream proxy.
+	// Zero means that a new token is obtained for each request,
+	// which is required by proxies with a Kerberos replay cache.
+	TokenTTL time.Duration
+
+	// RenewCommand is the program and arguments to execute to obtain or renew the Kerberos ticket-granting ticket,
+	// such as kinit with a keytab.
+	RenewCommand []string
+
+	// RenewInterval is the time between executions of RenewCommand.
+	RenewInterval time.Duration
+
+	// MinInterval is the minimum time between renewals triggered by 407 responses.
+	MinInterval time.Duration
+
+	// Timeout limits the command execution time.
+	Timeout time.Duration
+}
+
+func DefaultNegotiateConfig() *NegotiateConfig {
+	return &NegotiateConfig{
+		RenewInterval: 4 * time.Hour,
+		MinInterval:   10 * time.Second,
+		Timeout:       30 * time.Second,
+	}
+}
+
+func (c *NegotiateConfig) Validate() error {
+	if len(c.TokenCommand) == 0 {
+		return errors.New("token command is required")
+	}
+	if c.TokenTTL < 0 {
+		return errors.New("token ttl must not be negative")
+	}
+	if len(c.RenewCommand) > 0 && c.RenewInterval <= 0 {
+		return errors.New("renew interval must be positive")
+	}
+	return nil
+}
+
+// maxNegotiateTokenOutput limits the token command output that is read,
+// Kerberos tokens with a large PAC can be several kilobytes long.
+const maxNegotiateTokenOutput = 64 * 1024
+
+// Negotiate authenticates to upstream HTTP proxies with the Negotiate scheme (RFC 4559),
+// so that forwarder can use Kerberos proxies without embedding passwords.
+// Kerberos is not implemented natively, the SPNEGO tokens are obtained by executing the token command,
+// such as a script using the system GSSAPI library, with the Kerberos credentials cache maintained by the renew command.
+// The renew command is executed on start, periodically, and when the upstream proxy responds with 407.
+//
+// The token command must print the base64 encoded token, optionally prefixed with "Negotiate ".
+// Tokens are kept in memory only and are never logged.
+type Negotiate struct {
+	config NegotiateConfig
+	log    log.Logger
+	renew  chan struct{}
+
+	mu        sync.Mutex
+	tokens    map[string]negotiateToken
+	lastRenew time.Time
+}
+
+type negotiateToken struct {
+	value   string
+	created time.Time
+}
+
+// NewNegotiate executes the renew command if configured and returns an error if it fails,
+// call Run to renew the ticket periodically.
+func NewNegotiate(cfg *NegotiateConfig, log log.Logger) (*Negotiate, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	n := &Negotiate{
+		config: *cfg,
+		log:    log,
+		renew:  make(chan struct{}, 1),
+		tokens: make(map[string]negotiateToken),
+	}
+	if err := n.renewTicket(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// Renew requests renewal of the ticket and drops cached tokens, it does not block.
+// Renewals more frequent than MinInterval are ignored.
+func (n *Negotiate) Renew() {
+	n.mu.Lock()
+	clear(n.tokens)
+	n.mu.Unlock()
+
+	select {
+	case n.renew <- struct{}{}:
+	default:
+	}
+}
+
+// Run renews the ticket until ctx is done, it returns immediately if there is no renew command.
+// On error the command is retried after MinInterval.
+func (n *Negotiate) Run(ctx context.Context) error {
+	if len(n.config.RenewCommand) == 0 {
+		return nil
+	}
+
+	t := time.NewTimer(n.config.RenewInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		case <-n.renew:
+			if n.sinceLastRenew() < n.config.MinInterval {
+				continue
+			}
+			n.log.Infof("upstream proxy rejected Negotiate token, renewing ticket")
+		}
+
+		next := n.config.RenewInterval
+		if err := n.renewTicket(ctx); err != nil {
+			n.log.Errorf("renew ticket: %s", err)
+			next = n.config.MinInterval
+		}
+		t.Stop()
+		t.Reset(next)
+	}
+}
+
+func (n *Negotiate) sinceLastRenew() time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return time.Since(n.lastRenew)
+}
+
+func (n *Negotiate) renewTicket(ctx context.Context) error {
+	if len(n.config.RenewCommand) == 0 {
+		return nil
+	}
+
+	if _, err := runCommand(ctx, n.config.RenewCommand, n.config.Timeout, 1024); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	n.lastRenew = time.Now()
+	clear(n.tokens)
+	n.mu.Unlock()
+
+	n.log.Infof("ticket renewed next_renew=%s", n.config.RenewInterval)
+
+	return nil
+}
+
+// token returns the Proxy-Authorization header value for the proxy host.
+func (n *Negotiate) token(ctx context.Context, host string) (string, error) {
+	if n.config.TokenTTL > 0 {
+		n.mu.Lock()
+		t, ok := n.tokens[host]
+		n.mu.Unlock()
+		if ok && time.Since(t.created) < n.config.TokenTTL {
+			return t.value, nil
+		}
+	}
+
+	argv := append(n.config.TokenCommand[:len(n.config.TokenCommand):len(n.config.TokenCommand)], host)
+	out, err := runCommand(ctx, argv, n.config.Timeout, maxNegotiateTokenOutput)
+	if err != nil {
+		return "", err
+	}
+	v, err := parseNegotiateTokenOutput(out)
+	clear(out)
+	if err != nil {
+		return "", err
+	}
+
+	if n.config.TokenTTL > 0 {
+		n.mu.Lock()
+		n.tokens[host] = negotiateToken{value: v, created: time.Now()}
+		n.mu.Unlock()
+	}
+
+	return v, nil
+}
+
+// parseNegotiateTokenOutput returns the header value for a base64 encoded token optionally prefixed with "Negotiate ".
+func parseNegotiateTokenOutput(out []byte) (string, error) {
+	line, _, _ := bytes.Cut(bytes.TrimSpace(out), []byte("\n"))
+	s := strings.TrimSpace(string(line))
+	if len(s) > len("Negotiate ") && strings.EqualFold(s[:len("Negotiate ")], "Negotiate ") {
+		s = strings.TrimSpace(s[len("Negotiate "):])
+	}
+	if s == "" {
+		return "", errors.New("empty output")
+	}
+	if _, err := base64.StdEncoding.DecodeString(s); err != nil {
+		// Do not include the output in the error as it is a credential.
+		return "", errors.New("invalid output, expected base64 encoded token")
+	}
+	return "Negotiate " + s, nil
+}
+
+func isHTTPProxyURL(u *url.URL) bool {
+	return u != nil && (u.Scheme == "http" || u.Scheme == "https")
+}
+
+// proxyAuthorization returns a request modifier that sets the Proxy-Authorization header on plain HTTP requests
+// sent to upstream HTTP proxies returned by fn.
+// The header is removed if the request is sent directly, e.g. after falling back to DIRECT.
+// Requests tunneled with CONNECT are authenticated by proxyConnectHeader.
+//
+// The upstream proxy choice is kept in the request context by the pool and PAC fallback,
+// so fn returns the same proxy when the request is sent.
+// If the choice changes on retry, the modifier must be applied again, see retryConnect.
+func (n *Negotiate) proxyAuthorization(fn ProxyFunc) martian.RequestModifier {
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		if req.Method == http.MethodConnect || req.URL.Scheme != "http" {
+			return nil
+		}
+
+		u, err := fn(req)
+		if err != nil {
+			return err
+		}
+		if !isHTTPProxyURL(u) {
+			req.Header.Del("Proxy-Authorization")
+			return nil
+		}
+		v, err := n.token(req.Context(), u.Hostname())
+		if err != nil {
+			return fmt.Errorf("negotiate token: %w", err)
+		}
+		req.Header.Set("Proxy-Authorization", v)
+		return nil
+	})
+}
+
+// retryConnect wraps a RetryConnect function so that the Proxy-Authorization header
+// is set for the upstream proxy selected for the retry.
+func (n *Negotiate) retryConnect(retry func(*http.Request, error) bool, m martian.RequestModifier) func(*http.Request, error) bool {
+	return func(req *http.Request, err error) bool {
+		if !retry(req, err) {
+			return false
+		}
+		return m.ModifyRequest(req) == nil
+	}
+}
+
+// proxyConnectHeader returns the Proxy-Authorization header for CONNECT requests sent to upstream HTTP proxies.
+func (n *Negotiate) proxyConnectHeader(ctx context.Context, proxyURL *url.URL, _ string) (http.Header, error) {
+	if !isHTTPProxyURL(proxyURL) {
+		return nil, nil
+	}
+	v, err := n.token(ctx, proxyURL.Hostname())
+	if err != nil {
+		return nil, fmt.Errorf("negotiate token: %w", err)
+	}
+	return http.Header{"Proxy-Authorization": {v}}, nil
+}
+
+// renewOnProxyAuthRequired is a response modifier that triggers a renewal
+// when the upstream proxy responds with 407 and offers the Negotiate scheme.
+func (n *Negotiate) renewOnProxyAuthRequired(res *http.Response) error {
+	if res.StatusCode != http.StatusProxyAuthRequired {
+		return nil
+	}
+	for _, v := range res.Header.Values("Proxy-Authenticate") {
+		if len(v) >= len("Negotiate") && strings.EqualFold(v[:len("Negotiate")], "Negotiate") {
+			n.Renew()
+			return nil
+		}
+	}
+	return nil
+}
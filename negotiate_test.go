@@ -0,0 +1,167 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log"
+)
+
+func TestParseNegotiateTokenOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want string
+		err  bool
+	}{
+		{name: "token", out: "YIIBhgYGKwYBBQUCoIIBejCCAXagDTAL\n", want: "Negotiate YIIBhgYGKwYBBQUCoIIBejCCAXagDTAL"},
+		{name: "prefixed", out: "negotiate YIIBhgYG\n", want: "Negotiate YIIBhgYG"},
+		{name: "empty", out: " \n", err: true},
+		{name: "not base64", out: "user:pass", err: true},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseNegotiateTokenOutput([]byte(tc.out))
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNegotiateProxyAuthorization(t *testing.T) {
+	// The command prints the base64 encoded hostname argument, so that tokens are distinguishable.
+	cfg := DefaultNegotiateConfig()
+	cfg.TokenCommand = []string{"sh", "-c", `printf %s "$0" | base64`}
+	n, err := NewNegotiate(cfg, log.NopLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var upstream *url.URL
+	m := n.proxyAuthorization(func(*http.Request) (*url.URL, error) {
+		return upstream, nil
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", http.NoBody)
+	upstream = &url.URL{Scheme: "http", Host: "proxy.corp:3128"}
+	if err := m.ModifyRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := req.Header.Get("Proxy-Authorization"), "Negotiate cHJveHkuY29ycA=="; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// The header must not be sent to the target directly.
+	upstream = nil
+	if err := m.ModifyRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Header.Get("Proxy-Authorization"); got != "" {
+		t.Fatalf("got %q, want no header", got)
+	}
+
+	// Requests tunneled to the target must not carry the header.
+	req = httptest.NewRequest(http.MethodGet, "https://example.com", http.NoBody)
+	upstream = &url.URL{Scheme: "http", Host: "proxy.corp:3128"}
+	if err := m.ModifyRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Header.Get("Proxy-Authorization"); got != "" {
+		t.Fatalf("got %q, want no header", got)
+	}
+
+	// On retry the header is set for the newly selected upstream.
+	req = httptest.NewRequest(http.MethodGet, "http://example.com", http.NoBody)
+	retry := n.retryConnect(func(*http.Request, error) bool {
+		upstream = &url.URL{Scheme: "http", Host: "fallback.corp:3128"}
+		return true
+	}, m)
+	if !retry(req, errors.New("dial error")) {
+		t.Fatal("retry: got false, want true")
+	}
+	if got, want := req.Header.Get("Proxy-Authorization"), "Negotiate ZmFsbGJhY2suY29ycA=="; got != want {
+		t.Fatalf("retry: got %q, want %q", got, want)
+	}
+
+	upstream = &url.URL{Scheme: "http", Host: "proxy.corp:3128"}
+	h, err := n.proxyConnectHeader(context.Background(), upstream, "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := h.Get("Proxy-Authorization"), "Negotiate cHJveHkuY29ycA=="; got != want {
+		t.Fatalf("CONNECT: got %q, want %q", got, want)
+	}
+}
+
+func TestNegotiateTokenTTL(t *testing.T) {
+	counter := filepath.Join(t.TempDir(), "counter")
+
+	cfg := DefaultNegotiateConfig()
+	cfg.TokenCommand = []string{"sh", "-c", `echo x >> "` + counter + `"; echo dG9rZW4=`}
+	cfg.TokenTTL = time.Minute
+	n, err := NewNegotiate(cfg, log.NopLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := func() int {
+		b, _ := os.ReadFile(counter)
+		return strings.Count(string(b), "x")
+	}
+
+	for range 3 {
+		if _, err := n.token(context.Background(), "proxy"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := calls(); got != 1 {
+		t.Fatalf("got %d token command calls, want 1", got)
+	}
+
+	res := &http.Response{
+		StatusCode: http.StatusProxyAuthRequired,
+		Header:     http.Header{"Proxy-Authenticate": {"Negotiate"}},
+	}
+	n.renewOnProxyAuthRequired(res) //nolint:errcheck // always nil
+	if _, err := n.token(context.Background(), "proxy"); err != nil {
+		t.Fatal(err)
+	}
+	if got := calls(); got != 2 {
+		t.Fatalf("got %d token command calls after 407, want 2", got)
+	}
+}
+
+func TestNegotiateRenewError(t *testing.T) {
+	cfg := DefaultNegotiateConfig()
+	cfg.TokenCommand = []string{"true"}
+	cfg.RenewCommand = []string{"sh", "-c", "echo kinit failed >&2; exit 1"}
+	if _, err := NewNegotiate(cfg, log.NopLogger); err == nil || !strings.Contains(err.Error(), "kinit failed") {
+		t.Fatalf("got %v, want error with stderr", err)
+	}
+}
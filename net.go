@@ -9,8 +9,10 @@ package forwarder
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 	"slices"
 	"time"
 
@@ -47,6 +49,80 @@ func DialRedirectFromHostPortPairs(subs []HostPortPair) DialRedirectFunc {
 	}
 }
 
+// IPVersion restricts the IP family of outbound connections.
+type IPVersion string
+
+const (
+	IPVersionAuto IPVersion = "auto"
+	IPVersionV4   IPVersion = "v4"
+	IPVersionV6   IPVersion = "v6"
+)
+
+func (v *IPVersion) UnmarshalText(text []byte) error {
+	switch IPVersion(text) {
+	case IPVersionAuto, IPVersionV4, IPVersionV6:
+		*v = IPVersion(text)
+		return nil
+	default:
+		return fmt.Errorf("invalid IP version: %s", text)
+	}
+}
+
+func (v IPVersion) String() string {
+	return string(v)
+}
+
+// network returns the network restricted to the IP version, for example tcp4 for tcp and v4.
+func (v IPVersion) network(network string) string {
+	if network != "tcp" && network != "udp" {
+		return network
+	}
+
+	switch v {
+	case IPVersionV4:
+		return network + "4"
+	case IPVersionV6:
+		return network + "6"
+	default:
+		return network
+	}
+}
+
+// ProxyProtocolVersion selects the PROXY protocol header sent on outbound connections.
+type ProxyProtocolVersion string
+
+const (
+	ProxyProtocolOff ProxyProtocolVersion = "off"
+	ProxyProtocolV1  ProxyProtocolVersion = "v1"
+	ProxyProtocolV2  ProxyProtocolVersion = "v2"
+)
+
+func (v *ProxyProtocolVersion) UnmarshalText(text []byte) error {
+	switch ProxyProtocolVersion(text) {
+	case ProxyProtocolOff, ProxyProtocolV1, ProxyProtocolV2:
+		*v = ProxyProtocolVersion(text)
+		return nil
+	default:
+		return fmt.Errorf("invalid PROXY protocol version: %s", text)
+	}
+}
+
+func (v ProxyProtocolVersion) String() string {
+	return string(v)
+}
+
+// version returns the PROXY protocol version number, or zero if disabled.
+func (v ProxyProtocolVersion) version() int {
+	switch v {
+	case ProxyProtocolV1:
+		return 1
+	case ProxyProtocolV2:
+		return 2
+	default:
+		return 0
+	}
+}
+
 type DialRetryConfig struct {
 	Attempts int
 	Backoff  time.Duration
@@ -64,19 +140,64 @@ type DialConfig struct {
 	// KeepAliveConfig contains TCP keep-alive options.
 	KeepAliveConfig net.KeepAliveConfig
 
+	// IPVersion restricts outbound connections to IPv4 or IPv6, host names are resolved to addresses of that family only.
+	// The default is auto, which uses both.
+	IPVersion IPVersion
+
+	// SourceAddress can be optionally set to use the IP address as the source address of outbound connections.
+	// Only destinations of the same IP version as the source address can be dialed.
+	SourceAddress netip.Addr
+
+	// Interface can be optionally set to bind outbound connections to the network interface.
+	// It is only supported on Linux.
+	Interface string
+
+	// ProxyProtocol, if set to v1 or v2, sends a PROXY protocol header with the client address on outbound connections,
+	// so that upstream proxies and origin servers see the original client address.
+	// The header is sent only on connections dialed for a client, see WithDialClientAddr.
+	// The default is off.
+	ProxyProtocol ProxyProtocolVersion
+
 	// RedirectFunc can be optionally set to redirect the connection to a different address.
 	RedirectFunc DialRedirectFunc
 
+	// Hosts can be optionally set to dial the IP addresses of the host names without DNS resolution.
+	// If a host name is listed more than once, the first address is used.
+	Hosts []HostOverride
+
+	// Dialers can be optionally set to dial selected hosts with custom dialers instead of the default TCP dialer.
+	Dialers *DialerRegistry
+
 	// Retry specifies the number of attempts and backoff duration between them.
 	Retry DialRetryConfig
 
+	// ConnTable, if set, tracks open connections with traffic, unless tracking is disabled with WithDialConnTrack.
+	ConnTable *conntrack.Table
+
+	// FDGuard, if set, counts open connections, unless tracking is disabled with WithDialConnTrack.
+	FDGuard *FDGuard
+
 	PromConfig
 }
 
+func (c *DialConfig) Validate() error {
+	if a := c.SourceAddress; a.IsValid() {
+		if c.IPVersion == IPVersionV4 && !a.Is4() || c.IPVersion == IPVersionV6 && !a.Is6() {
+			return fmt.Errorf("source_address: %s does not match ip_version %s", a, c.IPVersion)
+		}
+	}
+	if c.Interface != "" && !bindToInterfaceSupported {
+		return errors.New("interface: binding to network interface is not supported on this platform")
+	}
+	return nil
+}
+
 func DefaultDialConfig() *DialConfig {
 	return &DialConfig{
 		DialTimeout:     25 * time.Second,
 		KeepAliveConfig: defaultKeepAliveConfig(),
+		IPVersion:       IPVersionAuto,
+		ProxyProtocol:   ProxyProtocolOff,
 		Retry: DialRetryConfig{
 			Attempts: 3,
 			Backoff:  1 * time.Second,
@@ -99,7 +220,13 @@ type dialContextFunc func(ctx context.Context, network, address string) (net.Con
 type Dialer struct {
 	nd      net.Dialer
 	rd      DialRedirectFunc
+	ipv     IPVersion
+	ppv     int
+	hosts   map[string]netip.Addr
+	reg     *DialerRegistry
 	rt      DialRetryConfig
+	table   *conntrack.Table
+	guard   *FDGuard
 	metrics *dialerMetrics
 
 	testingDialContext dialContextFunc
@@ -114,11 +241,34 @@ func NewDialer(cfg *DialConfig) *Dialer {
 			PreferGo: true,
 		},
 	}
+	if cfg.SourceAddress.IsValid() {
+		nd.LocalAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(cfg.SourceAddress, 0))
+	}
+	if cfg.Interface != "" {
+		nd.Control = bindToInterface(cfg.Interface)
+	}
+
+	var hosts map[string]netip.Addr
+	if len(cfg.Hosts) > 0 {
+		hosts = make(map[string]netip.Addr, len(cfg.Hosts))
+		for _, h := range cfg.Hosts {
+			k := normalizeOverrideHost(h.Host)
+			if _, ok := hosts[k]; !ok {
+				hosts[k] = h.Addr
+			}
+		}
+	}
 
 	return &Dialer{
 		nd:      nd,
 		rd:      cfg.RedirectFunc,
+		ipv:     cfg.IPVersion,
+		ppv:     cfg.ProxyProtocol.version(),
+		hosts:   hosts,
+		reg:     cfg.Dialers,
 		rt:      cfg.Retry,
+		table:   cfg.ConnTable,
+		guard:   cfg.FDGuard,
 		metrics: newDialerMetrics(cfg.PromRegistry, cfg.PromNamespace),
 	}
 }
@@ -139,6 +289,14 @@ func WithDialConnTrack(ctx context.Context, track DialConnTrack) context.Context
 	return context.WithValue(ctx, dialConnTrackKey{}, track)
 }
 
+type dialClientAddrKey struct{}
+
+// WithDialClientAddr sets the address of the client the connections are dialed for.
+// It is sent in the PROXY protocol header if enabled, see DialConfig.ProxyProtocol.
+func WithDialClientAddr(ctx context.Context, addr netip.AddrPort) context.Context {
+	return context.WithValue(ctx, dialClientAddrKey{}, addr)
+}
+
 // DialContext dials the provided network and address and configures OS-specific keep-alive parameters.
 // It tracks dialed and closed connections by default, the behavior can be changed with WithDialConnTrack.
 func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
@@ -151,6 +309,14 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.
 		network, address = d.rd(network, address)
 	}
 	conn, err := d.dialContext(ctx, network, address)
+	if err == nil && d.ppv != 0 {
+		if ca, ok := ctx.Value(dialClientAddrKey{}).(netip.AddrPort); ok {
+			if err = d.writeProxyProtocolHeader(conn, ca); err != nil {
+				conn.Close()
+				conn = nil
+			}
+		}
+	}
 
 	if dct == DialConnTrackDisabled {
 		return conn, err
@@ -162,12 +328,21 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.
 	}
 
 	d.metrics.dial(address)
+	if d.guard != nil {
+		d.guard.track()
+	}
 
 	return conntrack.Builder{
-		TrackTraffic: dct == DialConnTrackTraffic,
+		TrackTraffic: dct == DialConnTrackTraffic || d.table != nil,
 		OnClose: func() {
+			if d.guard != nil {
+				d.guard.release()
+			}
 			d.metrics.close(address)
 		},
+		Table:     d.table,
+		Direction: conntrack.Outbound,
+		Address:   address,
 	}.Build(conn), nil
 }
 
@@ -178,6 +353,12 @@ func (d *Dialer) dialContext(ctx context.Context, network, address string) (net.
 	if d.testingDialContext != nil {
 		dial = d.testingDialContext
 	}
+	if rd := d.reg.lookup(address); rd != nil {
+		dial = rd
+	} else if d.hosts != nil {
+		address = d.overrideHost(address)
+	}
+	network = d.ipv.network(network)
 
 	attempts := d.rt.Attempts
 	if attempts <= 0 {
@@ -203,6 +384,32 @@ func (d *Dialer) dialContext(ctx context.Context, network, address string) (net.
 	return nil, lastErr
 }
 
+// writeProxyProtocolHeader writes the PROXY protocol header with the client address as the source,
+// and the dialed address as the destination.
+func (d *Dialer) writeProxyProtocolHeader(conn net.Conn, clientAddr netip.AddrPort) error {
+	h := proxyproto.Header{
+		Version:     d.ppv,
+		Source:      net.TCPAddrFromAddrPort(clientAddr),
+		Destination: conn.RemoteAddr(),
+	}
+	if _, err := h.WriteTo(conn); err != nil {
+		return fmt.Errorf("write PROXY protocol header: %w", err)
+	}
+	return nil
+}
+
+// overrideHost replaces the host name in address with the IP address from the Hosts config.
+func (d *Dialer) overrideHost(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	if addr, ok := d.hosts[normalizeOverrideHost(host)]; ok {
+		return net.JoinHostPort(addr.String(), port)
+	}
+	return address
+}
+
 type ProxyProtocolConfig struct {
 	ReadHeaderTimeout time.Duration
 }
@@ -220,6 +427,16 @@ type ListenerConfig struct {
 	ReadLimit           SizeSuffix
 	WriteLimit          SizeSuffix
 	TrackTraffic        bool
+
+	// ConnTable, if set, tracks accepted connections with traffic.
+	ConnTable *conntrack.Table
+
+	// FDGuard, if set, sheds new connections when the number of open connections reaches its limit.
+	FDGuard *FDGuard
+
+	// Listener, if set, is used instead of listening on Address.
+	// It allows to serve on an in-memory listener, see MemListener.
+	Listener net.Listener
 }
 
 func DefaultListenerConfig(addr string) *ListenerConfig {
@@ -306,10 +523,28 @@ func (l *Listener) Listen() error {
 		l.metrics = newListenerMetrics(l.PromRegistry, l.PromNamespace)
 	}
 
+	if l.TLSConfig != nil {
+		l.TLSConfig = l.TLSConfig.Clone()
+		verify := l.TLSConfig.VerifyConnection
+		l.TLSConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if verify != nil {
+				if err := verify(cs); err != nil {
+					return err
+				}
+			}
+			l.metrics.tlsHandshake(&cs)
+			return nil
+		}
+	}
+
 	return nil
 }
 
 func (l *Listener) listen() (net.Listener, error) {
+	if l.ListenerConfig.Listener != nil {
+		return l.ListenerConfig.Listener, nil
+	}
+
 	lc := &net.ListenConfig{
 		KeepAlive:       -1,
 		KeepAliveConfig: l.ListenerConfig.KeepAliveConfig,
@@ -328,10 +563,31 @@ func (l *Listener) Accept() (net.Conn, error) {
 		return nil, err
 	}
 
+	onClose := l.metrics.close
+	if g := l.FDGuard; g != nil {
+		for !g.acquire() {
+			l.metrics.shed()
+			g.shed(conn, l.TLSConfig == nil)
+
+			conn, err = l.listener.Accept()
+			if err != nil {
+				l.metrics.error()
+				return nil, err
+			}
+		}
+		onClose = func() {
+			g.release()
+			l.metrics.close()
+		}
+	}
+
 	l.metrics.accept()
 	conn = conntrack.Builder{
-		TrackTraffic: l.TrackTraffic,
-		OnClose:      l.metrics.close,
+		TrackTraffic: l.TrackTraffic || l.ConnTable != nil,
+		OnClose:      onClose,
+		Table:        l.ConnTable,
+		Direction:    conntrack.Inbound,
+		Address:      conn.RemoteAddr().String(),
 	}.Build(conn)
 
 	if l.TLSConfig != nil {
@@ -0,0 +1,30 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+//go:build linux
+
+package forwarder
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const bindToInterfaceSupported = true
+
+// bindToInterface returns a dialer control function that binds the socket to the network interface with SO_BINDTODEVICE.
+func bindToInterface(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(_, _ string, c syscall.RawConn) error {
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			serr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, iface)
+		}); err != nil {
+			return err
+		}
+		return serr
+	}
+}
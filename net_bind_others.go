@@ -0,0 +1,22 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+//go:build !linux
+
+package forwarder
+
+import (
+	"errors"
+	"syscall"
+)
+
+const bindToInterfaceSupported = false
+
+func bindToInterface(_ string) func(network, address string, c syscall.RawConn) error {
+	return func(_, _ string, _ syscall.RawConn) error {
+		return errors.New("binding to network interface is not supported on this platform")
+	}
+}
@@ -7,8 +7,10 @@
 package forwarder
 
 import (
+	"crypto/tls"
 	"net"
 	"slices"
+	"strconv"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -94,9 +96,11 @@ func addr2Host(addr string) string {
 }
 
 type listenerMetrics struct {
-	errors   prometheus.Counter
-	accepted prometheus.Counter
-	active   prometheus.Gauge
+	errors        prometheus.Counter
+	accepted      prometheus.Counter
+	active        prometheus.Gauge
+	shedded       prometheus.Counter
+	tlsHandshakes *prometheus.CounterVec
 }
 
 func newListenerMetrics(r prometheus.Registerer, namespace string) *listenerMetrics {
@@ -121,6 +125,16 @@ func newListenerMetrics(r prometheus.Registerer, namespace string) *listenerMetr
 			Namespace: namespace,
 			Help:      "Number of active connections",
 		}),
+		shedded: f.NewCounter(prometheus.CounterOpts{
+			Name:      "listener_cx_shed_total",
+			Namespace: namespace,
+			Help:      "Number of connections closed right after accept because the file descriptor limit was near",
+		}),
+		tlsHandshakes: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "listener_tls_handshakes_total",
+			Namespace: namespace,
+			Help:      "Number of TLS handshakes by the negotiated key exchange group",
+		}, []string{"group"}),
 	}
 }
 
@@ -137,6 +151,14 @@ func (m *listenerMetrics) close() {
 	m.active.Dec()
 }
 
+func (m *listenerMetrics) shed() {
+	m.shedded.Inc()
+}
+
+func (m *listenerMetrics) tlsHandshake(cs *tls.ConnectionState) {
+	m.tlsHandshakes.WithLabelValues(tlsGroup(cs)).Inc()
+}
+
 func newListenerMetricsWithNameFunc(r prometheus.Registerer, namespace string) func(name string) *listenerMetrics {
 	if r == nil {
 		r = prometheus.NewRegistry() // This registry will be discarded.
@@ -158,12 +180,74 @@ func newListenerMetricsWithNameFunc(r prometheus.Registerer, namespace string) f
 		Namespace: namespace,
 		Help:      "Number of active connections",
 	}, []string{"name"})
+	shedded := f.NewCounterVec(prometheus.CounterOpts{
+		Name:      "listener_cx_shed_total",
+		Namespace: namespace,
+		Help:      "Number of connections closed right after accept because the file descriptor limit was near",
+	}, []string{"name"})
+	tlsHandshakes := f.NewCounterVec(prometheus.CounterOpts{
+		Name:      "listener_tls_handshakes_total",
+		Namespace: namespace,
+		Help:      "Number of TLS handshakes by the negotiated key exchange group",
+	}, []string{"name", "group"})
 
 	return func(name string) *listenerMetrics {
 		return &listenerMetrics{
-			errors:   errors.WithLabelValues(name),
-			accepted: accepted.WithLabelValues(name),
-			active:   active.WithLabelValues(name),
+			errors:        errors.WithLabelValues(name),
+			accepted:      accepted.WithLabelValues(name),
+			active:        active.WithLabelValues(name),
+			shedded:       shedded.WithLabelValues(name),
+			tlsHandshakes: tlsHandshakes.MustCurryWith(prometheus.Labels{"name": name}),
 		}
 	}
 }
+
+type tlsClientMetrics struct {
+	handshakes *prometheus.CounterVec
+}
+
+func newTLSClientMetrics(r prometheus.Registerer, namespace string) *tlsClientMetrics {
+	if r == nil {
+		r = prometheus.NewRegistry() // This registry will be discarded.
+	}
+	f := promauto.With(r)
+
+	return &tlsClientMetrics{
+		handshakes: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "tls_client_handshakes_total",
+			Namespace: namespace,
+			Help:      "Number of outbound TLS handshakes by host, whether the session was resumed, and the negotiated key exchange group",
+		}, []string{"host", "resumed", "group"}),
+	}
+}
+
+func (m *tlsClientMetrics) handshake(cs *tls.ConnectionState) {
+	m.handshakes.WithLabelValues(
+		addr2Host(net.JoinHostPort(cs.ServerName, "0")),
+		strconv.FormatBool(cs.DidResume),
+		tlsGroup(cs),
+	).Inc()
+}
+
+type connLifetimeMetrics struct {
+	recycled *prometheus.CounterVec
+}
+
+func newConnLifetimeMetrics(r prometheus.Registerer, namespace string) *connLifetimeMetrics {
+	if r == nil {
+		r = prometheus.NewRegistry() // This registry will be discarded.
+	}
+	f := promauto.With(r)
+
+	return &connLifetimeMetrics{
+		recycled: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "http_transport_cx_recycled_total",
+			Namespace: namespace,
+			Help:      "Number of upstream connections recycled after reaching the maximum age or number of requests",
+		}, []string{"reason"}),
+	}
+}
+
+func (m *connLifetimeMetrics) recycle(reason string) {
+	m.recycled.WithLabelValues(reason).Inc()
+}
@@ -13,12 +13,14 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"strconv"
 	"testing"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/saucelabs/forwarder/conntrack"
+	"github.com/saucelabs/forwarder/proxyproto"
 	"github.com/saucelabs/forwarder/utils/certutil"
 	"github.com/saucelabs/forwarder/utils/golden"
 )
@@ -127,6 +129,183 @@ func TestDialerRedirect(t *testing.T) {
 	}
 }
 
+func TestDialerHosts(t *testing.T) {
+	d := NewDialer(&DialConfig{
+		DialTimeout: 10 * time.Millisecond,
+		Hosts: []HostOverride{
+			{Host: "staging.example.com", Addr: netip.MustParseAddr("10.0.0.1")},
+			{Host: "staging.example.com", Addr: netip.MustParseAddr("10.0.0.2")},
+			{Host: "v6.example.com", Addr: netip.MustParseAddr("2001:db8::1")},
+		},
+	})
+
+	var got string
+	d.testingDialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		got = address
+		return new(net.TCPConn), nil
+	}
+
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"staging.example.com:443", "10.0.0.1:443"},
+		{"Staging.Example.COM.:80", "10.0.0.1:80"},
+		{"v6.example.com:80", "[2001:db8::1]:80"},
+		{"example.com:80", "example.com:80"},
+	}
+
+	ctx := context.Background()
+	for _, tc := range tests {
+		if _, err := d.DialContext(ctx, "tcp", tc.address); err != nil {
+			t.Fatalf("d.DialContext(%q): got %v, want no error", tc.address, err)
+		}
+		if got != tc.want {
+			t.Errorf("d.DialContext(%q): dialed %q, want %q", tc.address, got, tc.want)
+		}
+	}
+}
+
+func TestDialerIPVersion(t *testing.T) {
+	tests := []struct {
+		ipv     IPVersion
+		network string
+		want    string
+	}{
+		{IPVersionAuto, "tcp", "tcp"},
+		{IPVersionV4, "tcp", "tcp4"},
+		{IPVersionV6, "tcp", "tcp6"},
+		{IPVersionV4, "udp", "udp4"},
+		{IPVersionV6, "tcp4", "tcp4"},
+		{IPVersionV4, "unix", "unix"},
+	}
+
+	ctx := context.Background()
+	for _, tc := range tests {
+		d := NewDialer(&DialConfig{
+			DialTimeout: 10 * time.Millisecond,
+			IPVersion:   tc.ipv,
+		})
+		var got string
+		d.testingDialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			got = network
+			return new(net.TCPConn), nil
+		}
+
+		if _, err := d.DialContext(ctx, tc.network, "example.com:80"); err != nil {
+			t.Fatalf("d.DialContext(%q): got %v, want no error", tc.network, err)
+		}
+		if got != tc.want {
+			t.Errorf("ip version %s: dialed %q, want %q", tc.ipv, got, tc.want)
+		}
+	}
+}
+
+func TestDialerSourceAddress(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	d := NewDialer(&DialConfig{
+		DialTimeout:   time.Second,
+		SourceAddress: netip.MustParseAddr("127.0.0.1"),
+	})
+	conn, err := d.DialContext(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("d.DialContext(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	got := conn.LocalAddr().(*net.TCPAddr).AddrPort().Addr() //nolint:forcetypeassert // it's a TCP connection
+	if want := netip.MustParseAddr("127.0.0.1"); got != want {
+		t.Errorf("conn.LocalAddr(): got %v, want %v", got, want)
+	}
+}
+
+func TestDialerProxyProtocol(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	clientAddr := netip.MustParseAddrPort("192.0.2.1:1234")
+
+	for _, ppv := range []ProxyProtocolVersion{ProxyProtocolV1, ProxyProtocolV2} {
+		d := NewDialer(&DialConfig{
+			DialTimeout:   time.Second,
+			ProxyProtocol: ppv,
+		})
+		conn, err := d.DialContext(WithDialClientAddr(context.Background(), clientAddr), "tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: d.DialContext(): got %v, want no error", ppv, err)
+		}
+		defer conn.Close()
+
+		sc, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sc.Close()
+
+		h, err := proxyproto.ReadHeader(sc)
+		if err != nil {
+			t.Fatalf("%s: proxyproto.ReadHeader(): got %v, want no error", ppv, err)
+		}
+		if want := ppv.version(); h.Version != want {
+			t.Errorf("%s: header version: got %d, want %d", ppv, h.Version, want)
+		}
+		if got, want := h.Source.String(), clientAddr.String(); got != want {
+			t.Errorf("%s: header source: got %s, want %s", ppv, got, want)
+		}
+		if got, want := h.Destination.String(), l.Addr().String(); got != want {
+			t.Errorf("%s: header destination: got %s, want %s", ppv, got, want)
+		}
+	}
+}
+
+func TestDialConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  DialConfig
+		err  bool
+	}{
+		{
+			name: "source address auto",
+			cfg:  DialConfig{SourceAddress: netip.MustParseAddr("2001:db8::1"), IPVersion: IPVersionAuto},
+		},
+		{
+			name: "source address v4",
+			cfg:  DialConfig{SourceAddress: netip.MustParseAddr("10.0.0.1"), IPVersion: IPVersionV4},
+		},
+		{
+			name: "source address v6 mismatch",
+			cfg:  DialConfig{SourceAddress: netip.MustParseAddr("10.0.0.1"), IPVersion: IPVersionV6},
+			err:  true,
+		},
+		{
+			name: "source address v4 mismatch",
+			cfg:  DialConfig{SourceAddress: netip.MustParseAddr("2001:db8::1"), IPVersion: IPVersionV4},
+			err:  true,
+		},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.cfg.Validate()
+			if tc.err && err == nil {
+				t.Fatal("got no error, want error")
+			}
+			if !tc.err && err != nil {
+				t.Fatalf("got %v, want no error", err)
+			}
+		})
+	}
+}
+
 func TestDialerMetrics(t *testing.T) {
 	tests := []struct {
 		name  string
@@ -332,7 +511,7 @@ func TestListenerMetricsAcceptedWithTLS(t *testing.T) {
 		if err != nil {
 			t.Fatalf("net.Dial(): got %v, want no error", err)
 		}
-		conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true, CurvePreferences: []tls.CurveID{tls.X25519}})
 		fmt.Fprintf(conn, "Hello, World!\n")
 		if _, err := conn.Read(make([]byte, 1)); err != nil {
 			t.Fatal(err)
@@ -0,0 +1,141 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// NoProxyEntry is a NO_PROXY list entry with the same semantics as in curl and Go.
+// It is one of:
+//   - "*" matching all hosts,
+//   - a domain name matching the domain and all its subdomains,
+//   - a domain name with a leading "." or "*." matching subdomains only,
+//   - an IP address,
+//   - a CIDR matching IP addresses in the subnet.
+//
+// Domains and IP addresses can be followed by a port to match only that port.
+type NoProxyEntry struct {
+	all    bool
+	domain string
+	subdom bool
+	prefix netip.Prefix
+	port   string
+
+	raw string
+}
+
+func ParseNoProxyEntry(val string) (NoProxyEntry, error) {
+	e := NoProxyEntry{raw: val}
+
+	s := strings.ToLower(strings.TrimSpace(val))
+	if s == "" {
+		return e, errors.New("empty entry")
+	}
+	if s == "*" {
+		e.all = true
+		return e, nil
+	}
+
+	if p, err := netip.ParsePrefix(s); err == nil {
+		e.prefix = p.Masked()
+		return e, nil
+	}
+
+	host := s
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		if _, err := strconv.ParseUint(p, 10, 16); err != nil {
+			return e, fmt.Errorf("invalid port %q", p)
+		}
+		host, e.port = h, p
+	}
+
+	if a, err := netip.ParseAddr(host); err == nil {
+		e.prefix = netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen())
+		return e, nil
+	}
+
+	switch {
+	case strings.HasPrefix(host, "*."):
+		host = host[2:]
+		e.subdom = true
+	case strings.HasPrefix(host, "."):
+		host = host[1:]
+		e.subdom = true
+	}
+	if host == "" || strings.ContainsAny(host, "*/") {
+		return e, fmt.Errorf("invalid host %q", val)
+	}
+	e.domain = NormalizeHost(host)
+
+	return e, nil
+}
+
+func (e NoProxyEntry) String() string {
+	return e.raw
+}
+
+// Match returns true if the host and port match the entry.
+func (e NoProxyEntry) Match(host, port string) bool {
+	if e.all {
+		return true
+	}
+	if e.port != "" && e.port != port {
+		return false
+	}
+
+	host = NormalizeHost(host)
+	if e.prefix.IsValid() {
+		a, err := netip.ParseAddr(host)
+		return err == nil && e.prefix.Contains(a.WithZone(""))
+	}
+
+	if host == e.domain {
+		return !e.subdom
+	}
+	return strings.HasSuffix(host, "."+e.domain)
+}
+
+func noProxyMatch(entries []NoProxyEntry, u *url.URL) bool {
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https", "wss":
+			port = "443"
+		default:
+			port = "80"
+		}
+	}
+
+	for _, e := range entries {
+		if e.Match(host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (hp *HTTPProxy) noProxy(fn ProxyFunc) ProxyFunc {
+	if fn == nil {
+		return nil
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		if noProxyMatch(hp.config.NoProxy, req.URL) {
+			ruleTraceFromContext(req.Context()).add("direct", "no-proxy")
+			return nil, nil
+		}
+		return fn(req)
+	}
+}
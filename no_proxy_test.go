@@ -0,0 +1,97 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestNoProxyMatch(t *testing.T) {
+	tests := []struct {
+		entry string
+		match []string
+		miss  []string
+	}{
+		{
+			entry: "*",
+			match: []string{"http://example.com", "https://1.2.3.4"},
+		},
+		{
+			entry: "example.com",
+			match: []string{"http://example.com", "https://foo.example.com:8443", "http://EXAMPLE.com."},
+			miss:  []string{"http://notexample.com", "http://example.org"},
+		},
+		{
+			entry: ".example.com",
+			match: []string{"http://foo.example.com"},
+			miss:  []string{"http://example.com"},
+		},
+		{
+			entry: "*.example.com",
+			match: []string{"http://foo.bar.example.com"},
+			miss:  []string{"http://example.com"},
+		},
+		{
+			entry: "example.com:443",
+			match: []string{"https://example.com", "http://example.com:443"},
+			miss:  []string{"http://example.com", "https://example.com:8443"},
+		},
+		{
+			entry: "10.0.0.0/8",
+			match: []string{"http://10.1.2.3", "https://10.0.0.1:8443"},
+			miss:  []string{"http://11.0.0.1", "http://example.com"},
+		},
+		{
+			entry: "192.168.1.1",
+			match: []string{"http://192.168.1.1:8080"},
+			miss:  []string{"http://192.168.1.2"},
+		},
+		{
+			entry: "[::1]:8080",
+			match: []string{"http://[::1]:8080"},
+			miss:  []string{"http://[::1]"},
+		},
+		{
+			entry: "fd00::/8",
+			match: []string{"http://[fd00::1]"},
+			miss:  []string{"http://[fe80::1]"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.entry, func(t *testing.T) {
+			e, err := ParseNoProxyEntry(tc.entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.String() != tc.entry {
+				t.Errorf("String(): got %q, want %q", e.String(), tc.entry)
+			}
+			for _, s := range tc.match {
+				u, _ := url.Parse(s)
+				if !noProxyMatch([]NoProxyEntry{e}, u) {
+					t.Errorf("expected %s to match", s)
+				}
+			}
+			for _, s := range tc.miss {
+				u, _ := url.Parse(s)
+				if noProxyMatch([]NoProxyEntry{e}, u) {
+					t.Errorf("expected %s not to match", s)
+				}
+			}
+		})
+	}
+}
+
+func TestParseNoProxyEntryError(t *testing.T) {
+	for _, s := range []string{"", " ", "foo.*.com", "example.com:port", "example.com:99999", "*."} {
+		if _, err := ParseNoProxyEntry(s); err == nil {
+			t.Errorf("ParseNoProxyEntry(%q): expected error", s)
+		}
+	}
+}
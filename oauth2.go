@@ -0,0 +1,344 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saucelabs/forwarder/log"
+)
+
+const (
+	oauth2GrantClientCredentials = "client_credentials"
+	oauth2GrantTokenExchange     = "urn:ietf:params:oauth:grant-type:token-exchange"
+	oauth2TokenTypeAccessToken   = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// OAuth2Rule injects OAuth2 access tokens obtained from TokenURL into requests to hosts matching Host.
+type OAuth2Rule struct {
+	Host     *regexp.Regexp
+	TokenURL *url.URL
+
+	ClientID     string
+	ClientSecret string
+
+	// Params are additional parameters of the token request, such as scope, audience or resource.
+	// The grant_type parameter selects the grant, client credentials is used by default.
+	Params url.Values
+}
+
+// ParseOAuth2Rule parses <host-regexp>=<token-url> string into OAuth2Rule.
+// The client ID and secret are specified as the token URL userinfo,
+// and the token URL query parameters are sent as token request parameters.
+// The token-exchange grant_type value is a shorthand for the RFC 8693 token exchange grant.
+func ParseOAuth2Rule(val string) (OAuth2Rule, error) {
+	host, tu, ok := strings.Cut(val, "=")
+	if !ok {
+		return OAuth2Rule{}, errors.New("expected <host-regexp>=<token-url>")
+	}
+	re, err := regexp.Compile(host)
+	if err != nil {
+		return OAuth2Rule{}, fmt.Errorf("host: %w", err)
+	}
+	u, err := url.Parse(tu)
+	if err != nil {
+		return OAuth2Rule{}, fmt.Errorf("token URL: %w", err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return OAuth2Rule{}, errors.New("token URL scheme must be http or https")
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return OAuth2Rule{}, errors.New("token URL must contain the client ID and secret")
+	}
+
+	r := OAuth2Rule{
+		Host:     re,
+		ClientID: u.User.Username(),
+		Params:   u.Query(),
+	}
+	r.ClientSecret, _ = u.User.Password()
+
+	switch r.Params.Get("grant_type") {
+	case "", oauth2GrantClientCredentials:
+		r.Params.Set("grant_type", oauth2GrantClientCredentials)
+	case "token-exchange", oauth2GrantTokenExchange:
+		r.Params.Set("grant_type", oauth2GrantTokenExchange)
+	default:
+		return OAuth2Rule{}, fmt.Errorf("unsupported grant type %q, supported types are: client_credentials, token-exchange", r.Params.Get("grant_type"))
+	}
+
+	tokenURL := *u
+	tokenURL.User = nil
+	tokenURL.RawQuery = ""
+	r.TokenURL = &tokenURL
+
+	return r, nil
+}
+
+func (r OAuth2Rule) tokenExchange() bool {
+	return r.Params.Get("grant_type") == oauth2GrantTokenExchange
+}
+
+func (r OAuth2Rule) String() string {
+	u := *r.TokenURL
+	u.User = url.UserPassword(r.ClientID, r.ClientSecret)
+	u.RawQuery = r.Params.Encode()
+	return r.Host.String() + "=" + u.String()
+}
+
+// RedactOAuth2Rule returns a string representation of the rule with the client secret redacted.
+func RedactOAuth2Rule(r OAuth2Rule) string {
+	u := *r.TokenURL
+	u.User = url.UserPassword(r.ClientID, "xxxxx")
+	u.RawQuery = r.Params.Encode()
+	return r.Host.String() + "=" + u.Redacted()
+}
+
+// OAuth2Config configures injection of OAuth2 bearer tokens into outbound requests,
+// it centralizes service-to-service authentication at the proxy.
+// Only requests visible to the proxy are modified, i.e. plain HTTP and MITMed HTTPS requests.
+//
+// With the client credentials grant, the token is injected into requests without the Authorization header.
+// With the token exchange grant, the client bearer token is exchanged for a token for the destination.
+type OAuth2Config struct {
+	// Rules is the list of rules, the first rule matching the request host is applied.
+	Rules []OAuth2Rule
+
+	// Timeout limits the time to obtain a token.
+	Timeout time.Duration
+}
+
+func DefaultOAuth2Config() *OAuth2Config {
+	return &OAuth2Config{
+		Timeout: 10 * time.Second,
+	}
+}
+
+func (c *OAuth2Config) Validate() error {
+	if len(c.Rules) == 0 {
+		return errors.New("rules are required")
+	}
+	return nil
+}
+
+// oauth2TokenRefreshMargin is the time before the token expiry when a new token is obtained.
+const oauth2TokenRefreshMargin = 30 * time.Second
+
+// maxOAuth2ExchangedTokens limits the number of cached exchanged tokens per rule.
+const maxOAuth2ExchangedTokens = 1024
+
+type oauth2Token struct {
+	value  string
+	expiry time.Time
+}
+
+func (t *oauth2Token) valid(now time.Time) bool {
+	return t != nil && (t.expiry.IsZero() || now.Before(t.expiry.Add(-oauth2TokenRefreshMargin)))
+}
+
+type oauth2Source struct {
+	rule    *OAuth2Rule
+	client  *http.Client
+	timeout time.Duration
+
+	mu     sync.Mutex
+	tokens map[string]*oauth2Token // by subject token, empty for client credentials
+}
+
+type oauth2Injector struct {
+	sources []*oauth2Source
+	log     log.Logger
+}
+
+func newOAuth2Injector(cfg *OAuth2Config, rt http.RoundTripper, log log.Logger) *oauth2Injector {
+	in := &oauth2Injector{log: log}
+	for i := range cfg.Rules {
+		in.sources = append(in.sources, &oauth2Source{
+			rule:    &cfg.Rules[i],
+			client:  &http.Client{Transport: rt},
+			timeout: cfg.Timeout,
+			tokens:  make(map[string]*oauth2Token),
+		})
+	}
+	return in
+}
+
+func (in *oauth2Injector) match(req *http.Request) *oauth2Source {
+	host := NormalizeHost(req.URL.Hostname())
+	for _, s := range in.sources {
+		if s.rule.Host.MatchString(host) {
+			return s
+		}
+	}
+	return nil
+}
+
+func bearerToken(req *http.Request) (string, bool) {
+	auth := req.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return auth[7:], true
+	}
+	return "", false
+}
+
+func (in *oauth2Injector) ModifyRequest(req *http.Request) error {
+	if req.Method == http.MethodConnect {
+		return nil
+	}
+	s := in.match(req)
+	if s == nil {
+		return nil
+	}
+
+	var subject string
+	if s.rule.tokenExchange() {
+		t, ok := bearerToken(req)
+		if !ok {
+			return nil
+		}
+		subject = t
+	} else if req.Header.Get("Authorization") != "" {
+		return nil
+	}
+
+	tok, err := s.token(req.Context(), subject)
+	if err != nil {
+		in.log.Errorf("obtain OAuth2 token host=%s token_url=%s: %s", req.URL.Host, s.rule.TokenURL.Redacted(), err)
+		return fmt.Errorf("obtain OAuth2 token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+tok)
+	ruleTraceFromContext(req.Context()).add("oauth2", s.rule.ClientID)
+
+	return nil
+}
+
+// ModifyResponse drops the cached token if the destination rejects it,
+// so that a new token is obtained for the next request.
+func (in *oauth2Injector) ModifyResponse(res *http.Response) error {
+	if res.StatusCode != http.StatusUnauthorized || res.Request == nil {
+		return nil
+	}
+	s := in.match(res.Request)
+	if s == nil {
+		return nil
+	}
+	tok, ok := bearerToken(res.Request)
+	if !ok {
+		return nil
+	}
+	s.invalidate(tok)
+	return nil
+}
+
+func (s *oauth2Source) token(ctx context.Context, subject string) (string, error) {
+	// The lock is held while the token is obtained, so that concurrent requests share the token request.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t := s.tokens[subject]; t.valid(time.Now()) {
+		return t.value, nil
+	}
+
+	t, err := s.fetch(ctx, subject)
+	if err != nil {
+		return "", err
+	}
+	if len(s.tokens) >= maxOAuth2ExchangedTokens {
+		clear(s.tokens)
+	}
+	s.tokens[subject] = t
+
+	return t.value, nil
+}
+
+func (s *oauth2Source) invalidate(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, t := range s.tokens {
+		if t.value == token {
+			delete(s.tokens, k)
+		}
+	}
+}
+
+func (s *oauth2Source) fetch(ctx context.Context, subject string) (*oauth2Token, error) {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.WithoutCancel(ctx), s.timeout)
+		defer cancel()
+	}
+
+	form := url.Values{}
+	for k, v := range s.rule.Params {
+		form[k] = v
+	}
+	if subject != "" {
+		form.Set("subject_token", subject)
+		form.Set("subject_token_type", oauth2TokenTypeAccessToken)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.rule.TokenURL.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(s.rule.ClientID), url.QueryEscape(s.rule.ClientSecret))
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(b, &e) //nolint:errcheck // best effort
+		if e.Error != "" {
+			return nil, fmt.Errorf("token endpoint returned status %d: %s", res.StatusCode, e.Error)
+		}
+		return nil, fmt.Errorf("token endpoint returned status %d", res.StatusCode)
+	}
+
+	var v struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, fmt.Errorf("invalid token response: %w", err)
+	}
+	if v.AccessToken == "" {
+		return nil, errors.New("invalid token response: missing access_token")
+	}
+	if v.TokenType != "" && !strings.EqualFold(v.TokenType, "bearer") && !strings.EqualFold(v.TokenType, "N_A") {
+		return nil, fmt.Errorf("unsupported token type %q", v.TokenType)
+	}
+
+	t := &oauth2Token{value: v.AccessToken}
+	if v.ExpiresIn > 0 {
+		t.expiry = time.Now().Add(time.Duration(v.ExpiresIn) * time.Second)
+	}
+	return t, nil
+}
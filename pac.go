@@ -8,6 +8,7 @@ package forwarder
 
 import (
 	"net/url"
+	"sync/atomic"
 
 	"github.com/saucelabs/forwarder/log"
 )
@@ -32,3 +33,27 @@ func (r *LoggingPACResolver) FindProxyForURL(u *url.URL, hostname string) (strin
 	}
 	return s, err
 }
+
+// DynamicPACResolver delegates to a PACResolver that can be replaced at runtime.
+type DynamicPACResolver struct {
+	r atomic.Pointer[pacResolverHolder]
+}
+
+type pacResolverHolder struct {
+	PACResolver
+}
+
+func NewDynamicPACResolver(r PACResolver) *DynamicPACResolver {
+	dr := new(DynamicPACResolver)
+	dr.Store(r)
+	return dr
+}
+
+// Store replaces the resolver, it is safe to call concurrently with FindProxyForURL.
+func (r *DynamicPACResolver) Store(pr PACResolver) {
+	r.r.Store(&pacResolverHolder{pr})
+}
+
+func (r *DynamicPACResolver) FindProxyForURL(u *url.URL, hostname string) (string, error) {
+	return r.r.Load().FindProxyForURL(u, hostname)
+}
@@ -22,6 +22,11 @@ type ProxyResolverConfig struct {
 	Script    string
 	AlertSink io.Writer
 
+	// DisableDNS prevents the PAC script from resolving host names.
+	// Host names passed to dnsResolve, dnsResolveEx and functions using them, such as isInNet and isResolvable,
+	// are treated as not resolvable, IP addresses are returned as is.
+	DisableDNS bool
+
 	testingLookupIP      func(ctx context.Context, network, host string) ([]net.IP, error)
 	testingMyIPAddress   []net.IP
 	testingMyIPAddressEx []net.IP
@@ -159,3 +164,18 @@ func (pr *ProxyResolver) FindProxyForURL(u *url.URL, hostname string) (string, e
 
 	return s, nil
 }
+
+func (pr *ProxyResolver) lookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	if pr.config.DisableDNS {
+		if ip := net.ParseIP(host); ip != nil && (network != "ip4" || ip.To4() != nil) {
+			return []net.IP{ip}, nil
+		}
+		return nil, &net.DNSError{Err: "DNS resolution disabled", Name: host, IsNotFound: true}
+	}
+
+	lookupIP := pr.config.testingLookupIP
+	if lookupIP == nil {
+		lookupIP = pr.resolver.LookupIP
+	}
+	return lookupIP(ctx, network, host)
+}
@@ -22,11 +22,7 @@ func (pr *ProxyResolver) dnsResolve(call goja.FunctionCall) goja.Value {
 		return goja.Undefined()
 	}
 
-	lookupIP := pr.config.testingLookupIP
-	if lookupIP == nil {
-		lookupIP = pr.resolver.LookupIP
-	}
-	ips, err := lookupIP(context.Background(), "ip4", host)
+	ips, err := pr.lookupIP(context.Background(), "ip4", host)
 	if err != nil {
 		return goja.Null()
 	}
@@ -70,11 +70,7 @@ func (pr *ProxyResolver) dnsResolveEx(call goja.FunctionCall) goja.Value {
 		return pr.vm.ToValue(false)
 	}
 
-	lookupIP := pr.config.testingLookupIP
-	if lookupIP == nil {
-		lookupIP = pr.resolver.LookupIP
-	}
-	ips, err := lookupIP(context.Background(), "ip", host)
+	ips, err := pr.lookupIP(context.Background(), "ip", host)
 	if err != nil {
 		return pr.vm.ToValue("")
 	}
@@ -87,6 +87,19 @@ func TestProxyResolverChromium(t *testing.T) { //nolint:maintidx // long table
 			},
 			want: []Proxy{{Mode: PROXY, Host: "success", Port: "80"}},
 		},
+		{
+			fileName: "dns_fail.js",
+			configure: func(t *testing.T, cfg *ProxyResolverConfig) {
+				cfg.DisableDNS = true
+				cfg.testingLookupIP = func(ctx context.Context, network, host string) ([]net.IP, error) {
+					t.Errorf("unexpected DNS lookup of %q", host)
+					return nil, errors.New("test")
+				}
+				cfg.testingMyIPAddress = []net.IP{}
+				cfg.testingMyIPAddressEx = []net.IP{}
+			},
+			want: []Proxy{{Mode: PROXY, Host: "success", Port: "80"}},
+		},
 		{
 			fileName: "ends_with_comment.js",
 			want:     []Proxy{{Mode: PROXY, Host: "success", Port: "80"}},
@@ -68,6 +68,14 @@ func (p Proxy) URL() *url.URL {
 	}
 }
 
+// String returns the proxy in the PAC result format.
+func (p Proxy) String() string {
+	if p.Mode == DIRECT {
+		return "DIRECT"
+	}
+	return p.Mode.String() + " " + net.JoinHostPort(p.Host, p.Port)
+}
+
 func (s Proxies) String() string {
 	return string(s)
 }
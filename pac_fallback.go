@@ -0,0 +1,139 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/saucelabs/forwarder/log"
+	"github.com/saucelabs/forwarder/pac"
+)
+
+// pacFallback implements the browser behavior of falling back to the next entry of the PAC result
+// when connecting to a proxy fails.
+// Failed proxies are skipped by all requests until the retry interval elapses,
+// if all proxies failed they are tried anyway.
+// DIRECT is never marked as failed, a connection error may be specific to the target.
+type pacFallback struct {
+	retryInterval time.Duration
+	log           log.Logger
+
+	mu     sync.Mutex
+	failed map[pac.Proxy]time.Time
+}
+
+func newPACFallback(retryInterval time.Duration, log log.Logger) *pacFallback {
+	return &pacFallback{
+		retryInterval: retryInterval,
+		log:           log,
+		failed:        make(map[pac.Proxy]time.Time),
+	}
+}
+
+// pacChoice is the state of the fallback for a single request.
+type pacChoice struct {
+	tried    []pac.Proxy
+	current  pac.Proxy
+	selected bool
+	// untried is the number of entries that can be tried after current.
+	untried int
+}
+
+type pacChoiceKey struct{}
+
+func pacChoiceFromContext(ctx context.Context) *pacChoice {
+	c, _ := ctx.Value(pacChoiceKey{}).(*pacChoice)
+	return c
+}
+
+func (f *pacFallback) ModifyRequest(req *http.Request) error {
+	*req = *req.WithContext(context.WithValue(req.Context(), pacChoiceKey{}, new(pacChoice)))
+	return nil
+}
+
+// pick returns the first entry that was not tried by the request and did not fail recently.
+func (f *pacFallback) pick(ctx context.Context, proxies []pac.Proxy) pac.Proxy {
+	if len(proxies) == 0 {
+		return pac.Proxy{Mode: pac.DIRECT}
+	}
+
+	c := pacChoiceFromContext(ctx)
+	if c == nil {
+		c = new(pacChoice)
+	}
+
+	var (
+		now       = time.Now()
+		candidate []pac.Proxy
+		failed    []pac.Proxy
+	)
+	f.mu.Lock()
+	for _, p := range proxies {
+		if slices.Contains(c.tried, p) {
+			continue
+		}
+		if t, ok := f.failed[p]; ok {
+			if now.Sub(t) < f.retryInterval {
+				failed = append(failed, p)
+				continue
+			}
+			delete(f.failed, p)
+		}
+		candidate = append(candidate, p)
+	}
+	f.mu.Unlock()
+
+	candidate = append(candidate, failed...)
+	if len(candidate) == 0 {
+		return proxies[0]
+	}
+
+	c.current = candidate[0]
+	c.selected = true
+	c.untried = len(candidate) - 1
+	return c.current
+}
+
+// retry marks the proxy selected for the request as failed if err is a connection error,
+// it returns true if there are other entries to try.
+func (f *pacFallback) retry(req *http.Request, err error) bool {
+	c := pacChoiceFromContext(req.Context())
+	if c == nil || !c.selected || !isDialError(err) {
+		return false
+	}
+	c.selected = false
+	c.tried = append(c.tried, c.current)
+	ruleTraceFromContext(req.Context()).add("pac-failed", c.current.String())
+
+	if c.current.Mode != pac.DIRECT {
+		f.mu.Lock()
+		f.failed[c.current] = time.Now()
+		f.mu.Unlock()
+		f.log.Infof("PAC proxy %s failed, skipping it for %s: %s", c.current, f.retryInterval, err)
+	}
+
+	return c.untried > 0
+}
+
+// isDialError returns true if err is an error establishing a connection,
+// as opposed to an error returned by the proxy or the target.
+func isDialError(err error) bool {
+	var ne *net.OpError
+	for errors.As(err, &ne) {
+		if ne.Op == "dial" {
+			return true
+		}
+		err = ne.Err
+	}
+	return false
+}
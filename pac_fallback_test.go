@@ -0,0 +1,156 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"github.com/saucelabs/forwarder/pac"
+)
+
+func TestPACFallbackPick(t *testing.T) {
+	var (
+		a       = pac.Proxy{Mode: pac.PROXY, Host: "a", Port: "3128"}
+		b       = pac.Proxy{Mode: pac.PROXY, Host: "b", Port: "3128"}
+		direct  = pac.Proxy{Mode: pac.DIRECT}
+		all     = []pac.Proxy{a, b, direct}
+		dialErr = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	)
+
+	f := newPACFallback(time.Minute, stdlog.Default())
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com", http.NoBody)
+		f.ModifyRequest(req) //nolint:errcheck // always nil
+		return req
+	}
+
+	req := newRequest()
+	if p := f.pick(req.Context(), all); p != a {
+		t.Fatalf("got %s, want %s", p, a)
+	}
+	if f.retry(req, errors.New("bad gateway")) {
+		t.Fatal("retry on non-dial error")
+	}
+	if !f.retry(req, dialErr) {
+		t.Fatal("no retry on dial error")
+	}
+	if p := f.pick(req.Context(), all); p != b {
+		t.Fatalf("got %s, want %s", p, b)
+	}
+	if !f.retry(req, &net.OpError{Op: "proxyconnect", Err: dialErr}) {
+		t.Fatal("no retry on proxy dial error")
+	}
+	if p := f.pick(req.Context(), all); p != direct {
+		t.Fatalf("got %s, want %s", p, direct)
+	}
+	if f.retry(req, dialErr) {
+		t.Fatal("retry with no entries left")
+	}
+
+	t.Run("failed skipped", func(t *testing.T) {
+		req := newRequest()
+		if p := f.pick(req.Context(), all); p != direct {
+			t.Fatalf("got %s, want %s", p, direct)
+		}
+		// DIRECT is never marked as failed, failed proxies are tried as a last resort.
+		if !f.retry(req, dialErr) {
+			t.Fatal("no retry on dial error")
+		}
+		if p := f.pick(req.Context(), all); p != a {
+			t.Fatalf("got %s, want %s", p, a)
+		}
+	})
+
+	t.Run("retry interval", func(t *testing.T) {
+		f.mu.Lock()
+		for p := range f.failed {
+			f.failed[p] = time.Now().Add(-2 * time.Minute)
+		}
+		f.mu.Unlock()
+
+		req := newRequest()
+		if p := f.pick(req.Context(), all); p != a {
+			t.Fatalf("got %s, want %s", p, a)
+		}
+	})
+}
+
+type pacResolverFunc func(u *url.URL, hostname string) (string, error)
+
+func (f pacResolverFunc) FindProxyForURL(u *url.URL, hostname string) (string, error) {
+	return f(u, hostname)
+}
+
+func TestPACFallback(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, "ok") //nolint:errcheck // test server
+	})
+	origin := httptest.NewServer(h)
+	defer origin.Close()
+	tlsOrigin := httptest.NewTLSServer(h)
+	defer tlsOrigin.Close()
+
+	// Reserve a port with nothing listening on it.
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr().String()
+	l.Close()
+
+	pr := pacResolverFunc(func(*url.URL, string) (string, error) {
+		return fmt.Sprintf("PROXY %s; DIRECT", dead), nil
+	})
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.Address = "localhost:0"
+	cfg.ProxyLocalhost = AllowProxyLocalhost
+	cfg.PromRegistry = prometheus.NewRegistry()
+	p, err := NewHTTPProxy(cfg, pr, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx) //nolint:errcheck // returns on cancel
+
+	addrs, _ := p.Addr()
+	proxyURL := &url.URL{Scheme: "http", Host: addrs[0]}
+	tr := tlsOrigin.Client().Transport.(*http.Transport).Clone() //nolint:forcetypeassert // httptest client
+	tr.Proxy = http.ProxyURL(proxyURL)
+	c := &http.Client{Transport: tr}
+
+	for _, u := range []string{tlsOrigin.URL, origin.URL} {
+		res, err := c.Get(u) //nolint:noctx // test
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || string(b) != "ok" {
+			t.Fatalf("%s: got %d %q", u, res.StatusCode, b)
+		}
+	}
+
+	p.pacFallback.mu.Lock()
+	n := len(p.pacFallback.failed)
+	p.pacFallback.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("got %d failed proxies, want 1", n)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Protocols that can be used in PortPolicy.
+const (
+	PortPolicyHTTP    = "http"
+	PortPolicyHTTPS   = "https"
+	PortPolicyConnect = "connect"
+)
+
+type PortRange struct {
+	Min, Max uint16
+}
+
+func (r PortRange) contains(port uint16) bool {
+	return port >= r.Min && port <= r.Max
+}
+
+func (r PortRange) String() string {
+	if r.Min == r.Max {
+		return strconv.Itoa(int(r.Min))
+	}
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// PortPolicy restricts the destination ports and protocols that can be used for hosts matching Host.
+// If Ports or Protocols is empty, any port or protocol respectively is allowed.
+type PortPolicy struct {
+	Host      *regexp.Regexp
+	Ports     []PortRange
+	Protocols []string
+}
+
+// ParsePortPolicy parses <regexp>=<rule>[|<rule>]... string into PortPolicy.
+// The rule is a port, a port range <min>-<max>, or a protocol name: http, https or connect.
+func ParsePortPolicy(val string) (PortPolicy, error) {
+	idx := strings.LastIndex(val, "=")
+	if idx <= 0 || idx == len(val)-1 {
+		return PortPolicy{}, errors.New("expected <regexp>=<rule>[|<rule>]...")
+	}
+
+	r, err := regexp.Compile(val[:idx])
+	if err != nil {
+		return PortPolicy{}, err
+	}
+	p := PortPolicy{Host: r}
+
+	for _, rule := range strings.Split(val[idx+1:], "|") {
+		switch rule {
+		case PortPolicyHTTP, PortPolicyHTTPS, PortPolicyConnect:
+			p.Protocols = append(p.Protocols, rule)
+			continue
+		}
+
+		minPort, maxPort, isRange := strings.Cut(rule, "-")
+		if !isRange {
+			maxPort = minPort
+		}
+		pmin, err := strconv.ParseUint(minPort, 10, 16)
+		if err != nil {
+			return PortPolicy{}, fmt.Errorf("invalid rule %q", rule)
+		}
+		pmax, err := strconv.ParseUint(maxPort, 10, 16)
+		if err != nil {
+			return PortPolicy{}, fmt.Errorf("invalid rule %q", rule)
+		}
+		if pmin > pmax {
+			return PortPolicy{}, fmt.Errorf("invalid port range %q", rule)
+		}
+		p.Ports = append(p.Ports, PortRange{Min: uint16(pmin), Max: uint16(pmax)})
+	}
+
+	return p, nil
+}
+
+func (p PortPolicy) String() string {
+	var sb strings.Builder
+	sb.WriteString(p.Host.String())
+	sb.WriteString("=")
+	for i, r := range p.Ports {
+		if i > 0 {
+			sb.WriteString("|")
+		}
+		sb.WriteString(r.String())
+	}
+	for i, proto := range p.Protocols {
+		if i > 0 || len(p.Ports) > 0 {
+			sb.WriteString("|")
+		}
+		sb.WriteString(proto)
+	}
+	return sb.String()
+}
+
+func (p PortPolicy) allows(proto string, port uint16) bool {
+	if len(p.Protocols) > 0 && !slices.Contains(p.Protocols, proto) {
+		return false
+	}
+	if len(p.Ports) > 0 && !slices.ContainsFunc(p.Ports, func(r PortRange) bool { return r.contains(port) }) {
+		return false
+	}
+	return true
+}
+
+// portPolicyCheck returns the protocol and false if the request is not allowed by the first policy matching the request host.
+// Requests to hosts not matching any policy are allowed.
+func portPolicyCheck(policies []PortPolicy, req *http.Request) (string, bool) {
+	proto := req.URL.Scheme
+	if req.Method == http.MethodConnect {
+		proto = PortPolicyConnect
+	}
+
+	return proto, portPolicyAllows(policies, proto, req.URL.Hostname(), urlPort(req.URL.Scheme, req.URL.Port()))
+}
+
+// portPolicyAllows returns false if the destination is not allowed by the first policy matching the host.
+// Hosts not matching any policy are allowed.
+func portPolicyAllows(policies []PortPolicy, proto, host, port string) bool {
+	for _, p := range policies {
+		if !matchHost(MatchFunc(p.Host.MatchString), host) {
+			continue
+		}
+
+		port, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return false
+		}
+		return p.allows(proto, uint16(port))
+	}
+
+	return true
+}
+
+func urlPort(scheme, port string) string {
+	if port != "" {
+		return port
+	}
+	switch scheme {
+	case "https", "wss":
+		return "443"
+	default:
+		return "80"
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParsePortPolicy(t *testing.T) {
+	tests := []struct {
+		input string
+		err   bool
+	}{
+		{input: `.*\.corp=443`},
+		{input: `.*\.corp=8000-8080|443`},
+		{input: `.*\.corp=connect|https`},
+		{input: `.*\.corp=443|connect`},
+		{input: `.*\.corp=`, err: true},
+		{input: `=443`, err: true},
+		{input: `.*\.corp=443-80`, err: true},
+		{input: `.*\.corp=70000`, err: true},
+		{input: `.*\.corp=ftp`, err: true},
+		{input: `(=443`, err: true},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.input, func(t *testing.T) {
+			p, err := ParsePortPolicy(tc.input)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected error, got %v", p)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.String() != tc.input {
+				t.Fatalf("expected %s, got %s", tc.input, p)
+			}
+		})
+	}
+}
+
+func TestPortPolicyCheck(t *testing.T) {
+	var policies []PortPolicy
+	for _, s := range []string{`.*\.corp=443`, `.*\.local=connect|8000-8080`} {
+		p, err := ParsePortPolicy(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		policies = append(policies, p)
+	}
+
+	tests := []struct {
+		method string
+		target string
+		allow  bool
+	}{
+		{method: http.MethodGet, target: "http://foo.corp/", allow: false},
+		{method: http.MethodGet, target: "https://foo.corp/", allow: true},
+		{method: http.MethodConnect, target: "foo.corp:443", allow: true},
+		{method: http.MethodConnect, target: "foo.corp:22", allow: false},
+		{method: http.MethodGet, target: "http://foo.local:8080/", allow: false},
+		{method: http.MethodConnect, target: "foo.local:8080", allow: true},
+		{method: http.MethodConnect, target: "foo.local:443", allow: false},
+		{method: http.MethodGet, target: "http://foo.com:22/", allow: true},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.method+" "+tc.target, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.target, http.NoBody)
+			if _, ok := portPolicyCheck(policies, req); ok != tc.allow {
+				t.Fatalf("expected allow=%v, got %v", tc.allow, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package proxyproto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// Format returns the header encoded in the PROXY protocol version of the header.
+// If the header is local, or the addresses are not TCP addresses, the header is UNKNOWN (v1) or LOCAL (v2).
+// If the addresses are of different IP versions, IPv4 addresses are encoded as IPv4-mapped IPv6 addresses.
+func (h *Header) Format() ([]byte, error) {
+	src, srcOK := h.Source.(*net.TCPAddr)
+	dst, dstOK := h.Destination.(*net.TCPAddr)
+	local := h.IsLocal || !srcOK || !dstOK
+	ipv4 := !local && src.IP.To4() != nil && dst.IP.To4() != nil
+
+	switch h.Version {
+	case 1:
+		if local {
+			return []byte("PROXY " + v1UnKnownProto + cRLF), nil
+		}
+		proto := "TCP6"
+		if ipv4 {
+			proto = "TCP4"
+		}
+		b := make([]byte, 0, 108)
+		b = append(b, V1Identifier...)
+		b = append(b, proto...)
+		b = append(b, ' ')
+		b = append(b, formatV1IP(src.IP, ipv4)...)
+		b = append(b, ' ')
+		b = append(b, formatV1IP(dst.IP, ipv4)...)
+		b = append(b, ' ')
+		b = strconv.AppendInt(b, int64(src.Port), 10)
+		b = append(b, ' ')
+		b = strconv.AppendInt(b, int64(dst.Port), 10)
+		b = append(b, cRLF...)
+		return b, nil
+	case 2:
+		var (
+			cmd  byte = 0x21 // version 2, PROXY command
+			fam  byte
+			addr []byte
+		)
+		switch {
+		case local:
+			cmd = 0x20 // version 2, LOCAL command
+		case ipv4:
+			fam = 0x11 // TCP over IPv4
+			addr = make([]byte, 0, ipv4AddressLen)
+			addr = append(addr, src.IP.To4()...)
+			addr = append(addr, dst.IP.To4()...)
+		default:
+			fam = 0x21 // TCP over IPv6
+			addr = make([]byte, 0, ipv6AddressLen)
+			addr = append(addr, src.IP.To16()...)
+			addr = append(addr, dst.IP.To16()...)
+		}
+		if !local {
+			addr = binary.BigEndian.AppendUint16(addr, uint16(src.Port))
+			addr = binary.BigEndian.AppendUint16(addr, uint16(dst.Port))
+		}
+
+		length := len(addr) + len(h.RawTLVs)
+		if length > 2048 {
+			return nil, fmt.Errorf("header length of '%d' is greater than the allowed 2048 bytes", length)
+		}
+
+		b := make([]byte, 0, 16+length)
+		b = append(b, V2Identifier...)
+		b = append(b, cmd, fam)
+		b = binary.BigEndian.AppendUint16(b, uint16(length))
+		b = append(b, addr...)
+		b = append(b, h.RawTLVs...)
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy protocol version %d", h.Version)
+	}
+}
+
+func formatV1IP(ip net.IP, ipv4 bool) string {
+	if ipv4 {
+		return ip.To4().String()
+	}
+	// Print IPv4 addresses in IPv4-mapped IPv6 form, net.IP.String prints them in dotted decimal form.
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+// WriteTo writes the header encoded with Format to w.
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	b, err := h.Format()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
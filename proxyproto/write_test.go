@@ -0,0 +1,125 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package proxyproto
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormat(t *testing.T) {
+	tcp4 := func(ip string, port int) *net.TCPAddr { return &net.TCPAddr{IP: net.ParseIP(ip).To4(), Port: port} }
+	tcp6 := func(ip string, port int) *net.TCPAddr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: port} }
+
+	tests := []struct {
+		name   string
+		header Header
+		out    string
+		src    net.Addr
+		dest   net.Addr
+		local  bool
+	}{
+		{
+			name:   "v1 TCP4",
+			header: Header{Version: 1, Source: tcp4("1.1.1.1", 1000), Destination: tcp4("2.2.2.2", 2000)},
+			out:    "PROXY TCP4 1.1.1.1 2.2.2.2 1000 2000\r\n",
+		},
+		{
+			name:   "v1 TCP6",
+			header: Header{Version: 1, Source: tcp6("fe80::1", 1000), Destination: tcp6("fe80::2", 2000)},
+			out:    "PROXY TCP6 fe80::1 fe80::2 1000 2000\r\n",
+		},
+		{
+			name:   "v1 TCP6 mixed",
+			header: Header{Version: 1, Source: tcp4("1.1.1.1", 1000), Destination: tcp6("fe80::2", 2000)},
+			out:    "PROXY TCP6 ::ffff:1.1.1.1 fe80::2 1000 2000\r\n",
+			src:    tcp6("::ffff:1.1.1.1", 1000),
+		},
+		{
+			name:   "v1 UNKNOWN",
+			header: Header{Version: 1, IsLocal: true},
+			out:    "PROXY UNKNOWN\r\n",
+			local:  true,
+		},
+		{
+			name:   "v1 UNKNOWN non TCP",
+			header: Header{Version: 1, Source: &net.UnixAddr{Name: "/tmp/sock"}, Destination: tcp4("2.2.2.2", 2000)},
+			out:    "PROXY UNKNOWN\r\n",
+			local:  true,
+		},
+		{
+			name:   "v2 TCP4",
+			header: Header{Version: 2, Source: tcp4("1.1.1.1", 1000), Destination: tcp4("2.2.2.2", 2000)},
+			out:    string(v2Header),
+		},
+		{
+			name:   "v2 TCP6",
+			header: Header{Version: 2, Source: tcp6("fe80::1", 1000), Destination: tcp6("fe80::2", 2000)},
+		},
+		{
+			name:   "v2 TCP6 mixed",
+			header: Header{Version: 2, Source: tcp6("fe80::1", 1000), Destination: tcp4("2.2.2.2", 2000)},
+			dest:   tcp6("::ffff:2.2.2.2", 2000),
+		},
+		{
+			name:   "v2 LOCAL",
+			header: Header{Version: 2, IsLocal: true},
+			local:  true,
+		},
+		{
+			name:   "v2 TLVs",
+			header: Header{Version: 2, Source: tcp4("1.1.1.1", 1000), Destination: tcp4("2.2.2.2", 2000), RawTLVs: []byte{0x01, 0x00, 0x02, 'h', '2'}},
+		},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := tc.header.Format()
+			require.NoError(t, err)
+			if tc.out != "" {
+				assert.Equal(t, tc.out, string(b))
+			}
+
+			var buf bytes.Buffer
+			n, err := tc.header.WriteTo(&buf)
+			require.NoError(t, err)
+			assert.Equal(t, int64(len(b)), n)
+			assert.Equal(t, b, buf.Bytes())
+
+			h, err := ReadHeader(bytes.NewReader(b))
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.header.Version, h.Version)
+			assert.Equal(t, tc.local, h.IsLocal)
+			if tc.local {
+				return
+			}
+
+			src, dest := tc.header.Source, tc.header.Destination
+			if tc.src != nil {
+				src = tc.src
+			}
+			if tc.dest != nil {
+				dest = tc.dest
+			}
+			assert.Equal(t, src.String(), h.Source.String())
+			assert.Equal(t, dest.String(), h.Destination.String())
+			assert.Equal(t, tc.header.RawTLVs, h.RawTLVs)
+		})
+	}
+}
+
+func TestFormatUnsupportedVersion(t *testing.T) {
+	h := Header{Version: 3}
+	_, err := h.Format()
+	require.Error(t, err)
+}
@@ -0,0 +1,141 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/middleware"
+	"github.com/saucelabs/forwarder/ratelimit"
+)
+
+// RateLimit allows Requests requests per Period.
+// Long periods can be used as quotas, e.g. 10000/24h.
+type RateLimit struct {
+	Requests int64
+	Period   time.Duration
+}
+
+// ParseRateLimit parses <requests>/<duration> string into RateLimit.
+func ParseRateLimit(val string) (RateLimit, error) {
+	n, p, ok := strings.Cut(val, "/")
+	if !ok {
+		return RateLimit{}, errors.New("expected <requests>/<duration>")
+	}
+
+	requests, err := strconv.ParseInt(n, 10, 64)
+	if err != nil || requests <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid number of requests %q", n)
+	}
+	period, err := time.ParseDuration(p)
+	if err != nil {
+		return RateLimit{}, fmt.Errorf("invalid duration %q: %w", p, err)
+	}
+	if period < time.Millisecond {
+		return RateLimit{}, fmt.Errorf("duration %s must be at least 1ms", period)
+	}
+
+	return RateLimit{Requests: requests, Period: period}, nil
+}
+
+func (l RateLimit) String() string {
+	return fmt.Sprintf("%d/%s", l.Requests, l.Period)
+}
+
+// RateLimitConfig limits the number of requests per client.
+// Clients are identified by the proxy basic authentication username, or by IP address if it is not present.
+// CONNECT requests and requests in MITM tunnels each count as a request.
+// Periods are fixed windows aligned to the Unix epoch.
+type RateLimitConfig struct {
+	Limits []RateLimit
+
+	// Counter stores the request counts.
+	// Use a shared counter e.g. ratelimit.RedisCounter to enforce the limits across multiple proxy instances.
+	// If nil, the counts are local to the proxy.
+	// If the counter fails, the request is allowed.
+	Counter ratelimit.Counter
+}
+
+func (c *RateLimitConfig) Validate() error {
+	if len(c.Limits) == 0 {
+		return errors.New("limits are required")
+	}
+	return nil
+}
+
+func rateLimitsString(limits []RateLimit) string {
+	s := make([]string, len(limits))
+	for i, l := range limits {
+		s[i] = l.String()
+	}
+	return strings.Join(s, ",")
+}
+
+type rateLimitError struct {
+	client     string
+	limit      RateLimit
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("rate limit %s exceeded", e.limit)
+}
+
+func (hp *HTTPProxy) rateLimit() martian.RequestModifier {
+	cfg := hp.config.RateLimit
+	counter := cfg.Counter
+	if counter == nil {
+		counter = ratelimit.NewMemoryCounter()
+	}
+	ba := middleware.NewProxyBasicAuth()
+	now := time.Now
+
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		client := rateLimitClient(ba, req)
+		t := now()
+
+		for _, l := range cfg.Limits {
+			window := t.UnixNano() / int64(l.Period)
+			key := fmt.Sprintf("%s:%s:%d", client, l.Period, window)
+
+			n, err := counter.Incr(req.Context(), key, l.Period)
+			if err != nil {
+				hp.log.Errorf("rate limit: counter error, allowing request: %s", err)
+				return nil
+			}
+			if n > l.Requests {
+				hp.metrics.rateLimited(l.String())
+				ruleTraceFromContext(req.Context()).add("deny", "rate-limit")
+				return &rateLimitError{
+					client:     client,
+					limit:      l,
+					retryAfter: time.Unix(0, (window+1)*int64(l.Period)).Sub(t),
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+func rateLimitClient(ba *middleware.BasicAuth, req *http.Request) string {
+	if user, _, ok := ba.BasicAuth(req); ok && user != "" {
+		return "user:" + user
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return "ip:" + host
+}
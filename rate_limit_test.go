@@ -0,0 +1,86 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		input string
+		want  RateLimit
+		err   bool
+	}{
+		{input: "10/1s", want: RateLimit{Requests: 10, Period: time.Second}},
+		{input: "10000/24h", want: RateLimit{Requests: 10000, Period: 24 * time.Hour}},
+		{input: "10", err: true},
+		{input: "0/1s", err: true},
+		{input: "x/1s", err: true},
+		{input: "10/x", err: true},
+		{input: "10/1us", err: true},
+	}
+
+	for _, tc := range tests {
+		got, err := ParseRateLimit(tc.input)
+		if tc.err {
+			if err == nil {
+				t.Errorf("ParseRateLimit(%q): expected error", tc.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseRateLimit(%q): %v", tc.input, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("ParseRateLimit(%q) = %v, want %v", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer origin.Close()
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.ProxyLocalhost = AllowProxyLocalhost
+	cfg.RateLimit = &RateLimitConfig{
+		Limits: []RateLimit{{Requests: 2, Period: 24 * time.Hour}},
+	}
+
+	tr, err := NewClientTransport(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	c := &http.Client{Transport: tr}
+
+	for i := range 3 {
+		res, err := c.Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		want := http.StatusOK
+		if i == 2 {
+			want = http.StatusTooManyRequests
+		}
+		if res.StatusCode != want {
+			t.Fatalf("request %d: expected %d, got %d", i, want, res.StatusCode)
+		}
+		if i == 2 && res.Header.Get("Retry-After") == "" {
+			t.Fatal("expected Retry-After header")
+		}
+	}
+}
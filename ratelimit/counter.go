@@ -0,0 +1,68 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Counter counts events per key, keys expire after ttl since the first increment.
+// Callers implement fixed windows by including the window number in the key.
+type Counter interface {
+	// Incr increments the counter of key and returns the new value.
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+}
+
+// MemoryCounter is a Counter local to the process.
+type MemoryCounter struct {
+	mu      sync.Mutex
+	entries map[string]*memoryCounterEntry
+	now     func() time.Time
+	nextGC  time.Time
+}
+
+type memoryCounterEntry struct {
+	n       int64
+	expires time.Time
+}
+
+// memoryCounterGCInterval is the minimal interval between removals of expired keys.
+const memoryCounterGCInterval = time.Minute
+
+func NewMemoryCounter() *MemoryCounter {
+	return &MemoryCounter{
+		entries: make(map[string]*memoryCounterEntry),
+		now:     time.Now,
+	}
+}
+
+func (c *MemoryCounter) Incr(_ context.Context, key string, ttl time.Duration) (int64, error) {
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.After(c.nextGC) {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.nextGC = now.Add(memoryCounterGCInterval)
+	}
+
+	e, ok := c.entries[key]
+	if !ok || !now.Before(e.expires) {
+		e = &memoryCounterEntry{expires: now.Add(ttl)}
+		c.entries[key] = e
+	}
+	e.n++
+
+	return e.n, nil
+}
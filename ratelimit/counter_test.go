@@ -0,0 +1,100 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package ratelimit
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/redis/redistest"
+)
+
+func TestMemoryCounter(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := NewMemoryCounter()
+	c.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	for i := int64(1); i <= 3; i++ {
+		n, _ := c.Incr(ctx, "a", time.Second)
+		if n != i {
+			t.Fatalf("Incr() = %d, want %d", n, i)
+		}
+	}
+	if n, _ := c.Incr(ctx, "b", time.Second); n != 1 {
+		t.Fatalf("Incr() = %d, want 1", n)
+	}
+
+	now = now.Add(time.Second)
+	if n, _ := c.Incr(ctx, "a", time.Second); n != 1 {
+		t.Fatalf("Incr() after expiry = %d, want 1", n)
+	}
+
+	now = now.Add(2 * memoryCounterGCInterval)
+	c.Incr(ctx, "c", time.Second)
+	if len(c.entries) != 1 {
+		t.Fatalf("expected expired keys to be removed, got %d keys", len(c.entries))
+	}
+}
+
+func TestRedisCounter(t *testing.T) {
+	s, err := redistest.NewServer("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	u := s.URL("secret")
+	u.Path = "/2"
+	c, err := NewRedisCounter(u, "forwarder:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	for i := int64(1); i <= 3; i++ {
+		n, err := c.Incr(ctx, "a", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != i {
+			t.Fatalf("Incr() = %d, want %d", n, i)
+		}
+	}
+	if v, _ := s.Get("forwarder:a"); v != "3" {
+		t.Fatalf("expected prefixed key, got %q", v)
+	}
+
+	u.User = url.UserPassword("", "wrong")
+	c, err = NewRedisCounter(u, "forwarder:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Incr(ctx, "a", time.Second); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Fatalf("expected authentication error, got %v", err)
+	}
+}
+
+func TestNewRedisCounterErrors(t *testing.T) {
+	for _, s := range []string{
+		"http://localhost",
+		"redis://localhost/db",
+	} {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewRedisCounter(u, ""); err == nil {
+			t.Errorf("NewRedisCounter(%s): expected error", s)
+		}
+	}
+}
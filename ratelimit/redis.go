@@ -0,0 +1,56 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package ratelimit
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/redis"
+)
+
+// RedisCounter is a Counter stored in Redis, it can be shared by multiple processes.
+// It uses the INCR and PEXPIRE commands.
+type RedisCounter struct {
+	c      *redis.Client
+	prefix string
+}
+
+// NewRedisCounter returns a RedisCounter for the URL redis://[[user]:password@]host[:port][/db],
+// rediss:// enables TLS, the default port is 6379.
+// Keys are prefixed with prefix.
+func NewRedisCounter(u *url.URL, prefix string) (*RedisCounter, error) {
+	c, err := redis.NewClient(u)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RedisCounter{
+		c:      c,
+		prefix: prefix,
+	}, nil
+}
+
+func (c *RedisCounter) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	key = c.prefix + key
+	replies, err := c.c.Do(ctx,
+		[]string{"INCR", key},
+		[]string{"PEXPIRE", key, strconv.FormatInt(ttl.Milliseconds(), 10)},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(replies[0].Value, 10, 64)
+}
+
+// Close closes idle connections.
+func (c *RedisCounter) Close() error {
+	return c.c.Close()
+}
@@ -0,0 +1,161 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/saucelabs/forwarder/dialvia"
+	"github.com/saucelabs/forwarder/log"
+)
+
+// RelayAgentPath is the path of the relay endpoint agents connect to.
+const RelayAgentPath = "/agent"
+
+const relayPingInterval = 30 * time.Second
+
+// Relay pairs client connections with connections from agents running ReverseListener.
+// It is an http.Handler that accepts agent WebSocket connections,
+// and serves client connections passed to Serve by forwarding them to an idle agent connection.
+type Relay struct {
+	upgrader websocket.Upgrader
+	log      log.Logger
+	agents   chan net.Conn
+	done     chan struct{}
+	once     sync.Once
+
+	// AgentWaitTimeout limits the time a client waits for an idle agent connection.
+	AgentWaitTimeout time.Duration
+}
+
+func NewRelay(log log.Logger) *Relay {
+	return &Relay{
+		upgrader: websocket.Upgrader{
+			// Agents are not browsers, the endpoint is protected by the server basic auth.
+			CheckOrigin: func(*http.Request) bool { return true },
+		},
+		log:              log,
+		agents:           make(chan net.Conn),
+		done:             make(chan struct{}),
+		AgentWaitTimeout: 30 * time.Second,
+	}
+}
+
+// ServeHTTP accepts an agent connection and holds it until a client is paired with it.
+// Idle agent connections are pinged to detect dead connections.
+func (r *Relay) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != RelayAgentPath {
+		http.NotFound(w, req)
+		return
+	}
+
+	c, err := r.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// Upgrade replies to the agent with an error.
+		r.log.Debugf("agent upgrade failed agent=%s error=%s", req.RemoteAddr, err)
+		return
+	}
+	r.log.Debugf("agent connected agent=%s", req.RemoteAddr)
+
+	conn := dialvia.NewWebSocketConn(c)
+
+	t := time.NewTicker(relayPingInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case r.agents <- conn:
+			return
+		case <-t.C:
+			if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(relayPingInterval)); err != nil {
+				r.log.Debugf("agent disconnected agent=%s error=%s", req.RemoteAddr, err)
+				conn.Close()
+				return
+			}
+		case <-r.done:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// Serve accepts client connections from l and forwards them to agents until l is closed.
+func (r *Relay) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go r.handle(conn)
+	}
+}
+
+func (r *Relay) handle(conn net.Conn) {
+	ctx := context.Background()
+	if r.AgentWaitTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.AgentWaitTimeout)
+		defer cancel()
+	}
+
+	var agent net.Conn
+	select {
+	case agent = <-r.agents:
+	case <-ctx.Done():
+		r.log.Errorf("no agent connection available client=%s", conn.RemoteAddr())
+		conn.Close()
+		return
+	case <-r.done:
+		conn.Close()
+		return
+	}
+
+	r.log.Debugf("session started client=%s agent=%s", conn.RemoteAddr(), agent.RemoteAddr())
+	relayCopy(conn, agent)
+	r.log.Debugf("session finished client=%s agent=%s", conn.RemoteAddr(), agent.RemoteAddr())
+}
+
+// relayCopy copies data between a and b until one side is closed, then closes both.
+func relayCopy(a, b net.Conn) {
+	var once sync.Once
+	closeBoth := func() {
+		a.Close()
+		b.Close()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(a, b) //nolint:errcheck // the error is irrelevant, the connections are closed
+		once.Do(closeBoth)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(b, a) //nolint:errcheck // the error is irrelevant, the connections are closed
+		once.Do(closeBoth)
+	}()
+	wg.Wait()
+}
+
+// Close closes idle agent connections and rejects new clients.
+func (r *Relay) Close() error {
+	r.once.Do(func() {
+		close(r.done)
+	})
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/log"
+)
+
+// ErrProxyOverloaded is returned when a request is shed because the proxy is at its concurrency limit.
+var ErrProxyOverloaded = errors.New("proxy overloaded, too many concurrent requests")
+
+// requestLimiter sheds proxy requests above the concurrency limit, before any other processing,
+// so that the process keeps capacity for the API server, which has its own listener and is never shed.
+// A request is active from reading the request until the response is written,
+// for CONNECT requests until the tunnel is closed.
+type requestLimiter struct {
+	limit  int64
+	active atomic.Int64
+	log    log.Logger
+
+	lastLog atomic.Int64
+}
+
+func newRequestLimiter(limit int, log log.Logger) *requestLimiter {
+	return &requestLimiter{
+		limit: int64(limit),
+		log:   log,
+	}
+}
+
+type requestLimiterKey struct{}
+
+func (l *requestLimiter) ModifyRequest(req *http.Request) error {
+	if n := l.active.Add(1); n > l.limit {
+		l.active.Add(-1)
+		l.logShed(req)
+		return ErrProxyOverloaded
+	}
+	*req = *req.WithContext(context.WithValue(req.Context(), requestLimiterKey{}, new(atomic.Bool)))
+	return nil
+}
+
+func (l *requestLimiter) logShed(req *http.Request) {
+	// Log at most once per second.
+	now := time.Now().UnixNano()
+	if last := l.lastLog.Load(); now-last > int64(time.Second) && l.lastLog.CompareAndSwap(last, now) {
+		l.log.Errorf("shedding request from %s: active requests reached the limit=%d", req.RemoteAddr, l.limit)
+	}
+}
+
+// wrapTrace returns a trace that releases active requests and calls the hooks of t if not nil.
+func (l *requestLimiter) wrapTrace(t *martian.ProxyTrace) *martian.ProxyTrace {
+	var wt martian.ProxyTrace
+	if t != nil {
+		wt.ReadRequest = t.ReadRequest
+	}
+	wt.WroteResponse = func(info martian.WroteResponseInfo) {
+		if info.Res != nil && !info.Tunnel {
+			l.release(info.Res.Request)
+		}
+		if t != nil && t.WroteResponse != nil {
+			t.WroteResponse(info)
+		}
+	}
+	wt.ClosedTunnel = func(info martian.ClosedTunnelInfo) {
+		if info.Res != nil {
+			l.release(info.Res.Request)
+		}
+		if t != nil && t.ClosedTunnel != nil {
+			t.ClosedTunnel(info)
+		}
+	}
+	return &wt
+}
+
+func (l *requestLimiter) release(req *http.Request) {
+	if req == nil {
+		return
+	}
+	if released, ok := req.Context().Value(requestLimiterKey{}).(*atomic.Bool); ok && released.CompareAndSwap(false, true) {
+		l.active.Add(-1)
+	}
+}
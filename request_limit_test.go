@@ -0,0 +1,165 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestRequestLimiter(t *testing.T) {
+	l := newRequestLimiter(1, stdlog.Default())
+	trace := l.wrapTrace(nil)
+
+	newRequest := func() *http.Request {
+		return httptest.NewRequest(http.MethodGet, "http://example.com", http.NoBody)
+	}
+	wrote := func(req *http.Request) {
+		trace.WroteResponse(martian.WroteResponseInfo{Res: &http.Response{Request: req}})
+	}
+
+	r1 := newRequest()
+	if err := l.ModifyRequest(r1); err != nil {
+		t.Fatal(err)
+	}
+	r2 := newRequest()
+	if err := l.ModifyRequest(r2); !errors.Is(err, ErrProxyOverloaded) {
+		t.Fatalf("got %v, want %v", err, ErrProxyOverloaded)
+	}
+	// The response to the shed request does not release a slot.
+	wrote(r2)
+	if err := l.ModifyRequest(newRequest()); !errors.Is(err, ErrProxyOverloaded) {
+		t.Fatalf("got %v, want %v", err, ErrProxyOverloaded)
+	}
+
+	wrote(r1)
+	wrote(r1)
+	if n := l.active.Load(); n != 0 {
+		t.Fatalf("active=%d, want 0", n)
+	}
+	if err := l.ModifyRequest(r2); err != nil {
+		t.Fatal(err)
+	}
+
+	// A request that established a tunnel is active until the tunnel is closed.
+	res := &http.Response{Request: r2}
+	trace.WroteResponse(martian.WroteResponseInfo{Res: res, Tunnel: true})
+	if n := l.active.Load(); n != 1 {
+		t.Fatalf("active=%d, want 1", n)
+	}
+	trace.ClosedTunnel(martian.ClosedTunnelInfo{Res: res})
+	if n := l.active.Load(); n != 0 {
+		t.Fatalf("active=%d, want 0", n)
+	}
+}
+
+func TestRequestLimiterConnect(t *testing.T) {
+	origin, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer origin.Close()
+	go func() {
+		for {
+			conn, err := origin.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 1)
+				for {
+					if _, err := conn.Read(buf); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.Address = "localhost:0"
+	cfg.PromRegistry = prometheus.NewRegistry()
+	cfg.ProxyLocalhost = AllowProxyLocalhost
+	cfg.MaxConcurrentRequests = 1
+
+	p, err := NewHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx) //nolint:errcheck // returns on cancel
+
+	addrs, _ := p.Addr()
+
+	connect := func() (net.Conn, int) {
+		t.Helper()
+		conn, err := net.Dial("tcp", addrs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "CONNECT %[1]s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", origin.Addr())
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, res.StatusCode
+	}
+
+	tunnel, code := connect()
+	if code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", code, http.StatusOK)
+	}
+
+	// The open tunnel holds the only slot.
+	conn, code := connect()
+	conn.Close()
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	tunnel.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, code := connect()
+		conn.Close()
+		if code == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got status %d after closing the tunnel, want %d", code, http.StatusOK)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestErrorResponseOverloaded(t *testing.T) {
+	hp := &HTTPProxy{
+		config:  *DefaultHTTPProxyConfig(),
+		log:     stdlog.Default(),
+		metrics: newHTTPProxyMetrics(nil, ""),
+	}
+	res := hp.errorResponse(httptest.NewRequest(http.MethodGet, "http://example.com", http.NoBody), ErrProxyOverloaded)
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got %d, want %d", res.StatusCode, http.StatusServiceUnavailable)
+	}
+	if v := res.Header.Get("Retry-After"); v != "1" {
+		t.Fatalf("Retry-After: got %q, want %q", v, "1")
+	}
+}
@@ -0,0 +1,428 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+type SigningMethod string
+
+const (
+	SigningMethodSigV4 SigningMethod = "sigv4"
+	SigningMethodHMAC  SigningMethod = "hmac"
+)
+
+// SigningRule signs requests to hosts matching Host.
+// For SigV4 Region and Service specify the credential scope, the credentials are set in RequestSigningConfig.
+// For HMAC KeyID and Secret specify the key.
+type SigningRule struct {
+	Host   *regexp.Regexp
+	Method SigningMethod
+
+	Region  string
+	Service string
+
+	KeyID  string
+	Secret string
+}
+
+// ParseSigningRule parses a signing rule in one of the following formats:
+// - <host-regexp>=sigv4:<region>:<service>,
+// - <host-regexp>=hmac:<key-id>:<secret>.
+func ParseSigningRule(val string) (SigningRule, error) {
+	host, spec, ok := strings.Cut(val, "=")
+	if !ok {
+		return SigningRule{}, errors.New("expected <host-regexp>=<method>:<params>")
+	}
+	re, err := regexp.Compile(host)
+	if err != nil {
+		return SigningRule{}, fmt.Errorf("host: %w", err)
+	}
+
+	method, params, _ := strings.Cut(spec, ":")
+	a, b, ok := strings.Cut(params, ":")
+	if !ok || a == "" || b == "" {
+		return SigningRule{}, fmt.Errorf("expected %s:<param>:<param>", method)
+	}
+
+	r := SigningRule{Host: re, Method: SigningMethod(method)}
+	switch r.Method {
+	case SigningMethodSigV4:
+		r.Region, r.Service = a, b
+	case SigningMethodHMAC:
+		r.KeyID, r.Secret = a, b
+	default:
+		return SigningRule{}, fmt.Errorf("unsupported signing method %q, supported methods are: sigv4, hmac", method)
+	}
+
+	return r, nil
+}
+
+func (r SigningRule) String() string {
+	switch r.Method {
+	case SigningMethodSigV4:
+		return r.Host.String() + "=sigv4:" + r.Region + ":" + r.Service
+	case SigningMethodHMAC:
+		return r.Host.String() + "=hmac:" + r.KeyID + ":" + r.Secret
+	default:
+		return ""
+	}
+}
+
+// RedactSigningRule returns a string representation of the rule with the HMAC secret redacted.
+func RedactSigningRule(r SigningRule) string {
+	if r.Method == SigningMethodHMAC {
+		return r.Host.String() + "=hmac:" + r.KeyID + ":xxxxx"
+	}
+	return r.String()
+}
+
+// AWSCredentials are the credentials used for SigV4 signing.
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// ParseAWSCredentials parses <access-key-id>:<secret-access-key>[:<session-token>] string into AWSCredentials.
+func ParseAWSCredentials(val string) (*AWSCredentials, error) {
+	parts := strings.SplitN(val, ":", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return nil, errors.New("expected <access-key-id>:<secret-access-key>[:<session-token>]")
+	}
+	c := &AWSCredentials{AccessKeyID: parts[0], SecretAccessKey: parts[1]}
+	if len(parts) == 3 {
+		c.SessionToken = parts[2]
+	}
+	return c, nil
+}
+
+func RedactAWSCredentials(c *AWSCredentials) string {
+	if c == nil {
+		return ""
+	}
+	return c.AccessKeyID + ":xxxxx"
+}
+
+// RequestSigningConfig configures signing of outbound requests,
+// so that clients behind the proxy do not need the credentials themselves.
+// Only requests visible to the proxy are signed, i.e. plain HTTP and MITMed HTTPS requests.
+type RequestSigningConfig struct {
+	// Rules is the list of signing rules, the first rule matching the request host is applied.
+	Rules []SigningRule
+
+	// AWS are the credentials for SigV4 rules.
+	AWS *AWSCredentials
+
+	// MaxBodySize is the maximum size of a request body that is hashed.
+	// SigV4 requests to S3 with larger bodies are signed with UNSIGNED-PAYLOAD, other requests are rejected.
+	MaxBodySize SizeSuffix
+}
+
+func DefaultRequestSigningConfig() *RequestSigningConfig {
+	return &RequestSigningConfig{
+		MaxBodySize: 10 * Mebi,
+	}
+}
+
+func (c *RequestSigningConfig) Validate() error {
+	if len(c.Rules) == 0 {
+		return errors.New("rules are required")
+	}
+	for _, r := range c.Rules {
+		if r.Method == SigningMethodSigV4 && c.AWS == nil {
+			return errors.New("AWS credentials are required for sigv4 rules")
+		}
+	}
+	if c.MaxBodySize <= 0 {
+		return errors.New("max body size must be positive")
+	}
+	return nil
+}
+
+var errRequestBodyTooLarge = errors.New("request body too large to sign")
+
+func (hp *HTTPProxy) signRequest() RequestModifier {
+	cfg := hp.config.RequestSigning
+
+	return RequestModifierFunc(func(req *http.Request) error {
+		if req.Method == http.MethodConnect {
+			return nil
+		}
+
+		host := NormalizeHost(req.URL.Hostname())
+		for i := range cfg.Rules {
+			r := &cfg.Rules[i]
+			if !r.Host.MatchString(host) {
+				continue
+			}
+
+			body, err := readSigningBody(req, int64(cfg.MaxBodySize))
+			if err != nil {
+				return err
+			}
+
+			now := time.Now().UTC()
+			switch r.Method {
+			case SigningMethodSigV4:
+				err = signSigV4(req, body, cfg.AWS, r.Region, r.Service, now)
+			case SigningMethodHMAC:
+				err = signHMAC(req, body, r.KeyID, r.Secret, now)
+			}
+			if err != nil {
+				return fmt.Errorf("sign request: %w", err)
+			}
+
+			ruleTraceFromContext(req.Context()).add("sign", string(r.Method))
+			return nil
+		}
+
+		return nil
+	})
+}
+
+// readSigningBody reads the request body if it is at most limit bytes and restores it.
+// It returns nil if the body is larger than limit.
+func readSigningBody(req *http.Request, limit int64) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return []byte{}, nil
+	}
+	if req.ContentLength > limit {
+		return nil, nil
+	}
+
+	b, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("read request body: %w", err)
+	}
+	if int64(len(b)) > limit {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(b), req.Body), req.Body}
+		return nil, nil
+	}
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(b))
+
+	return b, nil
+}
+
+const (
+	sigV4Algorithm       = "AWS4-HMAC-SHA256"
+	sigV4UnsignedPayload = "UNSIGNED-PAYLOAD"
+	sigV4TimeFormat      = "20060102T150405Z"
+)
+
+// signSigV4 signs the request with AWS Signature Version 4.
+// If body is nil, the payload is unsigned, which is only supported by S3.
+func signSigV4(req *http.Request, body []byte, creds *AWSCredentials, region, service string, now time.Time) error {
+	s3 := service == "s3"
+
+	var payloadHash string
+	switch {
+	case body != nil:
+		payloadHash = sha256Hex(body)
+	case s3:
+		payloadHash = sigV4UnsignedPayload
+	default:
+		return errRequestBodyTooLarge
+	}
+
+	amzDate := now.Format(sigV4TimeFormat)
+	date := amzDate[:8]
+
+	req.Header.Del("Authorization")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if s3 {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	// Only headers set by the signer and the host are signed, so that headers modified on the way are not a problem.
+	hdrs := map[string]string{
+		"host":       hostHeader(req),
+		"x-amz-date": amzDate,
+	}
+	if s3 {
+		hdrs["x-amz-content-sha256"] = payloadHash
+	}
+	if creds.SessionToken != "" {
+		hdrs["x-amz-security-token"] = creds.SessionToken
+	}
+	names := make([]string, 0, len(hdrs))
+	for k := range hdrs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + strings.TrimSpace(hdrs[k]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if !s3 {
+		path = awsURIEncode(path, false)
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		awsCanonicalQuery(req.URL.RawQuery),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := sigV4Algorithm + "\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", sigV4Algorithm+
+		" Credential="+creds.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+
+		", Signature="+sig)
+
+	return nil
+}
+
+func awsCanonicalQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+
+	type kv struct{ k, v string }
+	var kvs []kv
+	for _, p := range strings.Split(rawQuery, "&") {
+		if p == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(p, "=")
+		// Re-encode with the AWS rules, the query may use a different encoding.
+		if uk, err := url.QueryUnescape(k); err == nil {
+			k = uk
+		}
+		if uv, err := url.QueryUnescape(v); err == nil {
+			v = uv
+		}
+		kvs = append(kvs, kv{awsURIEncode(k, true), awsURIEncode(v, true)})
+	}
+	sort.Slice(kvs, func(i, j int) bool {
+		if kvs[i].k != kvs[j].k {
+			return kvs[i].k < kvs[j].k
+		}
+		return kvs[i].v < kvs[j].v
+	})
+
+	parts := make([]string, len(kvs))
+	for i, e := range kvs {
+		parts[i] = e.k + "=" + e.v
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsURIEncode encodes all bytes except the unreserved characters, '/' is kept unless encodeSlash is set.
+func awsURIEncode(s string, encodeSlash bool) string {
+	const hexUpper = "0123456789ABCDEF"
+
+	var b strings.Builder
+	for i := range len(s) {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexUpper[c>>4])
+			b.WriteByte(hexUpper[c&15])
+		}
+	}
+	return b.String()
+}
+
+// signHMAC signs the request with the HMAC-SHA256 HTTP Signatures scheme (draft-cavage-http-signatures).
+// The signature covers the request target, host, date and digest of the body.
+func signHMAC(req *http.Request, body []byte, keyID, secret string, now time.Time) error {
+	if body == nil {
+		return errRequestBodyTooLarge
+	}
+
+	date := req.Header.Get("Date")
+	if date == "" {
+		date = now.Format(http.TimeFormat)
+		req.Header.Set("Date", date)
+	}
+	sum := sha256.Sum256(body)
+	digest := "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+	req.Header.Set("Digest", digest)
+
+	target := req.URL.EscapedPath()
+	if target == "" {
+		target = "/"
+	}
+	if req.URL.RawQuery != "" {
+		target += "?" + req.URL.RawQuery
+	}
+
+	signingString := strings.Join([]string{
+		"(request-target): " + strings.ToLower(req.Method) + " " + target,
+		"host: " + hostHeader(req),
+		"date: " + date,
+		"digest: " + digest,
+	}, "\n")
+	sig := base64.StdEncoding.EncodeToString(hmacSHA256([]byte(secret), signingString))
+
+	req.Header.Set("Authorization", fmt.Sprintf(`Signature keyId=%q,algorithm="hmac-sha256",headers="(request-target) host date digest",signature=%q`, keyID, sig))
+
+	return nil
+}
+
+func hostHeader(req *http.Request) string {
+	if req.Host != "" {
+		return req.Host
+	}
+	return req.URL.Host
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,163 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestParseSigningRule(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+		err bool
+	}{
+		{in: `.*\.amazonaws\.com=sigv4:us-east-1:s3`, out: `.*\.amazonaws\.com=sigv4:us-east-1:s3`},
+		{in: `api\.example\.com=hmac:key1:secret`, out: `api\.example\.com=hmac:key1:xxxxx`},
+		{in: `example.com=sigv4:us-east-1`, err: true},
+		{in: `example.com=basic:a:b`, err: true},
+		{in: `example.com`, err: true},
+		{in: `(=hmac:a:b`, err: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.in, func(t *testing.T) {
+			r, err := ParseSigningRule(tc.in)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := RedactSigningRule(r); got != tc.out {
+				t.Fatalf("got %q, want %q", got, tc.out)
+			}
+		})
+	}
+}
+
+// The test cases are from the AWS Signature Version 4 test suite.
+func TestSignSigV4(t *testing.T) {
+	creds := &AWSCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{
+			name: "get-vanilla",
+			url:  "http://example.amazonaws.com/",
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+				"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name: "get-vanilla-query-order-key-case",
+			url:  "http://example.amazonaws.com/?Param2=value2&Param1=value1",
+			want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+				"SignedHeaders=host;x-amz-date, Signature=b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.url, http.NoBody)
+			if err := signSigV4(req, []byte{}, creds, "us-east-1", "service", now); err != nil {
+				t.Fatal(err)
+			}
+			if got := req.Header.Get("Authorization"); got != tc.want {
+				t.Fatalf("got  %s\nwant %s", got, tc.want)
+			}
+			if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+				t.Fatalf("got X-Amz-Date %q", got)
+			}
+		})
+	}
+}
+
+func TestSignSigV4UnsignedPayload(t *testing.T) {
+	creds := &AWSCredentials{AccessKeyID: "a", SecretAccessKey: "b"}
+
+	req := httptest.NewRequest(http.MethodPut, "http://bucket.s3.amazonaws.com/key", http.NoBody)
+	if err := signSigV4(req, nil, creds, "us-east-1", "s3", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Header.Get("X-Amz-Content-Sha256"); got != sigV4UnsignedPayload {
+		t.Fatalf("got X-Amz-Content-Sha256 %q", got)
+	}
+
+	req = httptest.NewRequest(http.MethodPut, "http://example.amazonaws.com/", http.NoBody)
+	if err := signSigV4(req, nil, creds, "us-east-1", "service", time.Now()); err != errRequestBodyTooLarge { //nolint:errorlint // sentinel error
+		t.Fatalf("got error %v, want %v", err, errRequestBodyTooLarge)
+	}
+}
+
+func TestSignRequestHMAC(t *testing.T) {
+	r, err := ParseSigningRule(`api\.example\.com=hmac:key1:secret`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultHTTPProxyConfig()
+	cfg.RequestSigning = DefaultRequestSigningConfig()
+	cfg.RequestSigning.Rules = []SigningRule{r}
+	hp, err := newHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://api.example.com/v1/items?a=1", strings.NewReader("hello"))
+	req.Header.Set("Date", "Sun, 30 Aug 2015 12:36:00 GMT")
+	if err := hp.signRequest().ModifyRequest(req); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Fatalf("body not restored: %q", b)
+	}
+
+	const digest = "SHA-256=LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ="
+	if got := req.Header.Get("Digest"); got != digest {
+		t.Fatalf("got Digest %q", got)
+	}
+
+	h := hmac.New(sha256.New, []byte("secret"))
+	h.Write([]byte("(request-target): post /v1/items?a=1\nhost: api.example.com\ndate: Sun, 30 Aug 2015 12:36:00 GMT\ndigest: " + digest))
+	want := `Signature keyId="key1",algorithm="hmac-sha256",headers="(request-target) host date digest",signature="` +
+		base64.StdEncoding.EncodeToString(h.Sum(nil)) + `"`
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Fatalf("got  %s\nwant %s", got, want)
+	}
+
+	other := httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+	if err := hp.signRequest().ModifyRequest(other); err != nil {
+		t.Fatal(err)
+	}
+	if other.Header.Get("Authorization") != "" {
+		t.Fatal("unexpected signature for non-matching host")
+	}
+}
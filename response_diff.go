@@ -0,0 +1,460 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/log"
+)
+
+// ResponseDiffConfig configures response diffing against a reference upstream.
+// Each matching request is also sent to the reference upstream, the client receives the primary response,
+// and differences between the primary and reference responses are recorded as newline delimited JSON.
+// It is intended for validating proxy or backend migrations.
+//
+// Only requests visible to the proxy are diffed, i.e. plain HTTP and MITMed HTTPS requests.
+// Only GET, HEAD and OPTIONS requests without a body are diffed, so that requests with side effects are never duplicated.
+type ResponseDiffConfig struct {
+	// Transport sends requests to the reference upstream.
+	Transport http.RoundTripper
+
+	// Writer is the destination of the diff records.
+	Writer io.Writer
+
+	// Domains limits diffing to requests for matching hosts, if nil all hosts are diffed.
+	Domains Matcher
+
+	// IgnoreHeaders is the list of response headers that are not compared.
+	IgnoreHeaders []string
+
+	// MaxBodySize is the maximum number of bytes of each body that are compared.
+	MaxBodySize SizeSuffix
+
+	// Timeout limits the time to receive the reference response.
+	Timeout time.Duration
+}
+
+func DefaultResponseDiffConfig() *ResponseDiffConfig {
+	return &ResponseDiffConfig{
+		IgnoreHeaders: []string{"Age", "Date", "Expires", "Set-Cookie", "Server-Timing", "Via", "X-Request-Id"},
+		MaxBodySize:   1 * Mebi,
+		Timeout:       30 * time.Second,
+	}
+}
+
+func (c *ResponseDiffConfig) Validate() error {
+	if c.Transport == nil {
+		return errors.New("transport is required")
+	}
+	if c.Writer == nil {
+		return errors.New("writer is required")
+	}
+	if c.MaxBodySize <= 0 {
+		return errors.New("max body size must be positive")
+	}
+	return nil
+}
+
+// ResponseDiffEntry is a single record of differences between the primary and reference responses.
+// Headers map canonical header names to primary and reference values, an empty value means the header is missing.
+type ResponseDiffEntry struct {
+	Time            time.Time            `json:"time"`
+	ID              string               `json:"id"`
+	Method          string               `json:"method"`
+	URL             string               `json:"url"`
+	PrimaryStatus   int                  `json:"primary_status"`
+	ReferenceStatus int                  `json:"reference_status,omitempty"`
+	Headers         map[string][2]string `json:"headers,omitempty"`
+	Body            *ResponseBodyDiff    `json:"body,omitempty"`
+	Error           string               `json:"error,omitempty"`
+}
+
+// ResponseBodyDiff describes differences between the primary and reference response bodies.
+// For JSON bodies JSONPaths lists the paths of differing values, otherwise Offset is the offset of the first differing byte.
+// If Truncated is set, only the first MaxBodySize bytes of the bodies were compared.
+type ResponseBodyDiff struct {
+	PrimarySize     int      `json:"primary_size"`
+	ReferenceSize   int      `json:"reference_size"`
+	PrimarySHA256   string   `json:"primary_sha256"`
+	ReferenceSHA256 string   `json:"reference_sha256"`
+	Truncated       bool     `json:"truncated,omitempty"`
+	Offset          *int     `json:"offset,omitempty"`
+	JSONPaths       []string `json:"json_paths,omitempty"`
+}
+
+// maxResponseDiffJSONPaths limits the number of JSON paths recorded per body.
+const maxResponseDiffJSONPaths = 20
+
+type responseDiff struct {
+	config  ResponseDiffConfig
+	ignore  map[string]bool
+	log     log.Logger
+	metrics *httpProxyMetrics
+
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newResponseDiff(cfg *ResponseDiffConfig, log log.Logger, metrics *httpProxyMetrics) *responseDiff {
+	ignore := make(map[string]bool, len(cfg.IgnoreHeaders))
+	for _, h := range cfg.IgnoreHeaders {
+		ignore[http.CanonicalHeaderKey(h)] = true
+	}
+	return &responseDiff{
+		config:  *cfg,
+		ignore:  ignore,
+		log:     log,
+		metrics: metrics,
+		enc:     json.NewEncoder(cfg.Writer),
+	}
+}
+
+// diffResponse is the captured response of one side.
+type diffResponse struct {
+	status    int
+	header    http.Header
+	body      []byte
+	truncated bool
+	err       error
+}
+
+// diffPending is the reference response of an in-flight request.
+type diffPending struct {
+	done chan struct{}
+	ref  diffResponse
+}
+
+type responseDiffKey struct{}
+
+func (d *responseDiff) match(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return false
+	}
+	if req.URL.Host == "" || (req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0) {
+		return false
+	}
+	return d.config.Domains == nil || matchHost(d.config.Domains, req.URL.Hostname())
+}
+
+// ModifyRequest sends a copy of the request to the reference upstream in the background.
+func (d *responseDiff) ModifyRequest(req *http.Request) error {
+	if !d.match(req) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), d.config.Timeout)
+	ref := req.Clone(ctx)
+	ref.RequestURI = ""
+	ref.Body = http.NoBody
+	ref.Header.Del("Proxy-Authorization")
+
+	p := &diffPending{done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		defer cancel()
+		p.ref = d.roundTrip(ref)
+	}()
+
+	*req = *req.WithContext(context.WithValue(req.Context(), responseDiffKey{}, p))
+
+	return nil
+}
+
+func (d *responseDiff) roundTrip(req *http.Request) diffResponse {
+	res, err := d.config.Transport.RoundTrip(req)
+	if err != nil {
+		return diffResponse{err: err}
+	}
+	defer res.Body.Close()
+
+	dr := diffResponse{
+		status: res.StatusCode,
+		header: res.Header,
+	}
+	dr.body, dr.truncated, dr.err = readDiffBody(res.Body, int64(d.config.MaxBodySize))
+	return dr
+}
+
+func readDiffBody(r io.Reader, limit int64) ([]byte, bool, error) {
+	b, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if int64(len(b)) > limit {
+		return b[:limit], true, nil
+	}
+	return b, false, err
+}
+
+// ModifyResponse captures the primary response body as it is read by the client,
+// the diff is recorded when the body is fully read.
+func (d *responseDiff) ModifyResponse(res *http.Response) error {
+	p, ok := res.Request.Context().Value(responseDiffKey{}).(*diffPending)
+	if !ok {
+		return nil
+	}
+
+	primary := diffResponse{
+		status: res.StatusCode,
+		header: res.Header.Clone(),
+	}
+
+	if res.Body == nil || res.Body == http.NoBody || res.Request.Method == http.MethodHead {
+		go d.record(res.Request, &primary, p)
+		return nil
+	}
+
+	res.Body = &diffBody{
+		ReadCloser: res.Body,
+		limit:      int(d.config.MaxBodySize),
+		done: func(body []byte, truncated bool, err error) {
+			primary.body, primary.truncated, primary.err = body, truncated, err
+			go d.record(res.Request, &primary, p)
+		},
+	}
+
+	return nil
+}
+
+func (d *responseDiff) record(req *http.Request, primary *diffResponse, p *diffPending) {
+	<-p.done
+	ref := &p.ref
+
+	e := ResponseDiffEntry{
+		Time:          time.Now().UTC(),
+		ID:            martian.ContextTraceID(req.Context()),
+		Method:        req.Method,
+		URL:           req.URL.Redacted(),
+		PrimaryStatus: primary.status,
+	}
+
+	switch {
+	case ref.err != nil:
+		e.Error = "reference: " + ref.err.Error()
+	case primary.err != nil:
+		e.Error = "primary: " + primary.err.Error()
+	default:
+		if ref.status != primary.status {
+			e.ReferenceStatus = ref.status
+		}
+		e.Headers = d.diffHeaders(primary.header, ref.header)
+		e.Body = diffBodies(primary, ref)
+	}
+
+	switch {
+	case e.Error != "":
+		d.metrics.responseDiff("error")
+	case e.ReferenceStatus != 0 || len(e.Headers) > 0 || e.Body != nil:
+		d.metrics.responseDiff("mismatch")
+	default:
+		d.metrics.responseDiff("match")
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.enc.Encode(e); err != nil {
+		d.log.Errorf("failed to write response diff: %v", err)
+	}
+}
+
+func (d *responseDiff) diffHeaders(primary, ref http.Header) map[string][2]string {
+	names := make(map[string]struct{})
+	for k := range primary {
+		names[k] = struct{}{}
+	}
+	for k := range ref {
+		names[k] = struct{}{}
+	}
+
+	var m map[string][2]string
+	for k := range names {
+		if d.ignore[k] {
+			continue
+		}
+		// Encoded bodies are compared after decoding.
+		if k == "Content-Length" || k == "Content-Encoding" {
+			continue
+		}
+		pv, rv := strings.Join(primary[k], ", "), strings.Join(ref[k], ", ")
+		if pv == rv {
+			continue
+		}
+		if m == nil {
+			m = make(map[string][2]string)
+		}
+		m[k] = [2]string{pv, rv}
+	}
+	return m
+}
+
+// diffBodies returns nil if the bodies are equal.
+func diffBodies(primary, ref *diffResponse) *ResponseBodyDiff {
+	pb := decodeDiffBody(primary)
+	rb := decodeDiffBody(ref)
+	if bytes.Equal(pb, rb) {
+		return nil
+	}
+
+	ps, rs := sha256.Sum256(pb), sha256.Sum256(rb)
+	bd := &ResponseBodyDiff{
+		PrimarySize:     len(pb),
+		ReferenceSize:   len(rb),
+		PrimarySHA256:   hex.EncodeToString(ps[:]),
+		ReferenceSHA256: hex.EncodeToString(rs[:]),
+		Truncated:       primary.truncated || ref.truncated,
+	}
+
+	if !bd.Truncated && isJSONMediaType(primary.header) && isJSONMediaType(ref.header) {
+		var pv, rv any
+		if json.Unmarshal(pb, &pv) == nil && json.Unmarshal(rb, &rv) == nil {
+			diffJSON(pv, rv, "$", &bd.JSONPaths)
+			if len(bd.JSONPaths) == 0 {
+				// Formatting differences only.
+				return nil
+			}
+			return bd
+		}
+	}
+
+	off := 0
+	for off < len(pb) && off < len(rb) && pb[off] == rb[off] {
+		off++
+	}
+	bd.Offset = &off
+
+	return bd
+}
+
+func decodeDiffBody(dr *diffResponse) []byte {
+	if dr.truncated || !strings.EqualFold(dr.header.Get("Content-Encoding"), "gzip") {
+		return dr.body
+	}
+	b, err := gunzip(dr.body, int64(len(dr.body))*100)
+	if err != nil {
+		return dr.body
+	}
+	return b
+}
+
+func isJSONMediaType(h http.Header) bool {
+	mt, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return mt == "application/json" || strings.HasSuffix(mt, "+json")
+}
+
+// diffJSON appends paths of values that differ between a and b.
+func diffJSON(a, b any, path string, paths *[]string) {
+	if len(*paths) >= maxResponseDiffJSONPaths {
+		return
+	}
+
+	switch av := a.(type) {
+	case map[string]any:
+		bv, ok := b.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(av)+len(bv))
+		for k := range av {
+			keys = append(keys, k)
+		}
+		for k := range bv {
+			if _, ok := av[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			diffJSON(av[k], bv[k], path+"."+k, paths)
+		}
+		return
+	case []any:
+		bv, ok := b.([]any)
+		if !ok {
+			break
+		}
+		for i := range max(len(av), len(bv)) {
+			var x, y any
+			if i < len(av) {
+				x = av[i]
+			}
+			if i < len(bv) {
+				y = bv[i]
+			}
+			diffJSON(x, y, path+"["+strconv.Itoa(i)+"]", paths)
+		}
+		return
+	default:
+		if a == b {
+			return
+		}
+	}
+
+	*paths = append(*paths, path)
+}
+
+// diffBody captures up to limit bytes of the body as it is read,
+// done is called once when the body is read to EOF or closed.
+type diffBody struct {
+	io.ReadCloser
+	limit int
+	done  func(body []byte, truncated bool, err error)
+
+	buf       []byte
+	truncated bool
+	once      sync.Once
+}
+
+func (b *diffBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if room := b.limit - len(b.buf); room < n {
+			b.buf = append(b.buf, p[:max(room, 0)]...)
+			b.truncated = true
+		} else {
+			b.buf = append(b.buf, p[:n]...)
+		}
+	}
+	switch {
+	case errors.Is(err, io.EOF):
+		b.finish(nil)
+	case err != nil:
+		b.finish(err)
+	}
+	return n, err
+}
+
+func (b *diffBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.finish(errors.New("body not fully read"))
+	return err
+}
+
+func (b *diffBody) finish(err error) {
+	b.once.Do(func() {
+		// A truncated body does not need to be read to EOF.
+		if b.truncated {
+			err = nil
+		}
+		b.done(slices.Clip(b.buf), b.truncated, err)
+	})
+}
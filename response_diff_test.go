@@ -0,0 +1,155 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log"
+	"github.com/saucelabs/forwarder/utils/httpx"
+)
+
+type chanWriter chan []byte
+
+func (w chanWriter) Write(p []byte) (int, error) {
+	w <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func TestResponseDiff(t *testing.T) {
+	tests := []struct {
+		name      string
+		primary   string
+		reference string
+		header    http.Header
+		check     func(t *testing.T, e *ResponseDiffEntry)
+	}{
+		{
+			name:      "equal",
+			primary:   `{"a":1}`,
+			reference: `{"a":1}`,
+		},
+		{
+			name:      "json formatting",
+			primary:   `{"a":1,"b":[1,2]}`,
+			reference: "{\n  \"b\": [1, 2],\n  \"a\": 1\n}",
+		},
+		{
+			name:      "json",
+			primary:   `{"a":1,"b":[1,2],"c":"x"}`,
+			reference: `{"a":2,"b":[1],"c":"x","d":true}`,
+			check: func(t *testing.T, e *ResponseDiffEntry) {
+				t.Helper()
+				want := []string{"$.a", "$.b[1]", "$.d"}
+				if e.Body == nil || !reflect.DeepEqual(e.Body.JSONPaths, want) {
+					t.Fatalf("got %+v, want json paths %v", e.Body, want)
+				}
+			},
+		},
+		{
+			name:      "header",
+			primary:   `{}`,
+			reference: `{}`,
+			header:    http.Header{"X-Version": {"2"}, "Date": {"now"}},
+			check: func(t *testing.T, e *ResponseDiffEntry) {
+				t.Helper()
+				want := map[string][2]string{"X-Version": {"", "2"}}
+				if !reflect.DeepEqual(e.Headers, want) {
+					t.Fatalf("got headers %v, want %v", e.Headers, want)
+				}
+				if e.Body != nil {
+					t.Fatalf("unexpected body diff %+v", e.Body)
+				}
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := make(chanWriter, 1)
+
+			cfg := DefaultResponseDiffConfig()
+			cfg.Writer = w
+			cfg.Transport = httpx.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				h := http.Header{"Content-Type": {"application/json"}}
+				for k, v := range tc.header {
+					h[k] = v
+				}
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     h,
+					Body:       io.NopCloser(strings.NewReader(tc.reference)),
+					Request:    req,
+				}, nil
+			})
+			d := newResponseDiff(cfg, log.NopLogger, newHTTPProxyMetrics(nil, "test"))
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/api", http.NoBody)
+			if err := d.ModifyRequest(req); err != nil {
+				t.Fatal(err)
+			}
+			res := &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": {"application/json"}},
+				Body:       io.NopCloser(strings.NewReader(tc.primary)),
+				Request:    req,
+			}
+			if err := d.ModifyResponse(res); err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tc.primary {
+				t.Fatalf("got body %q, want primary body", b)
+			}
+			res.Body.Close()
+
+			select {
+			case line := <-w:
+				if tc.check == nil {
+					t.Fatalf("unexpected diff: %s", line)
+				}
+				var e ResponseDiffEntry
+				if err := json.Unmarshal(line, &e); err != nil {
+					t.Fatal(err)
+				}
+				tc.check(t, &e)
+			case <-time.After(200 * time.Millisecond):
+				if tc.check != nil {
+					t.Fatal("diff not recorded")
+				}
+			}
+		})
+	}
+}
+
+func TestResponseDiffSkipsUnsafeMethods(t *testing.T) {
+	cfg := DefaultResponseDiffConfig()
+	cfg.Writer = io.Discard
+	cfg.Transport = httpx.RoundTripperFunc(func(*http.Request) (*http.Response, error) {
+		t.Fatal("unexpected reference request")
+		return nil, nil //nolint:nilnil // unreachable
+	})
+	d := newResponseDiff(cfg, log.NopLogger, newHTTPProxyMetrics(nil, "test"))
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/api", strings.NewReader("x"))
+	if err := d.ModifyRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Context().Value(responseDiffKey{}) != nil {
+		t.Fatal("request should not be diffed")
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/saucelabs/forwarder/dialvia"
+	"github.com/saucelabs/forwarder/log"
+)
+
+type ReverseListenerConfig struct {
+	// RelayURL is the ws or wss URL of the relay agent endpoint, see Relay.
+	// Basic auth credentials can be specified in the URL.
+	RelayURL *url.URL
+
+	// Conns is the number of idle connections kept open to the relay.
+	// It limits the number of sessions the relay can start at the same time.
+	Conns int
+
+	// RetryInterval is the time to wait before reconnecting to the relay after a failure.
+	RetryInterval time.Duration
+
+	// DialTimeout limits the time to connect to the relay.
+	DialTimeout time.Duration
+}
+
+func DefaultReverseListenerConfig() *ReverseListenerConfig {
+	return &ReverseListenerConfig{
+		Conns:         4,
+		RetryInterval: 5 * time.Second,
+		DialTimeout:   30 * time.Second,
+	}
+}
+
+func (c *ReverseListenerConfig) Validate() error {
+	if c.RelayURL == nil {
+		return nil
+	}
+	if c.RelayURL.Scheme != "ws" && c.RelayURL.Scheme != "wss" {
+		return errors.New("relay URL scheme must be ws or wss")
+	}
+	if c.Conns <= 0 {
+		return errors.New("number of connections must be positive")
+	}
+	return nil
+}
+
+// ReverseListener is a net.Listener that accepts proxy sessions over connections it dials to a relay.
+// It allows to serve the proxy in networks that do not accept inbound connections, such as NAT'd lab networks.
+// The listener keeps a pool of idle WebSocket connections to the relay,
+// a connection is returned from Accept when the relay starts a session on it i.e. sends the first bytes of a client,
+// and it is replaced with a new connection to keep the pool full.
+type ReverseListener struct {
+	config ReverseListenerConfig
+	dialer *dialvia.WebSocketDialer
+	log    log.Logger
+
+	conns  chan net.Conn
+	ctx    context.Context //nolint:containedctx // it is cancelled on Close
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewReverseListener starts connecting to the relay, it is the caller's responsibility to call Close.
+func NewReverseListener(cfg *ReverseListenerConfig, tlsCfg *tls.Config, log log.Logger) (*ReverseListener, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.RelayURL == nil {
+		return nil, errors.New("relay URL is required")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rl := &ReverseListener{
+		config: *cfg,
+		dialer: dialvia.WebSocket((&net.Dialer{}).DialContext, cfg.RelayURL, tlsCfg),
+		log:    log,
+		conns:  make(chan net.Conn),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	rl.dialer.Timeout = cfg.DialTimeout
+
+	rl.log.Infof("connecting to relay url=%s conns=%d", cfg.RelayURL.Redacted(), cfg.Conns)
+	for range cfg.Conns {
+		rl.wg.Add(1)
+		go rl.worker()
+	}
+
+	return rl, nil
+}
+
+func (rl *ReverseListener) worker() {
+	defer rl.wg.Done()
+
+	for rl.ctx.Err() == nil {
+		conn, err := rl.dialer.DialContext(rl.ctx, "tcp", "")
+		if err != nil {
+			if rl.ctx.Err() == nil {
+				rl.log.Errorf("failed to connect to relay error=%s", err)
+				rl.sleep()
+			}
+			continue
+		}
+
+		c, err := rl.waitSession(conn)
+		if err != nil {
+			if rl.ctx.Err() == nil {
+				rl.log.Debugf("relay connection closed before session start error=%s", err)
+			}
+			continue
+		}
+
+		select {
+		case rl.conns <- c:
+		case <-rl.ctx.Done():
+			c.Close()
+		}
+	}
+}
+
+// waitSession blocks until the relay sends the first bytes of a session on conn.
+func (rl *ReverseListener) waitSession(conn net.Conn) (net.Conn, error) {
+	stop := context.AfterFunc(rl.ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	br := bufio.NewReader(conn)
+	if _, err := br.Peek(1); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &reverseConn{Conn: conn, r: br}, nil
+}
+
+func (rl *ReverseListener) sleep() {
+	t := time.NewTimer(rl.config.RetryInterval)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-rl.ctx.Done():
+	}
+}
+
+func (rl *ReverseListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-rl.conns:
+		return c, nil
+	case <-rl.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the idle connections to the relay, sessions in progress are not affected.
+func (rl *ReverseListener) Close() error {
+	rl.cancel()
+	rl.wg.Wait()
+	return nil
+}
+
+func (rl *ReverseListener) Addr() net.Addr {
+	return memAddr("reverse")
+}
+
+// reverseConn is a relay connection with the buffered first bytes of a session.
+type reverseConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *reverseConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,88 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/saucelabs/forwarder/log"
+)
+
+func TestReverseListener(t *testing.T) {
+	relay := NewRelay(log.NopLogger)
+	defer relay.Close()
+
+	s := httptest.NewServer(relay)
+	defer s.Close()
+
+	cl, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	go relay.Serve(cl)
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultReverseListenerConfig()
+	cfg.RelayURL = &url.URL{Scheme: "ws", Host: u.Host, Path: RelayAgentPath}
+	cfg.Conns = 2
+
+	rl, err := NewReverseListener(cfg, nil, log.NopLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := Listener{
+		ListenerConfig: ListenerConfig{
+			Listener: rl,
+		},
+		PromConfig: PromConfig{
+			PromRegistry: prometheus.NewRegistry(),
+		},
+	}
+	if err := l.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go l.acceptAndCopy()
+
+	// Run more sessions than connections to check that the pool is refilled.
+	for i := range 5 {
+		conn, err := net.Dial("tcp", cl.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := fmt.Sprintf("Hello, World %d!\n", i)
+		fmt.Fprint(conn, want)
+		buf := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf); got != want {
+			t.Fatalf("conn.Read(): got %q, want %q", got, want)
+		}
+		conn.Close()
+	}
+}
+
+func TestReverseListenerConfigValidate(t *testing.T) {
+	cfg := DefaultReverseListenerConfig()
+	cfg.RelayURL = &url.URL{Scheme: "http", Host: "relay"}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected error")
+	}
+}
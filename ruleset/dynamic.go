@@ -0,0 +1,33 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package ruleset
+
+import (
+	"sync/atomic"
+)
+
+// DynamicMatcher delegates to a RegexpMatcher that can be replaced at runtime.
+// It does not match anything if the matcher is nil.
+type DynamicMatcher struct {
+	m atomic.Pointer[RegexpMatcher]
+}
+
+func NewDynamicMatcher(m *RegexpMatcher) *DynamicMatcher {
+	dm := new(DynamicMatcher)
+	dm.m.Store(m)
+	return dm
+}
+
+// Store replaces the matcher, it is safe to call concurrently with Match.
+func (dm *DynamicMatcher) Store(m *RegexpMatcher) {
+	dm.m.Store(m)
+}
+
+func (dm *DynamicMatcher) Match(s string) bool {
+	m := dm.m.Load()
+	return m != nil && m.Match(s)
+}
@@ -0,0 +1,36 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package ruleset
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestDynamicMatcher(t *testing.T) {
+	dm := NewDynamicMatcher(nil)
+	if dm.Match("foo") {
+		t.Fatal("expected no match with nil matcher")
+	}
+
+	m, err := NewRegexpMatcher([]*regexp.Regexp{regexp.MustCompile("^foo$")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm.Store(m)
+	if !dm.Match("foo") {
+		t.Fatal("expected match after Store")
+	}
+	if dm.Match("bar") {
+		t.Fatal("expected no match")
+	}
+
+	dm.Store(nil)
+	if dm.Match("foo") {
+		t.Fatal("expected no match after Store(nil)")
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package ruleset
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a cron-like specification of time periods.
+// It consists of five space separated fields: minute, hour, day of month, month and day of week,
+// and is active during every minute matching all the fields.
+// For example, "* 9-16 * * mon-fri" is active during business hours.
+//
+// Each field is a comma separated list of values, ranges <min>-<max> or '*',
+// optionally followed by /<step>.
+// Months and days of week can be specified by their three letter English names,
+// Sunday is 0 or 7.
+// As in cron, if both day of month and day of week are restricted, either of them must match.
+//
+// The specification can be prefixed with TZ=<timezone> to evaluate it in the given IANA timezone,
+// by default the local timezone is used.
+type Schedule struct {
+	spec   string
+	loc    *time.Location
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	star   bool // day of month or day of week is '*'
+}
+
+type scheduleField struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var scheduleFields = [...]scheduleField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{name: "day of week", min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+func ParseSchedule(val string) (*Schedule, error) {
+	s := &Schedule{
+		spec: val,
+		loc:  time.Local,
+	}
+
+	spec := strings.TrimSpace(val)
+	if tz, ok := strings.CutPrefix(spec, "TZ="); ok {
+		tz, spec, _ = strings.Cut(tz, " ")
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, fmt.Errorf("timezone: %w", err)
+		}
+		s.loc = loc
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != len(scheduleFields) {
+		return nil, errors.New("expected 5 fields: minute, hour, day of month, month and day of week")
+	}
+
+	bits := [...]*uint64{&s.minute, &s.hour, &s.dom, &s.month, &s.dow}
+	for i, f := range scheduleFields {
+		b, err := f.parse(fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.name, err)
+		}
+		*bits[i] = b
+	}
+
+	// Sunday can be specified as 0 or 7.
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.star = fields[2] == "*" || fields[4] == "*"
+
+	return s, nil
+}
+
+func (f scheduleField) parse(val string) (uint64, error) {
+	var bits uint64
+	for _, r := range strings.Split(val, ",") {
+		r, stepStr, hasStep := strings.Cut(r, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepStr)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+		}
+
+		lo, hi := f.min, f.max
+		if r != "*" {
+			loStr, hiStr, isRange := strings.Cut(r, "-")
+			var err error
+			if lo, err = f.value(loStr); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = f.value(hiStr); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				hi = f.max
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid range %q", r)
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+
+	return bits, nil
+}
+
+func (f scheduleField) value(val string) (int, error) {
+	for i, n := range f.names {
+		if strings.EqualFold(val, n) {
+			return f.min + i, nil
+		}
+	}
+	v, err := strconv.Atoi(val)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid value %q, expected number in range [%d, %d]", val, f.min, f.max)
+	}
+	return v, nil
+}
+
+// Active returns true if t is within the schedule.
+func (s *Schedule) Active(t time.Time) bool {
+	t = t.In(s.loc)
+
+	if s.minute&(1<<t.Minute()) == 0 || s.hour&(1<<t.Hour()) == 0 || s.month&(1<<t.Month()) == 0 {
+		return false
+	}
+
+	dom := s.dom&(1<<t.Day()) != 0
+	dow := s.dow&(1<<t.Weekday()) != 0
+	if s.star {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+func (s *Schedule) String() string {
+	if s == nil {
+		return ""
+	}
+	return s.spec
+}
+
+type matcher interface {
+	Match(string) bool
+}
+
+// ScheduledMatcher matches only when the schedule is active.
+// The schedule applies to all the rules of the wrapped matcher.
+type ScheduledMatcher struct {
+	m   matcher
+	s   *Schedule
+	now func() time.Time
+}
+
+func NewScheduledMatcher(m matcher, s *Schedule) *ScheduledMatcher {
+	return &ScheduledMatcher{
+		m:   m,
+		s:   s,
+		now: time.Now,
+	}
+}
+
+func (sm *ScheduledMatcher) Match(s string) bool {
+	return sm.s.Active(sm.now()) && sm.m.Match(s)
+}
@@ -0,0 +1,129 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package ruleset
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	// 2024-01-15 is Monday.
+	at := func(s string) time.Time {
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	tests := []struct {
+		spec     string
+		active   []string
+		inactive []string
+	}{
+		{
+			spec:   "* * * * *",
+			active: []string{"2024-01-15T00:00:00Z", "2024-12-31T23:59:00Z"},
+		},
+		{
+			spec:     "TZ=UTC * 9-16 * * mon-fri",
+			active:   []string{"2024-01-15T09:00:00Z", "2024-01-19T16:59:00Z"},
+			inactive: []string{"2024-01-15T08:59:00Z", "2024-01-15T17:00:00Z", "2024-01-20T12:00:00Z"},
+		},
+		{
+			spec:     "TZ=Europe/Berlin * 9-16 * * 1-5",
+			active:   []string{"2024-01-15T08:00:00Z"},
+			inactive: []string{"2024-01-15T16:00:00Z"},
+		},
+		{
+			spec:     "TZ=UTC */15 * * * *",
+			active:   []string{"2024-01-15T10:00:00Z", "2024-01-15T10:45:00Z"},
+			inactive: []string{"2024-01-15T10:01:00Z"},
+		},
+		{
+			spec:     "TZ=UTC 0,30 2 * * sun",
+			active:   []string{"2024-01-14T02:30:00Z"},
+			inactive: []string{"2024-01-15T02:30:00Z", "2024-01-14T02:15:00Z"},
+		},
+		{
+			spec:     "TZ=UTC * * 1 * 7",
+			active:   []string{"2024-02-01T12:00:00Z", "2024-01-14T12:00:00Z"},
+			inactive: []string{"2024-01-15T12:00:00Z"},
+		},
+		{
+			spec:     "TZ=UTC * * * dec *",
+			active:   []string{"2024-12-01T12:00:00Z"},
+			inactive: []string{"2024-11-30T12:00:00Z"},
+		},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.spec, func(t *testing.T) {
+			s, err := ParseSchedule(tc.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, v := range tc.active {
+				if !s.Active(at(v)) {
+					t.Errorf("expected %s to be active", v)
+				}
+			}
+			for _, v := range tc.inactive {
+				if s.Active(at(v)) {
+					t.Errorf("expected %s to be inactive", v)
+				}
+			}
+		})
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 5-1 * * *",
+		"* * 0 * *",
+		"*/0 * * * *",
+		"* * * foo *",
+		"TZ=Foo/Bar * * * * *",
+	}
+
+	for _, spec := range tests {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Errorf("expected error for %q", spec)
+		}
+	}
+}
+
+func TestScheduledMatcher(t *testing.T) {
+	s, err := ParseSchedule("TZ=UTC * 9-16 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRegexpMatcher([]*regexp.Regexp{regexp.MustCompile("foo")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewScheduledMatcher(r, s)
+	m.now = func() time.Time { return time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC) }
+	if !m.Match("foo") {
+		t.Error("expected match within schedule")
+	}
+	if m.Match("bar") {
+		t.Error("expected no match for bar")
+	}
+
+	m.now = func() time.Time { return time.Date(2024, 1, 15, 20, 0, 0, 0, time.UTC) }
+	if m.Match("foo") {
+		t.Error("expected no match outside of schedule")
+	}
+}
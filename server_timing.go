@@ -0,0 +1,60 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+)
+
+// serverTiming appends a Server-Timing header with the proxy-side phases of the request to responses.
+// The phases are queue, dns, connect, tls, upstream (time to first response byte) and total,
+// phases that did not happen are omitted, see RequestTiming.
+// CONNECT responses are not modified.
+//
+// See https://www.w3.org/TR/server-timing/
+func serverTiming() ResponseModifier {
+	return ResponseModifierFunc(func(res *http.Response) error {
+		if res.Request.Method == http.MethodConnect {
+			return nil
+		}
+
+		ctx := res.Request.Context()
+
+		var sb strings.Builder
+		add := func(name string, d time.Duration) {
+			if d <= 0 {
+				return
+			}
+			if sb.Len() > 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString(name)
+			sb.WriteString(";dur=")
+			sb.WriteString(strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64))
+		}
+
+		if t, ok := ContextRequestTiming(ctx); ok {
+			add("queue", t.Queue)
+			add("dns", t.DNS)
+			add("connect", t.Connect)
+			add("tls", t.TLS)
+			add("upstream", t.TTFB)
+		}
+		add("total", martian.ContextDuration(ctx))
+
+		if sb.Len() > 0 {
+			res.Header.Add("Server-Timing", sb.String())
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,44 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestServerTiming(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer origin.Close()
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.ProxyLocalhost = AllowProxyLocalhost
+	cfg.ServerTiming = true
+
+	tr, err := NewClientTransport(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	res, err := (&http.Client{Transport: tr}).Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	got := res.Header.Get("Server-Timing")
+	for _, name := range []string{"connect", "upstream", "total"} {
+		if !regexp.MustCompile(`(^|, )` + name + `;dur=\d+\.\d{3}(,|$)`).MatchString(got) {
+			t.Errorf("expected %s in Server-Timing, got %q", name, got)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/saucelabs/forwarder/internal/martian"
+)
+
+// SLOConfig configures tracking of the proxy service level objectives.
+// A request counts against the availability objective if the proxy fails it with a 5xx error response,
+// and against the latency objective if the response is written later than Latency after the request was read.
+// For CONNECT requests the latency is the time to establish the tunnel.
+type SLOConfig struct {
+	// Availability is the target ratio of requests that are not failed by the proxy, for example 0.999.
+	Availability float64
+
+	// Latency is the threshold of the latency objective, zero disables the latency objective.
+	Latency time.Duration
+
+	// LatencyTarget is the target ratio of requests served within Latency, for example 0.99.
+	LatencyTarget float64
+
+	// Windows are the sliding windows over which the burn rates are computed.
+	Windows []time.Duration
+}
+
+func DefaultSLOConfig() *SLOConfig {
+	return &SLOConfig{
+		Availability:  0.999,
+		LatencyTarget: 0.99,
+		Windows:       []time.Duration{5 * time.Minute, time.Hour, 6 * time.Hour},
+	}
+}
+
+// sloBucketWidth is the resolution of the sliding windows.
+const sloBucketWidth = 10 * time.Second
+
+func (c *SLOConfig) Validate() error {
+	if c.Availability <= 0 || c.Availability >= 1 {
+		return errors.New("availability must be between 0 and 1")
+	}
+	if c.Latency < 0 {
+		return errors.New("latency must be non-negative")
+	}
+	if c.Latency > 0 && (c.LatencyTarget <= 0 || c.LatencyTarget >= 1) {
+		return errors.New("latency target must be between 0 and 1")
+	}
+	if len(c.Windows) == 0 {
+		return errors.New("at least one window is required")
+	}
+	for _, w := range c.Windows {
+		if w < sloBucketWidth {
+			return errors.New("windows must be at least " + sloBucketWidth.String())
+		}
+	}
+	return nil
+}
+
+const (
+	sloAvailability = "availability"
+	sloLatency      = "latency"
+)
+
+type sloBucket struct {
+	idx   int64
+	total int64
+	bad   [2]int64 // availability, latency
+}
+
+// sloTracker counts good and bad requests in fixed width buckets,
+// and computes the burn rates over sliding windows on demand.
+// The burn rate is the ratio of bad requests divided by the ratio allowed by the objective,
+// a burn rate of 1 consumes exactly the error budget over the window.
+type sloTracker struct {
+	config SLOConfig
+	now    func() time.Time
+
+	mu       sync.Mutex
+	buckets  []sloBucket
+	inflight map[*http.Request]time.Time
+}
+
+func newSLOTracker(cfg *SLOConfig, r prometheus.Registerer, namespace string) *sloTracker {
+	t := &sloTracker{
+		config:   *cfg,
+		now:      time.Now,
+		buckets:  make([]sloBucket, slices.Max(cfg.Windows)/sloBucketWidth+1),
+		inflight: make(map[*http.Request]time.Time),
+	}
+	t.config.Windows = slices.Clone(cfg.Windows)
+	slices.Sort(t.config.Windows)
+
+	if r != nil {
+		r.MustRegister(newSLOCollector(namespace, t))
+	}
+
+	return t
+}
+
+// wrapTrace returns a trace that records the request outcomes and calls the hooks of t if not nil.
+func (t *sloTracker) wrapTrace(pt *martian.ProxyTrace) *martian.ProxyTrace {
+	var wt martian.ProxyTrace
+	wt.ReadRequest = func(info martian.ReadRequestInfo) {
+		if info.Req != nil {
+			t.readRequest(info.Req)
+		}
+		if pt != nil && pt.ReadRequest != nil {
+			pt.ReadRequest(info)
+		}
+	}
+	wt.WroteResponse = func(info martian.WroteResponseInfo) {
+		if info.Res != nil {
+			t.wroteResponse(info.Res, info.Err)
+		}
+		if pt != nil && pt.WroteResponse != nil {
+			pt.WroteResponse(info)
+		}
+	}
+	if pt != nil {
+		wt.ClosedTunnel = pt.ClosedTunnel
+	}
+	return &wt
+}
+
+func (t *sloTracker) readRequest(req *http.Request) {
+	now := t.now()
+
+	t.mu.Lock()
+	t.inflight[req] = now
+	t.mu.Unlock()
+}
+
+func (t *sloTracker) wroteResponse(res *http.Response, err error) {
+	if res.Request == nil {
+		return
+	}
+	now := t.now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	start, ok := t.inflight[res.Request]
+	delete(t.inflight, res.Request)
+	// Requests that the client abandoned are not attributed to the proxy.
+	if !ok || err != nil {
+		return
+	}
+
+	b := t.bucketLocked(now)
+	b.total++
+	if res.StatusCode >= http.StatusInternalServerError && res.Header.Get(ErrorHeader) != "" {
+		b.bad[0]++
+	}
+	if t.config.Latency > 0 && now.Sub(start) > t.config.Latency {
+		b.bad[1]++
+	}
+}
+
+func (t *sloTracker) bucketLocked(now time.Time) *sloBucket {
+	idx := now.UnixNano() / int64(sloBucketWidth)
+	b := &t.buckets[idx%int64(len(t.buckets))]
+	if b.idx != idx {
+		*b = sloBucket{idx: idx}
+	}
+	return b
+}
+
+// sumLocked returns the number of all and bad requests in the window ending now.
+func (t *sloTracker) sumLocked(now time.Time, window time.Duration) (total int64, bad [2]int64) {
+	cur := now.UnixNano() / int64(sloBucketWidth)
+	n := int64(window / sloBucketWidth)
+	for i := range n {
+		idx := cur - i
+		b := &t.buckets[idx%int64(len(t.buckets))]
+		if b.idx != idx {
+			continue
+		}
+		total += b.total
+		bad[0] += b.bad[0]
+		bad[1] += b.bad[1]
+	}
+	return
+}
+
+// SLOSummary is the state of the service level objectives.
+type SLOSummary struct {
+	Objectives []SLOObjectiveSummary `json:"objectives"`
+}
+
+type SLOObjectiveSummary struct {
+	Objective string             `json:"objective"`
+	Target    float64            `json:"target"`
+	Latency   string             `json:"latency,omitempty"`
+	Windows   []SLOWindowSummary `json:"windows"`
+}
+
+type SLOWindowSummary struct {
+	Window     string  `json:"window"`
+	Requests   int64   `json:"requests"`
+	Bad        int64   `json:"bad"`
+	ErrorRatio float64 `json:"error_ratio"`
+	BurnRate   float64 `json:"burn_rate"`
+}
+
+// Summary returns the burn rates of the objectives over the configured windows.
+func (t *sloTracker) Summary() SLOSummary {
+	now := t.now()
+
+	avail := SLOObjectiveSummary{
+		Objective: sloAvailability,
+		Target:    t.config.Availability,
+	}
+	lat := SLOObjectiveSummary{
+		Objective: sloLatency,
+		Target:    t.config.LatencyTarget,
+		Latency:   t.config.Latency.String(),
+	}
+
+	t.mu.Lock()
+	for _, w := range t.config.Windows {
+		total, bad := t.sumLocked(now, w)
+		avail.Windows = append(avail.Windows, sloWindowSummary(w, total, bad[0], t.config.Availability))
+		lat.Windows = append(lat.Windows, sloWindowSummary(w, total, bad[1], t.config.LatencyTarget))
+	}
+	t.mu.Unlock()
+
+	s := SLOSummary{
+		Objectives: []SLOObjectiveSummary{avail},
+	}
+	if t.config.Latency > 0 {
+		s.Objectives = append(s.Objectives, lat)
+	}
+	return s
+}
+
+func sloWindowSummary(window time.Duration, total, bad int64, target float64) SLOWindowSummary {
+	s := SLOWindowSummary{
+		Window:   window.String(),
+		Requests: total,
+		Bad:      bad,
+	}
+	if total > 0 {
+		s.ErrorRatio = float64(bad) / float64(total)
+		s.BurnRate = s.ErrorRatio / (1 - target)
+	}
+	return s
+}
+
+func (t *sloTracker) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.Summary()) //nolint:errcheck // ignore error
+}
+
+// sloCollector exposes the burn rates computed at scrape time.
+type sloCollector struct {
+	burnRate *prometheus.Desc
+	requests *prometheus.Desc
+	t        *sloTracker
+}
+
+func newSLOCollector(namespace string, t *sloTracker) *sloCollector {
+	return &sloCollector{
+		burnRate: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "slo_burn_rate"),
+			"Error budget burn rate of the service level objective over the sliding window, 1 means the budget is consumed exactly over the window",
+			[]string{"objective", "window"}, nil,
+		),
+		requests: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "slo_window_requests"),
+			"Number of requests in the sliding window by service level objective and result",
+			[]string{"objective", "window", "result"}, nil,
+		),
+		t: t,
+	}
+}
+
+func (c *sloCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.burnRate
+	ch <- c.requests
+}
+
+func (c *sloCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, o := range c.t.Summary().Objectives {
+		for _, w := range o.Windows {
+			ch <- prometheus.MustNewConstMetric(c.burnRate, prometheus.GaugeValue, w.BurnRate, o.Objective, w.Window)
+			ch <- prometheus.MustNewConstMetric(c.requests, prometheus.GaugeValue, float64(w.Requests-w.Bad), o.Objective, w.Window, "good")
+			ch <- prometheus.MustNewConstMetric(c.requests, prometheus.GaugeValue, float64(w.Bad), o.Objective, w.Window, "bad")
+		}
+	}
+}
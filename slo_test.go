@@ -0,0 +1,158 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSLOTracker(t *testing.T) {
+	cfg := DefaultSLOConfig()
+	cfg.Latency = time.Second
+	cfg.Windows = []time.Duration{time.Hour, 5 * time.Minute}
+
+	r := prometheus.NewRegistry()
+	st := newSLOTracker(cfg, r, "")
+
+	now := time.Unix(1_700_000_000, 0)
+	st.now = func() time.Time { return now }
+
+	request := func(status int, proxyErr bool, d time.Duration, writeErr error) {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com", http.NoBody)
+		res := &http.Response{
+			StatusCode: status,
+			Header:     make(http.Header),
+			Request:    req,
+		}
+		if proxyErr {
+			res.Header.Set(ErrorHeader, "forwarder error")
+		}
+
+		st.readRequest(req)
+		now = now.Add(d)
+		st.wroteResponse(res, writeErr)
+	}
+
+	// Requests older than 5 minutes only count in the 1h window.
+	for range 8 {
+		request(http.StatusOK, false, 0, nil)
+	}
+	request(http.StatusBadGateway, true, 0, nil)
+	request(http.StatusOK, false, 2*time.Second, nil)
+	now = now.Add(10 * time.Minute)
+
+	request(http.StatusOK, false, 0, nil)
+	// Upstream errors and abandoned requests are not attributed to the proxy.
+	request(http.StatusInternalServerError, false, 0, nil)
+	request(http.StatusOK, false, 0, errors.New("broken pipe"))
+	request(http.StatusServiceUnavailable, true, 0, nil)
+
+	s := st.Summary()
+	if len(s.Objectives) != 2 {
+		t.Fatalf("objectives: got %d, want 2", len(s.Objectives))
+	}
+
+	tests := []struct {
+		objective string
+		window    string
+		requests  int64
+		bad       int64
+		burnRate  float64
+	}{
+		{sloAvailability, "5m0s", 3, 1, (1.0 / 3) / 0.001},
+		{sloAvailability, "1h0m0s", 13, 2, (2.0 / 13) / 0.001},
+		{sloLatency, "5m0s", 3, 0, 0},
+		{sloLatency, "1h0m0s", 13, 1, (1.0 / 13) / 0.01},
+	}
+	for i, o := range s.Objectives {
+		for j, w := range o.Windows {
+			tc := tests[i*2+j]
+			if o.Objective != tc.objective || w.Window != tc.window {
+				t.Fatalf("got %s %s, want %s %s", o.Objective, w.Window, tc.objective, tc.window)
+			}
+			if w.Requests != tc.requests || w.Bad != tc.bad {
+				t.Errorf("%s %s: got %d/%d bad requests, want %d/%d", o.Objective, w.Window, w.Bad, w.Requests, tc.bad, tc.requests)
+			}
+			if math.Abs(w.BurnRate-tc.burnRate) > 1e-9 {
+				t.Errorf("%s %s: got burn rate %v, want %v", o.Objective, w.Window, w.BurnRate, tc.burnRate)
+			}
+		}
+	}
+
+	mfs, err := r.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != "slo_burn_rate" {
+			continue
+		}
+		if n := len(mf.GetMetric()); n != 4 {
+			t.Fatalf("slo_burn_rate: got %d metrics, want 4", n)
+		}
+		return
+	}
+	t.Fatal("metric not found")
+}
+
+func TestSLOTrackerWindowExpiry(t *testing.T) {
+	cfg := DefaultSLOConfig()
+	cfg.Windows = []time.Duration{time.Minute}
+
+	st := newSLOTracker(cfg, nil, "")
+	now := time.Unix(1_700_000_000, 0)
+	st.now = func() time.Time { return now }
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", http.NoBody)
+	st.readRequest(req)
+	st.wroteResponse(&http.Response{StatusCode: http.StatusBadGateway, Header: http.Header{ErrorHeader: {"x"}}, Request: req}, nil)
+
+	if w := st.Summary().Objectives[0].Windows[0]; w.Requests != 1 || w.Bad != 1 {
+		t.Fatalf("got %d/%d bad requests, want 1/1", w.Bad, w.Requests)
+	}
+
+	// The request falls out of the window, its bucket slot is shared with the current time.
+	now = now.Add(time.Minute + sloBucketWidth)
+	if w := st.Summary().Objectives[0].Windows[0]; w.Requests != 0 || w.BurnRate != 0 {
+		t.Fatalf("got %d requests burn rate %v, want 0", w.Requests, w.BurnRate)
+	}
+}
+
+func TestSLOConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*SLOConfig)
+	}{
+		{"availability 1", func(c *SLOConfig) { c.Availability = 1 }},
+		{"availability 0", func(c *SLOConfig) { c.Availability = 0 }},
+		{"negative latency", func(c *SLOConfig) { c.Latency = -time.Second }},
+		{"latency target", func(c *SLOConfig) { c.Latency = time.Second; c.LatencyTarget = 1.5 }},
+		{"no windows", func(c *SLOConfig) { c.Windows = nil }},
+		{"short window", func(c *SLOConfig) { c.Windows = []time.Duration{time.Second} }},
+	}
+
+	if err := DefaultSLOConfig().Validate(); err != nil {
+		t.Fatalf("default config: %v", err)
+	}
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultSLOConfig()
+			tc.modify(cfg)
+			if err := cfg.Validate(); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/log"
+)
+
+// slowRequestStackLines is the maximum number of stack trace lines logged for a slow request.
+const slowRequestStackLines = 40
+
+// slowRequestWatchdog logs requests that are in-flight longer than the threshold.
+// A request is in-flight from reading the request until the response is written,
+// for CONNECT requests until the tunnel is established.
+// The log includes the stack of the goroutine handling the request,
+// which shows where it is blocked in the modifier chain or transport.
+type slowRequestWatchdog struct {
+	threshold time.Duration
+	log       log.Logger
+
+	mu       sync.Mutex
+	inflight map[*http.Request]*slowRequestEntry
+}
+
+type slowRequestEntry struct {
+	start     time.Time
+	goroutine uint64
+	reported  bool
+}
+
+func newSlowRequestWatchdog(threshold time.Duration, log log.Logger) *slowRequestWatchdog {
+	return &slowRequestWatchdog{
+		threshold: threshold,
+		log:       log,
+		inflight:  make(map[*http.Request]*slowRequestEntry),
+	}
+}
+
+// wrapTrace returns a trace that tracks in-flight requests and calls the hooks of t if not nil.
+func (w *slowRequestWatchdog) wrapTrace(t *martian.ProxyTrace) *martian.ProxyTrace {
+	var wt martian.ProxyTrace
+	wt.ReadRequest = func(info martian.ReadRequestInfo) {
+		if info.Req != nil {
+			w.readRequest(info.Req)
+		}
+		if t != nil && t.ReadRequest != nil {
+			t.ReadRequest(info)
+		}
+	}
+	wt.WroteResponse = func(info martian.WroteResponseInfo) {
+		if info.Res != nil {
+			w.wroteResponse(info.Res)
+		}
+		if t != nil && t.WroteResponse != nil {
+			t.WroteResponse(info)
+		}
+	}
+	if t != nil {
+		wt.ClosedTunnel = t.ClosedTunnel
+	}
+	return &wt
+}
+
+// readRequest must be called from the goroutine handling the request.
+func (w *slowRequestWatchdog) readRequest(req *http.Request) {
+	e := &slowRequestEntry{
+		start:     time.Now(),
+		goroutine: currentGoroutineID(),
+	}
+
+	w.mu.Lock()
+	w.inflight[req] = e
+	w.mu.Unlock()
+}
+
+func (w *slowRequestWatchdog) wroteResponse(res *http.Response) {
+	if res.Request == nil {
+		return
+	}
+
+	w.mu.Lock()
+	e, ok := w.inflight[res.Request]
+	delete(w.inflight, res.Request)
+	w.mu.Unlock()
+
+	if ok && e.reported {
+		w.log.Infof("slow request completed %s duration=%s status=%d",
+			describeSlowRequest(res.Request), time.Since(e.start).Round(time.Millisecond), res.StatusCode)
+	}
+}
+
+func (w *slowRequestWatchdog) run(ctx context.Context) {
+	t := time.NewTicker(max(w.threshold/2, 10*time.Millisecond))
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			w.check()
+		}
+	}
+}
+
+func (w *slowRequestWatchdog) check() {
+	now := time.Now()
+
+	type slow struct {
+		req *http.Request
+		*slowRequestEntry
+	}
+	var reqs []slow
+
+	w.mu.Lock()
+	for req, e := range w.inflight {
+		if !e.reported && now.Sub(e.start) >= w.threshold {
+			e.reported = true
+			reqs = append(reqs, slow{req, e})
+		}
+	}
+	w.mu.Unlock()
+
+	if len(reqs) == 0 {
+		return
+	}
+
+	stacks := goroutineStacks()
+	for _, r := range reqs {
+		stack, ok := stacks[r.goroutine]
+		if !ok {
+			stack = "goroutine " + strconv.FormatUint(r.goroutine, 10) + " not found"
+		}
+		w.log.Errorf("slow request in-flight %s duration=%s threshold=%s\n%s",
+			describeSlowRequest(r.req), now.Sub(r.start).Round(time.Millisecond), w.threshold, stack)
+	}
+}
+
+func describeSlowRequest(req *http.Request) string {
+	u := *req.URL
+	u.User = nil
+	u.RawQuery = ""
+	s := "method=" + req.Method + " url=" + u.String() + " client=" + req.RemoteAddr
+	if id := martian.ContextTraceID(req.Context()); id != "" {
+		s += " id=" + id
+	}
+	return s
+}
+
+// currentGoroutineID parses the goroutine ID from the stack trace header "goroutine <id> [running]:".
+func currentGoroutineID() uint64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	id, _ := parseGoroutineHeader(b)
+	return id
+}
+
+func parseGoroutineHeader(b []byte) (uint64, bool) {
+	b, ok := bytes.CutPrefix(b, []byte("goroutine "))
+	if !ok {
+		return 0, false
+	}
+	if i := bytes.IndexByte(b, ' '); i > 0 {
+		b = b[:i]
+	}
+	id, err := strconv.ParseUint(string(b), 10, 64)
+	return id, err == nil
+}
+
+// goroutineStacks returns the stacks of all goroutines by goroutine ID,
+// each stack is limited to slowRequestStackLines lines.
+func goroutineStacks() map[uint64]string {
+	buf := allGoroutineStacks()
+
+	stacks := make(map[uint64]string)
+	for _, g := range bytes.Split(buf, []byte("\n\n")) {
+		id, ok := parseGoroutineHeader(g)
+		if !ok {
+			continue
+		}
+		lines := bytes.SplitN(g, []byte("\n"), slowRequestStackLines+1)
+		if len(lines) > slowRequestStackLines {
+			lines[slowRequestStackLines] = []byte("...")
+		}
+		stacks[id] = string(bytes.Join(lines, []byte("\n")))
+	}
+	return stacks
+}
+
+// allGoroutineStacks returns the stack traces of all goroutines separated by empty lines.
+func allGoroutineStacks() []byte {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	return buf
+}
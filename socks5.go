@@ -0,0 +1,248 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// SOCKS5 protocol constants, see RFC 1928 and RFC 1929.
+const (
+	socks5Version        = 0x05
+	socks5AuthVersion    = 0x01
+	socks5MethodNoAuth   = 0x00
+	socks5MethodPassword = 0x02
+	socks5MethodNone     = 0xff
+	socks5CmdConnect     = 0x01
+	socks5CmdUDP         = 0x03
+	socks5AddrIPv4       = 0x01
+	socks5AddrDomain     = 0x03
+	socks5AddrIPv6       = 0x04
+)
+
+// SOCKS5 reply codes.
+const (
+	socks5Succeeded           = 0x00
+	socks5GeneralFailure      = 0x01
+	socks5NotAllowed          = 0x02
+	socks5HostUnreachable     = 0x04
+	socks5TTLExpired          = 0x06
+	socks5CmdNotSupported     = 0x07
+	socks5AddrTypeUnsupported = 0x08
+)
+
+// socks5Listener accepts SOCKS5 connections and serves them as HTTP CONNECT requests.
+// Each connection performs the SOCKS5 handshake on first read and yields a CONNECT request
+// for the requested destination, so that the proxy applies the same rules as for HTTP clients.
+// The CONNECT response is translated back to a SOCKS5 reply.
+type socks5Listener struct {
+	net.Listener
+	user *url.Userinfo
+	// udp serves UDP ASSOCIATE requests if set.
+	udp *socks5UDPRelay
+}
+
+func (l *socks5Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c := &socks5Conn{Conn: conn, user: l.user, udp: l.udp}
+	return &connectConn{
+		Conn:      conn,
+		handshake: c.handshake,
+		established: func(code int) error {
+			return c.reply(socks5ReplyCode(code))
+		},
+	}, nil
+}
+
+type socks5Conn struct {
+	net.Conn
+	user *url.Userinfo
+	udp  *socks5UDPRelay
+}
+
+func (c *socks5Conn) handshake() ([]byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != socks5Version {
+		return nil, fmt.Errorf("socks5: unsupported version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c.Conn, methods); err != nil {
+		return nil, err
+	}
+
+	method := byte(socks5MethodNoAuth)
+	if c.user != nil {
+		method = socks5MethodPassword
+	}
+	if bytes.IndexByte(methods, method) < 0 {
+		c.Conn.Write([]byte{socks5Version, socks5MethodNone}) //nolint:errcheck // closing anyway
+		return nil, errors.New("socks5: no acceptable authentication method")
+	}
+	if _, err := c.Conn.Write([]byte{socks5Version, method}); err != nil {
+		return nil, err
+	}
+
+	var user, pass string
+	if method == socks5MethodPassword {
+		var err error
+		if user, pass, err = c.readCredentials(); err != nil {
+			return nil, err
+		}
+		wantPass, _ := c.user.Password()
+		ok := subtle.ConstantTimeCompare([]byte(user), []byte(c.user.Username())) == 1 &&
+			subtle.ConstantTimeCompare([]byte(pass), []byte(wantPass)) == 1
+		if !ok {
+			c.Conn.Write([]byte{socks5AuthVersion, 0x01}) //nolint:errcheck // closing anyway
+			return nil, ErrProxyAuthentication
+		}
+		if _, err := c.Conn.Write([]byte{socks5AuthVersion, 0x00}); err != nil {
+			return nil, err
+		}
+	}
+
+	cmd, addr, err := c.readRequest()
+	if err != nil {
+		return nil, err
+	}
+	if cmd == socks5CmdUDP {
+		// The connection is not passed to the proxy, it only controls the association.
+		if err := c.udp.associate(c); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+
+	// The credentials are passed to the proxy to be handled by the basic auth middleware.
+	h := make(http.Header)
+	if method == socks5MethodPassword {
+		r := http.Request{Header: make(http.Header)}
+		r.SetBasicAuth(user, pass)
+		h.Set("Proxy-Authorization", r.Header.Get("Authorization"))
+	}
+
+	return connectRequest(addr, h), nil
+}
+
+func (c *socks5Conn) readCredentials() (user, pass string, err error) {
+	var ver [1]byte
+	if _, err := io.ReadFull(c.Conn, ver[:]); err != nil {
+		return "", "", err
+	}
+	if ver[0] != socks5AuthVersion {
+		return "", "", fmt.Errorf("socks5: unsupported auth version %d", ver[0])
+	}
+	if user, err = c.readString(); err != nil {
+		return "", "", err
+	}
+	if pass, err = c.readString(); err != nil {
+		return "", "", err
+	}
+	return user, pass, nil
+}
+
+func (c *socks5Conn) readString() (string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(c.Conn, n[:]); err != nil {
+		return "", err
+	}
+	b := make([]byte, n[0])
+	if _, err := io.ReadFull(c.Conn, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (c *socks5Conn) readRequest() (cmd byte, addr string, err error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+		return 0, "", err
+	}
+	if hdr[0] != socks5Version {
+		return 0, "", fmt.Errorf("socks5: unsupported version %d", hdr[0])
+	}
+
+	var host string
+	switch hdr[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if hdr[3] == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(c.Conn, ip); err != nil {
+			return 0, "", err
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		if host, err = c.readString(); err != nil {
+			return 0, "", err
+		}
+	default:
+		c.reply(socks5AddrTypeUnsupported) //nolint:errcheck // closing anyway
+		return 0, "", fmt.Errorf("socks5: unsupported address type %d", hdr[3])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(c.Conn, port[:]); err != nil {
+		return 0, "", err
+	}
+
+	if hdr[1] != socks5CmdConnect && (hdr[1] != socks5CmdUDP || c.udp == nil) {
+		c.reply(socks5CmdNotSupported) //nolint:errcheck // closing anyway
+		return 0, "", fmt.Errorf("socks5: unsupported command %d", hdr[1])
+	}
+
+	return hdr[1], net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+func (c *socks5Conn) reply(code byte) error {
+	// The bound address is not meaningful for CONNECT through the proxy.
+	return c.replyAddr(code, net.IPv4zero, 0)
+}
+
+func (c *socks5Conn) replyAddr(code byte, ip net.IP, port int) error {
+	b := []byte{socks5Version, code, 0x00}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socks5AddrIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socks5AddrIPv6)
+		b = append(b, ip.To16()...)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(port)) //nolint:gosec // port is uint16
+	_, err := c.Conn.Write(b)
+	return err
+}
+
+func socks5ReplyCode(code int) byte {
+	switch code {
+	case http.StatusOK:
+		return socks5Succeeded
+	case http.StatusForbidden, http.StatusProxyAuthRequired, http.StatusTooManyRequests:
+		return socks5NotAllowed
+	case http.StatusBadGateway:
+		return socks5HostUnreachable
+	case http.StatusGatewayTimeout:
+		return socks5TTLExpired
+	default:
+		return socks5GeneralFailure
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"golang.org/x/net/proxy"
+)
+
+func TestSOCKS5Proxy(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "Hello, World!") //nolint:errcheck // test server
+	}))
+	defer s.Close()
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.Protocol = SOCKS5Scheme
+	cfg.Address = "localhost:0"
+	cfg.PromRegistry = prometheus.NewRegistry()
+	cfg.ProxyLocalhost = AllowProxyLocalhost
+	cfg.BasicAuth = url.UserPassword("user", "pass")
+	cfg.DenyDomains = MatchFunc(func(host string) bool { return host == "denied.local" })
+
+	p, err := NewHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx) //nolint:errcheck // returns on cancel
+
+	addrs, _ := p.Addr()
+
+	dialer := func(t *testing.T, user, pass string) proxy.ContextDialer {
+		t.Helper()
+		d, err := proxy.SOCKS5("tcp", addrs[0], &proxy.Auth{User: user, Password: pass}, proxy.Direct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.(proxy.ContextDialer) //nolint:forcetypeassert // x/net/proxy SOCKS5 dialer
+	}
+
+	t.Run("connect", func(t *testing.T) {
+		d := dialer(t, "user", "pass")
+		c := http.Client{Transport: &http.Transport{DialContext: d.DialContext}}
+		resp, err := c.Get(s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "Hello, World!" {
+			t.Fatalf("got %q", b)
+		}
+	})
+
+	t.Run("bad credentials", func(t *testing.T) {
+		d := dialer(t, "user", "bad")
+		if _, err := d.DialContext(ctx, "tcp", s.Listener.Addr().String()); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		d := dialer(t, "user", "pass")
+		_, err := d.DialContext(ctx, "tcp", "denied.local:80")
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		t.Log(err)
+	})
+}
+
+func TestSOCKS5ReplyCode(t *testing.T) {
+	tests := []struct {
+		header string
+		code   byte
+	}{
+		{"HTTP/1.1 200 OK", socks5Succeeded},
+		{"HTTP/1.1 403 Forbidden\r\nContent-Type: text/plain", socks5NotAllowed},
+		{"HTTP/1.1 407 Proxy Authentication Required", socks5NotAllowed},
+		{"HTTP/1.1 502 Bad Gateway", socks5HostUnreachable},
+		{"HTTP/1.1 504 Gateway Timeout", socks5TTLExpired},
+		{"HTTP/1.1 500 Internal Server Error", socks5GeneralFailure},
+		{"garbage", socks5GeneralFailure},
+	}
+	for _, tc := range tests {
+		if got := socks5ReplyCode(parseStatusCode([]byte(tc.header))); got != tc.code {
+			t.Errorf("%q: got %d, want %d", tc.header, got, tc.code)
+		}
+	}
+}
@@ -0,0 +1,518 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/saucelabs/forwarder/log"
+)
+
+// SOCKS5UDPConfig configures relaying of UDP datagrams for SOCKS5 UDP ASSOCIATE requests.
+// Datagrams are sent directly to the destination, the upstream proxy is not used.
+type SOCKS5UDPConfig struct {
+	// IdleTimeout is the time after which an association without datagrams in either direction is closed,
+	// and after which a destination is removed from the association NAT table.
+	IdleTimeout time.Duration
+
+	// MaxDestinations is the maximum number of destinations in the NAT table of an association.
+	// Datagrams to new destinations are dropped when the table is full.
+	MaxDestinations int
+}
+
+func DefaultSOCKS5UDPConfig() *SOCKS5UDPConfig {
+	return &SOCKS5UDPConfig{
+		IdleTimeout:     2 * time.Minute,
+		MaxDestinations: 256,
+	}
+}
+
+func (c *SOCKS5UDPConfig) Validate() error {
+	if c.IdleTimeout <= 0 {
+		return errors.New("idle timeout must be positive")
+	}
+	if c.MaxDestinations < 1 {
+		return errors.New("max destinations must be at least 1")
+	}
+	return nil
+}
+
+type socks5UDPMetrics struct {
+	active  prometheus.Gauge
+	total   prometheus.Counter
+	packets *prometheus.CounterVec
+	bytes   *prometheus.CounterVec
+	dropped *prometheus.CounterVec
+}
+
+func newSOCKS5UDPMetrics(r prometheus.Registerer, namespace string) *socks5UDPMetrics {
+	if r == nil {
+		r = prometheus.NewRegistry() // This registry will be discarded.
+	}
+	f := promauto.With(r)
+
+	return &socks5UDPMetrics{
+		active: f.NewGauge(prometheus.GaugeOpts{
+			Name:      "socks5_udp_associations_active",
+			Namespace: namespace,
+			Help:      "Number of active SOCKS5 UDP associations",
+		}),
+		total: f.NewCounter(prometheus.CounterOpts{
+			Name:      "socks5_udp_associations_total",
+			Namespace: namespace,
+			Help:      "Number of SOCKS5 UDP associations",
+		}),
+		packets: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "socks5_udp_packets_total",
+			Namespace: namespace,
+			Help:      "Number of relayed SOCKS5 UDP datagrams by direction",
+		}, []string{"direction"}),
+		bytes: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "socks5_udp_bytes_total",
+			Namespace: namespace,
+			Help:      "Number of relayed SOCKS5 UDP payload bytes by direction",
+		}, []string{"direction"}),
+		dropped: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "socks5_udp_dropped_total",
+			Namespace: namespace,
+			Help:      "Number of dropped SOCKS5 UDP datagrams by reason",
+		}, []string{"reason"}),
+	}
+}
+
+func (m *socks5UDPMetrics) relayed(direction string, n int) {
+	m.packets.WithLabelValues(direction).Inc()
+	m.bytes.WithLabelValues(direction).Add(float64(n))
+}
+
+func (m *socks5UDPMetrics) drop(reason string) {
+	m.dropped.WithLabelValues(reason).Inc()
+}
+
+// socks5UDPRelay serves UDP associations.
+// Each association has its own UDP socket, datagrams from the client are sent to the destination
+// in the datagram header, and datagrams from destinations in the NAT table are sent back to the client.
+// The association lasts as long as the TCP connection that requested it, or until it is idle.
+type socks5UDPRelay struct {
+	config SOCKS5UDPConfig
+	// allow returns an error if datagrams to host and port are not allowed, host is a domain name or an IP address.
+	allow    func(host string, port int) error
+	resolver *net.Resolver
+	metrics  *socks5UDPMetrics
+	log      log.Logger
+}
+
+const (
+	// socks5UDPResolveTimeout limits the time to resolve a destination domain name.
+	socks5UDPResolveTimeout = 5 * time.Second
+	// socks5UDPMaxPending is the maximum number of datagrams queued per domain name while it is resolved.
+	socks5UDPMaxPending = 16
+)
+
+type socks5UDPDest struct {
+	lastSeen time.Time
+}
+
+// socks5UDPHost is the resolution of a destination domain name.
+// Domain names are resolved outside the association read loop, datagrams are queued until the resolution completes.
+type socks5UDPHost struct {
+	ip        net.IP
+	err       error
+	resolved  time.Time
+	resolving bool
+	pending   []socks5UDPDatagram
+}
+
+type socks5UDPDatagram struct {
+	port    int
+	payload []byte
+}
+
+func (r *socks5UDPRelay) associate(c *socks5Conn) error {
+	laddr, _ := c.Conn.LocalAddr().(*net.TCPAddr)
+	raddr, _ := c.Conn.RemoteAddr().(*net.TCPAddr)
+	if laddr == nil || raddr == nil {
+		c.reply(socks5GeneralFailure) //nolint:errcheck // closing anyway
+		return errors.New("socks5: UDP associate requires a TCP connection")
+	}
+
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: laddr.IP, Zone: laddr.Zone})
+	if err != nil {
+		c.reply(socks5GeneralFailure) //nolint:errcheck // closing anyway
+		return err
+	}
+	defer pc.Close()
+
+	bound := pc.LocalAddr().(*net.UDPAddr) //nolint:forcetypeassert // UDP listener
+	if err := c.replyAddr(socks5Succeeded, bound.IP, bound.Port); err != nil {
+		return err
+	}
+
+	r.metrics.total.Inc()
+	r.metrics.active.Inc()
+	defer r.metrics.active.Dec()
+	r.log.Debugf("SOCKS5 UDP association client=%s relay=%s", raddr, bound)
+
+	// The association terminates when the TCP connection closes.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		io.Copy(io.Discard, c.Conn) //nolint:errcheck // any error closes the association
+		pc.Close()
+	}()
+	defer wg.Wait()
+	defer c.Conn.Close()
+
+	// Domain names are resolved to addresses of the relay socket family.
+	network := "ip6"
+	if bound.IP.To4() != nil {
+		network = "ip4"
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a := socks5UDPAssociation{
+		relay:    r,
+		ctx:      ctx,
+		pc:       pc,
+		network:  network,
+		clientIP: raddr.IP,
+		nat:      make(map[string]*socks5UDPDest),
+		hosts:    make(map[string]*socks5UDPHost),
+	}
+	a.serve()
+	cancel()
+	a.wg.Wait()
+
+	r.log.Debugf("SOCKS5 UDP association closed client=%s relay=%s", raddr, bound)
+	return nil
+}
+
+type socks5UDPAssociation struct {
+	relay    *socks5UDPRelay
+	ctx      context.Context
+	pc       *net.UDPConn
+	network  string
+	clientIP net.IP
+	wg       sync.WaitGroup
+
+	mu sync.Mutex
+	// client is the address of the client, it is set by the first datagram from the client IP.
+	client *net.UDPAddr
+	nat    map[string]*socks5UDPDest
+	hosts  map[string]*socks5UDPHost
+}
+
+func (a *socks5UDPAssociation) serve() {
+	var (
+		buf        = make([]byte, 64*1024)
+		idle       = a.relay.config.IdleTimeout
+		lastActive = time.Now()
+	)
+	for {
+		a.pc.SetReadDeadline(time.Now().Add(idle)) //nolint:errcheck // UDP conn
+		n, from, err := a.pc.ReadFromUDP(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() && time.Since(lastActive) < idle {
+				continue
+			}
+			return
+		}
+
+		if a.isClient(from) {
+			if a.fromClient(buf[:n]) {
+				lastActive = time.Now()
+			}
+		} else if a.fromDest(from, buf[:n]) {
+			lastActive = time.Now()
+		}
+	}
+}
+
+func (a *socks5UDPAssociation) isClient(from *net.UDPAddr) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.client != nil {
+		return from.IP.Equal(a.client.IP) && from.Port == a.client.Port
+	}
+	if !from.IP.Equal(a.clientIP) {
+		return false
+	}
+	if _, ok := a.nat[from.String()]; ok {
+		return false
+	}
+	a.client = from
+	return true
+}
+
+func (a *socks5UDPAssociation) fromClient(b []byte) bool {
+	m := a.relay.metrics
+
+	host, port, payload, err := parseSOCKS5UDPHeader(b)
+	if err != nil {
+		m.drop("malformed")
+		return false
+	}
+
+	if err := a.relay.allow(host, port); err != nil {
+		a.relay.log.Debugf("SOCKS5 UDP datagram denied host=%s port=%d: %s", host, port, err)
+		m.drop("denied")
+		return false
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return a.send(&net.UDPAddr{IP: ip, Port: port}, payload)
+	}
+
+	now := time.Now()
+	a.mu.Lock()
+	h, ok := a.hosts[host]
+	switch {
+	case ok && h.resolving:
+		if len(h.pending) >= socks5UDPMaxPending {
+			a.mu.Unlock()
+			m.drop("resolve")
+			return false
+		}
+		h.pending = append(h.pending, socks5UDPDatagram{port, append([]byte(nil), payload...)})
+		a.mu.Unlock()
+		return true
+	case ok && now.Sub(h.resolved) < a.relay.config.IdleTimeout:
+		ip, err := h.ip, h.err
+		a.mu.Unlock()
+		return a.sendResolved(host, ip, err, port, payload)
+	default:
+		if !ok && len(a.hosts) >= a.relay.config.MaxDestinations {
+			a.expireHosts(now)
+		}
+		if !ok && len(a.hosts) >= a.relay.config.MaxDestinations {
+			a.mu.Unlock()
+			m.drop("nat_full")
+			return false
+		}
+		a.hosts[host] = &socks5UDPHost{
+			resolving: true,
+			pending:   []socks5UDPDatagram{{port, append([]byte(nil), payload...)}},
+		}
+		a.mu.Unlock()
+
+		a.wg.Add(1)
+		go a.resolve(host)
+		return true
+	}
+}
+
+// resolve resolves the domain name and sends the datagrams queued for it.
+func (a *socks5UDPAssociation) resolve(host string) {
+	defer a.wg.Done()
+
+	ctx, cancel := context.WithTimeout(a.ctx, socks5UDPResolveTimeout)
+	defer cancel()
+
+	var ip net.IP
+	ips, err := a.relay.resolver.LookupIP(ctx, a.network, host)
+	if err == nil {
+		ip = ips[0]
+	}
+
+	a.mu.Lock()
+	h := a.hosts[host]
+	h.ip, h.err, h.resolved, h.resolving = ip, err, time.Now(), false
+	pending := h.pending
+	h.pending = nil
+	a.mu.Unlock()
+
+	for _, d := range pending {
+		a.sendResolved(host, ip, err, d.port, d.payload)
+	}
+}
+
+func (a *socks5UDPAssociation) sendResolved(host string, ip net.IP, err error, port int, payload []byte) bool {
+	m := a.relay.metrics
+
+	if err != nil {
+		m.drop("resolve")
+		return false
+	}
+	if err := a.relay.allow(ip.String(), port); err != nil {
+		a.relay.log.Debugf("SOCKS5 UDP datagram denied host=%s ip=%s port=%d: %s", host, ip, port, err)
+		m.drop("denied")
+		return false
+	}
+	return a.send(&net.UDPAddr{IP: ip, Port: port}, payload)
+}
+
+func (a *socks5UDPAssociation) send(dst *net.UDPAddr, payload []byte) bool {
+	m := a.relay.metrics
+
+	key := dst.String()
+	now := time.Now()
+	a.mu.Lock()
+	d, ok := a.nat[key]
+	if !ok {
+		if len(a.nat) >= a.relay.config.MaxDestinations {
+			a.expire(now)
+		}
+		if len(a.nat) >= a.relay.config.MaxDestinations {
+			a.mu.Unlock()
+			m.drop("nat_full")
+			return false
+		}
+		d = new(socks5UDPDest)
+		a.nat[key] = d
+	}
+	d.lastSeen = now
+	a.mu.Unlock()
+
+	if _, err := a.pc.WriteToUDP(payload, dst); err != nil {
+		m.drop("write")
+		return false
+	}
+	m.relayed("out", len(payload))
+	return true
+}
+
+func (a *socks5UDPAssociation) fromDest(from *net.UDPAddr, b []byte) bool {
+	m := a.relay.metrics
+
+	a.mu.Lock()
+	d, ok := a.nat[from.String()]
+	client := a.client
+	if !ok || client == nil {
+		a.mu.Unlock()
+		m.drop("unsolicited")
+		return false
+	}
+	now := time.Now()
+	if now.Sub(d.lastSeen) > a.relay.config.IdleTimeout {
+		delete(a.nat, from.String())
+		a.mu.Unlock()
+		m.drop("unsolicited")
+		return false
+	}
+	d.lastSeen = now
+	a.mu.Unlock()
+
+	if _, err := a.pc.WriteToUDP(appendSOCKS5UDPHeader(nil, from, b), client); err != nil {
+		m.drop("write")
+		return false
+	}
+	m.relayed("in", len(b))
+	return true
+}
+
+// expire removes idle destinations from the NAT table, a.mu must be held.
+func (a *socks5UDPAssociation) expire(now time.Time) {
+	for k, d := range a.nat {
+		if now.Sub(d.lastSeen) > a.relay.config.IdleTimeout {
+			delete(a.nat, k)
+		}
+	}
+}
+
+// expireHosts removes stale domain name resolutions, a.mu must be held.
+func (a *socks5UDPAssociation) expireHosts(now time.Time) {
+	for k, h := range a.hosts {
+		if !h.resolving && now.Sub(h.resolved) > a.relay.config.IdleTimeout {
+			delete(a.hosts, k)
+		}
+	}
+}
+
+// parseSOCKS5UDPHeader parses the UDP request header, see RFC 1928 section 7.
+// Fragmented datagrams are not supported.
+func parseSOCKS5UDPHeader(b []byte) (host string, port int, payload []byte, err error) {
+	if len(b) < 4 {
+		return "", 0, nil, errors.New("short header")
+	}
+	if b[2] != 0 {
+		return "", 0, nil, errors.New("fragmentation not supported")
+	}
+
+	atyp, b := b[3], b[4:]
+	switch atyp {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		n := net.IPv4len
+		if atyp == socks5AddrIPv6 {
+			n = net.IPv6len
+		}
+		if len(b) < n {
+			return "", 0, nil, errors.New("short address")
+		}
+		host, b = net.IP(b[:n]).String(), b[n:]
+	case socks5AddrDomain:
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return "", 0, nil, errors.New("short address")
+		}
+		host, b = string(b[1:1+int(b[0])]), b[1+int(b[0]):]
+	default:
+		return "", 0, nil, errors.New("unsupported address type")
+	}
+
+	if len(b) < 2 {
+		return "", 0, nil, errors.New("short port")
+	}
+	port = int(binary.BigEndian.Uint16(b))
+	if port == 0 {
+		return "", 0, nil, errors.New("invalid port")
+	}
+	return host, port, b[2:], nil
+}
+
+func appendSOCKS5UDPHeader(dst []byte, addr *net.UDPAddr, payload []byte) []byte {
+	dst = append(dst, 0, 0, 0)
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		dst = append(dst, socks5AddrIPv4)
+		dst = append(dst, ip4...)
+	} else {
+		dst = append(dst, socks5AddrIPv6)
+		dst = append(dst, addr.IP.To16()...)
+	}
+	dst = binary.BigEndian.AppendUint16(dst, uint16(addr.Port)) //nolint:gosec // port is uint16
+	return append(dst, payload...)
+}
+
+// socks5UDPAllow is the policy check for UDP destinations.
+// It applies the same rules as the request modifiers for CONNECT requests:
+// localhost, deny domains, port policies with the connect protocol and homograph blocking.
+func (hp *HTTPProxy) socks5UDPAllow() func(host string, port int) error {
+	var hm *homographMatcher
+	if cfg := hp.config.Homograph; cfg != nil && cfg.Block {
+		hm = newHomographMatcher(cfg)
+	}
+
+	return func(host string, port int) error {
+		if hp.config.ProxyLocalhost == DenyProxyLocalhost && hp.isLocalhost(host) {
+			return ErrProxyLocalhost
+		}
+		if hp.config.DenyDomains != nil && matchHost(hp.config.DenyDomains, host) {
+			return ErrProxyDenied
+		}
+		if len(hp.config.PortPolicies) > 0 && !portPolicyAllows(hp.config.PortPolicies, PortPolicyConnect, host, strconv.Itoa(port)) {
+			hp.metrics.portPolicyViolation(PortPolicyConnect)
+			return ErrPortPolicy
+		}
+		if hm != nil {
+			if _, ok := hm.match(NormalizeHost(host)); ok {
+				hp.metrics.homograph("block")
+				return ErrHomograph
+			}
+		}
+		return nil
+	}
+}
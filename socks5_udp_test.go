@@ -0,0 +1,195 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestSOCKS5UDPHeader(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}
+	b := appendSOCKS5UDPHeader(nil, addr, []byte("payload"))
+
+	host, port, payload, err := parseSOCKS5UDPHeader(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "192.0.2.1" || port != 53 || string(payload) != "payload" {
+		t.Fatalf("got host=%s port=%d payload=%q", host, port, payload)
+	}
+
+	domain := append([]byte{0, 0, 0, socks5AddrDomain, 7}, "example"...)
+	domain = append(domain, 0, 53)
+	domain = append(domain, "q"...)
+	host, port, payload, err = parseSOCKS5UDPHeader(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "example" || port != 53 || string(payload) != "q" {
+		t.Fatalf("got host=%s port=%d payload=%q", host, port, payload)
+	}
+
+	for _, b := range [][]byte{
+		{0, 0, 0},
+		{0, 0, 1, socks5AddrIPv4, 1, 2, 3, 4, 0, 53},
+		{0, 0, 0, socks5AddrIPv4, 1, 2, 3, 4, 0, 0},
+		{0, 0, 0, socks5AddrDomain, 10, 'a'},
+		{0, 0, 0, 0x09},
+	} {
+		if _, _, _, err := parseSOCKS5UDPHeader(b); err == nil {
+			t.Errorf("%v: expected error", b)
+		}
+	}
+}
+
+func TestSOCKS5UDPAssociate(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], from) //nolint:errcheck // test server
+		}
+	}()
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.Protocol = SOCKS5Scheme
+	cfg.Address = "127.0.0.1:0"
+	reg := prometheus.NewRegistry()
+	cfg.PromRegistry = reg
+	cfg.ProxyLocalhost = AllowProxyLocalhost
+	cfg.DenyDomains = MatchFunc(func(host string) bool { return host == "denied.local" })
+	cfg.SOCKS5UDP = DefaultSOCKS5UDPConfig()
+	dst := echo.LocalAddr().(*net.UDPAddr) //nolint:forcetypeassert // UDP listener
+	pp, err := ParsePortPolicy(fmt.Sprintf("^localhost$=%d", dst.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.PortPolicies = []PortPolicy{pp}
+
+	p, err := NewHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx) //nolint:errcheck // returns on cancel
+
+	addrs, _ := p.Addr()
+	c, err := net.Dial("tcp", addrs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Method negotiation and UDP ASSOCIATE request.
+	if _, err := c.Write([]byte{socks5Version, 1, socks5MethodNoAuth}); err != nil {
+		t.Fatal(err)
+	}
+	var method [2]byte
+	if _, err := io.ReadFull(c, method[:]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte{socks5Version, socks5CmdUDP, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	var reply [10]byte
+	if _, err := io.ReadFull(c, reply[:]); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != socks5Succeeded || reply[3] != socks5AddrIPv4 {
+		t.Fatalf("unexpected reply %v", reply)
+	}
+	relay := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(binary.BigEndian.Uint16(reply[8:]))}
+
+	u, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+
+	denied := append([]byte{0, 0, 0, socks5AddrDomain, byte(len("denied.local"))}, "denied.local"...)
+	denied = append(denied, 0, 53)
+	denied = append(denied, "denied"...)
+	if _, err := u.Write(denied); err != nil {
+		t.Fatal(err)
+	}
+
+	domain := func(host string, port int, payload string) []byte {
+		b := append([]byte{0, 0, 0, socks5AddrDomain, byte(len(host))}, host...)
+		b = binary.BigEndian.AppendUint16(b, uint16(port)) //nolint:gosec // test port
+		return append(b, payload...)
+	}
+
+	// Denied by the port policy.
+	if _, err := u.Write(domain("localhost", dst.Port+1, "port")); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(payload string) {
+		t.Helper()
+		u.SetReadDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck // test
+		buf := make([]byte, 1024)
+		n, err := u.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := appendSOCKS5UDPHeader(nil, dst, []byte(payload))
+		if !bytes.Equal(buf[:n], want) {
+			t.Fatalf("got %v, want %v", buf[:n], want)
+		}
+	}
+
+	if _, err := u.Write(appendSOCKS5UDPHeader(nil, dst, []byte("ping"))); err != nil {
+		t.Fatal(err)
+	}
+	read("ping")
+
+	// Domain names are resolved outside the read loop.
+	if _, err := u.Write(domain("localhost", dst.Port, "pong")); err != nil {
+		t.Fatal(err)
+	}
+	read("pong")
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dropped float64
+	for _, mf := range mfs {
+		if mf.GetName() != "socks5_udp_dropped_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "reason" && l.GetValue() == "denied" {
+					dropped += m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	if dropped != 2 {
+		t.Fatalf("got %v denied datagrams, want 2", dropped)
+	}
+}
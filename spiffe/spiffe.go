@@ -0,0 +1,333 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package spiffe obtains X.509 SVIDs and trust bundles from the SPIFFE Workload API.
+package spiffe
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saucelabs/forwarder/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// EndpointSocketEnv is the environment variable with the default Workload API address.
+const EndpointSocketEnv = "SPIFFE_ENDPOINT_SOCKET"
+
+// SVID is an X.509 SPIFFE Verifiable Identity Document.
+type SVID struct {
+	ID          *url.URL
+	Certificate *tls.Certificate
+}
+
+// Source streams X.509 SVIDs and trust bundles from the Workload API and keeps the latest ones,
+// so that rotated certificates are used for new connections without restart.
+// The Workload API streams new documents before the current ones expire.
+type Source struct {
+	conn *grpc.ClientConn
+	log  log.Logger
+
+	mu      sync.RWMutex
+	svid    *SVID
+	bundles map[string]*x509.CertPool // by trust domain
+
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+// NewSource returns a source for the Workload API at addr,
+// the address is unix:///<path> or tcp://<ip>:<port> as in the SPIFFE_ENDPOINT_SOCKET environment variable.
+func NewSource(addr string, log log.Logger) (*Source, error) {
+	target, err := grpcTarget(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Source{
+		conn:  conn,
+		log:   log,
+		ready: make(chan struct{}),
+	}, nil
+}
+
+func grpcTarget(addr string) (string, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", fmt.Errorf("workload API address: %w", err)
+	}
+	switch u.Scheme {
+	case "unix":
+		if u.Path == "" || u.Host != "" {
+			return "", errors.New("workload API address: expected unix:///<path>")
+		}
+		return "unix://" + u.Path, nil
+	case "tcp":
+		if u.Host == "" || u.Path != "" {
+			return "", errors.New("workload API address: expected tcp://<ip>:<port>")
+		}
+		return "passthrough:///" + u.Host, nil
+	default:
+		return "", fmt.Errorf("workload API address: unsupported scheme %q", u.Scheme)
+	}
+}
+
+const fetchX509SVIDMethod = "/SpiffeWorkloadAPI/FetchX509SVID"
+
+// Run streams the documents until ctx is canceled, it reconnects with backoff when the stream fails.
+func (s *Source) Run(ctx context.Context) error {
+	const (
+		minBackoff = time.Second
+		maxBackoff = 30 * time.Second
+	)
+
+	backoff := minBackoff
+	for {
+		err := s.watch(ctx, func() { backoff = minBackoff })
+		if ctx.Err() != nil {
+			return nil
+		}
+		s.log.Errorf("SPIFFE workload API stream failed, retrying in %s: %s", backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+func (s *Source) watch(ctx context.Context, onUpdate func()) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "workload.spiffe.io", "true")
+	stream, err := s.conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, fetchX509SVIDMethod, grpc.ForceCodec(rawCodec{}))
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(new(rawMessage)); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+
+	for {
+		var m rawMessage
+		if err := stream.RecvMsg(&m); err != nil {
+			if errors.Is(err, io.EOF) {
+				return errors.New("stream closed by server")
+			}
+			return err
+		}
+		if err := s.update(m); err != nil {
+			s.log.Errorf("SPIFFE workload API: invalid X.509 SVID response: %s", err)
+			continue
+		}
+		onUpdate()
+	}
+}
+
+func (s *Source) update(m rawMessage) error {
+	res, err := parseX509SVIDResponse(m)
+	if err != nil {
+		return err
+	}
+	if len(res.svids) == 0 {
+		return errors.New("no SVIDs")
+	}
+
+	// The first SVID is the default identity of the workload.
+	svid, bundle, err := res.svids[0].parse()
+	if err != nil {
+		return err
+	}
+	bundles := map[string]*x509.CertPool{
+		svid.ID.Host: bundle,
+	}
+	for td, b := range res.federatedBundles {
+		p, err := parseBundle(b)
+		if err != nil {
+			return fmt.Errorf("federated bundle %s: %w", td, err)
+		}
+		bundles[strings.TrimPrefix(td, "spiffe://")] = p
+	}
+
+	s.mu.Lock()
+	s.svid = svid
+	s.bundles = bundles
+	s.mu.Unlock()
+
+	s.log.Infof("SPIFFE X.509 SVID updated id=%s expires=%s", svid.ID, svid.Certificate.Leaf.NotAfter.Format(time.RFC3339))
+	s.readyOnce.Do(func() { close(s.ready) })
+
+	return nil
+}
+
+// Ready is closed when the first SVID is received.
+func (s *Source) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// SVID returns the current SVID.
+func (s *Source) SVID() (*SVID, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.svid == nil {
+		return nil, errors.New("SPIFFE X.509 SVID not available")
+	}
+	return s.svid, nil
+}
+
+// GetClientCertificate can be used as tls.Config.GetClientCertificate to present the current SVID.
+func (s *Source) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	svid, err := s.SVID()
+	if err != nil {
+		return nil, err
+	}
+	return svid.Certificate, nil
+}
+
+// VerifyPeerCertificate returns a function that can be used as tls.Config.VerifyPeerCertificate,
+// it verifies that the peer presents an SVID issued by one of the trust domains known to the source.
+// The function is intended for connections with InsecureSkipVerify set or ClientAuth set to RequireAnyClientCert,
+// as SVIDs do not contain DNS names.
+// If match is not nil, the peer SPIFFE ID must match too.
+func (s *Source) VerifyPeerCertificate(match func(id string) bool) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		id, err := s.verify(rawCerts)
+		if err != nil {
+			return err
+		}
+		if match != nil && !match(id.String()) {
+			return fmt.Errorf("SPIFFE ID %s is not allowed", id)
+		}
+		return nil
+	}
+}
+
+func (s *Source) verify(rawCerts [][]byte) (*url.URL, error) {
+	if len(rawCerts) == 0 {
+		return nil, errors.New("no certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		c, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, err
+		}
+		certs[i] = c
+	}
+
+	leaf := certs[0]
+	id, err := spiffeID(leaf)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	roots := s.bundles[id.Host]
+	s.mu.RUnlock()
+	if roots == nil {
+		return nil, fmt.Errorf("no trust bundle for trust domain %s", id.Host)
+	}
+
+	inter := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		inter.AddCert(c)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: inter,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return nil, err
+	}
+
+	return id, nil
+}
+
+func (s *Source) Close() error {
+	return s.conn.Close()
+}
+
+func spiffeID(c *x509.Certificate) (*url.URL, error) {
+	if len(c.URIs) != 1 || c.URIs[0].Scheme != "spiffe" || c.URIs[0].Host == "" {
+		return nil, errors.New("certificate is not an X.509 SVID: expected a single spiffe URI SAN")
+	}
+	return c.URIs[0], nil
+}
+
+func parseBundle(der []byte) (*x509.CertPool, error) {
+	certs, err := x509.ParseCertificates(der)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("empty bundle")
+	}
+	p := x509.NewCertPool()
+	for _, c := range certs {
+		p.AddCert(c)
+	}
+	return p, nil
+}
+
+func (v *x509SVID) parse() (*SVID, *x509.CertPool, error) {
+	certs, err := x509.ParseCertificates(v.certs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("certificates: %w", err)
+	}
+	if len(certs) == 0 {
+		return nil, nil, errors.New("no certificates")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(v.key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("private key: %w", err)
+	}
+	if _, ok := key.(crypto.Signer); !ok {
+		return nil, nil, errors.New("private key is not a signer")
+	}
+	id, err := spiffeID(certs[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	if v.id != "" && v.id != id.String() {
+		return nil, nil, fmt.Errorf("SPIFFE ID %s does not match certificate ID %s", v.id, id)
+	}
+	bundle, err := parseBundle(v.bundle)
+	if err != nil {
+		return nil, nil, fmt.Errorf("bundle: %w", err)
+	}
+
+	cert := &tls.Certificate{
+		PrivateKey: key,
+		Leaf:       certs[0],
+	}
+	for _, c := range certs {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+
+	return &SVID{ID: id, Certificate: cert}, bundle, nil
+}
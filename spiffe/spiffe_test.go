@@ -0,0 +1,256 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package spiffe
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, td string) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: td},
+		URIs:                  []*url.URL{{Scheme: "spiffe", Host: td}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) issue(t *testing.T, id string) (certDER, keyDER []byte) {
+	t.Helper()
+
+	u, err := url.Parse(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		URIs:         []*url.URL{u},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	certDER, err = x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err = x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certDER, keyDER
+}
+
+func encodeX509SVIDResponse(id string, certDER, keyDER, bundle []byte) rawMessage {
+	var svid []byte
+	svid = protowire.AppendTag(svid, 1, protowire.BytesType)
+	svid = protowire.AppendString(svid, id)
+	svid = protowire.AppendTag(svid, 2, protowire.BytesType)
+	svid = protowire.AppendBytes(svid, certDER)
+	svid = protowire.AppendTag(svid, 3, protowire.BytesType)
+	svid = protowire.AppendBytes(svid, keyDER)
+	svid = protowire.AppendTag(svid, 4, protowire.BytesType)
+	svid = protowire.AppendBytes(svid, bundle)
+
+	var res []byte
+	res = protowire.AppendTag(res, 1, protowire.BytesType)
+	res = protowire.AppendBytes(res, svid)
+	return res
+}
+
+// startWorkloadAPI starts a fake Workload API sending responses from the channel.
+func startWorkloadAPI(t *testing.T, responses <-chan rawMessage) string {
+	t.Helper()
+
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := grpc.NewServer(grpc.ForceServerCodec(rawCodec{}), grpc.UnknownServiceHandler(func(_ any, stream grpc.ServerStream) error {
+		if m, _ := grpc.MethodFromServerStream(stream); m != fetchX509SVIDMethod {
+			t.Errorf("unexpected method %s", m)
+		}
+		if md, _ := metadata.FromIncomingContext(stream.Context()); len(md.Get("workload.spiffe.io")) == 0 {
+			t.Error("missing workload.spiffe.io header")
+		}
+		var req rawMessage
+		if err := stream.RecvMsg(&req); err != nil {
+			return err
+		}
+		for {
+			select {
+			case <-stream.Context().Done():
+				return nil
+			case res := <-responses:
+				if err := stream.SendMsg(&res); err != nil {
+					return err
+				}
+			}
+		}
+	}))
+	go s.Serve(l) //nolint:errcheck // test server
+	t.Cleanup(s.Stop)
+
+	return "unix://" + sock
+}
+
+func TestSource(t *testing.T) {
+	const id = "spiffe://example.org/forwarder"
+
+	ca := newTestCA(t, "example.org")
+	responses := make(chan rawMessage, 1)
+	addr := startWorkloadAPI(t, responses)
+
+	src, err := NewSource(addr, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go src.Run(ctx) //nolint:errcheck // returns nil on cancel
+
+	if _, err := src.GetClientCertificate(nil); err == nil {
+		t.Fatal("expected error before the first SVID")
+	}
+
+	certDER, keyDER := ca.issue(t, id)
+	responses <- encodeX509SVIDResponse(id, certDER, keyDER, ca.cert.Raw)
+
+	select {
+	case <-src.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for SVID")
+	}
+
+	svid, err := src.SVID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svid.ID.String() != id {
+		t.Fatalf("got ID %s, want %s", svid.ID, id)
+	}
+
+	t.Run("verify", func(t *testing.T) {
+		peer, _ := ca.issue(t, "spiffe://example.org/client")
+		if err := src.VerifyPeerCertificate(nil)([][]byte{peer}, nil); err != nil {
+			t.Fatal(err)
+		}
+		match := func(id string) bool { return id == "spiffe://example.org/other" }
+		if err := src.VerifyPeerCertificate(match)([][]byte{peer}, nil); err == nil {
+			t.Fatal("expected error for not allowed ID")
+		}
+
+		other, _ := newTestCA(t, "example.org").issue(t, "spiffe://example.org/client")
+		if err := src.VerifyPeerCertificate(nil)([][]byte{other}, nil); err == nil {
+			t.Fatal("expected error for untrusted issuer")
+		}
+
+		foreign, _ := newTestCA(t, "example.com").issue(t, "spiffe://example.com/client")
+		if err := src.VerifyPeerCertificate(nil)([][]byte{foreign}, nil); err == nil {
+			t.Fatal("expected error for unknown trust domain")
+		}
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		certDER, keyDER := ca.issue(t, id)
+		responses <- encodeX509SVIDResponse(id, certDER, keyDER, ca.cert.Raw)
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			c, err := src.GetClientCertificate(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(c.Certificate[0]) == string(certDER) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("timeout waiting for rotated SVID")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+func TestGRPCTarget(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+		err bool
+	}{
+		{in: "unix:///run/spire/agent.sock", out: "unix:///run/spire/agent.sock"},
+		{in: "tcp://127.0.0.1:8081", out: "passthrough:///127.0.0.1:8081"},
+		{in: "unix://run/agent.sock", err: true},
+		{in: "http://127.0.0.1:8081", err: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.in, func(t *testing.T) {
+			got, err := grpcTarget(tc.in)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.out {
+				t.Fatalf("got %q, want %q", got, tc.out)
+			}
+		})
+	}
+}
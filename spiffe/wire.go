@@ -0,0 +1,154 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package spiffe
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The Workload API messages are decoded from the protobuf wire format directly,
+// the relevant part of workload.proto is:
+//
+//	message X509SVIDRequest {}
+//
+//	message X509SVIDResponse {
+//	  repeated X509SVID svids = 1;
+//	  repeated bytes crl = 2;
+//	  map<string, bytes> federated_bundles = 3;
+//	}
+//
+//	message X509SVID {
+//	  string spiffe_id = 1;
+//	  bytes x509_svid = 2;
+//	  bytes x509_svid_key = 3;
+//	  bytes bundle = 4;
+//	  string hint = 5;
+//	}
+//
+//	service SpiffeWorkloadAPI {
+//	  rpc FetchX509SVID(X509SVIDRequest) returns (stream X509SVIDResponse);
+//	}
+
+// rawMessage is a protobuf message in the wire format.
+type rawMessage []byte
+
+// rawCodec passes rawMessage through without encoding.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(*rawMessage)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", v)
+	}
+	return *m, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(*rawMessage)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+	*m = append((*m)[:0], data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+type x509SVIDResponse struct {
+	svids            []x509SVID
+	federatedBundles map[string][]byte
+}
+
+type x509SVID struct {
+	id     string
+	certs  []byte
+	key    []byte
+	bundle []byte
+}
+
+func parseX509SVIDResponse(b []byte) (*x509SVIDResponse, error) {
+	res := new(x509SVIDResponse)
+	err := parseFields(b, func(num protowire.Number, v []byte) error {
+		switch num {
+		case 1:
+			var s x509SVID
+			if err := parseFields(v, s.setField); err != nil {
+				return fmt.Errorf("svid: %w", err)
+			}
+			res.svids = append(res.svids, s)
+		case 3:
+			var k string
+			var b []byte
+			if err := parseFields(v, func(num protowire.Number, v []byte) error {
+				switch num {
+				case 1:
+					k = string(v)
+				case 2:
+					b = v
+				}
+				return nil
+			}); err != nil {
+				return fmt.Errorf("federated bundle: %w", err)
+			}
+			if res.federatedBundles == nil {
+				res.federatedBundles = make(map[string][]byte)
+			}
+			res.federatedBundles[k] = b
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (s *x509SVID) setField(num protowire.Number, v []byte) error {
+	switch num {
+	case 1:
+		s.id = string(v)
+	case 2:
+		s.certs = v
+	case 3:
+		s.key = v
+	case 4:
+		s.bundle = v
+	}
+	return nil
+}
+
+// parseFields calls fn for every length-delimited field of the message, other fields are skipped.
+func parseFields(b []byte, fn func(num protowire.Number, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := fn(num, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
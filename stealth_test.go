@@ -0,0 +1,61 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestStealth(t *testing.T) {
+	var got http.Header
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req.Header.Clone()
+		w.Header().Set("Via", "1.1 upstream")
+		w.Header().Set("X-Forwarded-For", "10.0.0.1")
+		w.Header().Set("X-Custom", "value")
+	}))
+	defer origin.Close()
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.ProxyLocalhost = AllowProxyLocalhost
+	cfg.Stealth = true
+
+	tr, err := NewClientTransport(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	req, err := http.NewRequest(http.MethodGet, origin.URL, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Request-Id", "123")
+	req.Header.Set("Forwarded", "for=10.0.0.2")
+	req.Header.Set("X-Custom", "value")
+
+	res, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	for _, h := range []http.Header{got, res.Header} {
+		for _, k := range []string{"Via", "Forwarded", "X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "X-Request-Id"} {
+			if v := h.Get(k); v != "" {
+				t.Errorf("unexpected header %s: %s", k, v)
+			}
+		}
+		if h.Get("X-Custom") != "value" {
+			t.Errorf("expected X-Custom header, got %v", h)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// SubnetUpstream routes requests from clients in Subnet to Proxy.
+// If Proxy is nil, requests are sent directly.
+type SubnetUpstream struct {
+	Subnet netip.Prefix
+	Proxy  *url.URL
+}
+
+const subnetUpstreamDirect = "direct"
+
+// ParseSubnetUpstream parses <cidr>=<[protocol://]host:port|direct> string into SubnetUpstream.
+func ParseSubnetUpstream(val string) (SubnetUpstream, error) {
+	subnet, proxy, ok := strings.Cut(val, "=")
+	if !ok {
+		return SubnetUpstream{}, errors.New("expected <cidr>=<proxy|direct>")
+	}
+
+	p, err := netip.ParsePrefix(subnet)
+	if err != nil {
+		return SubnetUpstream{}, err
+	}
+	su := SubnetUpstream{Subnet: p.Masked()}
+
+	if proxy != subnetUpstreamDirect {
+		u, err := ParseProxyURL(proxy)
+		if err != nil {
+			return SubnetUpstream{}, err
+		}
+		su.Proxy = u
+	}
+
+	return su, nil
+}
+
+func (su SubnetUpstream) String() string {
+	if su.Proxy == nil {
+		return su.Subnet.String() + "=" + subnetUpstreamDirect
+	}
+	return su.Subnet.String() + "=" + su.Proxy.Redacted()
+}
+
+func (su SubnetUpstream) Validate() error {
+	return validateProxyURL(su.Proxy)
+}
+
+// subnetUpstream routes requests based on the client address,
+// requests from clients not matching any subnet are routed using fn.
+func (hp *HTTPProxy) subnetUpstream(fn ProxyFunc) ProxyFunc {
+	subnets := make([]SubnetUpstream, len(hp.config.UpstreamProxyBySubnet))
+	for i, su := range hp.config.UpstreamProxyBySubnet {
+		if su.Proxy != nil {
+			u := new(url.URL)
+			*u = *su.Proxy
+			if u.User == nil {
+				u.User = hp.creds.MatchURL(u)
+			}
+			su.Proxy = u
+		}
+		hp.log.Infof("using upstream proxy for client subnet: %s", su)
+		subnets[i] = su
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		ap, err := netip.ParseAddrPort(req.RemoteAddr)
+		if err == nil {
+			addr := ap.Addr().Unmap()
+			for _, su := range subnets {
+				if su.Subnet.Contains(addr) {
+					ruleTraceFromContext(req.Context()).add("client-subnet", su.Subnet.String())
+					return su.Proxy, nil
+				}
+			}
+		}
+
+		if fn == nil {
+			return nil, nil
+		}
+		return fn(req)
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saucelabs/forwarder/log"
+	"golang.org/x/net/http/httpproxy"
+)
+
+type SystemProxyConfig struct {
+	// RefreshInterval is the interval at which the system proxy settings are re-read.
+	// Zero means that the settings are read only once at startup.
+	RefreshInterval time.Duration
+}
+
+func DefaultSystemProxyConfig() *SystemProxyConfig {
+	return &SystemProxyConfig{
+		RefreshInterval: 1 * time.Minute,
+	}
+}
+
+// systemProxy selects the upstream proxy based on the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+// If none of HTTP_PROXY and HTTPS_PROXY is set, the OS proxy settings are used on Windows and macOS.
+type systemProxy struct {
+	config SystemProxyConfig
+	log    log.Logger
+
+	// testingLoad, if set, replaces loadSystemProxyConfig.
+	testingLoad func() (*httpproxy.Config, error)
+
+	mu  sync.RWMutex
+	cfg httpproxy.Config
+	fn  func(*url.URL) (*url.URL, error)
+}
+
+func newSystemProxy(cfg *SystemProxyConfig, log log.Logger) *systemProxy {
+	return &systemProxy{
+		config: *cfg,
+		log:    log,
+		fn:     func(*url.URL) (*url.URL, error) { return nil, nil },
+	}
+}
+
+func (sp *systemProxy) load() (*httpproxy.Config, error) {
+	if sp.testingLoad != nil {
+		return sp.testingLoad()
+	}
+	return loadSystemProxyConfig()
+}
+
+// refresh re-reads the system proxy settings and logs if they changed.
+func (sp *systemProxy) refresh() error {
+	cfg, err := sp.load()
+	if err != nil {
+		return err
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	if *cfg == sp.cfg {
+		return nil
+	}
+	sp.cfg = *cfg
+	sp.fn = cfg.ProxyFunc()
+	sp.log.Infof("system proxy settings http_proxy=%s https_proxy=%s no_proxy=%s",
+		redactProxyString(cfg.HTTPProxy), redactProxyString(cfg.HTTPSProxy), cfg.NoProxy)
+
+	return nil
+}
+
+func (sp *systemProxy) run(ctx context.Context) {
+	if sp.config.RefreshInterval <= 0 {
+		return
+	}
+
+	t := time.NewTicker(sp.config.RefreshInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := sp.refresh(); err != nil {
+				sp.log.Errorf("failed to read system proxy settings: %s", err)
+			}
+		}
+	}
+}
+
+func (sp *systemProxy) proxyURL(u *url.URL) (*url.URL, error) {
+	sp.mu.RLock()
+	fn := sp.fn
+	sp.mu.RUnlock()
+
+	p, err := fn(u)
+	if p == nil || err != nil {
+		return nil, err
+	}
+
+	proxyURL := new(url.URL)
+	*proxyURL = *p
+	return proxyURL, nil
+}
+
+func (hp *HTTPProxy) systemProxyFunc(r *http.Request) (*url.URL, error) {
+	proxyURL, err := hp.systemProxy.proxyURL(r.URL)
+	if proxyURL == nil || err != nil {
+		return nil, err
+	}
+
+	t := ruleTraceFromContext(r.Context())
+	t.add("system-proxy", proxyURL.Redacted())
+	if proxyURL.User == nil {
+		if u, mask := hp.creds.matchURL(proxyURL); u != nil {
+			proxyURL.User = u
+			t.addUserinfo("upstream-credentials", u, mask)
+		}
+	}
+
+	return proxyURL, nil
+}
+
+// loadSystemProxyConfig returns the proxy settings from the environment,
+// or from the OS settings if no proxy is set in the environment.
+func loadSystemProxyConfig() (*httpproxy.Config, error) {
+	cfg := httpproxy.FromEnvironment()
+	if cfg.HTTPProxy != "" || cfg.HTTPSProxy != "" {
+		return cfg, nil
+	}
+
+	ocfg, err := osProxyConfig()
+	if err != nil {
+		return nil, err
+	}
+	if ocfg == nil {
+		return cfg, nil
+	}
+	return ocfg, nil
+}
+
+func redactProxyString(s string) string {
+	if s == "" {
+		return s
+	}
+	u, err := ParseProxyURL(s)
+	if err != nil {
+		return s
+	}
+	return u.Redacted()
+}
+
+// parseScutilProxy parses the output of `scutil --proxy` on macOS.
+func parseScutilProxy(out string) *httpproxy.Config {
+	kv := make(map[string]string)
+	var exceptions []string
+
+	inExceptions := false
+	s := bufio.NewScanner(strings.NewReader(out))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		k, v, ok := strings.Cut(line, " : ")
+		switch {
+		case line == "}":
+			inExceptions = false
+		case !ok:
+		case inExceptions:
+			exceptions = append(exceptions, v)
+		case k == "ExceptionsList":
+			inExceptions = true
+		default:
+			kv[k] = v
+		}
+	}
+
+	hostPort := func(prefix string) string {
+		if kv[prefix+"Enable"] != "1" || kv[prefix+"Proxy"] == "" {
+			return ""
+		}
+		if p := kv[prefix+"Port"]; p != "" {
+			return kv[prefix+"Proxy"] + ":" + p
+		}
+		return kv[prefix+"Proxy"]
+	}
+
+	cfg := &httpproxy.Config{
+		HTTPProxy:  hostPort("HTTP"),
+		HTTPSProxy: hostPort("HTTPS"),
+	}
+	if cfg.HTTPProxy == "" && cfg.HTTPSProxy == "" {
+		if p := hostPort("SOCKS"); p != "" {
+			cfg.HTTPProxy = "socks5://" + p
+			cfg.HTTPSProxy = cfg.HTTPProxy
+		}
+	}
+	if cfg.HTTPProxy == "" && cfg.HTTPSProxy == "" {
+		return nil
+	}
+	cfg.NoProxy = strings.Join(exceptions, ",")
+
+	return cfg
+}
+
+// parseWindowsProxy parses the ProxyServer and ProxyOverride values of the Windows Internet Settings.
+// The server is either host:port used for all protocols, or a list of protocol=host:port separated by semicolons.
+func parseWindowsProxy(server, override string) *httpproxy.Config {
+	cfg := new(httpproxy.Config)
+
+	if !strings.Contains(server, "=") {
+		cfg.HTTPProxy = server
+		cfg.HTTPSProxy = server
+	} else {
+		var socks string
+		for _, e := range strings.Split(server, ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(e), "=")
+			switch strings.ToLower(k) {
+			case "http":
+				cfg.HTTPProxy = v
+			case "https":
+				cfg.HTTPSProxy = v
+			case "socks":
+				socks = "socks5://" + v
+			}
+		}
+		if cfg.HTTPProxy == "" && cfg.HTTPSProxy == "" && socks != "" {
+			cfg.HTTPProxy = socks
+			cfg.HTTPSProxy = socks
+		}
+	}
+	if cfg.HTTPProxy == "" && cfg.HTTPSProxy == "" {
+		return nil
+	}
+
+	var np []string
+	for _, e := range strings.Split(override, ";") {
+		// <local> bypasses hosts without a dot, it cannot be expressed in NO_PROXY.
+		if e = strings.TrimSpace(e); e != "" && e != "<local>" {
+			np = append(np, e)
+		}
+	}
+	cfg.NoProxy = strings.Join(np, ",")
+
+	return cfg
+}
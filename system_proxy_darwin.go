@@ -0,0 +1,24 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+//go:build darwin
+
+package forwarder
+
+import (
+	"fmt"
+	"os/exec"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+func osProxyConfig() (*httpproxy.Config, error) {
+	out, err := exec.Command("scutil", "--proxy").Output()
+	if err != nil {
+		return nil, fmt.Errorf("scutil: %w", err)
+	}
+	return parseScutilProxy(string(out)), nil
+}
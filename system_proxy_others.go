@@ -0,0 +1,18 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+//go:build !darwin && !windows
+
+package forwarder
+
+import (
+	"golang.org/x/net/http/httpproxy"
+)
+
+// osProxyConfig returns nil as there are no OS proxy settings, the environment is used.
+func osProxyConfig() (*httpproxy.Config, error) {
+	return nil, nil //nolint:nilnil // no proxy configured
+}
@@ -0,0 +1,162 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"golang.org/x/net/http/httpproxy"
+)
+
+func TestParseScutilProxy(t *testing.T) {
+	const out = `<dictionary> {
+  ExceptionsList : <array> {
+    0 : *.local
+    1 : 169.254/16
+  }
+  FTPPassive : 1
+  HTTPEnable : 1
+  HTTPPort : 3128
+  HTTPProxy : proxy.example.com
+  HTTPSEnable : 1
+  HTTPSPort : 3129
+  HTTPSProxy : proxy.example.com
+  SOCKSEnable : 0
+}
+`
+	want := &httpproxy.Config{
+		HTTPProxy:  "proxy.example.com:3128",
+		HTTPSProxy: "proxy.example.com:3129",
+		NoProxy:    "*.local,169.254/16",
+	}
+	if diff := cmp.Diff(want, parseScutilProxy(out)); diff != "" {
+		t.Fatalf("unexpected config (-want +got):\n%s", diff)
+	}
+
+	if cfg := parseScutilProxy("<dictionary> {\n  HTTPEnable : 0\n}\n"); cfg != nil {
+		t.Fatalf("expected nil config, got %+v", cfg)
+	}
+}
+
+func TestParseWindowsProxy(t *testing.T) {
+	tests := []struct {
+		name     string
+		server   string
+		override string
+		want     *httpproxy.Config
+	}{
+		{
+			name:     "single",
+			server:   "proxy:8080",
+			override: "*.example.com;<local>",
+			want: &httpproxy.Config{
+				HTTPProxy:  "proxy:8080",
+				HTTPSProxy: "proxy:8080",
+				NoProxy:    "*.example.com",
+			},
+		},
+		{
+			name:   "per protocol",
+			server: "http=proxy:8080;https=proxy:8443;ftp=proxy:21",
+			want: &httpproxy.Config{
+				HTTPProxy:  "proxy:8080",
+				HTTPSProxy: "proxy:8443",
+			},
+		},
+		{
+			name:   "socks",
+			server: "socks=proxy:1080",
+			want: &httpproxy.Config{
+				HTTPProxy:  "socks5://proxy:1080",
+				HTTPSProxy: "socks5://proxy:1080",
+			},
+		},
+		{
+			name:   "empty",
+			server: "",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, parseWindowsProxy(tc.server, tc.override)); diff != "" {
+				t.Fatalf("unexpected config (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLoadSystemProxyConfigFromEnvironment(t *testing.T) {
+	t.Setenv("HTTP_PROXY", "http://proxy:3128")
+	t.Setenv("HTTPS_PROXY", "")
+	t.Setenv("NO_PROXY", "example.com")
+
+	cfg, err := loadSystemProxyConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.HTTPProxy != "http://proxy:3128" || cfg.NoProxy != "example.com" {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+}
+
+func TestSystemProxyRefresh(t *testing.T) {
+	cfg := &httpproxy.Config{
+		HTTPProxy: "proxy1:3128",
+		NoProxy:   "direct.com",
+	}
+
+	sp := newSystemProxy(&SystemProxyConfig{}, stdlog.Default())
+	sp.testingLoad = func() (*httpproxy.Config, error) {
+		c := *cfg
+		return &c, nil
+	}
+
+	proxyFor := func(s string) string {
+		t.Helper()
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := sp.proxyURL(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p == nil {
+			return "direct"
+		}
+		return p.String()
+	}
+
+	if got := proxyFor("http://example.com"); got != "direct" {
+		t.Fatalf("before refresh: got %s, want direct", got)
+	}
+
+	if err := sp.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if got := proxyFor("http://example.com"); got != "http://proxy1:3128" {
+		t.Fatalf("got %s, want http://proxy1:3128", got)
+	}
+	if got := proxyFor("http://direct.com"); got != "direct" {
+		t.Fatalf("got %s, want direct", got)
+	}
+	if got := proxyFor("https://example.com"); got != "direct" {
+		t.Fatalf("got %s, want direct", got)
+	}
+
+	cfg.HTTPProxy = "proxy2:3128"
+	if err := sp.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if got := proxyFor("http://example.com"); got != "http://proxy2:3128" {
+		t.Fatalf("after change: got %s, want http://proxy2:3128", got)
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+//go:build windows
+
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/sys/windows/registry"
+)
+
+func osProxyConfig() (*httpproxy.Config, error) {
+	k, err := registry.OpenKey(registry.CURRENT_USER, `Software\Microsoft\Windows\CurrentVersion\Internet Settings`, registry.QUERY_VALUE)
+	if err != nil {
+		return nil, fmt.Errorf("open internet settings: %w", err)
+	}
+	defer k.Close()
+
+	enable, _, err := k.GetIntegerValue("ProxyEnable")
+	if err != nil && !errors.Is(err, registry.ErrNotExist) {
+		return nil, fmt.Errorf("read ProxyEnable: %w", err)
+	}
+	if enable == 0 {
+		return nil, nil //nolint:nilnil // no proxy configured
+	}
+
+	server, _, err := k.GetStringValue("ProxyServer")
+	if err != nil {
+		return nil, fmt.Errorf("read ProxyServer: %w", err)
+	}
+	override, _, err := k.GetStringValue("ProxyOverride")
+	if err != nil && !errors.Is(err, registry.ErrNotExist) {
+		return nil, fmt.Errorf("read ProxyOverride: %w", err)
+	}
+
+	return parseWindowsProxy(server, override), nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// TCPForward forwards connections accepted on ListenAddress to Target through the proxy.
+type TCPForward struct {
+	ListenAddress string
+	// ListenTLS terminates TLS on the listener using the proxy TLS certificate.
+	ListenTLS bool
+
+	Target string
+	// TargetTLS originates TLS to the target.
+	TargetTLS bool
+}
+
+// ParseTCPForward parses a forward in the format "[tls://]<listen address>=[tls://]<host:port>".
+func ParseTCPForward(val string) (TCPForward, error) {
+	listen, target, ok := strings.Cut(val, "=")
+	if !ok {
+		return TCPForward{}, errors.New("expected format [tls://]<listen address>=[tls://]<host:port>")
+	}
+
+	var f TCPForward
+	f.ListenAddress, f.ListenTLS = strings.CutPrefix(listen, "tls://")
+	f.Target, f.TargetTLS = strings.CutPrefix(target, "tls://")
+
+	return f, f.Validate()
+}
+
+func (f TCPForward) Validate() error {
+	if _, _, err := net.SplitHostPort(f.ListenAddress); err != nil {
+		return fmt.Errorf("listen address: %w", err)
+	}
+	host, port, err := net.SplitHostPort(f.Target)
+	if err != nil {
+		return fmt.Errorf("target: %w", err)
+	}
+	if host == "" {
+		return errors.New("target: missing host")
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return fmt.Errorf("target: invalid port %q", port)
+	}
+	return nil
+}
+
+func (f TCPForward) String() string {
+	s := f.ListenAddress
+	if f.ListenTLS {
+		s = "tls://" + s
+	}
+	s += "="
+	if f.TargetTLS {
+		s += "tls://"
+	}
+	return s + f.Target
+}
+
+// tcpForwardListener serves connections as CONNECT requests to the forward target,
+// the proxy applies the same rules and upstream proxy selection as for HTTP clients.
+type tcpForwardListener struct {
+	net.Listener
+	forward TCPForward
+	user    *url.Userinfo
+}
+
+func (l *tcpForwardListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &connectConn{
+		Conn:      conn,
+		handshake: l.handshake,
+	}, nil
+}
+
+func (l *tcpForwardListener) handshake() ([]byte, error) {
+	h := make(http.Header)
+	if l.forward.TargetTLS {
+		h.Set("X-Martian-Terminate-Tls", "true")
+	}
+	if l.user != nil {
+		r := http.Request{Header: make(http.Header)}
+		p, _ := l.user.Password()
+		r.SetBasicAuth(l.user.Username(), p)
+		h.Set("Proxy-Authorization", r.Header.Get("Authorization"))
+	}
+	return connectRequest(l.forward.Target, h), nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestParseTCPForward(t *testing.T) {
+	tests := []struct {
+		input string
+		want  TCPForward
+		err   bool
+	}{
+		{input: "0.0.0.0:5432=db.internal:5432", want: TCPForward{ListenAddress: "0.0.0.0:5432", Target: "db.internal:5432"}},
+		{input: "tls://:8443=tls://example.com:443", want: TCPForward{ListenAddress: ":8443", ListenTLS: true, Target: "example.com:443", TargetTLS: true}},
+		{input: "0.0.0.0:5432", err: true},
+		{input: "0.0.0.0:5432=db.internal", err: true},
+		{input: "0.0.0.0:5432=:5432", err: true},
+		{input: "0.0.0.0:5432=db.internal:0", err: true},
+	}
+	for _, tc := range tests {
+		got, err := ParseTCPForward(tc.input)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected error", tc.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.input, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%q: got %+v, want %+v", tc.input, got, tc.want)
+		}
+		if got.String() != tc.input {
+			t.Errorf("%q: String() = %q", tc.input, got.String())
+		}
+	}
+}
+
+func TestTCPForward(t *testing.T) {
+	echo, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				// Server speaks first, like many database protocols.
+				io.WriteString(c, "hello\n") //nolint:errcheck // test server
+				io.Copy(c, c)                //nolint:errcheck // test server
+			}()
+		}
+	}()
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.Address = "localhost:0"
+	cfg.DenyDomains = MatchFunc(func(host string) bool { return host == "denied.local" })
+	cfg.TCPForwards = []TCPForward{
+		{ListenAddress: "localhost:0", Target: echo.Addr().String()},
+		{ListenAddress: "localhost:0", Target: "denied.local:80"},
+	}
+
+	run := func(t *testing.T, cfg *HTTPProxyConfig) []string {
+		t.Helper()
+		cfg.PromRegistry = prometheus.NewRegistry()
+		p, err := NewHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		go p.Run(ctx) //nolint:errcheck // returns on cancel
+
+		addrs, _ := p.Addr()
+		if len(addrs) != 3 {
+			t.Fatalf("got %d listeners, want 3", len(addrs))
+		}
+		return addrs
+	}
+
+	t.Run("localhost denied", func(t *testing.T) {
+		addrs := run(t, cfg)
+		c, err := net.Dial("tcp", addrs[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if b, _ := io.ReadAll(c); len(b) != 0 {
+			t.Fatalf("got %q, want connection closed", b)
+		}
+	})
+
+	cfg.ProxyLocalhost = AllowProxyLocalhost
+	addrs := run(t, cfg)
+
+	t.Run("forward", func(t *testing.T) {
+		c, err := net.Dial("tcp", addrs[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		buf := make([]byte, len("hello\n"))
+		if _, err := io.ReadFull(c, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != "hello\n" {
+			t.Fatalf("got %q", buf)
+		}
+		if _, err := io.WriteString(c, "ping"); err != nil {
+			t.Fatal(err)
+		}
+		buf = buf[:4]
+		if _, err := io.ReadFull(c, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != "ping" {
+			t.Fatalf("got %q", buf)
+		}
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		c, err := net.Dial("tcp", addrs[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if b, _ := io.ReadAll(c); len(b) != 0 {
+			t.Fatalf("got %q, want connection closed", b)
+		}
+	})
+}
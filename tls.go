@@ -9,13 +9,76 @@ package forwarder
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"time"
 
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/spiffe"
 	"github.com/saucelabs/forwarder/utils/certutil"
 )
 
+// KeyExchange selects TLS key exchange mechanisms.
+type KeyExchange string
+
+const (
+	// KeyExchangeDefault uses the Go defaults, which include post-quantum hybrid key exchanges from Go 1.24.
+	KeyExchangeDefault KeyExchange = "default"
+
+	// KeyExchangeHybrid prefers the X25519MLKEM768 post-quantum hybrid key exchange, it requires Go 1.24 or later.
+	KeyExchangeHybrid KeyExchange = "hybrid"
+
+	// KeyExchangeClassic disables post-quantum key exchanges.
+	KeyExchangeClassic KeyExchange = "classic"
+)
+
+func (k KeyExchange) String() string {
+	if k == "" {
+		return string(KeyExchangeDefault)
+	}
+	return string(k)
+}
+
+func (k KeyExchange) configureTLSConfig(tlsCfg *tls.Config) error {
+	switch k {
+	case "", KeyExchangeDefault:
+	case KeyExchangeHybrid:
+		if hybridCurvePreferences == nil {
+			return errors.New("hybrid key exchange requires Go 1.24 or later")
+		}
+		tlsCfg.CurvePreferences = hybridCurvePreferences
+	case KeyExchangeClassic:
+		tlsCfg.CurvePreferences = []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521}
+	default:
+		return fmt.Errorf("unknown key exchange %q", k)
+	}
+
+	return nil
+}
+
+// ClientAuth selects how a server authenticates clients with TLS certificates.
+type ClientAuth string
+
+const (
+	// ClientAuthNone does not request client certificates.
+	ClientAuthNone ClientAuth = "none"
+
+	// ClientAuthRequest requests a client certificate and verifies it if the client presents one.
+	ClientAuthRequest ClientAuth = "request"
+
+	// ClientAuthRequire requires a valid client certificate.
+	ClientAuthRequire ClientAuth = "require"
+)
+
+func (a ClientAuth) String() string {
+	if a == "" {
+		return string(ClientAuthNone)
+	}
+	return string(a)
+}
+
 type TLSClientConfig struct {
 	// HandshakeTimeout specifies the maximum amount of time waiting to
 	// wait for a TLS handshake. Zero means no timeout.
@@ -37,12 +100,22 @@ type TLSClientConfig struct {
 	// in NSS key log format that can be used to allow external programs
 	// such as Wireshark to decrypt TLS connections.
 	KeyLogFile string
+
+	// SessionCacheSize is the number of TLS sessions cached for resumption,
+	// sessions are cached per server name.
+	// Resumed connections skip the full handshake, which cuts latency and CPU for repeated connections to the same origins.
+	// Zero disables the cache.
+	SessionCacheSize int
+
+	// KeyExchange selects key exchange mechanisms.
+	KeyExchange KeyExchange
 }
 
 func DefaultTLSClientConfig() *TLSClientConfig {
 	return &TLSClientConfig{
 		HandshakeTimeout: 10 * time.Second,
 		KeyLogFile:       os.Getenv("SSLKEYLOGFILE"),
+		SessionCacheSize: 1024,
 	}
 }
 
@@ -90,6 +163,14 @@ func (c *TLSClientConfig) ConfigureTLSConfig(tlsCfg *tls.Config) error {
 		tlsCfg.KeyLogWriter = f
 	}
 
+	if c.SessionCacheSize > 0 {
+		tlsCfg.ClientSessionCache = tls.NewLRUClientSessionCache(c.SessionCacheSize)
+	}
+
+	if err := c.KeyExchange.configureTLSConfig(tlsCfg); err != nil {
+		return fmt.Errorf("key exchange: %w", err)
+	}
+
 	return nil
 }
 
@@ -128,16 +209,98 @@ type TLSServerConfig struct {
 
 	// KeyFile is the path to the TLS private key of the certificate.
 	KeyFile string
+
+	// KeyExchange selects key exchange mechanisms.
+	KeyExchange KeyExchange
+
+	// SPIFFE, if set, requires clients to present X.509 SVIDs issued by the trust domains of the source.
+	SPIFFE *spiffe.Source
+
+	// SPIFFEIDs limits accepted client SPIFFE IDs, if nil all IDs from trusted domains are accepted.
+	SPIFFEIDs Matcher
+
+	// ClientCAFile is the path to the CA certificates used to verify client certificates.
+	ClientCAFile string
+
+	// ClientAuth selects if client certificates are requested or required, it requires ClientCAFile.
+	ClientAuth ClientAuth
 }
 
 func (c *TLSServerConfig) ConfigureTLSConfig(tlsCfg *tls.Config) error {
 	if err := c.loadCertificate(tlsCfg); err != nil {
 		return fmt.Errorf("load certificate: %w", err)
 	}
+	if err := c.configureClientAuth(tlsCfg); err != nil {
+		return fmt.Errorf("client auth: %w", err)
+	}
+	if c.SPIFFE != nil {
+		var match func(string) bool
+		if c.SPIFFEIDs != nil {
+			match = c.SPIFFEIDs.Match
+		}
+		tlsCfg.ClientAuth = tls.RequireAnyClientCert
+		tlsCfg.VerifyPeerCertificate = c.SPIFFE.VerifyPeerCertificate(match)
+	}
+	if err := c.KeyExchange.configureTLSConfig(tlsCfg); err != nil {
+		return fmt.Errorf("key exchange: %w", err)
+	}
+
+	return nil
+}
+
+func (c *TLSServerConfig) configureClientAuth(tlsCfg *tls.Config) error {
+	switch c.ClientAuth {
+	case "", ClientAuthNone:
+		if c.ClientCAFile != "" {
+			return errors.New("client CA file is set, but client auth is none")
+		}
+		return nil
+	case ClientAuthRequest, ClientAuthRequire:
+	default:
+		return fmt.Errorf("unknown client auth %q", c.ClientAuth)
+	}
+
+	if c.ClientCAFile == "" {
+		return errors.New("client CA file is required")
+	}
+	if c.SPIFFE != nil {
+		return errors.New("client CA file cannot be used with SPIFFE")
+	}
+
+	b, err := ReadFileOrBase64(c.ClientCAFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return fmt.Errorf("append certificate %q", c.ClientCAFile)
+	}
+	tlsCfg.ClientCAs = pool
+
+	if c.ClientAuth == ClientAuthRequire {
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
 
 	return nil
 }
 
+// ProxyClientCertificate returns the verified certificate the client presented when connecting to the proxy,
+// or nil if the client did not present one.
+// For requests read from MITMed connections, it is the certificate of the connection to the proxy,
+// not of the MITMed connection.
+func ProxyClientCertificate(req *http.Request) *x509.Certificate {
+	cs := martian.ContextClientTLS(req.Context())
+	if cs == nil {
+		cs = req.TLS
+	}
+	if cs == nil || len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+	return cs.PeerCertificates[0]
+}
+
 func (c *TLSServerConfig) loadCertificate(tlsCfg *tls.Config) error {
 	var (
 		cert tls.Certificate
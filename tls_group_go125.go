@@ -0,0 +1,19 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+//go:build go1.25
+
+package forwarder
+
+import "crypto/tls"
+
+// tlsGroup returns the name of the negotiated key exchange group.
+func tlsGroup(cs *tls.ConnectionState) string {
+	if cs.CurveID == 0 {
+		return "none"
+	}
+	return cs.CurveID.String()
+}
@@ -0,0 +1,20 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+//go:build go1.24
+
+package forwarder
+
+import "crypto/tls"
+
+// hybridCurvePreferences prefers the X25519MLKEM768 post-quantum hybrid key exchange,
+// the standardized successor of X25519Kyber768Draft00.
+var hybridCurvePreferences = []tls.CurveID{
+	tls.X25519MLKEM768,
+	tls.X25519,
+	tls.CurveP256,
+	tls.CurveP384,
+}
@@ -0,0 +1,14 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+//go:build !go1.24
+
+package forwarder
+
+import "crypto/tls"
+
+// hybridCurvePreferences is nil as post-quantum hybrid key exchanges cannot be configured before Go 1.24.
+var hybridCurvePreferences []tls.CurveID
@@ -8,10 +8,14 @@ package forwarder
 
 import (
 	"crypto/tls"
+	"encoding/base64"
 	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/saucelabs/forwarder/utils/certutil"
 	"golang.org/x/net/netutil"
 )
@@ -84,3 +88,109 @@ func tls12ServerTLSConfig(t *testing.T, cipherSuite uint16) *tls.Config {
 	}
 	return &tlsCfg
 }
+
+func TestTLSClientConfigSessionCache(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+
+	reg := prometheus.NewRegistry()
+	cfg := DefaultHTTPTransportConfig()
+	cfg.Insecure = true
+	cfg.PromRegistry = reg
+	tr, err := NewHTTPTransport(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.DisableKeepAlives = true
+	defer tr.CloseIdleConnections()
+
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodGet, s.URL, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]float64{}
+	for _, mf := range mfs {
+		if mf.GetName() != "tls_client_handshakes_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "resumed" {
+					got[l.GetValue()] = m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	if got["false"] != 1 || got["true"] != 1 {
+		t.Fatalf("expected one full and one resumed handshake, got %v", got)
+	}
+}
+
+func TestKeyExchangeConfigureTLSConfig(t *testing.T) {
+	for _, k := range []KeyExchange{"", KeyExchangeDefault, KeyExchangeClassic, KeyExchangeHybrid} {
+		t.Run(k.String(), func(t *testing.T) {
+			var tlsCfg tls.Config
+			err := k.configureTLSConfig(&tlsCfg)
+			if k == KeyExchangeHybrid && hybridCurvePreferences == nil {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if k.String() == string(KeyExchangeDefault) && tlsCfg.CurvePreferences != nil {
+				t.Fatalf("expected default curve preferences, got %v", tlsCfg.CurvePreferences)
+			}
+			if k != KeyExchangeDefault && k != "" && len(tlsCfg.CurvePreferences) == 0 {
+				t.Fatal("expected curve preferences")
+			}
+		})
+	}
+
+	var tlsCfg tls.Config
+	if err := KeyExchange("foo").configureTLSConfig(&tlsCfg); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestTLSServerConfigClientAuthValidation(t *testing.T) {
+	caPEM, _ := newTestClientCA(t)
+	ca := "data:base64," + base64.StdEncoding.EncodeToString(caPEM)
+
+	tests := []struct {
+		name    string
+		cfg     TLSServerConfig
+		wantErr bool
+	}{
+		{name: "none", cfg: TLSServerConfig{}},
+		{name: "ca without auth", cfg: TLSServerConfig{ClientCAFile: ca}, wantErr: true},
+		{name: "auth without ca", cfg: TLSServerConfig{ClientAuth: ClientAuthRequire}, wantErr: true},
+		{name: "request", cfg: TLSServerConfig{ClientCAFile: ca, ClientAuth: ClientAuthRequest}},
+		{name: "require", cfg: TLSServerConfig{ClientCAFile: ca, ClientAuth: ClientAuthRequire}},
+		{name: "unknown", cfg: TLSServerConfig{ClientCAFile: ca, ClientAuth: "foo"}, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var tlsCfg tls.Config
+			err := tc.cfg.configureClientAuth(&tlsCfg)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("configureClientAuth(): got %v, want error %t", err, tc.wantErr)
+			}
+		})
+	}
+}
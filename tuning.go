@@ -0,0 +1,83 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"fmt"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/internal/martian/mitm"
+)
+
+// Tuning holds resource dependent defaults derived from the memory limit and the number of CPUs,
+// so that the defaults fit a small sidecar as well as a large gateway.
+type Tuning struct {
+	MemoryLimit SizeSuffix
+	Procs       int
+
+	// BufferSize is the size of the buffers used to copy bodies and tunnel data,
+	// and of the read and write buffers of upstream connections.
+	BufferSize          SizeSuffix
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MITMCacheSize       uint32
+	TLSSessionCacheSize int
+}
+
+// DefaultTuning returns the static defaults used when the memory limit is unknown.
+func DefaultTuning() Tuning {
+	return Tuning{
+		BufferSize:          martian.DefaultCopyBufferSize,
+		MaxIdleConnsPerHost: DefaultHTTPTransportConfig().MaxIdleConnsPerHost,
+		MITMCacheSize:       mitm.DefaultCacheConfig().Capacity,
+		TLSSessionCacheSize: DefaultTLSClientConfig().SessionCacheSize,
+	}
+}
+
+// NewTuning derives the tuning from the memory limit in bytes and the number of CPUs (GOMAXPROCS).
+// If the memory limit is not positive, DefaultTuning is returned.
+//
+// The memory budget is split as follows:
+// 5% for idle upstream connections, each holding a read and a write buffer,
+// 2% for the MITM certificate cache and 1% for the TLS session cache.
+func NewTuning(memoryLimit int64, procs int) Tuning {
+	t := DefaultTuning()
+	t.Procs = procs
+	if memoryLimit <= 0 {
+		return t
+	}
+	t.MemoryLimit = SizeSuffix(memoryLimit)
+
+	switch {
+	case memoryLimit < 512*int64(Mebi):
+		t.BufferSize = 16 * Kibi
+	case memoryLimit < 8*int64(Gibi):
+		t.BufferSize = 32 * Kibi
+	default:
+		t.BufferSize = 64 * Kibi
+	}
+
+	const (
+		mitmCertSize   = 8 * 1024
+		tlsSessionSize = 4 * 1024
+	)
+	t.MaxIdleConns = clampInt(memoryLimit/20/int64(2*t.BufferSize), 64, 65536)
+	t.MaxIdleConnsPerHost = clampInt(int64(t.MaxIdleConns/4), 16, int64(max(procs, 1)*256))
+	t.MITMCacheSize = uint32(clampInt(memoryLimit/50/mitmCertSize, 256, 1<<20)) //nolint:gosec // clamped
+	t.TLSSessionCacheSize = clampInt(memoryLimit/100/tlsSessionSize, 256, 1<<20)
+
+	return t
+}
+
+func clampInt(v, lo, hi int64) int {
+	return int(min(max(v, lo), hi))
+}
+
+func (t Tuning) String() string {
+	return fmt.Sprintf("memory_limit=%s procs=%d buffer_size=%s max_idle_conns=%d max_idle_conns_per_host=%d mitm_cache_size=%d tls_session_cache_size=%d",
+		t.MemoryLimit, t.Procs, t.BufferSize, t.MaxIdleConns, t.MaxIdleConnsPerHost, t.MITMCacheSize, t.TLSSessionCacheSize)
+}
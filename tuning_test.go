@@ -0,0 +1,43 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"testing"
+)
+
+func TestNewTuning(t *testing.T) {
+	if got, want := NewTuning(0, 4), DefaultTuning(); got.BufferSize != want.BufferSize ||
+		got.MaxIdleConnsPerHost != want.MaxIdleConnsPerHost || got.MITMCacheSize != want.MITMCacheSize {
+		t.Fatalf("no memory limit: got %s, want %s", got, want)
+	}
+
+	small := NewTuning(256*int64(Mebi), 1)
+	large := NewTuning(32*int64(Gibi), 16)
+	t.Logf("small: %s", small)
+	t.Logf("large: %s", large)
+
+	if small.BufferSize != 16*Kibi || large.BufferSize != 64*Kibi {
+		t.Errorf("buffer size: got %s and %s", small.BufferSize, large.BufferSize)
+	}
+	if small.MaxIdleConns >= large.MaxIdleConns {
+		t.Errorf("max idle conns does not scale: %d >= %d", small.MaxIdleConns, large.MaxIdleConns)
+	}
+	if small.MaxIdleConnsPerHost > small.MaxIdleConns || small.MaxIdleConnsPerHost > 256 {
+		t.Errorf("max idle conns per host: %d", small.MaxIdleConnsPerHost)
+	}
+	if small.MITMCacheSize >= large.MITMCacheSize || small.TLSSessionCacheSize >= large.TLSSessionCacheSize {
+		t.Errorf("cache sizes do not scale: %s, %s", small, large)
+	}
+
+	// The idle connection buffers fit in 5% of the memory limit.
+	for _, tu := range []Tuning{small, large} {
+		if mem := int64(tu.MaxIdleConns) * 2 * int64(tu.BufferSize); mem > int64(tu.MemoryLimit)/20 {
+			t.Errorf("%s: idle connection buffers use %d bytes", tu, mem)
+		}
+	}
+}
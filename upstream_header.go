@@ -0,0 +1,94 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+)
+
+// upstreamHeaderDirect is the upstream header value that sends the request directly.
+const upstreamHeaderDirect = "direct"
+
+// upstreamOverride is the upstream proxy selected with the upstream header, nil proxy means direct.
+type upstreamOverride struct {
+	proxy *url.URL
+}
+
+type upstreamOverrideKey struct{}
+
+func upstreamOverrideFromContext(ctx context.Context) *upstreamOverride {
+	o, _ := ctx.Value(upstreamOverrideKey{}).(*upstreamOverride)
+	return o
+}
+
+// parseUpstreamHeader parses <[protocol://][user:pass@]host:port|direct> header value.
+func parseUpstreamHeader(val string) (*url.URL, error) {
+	if val == upstreamHeaderDirect {
+		return nil, nil
+	}
+
+	return ParseProxyURL(val)
+}
+
+// upstreamHeader reads the upstream proxy override from the upstream header.
+// MITMed requests without the header use the header of the CONNECT request.
+// The header is removed from the request so that it is not sent upstream,
+// CONNECT requests keep it as their headers are not forwarded.
+func (hp *HTTPProxy) upstreamHeader() martian.RequestModifier {
+	h := hp.config.UpstreamProxyHeader
+
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		val := req.Header.Get(h)
+		if val == "" {
+			val = martian.ContextConnectHeader(req.Context()).Get(h)
+		} else if req.Method != http.MethodConnect {
+			req.Header.Del(h)
+		}
+		if val == "" {
+			return nil
+		}
+
+		u, err := parseUpstreamHeader(val)
+		if err != nil {
+			return martian.ErrorStatus{
+				Err:    fmt.Errorf("invalid %s header: %w", h, err),
+				Status: http.StatusBadRequest,
+			}
+		}
+		if u != nil && u.User == nil {
+			u.User = hp.creds.MatchURL(u)
+		}
+
+		*req = *req.WithContext(context.WithValue(req.Context(), upstreamOverrideKey{}, &upstreamOverride{proxy: u}))
+		return nil
+	})
+}
+
+// upstreamHeaderProxy routes requests with the upstream header to the proxy from the header,
+// other requests are routed using fn.
+func (hp *HTTPProxy) upstreamHeaderProxy(fn ProxyFunc) ProxyFunc {
+	return func(req *http.Request) (*url.URL, error) {
+		if o := upstreamOverrideFromContext(req.Context()); o != nil {
+			if o.proxy == nil {
+				ruleTraceFromContext(req.Context()).add("upstream-header", upstreamHeaderDirect)
+			} else {
+				ruleTraceFromContext(req.Context()).add("upstream-header", o.proxy.Redacted())
+			}
+			return o.proxy, nil
+		}
+
+		if fn == nil {
+			return nil, nil
+		}
+		return fn(req)
+	}
+}
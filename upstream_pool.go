@@ -0,0 +1,339 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/log"
+)
+
+// UpstreamPoolStrategy is the algorithm used to select an upstream proxy for a request.
+type UpstreamPoolStrategy string
+
+const (
+	// UpstreamPoolLatency routes requests to the upstream with the lowest score.
+	UpstreamPoolLatency UpstreamPoolStrategy = "latency"
+	// UpstreamPoolRoundRobin routes requests to the upstreams in turn.
+	UpstreamPoolRoundRobin UpstreamPoolStrategy = "round-robin"
+	// UpstreamPoolLeastConn routes requests to the upstream with the fewest active requests,
+	// a CONNECT request is active until the tunnel is closed.
+	UpstreamPoolLeastConn UpstreamPoolStrategy = "least-conn"
+)
+
+func (s UpstreamPoolStrategy) String() string {
+	return string(s)
+}
+
+// UpstreamPoolConfig configures routing across multiple upstream proxies.
+// With the latency strategy, requests are routed to the preferred upstream, the one with the lowest score.
+// The score is the exponentially weighted moving average (EWMA) of the latency
+// plus the EWMA of the error rate multiplied by ErrorPenalty.
+// The latency is the time from selecting the upstream until response headers are received,
+// for CONNECT requests it is the time to establish the tunnel.
+// The scores are maintained with all strategies.
+type UpstreamPoolConfig struct {
+	// Proxies is the list of upstream proxies.
+	Proxies []*url.URL
+
+	// Strategy is the algorithm used to select an upstream.
+	Strategy UpstreamPoolStrategy
+
+	// Decay is the weight of the latest sample in the moving averages, in range (0, 1].
+	// Higher values make the scores react faster to changes.
+	Decay float64
+
+	// ErrorPenalty is the latency equivalent of a failed request.
+	ErrorPenalty time.Duration
+
+	// Hysteresis is the relative score improvement required to switch the preferred upstream,
+	// it prevents flapping between upstreams with similar scores.
+	Hysteresis float64
+
+	// ProbeRate is the fraction of requests routed to other upstreams, so that their scores are kept up to date.
+	ProbeRate float64
+}
+
+func DefaultUpstreamPoolConfig() *UpstreamPoolConfig {
+	return &UpstreamPoolConfig{
+		Strategy:     UpstreamPoolLatency,
+		Decay:        0.2,
+		ErrorPenalty: 10 * time.Second,
+		Hysteresis:   0.2,
+		ProbeRate:    0.05,
+	}
+}
+
+func (c *UpstreamPoolConfig) Validate() error {
+	if len(c.Proxies) < 2 {
+		return errors.New("at least two proxies are required")
+	}
+	for _, u := range c.Proxies {
+		if err := validateProxyURL(u); err != nil {
+			return fmt.Errorf("%s: %w", u.Redacted(), err)
+		}
+	}
+	switch c.Strategy {
+	case UpstreamPoolLatency, UpstreamPoolRoundRobin, UpstreamPoolLeastConn:
+	default:
+		return fmt.Errorf("unsupported strategy: %s", c.Strategy)
+	}
+	if c.Decay <= 0 || c.Decay > 1 {
+		return errors.New("decay must be in range (0, 1]")
+	}
+	if c.ErrorPenalty < 0 {
+		return errors.New("error penalty must be non-negative")
+	}
+	if c.Hysteresis < 0 || c.Hysteresis >= 1 {
+		return errors.New("hysteresis must be in range [0, 1)")
+	}
+	if c.ProbeRate < 0 || c.ProbeRate > 1 {
+		return errors.New("probe rate must be in range [0, 1]")
+	}
+	return nil
+}
+
+// UpstreamScore is the routing state of an upstream proxy.
+type UpstreamScore struct {
+	Proxy     string  `json:"proxy"`
+	Preferred bool    `json:"preferred"`
+	Score     float64 `json:"score_ms"`
+	Latency   float64 `json:"latency_ms"`
+	ErrorRate float64 `json:"error_rate"`
+	Requests  int64   `json:"requests"`
+	Errors    int64   `json:"errors"`
+	Active    int64   `json:"active"`
+}
+
+type poolUpstream struct {
+	url *url.URL
+
+	latency  float64 // EWMA in milliseconds
+	errRate  float64 // EWMA of 0 or 1
+	requests int64
+	errors   int64
+	active   int64
+}
+
+type upstreamPool struct {
+	cfg       *UpstreamPoolConfig
+	log       log.Logger
+	upstreams []*poolUpstream
+
+	mu        sync.Mutex
+	preferred int
+	next      int
+}
+
+func newUpstreamPool(cfg *UpstreamPoolConfig, proxies []*url.URL, log log.Logger) *upstreamPool {
+	p := &upstreamPool{
+		cfg: cfg,
+		log: log,
+	}
+	for _, u := range proxies {
+		p.upstreams = append(p.upstreams, &poolUpstream{url: u})
+	}
+	return p
+}
+
+func (p *upstreamPool) score(u *poolUpstream) float64 {
+	return u.latency + u.errRate*float64(p.cfg.ErrorPenalty.Milliseconds())
+}
+
+func (p *upstreamPool) pick() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch p.cfg.Strategy {
+	case UpstreamPoolRoundRobin:
+		i := p.next
+		p.next = (p.next + 1) % len(p.upstreams)
+		return i
+	case UpstreamPoolLeastConn:
+		// Start from the next upstream in turn, so that ties are spread evenly.
+		best := p.next
+		for j := range p.upstreams {
+			i := (p.next + j) % len(p.upstreams)
+			if p.upstreams[i].active < p.upstreams[best].active {
+				best = i
+			}
+		}
+		p.next = (best + 1) % len(p.upstreams)
+		return best
+	}
+
+	if p.cfg.ProbeRate > 0 && rand.Float64() < p.cfg.ProbeRate { //nolint:gosec // not security sensitive
+		// Pick one of the other upstreams uniformly.
+		i := rand.IntN(len(p.upstreams) - 1) //nolint:gosec // not security sensitive
+		if i >= p.preferred {
+			i++
+		}
+		return i
+	}
+	return p.preferred
+}
+
+func (p *upstreamPool) observe(i int, latency time.Duration, failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	u := p.upstreams[i]
+	ms := float64(latency) / float64(time.Millisecond)
+	e := 0.0
+	if failed {
+		e = 1
+		u.errors++
+	}
+	if u.requests == 0 {
+		u.latency, u.errRate = ms, e
+	} else {
+		d := p.cfg.Decay
+		u.latency = d*ms + (1-d)*u.latency
+		u.errRate = d*e + (1-d)*u.errRate
+	}
+	u.requests++
+
+	best := p.preferred
+	for j, v := range p.upstreams {
+		if p.score(v) < p.score(p.upstreams[best]) {
+			best = j
+		}
+	}
+	cur := p.upstreams[p.preferred]
+	if best != p.preferred && p.score(p.upstreams[best]) < p.score(cur)*(1-p.cfg.Hysteresis) {
+		p.log.Infof("preferred upstream proxy changed from=%s to=%s score_ms=%.1f->%.1f",
+			cur.url.Redacted(), p.upstreams[best].url.Redacted(), p.score(cur), p.score(p.upstreams[best]))
+		p.preferred = best
+	}
+}
+
+// Scores returns the routing state of the upstream proxies.
+func (p *upstreamPool) Scores() []UpstreamScore {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := make([]UpstreamScore, len(p.upstreams))
+	for i, u := range p.upstreams {
+		s[i] = UpstreamScore{
+			Proxy:     u.url.Redacted(),
+			Preferred: p.cfg.Strategy == UpstreamPoolLatency && i == p.preferred,
+			Score:     p.score(u),
+			Latency:   u.latency,
+			ErrorRate: u.errRate,
+			Requests:  u.requests,
+			Errors:    u.errors,
+			Active:    u.active,
+		}
+	}
+	return s
+}
+
+func (p *upstreamPool) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.Scores()) //nolint:errcheck // ignore error
+}
+
+// upstreamChoice is the upstream selected for a request,
+// it is attached to the request context so that the outcome can be attributed to the upstream.
+type upstreamChoice struct {
+	idx      int
+	start    time.Time
+	done     bool
+	released bool
+}
+
+type upstreamChoiceKey struct{}
+
+func upstreamChoiceFromContext(ctx context.Context) *upstreamChoice {
+	c, _ := ctx.Value(upstreamChoiceKey{}).(*upstreamChoice)
+	return c
+}
+
+// proxyFunc returns the upstream for the request, the choice is kept for the whole request.
+func (p *upstreamPool) proxyFunc(req *http.Request) (*url.URL, error) {
+	c := upstreamChoiceFromContext(req.Context())
+	if c == nil {
+		return p.upstreams[p.pick()].url, nil
+	}
+	if c.idx < 0 {
+		c.idx = p.pick()
+		c.start = time.Now()
+		p.mu.Lock()
+		p.upstreams[c.idx].active++
+		p.mu.Unlock()
+		ruleTraceFromContext(req.Context()).add("upstream-pool", p.upstreams[c.idx].url.Redacted())
+	}
+	return p.upstreams[c.idx].url, nil
+}
+
+func (p *upstreamPool) ModifyRequest(req *http.Request) error {
+	*req = *req.WithContext(context.WithValue(req.Context(), upstreamChoiceKey{}, &upstreamChoice{idx: -1}))
+	return nil
+}
+
+func (p *upstreamPool) ModifyResponse(res *http.Response) error {
+	p.done(res.Request, false)
+	return nil
+}
+
+// done records the outcome of the request if an upstream was selected for it.
+func (p *upstreamPool) done(req *http.Request, failed bool) {
+	c := upstreamChoiceFromContext(req.Context())
+	if c == nil || c.idx < 0 || c.done {
+		return
+	}
+	c.done = true
+	p.observe(c.idx, time.Since(c.start), failed)
+}
+
+// release ends the request started by the choice in the request context.
+func (p *upstreamPool) release(req *http.Request) {
+	c := upstreamChoiceFromContext(req.Context())
+	if c == nil || c.idx < 0 || c.released {
+		return
+	}
+	c.released = true
+
+	p.mu.Lock()
+	p.upstreams[c.idx].active--
+	p.mu.Unlock()
+}
+
+// wrapTrace returns a trace that counts active requests and calls the hooks of t if not nil.
+// Requests that establish a tunnel are active until the tunnel is closed.
+func (p *upstreamPool) wrapTrace(t *martian.ProxyTrace) *martian.ProxyTrace {
+	var wt martian.ProxyTrace
+	if t != nil {
+		wt.ReadRequest = t.ReadRequest
+	}
+	wt.WroteResponse = func(info martian.WroteResponseInfo) {
+		if info.Res != nil && info.Res.Request != nil && !info.Tunnel {
+			p.release(info.Res.Request)
+		}
+		if t != nil && t.WroteResponse != nil {
+			t.WroteResponse(info)
+		}
+	}
+	wt.ClosedTunnel = func(info martian.ClosedTunnelInfo) {
+		if info.Res != nil && info.Res.Request != nil {
+			p.release(info.Res.Request)
+		}
+		if t != nil && t.ClosedTunnel != nil {
+			t.ClosedTunnel(info)
+		}
+	}
+	return &wt
+}
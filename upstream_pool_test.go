@@ -0,0 +1,179 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func newTestUpstreamPool(t *testing.T, hosts ...string) *upstreamPool {
+	t.Helper()
+
+	cfg := DefaultUpstreamPoolConfig()
+	cfg.ProbeRate = 0
+	for _, h := range hosts {
+		cfg.Proxies = append(cfg.Proxies, &url.URL{Scheme: "http", Host: h})
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return newUpstreamPool(cfg, cfg.Proxies, stdlog.Default())
+}
+
+func TestUpstreamPoolPreferFaster(t *testing.T) {
+	p := newTestUpstreamPool(t, "a:3128", "b:3128")
+
+	p.observe(0, 100*time.Millisecond, false)
+	p.observe(1, 50*time.Millisecond, false)
+	if p.preferred != 1 {
+		t.Fatalf("preferred: got %d, want 1", p.preferred)
+	}
+
+	// Within hysteresis, no switch.
+	p.observe(0, 40*time.Millisecond, false) // a: 0.2*40+0.8*100 = 88
+	p.observe(0, 40*time.Millisecond, false) // a: 78.4
+	p.observe(0, 40*time.Millisecond, false) // a: 70.7
+	p.observe(0, 40*time.Millisecond, false) // a: 64.6
+	if p.preferred != 1 {
+		t.Fatalf("preferred: got %d, want 1", p.preferred)
+	}
+
+	// Errors make the upstream unattractive.
+	p.observe(1, 50*time.Millisecond, true)
+	if p.preferred != 0 {
+		t.Fatalf("preferred: got %d, want 0", p.preferred)
+	}
+
+	s := p.Scores()
+	if !s[0].Preferred || s[1].Errors != 1 || s[1].Requests != 2 {
+		t.Fatalf("unexpected scores: %+v", s)
+	}
+}
+
+func TestUpstreamPoolProbe(t *testing.T) {
+	p := newTestUpstreamPool(t, "a:3128", "b:3128", "c:3128")
+	p.cfg.ProbeRate = 1
+
+	for range 100 {
+		if i := p.pick(); i == p.preferred {
+			t.Fatalf("probe picked the preferred upstream")
+		}
+	}
+}
+
+func TestUpstreamPoolRequestChoice(t *testing.T) {
+	p := newTestUpstreamPool(t, "a:3128", "b:3128")
+	p.cfg.ProbeRate = 0.5
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+	if err := p.ModifyRequest(req); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := p.proxyFunc(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 10 {
+		v, err := p.proxyFunc(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != u {
+			t.Fatalf("got %s, want %s", v, u)
+		}
+	}
+
+	p.done(req, true)
+	if err := p.ModifyResponse(&http.Response{Request: req}); err != nil {
+		t.Fatal(err)
+	}
+
+	var requests, errors int64
+	for _, s := range p.Scores() {
+		requests += s.Requests
+		errors += s.Errors
+	}
+	if requests != 1 || errors != 1 {
+		t.Fatalf("got requests=%d errors=%d, want 1 and 1", requests, errors)
+	}
+}
+
+func TestUpstreamPoolRoundRobin(t *testing.T) {
+	p := newTestUpstreamPool(t, "a:3128", "b:3128", "c:3128")
+	p.cfg.Strategy = UpstreamPoolRoundRobin
+
+	for i := range 6 {
+		if got := p.pick(); got != i%3 {
+			t.Fatalf("pick %d: got %d, want %d", i, got, i%3)
+		}
+	}
+}
+
+func TestUpstreamPoolLeastConn(t *testing.T) {
+	p := newTestUpstreamPool(t, "a:3128", "b:3128", "c:3128")
+	p.cfg.Strategy = UpstreamPoolLeastConn
+
+	start := func() *http.Request {
+		req := httptest.NewRequest(http.MethodConnect, "http://example.com:443", http.NoBody)
+		if err := p.ModifyRequest(req); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.proxyFunc(req); err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+	idx := func(req *http.Request) int {
+		return upstreamChoiceFromContext(req.Context()).idx
+	}
+
+	// Ties are spread evenly.
+	reqs := []*http.Request{start(), start(), start()}
+	for i, req := range reqs {
+		if idx(req) != i {
+			t.Fatalf("request %d: got upstream %d", i, idx(req))
+		}
+	}
+
+	// The next request goes to the upstream with no active requests.
+	wrapped := p.wrapTrace(nil)
+	wrapped.WroteResponse(martian.WroteResponseInfo{Res: &http.Response{Request: reqs[1]}})
+	wrapped.WroteResponse(martian.WroteResponseInfo{Res: &http.Response{Request: reqs[1]}}) // released once
+	if req := start(); idx(req) != 1 {
+		t.Fatalf("got upstream %d, want 1", idx(req))
+	}
+
+	var active int64
+	for _, s := range p.Scores() {
+		active += s.Active
+		if s.Preferred {
+			t.Fatalf("unexpected preferred upstream with least-conn strategy: %+v", s)
+		}
+	}
+	if active != 3 {
+		t.Fatalf("got %d active requests, want 3", active)
+	}
+
+	// A CONNECT tunnel is active until it is closed.
+	res := &http.Response{Request: reqs[0]}
+	wrapped.WroteResponse(martian.WroteResponseInfo{Res: res, Tunnel: true})
+	if a := p.Scores()[0].Active; a != 1 {
+		t.Fatalf("got %d active requests with an open tunnel, want 1", a)
+	}
+	wrapped.ClosedTunnel(martian.ClosedTunnelInfo{Res: res})
+	if req := start(); idx(req) != 0 {
+		t.Fatalf("got upstream %d, want 0", idx(req))
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// HostRewrite maps URLs with From host to To host.
+// The hosts may include a port, a host without a port matches URLs with any port,
+// the port is kept unless To has a port.
+type HostRewrite struct {
+	From string
+	To   string
+}
+
+// ParseHostRewrite parses <from>=<to> string into HostRewrite.
+func ParseHostRewrite(val string) (HostRewrite, error) {
+	from, to, ok := strings.Cut(val, "=")
+	if !ok {
+		return HostRewrite{}, errors.New("expected <from-host>=<to-host>")
+	}
+	hr := HostRewrite{From: strings.ToLower(from), To: to}
+	if err := hr.Validate(); err != nil {
+		return HostRewrite{}, err
+	}
+	return hr, nil
+}
+
+func (hr HostRewrite) String() string {
+	return hr.From + "=" + hr.To
+}
+
+func (hr HostRewrite) Validate() error {
+	for _, h := range []string{hr.From, hr.To} {
+		if h == "" {
+			return errors.New("host is required")
+		}
+		if strings.ContainsAny(h, "/?#@ ") {
+			return fmt.Errorf("invalid host %q", h)
+		}
+	}
+	return nil
+}
+
+// URLRewriteConfig configures rewriting of absolute URLs in response bodies,
+// so that pages recorded with production hosts work in isolated test networks with sandbox hosts.
+// Only responses visible to the proxy are rewritten, i.e. plain HTTP and MITMed HTTPS responses.
+type URLRewriteConfig struct {
+	// Hosts is the list of host mappings, the first matching mapping is applied.
+	Hosts []HostRewrite
+
+	// Domains limits rewriting to responses for matching hosts, if nil all hosts are rewritten.
+	Domains Matcher
+
+	// ContentTypes is the list of media types of rewritten responses.
+	// An entry ending with "/" matches all subtypes e.g. "text/".
+	ContentTypes []string
+
+	// MaxBodySize is the maximum size of a response body that is rewritten, larger responses are passed through.
+	MaxBodySize SizeSuffix
+}
+
+func DefaultURLRewriteConfig() *URLRewriteConfig {
+	return &URLRewriteConfig{
+		ContentTypes: []string{"text/html", "application/json"},
+		MaxBodySize:  5 * Mebi,
+	}
+}
+
+func (c *URLRewriteConfig) Validate() error {
+	if len(c.Hosts) == 0 {
+		return errors.New("hosts are required")
+	}
+	for _, hr := range c.Hosts {
+		if err := hr.Validate(); err != nil {
+			return fmt.Errorf("%s: %w", hr, err)
+		}
+	}
+	if c.MaxBodySize <= 0 {
+		return errors.New("max body size must be positive")
+	}
+	return nil
+}
+
+func (c *URLRewriteConfig) match(res *http.Response) bool {
+	if c.Domains != nil && !matchHost(c.Domains, res.Request.URL.Hostname()) {
+		return false
+	}
+	mt, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	for _, ct := range c.ContentTypes {
+		if mt == ct || (strings.HasSuffix(ct, "/") && strings.HasPrefix(mt, ct)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (hp *HTTPProxy) urlRewriteAcceptEncoding() RequestModifier {
+	cfg := hp.config.URLRewrite
+
+	return RequestModifierFunc(func(req *http.Request) error {
+		if req.Method == http.MethodConnect {
+			return nil
+		}
+		if cfg.Domains != nil && !matchHost(cfg.Domains, req.URL.Hostname()) {
+			return nil
+		}
+		limitAcceptEncoding(req)
+		return nil
+	})
+}
+
+func (hp *HTTPProxy) urlRewrite() ResponseModifier {
+	cfg := hp.config.URLRewrite
+
+	return ResponseModifierFunc(func(res *http.Response) error {
+		req := res.Request
+		if req.Method == http.MethodConnect {
+			return nil
+		}
+
+		// Redirects must point to the sandbox hosts too.
+		for _, h := range []string{"Location", "Content-Location"} {
+			if v := res.Header.Get(h); v != "" {
+				if b, n := rewriteURLHosts([]byte(v), cfg.Hosts); n > 0 {
+					res.Header.Set(h, string(b))
+				}
+			}
+		}
+
+		if req.Method == http.MethodHead || res.Body == nil || res.Body == http.NoBody || !cfg.match(res) {
+			return nil
+		}
+
+		body, ok, err := readBodyForRewrite(res, int64(cfg.MaxBodySize))
+		if err != nil {
+			return fmt.Errorf("url rewrite: %w", err)
+		}
+		if !ok {
+			hp.log.Debugf("url rewrite skipped url=%s: unsupported encoding or body larger than %s", req.URL.Redacted(), cfg.MaxBodySize)
+			return nil
+		}
+
+		body, n := rewriteURLHosts(body, cfg.Hosts)
+		if n > 0 {
+			hp.log.Debugf("url rewrite url=%s rewritten=%d", req.URL.Redacted(), n)
+		}
+		setRewrittenBody(res, body)
+
+		return nil
+	})
+}
+
+// rewriteURLHosts replaces hosts of absolute and protocol-relative URLs in doc, i.e. hosts following "//".
+// JSON escaped slashes "\/\/" are supported too.
+// A host matches only if it is followed by a character that cannot be part of a host name,
+// so that a mapping for example.com does not apply to example.com.evil.net.
+// It returns the rewritten document and the number of replacements.
+func rewriteURLHosts(doc []byte, hosts []HostRewrite) ([]byte, int) {
+	var (
+		out  []byte
+		last int
+		n    int
+	)
+
+	for i := 0; i < len(doc); {
+		var sep int
+		switch {
+		case bytes.HasPrefix(doc[i:], []byte("//")):
+			sep = 2
+		case bytes.HasPrefix(doc[i:], []byte(`\/\/`)):
+			sep = 4
+		default:
+			i++
+			continue
+		}
+
+		h := i + sep
+		i = h
+		for _, hr := range hosts {
+			end := h + len(hr.From)
+			if end > len(doc) || !bytes.EqualFold(doc[h:end], []byte(hr.From)) || !isHostBoundary(doc, end) {
+				continue
+			}
+			// The target port replaces the source port.
+			if !strings.Contains(hr.From, ":") && strings.Contains(hr.To, ":") && end < len(doc) && doc[end] == ':' {
+				end++
+				for end < len(doc) && doc[end] >= '0' && doc[end] <= '9' {
+					end++
+				}
+			}
+			out = append(out, doc[last:h]...)
+			out = append(out, hr.To...)
+			last, i = end, end
+			n++
+			break
+		}
+	}
+
+	if n == 0 {
+		return doc, 0
+	}
+	return append(out, doc[last:]...), n
+}
+
+func isHostBoundary(doc []byte, i int) bool {
+	if i == len(doc) {
+		return true
+	}
+	c := doc[i]
+	return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_')
+}
@@ -0,0 +1,124 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestParseHostRewrite(t *testing.T) {
+	tests := []struct {
+		in   string
+		want HostRewrite
+		err  bool
+	}{
+		{in: "API.example.com=api.sandbox.test", want: HostRewrite{From: "api.example.com", To: "api.sandbox.test"}},
+		{in: "example.com=sandbox:8080", want: HostRewrite{From: "example.com", To: "sandbox:8080"}},
+		{in: "example.com", err: true},
+		{in: "=sandbox", err: true},
+		{in: "https://example.com=sandbox", err: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.in, func(t *testing.T) {
+			got, err := ParseHostRewrite(tc.in)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRewriteURLHosts(t *testing.T) {
+	hosts := []HostRewrite{
+		{From: "example.com", To: "sandbox.test"},
+		{From: "cdn.example.com:8443", To: "cdn.sandbox.test"},
+		{From: "api.example.com", To: "api.sandbox.test:8080"},
+	}
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+		n    int
+	}{
+		{name: "absolute", in: `<a href="https://example.com/x">`, want: `<a href="https://sandbox.test/x">`, n: 1},
+		{name: "protocol relative", in: `<img src="//example.com/a.png">`, want: `<img src="//sandbox.test/a.png">`, n: 1},
+		{name: "case insensitive", in: `https://EXAMPLE.com`, want: `https://sandbox.test`, n: 1},
+		{name: "port kept", in: `http://example.com:8080/`, want: `http://sandbox.test:8080/`, n: 1},
+		{name: "port exact", in: `https://cdn.example.com:8443/a https://cdn.example.com/b`, want: `https://cdn.sandbox.test/a https://cdn.example.com/b`, n: 1},
+		{name: "port replaced", in: `https://api.example.com:443/v1`, want: `https://api.sandbox.test:8080/v1`, n: 1},
+		{name: "json escaped", in: `{"url":"https:\/\/example.com\/x"}`, want: `{"url":"https:\/\/sandbox.test\/x"}`, n: 1},
+		{name: "suffix", in: `https://example.com.evil.net/ https://www.example.com/`, want: `https://example.com.evil.net/ https://www.example.com/`},
+		{name: "not a url", in: `example.com`, want: `example.com`},
+		{name: "multiple", in: `//example.com //example.com`, want: `//sandbox.test //sandbox.test`, n: 2},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, n := rewriteURLHosts([]byte(tc.in), hosts)
+			if string(got) != tc.want {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+			if n != tc.n {
+				t.Fatalf("got %d replacements, want %d", n, tc.n)
+			}
+		})
+	}
+}
+
+func TestURLRewrite(t *testing.T) {
+	cfg := DefaultHTTPProxyConfig()
+	cfg.URLRewrite = DefaultURLRewriteConfig()
+	cfg.URLRewrite.Hosts = []HostRewrite{{From: "example.com", To: "sandbox.test"}}
+	hp, err := newHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := &http.Response{
+		StatusCode: http.StatusFound,
+		Header: http.Header{
+			"Content-Type": {"application/json"},
+			"Location":     {"https://example.com/login"},
+		},
+		Body:    io.NopCloser(strings.NewReader(`{"next":"https://example.com/"}`)),
+		Request: httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody),
+	}
+	if err := hp.urlRewrite().ModifyResponse(res); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := res.Header.Get("Location"); got != "https://sandbox.test/login" {
+		t.Fatalf("got Location %q", got)
+	}
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"next":"https://sandbox.test/"}`; string(b) != want {
+		t.Fatalf("got %q, want %q", b, want)
+	}
+	if res.ContentLength != int64(len(b)) {
+		t.Fatalf("got content length %d, want %d", res.ContentLength, len(b))
+	}
+}
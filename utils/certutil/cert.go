@@ -7,6 +7,7 @@
 package certutil
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/ed25519"
 	"crypto/elliptic"
@@ -15,15 +16,51 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"errors"
 	"fmt"
 	"math/big"
 	"net"
+	"strings"
 	"time"
 )
 
+// KeyType is the type of a generated private key.
+type KeyType string
+
+const (
+	KeyTypeRSA     KeyType = "rsa"
+	KeyTypeECDSA   KeyType = "ecdsa"
+	KeyTypeEd25519 KeyType = "ed25519"
+)
+
+func ParseKeyType(val string) (KeyType, error) {
+	switch kt := KeyType(strings.ToLower(val)); kt {
+	case KeyTypeRSA, KeyTypeECDSA, KeyTypeEd25519:
+		return kt, nil
+	default:
+		return "", fmt.Errorf("unknown key type %q, expected one of rsa, ecdsa, ed25519", val)
+	}
+}
+
+// GenerateKey generates a private key of the given type, RSA keys are 2048 bits and ECDSA keys use P-256 curve.
+func GenerateKey(kt KeyType) (crypto.Signer, error) {
+	switch kt {
+	case KeyTypeRSA:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyTypeECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	default:
+		return nil, fmt.Errorf("unknown key type %q", kt)
+	}
+}
+
 // SelfSignedCert specifies a self-signed certificate to be generated.
 type SelfSignedCert struct {
 	Hosts        []string
+	CommonName   string
 	Organization []string
 	ValidFrom    time.Time
 	ValidFor     time.Duration
@@ -52,8 +89,38 @@ func ECDSASelfSignedCert() *SelfSignedCert {
 	}
 }
 
+// SetKeyType sets the type of the generated key, RSA keys are 2048 bits and ECDSA keys use P-256 curve.
+func (c *SelfSignedCert) SetKeyType(kt KeyType) {
+	c.RsaBits = 0
+	c.EcdsaCurve = ""
+	c.Ed25519Key = false
+
+	switch kt {
+	case KeyTypeRSA:
+		c.RsaBits = 2048
+	case KeyTypeECDSA:
+		c.EcdsaCurve = "P256"
+	case KeyTypeEd25519:
+		c.Ed25519Key = true
+	}
+}
+
 // Gen generates a self-signed certificate, the implementation is based on https://golang.org/src/crypto/tls/generate_cert.go.
 func (c *SelfSignedCert) Gen() (tls.Certificate, error) {
+	return c.gen(nil)
+}
+
+// GenSignedBy generates a certificate signed by the CA certificate ca.
+// The certificate validity is limited to the validity of the CA certificate.
+// The returned certificate chain includes the CA certificate.
+func (c *SelfSignedCert) GenSignedBy(ca tls.Certificate) (tls.Certificate, error) {
+	if len(ca.Certificate) == 0 {
+		return tls.Certificate{}, errors.New("missing CA certificate")
+	}
+	return c.gen(&ca)
+}
+
+func (c *SelfSignedCert) gen(ca *tls.Certificate) (tls.Certificate, error) {
 	var cert tls.Certificate
 
 	priv, err := c.generateKey()
@@ -80,6 +147,7 @@ func (c *SelfSignedCert) Gen() (tls.Certificate, error) {
 	template := x509.Certificate{
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
+			CommonName:   c.CommonName,
 			Organization: c.Organization,
 		},
 		NotBefore: c.ValidFrom,
@@ -103,11 +171,28 @@ func (c *SelfSignedCert) Gen() (tls.Certificate, error) {
 		template.KeyUsage |= x509.KeyUsageCertSign
 	}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, publicKey(priv), priv)
+	parent, parentPriv := &template, priv
+	if ca != nil {
+		if parent, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+			return cert, fmt.Errorf("parse CA certificate %w", err)
+		}
+		if !parent.IsCA {
+			return cert, errors.New("certificate is not a CA")
+		}
+		parentPriv = ca.PrivateKey
+		if template.NotAfter.After(parent.NotAfter) {
+			template.NotAfter = parent.NotAfter
+		}
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, parent, publicKey(priv), parentPriv)
 	if err != nil {
 		return cert, fmt.Errorf("create certificate %w", err)
 	}
 	cert.Certificate = [][]byte{derBytes}
+	if ca != nil {
+		cert.Certificate = append(cert.Certificate, ca.Certificate[0])
+	}
 	cert.PrivateKey = priv
 
 	return cert, nil
@@ -67,3 +67,55 @@ func testCert(t *testing.T, cert *tls.Certificate) { //nolint:thelper // this is
 		t.Fatalf("http.Get() status code %d", resp.StatusCode)
 	}
 }
+
+func TestGenSignedBy(t *testing.T) {
+	for _, kt := range []KeyType{KeyTypeRSA, KeyTypeECDSA, KeyTypeEd25519} {
+		t.Run(string(kt), func(t *testing.T) {
+			ca := ECDSASelfSignedCert()
+			ca.SetKeyType(kt)
+			ca.CommonName = "Test CA"
+			ca.IsCA = true
+			caCert, err := ca.Gen()
+			if err != nil {
+				t.Fatalf("Gen() error %s", err)
+			}
+
+			c := ECDSASelfSignedCert()
+			c.SetKeyType(kt)
+			c.Hosts = []string{"127.0.0.1"}
+			c.ValidFor = 2 * ca.ValidFor
+			cert, err := c.GenSignedBy(caCert)
+			if err != nil {
+				t.Fatalf("GenSignedBy() error %s", err)
+			}
+			if len(cert.Certificate) != 2 {
+				t.Fatalf("GenSignedBy() got %d certificates, want 2", len(cert.Certificate))
+			}
+
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				t.Fatalf("x509.ParseCertificate() error %s", err)
+			}
+			root, err := x509.ParseCertificate(caCert.Certificate[0])
+			if err != nil {
+				t.Fatalf("x509.ParseCertificate() error %s", err)
+			}
+			if err := leaf.CheckSignatureFrom(root); err != nil {
+				t.Fatalf("CheckSignatureFrom() error %s", err)
+			}
+			if !leaf.NotAfter.Equal(root.NotAfter) {
+				t.Fatalf("NotAfter got %s, want CA expiry %s", leaf.NotAfter, root.NotAfter)
+			}
+		})
+	}
+}
+
+func TestGenSignedByNotCA(t *testing.T) {
+	parent, err := ECDSASelfSignedCert().Gen()
+	if err != nil {
+		t.Fatalf("Gen() error %s", err)
+	}
+	if _, err := ECDSASelfSignedCert().GenSignedBy(parent); err == nil {
+		t.Fatal("GenSignedBy() expected error")
+	}
+}
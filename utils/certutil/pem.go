@@ -0,0 +1,34 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package certutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+)
+
+// EncodePEM encodes the certificate chain and the PKCS#8 private key of cert in PEM format.
+func EncodePEM(cert tls.Certificate) (certPEM, keyPEM []byte, err error) {
+	for _, c := range cert.Certificate {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: c,
+		})...)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM = pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: der,
+	})
+
+	return certPEM, keyPEM, nil
+}
@@ -0,0 +1,330 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package certutil
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec // SHA-1 is only used for the local key ID
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"unicode/utf16"
+)
+
+var (
+	oidDataContentType     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidCertBag             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidPKCS8ShroudedKeyBag = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertTypeX509        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidLocalKeyID          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidPBES2               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA256      = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256CBC           = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidSHA256              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+)
+
+const (
+	pkcs12Iterations = 2048
+	pkcs12SaltLen    = 16
+)
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue
+	Attributes []pkcs12Attribute `asn1:"set,omitempty"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Data      []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int
+	PRF        pkix.AlgorithmIdentifier
+}
+
+// EncodePKCS12 encodes the certificate chain and the private key of cert in PKCS#12 format protected with password.
+// The private key is encrypted with PBES2 using PBKDF2 with HMAC-SHA256 and AES-256-CBC,
+// and the integrity of the file is protected with HMAC-SHA256, the certificates are not encrypted.
+// This matches the algorithms used by OpenSSL 3 by default.
+func EncodePKCS12(cert tls.Certificate, password string) ([]byte, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("missing certificate")
+	}
+
+	keyID := sha1.Sum(cert.Certificate[0]) //nolint:gosec // SHA-1 is used as an identifier only
+	localKeyID, err := pkcs12LocalKeyID(keyID[:])
+	if err != nil {
+		return nil, err
+	}
+
+	certBags := make([]safeBag, 0, len(cert.Certificate))
+	for i, c := range cert.Certificate {
+		b, err := asn1.Marshal(certBag{ID: oidCertTypeX509, Data: c})
+		if err != nil {
+			return nil, err
+		}
+		bag := safeBag{
+			ID:    oidCertBag,
+			Value: explicitTag0(b),
+		}
+		if i == 0 {
+			bag.Attributes = []pkcs12Attribute{localKeyID}
+		}
+		certBags = append(certBags, bag)
+	}
+
+	key, err := pkcs12EncryptKey(cert.PrivateKey, password)
+	if err != nil {
+		return nil, err
+	}
+	keyBags := []safeBag{{
+		ID:         oidPKCS8ShroudedKeyBag,
+		Value:      explicitTag0(key),
+		Attributes: []pkcs12Attribute{localKeyID},
+	}}
+
+	var authSafe []contentInfo
+	for _, bags := range [][]safeBag{certBags, keyBags} {
+		ci, err := dataContentInfo(bags)
+		if err != nil {
+			return nil, err
+		}
+		authSafe = append(authSafe, ci)
+	}
+	authSafeDER, err := asn1.Marshal(authSafe)
+	if err != nil {
+		return nil, err
+	}
+	authSafeContent, err := asn1.Marshal(authSafeDER)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, pkcs12SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, pkcs12MacKey(password, salt, pkcs12Iterations))
+	mac.Write(authSafeDER)
+
+	return asn1.Marshal(pfxPdu{
+		Version: 3,
+		AuthSafe: contentInfo{
+			ContentType: oidDataContentType,
+			Content:     explicitTag0(authSafeContent),
+		},
+		MacData: macData{
+			Mac: digestInfo{
+				Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+				Digest:    mac.Sum(nil),
+			},
+			MacSalt:    salt,
+			Iterations: pkcs12Iterations,
+		},
+	})
+}
+
+func explicitTag0(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+func pkcs12LocalKeyID(id []byte) (pkcs12Attribute, error) {
+	v, err := asn1.Marshal(id)
+	if err != nil {
+		return pkcs12Attribute{}, err
+	}
+	return pkcs12Attribute{
+		ID:    oidLocalKeyID,
+		Value: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: v},
+	}, nil
+}
+
+func dataContentInfo(bags []safeBag) (contentInfo, error) {
+	b, err := asn1.Marshal(bags)
+	if err != nil {
+		return contentInfo{}, err
+	}
+	data, err := asn1.Marshal(b)
+	if err != nil {
+		return contentInfo{}, err
+	}
+	return contentInfo{
+		ContentType: oidDataContentType,
+		Content:     explicitTag0(data),
+	}, nil
+}
+
+// pkcs12EncryptKey returns the DER encoded EncryptedPrivateKeyInfo of the key.
+func pkcs12EncryptKey(key any, password string) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, pkcs12SaltLen)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	const keyLen = 32
+	block, err := aes.NewCipher(pbkdf2SHA256([]byte(password), salt, pkcs12Iterations, keyLen))
+	if err != nil {
+		return nil, err
+	}
+	pad := aes.BlockSize - len(der)%aes.BlockSize
+	data := append(der, bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:       salt,
+		Iterations: pkcs12Iterations,
+		KeyLength:  keyLen,
+		PRF:        pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		Data:      data,
+	})
+}
+
+// pbkdf2SHA256 implements PBKDF2 with HMAC-SHA256 as specified in RFC 8018.
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+
+	var buf [4]byte
+	dk := make([]byte, 0, blocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf[:], uint32(block)) //nolint:gosec // no overflow
+		prf.Write(buf[:])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+
+		for range iterations - 1 {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range u {
+				t[i] ^= u[i]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
+
+// pkcs12MacKey derives the MAC key with SHA-256 as specified in RFC 7292 appendix B.2.
+// The key length equals the hash size, so a single round of the derivation is enough.
+func pkcs12MacKey(password string, salt []byte, iterations int) []byte {
+	const (
+		v  = 64 // SHA-256 block size
+		id = 3  // MAC key material
+	)
+
+	// The password is a BMPString with two trailing zero bytes.
+	var p []byte
+	for _, r := range utf16.Encode([]rune(password)) {
+		p = binary.BigEndian.AppendUint16(p, r)
+	}
+	p = append(p, 0, 0)
+
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+
+	h := sha256.New()
+	h.Write(bytes.Repeat([]byte{id}, v))
+	h.Write(fill(salt))
+	h.Write(fill(p))
+	a := h.Sum(nil)
+	for range iterations - 1 {
+		h.Reset()
+		h.Write(a)
+		a = h.Sum(a[:0])
+	}
+	return a
+}
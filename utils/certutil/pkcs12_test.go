@@ -0,0 +1,117 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package certutil
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"testing"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	tests := []struct {
+		password   string
+		salt       string
+		iterations int
+		want       string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	}
+
+	for _, tc := range tests {
+		got := pbkdf2SHA256([]byte(tc.password), []byte(tc.salt), tc.iterations, len(tc.want)/2)
+		if hex.EncodeToString(got) != tc.want {
+			t.Errorf("pbkdf2SHA256(%q, %q, %d) got %x, want %s", tc.password, tc.salt, tc.iterations, got, tc.want)
+		}
+	}
+}
+
+func TestEncodePKCS12(t *testing.T) {
+	const password = "secret"
+
+	cert, err := ECDSASelfSignedCert().Gen()
+	if err != nil {
+		t.Fatalf("Gen() error %s", err)
+	}
+	b, err := EncodePKCS12(cert, password)
+	if err != nil {
+		t.Fatalf("EncodePKCS12() error %s", err)
+	}
+
+	var pfx pfxPdu
+	if _, err := asn1.Unmarshal(b, &pfx); err != nil {
+		t.Fatalf("asn1.Unmarshal() error %s", err)
+	}
+	var authSafeDER []byte
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authSafeDER); err != nil {
+		t.Fatalf("asn1.Unmarshal() error %s", err)
+	}
+
+	mac := hmac.New(sha256.New, pkcs12MacKey(password, pfx.MacData.MacSalt, pfx.MacData.Iterations))
+	mac.Write(authSafeDER)
+	if !hmac.Equal(mac.Sum(nil), pfx.MacData.Mac.Digest) {
+		t.Fatal("MAC mismatch")
+	}
+
+	var authSafe []contentInfo
+	if _, err := asn1.Unmarshal(authSafeDER, &authSafe); err != nil {
+		t.Fatalf("asn1.Unmarshal() error %s", err)
+	}
+	if len(authSafe) != 2 {
+		t.Fatalf("got %d content infos, want 2", len(authSafe))
+	}
+
+	var (
+		data []byte
+		bags []safeBag
+		key  encryptedPrivateKeyInfo
+	)
+	if _, err := asn1.Unmarshal(authSafe[1].Content.Bytes, &data); err != nil {
+		t.Fatalf("asn1.Unmarshal() error %s", err)
+	}
+	if _, err := asn1.Unmarshal(data, &bags); err != nil {
+		t.Fatalf("asn1.Unmarshal() error %s", err)
+	}
+	if _, err := asn1.Unmarshal(bags[0].Value.Bytes, &key); err != nil {
+		t.Fatalf("asn1.Unmarshal() error %s", err)
+	}
+
+	var (
+		params pbes2Params
+		kdf    pbkdf2Params
+		iv     []byte
+	)
+	if _, err := asn1.Unmarshal(key.Algorithm.Parameters.FullBytes, &params); err != nil {
+		t.Fatalf("asn1.Unmarshal() error %s", err)
+	}
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		t.Fatalf("asn1.Unmarshal() error %s", err)
+	}
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		t.Fatalf("asn1.Unmarshal() error %s", err)
+	}
+
+	block, err := aes.NewCipher(pbkdf2SHA256([]byte(password), kdf.Salt, kdf.Iterations, kdf.KeyLength))
+	if err != nil {
+		t.Fatalf("aes.NewCipher() error %s", err)
+	}
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(key.Data, key.Data)
+	priv, err := x509.ParsePKCS8PrivateKey(key.Data[:len(key.Data)-int(key.Data[len(key.Data)-1])])
+	if err != nil {
+		t.Fatalf("x509.ParsePKCS8PrivateKey() error %s", err)
+	}
+	if !priv.(interface{ Equal(crypto.PrivateKey) bool }).Equal(cert.PrivateKey) { //nolint:forcetypeassert // all private keys implement Equal
+		t.Fatal("private key mismatch")
+	}
+}
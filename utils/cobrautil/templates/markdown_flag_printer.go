@@ -36,7 +36,7 @@ func (p *MarkdownFlagPrinter) PrintHelpFlag(f *pflag.Flag) {
 	body = p.replaceHTML(body)
 	body = withMarkdownLinks(body)
 
-	fmt.Fprintf(p.out, body)
+	fmt.Fprint(p.out, body)
 	fmt.Fprintf(p.out, "\n\n")
 }
 
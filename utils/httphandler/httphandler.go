@@ -12,6 +12,9 @@ import (
 	"encoding/pem"
 	"net/http"
 	"runtime"
+	"strconv"
+
+	"github.com/saucelabs/forwarder/conntrack"
 )
 
 func SendCACert(ca *x509.Certificate) http.Handler {
@@ -22,6 +25,20 @@ func SendCACert(ca *x509.Certificate) http.Handler {
 	return SendFile("application/x-x509-ca-cert", b)
 }
 
+// SendCACerts sends the certificates returned by certs as a PEM bundle.
+func SendCACerts(certs func() []*x509.Certificate) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b []byte
+		for _, c := range certs() {
+			b = append(b, pem.EncodeToMemory(&pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: c.Raw,
+			})...)
+		}
+		SendFile("application/x-x509-ca-cert", b).ServeHTTP(w, r)
+	})
+}
+
 func SendFile(contentType string, content []byte) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", contentType)
@@ -56,3 +73,31 @@ func Version(version, time, commit string) http.Handler {
 		json.NewEncoder(w).Encode(v) //nolint // ignore error
 	})
 }
+
+// CloseIdleConnections calls c.CloseIdleConnections and responds with 200 OK.
+func CloseIdleConnections(c interface{ CloseIdleConnections() }) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.CloseIdleConnections()
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("OK"))
+	})
+}
+
+// ConnTable serves the connection table summary as JSON.
+// The number of reported destinations, clients and top talkers can be set with the top query parameter, the default is 10.
+func ConnTable(t *conntrack.Table) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := 10
+		if v := r.URL.Query().Get("top"); v != "" {
+			var err error
+			n, err = strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid top parameter", http.StatusBadRequest)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t.Summary(n)) //nolint // ignore error
+	})
+}
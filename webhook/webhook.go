@@ -0,0 +1,305 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package webhook sends notifications about notable proxy events to HTTP endpoints.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/saucelabs/forwarder/log"
+)
+
+// Event types.
+const (
+	UpstreamProxyDown = "upstream_proxy_down"
+	MITMCAExpiring    = "mitm_ca_expiring"
+	RateLimitExceeded = "rate_limit_exceeded"
+	ErrorRateExceeded = "error_rate_exceeded"
+)
+
+// EventTypes lists all event types.
+var EventTypes = []string{
+	UpstreamProxyDown,
+	MITMCAExpiring,
+	RateLimitExceeded,
+	ErrorRateExceeded,
+}
+
+// Event is a notable proxy event.
+// Subject identifies the affected entity e.g. the upstream proxy or the client,
+// events of the same type and subject are subject to Config.Cooldown.
+type Event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source,omitempty"`
+	Subject string    `json:"subject,omitempty"`
+	Message string    `json:"message"`
+}
+
+// SignatureHeader contains the HMAC-SHA256 signature of the request if Config.Secret is set.
+// The format is t=<unix timestamp>,sha256=<hex signature> where the signature is computed over "<unix timestamp>.<body>".
+const SignatureHeader = "X-Forwarder-Signature"
+
+// ParseTemplate parses a text/template used to render the request body.
+// The template is executed with Event, the json function can be used to quote strings.
+func ParseTemplate(val string) (*template.Template, error) {
+	return template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(val)
+}
+
+type Config struct {
+	// URLs are the endpoints that receive POST requests for every event.
+	URLs []*url.URL
+
+	// Template renders the request body, if nil the event is sent as JSON.
+	Template *template.Template
+
+	// Secret, if set, is used to sign requests, see SignatureHeader.
+	Secret string
+
+	// Events lists event types to send, if empty all events are sent.
+	Events []string
+
+	// Source is added to all events, it is typically the proxy name.
+	Source string
+
+	// Cooldown is the minimum time between events of the same type and subject, events within the cooldown are dropped.
+	Cooldown time.Duration
+
+	// Retries is the number of retries if the endpoint fails or responds with 5xx or 429 status code.
+	Retries int
+
+	// RetryInterval is the time before the first retry, it doubles with every retry.
+	RetryInterval time.Duration
+
+	Timeout time.Duration
+
+	Transport http.RoundTripper
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Source:        "forwarder",
+		Cooldown:      10 * time.Minute,
+		Retries:       3,
+		RetryInterval: time.Second,
+		Timeout:       10 * time.Second,
+	}
+}
+
+func (c *Config) Validate() error {
+	if len(c.URLs) == 0 {
+		return errors.New("at least one URL is required")
+	}
+	for _, u := range c.URLs {
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("unsupported URL scheme %q, expected http or https", u.Scheme)
+		}
+	}
+	for _, e := range c.Events {
+		if !slices.Contains(EventTypes, e) {
+			return fmt.Errorf("unknown event type %q", e)
+		}
+	}
+	if c.Retries < 0 {
+		return errors.New("retries must be non-negative")
+	}
+	return nil
+}
+
+// queueSize is the number of events waiting to be sent, if the queue is full new events are dropped.
+const queueSize = 128
+
+// Notifier sends events to webhooks.
+// Notify is non-blocking, events are sent by Run.
+type Notifier struct {
+	cfg    Config
+	log    log.Logger
+	client *http.Client
+	queue  chan Event
+
+	mu   sync.Mutex
+	last map[string]time.Time
+	now  func() time.Time
+}
+
+func New(cfg *Config, log log.Logger) *Notifier {
+	return &Notifier{
+		cfg: *cfg,
+		log: log,
+		client: &http.Client{
+			Transport: cfg.Transport,
+			Timeout:   cfg.Timeout,
+		},
+		queue: make(chan Event, queueSize),
+		last:  make(map[string]time.Time),
+		now:   time.Now,
+	}
+}
+
+// Notify queues the event unless it is filtered out or within the cooldown.
+func (n *Notifier) Notify(e Event) {
+	if len(n.cfg.Events) > 0 && !slices.Contains(n.cfg.Events, e.Type) {
+		return
+	}
+
+	now := n.now()
+	if e.Time.IsZero() {
+		e.Time = now.UTC()
+	}
+	if e.Source == "" {
+		e.Source = n.cfg.Source
+	}
+
+	n.mu.Lock()
+	k := e.Type + "\x00" + e.Subject
+	if t, ok := n.last[k]; ok && now.Sub(t) < n.cfg.Cooldown {
+		n.mu.Unlock()
+		return
+	}
+	n.last[k] = now
+	n.mu.Unlock()
+
+	select {
+	case n.queue <- e:
+	default:
+		n.log.Errorf("queue full, dropping event type=%s subject=%s", e.Type, e.Subject)
+	}
+}
+
+// Run sends queued events until ctx is done.
+func (n *Notifier) Run(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case e := <-n.queue:
+			body, err := n.render(e)
+			if err != nil {
+				n.log.Errorf("render event type=%s: %s", e.Type, err)
+				continue
+			}
+			for _, u := range n.cfg.URLs {
+				if err := n.send(ctx, u, body); err != nil {
+					n.log.Errorf("send event type=%s url=%s: %s", e.Type, u.Redacted(), err)
+				}
+			}
+		}
+	}
+}
+
+func (n *Notifier) render(e Event) ([]byte, error) {
+	if n.cfg.Template == nil {
+		return json.Marshal(e)
+	}
+
+	var buf bytes.Buffer
+	if err := n.cfg.Template.Execute(&buf, e); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (n *Notifier) send(ctx context.Context, u *url.URL, body []byte) error {
+	wait := n.cfg.RetryInterval
+	for i := 0; ; i++ {
+		retry, err := n.post(ctx, u, body)
+		if err == nil || !retry || i >= n.cfg.Retries {
+			return err
+		}
+
+		n.log.Debugf("send to %s failed, retrying in %s: %s", u.Redacted(), wait, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+func (n *Notifier) post(ctx context.Context, u *url.URL, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.cfg.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(n.cfg.Secret, n.now(), body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return false, nil
+}
+
+// Sign returns the SignatureHeader value for the body sent at time t.
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "t=" + ts + ",sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// certCheckInterval is the interval of certificate expiry checks in WatchCertExpiry.
+const certCheckInterval = time.Hour
+
+// WatchCertExpiry sends MITMCAExpiring event when the certificate returned by certFn expires in less than warn,
+// it checks the certificate every hour until ctx is done.
+func (n *Notifier) WatchCertExpiry(ctx context.Context, certFn func() *x509.Certificate, warn time.Duration) error {
+	t := time.NewTicker(certCheckInterval)
+	defer t.Stop()
+
+	for {
+		cert := certFn()
+		if left := cert.NotAfter.Sub(n.now()); left < warn {
+			n.Notify(Event{
+				Type:    MITMCAExpiring,
+				Subject: cert.Subject.String(),
+				Message: fmt.Sprintf("MITM CA certificate %q expires at %s", cert.Subject, cert.NotAfter.UTC().Format(time.RFC3339)),
+			})
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
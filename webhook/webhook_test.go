@@ -0,0 +1,176 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package webhook
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+type received struct {
+	body      []byte
+	signature string
+}
+
+func newReceiver(t *testing.T, failures int32) (*url.URL, <-chan received) {
+	t.Helper()
+
+	ch := make(chan received, 10)
+	var calls atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		ch <- received{body: b, signature: r.Header.Get(SignatureHeader)}
+	}))
+	t.Cleanup(s.Close)
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u, ch
+}
+
+func startNotifier(t *testing.T, cfg *Config) *Notifier {
+	t.Helper()
+
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	n := New(cfg, stdlog.Default())
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go n.Run(ctx)
+
+	return n
+}
+
+func receive(t *testing.T, ch <-chan received) received {
+	t.Helper()
+
+	select {
+	case r := <-ch:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for webhook")
+	}
+	return received{}
+}
+
+func TestNotifierSignedJSON(t *testing.T) {
+	u, ch := newReceiver(t, 1)
+
+	cfg := DefaultConfig()
+	cfg.URLs = []*url.URL{u}
+	cfg.Secret = "secret"
+	cfg.RetryInterval = 10 * time.Millisecond
+	n := startNotifier(t, cfg)
+
+	n.Notify(Event{Type: UpstreamProxyDown, Subject: "proxy:3128", Message: "down"})
+	r := receive(t, ch)
+
+	var e Event
+	if err := json.Unmarshal(r.body, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != UpstreamProxyDown || e.Subject != "proxy:3128" || e.Source != "forwarder" || e.Time.IsZero() {
+		t.Fatalf("unexpected event: %+v", e)
+	}
+
+	tv, _, _ := strings.Cut(strings.TrimPrefix(r.signature, "t="), ",")
+	ts, err := strconv.ParseInt(tv, 10, 64)
+	if err != nil {
+		t.Fatalf("invalid signature %q: %v", r.signature, err)
+	}
+	if want := Sign("secret", time.Unix(ts, 0), r.body); r.signature != want {
+		t.Fatalf("signature mismatch: got %q, want %q", r.signature, want)
+	}
+}
+
+func TestNotifierTemplateAndFilter(t *testing.T) {
+	u, ch := newReceiver(t, 0)
+
+	tmpl, err := ParseTemplate(`{"text": {{json .Message}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.URLs = []*url.URL{u}
+	cfg.Template = tmpl
+	cfg.Events = []string{ErrorRateExceeded}
+	n := startNotifier(t, cfg)
+
+	n.Notify(Event{Type: RateLimitExceeded, Message: "filtered"})
+	n.Notify(Event{Type: ErrorRateExceeded, Message: `too "many" errors`})
+
+	r := receive(t, ch)
+	if got, want := string(r.body), `{"text": "too \"many\" errors"}`; got != want {
+		t.Fatalf("got body %s, want %s", got, want)
+	}
+	if r.signature != "" {
+		t.Fatalf("unexpected signature %q", r.signature)
+	}
+}
+
+func TestNotifierCooldown(t *testing.T) {
+	now := time.Unix(1000, 0)
+	n := New(&Config{Cooldown: time.Minute}, stdlog.Default())
+	n.now = func() time.Time { return now }
+
+	n.Notify(Event{Type: RateLimitExceeded, Subject: "a"})
+	n.Notify(Event{Type: RateLimitExceeded, Subject: "a"})
+	n.Notify(Event{Type: RateLimitExceeded, Subject: "b"})
+	if got := len(n.queue); got != 2 {
+		t.Fatalf("expected 2 queued events, got %d", got)
+	}
+
+	now = now.Add(time.Minute)
+	n.Notify(Event{Type: RateLimitExceeded, Subject: "a"})
+	if got := len(n.queue); got != 3 {
+		t.Fatalf("expected 3 queued events after cooldown, got %d", got)
+	}
+}
+
+func TestWatchCertExpiry(t *testing.T) {
+	n := New(&Config{}, stdlog.Default())
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "ca"},
+		NotAfter: time.Now().Add(24 * time.Hour),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	n.WatchCertExpiry(ctx, func() *x509.Certificate { return cert }, time.Hour)
+	if got := len(n.queue); got != 0 {
+		t.Fatalf("expected no events, got %d", got)
+	}
+
+	n.WatchCertExpiry(ctx, func() *x509.Certificate { return cert }, 48*time.Hour)
+	if got := len(n.queue); got != 1 {
+		t.Fatalf("expected 1 event, got %d", got)
+	}
+	if e := <-n.queue; e.Type != MITMCAExpiring {
+		t.Fatalf("unexpected event type %s", e.Type)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/saucelabs/forwarder/dialvia"
+	"github.com/saucelabs/forwarder/log"
+)
+
+// WSTunnelPath is the path of the WebSocket tunnel endpoint.
+const WSTunnelPath = "/tunnel"
+
+// WSTunnel accepts proxy connections tunneled over WebSocket.
+// It is an http.Handler that upgrades requests to WebSocket,
+// and a net.Listener that returns the upgraded connections.
+// Set it as ListenerConfig.Listener of a proxy listener to serve the proxy protocol inside the tunnel,
+// clients can connect to it using dialvia.WebSocket.
+type WSTunnel struct {
+	upgrader websocket.Upgrader
+	log      log.Logger
+	conns    chan net.Conn
+	done     chan struct{}
+	once     sync.Once
+}
+
+func NewWSTunnel(log log.Logger) *WSTunnel {
+	return &WSTunnel{
+		upgrader: websocket.Upgrader{
+			// Clients are not browsers, the tunnel is protected by the server basic auth.
+			CheckOrigin: func(*http.Request) bool { return true },
+		},
+		log:   log,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (t *WSTunnel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != WSTunnelPath {
+		http.NotFound(w, r)
+		return
+	}
+
+	c, err := t.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade replies to the client with an error.
+		t.log.Debugf("WebSocket tunnel upgrade failed client=%s error=%s", r.RemoteAddr, err)
+		return
+	}
+	conn := dialvia.NewWebSocketConn(c)
+
+	select {
+	case t.conns <- conn:
+		t.log.Debugf("WebSocket tunnel opened client=%s", r.RemoteAddr)
+	case <-t.done:
+		conn.Close()
+	case <-r.Context().Done():
+		conn.Close()
+	}
+}
+
+func (t *WSTunnel) Accept() (net.Conn, error) {
+	select {
+	case c := <-t.conns:
+		return c, nil
+	case <-t.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (t *WSTunnel) Close() error {
+	t.once.Do(func() {
+		close(t.done)
+	})
+	return nil
+}
+
+func (t *WSTunnel) Addr() net.Addr {
+	return memAddr("ws-tunnel")
+}
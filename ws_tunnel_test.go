@@ -0,0 +1,75 @@
+// Copyright 2022-2024 Sauce Labs Inc., all rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/saucelabs/forwarder/dialvia"
+	"github.com/saucelabs/forwarder/log"
+)
+
+func TestWSTunnel(t *testing.T) {
+	wst := NewWSTunnel(log.NopLogger)
+	l := Listener{
+		ListenerConfig: ListenerConfig{
+			Listener: wst,
+		},
+		PromConfig: PromConfig{
+			PromRegistry: prometheus.NewRegistry(),
+		},
+	}
+	if err := l.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go l.acceptAndCopy()
+
+	s := httptest.NewServer(wst)
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("echo", func(t *testing.T) {
+		d := dialvia.WebSocket((&net.Dialer{}).DialContext, &url.URL{Scheme: "ws", Host: u.Host, Path: WSTunnelPath}, nil)
+		conn, err := d.DialContext(context.Background(), "tcp", "proxy:3128")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		for i := range 3 {
+			want := fmt.Sprintf("Hello, World %d!\n", i)
+			fmt.Fprint(conn, want)
+			buf := make([]byte, len(want))
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(buf); got != want {
+				t.Fatalf("conn.Read(): got %q, want %q", got, want)
+			}
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		d := dialvia.WebSocket((&net.Dialer{}).DialContext, &url.URL{Scheme: "ws", Host: u.Host, Path: "/foo"}, nil)
+		if _, err := d.DialContext(context.Background(), "tcp", "proxy:3128"); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}